@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sessionCookie is the cookie the web server reads session tokens from
+const sessionCookie = "session_token"
+
+// apiClient calls the web API of a running instance, for the subcommands
+// that control one remotely
+type apiClient struct {
+	url      string
+	user     string
+	password string
+	token    string
+	http     *http.Client
+}
+
+// apiFlags registers the flags selecting and authenticating to an instance
+func apiFlags(fs *flag.FlagSet) *apiClient {
+	c := &apiClient{http: &http.Client{}}
+	fs.StringVar(&c.url, "url", "http://127.0.0.1:18080", "web UI address of the running instance")
+	fs.StringVar(&c.user, "user", "", "username for Basic Authentication")
+	fs.StringVar(&c.password, "password", "", "password for Basic Authentication")
+	fs.StringVar(&c.token, "token", "", "session token (the session_token cookie set by /api/login), instead of --user and --password")
+	fs.DurationVar(&c.http.Timeout, "timeout", 10*time.Second, "request timeout")
+	return c
+}
+
+// do sends body as JSON, unless it is nil, and decodes a JSON response into
+// out, unless it is nil. A non-2xx status is returned as an error carrying
+// the response text.
+func (c *apiClient) do(method, path string, body, out any) error {
+	var rd io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(c.url, "/")+path, rd)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	c.authorize(req.Header)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// authorize adds the session token or Basic Authentication credentials
+func (c *apiClient) authorize(h http.Header) {
+	if c.token != "" {
+		h.Set("Cookie", (&http.Cookie{Name: sessionCookie, Value: c.token}).String())
+	} else if c.user != "" {
+		h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(c.user+":"+c.password)))
+	}
+}
+
+// dialWebSocket opens the /api/ws event socket
+func (c *apiClient) dialWebSocket() (*websocket.Conn, error) {
+	u, err := url.Parse(strings.TrimRight(c.url, "/") + "/api/ws")
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+
+	h := http.Header{}
+	c.authorize(h)
+	dialer := websocket.Dialer{HandshakeTimeout: c.http.Timeout, Proxy: http.ProxyFromEnvironment}
+	conn, resp, err := dialer.Dial(u.String(), h)
+	if err != nil && resp != nil {
+		return nil, fmt.Errorf("%w: %s", err, resp.Status)
+	}
+	return conn, err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/bench"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/proxy"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/simulator"
+)
+
+// runBench drives packets through a proxy with an echoing upstream and
+// prints throughput and latency
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	addr := fs.String("addr", "127.0.0.1:18899", "proxy address to connect to")
+	local := fs.Bool("local", false, "start an in-process echo upstream and proxy instead of using --addr")
+	size := fs.Int("size", 32, "bytes per packet")
+	rate := fs.Int("rate", 0, "packets per second (0 = as fast as the window allows)")
+	count := fs.Int("count", 0, "packets to send (0 = run for --duration)")
+	duration := fs.Duration("duration", 10*time.Second, "run time when --count is 0")
+	window := fs.Int("window", 64, "maximum packets in flight")
+	timeout := fs.Duration("timeout", 2*time.Second, "wait for outstanding echoes")
+	jsonOut := fs.Bool("json", false, "print the result as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: serial-tcp-proxy bench [--addr host:port | --local] [options]\n\n")
+		fmt.Fprintf(fs.Output(), "The upstream behind the proxy must echo every byte, e.g. \"serial-tcp-proxy mock\".\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	opts := bench.Options{
+		Addr:     *addr,
+		Size:     *size,
+		Rate:     *rate,
+		Count:    *count,
+		Duration: *duration,
+		Window:   *window,
+		Timeout:  *timeout,
+	}
+
+	if *local {
+		proxyAddr, stop, err := startLocalBench()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to start local setup: %v\n", err)
+			return 1
+		}
+		defer stop()
+		opts.Addr = proxyAddr
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	result, err := bench.Run(ctx, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Benchmark failed: %v\n", err)
+		return 1
+	}
+
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(result)
+	} else {
+		result.Report(os.Stdout)
+	}
+	if result.Dropped > 0 || result.Corrupt > 0 {
+		return 3
+	}
+	return 0
+}
+
+// startLocalBench runs an echo mock upstream and a proxy on loopback ports
+func startLocalBench() (string, func(), error) {
+	log, _ := logger.New(false, "")
+	log.SetOutput(io.Discard)
+
+	mock := simulator.NewServer("127.0.0.1:0", simulator.EchoScript(), log)
+	if err := mock.Start(); err != nil {
+		return "", nil, err
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		mock.Stop()
+		return "", nil, err
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	cfg := &config.Config{
+		UpstreamType: config.UpstreamTypeTCP,
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: mock.Addr().(*net.TCPAddr).Port,
+		UpstreamName: "primary",
+		ListenPort:   port,
+		MaxClients:   10,
+	}
+	server := proxy.NewServer(cfg, log)
+	if err := server.Start(context.Background()); err != nil {
+		_ = server.Stop(context.Background())
+		mock.Stop()
+		return "", nil, err
+	}
+
+	// Wait for the proxy to reach the mock
+	for i := 0; i < 100 && !server.IsUpstreamConnected(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stop := func() {
+		_ = server.Stop(context.Background())
+		mock.Stop()
+	}
+	return fmt.Sprintf("127.0.0.1:%d", port), stop, nil
+}
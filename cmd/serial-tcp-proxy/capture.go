@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/hexutil"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/pcapng"
+)
+
+// runCapture records the packets of a running instance to a pcapng file
+func runCapture(args []string) int {
+	fs := flag.NewFlagSet("capture", flag.ContinueOnError)
+	api := apiFlags(fs)
+	out := fs.String("out", "", "pcapng file to write (required)")
+	duration := fs.Duration("duration", 0, "stop after this long (0 = until interrupted)")
+	count := fs.Int("count", 0, "stop after this many packets (0 = no limit)")
+	directions := fs.String("direction", "", "comma-separated packet directions: from_upstream, to_upstream")
+	sources := fs.String("source", "", `comma-separated packet sources, e.g. "client#*,INJECT"`)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: serial-tcp-proxy capture [--url http://host:18080] --out file.pcapng [--duration 5m] [options]\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *out == "" {
+		fs.Usage()
+		return 2
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create %s: %v\n", *out, err)
+		return 1
+	}
+	defer f.Close()
+	buf := bufio.NewWriter(f)
+	w, err := pcapng.NewWriter(buf, pcapng.LinkTypeUser0, "serial-tcp-proxy")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write %s: %v\n", *out, err)
+		return 1
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	sub := logSubscription{
+		Types:       []string{"log"},
+		Directions:  splitList(*directions),
+		Sources:     splitList(*sources),
+		PacketsOnly: true,
+	}
+	written := 0
+	var writeErr error
+	err = followLog(ctx, api, sub, func(line string) {
+		p, ok := parsePacket(line)
+		if !ok || writeErr != nil || (*count > 0 && written >= *count) {
+			return
+		}
+		if writeErr = w.WritePacket(p.at, p.data, p.dir, p.comment); writeErr != nil {
+			cancel()
+			return
+		}
+		written++
+		if *count > 0 && written >= *count {
+			cancel()
+		}
+	})
+	if flushErr := buf.Flush(); writeErr == nil {
+		writeErr = flushErr
+	}
+
+	fmt.Fprintf(os.Stderr, "%d packets written to %s\n", written, *out)
+	if writeErr != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write %s: %v\n", *out, writeErr)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// capturedPacket is a packet recovered from a packet log line
+type capturedPacket struct {
+	at      time.Time
+	data    []byte
+	dir     pcapng.Direction
+	comment string // direction label and source, e.g. "->UP from client#1"
+}
+
+// parsePacket recovers a packet from a line such as
+// "2025-11-28T00:00:00.123456789Z [PKT] [->UP] f7 0e 11 (3 bytes) from client#1"
+func parsePacket(line string) (capturedPacket, bool) {
+	direction, source, ok := logger.ParsePacketLine(line)
+	if !ok {
+		return capturedPacket{}, false
+	}
+	stamp, _, _ := strings.Cut(line, " ")
+	at, err := time.Parse(time.RFC3339Nano, stamp)
+	if err != nil {
+		return capturedPacket{}, false
+	}
+	_, rest, _ := strings.Cut(line, "["+direction+"] ")
+	hexStr, _, found := strings.Cut(rest, " (")
+	if !found {
+		return capturedPacket{}, false
+	}
+	data, err := hexutil.Parse(hexStr)
+	if err != nil {
+		return capturedPacket{}, false
+	}
+
+	p := capturedPacket{at: at, data: data, comment: direction}
+	if strings.HasPrefix(direction, "->") {
+		p.dir = pcapng.Outbound
+	} else {
+		p.dir = pcapng.Inbound
+	}
+	if source != "" {
+		p.comment += " from " + source
+	}
+	return p, true
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/pcapng"
+)
+
+func TestParsePacket(t *testing.T) {
+	p, ok := parsePacket(testPacketUp)
+	if !ok {
+		t.Fatal("Expected the packet line to parse")
+	}
+	want := time.Date(2025, 11, 28, 0, 0, 0, 123456789, time.UTC)
+	if !p.at.Equal(want) || !bytes.Equal(p.data, []byte{0xf7, 0x0e, 0x11}) || p.dir != pcapng.Outbound || p.comment != "->UP from client#1" {
+		t.Errorf("Unexpected packet: %+v", p)
+	}
+
+	p, ok = parsePacket(testPacketDown)
+	if !ok || p.dir != pcapng.Inbound || p.comment != "UP->" {
+		t.Errorf("Expected an inbound packet without source, got %+v", p)
+	}
+
+	for _, line := range []string{
+		testInfoLine,
+		"yesterday [PKT] [->UP] f7 (1 bytes)",
+		"2025-11-28T00:00:00Z [PKT] [->UP] f7 zz (2 bytes)",
+		"2025-11-28T00:00:00Z [PKT] [->UP] f7",
+	} {
+		if _, ok := parsePacket(line); ok {
+			t.Errorf("Expected %q not to parse", line)
+		}
+	}
+}
+
+func TestRunCapture(t *testing.T) {
+	srv := newLogServer(t, "", []string{testPacketUp, testInfoLine, testPacketDown, testPacketUp})
+	out := filepath.Join(t.TempDir(), "capture.pcapng")
+
+	if code := runCapture([]string{"--url", srv.URL, "--out", out, "--count", "2"}); code != 0 {
+		t.Fatalf("Expected exit code 0 once the count is reached, got %d", code)
+	}
+	if sub := <-srv.sub; !sub.PacketsOnly {
+		t.Error("Expected capture to subscribe to packets only")
+	}
+
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatalf("Failed to open capture: %v", err)
+	}
+	defer f.Close()
+	packets, err := pcapng.ReadPackets(f)
+	if err != nil {
+		t.Fatalf("Failed to read capture: %v", err)
+	}
+	if len(packets) != 2 {
+		t.Fatalf("Expected 2 packets, got %d", len(packets))
+	}
+	if !bytes.Equal(packets[0].Data, []byte{0xf7, 0x0e, 0x11}) || packets[0].Comment != "->UP from client#1" {
+		t.Errorf("Unexpected first packet: %+v", packets[0])
+	}
+	if !bytes.Equal(packets[1].Data, []byte{0xf7, 0x0e, 0x91, 0x41}) || packets[1].Direction != pcapng.Inbound {
+		t.Errorf("Unexpected second packet: %+v", packets[1])
+	}
+}
+
+func TestRunCapture_ExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	for name, args := range map[string][]string{
+		"no output file": {},
+		"unknown flag":   {"--out", filepath.Join(dir, "x.pcapng"), "--bogus"},
+	} {
+		if code := runCapture(args); code != 2 {
+			t.Errorf("%s: expected exit code 2, got %d", name, code)
+		}
+	}
+
+	if code := runCapture([]string{"--out", filepath.Join(dir, "missing", "x.pcapng")}); code != 1 {
+		t.Errorf("Expected exit code 1 when the file cannot be created, got %d", code)
+	}
+
+	// The connection dropping before the count is reached is an error, but
+	// what was captured is kept
+	srv := newLogServer(t, "", []string{testPacketUp})
+	out := filepath.Join(dir, "partial.pcapng")
+	if code := runCapture([]string{"--url", srv.URL, "--out", out, "--count", "5"}); code != 1 {
+		t.Errorf("Expected exit code 1 when the connection is lost, got %d", code)
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatalf("Failed to open capture: %v", err)
+	}
+	defer f.Close()
+	if packets, err := pcapng.ReadPackets(f); err != nil || len(packets) != 1 {
+		t.Errorf("Expected the packet captured before the loss, got %d, %v", len(packets), err)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/web"
+)
+
+// injectServer records the inject requests it receives and answers with
+// status
+type injectServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []web.InjectRequest
+	headers  []http.Header
+}
+
+func newInjectServer(t *testing.T, status int) *injectServer {
+	t.Helper()
+	s := &injectServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/inject" {
+			http.NotFound(w, r)
+			return
+		}
+		var req web.InjectRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, req)
+		s.headers = append(s.headers, r.Header.Clone())
+		s.mu.Unlock()
+		if status != http.StatusOK {
+			http.Error(w, "injection is disabled", status)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *injectServer) received() ([]web.InjectRequest, []http.Header) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests, s.headers
+}
+
+func TestRunInject(t *testing.T) {
+	srv := newInjectServer(t, http.StatusOK)
+
+	code := runInject([]string{"--url", srv.URL, "--user", "admin", "--password", "secret", "--hex", "f7 0e 11"})
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+	code = runInject([]string{"--url", srv.URL + "/", "--token", "abc", "--client", "client#3", "--ascii", "hi"})
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+
+	reqs, headers := srv.received()
+	if len(reqs) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(reqs))
+	}
+	if r := reqs[0]; r.Target != "upstream" || r.Format != "hex" || r.Data != "f7 0e 11" || r.Template {
+		t.Errorf("Unexpected hex request: %+v", r)
+	}
+	if user, pass, ok := (&http.Request{Header: headers[0]}).BasicAuth(); !ok || user != "admin" || pass != "secret" {
+		t.Errorf("Expected Basic Authentication as admin, got %q", headers[0].Get("Authorization"))
+	}
+	if r := reqs[1]; r.Target != "downstream" || r.ClientID != "client#3" || r.Format != "ascii" || r.Data != "hi" {
+		t.Errorf("Expected an ascii packet to client#3, got %+v", r)
+	}
+	if cookie := headers[1].Get("Cookie"); cookie != sessionCookie+"=abc" {
+		t.Errorf("Expected the session cookie, got %q", cookie)
+	}
+}
+
+func TestRunInject_Template(t *testing.T) {
+	srv := newInjectServer(t, http.StatusOK)
+
+	// Placeholders are left to the server, so the hex is not checked here
+	code := runInject([]string{"--url", srv.URL, "--template", "--var", "addr=0x11", "--hex", "f7 {{addr}}"})
+	if code != 0 {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+	reqs, _ := srv.received()
+	if len(reqs) != 1 || !reqs[0].Template || reqs[0].Vars["addr"] != "0x11" {
+		t.Errorf("Expected a template request with addr=0x11, got %+v", reqs)
+	}
+}
+
+func TestRunInject_UsageErrors(t *testing.T) {
+	srv := newInjectServer(t, http.StatusOK)
+
+	for name, args := range map[string][]string{
+		"no packet":         {},
+		"hex and ascii":     {"--hex", "f7", "--ascii", "x"},
+		"invalid hex":       {"--hex", "f7 zz"},
+		"var sans template": {"--var", "addr=1", "--hex", "f7"},
+		"malformed var":     {"--template", "--var", "addr", "--hex", "f7"},
+		"unknown flag":      {"--bogus"},
+	} {
+		if code := runInject(append([]string{"--url", srv.URL}, args...)); code != 2 {
+			t.Errorf("%s: expected exit code 2, got %d", name, code)
+		}
+	}
+	if reqs, _ := srv.received(); len(reqs) != 0 {
+		t.Errorf("Expected nothing to be sent for usage errors, got %+v", reqs)
+	}
+}
+
+func TestRunInject_Rejected(t *testing.T) {
+	srv := newInjectServer(t, http.StatusForbidden)
+
+	if code := runInject([]string{"--url", srv.URL, "--hex", "f7"}); code != 1 {
+		t.Errorf("Expected exit code 1 for a rejected injection, got %d", code)
+	}
+
+	srv.Close()
+	if code := runInject([]string{"--url", srv.URL, "--hex", "f7"}); code != 1 {
+		t.Errorf("Expected exit code 1 for an unreachable instance, got %d", code)
+	}
+}
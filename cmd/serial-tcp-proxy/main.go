@@ -1,19 +1,48 @@
 package main
 
 import (
+	"context"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/hoon-ch/serial-tcp-proxy/internal/buildinfo"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/exporter"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/proxy"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/retention"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/storage"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/web"
 )
 
-var Version = "dev"
+// version and buildDate are set at build time with
+// -ldflags "-X main.version=... -X main.buildDate=..."
+var (
+	version   = "dev"
+	buildDate = ""
+)
 
 func main() {
+	// Subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "mock":
+			os.Exit(runMock(os.Args[2:]))
+		case "bench":
+			os.Exit(runBench(os.Args[2:]))
+		case "inject":
+			os.Exit(runInject(os.Args[2:]))
+		case "tail":
+			os.Exit(runTail(os.Args[2:]))
+		case "term":
+			os.Exit(runTerm(os.Args[2:]))
+		case "capture":
+			os.Exit(runCapture(os.Args[2:]))
+		}
+	}
+
 	// Load configuration
 	cfg, err := config.Load()
 	if err != nil {
@@ -27,39 +56,106 @@ func main() {
 		println("Logger error:", err.Error())
 		os.Exit(1)
 	}
+	log.SetPacketFilter(cfg.PacketLogFilter())
+	log.SetPacketDeltas(cfg.LogDeltas)
+	log.SetPacketOffsets(cfg.LogOffsets)
 
-	// Set version for web package
-	web.SetVersion(Version)
-
-	log.Info("Starting Serial TCP Proxy v%s", Version)
+	build := buildinfo.Read(version)
+	if buildDate != "" {
+		build.BuildDate = buildDate
+	}
+	log.Info("Starting Serial TCP Proxy v%s", build)
 	log.Info("Upstream: %s", cfg.UpstreamAddr())
 	log.Info("Listen: %s", cfg.ListenAddr())
 	log.Info("Max clients: %d", cfg.MaxClients)
 	log.Info("Packet logging: %v", cfg.LogPackets)
+	if cfg.LogPackets && (len(cfg.LogDirections) > 0 || len(cfg.LogSources) > 0) {
+		log.Info("Packet log filter: directions %v, sources %v", cfg.LogDirections, cfg.LogSources)
+	}
 
-	// Create and start proxy server
+	// Create proxy server
 	server := proxy.NewServer(cfg, log)
-
-	if err := server.Start(); err != nil {
-		log.Error("Failed to start proxy: %v", err)
+	store, err := storage.Open(cfg)
+	if err != nil {
+		log.Error("Failed to open storage: %v", err)
 		os.Exit(1)
 	}
+	server.SetStorage(store)
+	if cfg.StorageBackend == config.StorageSQLite {
+		log.Info("Storage: %s", cfg.StoragePath)
+	}
 
-	// Start Web UI
+	// Cancelled by SIGINT or SIGTERM, which also cuts WAIT_FOR_UPSTREAM short
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Keeps the files under /data within RETENTION_MAX_MB and
+	// RETENTION_MAX_AGE_DAYS
+	keeper := retention.New(cfg, log, store)
+	keeper.Start()
+
+	// Start Web UI first so health reports "starting" during WAIT_FOR_UPSTREAM
 	webServer := web.NewServer(cfg, server, log)
-	if err := webServer.Start(); err != nil {
+	webServer.SetBuildInfo(build)
+	webServer.SetRetention(keeper)
+	if err := webServer.Start(ctx); err != nil {
 		log.Error("Failed to start web server: %v", err)
 		// Don't exit, just log error
 	}
 
-	// Wait for shutdown signal
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	if err := server.Start(ctx); err != nil {
+		log.Error("Failed to start proxy: %v", err)
+		_ = server.Stop(context.Background())
+		os.Exit(1)
+	}
+
+	// Start optional metrics exporters
+	var influx *exporter.Influx
+	if cfg.InfluxURL != "" {
+		tags, _ := cfg.InfluxTagMap()
+		influx = exporter.NewInflux(exporter.InfluxConfig{
+			URL:      cfg.InfluxURL,
+			Database: cfg.InfluxDatabase,
+			Org:      cfg.InfluxOrg,
+			Bucket:   cfg.InfluxBucket,
+			Token:    cfg.InfluxToken,
+			Interval: time.Duration(cfg.InfluxInterval) * time.Second,
+			Tags:     tags,
+		}, server.GetMetrics, log)
+		influx.Start()
+	}
+
+	var statsd *exporter.Statsd
+	if cfg.StatsdAddr != "" {
+		statsd, err = exporter.NewStatsd(exporter.StatsdConfig{
+			Addr:     cfg.StatsdAddr,
+			Prefix:   cfg.StatsdPrefix,
+			Interval: time.Duration(cfg.StatsdInterval) * time.Second,
+		}, server.GetMetrics, log)
+		if err != nil {
+			log.Error("Failed to start statsd exporter: %v", err)
+		} else {
+			statsd.Start()
+		}
+	}
 
-	sig := <-sigCh
-	log.Info("Received signal %v, shutting down...", sig)
+	// Wait for shutdown signal
+	<-ctx.Done()
+	stop()
+	log.Info("Received signal, shutting down...")
 
 	// Graceful shutdown
-	webServer.Stop()
-	server.Stop()
+	if influx != nil {
+		influx.Stop()
+	}
+	if statsd != nil {
+		statsd.Stop()
+	}
+	keeper.Stop()
+	if err := webServer.Stop(context.Background()); err != nil {
+		log.Error("Web server shutdown error: %v", err)
+	}
+	if err := server.Stop(context.Background()); err != nil {
+		log.Error("Proxy shutdown error: %v", err)
+	}
 }
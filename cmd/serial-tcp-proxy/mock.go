@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/simulator"
+)
+
+// runMock runs a scripted mock upstream until interrupted
+func runMock(args []string) int {
+	fs := flag.NewFlagSet("mock", flag.ContinueOnError)
+	host := fs.String("host", "", "address to listen on (default all interfaces)")
+	port := fs.Int("port", 8899, "TCP port to listen on")
+	script := fs.String("script", "", "YAML script with rules and periodic frames (default: echo)")
+	verbose := fs.Bool("v", false, "log every frame")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: serial-tcp-proxy mock [--port 8899] [--script responses.yaml]\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	sc := simulator.EchoScript()
+	if *script != "" {
+		loaded, err := simulator.LoadScript(*script)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Script error: %v\n", err)
+			return 1
+		}
+		sc = loaded
+	}
+
+	log, err := logger.New(*verbose, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Logger error: %v\n", err)
+		return 1
+	}
+	defer log.Close()
+
+	server := simulator.NewServer(fmt.Sprintf("%s:%d", *host, *port), sc, log)
+	if err := server.Start(); err != nil {
+		log.Error("Failed to start mock upstream: %v", err)
+		return 1
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+
+	server.Stop()
+	return 0
+}
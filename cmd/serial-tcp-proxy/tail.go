@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/hexutil"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+)
+
+// subscribeID identifies the subscription acknowledgement; messages before
+// it replay the server's log buffer and are skipped
+const subscribeID = "follow"
+
+// ANSI colors for the terminal
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorCyan   = "\033[36m"
+)
+
+// runTail prints the log lines of a running instance as they are logged
+func runTail(args []string) int {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	api := apiFlags(fs)
+	directions := fs.String("direction", "", "comma-separated packet directions: from_upstream, to_upstream")
+	sources := fs.String("source", "", `comma-separated packet sources, e.g. "client#*,INJECT"`)
+	packets := fs.Bool("packets", false, "print packet lines only")
+	hexFilter := fs.String("hex-filter", "", `print only packets containing these bytes, e.g. "f7 0e"`)
+	color := fs.String("color", "auto", "colorize output: auto, always or never")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: serial-tcp-proxy tail [--url http://host:18080] [--packets] [--hex-filter 'f7 0e'] [options]\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	p := linePrinter{out: os.Stdout}
+	switch *color {
+	case "always":
+		p.color = true
+	case "auto":
+		p.color = isTerminal(os.Stdout)
+	case "never":
+	default:
+		fmt.Fprintf(os.Stderr, "Invalid --color %q\n", *color)
+		return 2
+	}
+	if *hexFilter != "" {
+		data, err := hexutil.Parse(*hexFilter)
+		if err != nil || len(data) == 0 {
+			fmt.Fprintf(os.Stderr, "Invalid --hex-filter %q\n", *hexFilter)
+			return 2
+		}
+		p.match = " " + hexutil.Format(data) + " "
+		*packets = true
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	sub := logSubscription{
+		Types:       []string{"log"},
+		Directions:  splitList(*directions),
+		Sources:     splitList(*sources),
+		PacketsOnly: *packets,
+	}
+	if err := followLog(ctx, api, sub, p.print); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// logSubscription is the filter sent with the WebSocket subscribe command
+type logSubscription struct {
+	Types       []string `json:"types"`
+	Directions  []string `json:"directions,omitempty"`
+	Sources     []string `json:"sources,omitempty"`
+	PacketsOnly bool     `json:"packets_only"`
+}
+
+// followLog subscribes to the log of a running instance and calls fn for
+// each line logged from then on, until ctx is done or the connection fails
+func followLog(ctx context.Context, api *apiClient, sub logSubscription, fn func(line string)) error {
+	conn, err := api.dialWebSocket()
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(map[string]any{"id": subscribeID, "type": "subscribe", "data": sub}); err != nil {
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	live := false
+	for {
+		var msg struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("connection lost: %w", err)
+		}
+
+		var lines []string
+		switch msg.Type {
+		case "ack":
+			var ack struct {
+				ID    string `json:"id"`
+				OK    bool   `json:"ok"`
+				Error string `json:"error"`
+			}
+			if json.Unmarshal(msg.Data, &ack) == nil && ack.ID == subscribeID {
+				if !ack.OK {
+					return fmt.Errorf("subscription rejected: %s", ack.Error)
+				}
+				live = true
+			}
+		case "log":
+			var line string
+			if json.Unmarshal(msg.Data, &line) == nil {
+				lines = []string{line}
+			}
+		case "logs":
+			_ = json.Unmarshal(msg.Data, &lines)
+		}
+		if live {
+			for _, line := range lines {
+				fn(line)
+			}
+		}
+	}
+}
+
+// linePrinter writes log lines, optionally colored and limited to packets
+// containing match
+type linePrinter struct {
+	out   io.Writer
+	color bool
+	match string
+}
+
+func (p linePrinter) print(line string) {
+	line = strings.TrimRight(line, "\n")
+	direction, _, isPacket := logger.ParsePacketLine(line)
+	if p.match != "" && (!isPacket || !strings.Contains(line, p.match)) {
+		return
+	}
+	if !p.color {
+		fmt.Fprintln(p.out, line)
+		return
+	}
+
+	color := ""
+	switch {
+	case isPacket && strings.HasPrefix(direction, "->"):
+		color = colorCyan
+	case isPacket:
+		color = colorGreen
+	case strings.Contains(line, "[ERROR]"):
+		color = colorRed
+	case strings.Contains(line, "[WARN]"):
+		color = colorYellow
+	}
+	if color == "" {
+		fmt.Fprintln(p.out, line)
+		return
+	}
+	fmt.Fprintln(p.out, color+line+colorReset)
+}
+
+// splitList splits a comma-separated flag value, dropping empty items
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// isTerminal reports whether f is a character device, such as a terminal
+func isTerminal(f *os.File) bool {
+	st, err := f.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hoon-ch/serial-tcp-proxy/pkg/testutil"
+)
+
+const (
+	testPacketUp   = "2025-11-28T00:00:00.123456789Z [PKT] [->UP] f7 0e 11 (3 bytes) from client#1"
+	testPacketDown = "2025-11-28T00:00:00.223456789Z [PKT] [UP->] f7 0e 91 41 (4 bytes)"
+	testInfoLine   = "2025-11-28T00:00:00.323456789Z [INFO] Client connected"
+)
+
+// logServer is a /api/ws endpoint that replays a line before acknowledging
+// the subscription, as the web server does with its log buffer, then sends
+// lines and closes the socket
+type logServer struct {
+	*httptest.Server
+	sub chan logSubscription
+}
+
+func newLogServer(t *testing.T, ack string, lines []string) *logServer {
+	t.Helper()
+	s := &logServer{sub: make(chan logSubscription, 1)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/ws" {
+			http.NotFound(w, r)
+			return
+		}
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var cmd struct {
+			ID   string          `json:"id"`
+			Type string          `json:"type"`
+			Data logSubscription `json:"data"`
+		}
+		if err := conn.ReadJSON(&cmd); err != nil || cmd.Type != "subscribe" {
+			return
+		}
+		s.sub <- cmd.Data
+
+		_ = conn.WriteJSON(map[string]any{"type": "log", "data": "replayed before the subscription"})
+		ok := ack == ""
+		_ = conn.WriteJSON(map[string]any{"type": "ack", "data": map[string]any{"id": cmd.ID, "ok": ok, "error": ack}})
+		for _, line := range lines {
+			_ = conn.WriteJSON(map[string]any{"type": "log", "data": line})
+		}
+		_ = conn.WriteJSON(map[string]any{"type": "logs", "data": []string{testInfoLine}})
+		time.Sleep(50 * time.Millisecond)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestFollowLog(t *testing.T) {
+	srv := newLogServer(t, "", []string{testPacketUp, testPacketDown})
+	api := &apiClient{url: srv.URL, http: &http.Client{Timeout: time.Second}}
+
+	var lines []string
+	sub := logSubscription{Types: []string{"log"}, Sources: []string{"client#1"}, PacketsOnly: true}
+	err := followLog(context.Background(), api, sub, func(line string) { lines = append(lines, line) })
+	if err == nil || !strings.Contains(err.Error(), "connection lost") {
+		t.Errorf("Expected the closed socket to be reported, got %v", err)
+	}
+
+	if got := <-srv.sub; !got.PacketsOnly || len(got.Sources) != 1 || got.Sources[0] != "client#1" {
+		t.Errorf("Expected the filter to be sent with the subscription, got %+v", got)
+	}
+	want := []string{testPacketUp, testPacketDown, testInfoLine}
+	if fmt.Sprint(lines) != fmt.Sprint(want) {
+		t.Errorf("Expected only the lines after the acknowledgement, got %q", lines)
+	}
+}
+
+func TestFollowLog_Rejected(t *testing.T) {
+	srv := newLogServer(t, "unknown type", nil)
+	api := &apiClient{url: srv.URL, http: &http.Client{Timeout: time.Second}}
+
+	err := followLog(context.Background(), api, logSubscription{}, func(string) {})
+	if err == nil || !strings.Contains(err.Error(), "unknown type") {
+		t.Errorf("Expected the rejection to be reported, got %v", err)
+	}
+}
+
+func TestLinePrinter(t *testing.T) {
+	var out bytes.Buffer
+	p := linePrinter{out: &out, match: " 91 41 "}
+	for _, line := range []string{testPacketUp, testPacketDown, testInfoLine} {
+		p.print(line)
+	}
+	if out.String() != testPacketDown+"\n" {
+		t.Errorf("Expected only the packet containing 91 41, got %q", out.String())
+	}
+
+	out.Reset()
+	p = linePrinter{out: &out, color: true}
+	p.print(testPacketUp)
+	p.print(testInfoLine)
+	if want := colorCyan + testPacketUp + colorReset + "\n" + testInfoLine + "\n"; out.String() != want {
+		t.Errorf("Expected %q, got %q", want, out.String())
+	}
+}
+
+func TestRunTail_ExitCodes(t *testing.T) {
+	for name, args := range map[string][]string{
+		"invalid color":      {"--color", "rainbow"},
+		"invalid hex filter": {"--hex-filter", "zz"},
+		"empty hex filter":   {"--hex-filter", " "},
+		"unknown flag":       {"--bogus"},
+	} {
+		if code := runTail(args); code != 2 {
+			t.Errorf("%s: expected exit code 2, got %d", name, code)
+		}
+	}
+
+	url := fmt.Sprintf("http://127.0.0.1:%d", testutil.FreePort(t))
+	if code := runTail([]string{"--url", url, "--timeout", "1s"}); code != 1 {
+		t.Errorf("Expected exit code 1 for an unreachable instance, got %d", code)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/hexutil"
+)
+
+// lineEndings are the --eol choices appended to text lines
+var lineEndings = map[string]string{
+	"none": "",
+	"lf":   "\n",
+	"cr":   "\r",
+	"crlf": "\r\n",
+}
+
+// runTerm connects to the proxy as a client, sends each line typed as hex
+// or text and prints what it receives
+func runTerm(args []string) int {
+	fs := flag.NewFlagSet("term", flag.ContinueOnError)
+	addr := fs.String("addr", "127.0.0.1:18899", "proxy address to connect to")
+	input := fs.String("input", "hex", `how typed lines are sent: "hex" or "text"`)
+	eol := fs.String("eol", "lf", "line ending appended to text lines: none, lf, cr or crlf")
+	name := fs.String("name", "", "name to announce with IDENT (see CLIENT_IDENT_TIMEOUT)")
+	wait := fs.Duration("wait", time.Second, "how long to keep printing after the input ends")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: serial-tcp-proxy term [--addr host:port] [--input hex|text] [options]\n\n")
+		fmt.Fprintf(fs.Output(), "Type a line to send it; prefix a line with \"hex:\" or \"text:\" to send it the other way.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	ending, ok := lineEndings[*eol]
+	if !ok || (*input != "hex" && *input != "text") {
+		fs.Usage()
+		return 2
+	}
+
+	conn, err := net.Dial("tcp", *addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to connect: %v\n", err)
+		return 1
+	}
+	defer conn.Close()
+	if *name != "" {
+		if _, err := conn.Write([]byte("IDENT " + *name + "\n")); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to send IDENT: %v\n", err)
+			return 1
+		}
+	}
+
+	t := &terminal{out: os.Stdout}
+	t.printf("Connected to %s", *addr)
+
+	lost := make(chan struct{})
+	go func() {
+		defer close(lost)
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				t.frame("<", buf[:n])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	lines := make(chan string)
+	scanner := bufio.NewScanner(os.Stdin)
+	go func() {
+		defer close(lines)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				// Input ended, e.g. when piped: print late responses
+				select {
+				case <-time.After(*wait):
+				case <-lost:
+				case <-sigCh:
+				}
+				return 0
+			}
+			data, err := encodeLine(line, *input, ending)
+			if err != nil {
+				t.printf("Not sent: %v", err)
+				continue
+			}
+			if len(data) == 0 {
+				continue
+			}
+			if _, err := conn.Write(data); err != nil {
+				fmt.Fprintf(os.Stderr, "Write failed: %v\n", err)
+				return 1
+			}
+			t.frame(">", data)
+		case <-lost:
+			t.printf("Connection closed by the proxy")
+			return 1
+		case <-sigCh:
+			return 0
+		}
+	}
+}
+
+// encodeLine converts a typed line to the bytes to send. A "hex:" or
+// "text:" prefix overrides the input mode for the line.
+func encodeLine(line, mode, ending string) ([]byte, error) {
+	if rest, ok := strings.CutPrefix(line, "hex:"); ok {
+		line, mode = rest, "hex"
+	} else if rest, ok := strings.CutPrefix(line, "text:"); ok {
+		line, mode = rest, "text"
+	}
+	if mode == "text" {
+		return []byte(line + ending), nil
+	}
+	if strings.TrimSpace(line) == "" {
+		return nil, nil
+	}
+	return hexutil.Parse(line)
+}
+
+// terminal prints timestamped lines from the reading and sending
+// goroutines without interleaving them
+type terminal struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// frame prints data sent (">") or received ("<") as hex and printable text
+func (t *terminal) frame(dir string, data []byte) {
+	text := append([]byte(nil), data...)
+	for i, b := range text {
+		if b < 0x20 || b > 0x7e {
+			text[i] = '.'
+		}
+	}
+	t.printf("%s %s  |%s| (%d bytes)", dir, hexutil.Format(data), text, len(data))
+}
+
+func (t *terminal) printf(format string, args ...any) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.out, "%s %s\n", time.Now().Format("15:04:05.000"), fmt.Sprintf(format, args...))
+}
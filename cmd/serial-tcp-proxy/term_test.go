@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hoon-ch/serial-tcp-proxy/pkg/testutil"
+)
+
+// runTermWith runs the term subcommand with input on stdin and returns its
+// exit code and output. Unless closeInput is set, stdin stays open.
+func runTermWith(t *testing.T, args []string, input string, closeInput bool) (int, string) {
+	t.Helper()
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inW.WriteString(input); err != nil {
+		t.Fatal(err)
+	}
+	if closeInput {
+		inW.Close()
+	} else {
+		t.Cleanup(func() { inW.Close() })
+	}
+
+	var out bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(&out, outR)
+		close(copied)
+	}()
+
+	stdin, stdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = inR, outW
+	code := runTerm(args)
+	os.Stdin, os.Stdout = stdin, stdout
+
+	outW.Close()
+	<-copied
+	return code, out.String()
+}
+
+func TestEncodeLine(t *testing.T) {
+	tests := []struct {
+		line, mode, ending string
+		want               []byte
+		wantErr            bool
+	}{
+		{"f7 0e 11", "hex", "\n", []byte{0xf7, 0x0e, 0x11}, false},
+		{"  ", "hex", "\n", nil, false},
+		{"f7 zz", "hex", "\n", nil, true},
+		{"AT", "text", "\r\n", []byte("AT\r\n"), false},
+		{"text:AT", "hex", "\r", []byte("AT\r"), false},
+		{"hex:41 54", "text", "\n", []byte("AT"), false},
+	}
+	for _, tt := range tests {
+		got, err := encodeLine(tt.line, tt.mode, tt.ending)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("encodeLine(%q, %s): expected an error", tt.line, tt.mode)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, tt.want) {
+			t.Errorf("encodeLine(%q, %s): expected %x, got %x, %v", tt.line, tt.mode, tt.want, got, err)
+		}
+	}
+}
+
+func TestRunTerm_UsageErrors(t *testing.T) {
+	for name, args := range map[string][]string{
+		"invalid eol":   {"--eol", "nl"},
+		"invalid input": {"--input", "binary"},
+		"unknown flag":  {"--bogus"},
+	} {
+		if code := runTerm(args); code != 2 {
+			t.Errorf("%s: expected exit code 2, got %d", name, code)
+		}
+	}
+
+	addr := fmt.Sprintf("127.0.0.1:%d", testutil.FreePort(t))
+	if code := runTerm([]string{"--addr", addr}); code != 1 {
+		t.Errorf("Expected exit code 1 when the proxy is unreachable, got %d", code)
+	}
+}
+
+func TestRunTerm_Session(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var got []byte
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			got = append(got, buf[:n]...)
+			if err != nil {
+				break
+			}
+			_, _ = conn.Write(buf[:n])
+		}
+		received <- got
+	}()
+
+	input := "IDENT\nf7 0e\nzz\ntext:hi\n"
+	code, out := runTermWith(t, []string{"--addr", ln.Addr().String(), "--name", "tester", "--wait", "200ms"}, input, true)
+	if code != 0 {
+		t.Fatalf("Expected exit code 0 once the input ends, got %d:\n%s", code, out)
+	}
+
+	// The first line is not hex and is reported, not sent
+	if got, want := <-received, "IDENT tester\n\xf7\x0ehi\n"; string(got) != want {
+		t.Errorf("Expected the proxy to receive %q, got %q", want, got)
+	}
+	for _, want := range []string{"Connected to", "Not sent", "> f7 0e", "> 68 69 0a  |hi.|", "< 49 44 45 4e 54"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected output to contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestRunTerm_ConnectionClosed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	code, out := runTermWith(t, []string{"--addr", ln.Addr().String()}, "", false)
+	if code != 1 {
+		t.Errorf("Expected exit code 1 when the proxy closes the connection, got %d", code)
+	}
+	if !strings.Contains(out, "Connection closed by the proxy") {
+		t.Errorf("Expected the closed connection to be reported:\n%s", out)
+	}
+}
@@ -0,0 +1,300 @@
+// Package bench drives test packets through a running proxy and measures
+// how they come back from an echoing upstream.
+package bench
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Packet layout: magic, sequence number, then padding up to Size
+var magic = [2]byte{0xb5, 0x5b}
+
+// MinSize is the smallest packet that can carry a sequence number
+const MinSize = 6
+
+// Options controls a benchmark run
+type Options struct {
+	Addr     string        // proxy address to connect to as a client
+	Size     int           // bytes per packet
+	Rate     int           // packets per second, 0 for as fast as the window allows
+	Count    int           // packets to send, 0 to run for Duration
+	Duration time.Duration // run time when Count is 0
+	Window   int           // maximum packets in flight
+	Timeout  time.Duration // wait for outstanding echoes after the last send
+}
+
+// Result summarizes a benchmark run
+type Result struct {
+	Sent          int     `json:"sent"`
+	Received      int     `json:"received"`
+	Dropped       int     `json:"dropped"`
+	Corrupt       int     `json:"corrupt"`
+	ElapsedMs     int64   `json:"elapsed_ms"`
+	PacketsPerSec float64 `json:"packets_per_sec"`
+	BytesPerSec   float64 `json:"bytes_per_sec"`
+	LatencyMinUs  int64   `json:"latency_min_us"`
+	LatencyP50Us  int64   `json:"latency_p50_us"`
+	LatencyP90Us  int64   `json:"latency_p90_us"`
+	LatencyP99Us  int64   `json:"latency_p99_us"`
+	LatencyMaxUs  int64   `json:"latency_max_us"`
+	LatencyMeanUs int64   `json:"latency_mean_us"`
+	PacketSize    int     `json:"packet_size"`
+	RequestedRate int     `json:"requested_rate"`
+	Window        int     `json:"window"`
+	Error         string  `json:"error,omitempty"` // why sending stopped early
+}
+
+// Validate checks the options and fills in defaults
+func (o *Options) Validate() error {
+	if o.Addr == "" {
+		return errors.New("address is required")
+	}
+	if o.Size < MinSize || o.Size > 65536 {
+		return fmt.Errorf("size must be between %d and 65536", MinSize)
+	}
+	if o.Rate < 0 {
+		return errors.New("rate must not be negative")
+	}
+	if o.Count < 0 {
+		return errors.New("count must not be negative")
+	}
+	if o.Count == 0 && o.Duration <= 0 {
+		o.Duration = 10 * time.Second
+	}
+	if o.Window <= 0 {
+		o.Window = 64
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 2 * time.Second
+	}
+	return nil
+}
+
+type tracker struct {
+	mu        sync.Mutex
+	sentAt    map[uint32]time.Time
+	latencies []time.Duration
+	received  int
+	corrupt   int
+	last      time.Time
+	inFlight  chan struct{}
+}
+
+// Run connects to the proxy, sends packets and collects their echoes. The
+// upstream must echo every byte back, e.g. "serial-tcp-proxy mock".
+func Run(ctx context.Context, opts Options) (Result, error) {
+	if err := opts.Validate(); err != nil {
+		return Result{}, err
+	}
+
+	conn, err := net.DialTimeout("tcp", opts.Addr, 5*time.Second)
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+
+	tr := &tracker{
+		sentAt:   make(map[uint32]time.Time),
+		inFlight: make(chan struct{}, opts.Window),
+	}
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		tr.readLoop(conn, opts.Size)
+	}()
+
+	start := time.Now()
+	sent, err := send(ctx, conn, tr, opts)
+	sendEnd := time.Now()
+
+	// Wait for outstanding echoes
+	deadline := time.Now().Add(opts.Timeout)
+	for time.Now().Before(deadline) {
+		tr.mu.Lock()
+		outstanding := len(tr.sentAt)
+		tr.mu.Unlock()
+		if outstanding == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn.Close()
+	<-readDone
+
+	if err != nil && sent == 0 {
+		return Result{}, err
+	}
+
+	// Throughput covers the time until the last echo arrived
+	end := sendEnd
+	if tr.last.After(end) {
+		end = tr.last
+	}
+	result := tr.result(opts, sent, end.Sub(start))
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result, nil
+}
+
+func send(ctx context.Context, conn net.Conn, tr *tracker, opts Options) (int, error) {
+	var tick <-chan time.Time
+	if opts.Rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(opts.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	var stop <-chan time.Time
+	if opts.Count == 0 {
+		timer := time.NewTimer(opts.Duration)
+		defer timer.Stop()
+		stop = timer.C
+	}
+
+	packet := make([]byte, opts.Size)
+	copy(packet, magic[:])
+	for i := MinSize; i < opts.Size; i++ {
+		packet[i] = byte(i)
+	}
+
+	sent := 0
+	for seq := uint32(0); opts.Count == 0 || sent < opts.Count; seq++ {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-stop:
+				return sent, nil
+			case <-ctx.Done():
+				return sent, nil
+			}
+		}
+
+		select {
+		case tr.inFlight <- struct{}{}:
+		case <-stop:
+			return sent, nil
+		case <-ctx.Done():
+			return sent, nil
+		case <-time.After(opts.Timeout):
+			return sent, fmt.Errorf("no echo within %s with %d packets in flight", opts.Timeout, opts.Window)
+		}
+
+		binary.BigEndian.PutUint32(packet[2:], seq)
+		tr.mu.Lock()
+		tr.sentAt[seq] = time.Now()
+		tr.mu.Unlock()
+
+		_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write(packet); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+func (tr *tracker) readLoop(conn net.Conn, size int) {
+	buf := make([]byte, size)
+	for {
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		now := time.Now()
+
+		tr.mu.Lock()
+		if buf[0] != magic[0] || buf[1] != magic[1] {
+			tr.corrupt++
+			tr.mu.Unlock()
+			continue
+		}
+		seq := binary.BigEndian.Uint32(buf[2:])
+		sentAt, ok := tr.sentAt[seq]
+		if ok {
+			delete(tr.sentAt, seq)
+			tr.received++
+			tr.latencies = append(tr.latencies, now.Sub(sentAt))
+			tr.last = now
+		}
+		tr.mu.Unlock()
+
+		if ok {
+			select {
+			case <-tr.inFlight:
+			default:
+			}
+		}
+	}
+}
+
+func (tr *tracker) result(opts Options, sent int, elapsed time.Duration) Result {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	r := Result{
+		Sent:          sent,
+		Received:      tr.received,
+		Dropped:       sent - tr.received,
+		Corrupt:       tr.corrupt,
+		ElapsedMs:     elapsed.Milliseconds(),
+		PacketSize:    opts.Size,
+		RequestedRate: opts.Rate,
+		Window:        opts.Window,
+	}
+	if secs := elapsed.Seconds(); secs > 0 {
+		r.PacketsPerSec = float64(tr.received) / secs
+		r.BytesPerSec = float64(tr.received*opts.Size) / secs
+	}
+
+	if n := len(tr.latencies); n > 0 {
+		sort.Slice(tr.latencies, func(i, j int) bool { return tr.latencies[i] < tr.latencies[j] })
+		var total time.Duration
+		for _, l := range tr.latencies {
+			total += l
+		}
+		r.LatencyMinUs = tr.latencies[0].Microseconds()
+		r.LatencyP50Us = percentile(tr.latencies, 50).Microseconds()
+		r.LatencyP90Us = percentile(tr.latencies, 90).Microseconds()
+		r.LatencyP99Us = percentile(tr.latencies, 99).Microseconds()
+		r.LatencyMaxUs = tr.latencies[n-1].Microseconds()
+		r.LatencyMeanUs = (total / time.Duration(n)).Microseconds()
+	}
+	return r
+}
+
+// percentile returns the p-th percentile of sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	idx := (len(sorted)*p + 99) / 100
+	if idx > 0 {
+		idx--
+	}
+	return sorted[idx]
+}
+
+// Report formats the result for a terminal
+func (r Result) Report(w io.Writer) {
+	fmt.Fprintf(w, "Packets:    %d sent, %d received, %d dropped, %d corrupt\n", r.Sent, r.Received, r.Dropped, r.Corrupt)
+	fmt.Fprintf(w, "Duration:   %d ms (%d-byte packets)\n", r.ElapsedMs, r.PacketSize)
+	fmt.Fprintf(w, "Throughput: %.1f packets/s, %.1f KiB/s\n", r.PacketsPerSec, r.BytesPerSec/1024)
+	if r.Received > 0 {
+		fmt.Fprintf(w, "Latency:    min %s, p50 %s, p90 %s, p99 %s, max %s, mean %s\n",
+			us(r.LatencyMinUs), us(r.LatencyP50Us), us(r.LatencyP90Us),
+			us(r.LatencyP99Us), us(r.LatencyMaxUs), us(r.LatencyMeanUs))
+	}
+	if r.Error != "" {
+		fmt.Fprintf(w, "Stopped:    %s\n", r.Error)
+	}
+}
+
+func us(v int64) string {
+	return (time.Duration(v) * time.Microsecond).String()
+}
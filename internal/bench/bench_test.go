@@ -0,0 +1,114 @@
+package bench
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/simulator"
+)
+
+func startEcho(t *testing.T) string {
+	t.Helper()
+	log, _ := logger.New(false, "")
+	log.SetOutput(io.Discard)
+	s := simulator.NewServer("127.0.0.1:0", simulator.EchoScript(), log)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Failed to start echo server: %v", err)
+	}
+	t.Cleanup(s.Stop)
+	return s.Addr().String()
+}
+
+func TestRun_Echo(t *testing.T) {
+	result, err := Run(context.Background(), Options{
+		Addr:  startEcho(t),
+		Size:  16,
+		Count: 200,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Sent != 200 || result.Received != 200 {
+		t.Errorf("Expected 200 sent and received, got %d/%d", result.Sent, result.Received)
+	}
+	if result.Dropped != 0 || result.Corrupt != 0 {
+		t.Errorf("Expected no drops, got %d dropped, %d corrupt", result.Dropped, result.Corrupt)
+	}
+	if result.LatencyP50Us > result.LatencyP99Us || result.LatencyP99Us > result.LatencyMaxUs {
+		t.Errorf("Percentiles out of order: %+v", result)
+	}
+}
+
+func TestRun_Drops(t *testing.T) {
+	// A sink that never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	result, err := Run(context.Background(), Options{
+		Addr:    ln.Addr().String(),
+		Size:    8,
+		Count:   10,
+		Window:  4,
+		Timeout: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result.Sent != 4 || result.Dropped != 4 {
+		t.Errorf("Expected 4 sent and dropped with a full window, got %d/%d", result.Sent, result.Dropped)
+	}
+	if result.Error == "" {
+		t.Error("Expected Error to explain the stall")
+	}
+}
+
+func TestOptions_Validate(t *testing.T) {
+	opts := Options{Addr: "127.0.0.1:1", Size: 32}
+	if err := opts.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.Duration != 10*time.Second || opts.Window != 64 {
+		t.Errorf("Expected defaults, got %+v", opts)
+	}
+
+	for _, bad := range []Options{
+		{Size: 32},
+		{Addr: "x:1", Size: 2},
+		{Addr: "x:1", Size: 32, Rate: -1},
+	} {
+		if err := bad.Validate(); err == nil {
+			t.Errorf("Expected error for %+v", bad)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]time.Duration, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+	if p := percentile(sorted, 50); p != 50*time.Millisecond {
+		t.Errorf("Expected p50 50ms, got %v", p)
+	}
+	if p := percentile(sorted, 99); p != 99*time.Millisecond {
+		t.Errorf("Expected p99 99ms, got %v", p)
+	}
+	if p := percentile(sorted[:1], 99); p != time.Millisecond {
+		t.Errorf("Expected single sample, got %v", p)
+	}
+}
@@ -0,0 +1,93 @@
+// Package bufpool provides instrumented byte buffer pools, so buffer reuse
+// can be observed in the status output.
+package bufpool
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Pool hands out fixed-size buffers and counts their use
+type Pool struct {
+	name   string
+	size   int
+	pool   sync.Pool
+	frames sync.Pool // *Frame wrappers without a buffer
+	gets   atomic.Uint64
+	allocs atomic.Uint64
+	inUse  atomic.Int64
+}
+
+// Stats is a snapshot of a pool's counters
+type Stats struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	Gets   uint64 `json:"gets"`
+	Allocs uint64 `json:"allocs"` // buffers created because none was free
+	InUse  int64  `json:"in_use"`
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]*Pool)
+)
+
+// New returns a pool of size-byte buffers registered under name. Pools
+// with the same name share their counters.
+func New(name string, size int) *Pool {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if p, ok := registry[name]; ok {
+		return p
+	}
+	p := &Pool{name: name, size: size}
+	p.pool.New = func() interface{} {
+		p.allocs.Add(1)
+		buf := make([]byte, size)
+		return &buf
+	}
+	registry[name] = p
+	return p
+}
+
+// Get returns a buffer of the pool's size
+func (p *Pool) Get() *[]byte {
+	p.gets.Add(1)
+	p.inUse.Add(1)
+	return p.pool.Get().(*[]byte)
+}
+
+// Put returns a buffer obtained from Get
+func (p *Pool) Put(buf *[]byte) {
+	p.inUse.Add(-1)
+	p.pool.Put(buf)
+}
+
+// Stats returns the pool's counters
+func (p *Pool) Stats() Stats {
+	return Stats{
+		Name:   p.name,
+		Size:   p.size,
+		Gets:   p.gets.Load(),
+		Allocs: p.allocs.Load(),
+		InUse:  p.inUse.Load(),
+	}
+}
+
+// All returns the counters of every pool, sorted by name
+func All() []Stats {
+	registryMu.Lock()
+	pools := make([]*Pool, 0, len(registry))
+	for _, p := range registry {
+		pools = append(pools, p)
+	}
+	registryMu.Unlock()
+
+	result := make([]Stats, 0, len(pools))
+	for _, p := range pools {
+		result = append(result, p.Stats())
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
@@ -0,0 +1,66 @@
+package bufpool
+
+import "testing"
+
+func TestPool_Counters(t *testing.T) {
+	p := New("test-counters", 128)
+
+	a := p.Get()
+	if len(*a) != 128 {
+		t.Errorf("Expected 128-byte buffer, got %d", len(*a))
+	}
+	b := p.Get()
+	stats := p.Stats()
+	if stats.Gets != 2 || stats.InUse != 2 {
+		t.Errorf("Expected 2 gets and 2 in use, got %+v", stats)
+	}
+	if stats.Allocs < 2 {
+		t.Errorf("Expected at least 2 allocations, got %d", stats.Allocs)
+	}
+
+	p.Put(a)
+	p.Put(b)
+	if stats := p.Stats(); stats.InUse != 0 {
+		t.Errorf("Expected 0 in use after Put, got %d", stats.InUse)
+	}
+}
+
+func TestNew_SharedName(t *testing.T) {
+	if New("test-shared", 64) != New("test-shared", 64) {
+		t.Error("Expected pools with the same name to be shared")
+	}
+
+	found := false
+	for _, s := range All() {
+		if s.Name == "test-shared" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Expected All to include the registered pool")
+	}
+}
+
+func TestFrame_Refs(t *testing.T) {
+	p := New("test-frame", 16)
+
+	f := p.GetFrame()
+	if len(f.Bytes()) != 16 {
+		t.Errorf("Expected 16-byte frame, got %d", len(f.Bytes()))
+	}
+	f.Truncate(3)
+	copy(f.Bytes(), "abc")
+	if string(f.Bytes()) != "abc" {
+		t.Errorf("Expected 'abc', got %q", f.Bytes())
+	}
+
+	f.Retain()
+	f.Release()
+	if stats := p.Stats(); stats.InUse != 1 {
+		t.Errorf("Expected the buffer held by the remaining reference, got %d in use", stats.InUse)
+	}
+	f.Release()
+	if stats := p.Stats(); stats.InUse != 0 {
+		t.Errorf("Expected 0 in use after the last Release, got %d", stats.InUse)
+	}
+}
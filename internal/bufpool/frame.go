@@ -0,0 +1,54 @@
+package bufpool
+
+import "sync/atomic"
+
+// Frame is a pooled buffer shared by several holders, so data read once can
+// be broadcast and logged without copies. The caller of GetFrame holds the
+// first reference. Anyone keeping the frame after the call that handed it
+// over calls Retain, and every holder calls Release once; the buffer goes
+// back to its pool with the last Release.
+type Frame struct {
+	pool *Pool
+	buf  *[]byte
+	n    int
+	refs atomic.Int32
+}
+
+// GetFrame returns a frame spanning a whole buffer of the pool's size
+func (p *Pool) GetFrame() *Frame {
+	f, _ := p.frames.Get().(*Frame)
+	if f == nil {
+		f = &Frame{pool: p}
+	}
+	f.buf = p.Get()
+	f.n = len(*f.buf)
+	f.refs.Store(1)
+	return f
+}
+
+// Bytes returns the data in the frame
+func (f *Frame) Bytes() []byte {
+	return (*f.buf)[:f.n]
+}
+
+// Truncate shortens the frame to n bytes, e.g. to what a Read returned
+func (f *Frame) Truncate(n int) {
+	f.n = n
+}
+
+// Retain adds a reference
+func (f *Frame) Retain() {
+	f.refs.Add(1)
+}
+
+// Release drops a reference, returning the buffer to the pool with the last
+func (f *Frame) Release() {
+	switch refs := f.refs.Add(-1); {
+	case refs == 0:
+		f.pool.Put(f.buf)
+		f.buf = nil
+		f.pool.frames.Put(f)
+	case refs < 0:
+		panic("bufpool: frame released more often than retained")
+	}
+}
@@ -0,0 +1,45 @@
+// Package buildinfo describes the running binary. The version is set at
+// link time in package main and passed down, so packages never read a
+// global to learn it.
+package buildinfo
+
+import "runtime/debug"
+
+// Info identifies a build
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`     // VCS revision, shortened
+	BuildDate string `json:"build_date,omitempty"` // set at link time, or the commit time
+	GoVersion string `json:"go_version,omitempty"`
+}
+
+// Read returns the build info with version and what the Go toolchain
+// recorded in the binary
+func Read(version string) Info {
+	info := Info{Version: version}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	info.GoVersion = bi.GoVersion
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Commit = s.Value
+			if len(info.Commit) > 12 {
+				info.Commit = info.Commit[:12]
+			}
+		case "vcs.time":
+			info.BuildDate = s.Value
+		}
+	}
+	return info
+}
+
+// String returns the version followed by the commit, if known
+func (i Info) String() string {
+	if i.Commit == "" {
+		return i.Version
+	}
+	return i.Version + " (" + i.Commit + ")"
+}
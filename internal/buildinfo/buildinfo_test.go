@@ -0,0 +1,19 @@
+package buildinfo
+
+import "testing"
+
+func TestRead(t *testing.T) {
+	info := Read("1.2.3")
+	if info.Version != "1.2.3" || info.GoVersion == "" {
+		t.Errorf("Unexpected info %+v", info)
+	}
+}
+
+func TestInfo_String(t *testing.T) {
+	if s := (Info{Version: "1.2.3"}).String(); s != "1.2.3" {
+		t.Errorf("Expected 1.2.3, got %s", s)
+	}
+	if s := (Info{Version: "1.2.3", Commit: "abc123"}).String(); s != "1.2.3 (abc123)" {
+		t.Errorf("Expected the commit appended, got %s", s)
+	}
+}
@@ -0,0 +1,220 @@
+// Package capdiff compares two packet captures frame by frame, e.g. one
+// recorded before and one after a firmware update, and reports the frames
+// one of them added, lost or changed.
+package capdiff
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/codec"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/hexutil"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/pcapng"
+)
+
+// Directions reported for frames, as used in configuration and APIs
+const (
+	FromUpstream = "from_upstream"
+	ToUpstream   = "to_upstream"
+)
+
+// Difference types
+const (
+	Added   = "added"   // only in the second capture
+	Missing = "missing" // only in the first capture
+	Changed = "changed" // same position, different bytes
+)
+
+// MaxFrames bounds the frames compared per capture
+const MaxFrames = 50000
+
+// MaxEdits bounds the added and missing frames the comparison looks for
+// before giving up
+const MaxEdits = 2000
+
+// ErrTooDifferent is returned when the captures differ in more than
+// MaxEdits frames
+var ErrTooDifferent = fmt.Errorf("captures differ in more than %d frames", MaxEdits)
+
+// Options selects how packets are split into frames before comparing
+type Options struct {
+	// Gap joins packets of the same direction that follow each other
+	// within this time, like FRAME_GAP_MS. Zero compares packets as
+	// captured.
+	Gap time.Duration
+	// Transform decodes each direction's byte stream after joining, e.g.
+	// codec.SLIPDecode. Empty leaves it unchanged.
+	Transform string
+	// Direction compares only frames in this direction; empty compares
+	// both
+	Direction string
+}
+
+// Validate checks the transform and direction names
+func (o Options) Validate() error {
+	if _, err := codec.New(o.Transform); err != nil {
+		return err
+	}
+	if o.Direction != "" && o.Direction != FromUpstream && o.Direction != ToUpstream {
+		return fmt.Errorf("direction must be %q or %q", FromUpstream, ToUpstream)
+	}
+	if o.Gap < 0 {
+		return errors.New("gap must not be negative")
+	}
+	return nil
+}
+
+// Frame is one frame of a capture
+type Frame struct {
+	Time      time.Time
+	Direction string // FromUpstream, ToUpstream or empty if not recorded
+	Data      []byte
+}
+
+// Frames splits captured packets into frames as selected by opts, in
+// capture order
+func Frames(packets []pcapng.Packet, opts Options) ([]Frame, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Join packets per direction, keeping the time of the first one
+	var joined []Frame
+	open := make(map[string]int) // direction to index in joined
+	last := make(map[string]time.Time)
+	for _, p := range packets {
+		dir := direction(p.Direction)
+		if opts.Direction != "" && dir != opts.Direction {
+			continue
+		}
+		if i, ok := open[dir]; ok && opts.Gap > 0 && p.Time.Sub(last[dir]) <= opts.Gap {
+			joined[i].Data = append(joined[i].Data, p.Data...)
+		} else {
+			open[dir] = len(joined)
+			joined = append(joined, Frame{Time: p.Time, Direction: dir, Data: append([]byte(nil), p.Data...)})
+		}
+		last[dir] = p.Time
+	}
+
+	transforms := make(map[string]codec.Transform)
+	var frames []Frame
+	for _, f := range joined {
+		t, ok := transforms[f.Direction]
+		if !ok {
+			t, _ = codec.New(opts.Transform)
+			transforms[f.Direction] = t
+		}
+		for _, data := range codec.Apply(t, f.Data) {
+			frames = append(frames, Frame{Time: f.Time, Direction: f.Direction, Data: data})
+		}
+		if len(frames) > MaxFrames {
+			return nil, fmt.Errorf("capture has more than %d frames", MaxFrames)
+		}
+	}
+	sort.SliceStable(frames, func(i, j int) bool { return frames[i].Time.Before(frames[j].Time) })
+	return frames, nil
+}
+
+func direction(d pcapng.Direction) string {
+	switch d {
+	case pcapng.Inbound:
+		return FromUpstream
+	case pcapng.Outbound:
+		return ToUpstream
+	default:
+		return ""
+	}
+}
+
+// FrameRef identifies a frame in one of the captures
+type FrameRef struct {
+	Index int    `json:"index"` // position among the capture's frames
+	Time  string `json:"time"`
+	Data  string `json:"data"` // hex
+}
+
+// Difference is a frame found in only one capture, or changed between them
+type Difference struct {
+	Type      string    `json:"type"`
+	Direction string    `json:"direction,omitempty"`
+	A         *FrameRef `json:"a,omitempty"` // frame in the first capture
+	B         *FrameRef `json:"b,omitempty"` // frame in the second capture
+}
+
+// Result summarizes a comparison
+type Result struct {
+	FramesA     int          `json:"frames_a"`
+	FramesB     int          `json:"frames_b"`
+	Same        int          `json:"same"`
+	Added       int          `json:"added"`
+	Missing     int          `json:"missing"`
+	Changed     int          `json:"changed"`
+	Differences []Difference `json:"differences"`
+}
+
+// Diff compares two frame sequences. Frames match when direction and bytes
+// are equal; timing is ignored. Within a run of non-matching frames, a
+// missing and an added frame in the same direction are paired up as a
+// changed frame.
+func Diff(a, b []Frame) (Result, error) {
+	res := Result{FramesA: len(a), FramesB: len(b), Differences: []Difference{}}
+	keyA, keyB := keys(a), keys(b)
+	ops, err := editScript(keyA, keyB)
+	if err != nil {
+		return Result{}, err
+	}
+
+	var missing, added []int // indexes of the current run of edits
+	flush := func() {
+		for len(missing) > 0 || len(added) > 0 {
+			switch {
+			case len(missing) > 0 && len(added) > 0 && a[missing[0]].Direction == b[added[0]].Direction:
+				res.Changed++
+				res.Differences = append(res.Differences, Difference{
+					Type: Changed, Direction: a[missing[0]].Direction,
+					A: ref(a, missing[0]), B: ref(b, added[0]),
+				})
+				missing, added = missing[1:], added[1:]
+			case len(missing) > 0 && (len(added) == 0 || missing[0] <= added[0]):
+				res.Missing++
+				res.Differences = append(res.Differences, Difference{Type: Missing, Direction: a[missing[0]].Direction, A: ref(a, missing[0])})
+				missing = missing[1:]
+			default:
+				res.Added++
+				res.Differences = append(res.Differences, Difference{Type: Added, Direction: b[added[0]].Direction, B: ref(b, added[0])})
+				added = added[1:]
+			}
+		}
+	}
+	for _, op := range ops {
+		switch op.kind {
+		case opEqual:
+			flush()
+			res.Same++
+		case opDelete:
+			missing = append(missing, op.a)
+		case opInsert:
+			added = append(added, op.b)
+		}
+	}
+	flush()
+	return res, nil
+}
+
+func keys(frames []Frame) []string {
+	k := make([]string, len(frames))
+	for i, f := range frames {
+		k[i] = f.Direction + "\x00" + string(f.Data)
+	}
+	return k
+}
+
+func ref(frames []Frame, i int) *FrameRef {
+	return &FrameRef{
+		Index: i,
+		Time:  frames[i].Time.UTC().Format(time.RFC3339Nano),
+		Data:  hexutil.Format(frames[i].Data),
+	}
+}
@@ -0,0 +1,131 @@
+package capdiff
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/codec"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/pcapng"
+)
+
+var start = time.Unix(1700000000, 0)
+
+func packet(ms int, dir pcapng.Direction, data ...byte) pcapng.Packet {
+	return pcapng.Packet{Time: start.Add(time.Duration(ms) * time.Millisecond), Direction: dir, Data: data}
+}
+
+func frames(t *testing.T, packets ...pcapng.Packet) []Frame {
+	t.Helper()
+	f, err := Frames(packets, Options{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return f
+}
+
+func TestDiff_Identical(t *testing.T) {
+	a := frames(t, packet(0, pcapng.Outbound, 0x01), packet(10, pcapng.Inbound, 0x81))
+	res, err := Diff(a, a)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if res.Same != 2 || len(res.Differences) != 0 {
+		t.Errorf("Expected no differences, got %+v", res)
+	}
+}
+
+func TestDiff_AddedMissingChanged(t *testing.T) {
+	a := frames(t,
+		packet(0, pcapng.Outbound, 0x01),
+		packet(10, pcapng.Inbound, 0x81, 0x10), // changed to 81 11
+		packet(20, pcapng.Outbound, 0x02),      // missing
+		packet(30, pcapng.Outbound, 0x03),
+	)
+	b := frames(t,
+		packet(0, pcapng.Outbound, 0x01),
+		packet(10, pcapng.Inbound, 0x81, 0x11),
+		packet(30, pcapng.Outbound, 0x03),
+		packet(40, pcapng.Inbound, 0x83), // added
+	)
+
+	res, err := Diff(a, b)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if res.Same != 2 || res.Changed != 1 || res.Missing != 1 || res.Added != 1 {
+		t.Fatalf("Unexpected summary %+v", res)
+	}
+	d := res.Differences
+	if d[0].Type != Changed || d[0].Direction != FromUpstream || d[0].A.Data != "81 10" || d[0].B.Data != "81 11" || d[0].A.Index != 1 {
+		t.Errorf("Unexpected change %+v %+v %+v", d[0], d[0].A, d[0].B)
+	}
+	if d[1].Type != Missing || d[1].A.Data != "02" || d[1].B != nil {
+		t.Errorf("Unexpected missing frame %+v", d[1])
+	}
+	if d[2].Type != Added || d[2].B.Data != "83" || d[2].B.Index != 3 {
+		t.Errorf("Unexpected added frame %+v", d[2])
+	}
+}
+
+func TestDiff_DirectionMatters(t *testing.T) {
+	a := frames(t, packet(0, pcapng.Outbound, 0x01))
+	b := frames(t, packet(0, pcapng.Inbound, 0x01))
+	res, _ := Diff(a, b)
+	if res.Missing != 1 || res.Added != 1 || res.Changed != 0 {
+		t.Errorf("Expected the frame reported as missing and added, got %+v", res)
+	}
+}
+
+func TestDiff_TooDifferent(t *testing.T) {
+	var a, b []Frame
+	for i := 0; i < MaxEdits; i++ {
+		a = append(a, Frame{Data: []byte(strconv.Itoa(i))})
+		b = append(b, Frame{Data: []byte("x" + strconv.Itoa(i))})
+	}
+	if _, err := Diff(a, b); !errors.Is(err, ErrTooDifferent) {
+		t.Errorf("Expected ErrTooDifferent, got %v", err)
+	}
+}
+
+func TestFrames_Gap(t *testing.T) {
+	packets := []pcapng.Packet{
+		packet(0, pcapng.Inbound, 0x01, 0x02),
+		packet(2, pcapng.Outbound, 0x10), // other directions do not end a frame
+		packet(3, pcapng.Inbound, 0x03),
+		packet(50, pcapng.Inbound, 0x04),
+	}
+	f, err := Frames(packets, Options{Gap: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(f) != 3 || string(f[0].Data) != "\x01\x02\x03" || f[1].Direction != ToUpstream || string(f[2].Data) != "\x04" {
+		t.Errorf("Unexpected frames %+v", f)
+	}
+
+	f, _ = Frames(packets, Options{Gap: 10 * time.Millisecond, Direction: FromUpstream})
+	if len(f) != 2 {
+		t.Errorf("Expected 2 frames from the upstream, got %+v", f)
+	}
+}
+
+func TestFrames_Transform(t *testing.T) {
+	// One SLIP frame split over two packets, then two frames in one
+	packets := []pcapng.Packet{
+		packet(0, pcapng.Inbound, 0xc0, 0x01, 0xdb),
+		packet(1, pcapng.Inbound, 0xdc, 0xc0),
+		packet(2, pcapng.Inbound, 0xc0, 0x02, 0xc0, 0xc0, 0x03, 0xc0),
+	}
+	f, err := Frames(packets, Options{Transform: codec.SLIPDecode})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(f) != 3 || string(f[0].Data) != "\x01\xc0" || string(f[2].Data) != "\x03" {
+		t.Errorf("Unexpected frames %+v", f)
+	}
+
+	if _, err := Frames(packets, Options{Transform: "zip"}); err == nil {
+		t.Error("Expected error for an unknown transform")
+	}
+}
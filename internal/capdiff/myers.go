@@ -0,0 +1,84 @@
+package capdiff
+
+// Edit script operations
+const (
+	opEqual = iota
+	opDelete
+	opInsert
+)
+
+// edit is one step turning a into b: a[a] kept as b[b], a[a] deleted or
+// b[b] inserted
+type edit struct {
+	kind int
+	a, b int
+}
+
+// editScript returns a shortest edit script from a to b using Myers'
+// algorithm. It gives up with ErrTooDifferent after MaxEdits deletions and
+// insertions.
+func editScript(a, b []string) ([]edit, error) {
+	n, m := len(a), len(b)
+	limit := min(n+m, MaxEdits)
+
+	// v[k+offset] is the furthest x reached on diagonal k = x - y. Before
+	// each round d, the diagonals -(d+1)..d+1 are saved for backtracking.
+	offset := limit + 1
+	v := make([]int, 2*offset+1)
+	var trace [][]int
+	for d := 0; d <= limit; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1] // down: insert b[y]
+			} else {
+				x = v[offset+k-1] + 1 // right: delete a[x]
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(trace, n, m), nil
+			}
+		}
+	}
+	return nil, ErrTooDifferent
+}
+
+// backtrack walks the saved rounds from (n, m) back to the origin
+func backtrack(trace [][]int, n, m int) []edit {
+	var ops []edit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		saved := trace[d]
+		at := func(k int) int { return saved[k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x, y = x-1, y-1
+			ops = append(ops, edit{opEqual, x, y})
+		}
+		if d > 0 {
+			if x == prevX {
+				ops = append(ops, edit{opInsert, x, prevY})
+			} else {
+				ops = append(ops, edit{opDelete, prevX, y})
+			}
+		}
+		x, y = prevX, prevY
+	}
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
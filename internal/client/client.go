@@ -15,15 +15,149 @@ type Client struct {
 	Conn        net.Conn
 	Addr        string
 	ConnectedAt time.Time
+	Session     string         // random ID correlating this connection's log lines
+	Log         *logger.Logger // logger tagged with the session
+	Raw         bool           // connected on the raw port, see RAW_LISTEN_PORT
+	Upstream    string         // bound to this upstream by TLS_ROUTES; "" for all
+	refused     atomic.Uint64  // writes refused for lack of write access
+	requests    atomic.Uint64  // writes supervised with RESPONSE_TIMEOUT_MS
+	timeouts    atomic.Uint64  // requests the device did not answer in time
+	writeMu     sync.Mutex
+	nameMu      sync.Mutex
+	name        string       // announced by the client, see CLIENT_IDENT_TIMEOUT
+	access      atomic.Value // string set by SetAccess
+	lastRead    atomic.Int64 // unix nanoseconds of the last read, see Touch
+	closeReason atomic.Value // string set by SetCloseReason
+	group       string       // named by CLIENT_GROUPS, see SetGroup
+	accept      func(data []byte) bool
+}
+
+// SetName labels the client with the name it announced
+func (c *Client) SetName(name string) {
+	c.nameMu.Lock()
+	defer c.nameMu.Unlock()
+	c.name = name
+}
+
+// Name returns the name the client announced, or "" if it did not
+func (c *Client) Name() string {
+	c.nameMu.Lock()
+	defer c.nameMu.Unlock()
+	return c.name
+}
+
+// SetGroup places the client in a group of CLIENT_GROUPS. accept selects
+// the broadcast frames the client receives; nil accepts them all.
+func (c *Client) SetGroup(name string, accept func(data []byte) bool) {
+	c.nameMu.Lock()
+	defer c.nameMu.Unlock()
+	c.group, c.accept = name, accept
+}
+
+// Group returns the group set with SetGroup, or "" if the client is in none
+func (c *Client) Group() string {
+	c.nameMu.Lock()
+	defer c.nameMu.Unlock()
+	return c.group
+}
+
+// accepts reports whether a broadcast frame passes the client's group filter
+func (c *Client) accepts(data []byte) bool {
+	c.nameMu.Lock()
+	accept := c.accept
+	c.nameMu.Unlock()
+	return accept == nil || accept(data)
+}
+
+// SetAccess records the client's access level, see CLIENT_ACCESS, and
+// returns the previous one
+func (c *Client) SetAccess(access string) string {
+	old, _ := c.access.Swap(access).(string)
+	return old
+}
+
+// Access returns the access level recorded with SetAccess, or ""
+func (c *Client) Access() string {
+	access, _ := c.access.Load().(string)
+	return access
+}
+
+// AddRefused counts a write refused for lack of write access and returns
+// the count so far
+func (c *Client) AddRefused() uint64 {
+	return c.refused.Add(1)
+}
+
+// Refused returns the number of writes counted with AddRefused
+func (c *Client) Refused() uint64 {
+	return c.refused.Load()
+}
+
+// AddRequest counts a write awaiting an answer from the device
+func (c *Client) AddRequest() {
+	c.requests.Add(1)
+}
+
+// AddTimeout counts a request the device did not answer in time
+func (c *Client) AddTimeout() {
+	c.timeouts.Add(1)
+}
+
+// Requests returns the counts of AddRequest and AddTimeout
+func (c *Client) Requests() (requests, timeouts uint64) {
+	return c.requests.Load(), c.timeouts.Load()
+}
+
+// Touch records that data was read from the client
+func (c *Client) Touch(t time.Time) {
+	c.lastRead.Store(t.UnixNano())
+}
+
+// LastRead returns when data was last read from the client, or
+// ConnectedAt if it has sent nothing
+func (c *Client) LastRead() time.Time {
+	if ns := c.lastRead.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return c.ConnectedAt
+}
+
+// SetCloseReason records why the proxy is closing the client, e.g.
+// "idle"; the first reason set wins
+func (c *Client) SetCloseReason(reason string) {
+	c.closeReason.CompareAndSwap(nil, reason)
+}
+
+// CloseReason returns the reason recorded with SetCloseReason, or ""
+func (c *Client) CloseReason() string {
+	reason, _ := c.closeReason.Load().(string)
+	return reason
+}
+
+// Write sends one frame to the client. Writes are serialized per client, so
+// concurrent callers (upstream data, injections, trigger responses) never
+// interleave their bytes. A write that fails or times out may have been
+// partially sent; callers must disconnect the client so it never sees a
+// truncated frame followed by other data.
+func (c *Client) Write(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	// Set write deadline to prevent blocking on slow clients
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := c.Conn.Write(data)
+	_ = c.Conn.SetWriteDeadline(time.Time{})
+	return err
 }
 
 type Manager struct {
-	clients      map[string]*Client
-	mu           sync.RWMutex
-	maxClients   int
-	counter      atomic.Uint64
-	webClients   atomic.Int32 // Count of web UI clients (SSE/WebSocket)
-	logger       *logger.Logger
+	clients    map[string]*Client
+	mu         sync.RWMutex
+	maxClients int
+	counter    atomic.Uint64
+	webClients atomic.Int32 // Count of web UI clients (SSE/WebSocket)
+	logger     *logger.Logger
+	onChange   func(c *Client, connected bool, total int)
 }
 
 func NewManager(maxClients int, log *logger.Logger) *Manager {
@@ -34,39 +168,92 @@ func NewManager(maxClients int, log *logger.Logger) *Manager {
 	}
 }
 
+// SetOnChange registers a callback invoked after a TCP client is added or
+// removed, with the new total client count. It must be called before
+// clients connect.
+func (cm *Manager) SetOnChange(fn func(c *Client, connected bool, total int)) {
+	cm.onChange = fn
+}
+
 func (cm *Manager) Add(conn net.Conn) (*Client, error) {
+	return cm.add(conn, "", false, "")
+}
+
+// AddRaw registers a client that receives the unprocessed upstream stream
+// through BroadcastRaw instead of Broadcast
+func (cm *Manager) AddRaw(conn net.Conn) (*Client, error) {
+	return cm.add(conn, "", true, "")
+}
+
+// AddAs registers a client under a stable ID rather than client#N. While
+// another connection holds id, the client gets id#2, id#3 and so on. A raw
+// client receives BroadcastRaw, as with AddRaw.
+func (cm *Manager) AddAs(conn net.Conn, id string, raw bool) (*Client, error) {
+	return cm.add(conn, id, raw, "")
+}
+
+// AddBound registers a client bound to one upstream: it receives only that
+// upstream's data through BroadcastFrom. An empty id is assigned as by Add.
+func (cm *Manager) AddBound(conn net.Conn, id, upstream string) (*Client, error) {
+	return cm.add(conn, id, false, upstream)
+}
+
+func (cm *Manager) add(conn net.Conn, id string, raw bool, upstream string) (*Client, error) {
 	cm.mu.Lock()
-	defer cm.mu.Unlock()
 
 	totalClients := len(cm.clients) + int(cm.webClients.Load())
 	if totalClients >= cm.maxClients {
+		cm.mu.Unlock()
 		return nil, fmt.Errorf("max clients (%d) reached", cm.maxClients)
 	}
 
-	id := fmt.Sprintf("client#%d", cm.counter.Add(1))
+	if id == "" {
+		id = fmt.Sprintf("client#%d", cm.counter.Add(1))
+	} else if _, taken := cm.clients[id]; taken {
+		base := id
+		for n := 2; taken; n++ {
+			id = fmt.Sprintf("%s#%d", base, n)
+			_, taken = cm.clients[id]
+		}
+	}
+	session := logger.NewSessionID()
 	client := &Client{
 		ID:          id,
 		Conn:        conn,
 		Addr:        conn.RemoteAddr().String(),
 		ConnectedAt: time.Now(),
+		Session:     session,
+		Log:         cm.logger.With("session", session),
+		Raw:         raw,
+		Upstream:    upstream,
 	}
 
 	cm.clients[id] = client
 	newTotal := len(cm.clients) + int(cm.webClients.Load())
-	cm.logger.Info("Client connected: %s [%s] (total: %d)", client.Addr, id, newTotal)
+	client.Log.Info("Client connected: %s [%s] (total: %d)", client.Addr, id, newTotal)
+	cm.mu.Unlock()
 
+	if cm.onChange != nil {
+		cm.onChange(client, true, newTotal)
+	}
 	return client, nil
 }
 
 func (cm *Manager) Remove(id string) {
 	cm.mu.Lock()
-	defer cm.mu.Unlock()
+	client, ok := cm.clients[id]
+	if !ok {
+		cm.mu.Unlock()
+		return
+	}
+	client.Conn.Close()
+	delete(cm.clients, id)
+	newTotal := len(cm.clients) + int(cm.webClients.Load())
+	client.Log.Info("Client disconnected: %s [%s] (total: %d)", client.Addr, id, newTotal)
+	cm.mu.Unlock()
 
-	if client, ok := cm.clients[id]; ok {
-		client.Conn.Close()
-		delete(cm.clients, id)
-		newTotal := len(cm.clients) + int(cm.webClients.Load())
-		cm.logger.Info("Client disconnected: %s [%s] (total: %d)", client.Addr, id, newTotal)
+	if cm.onChange != nil {
+		cm.onChange(client, false, newTotal)
 	}
 }
 
@@ -137,24 +324,56 @@ func (cm *Manager) WebClientCount() int {
 	return int(cm.webClients.Load())
 }
 
+// Broadcast delivers data to every client except raw ones as one atomic
+// frame: each client receives either all of data, contiguous and never
+// interleaved with another Broadcast or injection, or is disconnected.
+// Clients whose group filter rejects data are skipped, see SetGroup.
 func (cm *Manager) Broadcast(data []byte) {
+	cm.broadcast(data, func(c *Client) bool {
+		return !c.Raw && c.accepts(data)
+	})
+}
+
+// BroadcastFrom delivers data received from the named upstream, like
+// Broadcast, skipping clients bound to another upstream
+func (cm *Manager) BroadcastFrom(upstream string, data []byte) {
+	cm.broadcast(data, func(c *Client) bool {
+		return !c.Raw && (c.Upstream == "" || c.Upstream == upstream) && c.accepts(data)
+	})
+}
+
+// BroadcastRaw delivers data to the raw clients, like Broadcast but
+// without group filters, as the unprocessed stream is not split in frames
+func (cm *Manager) BroadcastRaw(data []byte) {
+	cm.broadcast(data, func(c *Client) bool {
+		return c.Raw
+	})
+}
+
+// BroadcastGroup delivers data to the clients in the named group, like
+// Broadcast, whatever the group's filter. It returns how many clients were
+// sent data.
+func (cm *Manager) BroadcastGroup(group string, data []byte) int {
+	return cm.broadcast(data, func(c *Client) bool {
+		return !c.Raw && c.Group() == group
+	})
+}
+
+func (cm *Manager) broadcast(data []byte, include func(c *Client) bool) int {
 	cm.mu.RLock()
 	clients := make([]*Client, 0, len(cm.clients))
 	for _, c := range cm.clients {
-		clients = append(clients, c)
+		if include(c) {
+			clients = append(clients, c)
+		}
 	}
 	cm.mu.RUnlock()
 
 	var failedClients []string
 
 	for _, client := range clients {
-		// Set write deadline to prevent blocking on slow clients
-		_ = client.Conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
-		_, err := client.Conn.Write(data)
-		_ = client.Conn.SetWriteDeadline(time.Time{})
-
-		if err != nil {
-			cm.logger.Warn("Failed to write to %s [%s]: %v", client.Addr, client.ID, err)
+		if err := client.Write(data); err != nil {
+			client.Log.Warn("Failed to write to %s [%s]: %v", client.Addr, client.ID, err)
 			failedClients = append(failedClients, client.ID)
 		}
 	}
@@ -163,6 +382,7 @@ func (cm *Manager) Broadcast(data []byte) {
 	for _, id := range failedClients {
 		cm.Remove(id)
 	}
+	return len(clients)
 }
 
 func (cm *Manager) CloseAll() {
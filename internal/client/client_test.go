@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"io"
 	"net"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
@@ -95,6 +97,27 @@ func TestManager_AddMultiple(t *testing.T) {
 	}
 }
 
+func TestManager_AddAs(t *testing.T) {
+	log := newTestLogger()
+	cm := NewManager(10, log)
+
+	first, err := cm.AddAs(newMockConn(), "192.168.1.10", false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	second, _ := cm.AddAs(newMockConn(), "192.168.1.10", false)
+	if first.ID != "192.168.1.10" || second.ID != "192.168.1.10#2" {
+		t.Errorf("Expected IDs 192.168.1.10 and 192.168.1.10#2, got %s and %s", first.ID, second.ID)
+	}
+
+	// A reconnecting client gets its ID back once the old connection is gone
+	cm.Remove(first.ID)
+	again, _ := cm.AddAs(newMockConn(), "192.168.1.10", true)
+	if again.ID != "192.168.1.10" || !again.Raw {
+		t.Errorf("Expected raw client 192.168.1.10, got %s (raw=%v)", again.ID, again.Raw)
+	}
+}
+
 func TestManager_MaxClients(t *testing.T) {
 	log := newTestLogger()
 	cm := NewManager(2, log)
@@ -134,6 +157,35 @@ func TestManager_Remove(t *testing.T) {
 	}
 }
 
+func TestManager_OnChange(t *testing.T) {
+	log := newTestLogger()
+	cm := NewManager(10, log)
+
+	type change struct {
+		id        string
+		connected bool
+		total     int
+	}
+	var changes []change
+	cm.SetOnChange(func(c *Client, connected bool, total int) {
+		changes = append(changes, change{c.ID, connected, total})
+	})
+
+	client, _ := cm.Add(newMockConn())
+	cm.Remove(client.ID)
+	cm.Remove(client.ID) // already removed, no second event
+
+	expected := []change{{"client#1", true, 1}, {"client#1", false, 0}}
+	if len(changes) != len(expected) {
+		t.Fatalf("Expected %d changes, got %+v", len(expected), changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Errorf("Change %d: expected %+v, got %+v", i, expected[i], changes[i])
+		}
+	}
+}
+
 func TestManager_Get(t *testing.T) {
 	log := newTestLogger()
 	cm := NewManager(10, log)
@@ -187,6 +239,113 @@ func TestManager_Broadcast(t *testing.T) {
 	}
 }
 
+func TestManager_BroadcastRaw(t *testing.T) {
+	log := newTestLogger()
+	cm := NewManager(10, log)
+
+	processed, raw := newMockConn(), newMockConn()
+	_, _ = cm.Add(processed)
+	cl, _ := cm.AddRaw(raw)
+	if !cl.Raw {
+		t.Error("Expected client added with AddRaw to be raw")
+	}
+
+	cm.Broadcast([]byte{0x01})
+	cm.BroadcastRaw([]byte{0x02})
+
+	if !bytes.Equal(processed.writeBuf.Bytes(), []byte{0x01}) {
+		t.Errorf("Expected processed client to receive 01, got % x", processed.writeBuf.Bytes())
+	}
+	if !bytes.Equal(raw.writeBuf.Bytes(), []byte{0x02}) {
+		t.Errorf("Expected raw client to receive 02, got % x", raw.writeBuf.Bytes())
+	}
+}
+
+func TestManager_BroadcastFrom(t *testing.T) {
+	log := newTestLogger()
+	cm := NewManager(10, log)
+
+	all, boundA, boundB := newMockConn(), newMockConn(), newMockConn()
+	_, _ = cm.Add(all)
+	cl, _ := cm.AddBound(boundA, "", "a")
+	_, _ = cm.AddBound(boundB, "", "b")
+	if cl.Upstream != "a" || cl.ID == "" {
+		t.Errorf("Unexpected bound client %+v", cl)
+	}
+
+	cm.BroadcastFrom("a", []byte{0x01})
+	cm.BroadcastFrom("b", []byte{0x02})
+	cm.Broadcast([]byte{0x03})
+
+	for _, tc := range []struct {
+		conn *mockConn
+		want []byte
+	}{
+		{all, []byte{0x01, 0x02, 0x03}},
+		{boundA, []byte{0x01, 0x03}},
+		{boundB, []byte{0x02, 0x03}},
+	} {
+		if !bytes.Equal(tc.conn.writeBuf.Bytes(), tc.want) {
+			t.Errorf("Expected % x, got % x", tc.want, tc.conn.writeBuf.Bytes())
+		}
+	}
+}
+
+// byteConn writes one byte at a time and yields in between, so unsynchronized
+// concurrent writers would interleave their frames
+type byteConn struct {
+	*mockConn
+	mu sync.Mutex
+}
+
+func (b *byteConn) Write(p []byte) (int, error) {
+	for _, c := range p {
+		b.mu.Lock()
+		b.writeBuf.WriteByte(c)
+		b.mu.Unlock()
+		runtime.Gosched()
+	}
+	return len(p), nil
+}
+
+func TestManager_BroadcastFrameAligned(t *testing.T) {
+	log := newTestLogger()
+	cm := NewManager(10, log)
+
+	conn := &byteConn{mockConn: newMockConn()}
+	cl, _ := cm.Add(conn)
+
+	// Concurrent broadcasts plus direct writes (as injections do), each a
+	// frame of one repeated byte
+	const frames = 50
+	const frameSize = 16
+	var wg sync.WaitGroup
+	for i := 0; i < frames; i++ {
+		wg.Add(1)
+		go func(v byte) {
+			defer wg.Done()
+			frame := bytes.Repeat([]byte{v}, frameSize)
+			if v%2 == 0 {
+				cm.Broadcast(frame)
+			} else {
+				_ = cl.Write(frame)
+			}
+		}(byte(i))
+	}
+	wg.Wait()
+
+	out := conn.writeBuf.Bytes()
+	if len(out) != frames*frameSize {
+		t.Fatalf("Expected %d bytes, got %d", frames*frameSize, len(out))
+	}
+	for i := 0; i < len(out); i += frameSize {
+		frame := out[i : i+frameSize]
+		if !bytes.Equal(frame, bytes.Repeat(frame[:1], frameSize)) {
+			t.Fatalf("Frame at offset %d was interleaved: %x", i, frame)
+		}
+	}
+}
+
 func TestManager_CloseAll(t *testing.T) {
 	log := newTestLogger()
 	cm := NewManager(10, log)
@@ -227,3 +386,26 @@ func TestClient_Fields(t *testing.T) {
 		t.Errorf("Expected Addr=192.168.1.10:54321, got %s", client.Addr)
 	}
 }
+
+func TestClient_LastReadAndCloseReason(t *testing.T) {
+	connected := time.Now().Add(-time.Minute)
+	client := &Client{ID: "client#1", Conn: newMockConn(), ConnectedAt: connected}
+
+	if !client.LastRead().Equal(connected) {
+		t.Errorf("Expected LastRead to default to ConnectedAt, got %v", client.LastRead())
+	}
+	now := time.Now()
+	client.Touch(now)
+	if !client.LastRead().Equal(now) {
+		t.Errorf("Expected LastRead %v, got %v", now, client.LastRead())
+	}
+
+	if client.CloseReason() != "" {
+		t.Errorf("Expected no close reason, got %q", client.CloseReason())
+	}
+	client.SetCloseReason("idle")
+	client.SetCloseReason("keepalive")
+	if client.CloseReason() != "idle" {
+		t.Errorf("Expected the first close reason to win, got %q", client.CloseReason())
+	}
+}
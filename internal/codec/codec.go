@@ -0,0 +1,142 @@
+// Package codec implements byte-stuffing transforms (SLIP and KISS) applied
+// to proxied traffic so clients see whole, unescaped frames.
+package codec
+
+import "fmt"
+
+// Transform names accepted by New
+const (
+	None       = "none"
+	SLIPEncode = "slip-encode"
+	SLIPDecode = "slip-decode"
+	KISSEncode = "kiss-encode"
+	KISSDecode = "kiss-decode"
+)
+
+// SLIP and KISS share the same special bytes
+const (
+	frameEnd   byte = 0xc0
+	frameEsc   byte = 0xdb
+	escEnd     byte = 0xdc
+	escEsc     byte = 0xdd
+	maxFrame        = 64 * 1024
+	kissData   byte = 0x00
+	kissCmdMsk byte = 0x0f
+)
+
+// Transform converts a byte stream. Process returns zero or more output
+// chunks; decoders keep partial frames between calls, so each stream needs
+// its own instance.
+type Transform interface {
+	Process(data []byte) [][]byte
+}
+
+// New returns the named transform, or nil for "" and "none"
+func New(name string) (Transform, error) {
+	switch name {
+	case "", None:
+		return nil, nil
+	case SLIPEncode:
+		return encoder{}, nil
+	case SLIPDecode:
+		return &decoder{}, nil
+	case KISSEncode:
+		return encoder{kiss: true}, nil
+	case KISSDecode:
+		return &decoder{kiss: true}, nil
+	default:
+		return nil, fmt.Errorf("unknown transform %q", name)
+	}
+}
+
+// Apply runs data through t, passing it through unchanged when t is nil
+func Apply(t Transform, data []byte) [][]byte {
+	if t == nil {
+		return [][]byte{data}
+	}
+	return t.Process(data)
+}
+
+// encoder wraps each chunk in one frame
+type encoder struct {
+	kiss bool
+}
+
+func (e encoder) Process(data []byte) [][]byte {
+	out := make([]byte, 0, len(data)+4)
+	out = append(out, frameEnd)
+	if e.kiss {
+		out = append(out, kissData) // data frame on port 0
+	}
+	for _, b := range data {
+		switch b {
+		case frameEnd:
+			out = append(out, frameEsc, escEnd)
+		case frameEsc:
+			out = append(out, frameEsc, escEsc)
+		default:
+			out = append(out, b)
+		}
+	}
+	return [][]byte{append(out, frameEnd)}
+}
+
+// decoder reassembles frames from a stuffed byte stream
+type decoder struct {
+	kiss    bool
+	buf     []byte
+	escaped bool
+}
+
+func (d *decoder) Process(data []byte) [][]byte {
+	var frames [][]byte
+	for _, b := range data {
+		if d.escaped {
+			d.escaped = false
+			switch b {
+			case escEnd:
+				b = frameEnd
+			case escEsc:
+				b = frameEsc
+			}
+			d.buf = append(d.buf, b)
+			continue
+		}
+
+		switch b {
+		case frameEnd:
+			if frame, ok := d.finish(); ok {
+				frames = append(frames, frame)
+			}
+		case frameEsc:
+			d.escaped = true
+		default:
+			if len(d.buf) >= maxFrame {
+				// Runaway frame without END; drop it
+				d.buf = d.buf[:0]
+			}
+			d.buf = append(d.buf, b)
+		}
+	}
+	return frames
+}
+
+// finish completes the current frame. Empty frames (back-to-back END bytes)
+// and KISS command frames are dropped.
+func (d *decoder) finish() ([]byte, bool) {
+	frame := d.buf
+	d.buf = nil
+	if len(frame) == 0 {
+		return nil, false
+	}
+	if d.kiss {
+		if frame[0]&kissCmdMsk != kissData {
+			return nil, false
+		}
+		frame = frame[1:]
+		if len(frame) == 0 {
+			return nil, false
+		}
+	}
+	return frame, true
+}
@@ -0,0 +1,75 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSLIP_RoundTrip(t *testing.T) {
+	enc, _ := New(SLIPEncode)
+	dec, _ := New(SLIPDecode)
+
+	payload := []byte{0x01, 0xc0, 0x02, 0xdb, 0x03}
+	encoded := enc.Process(payload)[0]
+
+	expected := []byte{0xc0, 0x01, 0xdb, 0xdc, 0x02, 0xdb, 0xdd, 0x03, 0xc0}
+	if !bytes.Equal(encoded, expected) {
+		t.Fatalf("Expected %x, got %x", expected, encoded)
+	}
+
+	// Feed the encoded frame split across reads
+	var frames [][]byte
+	frames = append(frames, dec.Process(encoded[:3])...)
+	frames = append(frames, dec.Process(encoded[3:])...)
+	if len(frames) != 1 || !bytes.Equal(frames[0], payload) {
+		t.Errorf("Expected one frame %x, got %x", payload, frames)
+	}
+}
+
+func TestSLIP_DecodeMultipleFrames(t *testing.T) {
+	dec, _ := New(SLIPDecode)
+
+	frames := dec.Process([]byte{0xc0, 0xc0, 0x01, 0xc0, 0x02, 0x03, 0xc0, 0x04})
+	if len(frames) != 2 {
+		t.Fatalf("Expected 2 frames, got %d", len(frames))
+	}
+	if !bytes.Equal(frames[0], []byte{0x01}) || !bytes.Equal(frames[1], []byte{0x02, 0x03}) {
+		t.Errorf("Unexpected frames %x", frames)
+	}
+
+	// Trailing partial frame completes later
+	frames = dec.Process([]byte{0x05, 0xc0})
+	if len(frames) != 1 || !bytes.Equal(frames[0], []byte{0x04, 0x05}) {
+		t.Errorf("Unexpected frames %x", frames)
+	}
+}
+
+func TestKISS(t *testing.T) {
+	enc, _ := New(KISSEncode)
+	dec, _ := New(KISSDecode)
+
+	encoded := enc.Process([]byte{0xaa, 0xc0})[0]
+	expected := []byte{0xc0, 0x00, 0xaa, 0xdb, 0xdc, 0xc0}
+	if !bytes.Equal(encoded, expected) {
+		t.Fatalf("Expected %x, got %x", expected, encoded)
+	}
+
+	// A TXDELAY command frame is dropped, the data frame is kept
+	stream := append([]byte{0xc0, 0x01, 0x32, 0xc0}, encoded...)
+	frames := dec.Process(stream)
+	if len(frames) != 1 || !bytes.Equal(frames[0], []byte{0xaa, 0xc0}) {
+		t.Errorf("Unexpected frames %x", frames)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if tr, err := New(""); tr != nil || err != nil {
+		t.Errorf("Expected nil transform for empty name")
+	}
+	if _, err := New("base64"); err == nil {
+		t.Error("Expected error for unknown transform")
+	}
+	if out := Apply(nil, []byte{0x01}); len(out) != 1 || out[0][0] != 0x01 {
+		t.Errorf("Expected passthrough, got %x", out)
+	}
+}
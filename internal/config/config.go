@@ -3,41 +3,725 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/codec"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/fec"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/hexutil"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/rfc2217"
+)
+
+// Upstream transport types selectable via UPSTREAM_TYPE
+const (
+	UpstreamTypeTCP  = "tcp"
+	UpstreamTypeMQTT = "mqtt"
 )
 
 type Config struct {
-	UpstreamHost    string        `json:"upstream_host"`
-	UpstreamPort    int           `json:"upstream_port"`
-	ListenPort      int           `json:"listen_port"`
-	MaxClients      int           `json:"max_clients"`
-	LogPackets      bool          `json:"log_packets"`
-	LogFile         string        `json:"log_file"`
-	WebPort         int           `json:"web_port"`
-	WebAuthEnabled  bool          `json:"web_auth_enabled"`
-	WebAuthUsername string        `json:"web_auth_username"`
-	WebAuthPassword string        `json:"web_auth_password"`
-	ReconnectDelay  time.Duration `json:"-"`
+	UpstreamHost      string         `json:"upstream_host"`
+	UpstreamPort      int            `json:"upstream_port"`
+	UpstreamURL       string         `json:"upstream_url"`
+	UpstreamType      string         `json:"upstream_type"`
+	UpstreamName      string         `json:"upstream_name"`
+	TCPUserTimeout    int            `json:"upstream_tcp_user_timeout"`   // seconds unacknowledged upstream writes may wait before the connection fails, 0 = OS default
+	TCPKeepIdle       int            `json:"upstream_keepalive_idle"`     // seconds of silence before upstream keepalive probes, 0 = Go default
+	TCPKeepInterval   int            `json:"upstream_keepalive_interval"` // seconds between keepalive probes, 0 = OS default
+	TCPKeepCount      int            `json:"upstream_keepalive_count"`    // unanswered probes before the connection fails, 0 = OS default
+	SocketDSCP        int            `json:"socket_dscp"`                 // DSCP marking of upstream and client traffic, 0 = unmarked
+	SocketPriority    int            `json:"socket_priority"`             // SO_PRIORITY of upstream and client sockets, 0 = OS default
+	WaitForUpstream   string         `json:"wait_for_upstream"`           // how long to hold back client listeners at startup, e.g. "30s"
+	Upstreams         []UpstreamSpec `json:"upstreams"`                   // additional upstreams merged into one stream
+	UpstreamWrite     string         `json:"upstream_write_target"`       // upstream name receiving client writes, or "all"
+	UpstreamTags      bool           `json:"upstream_source_tags"`        // prefix frames with a source header
+	UpstreamDetect    bool           `json:"upstream_detect"`             // tell raw TCP, Telnet and RFC 2217 apart on connect
+	UpstreamQuirks    []string       `json:"upstream_quirks"`             // workarounds for firmware serial bridges, see Quirk*
+	TransformFrom     string         `json:"transform_from_upstream"`     // codec applied to upstream data
+	TransformTo       string         `json:"transform_to_upstream"`       // codec applied to client data
+	FrameGapMs        int            `json:"frame_gap_ms"`                // quiet time ending an upstream frame, 0 disables
+	ResponseTimeoutMs int            `json:"response_timeout_ms"`         // how long the device may take to answer a client write, 0 disables
+	FairWrites        bool           `json:"fair_write_scheduling"`       // round-robin client writes to the upstream
+	LatencyBudgetMs   int            `json:"latency_budget_ms"`           // warn when forwarding a packet takes longer, 0 disables
+	ClientPriority    []PriorityRule `json:"client_priorities"`           // per-client scheduling weights
+	OutagePolicy      string         `json:"client_outage_policy"`        // "drop", "close" or "buffer" for client writes while the upstream is down
+	OutageBuffer      int            `json:"client_outage_buffer"`        // bytes held per client by the "buffer" policy
+	OutageRules       []OutageRule   `json:"client_outage_policies"`      // per-client outage policies
+	WriteRetryFrames  int            `json:"upstream_retry_frames"`       // client frames kept for retry after a failed upstream write, 0 disables
+	WriteRetryMaxAge  int            `json:"upstream_retry_max_age_ms"`   // how long a frame may wait for its retry
+	ClientAccess      string         `json:"client_access"`               // "write", "read" or "inject" for clients without a matching rule
+	AccessRules       []AccessRule   `json:"client_access_rules"`         // per-client access by address or name
+	ClientGroups      []ClientGroup  `json:"client_groups"`               // named clients targeted by injections, with upstream filters
+	RefusedWrites     string         `json:"client_refused_writes"`       // "drop", "reset" or "error" for writes without write access
+	RefusedMessage    string         `json:"client_refused_message"`      // text line sent back by "error"
+	MQTTBroker        string         `json:"mqtt_broker"`
+	MQTTUsername      string         `json:"mqtt_username"`
+	MQTTPassword      string         `json:"mqtt_password"`
+	MQTTClientID      string         `json:"mqtt_client_id"`
+	MQTTRxTopic       string         `json:"mqtt_rx_topic"`
+	MQTTTxTopic       string         `json:"mqtt_tx_topic"`
+	ListenPort        int            `json:"listen_port"`
+	StatusListenPort  int            `json:"status_listen_port"`
+	ListenProfile     string         `json:"listen_profile"`
+	ListenSingle      bool           `json:"listen_single_client"`
+	RawListenProfile  string         `json:"raw_listen_profile"`
+	RawListenSingle   bool           `json:"raw_listen_single_client"`
+	RawListenPort     int            `json:"raw_listen_port"`   // second port carrying the unprocessed stream, 0 disables
+	ListenFormat      string         `json:"listen_format"`     // "binary" or "hex" for LISTEN_PORT clients
+	RawListenFormat   string         `json:"raw_listen_format"` // "binary" or "hex" for RAW_LISTEN_PORT clients
+	ClientEngine      string         `json:"client_engine"`     // "goroutine" or "epoll" for reading client connections
+	MaxClients        int            `json:"max_clients"`
+	MaxClientsPerIP   int            `json:"max_clients_per_ip"`       // open connections per source IP, 0 for no limit
+	ConnectRate       int            `json:"connect_rate_limit"`       // connection attempts per source IP per minute, 0 for no limit
+	GreylistSecs      int            `json:"connect_greylist_seconds"` // how long an IP exceeding ConnectRate is refused
+	ClientBanner      string         `json:"client_banner"`            // text line sent to every client on connect
+	IdentTimeout      int            `json:"client_ident_timeout"`     // seconds to wait for an "IDENT <name>" line, 0 disables
+	ClientIDs         string         `json:"client_ids"`               // "sequential" (client#N) or "stable" (from source IP and name)
+	LivenessTimeout   int            `json:"client_liveness_timeout"`  // seconds a client may stay silent or unreachable before it is reaped, 0 disables
+	LivenessCheck     string         `json:"client_liveness_check"`    // "data" or "keepalive", see CLIENT_LIVENESS_TIMEOUT
+	HeartbeatFrame    string         `json:"client_heartbeat_frame"`   // hex frame sent to clients after HeartbeatSecs without traffic
+	HeartbeatSecs     int            `json:"client_heartbeat_seconds"` // 0 disables heartbeat frames
+	ControllerSecs    int            `json:"client_controller_window"` // seconds within which commands from two clients to one coordinator conflict, 0 disables
+	FlashAutoDetect   bool           `json:"flash_auto_detect"`        // start flashing mode for clients opening with RFC 2217
+	InjectEnabled     *bool          `json:"inject_enabled"`           // injections, macros and triggers; nil means enabled
+	DryRun            bool           `json:"dry_run"`                  // log and count client writes without forwarding them
+	StartParked       bool           `json:"start_parked"`             // start with the upstream released and clients refused
+	LogPackets        bool           `json:"log_packets"`
+	LogFile           string         `json:"log_file"`
+	LogDirections     []string       `json:"log_packet_directions"` // "from_upstream", "to_upstream"; empty logs both
+	LogSources        []string       `json:"log_packet_sources"`    // source patterns such as "client#3" or "client#*"
+	LogDeltas         bool           `json:"log_packet_deltas"`     // add the time since the previous packet per direction
+	LogOffsets        bool           `json:"log_packet_offsets"`    // add per-direction packet numbers and byte offsets
+	WriteJournal      string         `json:"write_journal"`         // append-only file recording every write toward the upstream, "" disables
+	JournalMaxMB      int            `json:"write_journal_max_mb"`  // size at which the journal is rotated, 0 for DefaultJournalMB
+	JournalFiles      int            `json:"write_journal_files"`   // rotated journal files kept, 0 keeps all
+	WebPort           int            `json:"web_port"`
+	WebBindRetry      int            `json:"web_bind_retry_seconds"`        // how long to retry WEB_PORT while it is in use, 0 tries once
+	WebFallbackPorts  []int          `json:"web_fallback_ports"`            // ports tried in order when WEB_PORT cannot be bound, 0 for any free port
+	HealthDegraded    int            `json:"health_data_degraded_seconds"`  // upstream silence marking health degraded, 0 disables
+	HealthUnhealthy   int            `json:"health_data_unhealthy_seconds"` // upstream silence marking health unhealthy, 0 disables
+	HealthDebounce    int            `json:"health_debounce_seconds"`       // upstream outages shorter than this neither change health nor fire hooks
+	WebLogLines       int            `json:"web_log_buffer"`                // log lines kept for new web clients and /api/logs
+	WebPacketLines    int            `json:"web_packet_buffer"`             // packet lines kept, separately from log lines
+	WebLogMaxAge      int            `json:"web_log_max_age"`               // seconds; older buffered lines are dropped, 0 keeps them
+	WebStatusPush     *bool          `json:"web_status_push"`               // periodic status messages to web clients; nil means enabled
+	WebStatusInterval int            `json:"web_status_interval"`           // seconds between status messages
+	WebSSEHeartbeat   int            `json:"web_sse_heartbeat"`             // seconds between SSE heartbeat comments
+	WebWSPing         int            `json:"web_ws_ping_interval"`          // seconds between WebSocket pings
+	WebPacketEvents   bool           `json:"web_packet_events"`             // packet events with hex, text and likely_ascii
+	ACMEDomains       []string       `json:"web_acme_domains"`              // hostnames served over HTTPS with ACME certificates
+	ACMEEmail         string         `json:"web_acme_email"`                // contact for expiry notices
+	ACMECacheDir      string         `json:"web_acme_cache_dir"`            // account key and certificate storage
+	ACMEDirectory     string         `json:"web_acme_directory_url"`        // CA directory, default Let's Encrypt production
+	ACMEHTTPPort      int            `json:"web_acme_http_port"`            // HTTP-01 challenge and redirect port, 0 disables
+	QUICListenPort    int            `json:"quic_listen_port"`
+	QUICCertFile      string         `json:"quic_cert_file"`
+	QUICKeyFile       string         `json:"quic_key_file"`
+	MuxListenPort     int            `json:"mux_listen_port"` // upstreams as channels of one TLS connection per peer
+	TLSListenPort     int            `json:"tls_listen_port"`
+	TLSCertFile       string         `json:"tls_cert_file"`
+	TLSKeyFile        string         `json:"tls_key_file"`
+	TLSRoutes         []TLSRoute     `json:"tls_routes"` // SNI or ALPN to upstream
+	WebAuthEnabled    bool           `json:"web_auth_enabled"`
+	WebAuthUsername   string         `json:"web_auth_username"`
+	WebAuthPassword   string         `json:"web_auth_password"`
+	WebAdminUsername  string         `json:"web_admin_username"` // account allowed to override DenyFrames
+	WebAdminPassword  string         `json:"web_admin_password"`
+	WebSessionLife    int            `json:"web_session_lifetime"`     // seconds a login lasts at most
+	WebSessionIdle    int            `json:"web_session_idle_timeout"` // seconds without requests that end a login, 0 disables
+	InfluxURL         string         `json:"influx_url"`
+	InfluxDatabase    string         `json:"influx_database"`
+	InfluxOrg         string         `json:"influx_org"`
+	InfluxBucket      string         `json:"influx_bucket"`
+	InfluxToken       string         `json:"influx_token"`
+	InfluxInterval    int            `json:"influx_interval"` // seconds
+	InfluxTags        string         `json:"influx_tags"`     // comma-separated key=value pairs
+	StatsdAddr        string         `json:"statsd_addr"`
+	StatsdPrefix      string         `json:"statsd_prefix"`
+	StatsdInterval    int            `json:"statsd_interval"` // seconds
+	Triggers          []TriggerRule  `json:"triggers"`
+	DenyFrames        []DenyRule     `json:"deny_frames"` // frames never written to an upstream
+	MacrosFile        string         `json:"macros_file"`
+	StorageBackend    string         `json:"storage_backend"`
+	StoragePath       string         `json:"storage_path"`
+	RetentionMaxMB    int            `json:"retention_max_mb"`
+	RetentionMaxAge   int            `json:"retention_max_age_days"`
+	OnUpstreamUp      string         `json:"on_upstream_up"` // commands run with sh -c on connection events
+	OnUpstreamDown    string         `json:"on_upstream_down"`
+	OnClientConnect   string         `json:"on_client_connect"`
+	OnClientClose     string         `json:"on_client_disconnect"`
+	HookTimeout       int            `json:"hook_timeout"` // seconds a hook may run
+	RecoveryAfter     int            `json:"recovery_after_failures"`
+	RecoveryURL       string         `json:"recovery_url"`
+	RecoveryMethod    string         `json:"recovery_method"`
+	RecoveryTopic     string         `json:"recovery_mqtt_topic"`
+	RecoveryPayload   string         `json:"recovery_mqtt_payload"`
+	RecoveryPause     int            `json:"recovery_cooldown"`     // seconds between actions
+	RecoveryMax       int            `json:"recovery_max_attempts"` // actions until the upstream connects, 0 = unlimited
+	InitSequence      []InitFrame    `json:"init_sequence"`
+	Polls             []PollRule     `json:"polls"`
+	Values            []ValueRule    `json:"values"`
+	ReconnectDelay    time.Duration  `json:"-"`
+
+	sources map[string]string // field name to SourceOptions or SourceEnv
 }
 
-func Load() (*Config, error) {
-	config := &Config{
+// Client stream formats selectable per port via LISTEN_FORMAT and
+// RAW_LISTEN_FORMAT
+const (
+	FormatBinary = "binary"
+	FormatHex    = "hex" // one frame per line as hex bytes, for netcat/telnet
+)
+
+// Client port profiles selectable per port via LISTEN_PROFILE and
+// RAW_LISTEN_PROFILE
+const (
+	ProfileDefault = "default"
+	ProfileESPHome = "esphome" // like ESPHome's stream_server: raw passthrough, no banner or IDENT
+)
+
+// Upstream quirks selectable via UPSTREAM_QUIRKS, for firmware serial
+// bridges such as Tasmota and ESP-Link
+const (
+	QuirkBanner = "banner" // discard what the bridge sends in the first seconds of a connection
+	QuirkTelnet = "telnet" // strip Telnet negotiation without answering it
+	QuirkOTA    = "ota"    // reconnect every second for a while after the connection drops
+)
+
+// Client connection engines selectable via CLIENT_ENGINE
+const (
+	EngineGoroutine = "goroutine" // one goroutine blocked in Read per client
+	EngineEpoll     = "epoll"     // one epoll instance for idle clients, Linux only
+)
+
+// Storage backends selectable via STORAGE_BACKEND
+const (
+	StorageMemory = "memory" // kept in memory, lost on restart
+	StorageSQLite = "sqlite" // kept in the SQLite database at STORAGE_PATH
+)
+
+// Liveness checks selectable via CLIENT_LIVENESS_CHECK
+const (
+	LivenessData      = "data"      // the client must send a byte within the timeout
+	LivenessKeepalive = "keepalive" // TCP keepalive probes must be answered within the timeout
+)
+
+// Client ID schemes selectable via CLIENT_IDS
+const (
+	ClientIDsSequential = "sequential" // client#1, client#2, ... in connection order
+	ClientIDsStable     = "stable"     // derived from the source IP and announced name
+)
+
+// UpstreamAll is the write target sending client data to every upstream
+const UpstreamAll = "all"
+
+// UpstreamSpec names an additional upstream device
+type UpstreamSpec struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"` // host:port or tcp://, ws://, wss://, quic://, mux:// URL
+}
+
+// TLSRoute binds clients of the TLS listener to one upstream by the server
+// name (SNI) or application protocol (ALPN) they ask for
+type TLSRoute struct {
+	SNI      string `json:"sni"`  // hostname, * matches any characters
+	ALPN     string `json:"alpn"` // protocol token offered by the client
+	Upstream string `json:"upstream"`
+}
+
+// Validate checks that the route matches on exactly one of SNI and ALPN
+func (r TLSRoute) Validate() error {
+	if (r.SNI == "") == (r.ALPN == "") {
+		return fmt.Errorf("TLS route to %q: exactly one of sni and alpn is required", r.Upstream)
+	}
+	if _, err := path.Match(r.SNI, ""); err != nil {
+		return fmt.Errorf("TLS route to %q: invalid sni pattern %q", r.Upstream, r.SNI)
+	}
+	return nil
+}
+
+// Matches reports whether a client that sent serverName and negotiated
+// protocol is routed by r. Server names compare case-insensitively.
+func (r TLSRoute) Matches(serverName, protocol string) bool {
+	if r.ALPN != "" {
+		return protocol == r.ALPN
+	}
+	ok, _ := path.Match(strings.ToLower(r.SNI), strings.ToLower(serverName))
+	return ok && serverName != ""
+}
+
+// InitFrame is one frame of the sequence sent to the upstream after each
+// connect
+type InitFrame struct {
+	Data    string `json:"data"`     // hex bytes
+	DelayMs int    `json:"delay_ms"` // wait before sending this frame
+}
+
+// PollRule describes a query frame sent periodically to the upstream and how
+// its response is recognized
+type PollRule struct {
+	Name           string `json:"name"`
+	Query          string `json:"query"`           // hex frame sent to the upstream
+	Interval       int    `json:"interval"`        // seconds between queries
+	ResponsePrefix string `json:"response_prefix"` // hex prefix identifying the response
+	ResponseLength int    `json:"response_length"` // expected response size, 0 for any
+	Timeout        int    `json:"timeout_ms"`      // response timeout, default 1000
+}
+
+// Validate checks that the rule is well formed
+func (p PollRule) Validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("poll name is required")
+	}
+	if b, err := hexutil.Parse(p.Query); err != nil || len(b) == 0 {
+		return fmt.Errorf("poll %q: query must be non-empty hex", p.Name)
+	}
+	if p.Interval <= 0 {
+		return fmt.Errorf("poll %q: interval must be positive", p.Name)
+	}
+	if _, err := hexutil.Parse(p.ResponsePrefix); err != nil {
+		return fmt.Errorf("poll %q: invalid response_prefix: %w", p.Name, err)
+	}
+	if p.ResponseLength < 0 {
+		return fmt.Errorf("poll %q: response_length must not be negative", p.Name)
+	}
+	if p.Timeout < 0 || p.Timeout > p.Interval*1000 {
+		return fmt.Errorf("poll %q: timeout_ms must be between 0 and the interval", p.Name)
+	}
+	return nil
+}
+
+// maxWebBuffer bounds WEB_LOG_BUFFER and WEB_PACKET_BUFFER
+const maxWebBuffer = 1000000
+
+// maxUpstreamWait bounds WAIT_FOR_UPSTREAM
+const maxUpstreamWait = time.Hour
+
+// maxWebInterval bounds the web status, heartbeat and ping intervals
+const maxWebInterval = 3600
+
+// maxSessionLife bounds WEB_SESSION_LIFETIME, one year
+const maxSessionLife = 365 * 86400
+
+// DefaultJournalMB is the size at which the WRITE_JOURNAL file is rotated
+// when WRITE_JOURNAL_MAX_MB is 0
+const DefaultJournalMB = 10
+
+// maxJournalMB bounds WRITE_JOURNAL_MAX_MB
+const maxJournalMB = 10240
+
+// MaxPriority bounds a client's scheduling weight
+const MaxPriority = 16
+
+// PriorityRule gives clients whose address matches Match (an IP or CIDR)
+// Priority frames per scheduling round instead of one
+type PriorityRule struct {
+	Match    string `json:"match"`
+	Priority int    `json:"priority"`
+}
+
+// Validate checks that the rule is well formed
+func (p PriorityRule) Validate() error {
+	if !validMatch(p.Match) {
+		return fmt.Errorf("client priority %q: match must be an IP address or CIDR", p.Match)
+	}
+	if p.Priority < 1 || p.Priority > MaxPriority {
+		return fmt.Errorf("client priority %q: priority must be between 1 and %d", p.Match, MaxPriority)
+	}
+	return nil
+}
+
+// Matches reports whether the client IP falls under the rule
+func (p PriorityRule) Matches(ip net.IP) bool {
+	return matchIP(p.Match, ip)
+}
+
+// Client write policies while the upstream is down, selected by
+// CLIENT_OUTAGE_POLICY
+const (
+	OutageDrop   = "drop"   // discard the data (default)
+	OutageClose  = "close"  // disconnect the client
+	OutageBuffer = "buffer" // hold the data until the upstream is back
+)
+
+// DefaultOutageBuffer is the CLIENT_OUTAGE_BUFFER default
+const DefaultOutageBuffer = 4096
+
+// maxOutageBuffer bounds the bytes held per client
+const maxOutageBuffer = 1 << 20
+
+// DefaultWriteRetryMaxAge is the UPSTREAM_RETRY_MAX_AGE_MS default
+const DefaultWriteRetryMaxAge = 3000
+
+// Bounds for UPSTREAM_RETRY_FRAMES and UPSTREAM_RETRY_MAX_AGE_MS
+const (
+	maxWriteRetryFrames = 1024
+	maxWriteRetryAge    = 60000
+)
+
+// OutageRule selects the outage policy of clients whose address matches
+// Match (an IP or CIDR)
+type OutageRule struct {
+	Match  string `json:"match"`
+	Policy string `json:"policy"`
+	Buffer int    `json:"buffer"` // bytes for the "buffer" policy, 0 uses CLIENT_OUTAGE_BUFFER
+}
+
+// Validate checks that the rule is well formed
+func (o OutageRule) Validate() error {
+	if !validMatch(o.Match) {
+		return fmt.Errorf("client outage policy %q: match must be an IP address or CIDR", o.Match)
+	}
+	if !validOutagePolicy(o.Policy) {
+		return fmt.Errorf("client outage policy %q: policy must be %q, %q or %q", o.Match, OutageDrop, OutageClose, OutageBuffer)
+	}
+	if o.Buffer < 0 || o.Buffer > maxOutageBuffer {
+		return fmt.Errorf("client outage policy %q: buffer must be between 0 and %d", o.Match, maxOutageBuffer)
+	}
+	return nil
+}
+
+// Matches reports whether the client IP falls under the rule
+func (o OutageRule) Matches(ip net.IP) bool {
+	return matchIP(o.Match, ip)
+}
+
+func validOutagePolicy(policy string) bool {
+	return policy == OutageDrop || policy == OutageClose || policy == OutageBuffer
+}
+
+// Client access levels selected by CLIENT_ACCESS and CLIENT_ACCESS_RULES
+const (
+	AccessWrite  = "write"  // receive upstream data and write to the upstream (default)
+	AccessRead   = "read"   // receive only; writes are dropped
+	AccessInject = "inject" // receive only; the device is changed through /api/inject
+	AccessDeny   = "deny"   // the connection is refused
+)
+
+// Responses to a write from a client without write access, selected by
+// CLIENT_REFUSED_WRITES. The data is dropped in every case.
+const (
+	RefuseDrop  = "drop"  // drop silently, logging the first one (default)
+	RefuseReset = "reset" // disconnect the client with a TCP reset
+	RefuseError = "error" // send CLIENT_REFUSED_MESSAGE back to the client
+)
+
+// DefaultRefusedMessage is the CLIENT_REFUSED_MESSAGE default
+const DefaultRefusedMessage = "ERROR write access denied"
+
+// AccessRule sets the access level of clients whose address matches Match
+// (an IP or CIDR) and whose announced name matches Name (a pattern such as
+// "dashboard-*"). Either may be empty, but not both. A rule with Hours
+// only applies within them, see ParseHours.
+type AccessRule struct {
+	Match  string `json:"match"`
+	Name   string `json:"name"`
+	Access string `json:"access"`
+	Hours  string `json:"hours"`
+}
+
+// Validate checks that the rule is well formed
+func (a AccessRule) Validate() error {
+	if a.Match == "" && a.Name == "" {
+		return fmt.Errorf("client access rule: match or name is required")
+	}
+	if a.Match != "" && !validMatch(a.Match) {
+		return fmt.Errorf("client access rule %q: match must be an IP address or CIDR", a.Match)
+	}
+	if _, err := path.Match(a.Name, ""); err != nil {
+		return fmt.Errorf("client access rule %q: invalid name pattern", a.Name)
+	}
+	if !validAccess(a.Access) {
+		return fmt.Errorf("client access rule %q: access must be %q, %q, %q or %q", a.Match+a.Name, AccessWrite, AccessRead, AccessInject, AccessDeny)
+	}
+	if _, err := ParseHours(a.Hours); a.Hours != "" && err != nil {
+		return fmt.Errorf("client access rule %q: hours: %w", a.Match+a.Name, err)
+	}
+	return nil
+}
+
+// Matches reports whether a client with the given IP and announced name
+// falls under the rule. A rule with a name pattern does not match clients
+// that did not announce a name.
+func (a AccessRule) Matches(ip net.IP, name string) bool {
+	if a.Match != "" && !matchIP(a.Match, ip) {
+		return false
+	}
+	if a.Name != "" {
+		ok, _ := path.Match(a.Name, name)
+		return name != "" && ok
+	}
+	return true
+}
+
+func validAccess(access string) bool {
+	return access == AccessWrite || access == AccessRead || access == AccessInject || access == AccessDeny
+}
+
+// validMatch reports whether match is an IP address or CIDR
+func validMatch(match string) bool {
+	if net.ParseIP(match) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(match)
+	return err == nil
+}
+
+// matchIP reports whether ip equals the address or falls in the CIDR match
+func matchIP(match string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if rip := net.ParseIP(match); rip != nil {
+		return rip.Equal(ip)
+	}
+	_, network, err := net.ParseCIDR(match)
+	return err == nil && network.Contains(ip)
+}
+
+// ClientGroup names the clients whose address matches Match (an IP or
+// CIDR) and whose announced name matches Client (a pattern as in
+// CLIENT_ACCESS_RULES), so that injections and trigger responses can
+// target them as "group:<name>". With Filter, the group only receives the
+// upstream frames starting with one of its hex prefixes.
+type ClientGroup struct {
+	Name   string   `json:"name"`
+	Match  string   `json:"match"`
+	Client string   `json:"client"`
+	Filter []string `json:"filter"`
+}
+
+// Validate checks that the group is well formed
+func (g ClientGroup) Validate() error {
+	if g.Name == "" {
+		return fmt.Errorf("client group name is required")
+	}
+	if g.Match == "" && g.Client == "" {
+		return fmt.Errorf("client group %q: match or client is required", g.Name)
+	}
+	if g.Match != "" && !validMatch(g.Match) {
+		return fmt.Errorf("client group %q: match must be an IP address or CIDR", g.Name)
+	}
+	if _, err := path.Match(g.Client, ""); err != nil {
+		return fmt.Errorf("client group %q: invalid client pattern", g.Name)
+	}
+	for _, prefix := range g.Filter {
+		if b, err := hexutil.Parse(prefix); err != nil || len(b) == 0 {
+			return fmt.Errorf("client group %q: invalid filter %q", g.Name, prefix)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether a client with the given IP and announced name
+// belongs to the group, as AccessRule.Matches does for a rule
+func (g ClientGroup) Matches(ip net.IP, name string) bool {
+	return AccessRule{Match: g.Match, Name: g.Client}.Matches(ip, name)
+}
+
+// ValueRule extracts a named value from frames that start with Match
+type ValueRule struct {
+	Name       string  `json:"name"`
+	Match      string  `json:"match"`     // hex prefix the frame must start with
+	Direction  string  `json:"direction"` // "from_upstream" (default), "to_upstream" or "any"
+	Offset     int     `json:"offset"`    // byte offset of the value in the frame
+	Length     int     `json:"length"`    // byte length; implied by numeric types
+	Type       string  `json:"type"`      // u8, i8, u16, i16, u32, i32, f32, f64, bcd, string or hex
+	Endian     string  `json:"endian"`    // "big" (default) or "little"
+	Scale      float64 `json:"scale"`     // multiplier for numeric values, default 1
+	Unit       string  `json:"unit"`
+	StaleAfter int     `json:"stale_after"` // seconds until the value is stale, 0 for never
+}
+
+// ValueTypeSize returns the byte length of a fixed-size value type
+func ValueTypeSize(typ string) (int, bool) {
+	switch typ {
+	case "u8", "i8":
+		return 1, true
+	case "u16", "i16":
+		return 2, true
+	case "u32", "i32", "f32":
+		return 4, true
+	case "f64":
+		return 8, true
+	}
+	return 0, false
+}
+
+// Validate checks that the rule is well formed
+func (v ValueRule) Validate() error {
+	if v.Name == "" {
+		return fmt.Errorf("value name is required")
+	}
+	if _, err := hexutil.Parse(v.Match); err != nil {
+		return fmt.Errorf("value %q: invalid match: %w", v.Name, err)
+	}
+	switch v.Direction {
+	case "", "from_upstream", "to_upstream", "any":
+	default:
+		return fmt.Errorf("value %q: invalid direction %q", v.Name, v.Direction)
+	}
+	if v.StaleAfter < 0 {
+		return fmt.Errorf("value %q: stale_after must not be negative", v.Name)
+	}
+	if v.Offset < 0 || v.Length < 0 {
+		return fmt.Errorf("value %q: offset and length must not be negative", v.Name)
+	}
+	switch v.Type {
+	case "bcd":
+		if v.Length == 0 {
+			return fmt.Errorf("value %q: length is required for type bcd", v.Name)
+		}
+	case "string", "hex":
+	default:
+		size, ok := ValueTypeSize(v.Type)
+		if !ok {
+			return fmt.Errorf("value %q: invalid type %q", v.Name, v.Type)
+		}
+		if v.Length != 0 && v.Length != size {
+			return fmt.Errorf("value %q: length %d does not match type %s", v.Name, v.Length, v.Type)
+		}
+	}
+	switch v.Endian {
+	case "", "big", "little":
+	default:
+		return fmt.Errorf("value %q: invalid endian %q", v.Name, v.Endian)
+	}
+	return nil
+}
+
+// TriggerRule matches packets and describes the actions to run on a match
+type TriggerRule struct {
+	Name      string `json:"name"`
+	Direction string `json:"direction"`  // "from_upstream", "to_upstream" or empty for both
+	HexPrefix string `json:"hex_prefix"` // packet must start with these bytes
+	Regex     string `json:"regex"`      // matched against the lowercase hex of the packet
+	Respond   string `json:"respond"`    // hex frame sent back toward the packet's sender
+	Suppress  bool   `json:"suppress"`   // do not forward the matching packet
+	Webhook   string `json:"webhook"`    // URL receiving a JSON POST
+	MQTTTopic string `json:"mqtt_topic"` // topic receiving a JSON message
+	Alert     bool   `json:"alert"`      // log a warning
+	Cooldown  int    `json:"cooldown"`   // minimum seconds between actions
+	Target    string `json:"target"`     // where Respond goes instead: "upstream", "downstream" or "group:<name>"
+}
+
+// Validate checks that the rule is well formed
+func (t TriggerRule) Validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("trigger name is required")
+	}
+	switch t.Direction {
+	case "", "from_upstream", "to_upstream":
+	default:
+		return fmt.Errorf("trigger %q: invalid direction %q", t.Name, t.Direction)
+	}
+	if _, err := hexutil.Parse(t.HexPrefix); err != nil {
+		return fmt.Errorf("trigger %q: invalid hex_prefix: %w", t.Name, err)
+	}
+	if _, err := regexp.Compile(t.Regex); err != nil {
+		return fmt.Errorf("trigger %q: invalid regex: %w", t.Name, err)
+	}
+	if _, err := hexutil.Parse(t.Respond); err != nil {
+		return fmt.Errorf("trigger %q: invalid respond: %w", t.Name, err)
+	}
+	if t.Respond == "" && !t.Suppress && t.Webhook == "" && t.MQTTTopic == "" && !t.Alert {
+		return fmt.Errorf("trigger %q: no action configured", t.Name)
+	}
+	if t.Target != "" && t.Respond == "" {
+		return fmt.Errorf("trigger %q: target requires respond", t.Name)
+	}
+	switch group, isGroup := strings.CutPrefix(t.Target, "group:"); {
+	case t.Target == "", t.Target == "upstream", t.Target == "downstream":
+	case isGroup && group != "":
+	default:
+		return fmt.Errorf("trigger %q: target must be \"upstream\", \"downstream\" or \"group:<name>\"", t.Name)
+	}
+	if t.Cooldown < 0 {
+		return fmt.Errorf("trigger %q: cooldown must not be negative", t.Name)
+	}
+	return nil
+}
+
+// DenyRule matches client or injected frames that must never reach an
+// upstream, such as factory-reset or bootloader-entry commands
+type DenyRule struct {
+	Name      string `json:"name"`
+	HexPrefix string `json:"hex_prefix"` // frame must start with these bytes
+	Regex     string `json:"regex"`      // matched against the lowercase hex of the frame
+}
+
+// Validate checks that the rule is well formed
+func (d DenyRule) Validate() error {
+	if d.Name == "" {
+		return fmt.Errorf("deny rule name is required")
+	}
+	if d.HexPrefix == "" && d.Regex == "" {
+		return fmt.Errorf("deny rule %q: hex_prefix or regex is required", d.Name)
+	}
+	if _, err := hexutil.Parse(d.HexPrefix); err != nil {
+		return fmt.Errorf("deny rule %q: invalid hex_prefix: %w", d.Name, err)
+	}
+	if _, err := regexp.Compile(d.Regex); err != nil {
+		return fmt.Errorf("deny rule %q: invalid regex: %w", d.Name, err)
+	}
+	return nil
+}
+
+// optionsFile is the Home Assistant add-on options file
+var optionsFile = "/data/options.json"
+
+// Default returns the configuration before options.json and the
+// environment are applied
+func Default() *Config {
+	return &Config{
 		UpstreamPort:   8899,
+		UpstreamType:   UpstreamTypeTCP,
+		MQTTClientID:   "serial-tcp-proxy",
+		UpstreamName:   "primary",
 		ListenPort:     18899,
 		MaxClients:     10,
+		GreylistSecs:   300,
+		ControllerSecs: 60,
+		WebSessionLife: 86400,
 		LogPackets:     false,
 		LogFile:        "/data/packets.log",
 		WebPort:        18080,
+		WebBindRetry:   10,
+		WebLogLines:    1000,
+		WebPacketLines: 1000,
+		ACMECacheDir:   "/data/acme",
+		ACMEHTTPPort:   80,
+		InfluxInterval: 10,
+		StatsdPrefix:   "serial_tcp_proxy.",
+		StatsdInterval: 10,
+		MacrosFile:     "/data/macros.json",
+		StorageBackend: StorageMemory,
+		StoragePath:    "/data/storage.db",
+		HookTimeout:    10,
+		RecoveryMethod: http.MethodPost,
+		RecoveryPause:  300,
+		RecoveryMax:    3,
 		ReconnectDelay: time.Second,
 	}
+}
+
+func Load() (*Config, error) {
+	config := Default()
 
 	// Try to load from Home Assistant options file first
-	if optionsData, err := os.ReadFile("/data/options.json"); err == nil {
+	if optionsData, err := os.ReadFile(optionsFile); err == nil {
 		if err := json.Unmarshal(optionsData, config); err != nil {
 			return nil, fmt.Errorf("failed to parse options.json: %w", err)
 		}
+		config.recordOptions(optionsData)
 	}
 
 	// Environment variables override file config
@@ -51,18 +735,181 @@ func Load() (*Config, error) {
 		}
 	}
 
+	if upstreamURL := os.Getenv("UPSTREAM_URL"); upstreamURL != "" {
+		config.UpstreamURL = upstreamURL
+	}
+
+	if upstreamType := os.Getenv("UPSTREAM_TYPE"); upstreamType != "" {
+		config.UpstreamType = upstreamType
+	}
+
+	for name, field := range map[string]*int{
+		"UPSTREAM_TCP_USER_TIMEOUT":   &config.TCPUserTimeout,
+		"UPSTREAM_KEEPALIVE_IDLE":     &config.TCPKeepIdle,
+		"UPSTREAM_KEEPALIVE_INTERVAL": &config.TCPKeepInterval,
+		"UPSTREAM_KEEPALIVE_COUNT":    &config.TCPKeepCount,
+		"SOCKET_DSCP":                 &config.SocketDSCP,
+		"SOCKET_PRIORITY":             &config.SocketPriority,
+	} {
+		if v := os.Getenv(name); v != "" {
+			if n, err := strconv.Atoi(v); err == nil {
+				*field = n
+			}
+		}
+	}
+
+	if wait := os.Getenv("WAIT_FOR_UPSTREAM"); wait != "" {
+		config.WaitForUpstream = wait
+	}
+
+	if broker := os.Getenv("MQTT_BROKER"); broker != "" {
+		config.MQTTBroker = broker
+	}
+
+	if mqttUsername := os.Getenv("MQTT_USERNAME"); mqttUsername != "" {
+		config.MQTTUsername = mqttUsername
+	}
+
+	if mqttPassword := os.Getenv("MQTT_PASSWORD"); mqttPassword != "" {
+		config.MQTTPassword = mqttPassword
+	}
+
+	if clientID := os.Getenv("MQTT_CLIENT_ID"); clientID != "" {
+		config.MQTTClientID = clientID
+	}
+
+	if rxTopic := os.Getenv("MQTT_RX_TOPIC"); rxTopic != "" {
+		config.MQTTRxTopic = rxTopic
+	}
+
+	if txTopic := os.Getenv("MQTT_TX_TOPIC"); txTopic != "" {
+		config.MQTTTxTopic = txTopic
+	}
+
 	if port := os.Getenv("LISTEN_PORT"); port != "" {
 		if p, err := strconv.Atoi(port); err == nil {
 			config.ListenPort = p
 		}
 	}
 
+	if port := os.Getenv("RAW_LISTEN_PORT"); port != "" {
+		if p, err := strconv.Atoi(port); err == nil {
+			config.RawListenPort = p
+		}
+	}
+
+	if port := os.Getenv("STATUS_LISTEN_PORT"); port != "" {
+		if p, err := strconv.Atoi(port); err == nil {
+			config.StatusListenPort = p
+		}
+	}
+
+	if format := os.Getenv("LISTEN_FORMAT"); format != "" {
+		config.ListenFormat = format
+	}
+
+	if format := os.Getenv("RAW_LISTEN_FORMAT"); format != "" {
+		config.RawListenFormat = format
+	}
+
+	if profile := os.Getenv("LISTEN_PROFILE"); profile != "" {
+		config.ListenProfile = profile
+	}
+	if profile := os.Getenv("RAW_LISTEN_PROFILE"); profile != "" {
+		config.RawListenProfile = profile
+	}
+	if single := os.Getenv("LISTEN_SINGLE_CLIENT"); single != "" {
+		config.ListenSingle = single == "true" || single == "1"
+	}
+	if single := os.Getenv("RAW_LISTEN_SINGLE_CLIENT"); single != "" {
+		config.RawListenSingle = single == "true" || single == "1"
+	}
+
+	if engine := os.Getenv("CLIENT_ENGINE"); engine != "" {
+		config.ClientEngine = engine
+	}
+
 	if maxClients := os.Getenv("MAX_CLIENTS"); maxClients != "" {
 		if m, err := strconv.Atoi(maxClients); err == nil {
 			config.MaxClients = m
 		}
 	}
 
+	if perIP := os.Getenv("MAX_CLIENTS_PER_IP"); perIP != "" {
+		if m, err := strconv.Atoi(perIP); err == nil {
+			config.MaxClientsPerIP = m
+		}
+	}
+
+	if rate := os.Getenv("CONNECT_RATE_LIMIT"); rate != "" {
+		if r, err := strconv.Atoi(rate); err == nil {
+			config.ConnectRate = r
+		}
+	}
+
+	if greylist := os.Getenv("CONNECT_GREYLIST_SECONDS"); greylist != "" {
+		if g, err := strconv.Atoi(greylist); err == nil {
+			config.GreylistSecs = g
+		}
+	}
+
+	if banner := os.Getenv("CLIENT_BANNER"); banner != "" {
+		config.ClientBanner = banner
+	}
+
+	if identTimeout := os.Getenv("CLIENT_IDENT_TIMEOUT"); identTimeout != "" {
+		if t, err := strconv.Atoi(identTimeout); err == nil {
+			config.IdentTimeout = t
+		}
+	}
+
+	if ids := os.Getenv("CLIENT_IDS"); ids != "" {
+		config.ClientIDs = ids
+	}
+
+	if frame := os.Getenv("CLIENT_HEARTBEAT_FRAME"); frame != "" {
+		config.HeartbeatFrame = frame
+	}
+
+	if interval := os.Getenv("CLIENT_HEARTBEAT_SECONDS"); interval != "" {
+		if n, err := strconv.Atoi(interval); err == nil {
+			config.HeartbeatSecs = n
+		}
+	}
+
+	if window := os.Getenv("CLIENT_CONTROLLER_WINDOW"); window != "" {
+		if n, err := strconv.Atoi(window); err == nil {
+			config.ControllerSecs = n
+		}
+	}
+
+	if liveness := os.Getenv("CLIENT_LIVENESS_TIMEOUT"); liveness != "" {
+		if t, err := strconv.Atoi(liveness); err == nil {
+			config.LivenessTimeout = t
+		}
+	}
+
+	if check := os.Getenv("CLIENT_LIVENESS_CHECK"); check != "" {
+		config.LivenessCheck = check
+	}
+
+	if flashAuto := os.Getenv("FLASH_AUTO_DETECT"); flashAuto != "" {
+		config.FlashAutoDetect = flashAuto == "true" || flashAuto == "1"
+	}
+
+	if injectEnabled := os.Getenv("INJECT_ENABLED"); injectEnabled != "" {
+		enabled := injectEnabled == "true" || injectEnabled == "1"
+		config.InjectEnabled = &enabled
+	}
+
+	if dryRun := os.Getenv("DRY_RUN"); dryRun != "" {
+		config.DryRun = dryRun == "true" || dryRun == "1"
+	}
+
+	if startParked := os.Getenv("START_PARKED"); startParked != "" {
+		config.StartParked = startParked == "true" || startParked == "1"
+	}
+
 	if logPackets := os.Getenv("LOG_PACKETS"); logPackets != "" {
 		config.LogPackets = logPackets == "true" || logPackets == "1"
 	}
@@ -71,58 +918,1172 @@ func Load() (*Config, error) {
 		config.LogFile = logFile
 	}
 
-	if webPort := os.Getenv("WEB_PORT"); webPort != "" {
-		if p, err := strconv.Atoi(webPort); err == nil {
-			config.WebPort = p
-		}
+	if directions := os.Getenv("LOG_PACKET_DIRECTIONS"); directions != "" {
+		config.LogDirections = splitList(directions)
 	}
 
-	if webAuthEnabled := os.Getenv("WEB_AUTH_ENABLED"); webAuthEnabled != "" {
-		config.WebAuthEnabled = webAuthEnabled == "true" || webAuthEnabled == "1"
+	if sources := os.Getenv("LOG_PACKET_SOURCES"); sources != "" {
+		config.LogSources = splitList(sources)
 	}
 
-	if webAuthUsername := os.Getenv("WEB_AUTH_USERNAME"); webAuthUsername != "" {
-		config.WebAuthUsername = webAuthUsername
+	if deltas := os.Getenv("LOG_PACKET_DELTAS"); deltas != "" {
+		config.LogDeltas = deltas == "true" || deltas == "1"
 	}
 
-	if webAuthPassword := os.Getenv("WEB_AUTH_PASSWORD"); webAuthPassword != "" {
-		config.WebAuthPassword = webAuthPassword
+	if offsets := os.Getenv("LOG_PACKET_OFFSETS"); offsets != "" {
+		config.LogOffsets = offsets == "true" || offsets == "1"
 	}
 
-	// Validate required fields
-	if config.UpstreamHost == "" {
-		return nil, fmt.Errorf("UPSTREAM_HOST is required")
+	if journal := os.Getenv("WRITE_JOURNAL"); journal != "" {
+		config.WriteJournal = journal
 	}
 
-	if config.UpstreamPort <= 0 || config.UpstreamPort > 65535 {
-		return nil, fmt.Errorf("invalid UPSTREAM_PORT: %d", config.UpstreamPort)
+	for name, field := range map[string]*int{
+		"WRITE_JOURNAL_MAX_MB": &config.JournalMaxMB,
+		"WRITE_JOURNAL_FILES":  &config.JournalFiles,
+	} {
+		if v := os.Getenv(name); v != "" {
+			if n, err := strconv.Atoi(v); err == nil {
+				*field = n
+			}
+		}
 	}
 
-	if config.ListenPort <= 0 || config.ListenPort > 65535 {
-		return nil, fmt.Errorf("invalid LISTEN_PORT: %d", config.ListenPort)
+	if webPort := os.Getenv("WEB_PORT"); webPort != "" {
+		if p, err := strconv.Atoi(webPort); err == nil {
+			config.WebPort = p
+		}
 	}
 
-	if config.MaxClients <= 0 || config.MaxClients > 100 {
-		return nil, fmt.Errorf("MAX_CLIENTS must be between 1 and 100")
+	if retry := os.Getenv("WEB_BIND_RETRY_SECONDS"); retry != "" {
+		if n, err := strconv.Atoi(retry); err == nil {
+			config.WebBindRetry = n
+		}
 	}
 
-	// Validate auth configuration
-	if config.WebAuthEnabled {
-		if config.WebAuthUsername == "" {
-			return nil, fmt.Errorf("WEB_AUTH_USERNAME is required when WEB_AUTH_ENABLED is true")
+	if fallback := os.Getenv("WEB_FALLBACK_PORTS"); fallback != "" {
+		var ports []int
+		for _, item := range splitList(fallback) {
+			p, err := strconv.Atoi(item)
+			if err != nil {
+				ports = nil
+				break
+			}
+			ports = append(ports, p)
 		}
-		if config.WebAuthPassword == "" {
-			return nil, fmt.Errorf("WEB_AUTH_PASSWORD is required when WEB_AUTH_ENABLED is true")
+		if ports != nil {
+			config.WebFallbackPorts = ports
 		}
 	}
 
-	return config, nil
-}
+	for name, field := range map[string]*int{
+		"HEALTH_DATA_DEGRADED_SECONDS":  &config.HealthDegraded,
+		"HEALTH_DATA_UNHEALTHY_SECONDS": &config.HealthUnhealthy,
+		"HEALTH_DEBOUNCE_SECONDS":       &config.HealthDebounce,
+	} {
+		if v := os.Getenv(name); v != "" {
+			if n, err := strconv.Atoi(v); err == nil {
+				*field = n
+			}
+		}
+	}
 
+	if lines := os.Getenv("WEB_LOG_BUFFER"); lines != "" {
+		if n, err := strconv.Atoi(lines); err == nil {
+			config.WebLogLines = n
+		}
+	}
+
+	if lines := os.Getenv("WEB_PACKET_BUFFER"); lines != "" {
+		if n, err := strconv.Atoi(lines); err == nil {
+			config.WebPacketLines = n
+		}
+	}
+
+	if maxAge := os.Getenv("WEB_LOG_MAX_AGE"); maxAge != "" {
+		if n, err := strconv.Atoi(maxAge); err == nil {
+			config.WebLogMaxAge = n
+		}
+	}
+
+	if statusPush := os.Getenv("WEB_STATUS_PUSH"); statusPush != "" {
+		enabled := statusPush == "true" || statusPush == "1"
+		config.WebStatusPush = &enabled
+	}
+
+	for name, field := range map[string]*int{
+		"WEB_STATUS_INTERVAL":  &config.WebStatusInterval,
+		"WEB_SSE_HEARTBEAT":    &config.WebSSEHeartbeat,
+		"WEB_WS_PING_INTERVAL": &config.WebWSPing,
+	} {
+		if v := os.Getenv(name); v != "" {
+			if n, err := strconv.Atoi(v); err == nil {
+				*field = n
+			}
+		}
+	}
+
+	if packetEvents := os.Getenv("WEB_PACKET_EVENTS"); packetEvents != "" {
+		config.WebPacketEvents = packetEvents == "true" || packetEvents == "1"
+	}
+
+	if quicPort := os.Getenv("QUIC_LISTEN_PORT"); quicPort != "" {
+		if p, err := strconv.Atoi(quicPort); err == nil {
+			config.QUICListenPort = p
+		}
+	}
+
+	if quicCert := os.Getenv("QUIC_CERT_FILE"); quicCert != "" {
+		config.QUICCertFile = quicCert
+	}
+
+	if quicKey := os.Getenv("QUIC_KEY_FILE"); quicKey != "" {
+		config.QUICKeyFile = quicKey
+	}
+
+	if muxPort := os.Getenv("MUX_LISTEN_PORT"); muxPort != "" {
+		if p, err := strconv.Atoi(muxPort); err == nil {
+			config.MuxListenPort = p
+		}
+	}
+
+	if tlsPort := os.Getenv("TLS_LISTEN_PORT"); tlsPort != "" {
+		if p, err := strconv.Atoi(tlsPort); err == nil {
+			config.TLSListenPort = p
+		}
+	}
+
+	if tlsCert := os.Getenv("TLS_CERT_FILE"); tlsCert != "" {
+		config.TLSCertFile = tlsCert
+	}
+
+	if tlsKey := os.Getenv("TLS_KEY_FILE"); tlsKey != "" {
+		config.TLSKeyFile = tlsKey
+	}
+
+	if tlsRoutes := os.Getenv("TLS_ROUTES"); tlsRoutes != "" {
+		if err := json.Unmarshal([]byte(tlsRoutes), &config.TLSRoutes); err != nil {
+			return nil, fmt.Errorf("failed to parse TLS_ROUTES: %w", err)
+		}
+	}
+
+	if influxURL := os.Getenv("INFLUX_URL"); influxURL != "" {
+		config.InfluxURL = influxURL
+	}
+
+	if influxDatabase := os.Getenv("INFLUX_DATABASE"); influxDatabase != "" {
+		config.InfluxDatabase = influxDatabase
+	}
+
+	if influxOrg := os.Getenv("INFLUX_ORG"); influxOrg != "" {
+		config.InfluxOrg = influxOrg
+	}
+
+	if influxBucket := os.Getenv("INFLUX_BUCKET"); influxBucket != "" {
+		config.InfluxBucket = influxBucket
+	}
+
+	if influxToken := os.Getenv("INFLUX_TOKEN"); influxToken != "" {
+		config.InfluxToken = influxToken
+	}
+
+	if influxInterval := os.Getenv("INFLUX_INTERVAL"); influxInterval != "" {
+		if i, err := strconv.Atoi(influxInterval); err == nil {
+			config.InfluxInterval = i
+		}
+	}
+
+	if influxTags := os.Getenv("INFLUX_TAGS"); influxTags != "" {
+		config.InfluxTags = influxTags
+	}
+
+	if statsdAddr := os.Getenv("STATSD_ADDR"); statsdAddr != "" {
+		config.StatsdAddr = statsdAddr
+	}
+
+	if statsdPrefix, ok := os.LookupEnv("STATSD_PREFIX"); ok {
+		config.StatsdPrefix = statsdPrefix
+	}
+
+	if statsdInterval := os.Getenv("STATSD_INTERVAL"); statsdInterval != "" {
+		if i, err := strconv.Atoi(statsdInterval); err == nil {
+			config.StatsdInterval = i
+		}
+	}
+
+	if triggers := os.Getenv("TRIGGERS"); triggers != "" {
+		if err := json.Unmarshal([]byte(triggers), &config.Triggers); err != nil {
+			return nil, fmt.Errorf("failed to parse TRIGGERS: %w", err)
+		}
+	}
+
+	if denyFrames := os.Getenv("DENY_FRAMES"); denyFrames != "" {
+		if err := json.Unmarshal([]byte(denyFrames), &config.DenyFrames); err != nil {
+			return nil, fmt.Errorf("failed to parse DENY_FRAMES: %w", err)
+		}
+	}
+
+	if upstreamName := os.Getenv("UPSTREAM_NAME"); upstreamName != "" {
+		config.UpstreamName = upstreamName
+	}
+
+	if upstreams := os.Getenv("UPSTREAMS"); upstreams != "" {
+		if err := json.Unmarshal([]byte(upstreams), &config.Upstreams); err != nil {
+			return nil, fmt.Errorf("failed to parse UPSTREAMS: %w", err)
+		}
+	}
+
+	if upstreamWrite := os.Getenv("UPSTREAM_WRITE_TARGET"); upstreamWrite != "" {
+		config.UpstreamWrite = upstreamWrite
+	}
+
+	if upstreamTags := os.Getenv("UPSTREAM_SOURCE_TAGS"); upstreamTags != "" {
+		config.UpstreamTags = upstreamTags == "true" || upstreamTags == "1"
+	}
+
+	if upstreamDetect := os.Getenv("UPSTREAM_DETECT"); upstreamDetect != "" {
+		config.UpstreamDetect = upstreamDetect == "true" || upstreamDetect == "1"
+	}
+
+	if quirks := os.Getenv("UPSTREAM_QUIRKS"); quirks != "" {
+		config.UpstreamQuirks = splitList(quirks)
+	}
+
+	if transformFrom := os.Getenv("TRANSFORM_FROM_UPSTREAM"); transformFrom != "" {
+		config.TransformFrom = transformFrom
+	}
+
+	if transformTo := os.Getenv("TRANSFORM_TO_UPSTREAM"); transformTo != "" {
+		config.TransformTo = transformTo
+	}
+
+	if frameGap := os.Getenv("FRAME_GAP_MS"); frameGap != "" {
+		if g, err := strconv.Atoi(frameGap); err == nil {
+			config.FrameGapMs = g
+		}
+	}
+
+	if timeout := os.Getenv("RESPONSE_TIMEOUT_MS"); timeout != "" {
+		if t, err := strconv.Atoi(timeout); err == nil {
+			config.ResponseTimeoutMs = t
+		}
+	}
+
+	if budget := os.Getenv("LATENCY_BUDGET_MS"); budget != "" {
+		if b, err := strconv.Atoi(budget); err == nil {
+			config.LatencyBudgetMs = b
+		}
+	}
+
+	if acmeDomains := os.Getenv("WEB_ACME_DOMAINS"); acmeDomains != "" {
+		config.ACMEDomains = splitList(acmeDomains)
+	}
+
+	if acmeEmail := os.Getenv("WEB_ACME_EMAIL"); acmeEmail != "" {
+		config.ACMEEmail = acmeEmail
+	}
+
+	if acmeCacheDir := os.Getenv("WEB_ACME_CACHE_DIR"); acmeCacheDir != "" {
+		config.ACMECacheDir = acmeCacheDir
+	}
+
+	if acmeDirectory := os.Getenv("WEB_ACME_DIRECTORY_URL"); acmeDirectory != "" {
+		config.ACMEDirectory = acmeDirectory
+	}
+
+	if acmeHTTPPort := os.Getenv("WEB_ACME_HTTP_PORT"); acmeHTTPPort != "" {
+		if p, err := strconv.Atoi(acmeHTTPPort); err == nil {
+			config.ACMEHTTPPort = p
+		}
+	}
+
+	if fairWrites := os.Getenv("FAIR_WRITE_SCHEDULING"); fairWrites != "" {
+		config.FairWrites = fairWrites == "true" || fairWrites == "1"
+	}
+
+	if priorities := os.Getenv("CLIENT_PRIORITIES"); priorities != "" {
+		if err := json.Unmarshal([]byte(priorities), &config.ClientPriority); err != nil {
+			return nil, fmt.Errorf("failed to parse CLIENT_PRIORITIES: %w", err)
+		}
+	}
+
+	if policy := os.Getenv("CLIENT_OUTAGE_POLICY"); policy != "" {
+		config.OutagePolicy = policy
+	}
+	if size := os.Getenv("CLIENT_OUTAGE_BUFFER"); size != "" {
+		if n, err := strconv.Atoi(size); err == nil {
+			config.OutageBuffer = n
+		}
+	}
+	if rules := os.Getenv("CLIENT_OUTAGE_POLICIES"); rules != "" {
+		if err := json.Unmarshal([]byte(rules), &config.OutageRules); err != nil {
+			return nil, fmt.Errorf("failed to parse CLIENT_OUTAGE_POLICIES: %w", err)
+		}
+	}
+
+	for name, field := range map[string]*int{
+		"UPSTREAM_RETRY_FRAMES":     &config.WriteRetryFrames,
+		"UPSTREAM_RETRY_MAX_AGE_MS": &config.WriteRetryMaxAge,
+	} {
+		if v := os.Getenv(name); v != "" {
+			if n, err := strconv.Atoi(v); err == nil {
+				*field = n
+			}
+		}
+	}
+
+	if access := os.Getenv("CLIENT_ACCESS"); access != "" {
+		config.ClientAccess = access
+	}
+	if rules := os.Getenv("CLIENT_ACCESS_RULES"); rules != "" {
+		if err := json.Unmarshal([]byte(rules), &config.AccessRules); err != nil {
+			return nil, fmt.Errorf("failed to parse CLIENT_ACCESS_RULES: %w", err)
+		}
+	}
+	if groups := os.Getenv("CLIENT_GROUPS"); groups != "" {
+		if err := json.Unmarshal([]byte(groups), &config.ClientGroups); err != nil {
+			return nil, fmt.Errorf("failed to parse CLIENT_GROUPS: %w", err)
+		}
+	}
+	if action := os.Getenv("CLIENT_REFUSED_WRITES"); action != "" {
+		config.RefusedWrites = action
+	}
+	if message := os.Getenv("CLIENT_REFUSED_MESSAGE"); message != "" {
+		config.RefusedMessage = message
+	}
+
+	if values := os.Getenv("VALUES"); values != "" {
+		if err := json.Unmarshal([]byte(values), &config.Values); err != nil {
+			return nil, fmt.Errorf("failed to parse VALUES: %w", err)
+		}
+	}
+
+	if polls := os.Getenv("POLLS"); polls != "" {
+		if err := json.Unmarshal([]byte(polls), &config.Polls); err != nil {
+			return nil, fmt.Errorf("failed to parse POLLS: %w", err)
+		}
+	}
+
+	if initSequence := os.Getenv("INIT_SEQUENCE"); initSequence != "" {
+		if err := json.Unmarshal([]byte(initSequence), &config.InitSequence); err != nil {
+			return nil, fmt.Errorf("failed to parse INIT_SEQUENCE: %w", err)
+		}
+	}
+
+	if macrosFile, ok := os.LookupEnv("MACROS_FILE"); ok {
+		config.MacrosFile = macrosFile
+	}
+
+	if backend := os.Getenv("STORAGE_BACKEND"); backend != "" {
+		config.StorageBackend = backend
+	}
+
+	if storagePath := os.Getenv("STORAGE_PATH"); storagePath != "" {
+		config.StoragePath = storagePath
+	}
+
+	if maxMB := os.Getenv("RETENTION_MAX_MB"); maxMB != "" {
+		if n, err := strconv.Atoi(maxMB); err == nil {
+			config.RetentionMaxMB = n
+		}
+	}
+
+	if maxAge := os.Getenv("RETENTION_MAX_AGE_DAYS"); maxAge != "" {
+		if n, err := strconv.Atoi(maxAge); err == nil {
+			config.RetentionMaxAge = n
+		}
+	}
+
+	for name, field := range map[string]*string{
+		"ON_UPSTREAM_UP":       &config.OnUpstreamUp,
+		"ON_UPSTREAM_DOWN":     &config.OnUpstreamDown,
+		"ON_CLIENT_CONNECT":    &config.OnClientConnect,
+		"ON_CLIENT_DISCONNECT": &config.OnClientClose,
+	} {
+		if v := os.Getenv(name); v != "" {
+			*field = v
+		}
+	}
+
+	if hookTimeout := os.Getenv("HOOK_TIMEOUT"); hookTimeout != "" {
+		if t, err := strconv.Atoi(hookTimeout); err == nil {
+			config.HookTimeout = t
+		}
+	}
+
+	for name, field := range map[string]*int{
+		"RECOVERY_AFTER_FAILURES": &config.RecoveryAfter,
+		"RECOVERY_COOLDOWN":       &config.RecoveryPause,
+		"RECOVERY_MAX_ATTEMPTS":   &config.RecoveryMax,
+	} {
+		if v := os.Getenv(name); v != "" {
+			if n, err := strconv.Atoi(v); err == nil {
+				*field = n
+			}
+		}
+	}
+
+	for name, field := range map[string]*string{
+		"RECOVERY_URL":          &config.RecoveryURL,
+		"RECOVERY_METHOD":       &config.RecoveryMethod,
+		"RECOVERY_MQTT_TOPIC":   &config.RecoveryTopic,
+		"RECOVERY_MQTT_PAYLOAD": &config.RecoveryPayload,
+	} {
+		if v := os.Getenv(name); v != "" {
+			*field = v
+		}
+	}
+
+	if webAuthEnabled := os.Getenv("WEB_AUTH_ENABLED"); webAuthEnabled != "" {
+		config.WebAuthEnabled = webAuthEnabled == "true" || webAuthEnabled == "1"
+	}
+
+	if webAuthUsername := os.Getenv("WEB_AUTH_USERNAME"); webAuthUsername != "" {
+		config.WebAuthUsername = webAuthUsername
+	}
+
+	if webAuthPassword := os.Getenv("WEB_AUTH_PASSWORD"); webAuthPassword != "" {
+		config.WebAuthPassword = webAuthPassword
+	}
+
+	if webAdminUsername := os.Getenv("WEB_ADMIN_USERNAME"); webAdminUsername != "" {
+		config.WebAdminUsername = webAdminUsername
+	}
+
+	if webAdminPassword := os.Getenv("WEB_ADMIN_PASSWORD"); webAdminPassword != "" {
+		config.WebAdminPassword = webAdminPassword
+	}
+
+	for name, field := range map[string]*int{
+		"WEB_SESSION_LIFETIME":     &config.WebSessionLife,
+		"WEB_SESSION_IDLE_TIMEOUT": &config.WebSessionIdle,
+	} {
+		if v := os.Getenv(name); v != "" {
+			if n, err := strconv.Atoi(v); err == nil {
+				*field = n
+			}
+		}
+	}
+
+	config.recordEnv()
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// Validate checks the settings, as Load does once they are read. Embedders
+// building a Config directly call it before starting the proxy.
+func (c *Config) Validate() error {
+	// Validate required fields
+	if c.UpstreamType == UpstreamTypeMQTT {
+		if c.MQTTBroker == "" {
+			return fmt.Errorf("MQTT_BROKER is required when UPSTREAM_TYPE is mqtt")
+		}
+		if c.MQTTRxTopic == "" || c.MQTTTxTopic == "" {
+			return fmt.Errorf("MQTT_RX_TOPIC and MQTT_TX_TOPIC are required when UPSTREAM_TYPE is mqtt")
+		}
+	} else if c.UpstreamType != UpstreamTypeTCP {
+		return fmt.Errorf("invalid UPSTREAM_TYPE: %q", c.UpstreamType)
+	} else if c.UpstreamURL != "" {
+		u, err := url.Parse(c.UpstreamURL)
+		if err != nil {
+			return fmt.Errorf("invalid UPSTREAM_URL: %w", err)
+		}
+		switch u.Scheme {
+		case "tcp", "ws", "wss", "quic", "mux", "rfc2217":
+		default:
+			return fmt.Errorf("unsupported UPSTREAM_URL scheme: %q", u.Scheme)
+		}
+		if u.Host == "" {
+			return fmt.Errorf("UPSTREAM_URL must include a host")
+		}
+		if u.Scheme == "mux" && strings.Trim(u.Path, "/") == "" {
+			return fmt.Errorf("UPSTREAM_URL must name the upstream to open, e.g. mux://host:port/name")
+		}
+		if u.Scheme == "rfc2217" {
+			if _, err := rfc2217.ParseQuery(u.Query()); err != nil {
+				return fmt.Errorf("invalid UPSTREAM_URL serial settings: %w", err)
+			}
+		}
+		if u.Scheme == "quic" {
+			if _, err := fec.ParseQuery(u.Query()); err != nil {
+				return fmt.Errorf("invalid UPSTREAM_URL: %w", err)
+			}
+		}
+	} else {
+		if c.UpstreamHost == "" {
+			return fmt.Errorf("UPSTREAM_HOST is required")
+		}
+
+		if c.UpstreamPort <= 0 || c.UpstreamPort > 65535 {
+			return fmt.Errorf("invalid UPSTREAM_PORT: %d", c.UpstreamPort)
+		}
+	}
+
+	// Validate additional upstreams
+	upstreamNames := map[string]bool{c.UpstreamName: true}
+	for _, u := range c.Upstreams {
+		if u.Name == "" || u.Name == UpstreamAll {
+			return fmt.Errorf("invalid upstream name: %q", u.Name)
+		}
+		if upstreamNames[u.Name] {
+			return fmt.Errorf("duplicate upstream name: %q", u.Name)
+		}
+		upstreamNames[u.Name] = true
+		if err := validateUpstreamAddr(u.Addr); err != nil {
+			return fmt.Errorf("upstream %q: %w", u.Name, err)
+		}
+	}
+	if len(c.Upstreams) > 255 {
+		return fmt.Errorf("at most 255 additional upstreams are supported")
+	}
+	if c.UpstreamWrite != "" && c.UpstreamWrite != UpstreamAll && !upstreamNames[c.UpstreamWrite] {
+		return fmt.Errorf("UPSTREAM_WRITE_TARGET %q does not name an upstream", c.UpstreamWrite)
+	}
+
+	for name, secs := range map[string]int{
+		"UPSTREAM_TCP_USER_TIMEOUT":   c.TCPUserTimeout,
+		"UPSTREAM_KEEPALIVE_IDLE":     c.TCPKeepIdle,
+		"UPSTREAM_KEEPALIVE_INTERVAL": c.TCPKeepInterval,
+	} {
+		if secs < 0 || secs > 3600 {
+			return fmt.Errorf("%s must be between 0 and 3600", name)
+		}
+	}
+	if c.TCPKeepCount < 0 || c.TCPKeepCount > 100 {
+		return fmt.Errorf("UPSTREAM_KEEPALIVE_COUNT must be between 0 and 100")
+	}
+	if c.SocketDSCP < 0 || c.SocketDSCP > 63 {
+		return fmt.Errorf("SOCKET_DSCP must be between 0 and 63")
+	}
+	if c.SocketPriority < 0 || c.SocketPriority > 6 {
+		return fmt.Errorf("SOCKET_PRIORITY must be between 0 and 6")
+	}
+
+	if wait, err := parseWait(c.WaitForUpstream); err != nil || wait < 0 || wait > maxUpstreamWait {
+		return fmt.Errorf("WAIT_FOR_UPSTREAM must be a duration such as 30s, at most %v", maxUpstreamWait)
+	}
+
+	if c.ListenPort <= 0 || c.ListenPort > 65535 {
+		return fmt.Errorf("invalid LISTEN_PORT: %d", c.ListenPort)
+	}
+
+	if c.RawListenPort < 0 || c.RawListenPort > 65535 {
+		return fmt.Errorf("invalid RAW_LISTEN_PORT: %d", c.RawListenPort)
+	}
+	if c.RawListenPort != 0 && (c.RawListenPort == c.ListenPort || c.RawListenPort == c.WebPort) {
+		return fmt.Errorf("RAW_LISTEN_PORT must differ from LISTEN_PORT and WEB_PORT")
+	}
+	for name, format := range map[string]string{"LISTEN_FORMAT": c.ListenFormat, "RAW_LISTEN_FORMAT": c.RawListenFormat} {
+		if format != "" && format != FormatBinary && format != FormatHex {
+			return fmt.Errorf("%s must be %q or %q", name, FormatBinary, FormatHex)
+		}
+	}
+	for _, p := range []struct{ name, profile, format, formatName string }{
+		{"LISTEN_PROFILE", c.ListenProfile, c.ListenFormat, "LISTEN_FORMAT"},
+		{"RAW_LISTEN_PROFILE", c.RawListenProfile, c.RawListenFormat, "RAW_LISTEN_FORMAT"},
+	} {
+		switch p.profile {
+		case "", ProfileDefault:
+		case ProfileESPHome:
+			if p.format == FormatHex {
+				return fmt.Errorf("%s=%s requires %s=%s", p.name, ProfileESPHome, p.formatName, FormatBinary)
+			}
+		default:
+			return fmt.Errorf("%s must be %q or %q", p.name, ProfileDefault, ProfileESPHome)
+		}
+	}
+	if e := c.ClientEngine; e != "" && e != EngineGoroutine && e != EngineEpoll {
+		return fmt.Errorf("CLIENT_ENGINE must be %q or %q", EngineGoroutine, EngineEpoll)
+	}
+	if b := c.StorageBackend; b != StorageMemory && b != StorageSQLite {
+		return fmt.Errorf("STORAGE_BACKEND must be %q or %q", StorageMemory, StorageSQLite)
+	}
+	if c.StorageBackend == StorageSQLite && c.StoragePath == "" {
+		return fmt.Errorf("STORAGE_PATH is required with STORAGE_BACKEND=%s", StorageSQLite)
+	}
+	if c.RetentionMaxMB < 0 {
+		return fmt.Errorf("RETENTION_MAX_MB must not be negative")
+	}
+	if c.JournalMaxMB < 0 || c.JournalMaxMB > maxJournalMB {
+		return fmt.Errorf("WRITE_JOURNAL_MAX_MB must be between 0 and %d", maxJournalMB)
+	}
+	if c.JournalFiles < 0 {
+		return fmt.Errorf("WRITE_JOURNAL_FILES must not be negative")
+	}
+	if c.WriteJournal != "" && c.WriteJournal == c.LogFile {
+		return fmt.Errorf("WRITE_JOURNAL must not be LOG_FILE")
+	}
+	if c.RetentionMaxAge < 0 {
+		return fmt.Errorf("RETENTION_MAX_AGE_DAYS must not be negative")
+	}
+
+	if c.QUICListenPort < 0 || c.QUICListenPort > 65535 {
+		return fmt.Errorf("invalid QUIC_LISTEN_PORT: %d", c.QUICListenPort)
+	}
+
+	if c.TLSListenPort < 0 || c.TLSListenPort > 65535 {
+		return fmt.Errorf("invalid TLS_LISTEN_PORT: %d", c.TLSListenPort)
+	}
+	if p := c.TLSListenPort; p != 0 && (p == c.ListenPort || p == c.RawListenPort || p == c.WebPort) {
+		return fmt.Errorf("TLS_LISTEN_PORT must differ from LISTEN_PORT, RAW_LISTEN_PORT and WEB_PORT")
+	}
+	if c.MuxListenPort < 0 || c.MuxListenPort > 65535 {
+		return fmt.Errorf("invalid MUX_LISTEN_PORT: %d", c.MuxListenPort)
+	}
+	if p := c.MuxListenPort; p != 0 && (p == c.ListenPort || p == c.RawListenPort || p == c.WebPort || p == c.TLSListenPort) {
+		return fmt.Errorf("MUX_LISTEN_PORT must differ from LISTEN_PORT, RAW_LISTEN_PORT, WEB_PORT and TLS_LISTEN_PORT")
+	}
+	if c.StatusListenPort < 0 || c.StatusListenPort > 65535 {
+		return fmt.Errorf("invalid STATUS_LISTEN_PORT: %d", c.StatusListenPort)
+	}
+	if p := c.StatusListenPort; p != 0 && (p == c.ListenPort || p == c.RawListenPort || p == c.WebPort || p == c.TLSListenPort || p == c.MuxListenPort) {
+		return fmt.Errorf("STATUS_LISTEN_PORT must differ from LISTEN_PORT, RAW_LISTEN_PORT, WEB_PORT, TLS_LISTEN_PORT and MUX_LISTEN_PORT")
+	}
+	if len(c.TLSRoutes) > 0 && c.TLSListenPort == 0 {
+		return fmt.Errorf("TLS_ROUTES requires TLS_LISTEN_PORT")
+	}
+	for _, r := range c.TLSRoutes {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		if !upstreamNames[r.Upstream] {
+			return fmt.Errorf("TLS route upstream %q does not name an upstream", r.Upstream)
+		}
+	}
+
+	if c.MaxClients <= 0 || c.MaxClients > 100 {
+		return fmt.Errorf("MAX_CLIENTS must be between 1 and 100")
+	}
+
+	if c.MaxClientsPerIP < 0 || c.MaxClientsPerIP > c.MaxClients {
+		return fmt.Errorf("MAX_CLIENTS_PER_IP must be between 0 and MAX_CLIENTS")
+	}
+
+	if len(c.ClientBanner) > 1024 {
+		return fmt.Errorf("CLIENT_BANNER must be at most 1024 bytes")
+	}
+
+	if c.HeartbeatSecs < 0 || c.HeartbeatSecs > 3600 {
+		return fmt.Errorf("CLIENT_HEARTBEAT_SECONDS must be between 0 and 3600")
+	}
+	if c.HeartbeatSecs > 0 {
+		frame, err := hexutil.Parse(c.HeartbeatFrame)
+		if err != nil || len(frame) == 0 || len(frame) > 1024 {
+			return fmt.Errorf("CLIENT_HEARTBEAT_FRAME must be 1 to 1024 hex bytes with CLIENT_HEARTBEAT_SECONDS")
+		}
+	}
+
+	if c.ControllerSecs < 0 || c.ControllerSecs > 3600 {
+		return fmt.Errorf("CLIENT_CONTROLLER_WINDOW must be between 0 and 3600")
+	}
+
+	if c.IdentTimeout < 0 || c.IdentTimeout > 60 {
+		return fmt.Errorf("CLIENT_IDENT_TIMEOUT must be between 0 and 60")
+	}
+	if ids := c.ClientIDs; ids != "" && ids != ClientIDsSequential && ids != ClientIDsStable {
+		return fmt.Errorf("CLIENT_IDS must be %q or %q", ClientIDsSequential, ClientIDsStable)
+	}
+	if c.LivenessTimeout < 0 || c.LivenessTimeout > 86400 {
+		return fmt.Errorf("CLIENT_LIVENESS_TIMEOUT must be between 0 and 86400")
+	}
+	if c := c.LivenessCheck; c != "" && c != LivenessData && c != LivenessKeepalive {
+		return fmt.Errorf("CLIENT_LIVENESS_CHECK must be %q or %q", LivenessData, LivenessKeepalive)
+	}
+
+	if c.ConnectRate < 0 || c.ConnectRate > 10000 {
+		return fmt.Errorf("CONNECT_RATE_LIMIT must be between 0 and 10000")
+	}
+
+	if c.ConnectRate > 0 && (c.GreylistSecs < 1 || c.GreylistSecs > 86400) {
+		return fmt.Errorf("CONNECT_GREYLIST_SECONDS must be between 1 and 86400")
+	}
+
+	// Validate InfluxDB exporter configuration
+	if c.InfluxURL != "" {
+		if c.InfluxDatabase == "" && c.InfluxBucket == "" {
+			return fmt.Errorf("INFLUX_DATABASE (v1) or INFLUX_BUCKET (v2) is required when INFLUX_URL is set")
+		}
+		if c.InfluxInterval <= 0 {
+			return fmt.Errorf("INFLUX_INTERVAL must be positive")
+		}
+		if _, err := c.InfluxTagMap(); err != nil {
+			return err
+		}
+	}
+
+	if c.StatsdAddr != "" && c.StatsdInterval <= 0 {
+		return fmt.Errorf("STATSD_INTERVAL must be positive")
+	}
+
+	if c.HookTimeout < 1 || c.HookTimeout > 3600 {
+		return fmt.Errorf("HOOK_TIMEOUT must be between 1 and 3600")
+	}
+
+	if err := c.validateRecovery(); err != nil {
+		return err
+	}
+
+	// Validate trigger rules
+	triggerNames := make(map[string]bool)
+	for _, t := range c.Triggers {
+		if err := t.Validate(); err != nil {
+			return err
+		}
+		if triggerNames[t.Name] {
+			return fmt.Errorf("duplicate trigger name: %q", t.Name)
+		}
+		triggerNames[t.Name] = true
+	}
+
+	// Validate deny rules
+	denyNames := make(map[string]bool)
+	for _, d := range c.DenyFrames {
+		if err := d.Validate(); err != nil {
+			return err
+		}
+		if denyNames[d.Name] {
+			return fmt.Errorf("duplicate deny rule name: %q", d.Name)
+		}
+		denyNames[d.Name] = true
+	}
+
+	if _, err := codec.New(c.TransformFrom); err != nil {
+		return fmt.Errorf("invalid TRANSFORM_FROM_UPSTREAM: %w", err)
+	}
+	if _, err := codec.New(c.TransformTo); err != nil {
+		return fmt.Errorf("invalid TRANSFORM_TO_UPSTREAM: %w", err)
+	}
+
+	if c.FrameGapMs < 0 || c.FrameGapMs > 10000 {
+		return fmt.Errorf("FRAME_GAP_MS must be between 0 and 10000")
+	}
+	if c.ResponseTimeoutMs < 0 || c.ResponseTimeoutMs > 60000 {
+		return fmt.Errorf("RESPONSE_TIMEOUT_MS must be between 0 and 60000")
+	}
+	if c.ResponseTimeoutMs > 0 && c.FrameGapMs == 0 {
+		return fmt.Errorf("RESPONSE_TIMEOUT_MS requires FRAME_GAP_MS, which tells the replies apart")
+	}
+
+	if c.LatencyBudgetMs < 0 || c.LatencyBudgetMs > 60000 {
+		return fmt.Errorf("LATENCY_BUDGET_MS must be between 0 and 60000")
+	}
+
+	for _, q := range c.UpstreamQuirks {
+		switch q {
+		case QuirkBanner, QuirkTelnet, QuirkOTA:
+		default:
+			return fmt.Errorf("UPSTREAM_QUIRKS: unknown quirk %q, expected %q, %q or %q", q, QuirkBanner, QuirkTelnet, QuirkOTA)
+		}
+	}
+
+	for _, d := range c.LogDirections {
+		if _, ok := logger.DirectionLabel(d); !ok {
+			return fmt.Errorf("LOG_PACKET_DIRECTIONS: invalid direction %q", d)
+		}
+	}
+	for _, p := range c.LogSources {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("LOG_PACKET_SOURCES: invalid pattern %q", p)
+		}
+	}
+
+	// Validate web log buffer
+	if c.WebLogLines < 1 || c.WebLogLines > maxWebBuffer {
+		return fmt.Errorf("WEB_LOG_BUFFER must be between 1 and %d", maxWebBuffer)
+	}
+	if c.WebPacketLines < 1 || c.WebPacketLines > maxWebBuffer {
+		return fmt.Errorf("WEB_PACKET_BUFFER must be between 1 and %d", maxWebBuffer)
+	}
+	if c.WebLogMaxAge < 0 {
+		return fmt.Errorf("WEB_LOG_MAX_AGE must not be negative")
+	}
+
+	// Validate web keep-alive intervals; 0 selects the default
+	for name, secs := range map[string]int{
+		"WEB_STATUS_INTERVAL":  c.WebStatusInterval,
+		"WEB_SSE_HEARTBEAT":    c.WebSSEHeartbeat,
+		"WEB_WS_PING_INTERVAL": c.WebWSPing,
+	} {
+		if secs < 0 || secs > maxWebInterval {
+			return fmt.Errorf("%s must be between 0 and %d seconds", name, maxWebInterval)
+		}
+	}
+
+	// Validate web port binding
+	if c.WebBindRetry < 0 || c.WebBindRetry > maxWebInterval {
+		return fmt.Errorf("WEB_BIND_RETRY_SECONDS must be between 0 and %d seconds", maxWebInterval)
+	}
+	for _, p := range c.WebFallbackPorts {
+		if p < 0 || p > 65535 {
+			return fmt.Errorf("WEB_FALLBACK_PORTS must be between 0 and 65535, got %d", p)
+		}
+		if p != 0 && p == c.WebPort {
+			return fmt.Errorf("WEB_FALLBACK_PORTS must not include WEB_PORT")
+		}
+	}
+
+	// Validate data freshness thresholds
+	for name, secs := range map[string]int{
+		"HEALTH_DATA_DEGRADED_SECONDS":  c.HealthDegraded,
+		"HEALTH_DATA_UNHEALTHY_SECONDS": c.HealthUnhealthy,
+	} {
+		if secs < 0 || secs > 604800 {
+			return fmt.Errorf("%s must be between 0 and 604800", name)
+		}
+	}
+	if c.HealthDegraded > 0 && c.HealthUnhealthy > 0 && c.HealthUnhealthy < c.HealthDegraded {
+		return fmt.Errorf("HEALTH_DATA_UNHEALTHY_SECONDS must not be less than HEALTH_DATA_DEGRADED_SECONDS")
+	}
+	if c.HealthDebounce < 0 || c.HealthDebounce > 3600 {
+		return fmt.Errorf("HEALTH_DEBOUNCE_SECONDS must be between 0 and 3600")
+	}
+
+	// Validate ACME settings
+	if c.ACMEEnabled() {
+		for _, d := range c.ACMEDomains {
+			if strings.ContainsAny(d, ":/ ") || !strings.Contains(d, ".") {
+				return fmt.Errorf("WEB_ACME_DOMAINS: invalid hostname %q", d)
+			}
+		}
+		if c.ACMECacheDir == "" {
+			return fmt.Errorf("WEB_ACME_CACHE_DIR is required when WEB_ACME_DOMAINS is set")
+		}
+		if c.ACMEHTTPPort < 0 || c.ACMEHTTPPort > 65535 || c.ACMEHTTPPort == c.WebPort {
+			return fmt.Errorf("WEB_ACME_HTTP_PORT must be a port other than WEB_PORT, or 0")
+		}
+		if c.ACMEDirectory != "" {
+			if u, err := url.Parse(c.ACMEDirectory); err != nil || u.Scheme != "https" {
+				return fmt.Errorf("WEB_ACME_DIRECTORY_URL must be an https URL")
+			}
+		}
+	}
+
+	// Validate client priorities
+	for _, p := range c.ClientPriority {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Validate outage policies
+	if c.OutagePolicy != "" && !validOutagePolicy(c.OutagePolicy) {
+		return fmt.Errorf("CLIENT_OUTAGE_POLICY must be %q, %q or %q", OutageDrop, OutageClose, OutageBuffer)
+	}
+	if c.OutageBuffer < 0 || c.OutageBuffer > maxOutageBuffer {
+		return fmt.Errorf("CLIENT_OUTAGE_BUFFER must be between 0 and %d", maxOutageBuffer)
+	}
+	for _, o := range c.OutageRules {
+		if err := o.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Validate the upstream write retry queue
+	if c.WriteRetryFrames < 0 || c.WriteRetryFrames > maxWriteRetryFrames {
+		return fmt.Errorf("UPSTREAM_RETRY_FRAMES must be between 0 and %d", maxWriteRetryFrames)
+	}
+	if c.WriteRetryMaxAge < 0 || c.WriteRetryMaxAge > maxWriteRetryAge {
+		return fmt.Errorf("UPSTREAM_RETRY_MAX_AGE_MS must be between 0 and %d", maxWriteRetryAge)
+	}
+
+	// Validate access rules
+	if c.ClientAccess != "" && !validAccess(c.ClientAccess) {
+		return fmt.Errorf("CLIENT_ACCESS must be %q, %q, %q or %q", AccessWrite, AccessRead, AccessInject, AccessDeny)
+	}
+	for _, a := range c.AccessRules {
+		if err := a.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// Validate client groups and the triggers sending to them
+	groupNames := make(map[string]bool)
+	for _, g := range c.ClientGroups {
+		if err := g.Validate(); err != nil {
+			return err
+		}
+		if groupNames[g.Name] {
+			return fmt.Errorf("duplicate client group name: %q", g.Name)
+		}
+		groupNames[g.Name] = true
+	}
+	for _, t := range c.Triggers {
+		if group, ok := strings.CutPrefix(t.Target, "group:"); ok && !groupNames[group] {
+			return fmt.Errorf("trigger %q: unknown client group %q", t.Name, group)
+		}
+	}
+	switch c.RefusedWrites {
+	case "", RefuseDrop, RefuseReset, RefuseError:
+	default:
+		return fmt.Errorf("CLIENT_REFUSED_WRITES must be %q, %q or %q", RefuseDrop, RefuseReset, RefuseError)
+	}
+	if strings.ContainsAny(c.RefusedMessage, "\r\n") {
+		return fmt.Errorf("CLIENT_REFUSED_MESSAGE must be a single line")
+	}
+
+	// Validate value extraction rules
+	valueNames := make(map[string]bool)
+	for _, v := range c.Values {
+		if err := v.Validate(); err != nil {
+			return err
+		}
+		if valueNames[v.Name] {
+			return fmt.Errorf("duplicate value name: %q", v.Name)
+		}
+		valueNames[v.Name] = true
+	}
+
+	// Validate poll rules
+	pollNames := make(map[string]bool)
+	for _, p := range c.Polls {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		if pollNames[p.Name] {
+			return fmt.Errorf("duplicate poll name: %q", p.Name)
+		}
+		pollNames[p.Name] = true
+	}
+
+	// Validate init sequence
+	for i, f := range c.InitSequence {
+		if b, err := hexutil.Parse(f.Data); err != nil || len(b) == 0 {
+			return fmt.Errorf("INIT_SEQUENCE frame %d: data must be non-empty hex", i)
+		}
+		if f.DelayMs < 0 || f.DelayMs > 60000 {
+			return fmt.Errorf("INIT_SEQUENCE frame %d: delay_ms must be between 0 and 60000", i)
+		}
+	}
+
+	// Validate auth configuration
+	if c.WebAuthEnabled {
+		if c.WebAuthUsername == "" {
+			return fmt.Errorf("WEB_AUTH_USERNAME is required when WEB_AUTH_ENABLED is true")
+		}
+		if c.WebAuthPassword == "" {
+			return fmt.Errorf("WEB_AUTH_PASSWORD is required when WEB_AUTH_ENABLED is true")
+		}
+	}
+	if c.WebSessionLife != 0 && (c.WebSessionLife < 60 || c.WebSessionLife > maxSessionLife) {
+		return fmt.Errorf("WEB_SESSION_LIFETIME must be between 60 and %d seconds", maxSessionLife)
+	}
+	if c.WebSessionIdle != 0 && (c.WebSessionIdle < 60 || c.WebSessionLife != 0 && c.WebSessionIdle > c.WebSessionLife) {
+		return fmt.Errorf("WEB_SESSION_IDLE_TIMEOUT must be 0 or between 60 seconds and WEB_SESSION_LIFETIME")
+	}
+	if (c.WebAdminUsername == "") != (c.WebAdminPassword == "") {
+		return fmt.Errorf("WEB_ADMIN_USERNAME and WEB_ADMIN_PASSWORD must be set together")
+	}
+	if c.WebAdminUsername != "" && c.WebAdminUsername == c.WebAuthUsername {
+		return fmt.Errorf("WEB_ADMIN_USERNAME must differ from WEB_AUTH_USERNAME")
+	}
+
+	return nil
+}
+
+// ACMEEnabled reports whether the web UI obtains its certificate via ACME
+func (c *Config) ACMEEnabled() bool {
+	return len(c.ACMEDomains) > 0
+}
+
+// PacketLogFilter returns the filter applied to packets written to stdout
+// and LOG_FILE
+func (c *Config) PacketLogFilter() logger.PacketFilter {
+	f := logger.PacketFilter{Sources: c.LogSources}
+	for _, d := range c.LogDirections {
+		if label, ok := logger.DirectionLabel(d); ok {
+			f.Directions = append(f.Directions, label)
+		}
+	}
+	return f
+}
+
+// splitList splits a comma-separated environment value, dropping empty items
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// HasQuirk reports whether UPSTREAM_QUIRKS includes quirk
+func (c *Config) HasQuirk(quirk string) bool {
+	return slices.Contains(c.UpstreamQuirks, quirk)
+}
+
+// UpstreamAddr returns the upstream address. When UpstreamURL is set it is
+// returned verbatim so the upstream package can select the transport.
 func (c *Config) UpstreamAddr() string {
+	if c.UpstreamType == UpstreamTypeMQTT {
+		broker := strings.TrimPrefix(strings.TrimPrefix(c.MQTTBroker, "tcp://"), "mqtt://")
+		return fmt.Sprintf("mqtt://%s/%s", broker, c.MQTTRxTopic)
+	}
+	if c.UpstreamURL != "" {
+		return c.UpstreamURL
+	}
 	return fmt.Sprintf("%s:%d", c.UpstreamHost, c.UpstreamPort)
 }
 
+// validateUpstreamAddr checks a host:port or transport URL
+func validateUpstreamAddr(addr string) error {
+	if !strings.Contains(addr, "://") {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid address %q: %w", addr, err)
+		}
+		return nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return fmt.Errorf("invalid address: %w", err)
+	}
+	switch u.Scheme {
+	case "tcp", "ws", "wss", "quic", "mux", "rfc2217":
+	default:
+		return fmt.Errorf("unsupported scheme: %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("address must include a host")
+	}
+	if u.Scheme == "mux" && strings.Trim(u.Path, "/") == "" {
+		return fmt.Errorf("address must name the upstream to open, e.g. mux://host:port/name")
+	}
+	if u.Scheme == "rfc2217" {
+		if _, err := rfc2217.ParseQuery(u.Query()); err != nil {
+			return fmt.Errorf("invalid serial settings: %w", err)
+		}
+	}
+	if u.Scheme == "quic" {
+		if _, err := fec.ParseQuery(u.Query()); err != nil {
+			return fmt.Errorf("invalid address: %w", err)
+		}
+	}
+	return nil
+}
+
 func (c *Config) ListenAddr() string {
 	return fmt.Sprintf(":%d", c.ListenPort)
 }
+
+// InjectionEnabled reports whether packet injection, macros and triggers are
+// enabled at startup (INJECT_ENABLED, default true)
+func (c *Config) InjectionEnabled() bool {
+	return c.InjectEnabled == nil || *c.InjectEnabled
+}
+
+// UpstreamWait returns how long startup waits for the upstream before
+// opening the client listeners (WAIT_FOR_UPSTREAM), 0 for not at all
+func (c *Config) UpstreamWait() time.Duration {
+	wait, _ := parseWait(c.WaitForUpstream)
+	return wait
+}
+
+// parseWait parses a Go duration, or a number of seconds for convenience
+// in add-on options
+func parseWait(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if secs, err := strconv.Atoi(s); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// StatusPushEnabled reports whether web clients receive periodic status
+// messages (WEB_STATUS_PUSH, default true)
+func (c *Config) StatusPushEnabled() bool {
+	return c.WebStatusPush == nil || *c.WebStatusPush
+}
+
+// RawListenAddr returns the TCP address for the raw client listener
+func (c *Config) RawListenAddr() string {
+	return fmt.Sprintf(":%d", c.RawListenPort)
+}
+
+// validateRecovery checks the RECOVERY_* options
+func (c *Config) validateRecovery() error {
+	if c.RecoveryAfter < 0 || c.RecoveryAfter > 1000 {
+		return fmt.Errorf("RECOVERY_AFTER_FAILURES must be between 0 and 1000")
+	}
+	if c.RecoveryPause < 0 || c.RecoveryPause > 86400 {
+		return fmt.Errorf("RECOVERY_COOLDOWN must be between 0 and 86400")
+	}
+	if c.RecoveryMax < 0 || c.RecoveryMax > 100 {
+		return fmt.Errorf("RECOVERY_MAX_ATTEMPTS must be between 0 and 100")
+	}
+	if c.RecoveryAfter == 0 {
+		return nil
+	}
+	if c.RecoveryURL == "" && c.RecoveryTopic == "" {
+		return fmt.Errorf("RECOVERY_AFTER_FAILURES requires RECOVERY_URL or RECOVERY_MQTT_TOPIC")
+	}
+	if c.RecoveryURL != "" {
+		u, err := url.Parse(c.RecoveryURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("RECOVERY_URL must be an http:// or https:// URL")
+		}
+	}
+	switch c.RecoveryMethod {
+	case http.MethodGet, http.MethodPost, http.MethodPut:
+	default:
+		return fmt.Errorf("RECOVERY_METHOD must be GET, POST or PUT")
+	}
+	if c.RecoveryTopic != "" && c.MQTTBroker == "" {
+		return fmt.Errorf("RECOVERY_MQTT_TOPIC requires MQTT_BROKER")
+	}
+	return nil
+}
+
+// TLSListenAddr returns the TCP address for the TLS client listener
+func (c *Config) TLSListenAddr() string {
+	return fmt.Sprintf(":%d", c.TLSListenPort)
+}
+
+// MuxListenAddr returns the TCP address for the mux listener
+func (c *Config) MuxListenAddr() string {
+	return fmt.Sprintf(":%d", c.MuxListenPort)
+}
+
+// StatusListenAddr returns the TCP address for the upstream status listener
+func (c *Config) StatusListenAddr() string {
+	return fmt.Sprintf(":%d", c.StatusListenPort)
+}
+
+// TLSProtocols returns the distinct ALPN tokens of TLS_ROUTES, which the
+// TLS listener offers to clients
+func (c *Config) TLSProtocols() []string {
+	var protos []string
+	for _, r := range c.TLSRoutes {
+		if r.ALPN != "" && !slices.Contains(protos, r.ALPN) {
+			protos = append(protos, r.ALPN)
+		}
+	}
+	return protos
+}
+
+// QUICListenAddr returns the UDP address for the QUIC client listener
+func (c *Config) QUICListenAddr() string {
+	return fmt.Sprintf(":%d", c.QUICListenPort)
+}
+
+// InfluxTagMap parses InfluxTags ("k1=v1,k2=v2") into a map
+func (c *Config) InfluxTagMap() (map[string]string, error) {
+	tags := make(map[string]string)
+	if c.InfluxTags == "" {
+		return tags, nil
+	}
+	for _, pair := range strings.Split(c.InfluxTags, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("invalid INFLUX_TAGS entry: %q", pair)
+		}
+		tags[k] = v
+	}
+	return tags, nil
+}
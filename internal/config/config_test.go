@@ -1,8 +1,11 @@
 package config
 
 import (
+	"net"
 	"os"
+	"slices"
 	"testing"
+	"time"
 )
 
 func TestLoad_RequiredFields(t *testing.T) {
@@ -133,3 +136,1455 @@ func TestConfig_ListenAddr(t *testing.T) {
 		t.Errorf("Expected %s, got %s", expected, config.ListenAddr())
 	}
 }
+
+func TestLoad_UpstreamURL(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_URL", "wss://relay.example.com/serial")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if config.UpstreamAddr() != "wss://relay.example.com/serial" {
+		t.Errorf("Expected UpstreamAddr=wss://relay.example.com/serial, got %s", config.UpstreamAddr())
+	}
+}
+
+func TestLoad_UpstreamURL_InvalidScheme(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_URL", "ftp://relay.example.com/serial")
+
+	_, err := Load()
+	if err == nil {
+		t.Error("Expected error for unsupported UPSTREAM_URL scheme")
+	}
+}
+
+func TestLoad_UpstreamURL_RFC2217(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_URL", "rfc2217://192.168.1.50:4001?baud=115200&parity=even")
+
+	if _, err := Load(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	os.Setenv("UPSTREAM_URL", "rfc2217://192.168.1.50:4001?baud=fast")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for invalid baud rate")
+	}
+}
+
+func TestLoad_UpstreamURL_QUICFEC(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_URL", "quic://remote-site.example.com:18899?insecure=1&fec=2")
+
+	if _, err := Load(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	os.Setenv("UPSTREAM_URL", "quic://remote-site.example.com:18899?fec=9")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for out-of-range fec")
+	}
+}
+
+func TestLoad_FlashAutoDetect(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.FlashAutoDetect {
+		t.Error("Expected FlashAutoDetect off by default")
+	}
+
+	os.Setenv("FLASH_AUTO_DETECT", "true")
+	config, err = Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !config.FlashAutoDetect {
+		t.Error("Expected FlashAutoDetect=true")
+	}
+}
+
+func TestLoad_MQTTUpstream(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_TYPE", "mqtt")
+	os.Setenv("MQTT_BROKER", "192.168.1.10:1883")
+
+	_, err := Load()
+	if err == nil {
+		t.Error("Expected error when MQTT topics are not set")
+	}
+
+	os.Setenv("MQTT_RX_TOPIC", "bridge/serial/rx")
+	os.Setenv("MQTT_TX_TOPIC", "bridge/serial/tx")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := "mqtt://192.168.1.10:1883/bridge/serial/rx"
+	if config.UpstreamAddr() != expected {
+		t.Errorf("Expected UpstreamAddr=%s, got %s", expected, config.UpstreamAddr())
+	}
+}
+
+func TestLoad_InfluxExporter(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("INFLUX_URL", "http://influx:8086")
+
+	_, err := Load()
+	if err == nil {
+		t.Error("Expected error when neither INFLUX_DATABASE nor INFLUX_BUCKET is set")
+	}
+
+	os.Setenv("INFLUX_BUCKET", "serial")
+	os.Setenv("INFLUX_TAGS", "site=home,host=pi")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tags, err := config.InfluxTagMap()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tags["site"] != "home" || tags["host"] != "pi" {
+		t.Errorf("Unexpected tags %v", tags)
+	}
+
+	os.Setenv("INFLUX_TAGS", "site")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for malformed INFLUX_TAGS")
+	}
+}
+
+func TestLoad_Triggers(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("TRIGGERS", `[{"name":"poll","direction":"from_upstream","hex_prefix":"f7 0e","respond":"f7 0e 80"}]`)
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(config.Triggers) != 1 || config.Triggers[0].Name != "poll" {
+		t.Errorf("Unexpected triggers %+v", config.Triggers)
+	}
+
+	invalid := []string{
+		`[{"name":"x","alert":true,"direction":"sideways"}]`,
+		`[{"name":"x","alert":true,"hex_prefix":"zz"}]`,
+		`[{"name":"x","alert":true,"regex":"("}]`,
+		`[{"name":"x"}]`,
+		`[{"name":"x","alert":true},{"name":"x","alert":true}]`,
+		`not json`,
+	}
+	for _, v := range invalid {
+		os.Setenv("TRIGGERS", v)
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected error for TRIGGERS=%s", v)
+		}
+	}
+}
+
+func TestLoad_DenyFrames(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("DENY_FRAMES", `[{"name":"factory-reset","hex_prefix":"1a c0"},{"name":"bootloader","regex":"^fe..0f"}]`)
+	os.Setenv("WEB_ADMIN_USERNAME", "admin")
+	os.Setenv("WEB_ADMIN_PASSWORD", "s3cret")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(config.DenyFrames) != 2 || config.DenyFrames[1].Regex != "^fe..0f" || config.WebAdminUsername != "admin" {
+		t.Errorf("Unexpected deny rules %+v", config.DenyFrames)
+	}
+
+	invalid := []string{
+		`[{"name":"x"}]`,
+		`[{"hex_prefix":"aa"}]`,
+		`[{"name":"x","hex_prefix":"zz"}]`,
+		`[{"name":"x","regex":"("}]`,
+		`[{"name":"x","hex_prefix":"aa"},{"name":"x","regex":"bb"}]`,
+		`not json`,
+	}
+	for _, v := range invalid {
+		os.Setenv("DENY_FRAMES", v)
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected error for DENY_FRAMES=%s", v)
+		}
+	}
+
+	os.Unsetenv("DENY_FRAMES")
+	os.Unsetenv("WEB_ADMIN_PASSWORD")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for WEB_ADMIN_USERNAME without WEB_ADMIN_PASSWORD")
+	}
+}
+
+func TestLoad_InitSequence(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("INIT_SEQUENCE", `[{"data":"aa 01"},{"data":"aa 02","delay_ms":500}]`)
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(config.InitSequence) != 2 || config.InitSequence[1].DelayMs != 500 {
+		t.Errorf("Unexpected init sequence %+v", config.InitSequence)
+	}
+
+	invalid := []string{
+		`[{"data":"zz"}]`,
+		`[{"data":""}]`,
+		`[{"data":"aa","delay_ms":-1}]`,
+		`not json`,
+	}
+	for _, v := range invalid {
+		os.Setenv("INIT_SEQUENCE", v)
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected error for INIT_SEQUENCE=%s", v)
+		}
+	}
+}
+
+func TestLoad_Polls(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("POLLS", `[{"name":"boiler","query":"01 03 00 00 00 02","interval":10,"response_prefix":"01 03","response_length":9}]`)
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(config.Polls) != 1 || config.Polls[0].ResponseLength != 9 {
+		t.Errorf("Unexpected polls %+v", config.Polls)
+	}
+
+	invalid := []string{
+		`[{"name":"","query":"01","interval":1}]`,
+		`[{"name":"x","query":"","interval":1}]`,
+		`[{"name":"x","query":"01","interval":0}]`,
+		`[{"name":"x","query":"01","interval":1,"response_prefix":"zz"}]`,
+		`[{"name":"x","query":"01","interval":1,"timeout_ms":5000}]`,
+		`[{"name":"x","query":"01","interval":1},{"name":"x","query":"02","interval":1}]`,
+	}
+	for _, v := range invalid {
+		os.Setenv("POLLS", v)
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected error for POLLS=%s", v)
+		}
+	}
+}
+
+func TestLoad_Values(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("VALUES", `[{"name":"boiler_temp","match":"01 03 04","offset":3,"type":"i16","scale":0.1,"unit":"°C"}]`)
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(config.Values) != 1 || config.Values[0].Scale != 0.1 {
+		t.Errorf("Unexpected values %+v", config.Values)
+	}
+
+	invalid := []string{
+		`[{"name":"","type":"u8"}]`,
+		`[{"name":"x","type":"u24"}]`,
+		`[{"name":"x","type":"u16","length":3}]`,
+		`[{"name":"x","type":"bcd"}]`,
+		`[{"name":"x","type":"u8","match":"zz"}]`,
+		`[{"name":"x","type":"u8","endian":"middle"}]`,
+		`[{"name":"x","type":"u8","offset":-1}]`,
+		`[{"name":"x","type":"u8"},{"name":"x","type":"u8"}]`,
+	}
+	for _, v := range invalid {
+		os.Setenv("VALUES", v)
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected error for VALUES=%s", v)
+		}
+	}
+}
+
+func TestLoad_MultiUpstream(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("UPSTREAM_NAME", "meter1")
+	os.Setenv("UPSTREAMS", `[{"name":"meter2","addr":"192.168.1.101:8899"},{"name":"meter3","addr":"ws://192.168.1.102/serial"}]`)
+	os.Setenv("UPSTREAM_WRITE_TARGET", "meter2")
+	os.Setenv("UPSTREAM_SOURCE_TAGS", "true")
+	os.Setenv("UPSTREAM_DETECT", "1")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.UpstreamName != "meter1" || len(config.Upstreams) != 2 {
+		t.Errorf("Unexpected upstreams %q %+v", config.UpstreamName, config.Upstreams)
+	}
+	if config.UpstreamWrite != "meter2" || !config.UpstreamTags {
+		t.Errorf("Unexpected write target %q / tags %v", config.UpstreamWrite, config.UpstreamTags)
+	}
+	if !config.UpstreamDetect {
+		t.Error("Expected UPSTREAM_DETECT enabled")
+	}
+
+	invalid := []struct {
+		upstreams string
+		write     string
+	}{
+		{`[{"name":"meter1","addr":"10.0.0.1:1"}]`, ""},
+		{`[{"name":"all","addr":"10.0.0.1:1"}]`, ""},
+		{`[{"name":"m","addr":"10.0.0.1"}]`, ""},
+		{`[{"name":"m","addr":"http://10.0.0.1"}]`, ""},
+		{`[{"name":"m","addr":"10.0.0.1:1"}]`, "unknown"},
+	}
+	for _, tt := range invalid {
+		os.Setenv("UPSTREAMS", tt.upstreams)
+		os.Setenv("UPSTREAM_WRITE_TARGET", tt.write)
+		if tt.write == "" {
+			os.Unsetenv("UPSTREAM_WRITE_TARGET")
+		}
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected error for UPSTREAMS=%s UPSTREAM_WRITE_TARGET=%s", tt.upstreams, tt.write)
+		}
+	}
+}
+
+func TestLoad_Transforms(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("TRANSFORM_FROM_UPSTREAM", "kiss-decode")
+	os.Setenv("TRANSFORM_TO_UPSTREAM", "kiss-encode")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.TransformFrom != "kiss-decode" || config.TransformTo != "kiss-encode" {
+		t.Errorf("Unexpected transforms %q / %q", config.TransformFrom, config.TransformTo)
+	}
+
+	os.Setenv("TRANSFORM_TO_UPSTREAM", "rot13")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for unknown transform")
+	}
+}
+
+func TestLoad_FrameGap(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("FRAME_GAP_MS", "4")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.FrameGapMs != 4 {
+		t.Errorf("Expected FrameGapMs 4, got %d", config.FrameGapMs)
+	}
+
+	os.Setenv("FRAME_GAP_MS", "-1")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for negative FRAME_GAP_MS")
+	}
+}
+
+func TestLoad_ClientPriorities(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("FAIR_WRITE_SCHEDULING", "true")
+	os.Setenv("CLIENT_PRIORITIES", `[{"match":"192.168.1.20","priority":4},{"match":"10.0.0.0/8","priority":2}]`)
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !config.FairWrites {
+		t.Error("Expected FairWrites to be enabled")
+	}
+	if len(config.ClientPriority) != 2 {
+		t.Fatalf("Expected 2 priority rules, got %d", len(config.ClientPriority))
+	}
+	if !config.ClientPriority[0].Matches(net.ParseIP("192.168.1.20")) {
+		t.Error("Expected IP rule to match its address")
+	}
+	if !config.ClientPriority[1].Matches(net.ParseIP("10.1.2.3")) {
+		t.Error("Expected CIDR rule to match an address in range")
+	}
+	if config.ClientPriority[1].Matches(net.ParseIP("192.168.1.20")) {
+		t.Error("Expected CIDR rule not to match an address out of range")
+	}
+
+	for _, bad := range []string{
+		`[{"match":"not-an-ip","priority":1}]`,
+		`[{"match":"10.0.0.1","priority":0}]`,
+		`[{"match":"10.0.0.1","priority":17}]`,
+	} {
+		os.Setenv("CLIENT_PRIORITIES", bad)
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected error for CLIENT_PRIORITIES %s", bad)
+		}
+	}
+}
+
+func TestLoad_ACME(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("WEB_ACME_DOMAINS", "proxy.example.com, www.proxy.example.com")
+	os.Setenv("WEB_ACME_EMAIL", "admin@example.com")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !config.ACMEEnabled() || len(config.ACMEDomains) != 2 || config.ACMEDomains[1] != "www.proxy.example.com" {
+		t.Errorf("Unexpected ACMEDomains: %v", config.ACMEDomains)
+	}
+	if config.ACMECacheDir != "/data/acme" {
+		t.Errorf("Expected default ACMECacheDir /data/acme, got %q", config.ACMECacheDir)
+	}
+	if config.ACMEHTTPPort != 80 {
+		t.Errorf("Expected default ACMEHTTPPort 80, got %d", config.ACMEHTTPPort)
+	}
+
+	os.Setenv("WEB_ACME_DOMAINS", "https://proxy.example.com")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for a URL instead of a hostname")
+	}
+
+	os.Setenv("WEB_ACME_DOMAINS", "proxy.example.com")
+	os.Setenv("WEB_ACME_DIRECTORY_URL", "http://insecure.example.com/directory")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for a non-https directory URL")
+	}
+}
+
+func TestLoad_PacketLogFilter(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("LOG_PACKET_DIRECTIONS", "to_upstream")
+	os.Setenv("LOG_PACKET_SOURCES", "client#3, INJECT")
+	os.Setenv("LOG_PACKET_DELTAS", "1")
+	os.Setenv("LOG_PACKET_OFFSETS", "true")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	f := config.PacketLogFilter()
+	if len(f.Directions) != 1 || f.Directions[0] != "->UP" {
+		t.Errorf("Expected directions [->UP], got %v", f.Directions)
+	}
+	if len(f.Sources) != 2 || f.Sources[1] != "INJECT" {
+		t.Errorf("Expected sources [client#3 INJECT], got %v", f.Sources)
+	}
+	if !config.LogDeltas {
+		t.Error("Expected LogDeltas=true")
+	}
+	if !config.LogOffsets {
+		t.Error("Expected LogOffsets=true")
+	}
+
+	os.Setenv("LOG_PACKET_DIRECTIONS", "sideways")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for an invalid direction")
+	}
+
+	os.Setenv("LOG_PACKET_DIRECTIONS", "from_upstream")
+	os.Setenv("LOG_PACKET_SOURCES", "client[")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for an invalid source pattern")
+	}
+}
+
+func TestLoad_WebLogBuffer(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.WebLogLines != 1000 || config.WebPacketLines != 1000 || config.WebLogMaxAge != 0 {
+		t.Errorf("Expected defaults 1000/1000/0, got %d/%d/%d", config.WebLogLines, config.WebPacketLines, config.WebLogMaxAge)
+	}
+
+	os.Setenv("WEB_LOG_BUFFER", "200")
+	os.Setenv("WEB_PACKET_BUFFER", "50000")
+	os.Setenv("WEB_LOG_MAX_AGE", "3600")
+	config, err = Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.WebLogLines != 200 || config.WebPacketLines != 50000 || config.WebLogMaxAge != 3600 {
+		t.Errorf("Expected 200/50000/3600, got %d/%d/%d", config.WebLogLines, config.WebPacketLines, config.WebLogMaxAge)
+	}
+
+	os.Setenv("WEB_PACKET_BUFFER", "0")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for an empty packet buffer")
+	}
+}
+
+func TestLoad_ConnectionLimits(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("MAX_CLIENTS_PER_IP", "2")
+	os.Setenv("CONNECT_RATE_LIMIT", "20")
+	os.Setenv("CLIENT_BANNER", "proxy ready")
+	os.Setenv("CLIENT_IDENT_TIMEOUT", "3")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.MaxClientsPerIP != 2 || config.ConnectRate != 20 {
+		t.Errorf("Expected MaxClientsPerIP=2 and ConnectRate=20, got %d and %d", config.MaxClientsPerIP, config.ConnectRate)
+	}
+	if config.GreylistSecs != 300 {
+		t.Errorf("Expected default GreylistSecs 300, got %d", config.GreylistSecs)
+	}
+	if config.ClientBanner != "proxy ready" || config.IdentTimeout != 3 {
+		t.Errorf("Expected banner and ident timeout, got %q and %d", config.ClientBanner, config.IdentTimeout)
+	}
+
+	os.Setenv("CONNECT_GREYLIST_SECONDS", "0")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for a zero greylist period")
+	}
+
+	os.Setenv("CONNECT_GREYLIST_SECONDS", "60")
+	os.Setenv("CLIENT_IDENT_TIMEOUT", "61")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for CLIENT_IDENT_TIMEOUT above 60")
+	}
+
+	os.Setenv("CLIENT_IDENT_TIMEOUT", "3")
+	os.Setenv("MAX_CLIENTS_PER_IP", "11")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for MAX_CLIENTS_PER_IP above MAX_CLIENTS")
+	}
+}
+
+func TestLoad_RawListenPort(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("RAW_LISTEN_PORT", "18900")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.RawListenPort != 18900 {
+		t.Errorf("Expected RawListenPort 18900, got %d", config.RawListenPort)
+	}
+	if config.RawListenAddr() != ":18900" {
+		t.Errorf("Expected RawListenAddr :18900, got %s", config.RawListenAddr())
+	}
+
+	os.Setenv("RAW_LISTEN_PORT", "18899")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for RAW_LISTEN_PORT equal to LISTEN_PORT")
+	}
+}
+
+func TestLoad_ListenFormat(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("LISTEN_FORMAT", "hex")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.ListenFormat != FormatHex || config.RawListenFormat != "" {
+		t.Errorf("Expected formats hex and default, got %q and %q", config.ListenFormat, config.RawListenFormat)
+	}
+
+	os.Setenv("RAW_LISTEN_FORMAT", "ascii")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for an unknown RAW_LISTEN_FORMAT")
+	}
+}
+
+func TestLoad_ClientEngine(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("CLIENT_ENGINE", "epoll")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.ClientEngine != EngineEpoll {
+		t.Errorf("Expected engine epoll, got %q", config.ClientEngine)
+	}
+
+	os.Setenv("CLIENT_ENGINE", "kqueue")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for an unknown CLIENT_ENGINE")
+	}
+}
+
+func TestLoad_Storage(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.StorageBackend != StorageMemory || config.StoragePath != "/data/storage.db" {
+		t.Errorf("Expected memory storage by default, got %q at %q", config.StorageBackend, config.StoragePath)
+	}
+
+	os.Setenv("STORAGE_BACKEND", "sqlite")
+	os.Setenv("STORAGE_PATH", "/tmp/s.db")
+	if config, err = Load(); err != nil || config.StorageBackend != StorageSQLite || config.StoragePath != "/tmp/s.db" {
+		t.Errorf("Expected sqlite storage at /tmp/s.db, got %+v, %v", config, err)
+	}
+
+	os.Setenv("STORAGE_BACKEND", "bolt")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for an unknown STORAGE_BACKEND")
+	}
+}
+
+func TestLoad_Retention(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("RETENTION_MAX_MB", "512")
+	os.Setenv("RETENTION_MAX_AGE_DAYS", "14")
+
+	config, err := Load()
+	if err != nil || config.RetentionMaxMB != 512 || config.RetentionMaxAge != 14 {
+		t.Errorf("Expected 512 MB for 14 days, got %d, %d, %v", config.RetentionMaxMB, config.RetentionMaxAge, err)
+	}
+
+	for _, name := range []string{"RETENTION_MAX_MB", "RETENTION_MAX_AGE_DAYS"} {
+		os.Setenv(name, "-1")
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected error for negative %s", name)
+		}
+		os.Setenv(name, "1")
+	}
+}
+
+func TestLoad_WriteJournal(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("WRITE_JOURNAL", "/data/writes.jsonl")
+	os.Setenv("WRITE_JOURNAL_MAX_MB", "50")
+	os.Setenv("WRITE_JOURNAL_FILES", "20")
+
+	config, err := Load()
+	if err != nil || config.WriteJournal != "/data/writes.jsonl" || config.JournalMaxMB != 50 || config.JournalFiles != 20 {
+		t.Errorf("Expected /data/writes.jsonl rotated at 50 MB keeping 20 files, got %q, %d, %d, %v", config.WriteJournal, config.JournalMaxMB, config.JournalFiles, err)
+	}
+
+	for name, value := range map[string]string{
+		"WRITE_JOURNAL_MAX_MB": "20000",
+		"WRITE_JOURNAL_FILES":  "-1",
+		"WRITE_JOURNAL":        "/data/packets.log",
+	} {
+		old := os.Getenv(name)
+		os.Setenv(name, value)
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected error for %s=%s", name, value)
+		}
+		os.Setenv(name, old)
+	}
+}
+
+func TestLoad_WebBinding(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+
+	config, err := Load()
+	if err != nil || config.WebBindRetry != 10 || len(config.WebFallbackPorts) != 0 {
+		t.Fatalf("Expected 10s of retries without fallback ports by default, got %d, %v, %v", config.WebBindRetry, config.WebFallbackPorts, err)
+	}
+
+	os.Setenv("WEB_BIND_RETRY_SECONDS", "30")
+	os.Setenv("WEB_FALLBACK_PORTS", "18081, 18082,0")
+	config, err = Load()
+	if err != nil || config.WebBindRetry != 30 || !slices.Equal(config.WebFallbackPorts, []int{18081, 18082, 0}) {
+		t.Errorf("Expected 30s and fallback ports 18081, 18082 and any, got %d, %v, %v", config.WebBindRetry, config.WebFallbackPorts, err)
+	}
+
+	for name, value := range map[string]string{
+		"WEB_BIND_RETRY_SECONDS": "-1",
+		"WEB_FALLBACK_PORTS":     "18080",
+	} {
+		os.Setenv(name, value)
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected error for %s=%s", name, value)
+		}
+		os.Unsetenv(name)
+	}
+	os.Setenv("WEB_BIND_RETRY_SECONDS", "10s")
+	os.Setenv("WEB_FALLBACK_PORTS", "18081,ui")
+	config, err = Load()
+	if err != nil || config.WebBindRetry != 10 || len(config.WebFallbackPorts) != 0 {
+		t.Errorf("Expected unparsable values to keep the defaults, got %d, %v, %v", config.WebBindRetry, config.WebFallbackPorts, err)
+	}
+	os.Unsetenv("WEB_BIND_RETRY_SECONDS")
+	os.Setenv("WEB_FALLBACK_PORTS", "70000")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for a WEB_FALLBACK_PORTS entry out of range")
+	}
+}
+
+func TestLoad_ClientIDs(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("CLIENT_IDS", "stable")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.ClientIDs != ClientIDsStable {
+		t.Errorf("Expected stable client IDs, got %q", config.ClientIDs)
+	}
+
+	os.Setenv("CLIENT_IDS", "random")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for an unknown CLIENT_IDS")
+	}
+}
+
+func TestLoad_UpstreamTCPOptions(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("UPSTREAM_TCP_USER_TIMEOUT", "5")
+	os.Setenv("UPSTREAM_KEEPALIVE_IDLE", "10")
+	os.Setenv("UPSTREAM_KEEPALIVE_INTERVAL", "2")
+	os.Setenv("UPSTREAM_KEEPALIVE_COUNT", "3")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.TCPUserTimeout != 5 || config.TCPKeepIdle != 10 || config.TCPKeepInterval != 2 || config.TCPKeepCount != 3 {
+		t.Errorf("Expected 5/10/2/3, got %d/%d/%d/%d",
+			config.TCPUserTimeout, config.TCPKeepIdle, config.TCPKeepInterval, config.TCPKeepCount)
+	}
+
+	os.Setenv("UPSTREAM_TCP_USER_TIMEOUT", "-1")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for a negative UPSTREAM_TCP_USER_TIMEOUT")
+	}
+	os.Setenv("UPSTREAM_TCP_USER_TIMEOUT", "5")
+	os.Setenv("UPSTREAM_KEEPALIVE_COUNT", "1000")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for UPSTREAM_KEEPALIVE_COUNT above 100")
+	}
+}
+
+func TestLoad_SocketMarking(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("SOCKET_DSCP", "46")
+	os.Setenv("SOCKET_PRIORITY", "6")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.SocketDSCP != 46 || config.SocketPriority != 6 {
+		t.Errorf("Expected 46/6, got %d/%d", config.SocketDSCP, config.SocketPriority)
+	}
+
+	os.Setenv("SOCKET_DSCP", "64")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for SOCKET_DSCP above 63")
+	}
+	os.Setenv("SOCKET_DSCP", "0")
+	os.Setenv("SOCKET_PRIORITY", "7")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for SOCKET_PRIORITY above 6")
+	}
+}
+
+func TestLoad_Mux(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_URL", "mux://relay.example:18905/meter?insecure=1")
+	os.Setenv("MUX_LISTEN_PORT", "18905")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.MuxListenPort != 18905 || config.MuxListenAddr() != ":18905" {
+		t.Errorf("Expected mux listener on :18905, got %d (%s)", config.MuxListenPort, config.MuxListenAddr())
+	}
+
+	os.Setenv("UPSTREAM_URL", "mux://relay.example:18905")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for a mux URL without an upstream name")
+	}
+	os.Setenv("UPSTREAM_URL", "mux://relay.example:18905/meter")
+	os.Setenv("MUX_LISTEN_PORT", "18899")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for MUX_LISTEN_PORT equal to LISTEN_PORT")
+	}
+}
+
+func TestLoad_ListenProfile(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("LISTEN_PROFILE", "esphome")
+	os.Setenv("LISTEN_SINGLE_CLIENT", "true")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.ListenProfile != ProfileESPHome || !config.ListenSingle || config.RawListenSingle {
+		t.Errorf("Unexpected %q, %v, %v", config.ListenProfile, config.ListenSingle, config.RawListenSingle)
+	}
+
+	os.Setenv("LISTEN_FORMAT", "hex")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for the esphome profile with the hex format")
+	}
+	os.Setenv("LISTEN_FORMAT", "binary")
+	os.Setenv("RAW_LISTEN_PROFILE", "ser2net")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for an unknown RAW_LISTEN_PROFILE")
+	}
+}
+
+func TestLoad_RefusedWrites(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("CLIENT_REFUSED_WRITES", "error")
+	os.Setenv("CLIENT_REFUSED_MESSAGE", "NAK read-only")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.RefusedWrites != RefuseError || config.RefusedMessage != "NAK read-only" {
+		t.Errorf("Unexpected %q, %q", config.RefusedWrites, config.RefusedMessage)
+	}
+
+	os.Setenv("CLIENT_REFUSED_WRITES", "close")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for an unknown CLIENT_REFUSED_WRITES")
+	}
+	os.Setenv("CLIENT_REFUSED_WRITES", "error")
+	os.Setenv("CLIENT_REFUSED_MESSAGE", "two\nlines")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for a multi-line CLIENT_REFUSED_MESSAGE")
+	}
+}
+
+func TestLoad_StatusListenPort(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("STATUS_LISTEN_PORT", "18901")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.StatusListenPort != 18901 || config.StatusListenAddr() != ":18901" {
+		t.Errorf("Expected status listener on :18901, got %d (%s)", config.StatusListenPort, config.StatusListenAddr())
+	}
+
+	os.Setenv("STATUS_LISTEN_PORT", "18899")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for STATUS_LISTEN_PORT equal to LISTEN_PORT")
+	}
+}
+
+func TestLoad_ControllerWindow(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.ControllerSecs != 60 {
+		t.Errorf("Expected a 60 second default, got %d", config.ControllerSecs)
+	}
+
+	os.Setenv("CLIENT_CONTROLLER_WINDOW", "0")
+	config, err = Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.ControllerSecs != 0 {
+		t.Errorf("Expected detection to be disabled, got %d", config.ControllerSecs)
+	}
+	os.Setenv("CLIENT_CONTROLLER_WINDOW", "3601")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for CLIENT_CONTROLLER_WINDOW above 3600")
+	}
+}
+
+func TestLoad_OutagePolicies(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("CLIENT_OUTAGE_POLICY", "buffer")
+	os.Setenv("CLIENT_OUTAGE_BUFFER", "8192")
+	os.Setenv("CLIENT_OUTAGE_POLICIES", `[{"match":"10.0.0.0/24","policy":"close"}]`)
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.OutagePolicy != OutageBuffer || config.OutageBuffer != 8192 {
+		t.Errorf("Expected buffer policy with 8192 bytes, got %q with %d", config.OutagePolicy, config.OutageBuffer)
+	}
+	if len(config.OutageRules) != 1 || !config.OutageRules[0].Matches(net.ParseIP("10.0.0.7")) {
+		t.Errorf("Expected a rule matching 10.0.0.7, got %+v", config.OutageRules)
+	}
+
+	os.Setenv("CLIENT_OUTAGE_POLICIES", `[{"match":"10.0.0.0/24","policy":"queue"}]`)
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for an unknown outage policy")
+	}
+	os.Setenv("CLIENT_OUTAGE_POLICIES", "")
+	os.Setenv("CLIENT_OUTAGE_POLICY", "reject")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for an unknown CLIENT_OUTAGE_POLICY")
+	}
+}
+
+func TestLoad_AccessRules(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("CLIENT_ACCESS", "read")
+	os.Setenv("CLIENT_ACCESS_RULES", `[{"match":"192.168.1.20","access":"write"},{"name":"dash-*","access":"inject"},{"name":"integrator","access":"write","hours":"Mon-Fri 08:00-18:00"}]`)
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.ClientAccess != AccessRead || len(config.AccessRules) != 3 || config.AccessRules[2].Hours != "Mon-Fri 08:00-18:00" {
+		t.Fatalf("Unexpected access config %q %+v", config.ClientAccess, config.AccessRules)
+	}
+	if !config.AccessRules[0].Matches(net.ParseIP("192.168.1.20"), "") {
+		t.Error("Expected the address rule to match any name")
+	}
+	if !config.AccessRules[1].Matches(net.ParseIP("10.0.0.1"), "dash-kitchen") {
+		t.Error("Expected the name rule to match any address")
+	}
+	if config.AccessRules[1].Matches(net.ParseIP("10.0.0.1"), "") {
+		t.Error("Expected the name rule not to match an anonymous client")
+	}
+
+	for _, rules := range []string{
+		`[{"access":"read"}]`,
+		`[{"match":"not-an-ip","access":"read"}]`,
+		`[{"name":"[","access":"read"}]`,
+		`[{"match":"10.0.0.0/8","access":"admin"}]`,
+		`[{"name":"integrator","access":"write","hours":"weekdays"}]`,
+	} {
+		os.Setenv("CLIENT_ACCESS_RULES", rules)
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected error for CLIENT_ACCESS_RULES %s", rules)
+		}
+	}
+	os.Setenv("CLIENT_ACCESS_RULES", "")
+	os.Setenv("CLIENT_ACCESS", "none")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for an unknown CLIENT_ACCESS")
+	}
+}
+
+func TestLoad_ClientGroups(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("CLIENT_GROUPS", `[{"name":"dashboards","client":"dash-*","filter":["f7 0e","f7 12"]},{"name":"lan","match":"192.168.1.0/24"}]`)
+	os.Setenv("TRIGGERS", `[{"name":"status","hex_prefix":"f7 0e","respond":"f7 0e 80","target":"group:dashboards"}]`)
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(config.ClientGroups) != 2 || len(config.ClientGroups[0].Filter) != 2 || config.Triggers[0].Target != "group:dashboards" {
+		t.Fatalf("Unexpected groups %+v and triggers %+v", config.ClientGroups, config.Triggers)
+	}
+	if !config.ClientGroups[1].Matches(net.ParseIP("192.168.1.20"), "") {
+		t.Error("Expected the address group to match any name")
+	}
+	if config.ClientGroups[0].Matches(net.ParseIP("192.168.1.20"), "") {
+		t.Error("Expected the name group not to match an anonymous client")
+	}
+
+	for _, groups := range []string{
+		`[{"name":"dashboards"}]`,
+		`[{"match":"10.0.0.0/8"}]`,
+		`[{"name":"lan","match":"not-an-ip"}]`,
+		`[{"name":"dashboards","client":"["}]`,
+		`[{"name":"dashboards","client":"dash-*","filter":["zz"]}]`,
+		`[{"name":"lan","match":"10.0.0.0/8"},{"name":"lan","match":"192.168.0.0/16"}]`,
+	} {
+		os.Setenv("CLIENT_GROUPS", groups)
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected error for CLIENT_GROUPS %s", groups)
+		}
+	}
+
+	os.Setenv("CLIENT_GROUPS", `[{"name":"lan","match":"192.168.1.0/24"}]`)
+	for _, triggers := range []string{
+		`[{"name":"status","respond":"f7","target":"group:dashboards"}]`,
+		`[{"name":"status","respond":"f7","target":"clients"}]`,
+		`[{"name":"status","alert":true,"target":"upstream"}]`,
+	} {
+		os.Setenv("TRIGGERS", triggers)
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected error for TRIGGERS %s", triggers)
+		}
+	}
+}
+
+func TestLoad_HealthDataThresholds(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("HEALTH_DATA_DEGRADED_SECONDS", "60")
+	os.Setenv("HEALTH_DATA_UNHEALTHY_SECONDS", "600")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.HealthDegraded != 60 || config.HealthUnhealthy != 600 {
+		t.Errorf("Expected 60/600, got %d/%d", config.HealthDegraded, config.HealthUnhealthy)
+	}
+
+	os.Setenv("HEALTH_DATA_UNHEALTHY_SECONDS", "30")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for an unhealthy threshold below the degraded one")
+	}
+	os.Setenv("HEALTH_DATA_UNHEALTHY_SECONDS", "-1")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for a negative threshold")
+	}
+}
+
+func TestLoad_HealthDebounce(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("HEALTH_DEBOUNCE_SECONDS", "15")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.HealthDebounce != 15 {
+		t.Errorf("Expected 15, got %d", config.HealthDebounce)
+	}
+
+	os.Setenv("HEALTH_DEBOUNCE_SECONDS", "3601")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for HEALTH_DEBOUNCE_SECONDS above 3600")
+	}
+}
+
+func TestLoad_WebSessions(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.WebSessionLife != 86400 || config.WebSessionIdle != 0 {
+		t.Errorf("Expected a 24h lifetime without idle timeout, got %d, %d", config.WebSessionLife, config.WebSessionIdle)
+	}
+
+	os.Setenv("WEB_SESSION_LIFETIME", "3600")
+	os.Setenv("WEB_SESSION_IDLE_TIMEOUT", "600")
+	if config, err = Load(); err != nil || config.WebSessionLife != 3600 || config.WebSessionIdle != 600 {
+		t.Errorf("Unexpected %+v, %v", config, err)
+	}
+
+	os.Setenv("WEB_SESSION_IDLE_TIMEOUT", "7200")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for an idle timeout longer than the lifetime")
+	}
+	os.Setenv("WEB_SESSION_IDLE_TIMEOUT", "30")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for an idle timeout under 60 seconds")
+	}
+	os.Setenv("WEB_SESSION_IDLE_TIMEOUT", "0")
+	os.Setenv("WEB_SESSION_LIFETIME", "59")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for a lifetime under 60 seconds")
+	}
+}
+
+func TestLoad_WriteRetry(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("UPSTREAM_RETRY_FRAMES", "8")
+	os.Setenv("UPSTREAM_RETRY_MAX_AGE_MS", "1500")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.WriteRetryFrames != 8 || config.WriteRetryMaxAge != 1500 {
+		t.Errorf("Expected 8 frames and 1500ms, got %d/%d", config.WriteRetryFrames, config.WriteRetryMaxAge)
+	}
+
+	os.Setenv("UPSTREAM_RETRY_FRAMES", "2000")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for too many retry frames")
+	}
+	os.Setenv("UPSTREAM_RETRY_FRAMES", "8")
+	os.Setenv("UPSTREAM_RETRY_MAX_AGE_MS", "-1")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for a negative retry age")
+	}
+}
+
+func TestLoad_WebKeepAlive(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !config.StatusPushEnabled() {
+		t.Error("Expected status pushes enabled by default")
+	}
+
+	os.Setenv("WEB_STATUS_PUSH", "false")
+	os.Setenv("WEB_STATUS_INTERVAL", "10")
+	os.Setenv("WEB_SSE_HEARTBEAT", "45")
+	os.Setenv("WEB_WS_PING_INTERVAL", "20")
+	os.Setenv("WEB_PACKET_EVENTS", "1")
+	config, err = Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.StatusPushEnabled() {
+		t.Error("Expected status pushes disabled")
+	}
+	if !config.WebPacketEvents {
+		t.Error("Expected packet events enabled")
+	}
+	if config.WebStatusInterval != 10 || config.WebSSEHeartbeat != 45 || config.WebWSPing != 20 {
+		t.Errorf("Expected 10/45/20, got %d/%d/%d", config.WebStatusInterval, config.WebSSEHeartbeat, config.WebWSPing)
+	}
+
+	os.Setenv("WEB_WS_PING_INTERVAL", "3601")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for a ping interval above the limit")
+	}
+}
+
+func TestLoad_InjectEnabled(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !config.InjectionEnabled() {
+		t.Error("Expected injection enabled by default")
+	}
+
+	os.Setenv("INJECT_ENABLED", "false")
+	config, err = Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.InjectionEnabled() {
+		t.Error("Expected injection disabled with INJECT_ENABLED=false")
+	}
+}
+
+func TestLoad_StartParked(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("START_PARKED", "true")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !config.StartParked {
+		t.Error("Expected StartParked with START_PARKED=true")
+	}
+}
+
+func TestLoad_LatencyBudget(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("LATENCY_BUDGET_MS", "20")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.LatencyBudgetMs != 20 {
+		t.Errorf("Expected LatencyBudgetMs 20, got %d", config.LatencyBudgetMs)
+	}
+
+	os.Setenv("LATENCY_BUDGET_MS", "-1")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for a negative LATENCY_BUDGET_MS")
+	}
+}
+
+func TestLoad_WaitForUpstream(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.UpstreamWait() != 0 {
+		t.Errorf("Expected no wait by default, got %v", config.UpstreamWait())
+	}
+
+	for value, want := range map[string]time.Duration{"30s": 30 * time.Second, "2m": 2 * time.Minute, "15": 15 * time.Second} {
+		os.Setenv("WAIT_FOR_UPSTREAM", value)
+		config, err := Load()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", value, err)
+		}
+		if config.UpstreamWait() != want {
+			t.Errorf("%s: expected %v, got %v", value, want, config.UpstreamWait())
+		}
+	}
+
+	for _, value := range []string{"soon", "-5s", "2h"} {
+		os.Setenv("WAIT_FOR_UPSTREAM", value)
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected error for WAIT_FOR_UPSTREAM=%s", value)
+		}
+	}
+}
+
+func TestLoad_TLSRoutes(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("UPSTREAMS", `[{"name":"meter2","addr":"192.168.1.101:8899"}]`)
+	os.Setenv("TLS_LISTEN_PORT", "18443")
+	os.Setenv("TLS_ROUTES", `[{"sni":"*.meter.lan","upstream":"primary"},{"alpn":"meter2","upstream":"meter2"},{"alpn":"meter2","upstream":"primary"}]`)
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(config.TLSRoutes) != 3 || config.TLSListenAddr() != ":18443" {
+		t.Errorf("Unexpected TLS config %+v", config.TLSRoutes)
+	}
+	if protos := config.TLSProtocols(); len(protos) != 1 || protos[0] != "meter2" {
+		t.Errorf("Expected the ALPN tokens once, got %v", protos)
+	}
+	sni := config.TLSRoutes[0]
+	if !sni.Matches("Kitchen.Meter.LAN", "") || sni.Matches("meter.lan", "") || sni.Matches("", "meter2") {
+		t.Error("Unexpected SNI matching")
+	}
+
+	for _, routes := range []string{
+		`[{"upstream":"primary"}]`,
+		`[{"sni":"a","alpn":"b","upstream":"primary"}]`,
+		`[{"sni":"[","upstream":"primary"}]`,
+		`[{"sni":"a","upstream":"nowhere"}]`,
+		`{`,
+	} {
+		os.Setenv("TLS_ROUTES", routes)
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected error for TLS_ROUTES=%s", routes)
+		}
+	}
+
+	os.Setenv("TLS_ROUTES", `[{"sni":"a","upstream":"primary"}]`)
+	for _, port := range []string{"0", "18899", "70000"} {
+		os.Setenv("TLS_LISTEN_PORT", port)
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected error for TLS_LISTEN_PORT=%s", port)
+		}
+	}
+}
+
+func TestLoad_Hooks(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("ON_UPSTREAM_DOWN", "/config/relay.sh off")
+	os.Setenv("ON_CLIENT_DISCONNECT", "logger gone")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.OnUpstreamDown != "/config/relay.sh off" || config.OnClientClose != "logger gone" || config.OnUpstreamUp != "" {
+		t.Errorf("Unexpected hooks %+v", config)
+	}
+	if config.HookTimeout != 10 {
+		t.Errorf("Expected default HOOK_TIMEOUT 10, got %d", config.HookTimeout)
+	}
+
+	for _, timeout := range []string{"0", "3601"} {
+		os.Setenv("HOOK_TIMEOUT", timeout)
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected error for HOOK_TIMEOUT=%s", timeout)
+		}
+	}
+}
+
+func TestLoad_Liveness(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("CLIENT_LIVENESS_TIMEOUT", "120")
+	os.Setenv("CLIENT_LIVENESS_CHECK", "keepalive")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.LivenessTimeout != 120 || config.LivenessCheck != LivenessKeepalive {
+		t.Errorf("Unexpected liveness settings %d %q", config.LivenessTimeout, config.LivenessCheck)
+	}
+
+	os.Setenv("CLIENT_LIVENESS_CHECK", "ping")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for CLIENT_LIVENESS_CHECK=ping")
+	}
+	os.Setenv("CLIENT_LIVENESS_CHECK", "data")
+	os.Setenv("CLIENT_LIVENESS_TIMEOUT", "-1")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for CLIENT_LIVENESS_TIMEOUT=-1")
+	}
+}
+
+func TestLoad_Heartbeat(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("CLIENT_HEARTBEAT_FRAME", "F7 0E 00")
+	os.Setenv("CLIENT_HEARTBEAT_SECONDS", "30")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.HeartbeatFrame != "F7 0E 00" || config.HeartbeatSecs != 30 {
+		t.Errorf("Unexpected heartbeat settings %q %d", config.HeartbeatFrame, config.HeartbeatSecs)
+	}
+
+	os.Setenv("CLIENT_HEARTBEAT_FRAME", "F7 0")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for CLIENT_HEARTBEAT_FRAME=F7 0")
+	}
+	os.Unsetenv("CLIENT_HEARTBEAT_FRAME")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for CLIENT_HEARTBEAT_SECONDS without a frame")
+	}
+	os.Setenv("CLIENT_HEARTBEAT_FRAME", "F7")
+	os.Setenv("CLIENT_HEARTBEAT_SECONDS", "3601")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for CLIENT_HEARTBEAT_SECONDS=3601")
+	}
+}
+
+func TestLoad_Recovery(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.RecoveryAfter != 0 || config.RecoveryMethod != "POST" || config.RecoveryPause != 300 || config.RecoveryMax != 3 {
+		t.Errorf("Unexpected recovery defaults %+v", config)
+	}
+
+	os.Setenv("RECOVERY_AFTER_FAILURES", "5")
+	os.Setenv("RECOVERY_URL", "http://plug.local/relay/0?turn=off&timer=10")
+	os.Setenv("RECOVERY_METHOD", "GET")
+	config, err = Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.RecoveryAfter != 5 || config.RecoveryMethod != "GET" {
+		t.Errorf("Unexpected recovery config %+v", config)
+	}
+
+	for name, value := range map[string]string{
+		"RECOVERY_URL":            "ftp://plug.local",
+		"RECOVERY_METHOD":         "DELETE",
+		"RECOVERY_MQTT_TOPIC":     "plug/power", // without MQTT_BROKER
+		"RECOVERY_COOLDOWN":       "-1",
+		"RECOVERY_MAX_ATTEMPTS":   "101",
+		"RECOVERY_AFTER_FAILURES": "1001",
+	} {
+		old, _ := os.LookupEnv(name)
+		os.Setenv(name, value)
+		if _, err := Load(); err == nil {
+			t.Errorf("Expected error for %s=%s", name, value)
+		}
+		os.Setenv(name, old)
+	}
+
+	os.Unsetenv("RECOVERY_URL")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error without RECOVERY_URL or RECOVERY_MQTT_TOPIC")
+	}
+}
+
+func TestLoad_UpstreamQuirks(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("UPSTREAM_QUIRKS", "banner, ota")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !config.HasQuirk(QuirkBanner) || !config.HasQuirk(QuirkOTA) || config.HasQuirk(QuirkTelnet) {
+		t.Errorf("Unexpected quirks %q", config.UpstreamQuirks)
+	}
+
+	os.Setenv("UPSTREAM_QUIRKS", "banner,reboot")
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for an unknown quirk")
+	}
+}
+
+func TestLoad_ResponseTimeout(t *testing.T) {
+	os.Clearenv()
+	os.Setenv("UPSTREAM_HOST", "192.168.1.100")
+	os.Setenv("RESPONSE_TIMEOUT_MS", "500")
+
+	if _, err := Load(); err == nil {
+		t.Error("Expected error for RESPONSE_TIMEOUT_MS without FRAME_GAP_MS")
+	}
+
+	os.Setenv("FRAME_GAP_MS", "5")
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if config.ResponseTimeoutMs != 500 {
+		t.Errorf("Expected 500, got %d", config.ResponseTimeoutMs)
+	}
+}
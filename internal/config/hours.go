@@ -0,0 +1,132 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Hours is a weekly schedule such as "Mon-Fri 08:00-18:00, Sat 09:00-13:00"
+// in the local time zone (TZ)
+type Hours []hoursSpan
+
+type hoursSpan struct {
+	days       [7]bool // indexed by time.Weekday
+	start, end int     // minutes after midnight; end <= start runs past midnight
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseHours parses comma-separated spans of an optional day or day range
+// ("Mon", "Mon-Fri", "Fri-Mon") and a time range ("08:00-18:00"). A span
+// without days applies every day. A span ending at or before its start
+// runs past midnight into the next day, and "24:00" ends at midnight.
+func ParseHours(s string) (Hours, error) {
+	var hours Hours
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Fields(part)
+		var span hoursSpan
+		switch len(fields) {
+		case 1:
+			for d := range span.days {
+				span.days[d] = true
+			}
+		case 2:
+			if err := span.parseDays(fields[0]); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("invalid span %q, expected [days] HH:MM-HH:MM", strings.TrimSpace(part))
+		}
+		if err := span.parseTimes(fields[len(fields)-1]); err != nil {
+			return nil, err
+		}
+		hours = append(hours, span)
+	}
+	return hours, nil
+}
+
+func (h *hoursSpan) parseDays(s string) error {
+	from, to, isRange := strings.Cut(strings.ToLower(s), "-")
+	if !isRange {
+		to = from
+	}
+	first, ok1 := weekdays[from]
+	last, ok2 := weekdays[to]
+	if !ok1 || !ok2 {
+		return fmt.Errorf("invalid days %q, expected e.g. Mon or Mon-Fri", s)
+	}
+	for d := first; ; d = (d + 1) % 7 {
+		h.days[d] = true
+		if d == last {
+			return nil
+		}
+	}
+}
+
+func (h *hoursSpan) parseTimes(s string) error {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return fmt.Errorf("invalid time range %q, expected HH:MM-HH:MM", s)
+	}
+	var err error
+	if h.start, err = parseClock(from, false); err != nil {
+		return err
+	}
+	h.end, err = parseClock(to, true)
+	return err
+}
+
+// parseClock returns the minutes after midnight of "HH:MM". "24:00" is
+// only valid as an end time.
+func parseClock(s string, end bool) (int, error) {
+	if len(s) != 5 || s[2] != ':' || !isDigits(s[:2]) || !isDigits(s[3:]) {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	hh := int(s[0]-'0')*10 + int(s[1]-'0')
+	mm := int(s[3]-'0')*10 + int(s[4]-'0')
+	if end && hh == 24 && mm == 0 {
+		return 24 * 60, nil
+	}
+	if hh > 23 || mm > 59 {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return hh*60 + mm, nil
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports whether t falls within the schedule. An empty schedule
+// contains every time.
+func (h Hours) Contains(t time.Time) bool {
+	if len(h) == 0 {
+		return true
+	}
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	for _, span := range h {
+		if span.end > span.start {
+			if span.days[today] && minute >= span.start && minute < span.end {
+				return true
+			}
+			continue
+		}
+		// Past midnight: the evening part today, the morning part of a span
+		// that started yesterday
+		if span.days[today] && minute >= span.start || span.days[yesterday] && minute < span.end {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseHours(t *testing.T) {
+	hours, err := ParseHours("Mon-Fri 08:00-18:00, Sat 22:00-02:00")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// 2024-01-01 is a Monday
+	at := func(day int, clock string) time.Time {
+		tm, _ := time.Parse("15:04", clock)
+		return time.Date(2024, 1, day, tm.Hour(), tm.Minute(), 0, 0, time.Local)
+	}
+	for _, tc := range []struct {
+		t    time.Time
+		want bool
+	}{
+		{at(1, "08:00"), true},
+		{at(1, "07:59"), false},
+		{at(5, "17:59"), true},
+		{at(5, "18:00"), false},
+		{at(6, "12:00"), false},
+		{at(6, "23:30"), true},
+		{at(7, "01:59"), true},
+		{at(7, "02:00"), false},
+		{at(7, "23:00"), false},
+	} {
+		if got := hours.Contains(tc.t); got != tc.want {
+			t.Errorf("Contains(%s) = %v, want %v", tc.t.Format("Mon 15:04"), got, tc.want)
+		}
+	}
+
+	if all, err := ParseHours("00:00-24:00"); err != nil || !all.Contains(at(3, "23:59")) {
+		t.Errorf("Expected every time in 00:00-24:00, got %v", err)
+	}
+	if wrap, err := ParseHours("Fri-Mon 09:00-17:00"); err != nil || !wrap.Contains(at(7, "10:00")) || wrap.Contains(at(3, "10:00")) {
+		t.Errorf("Expected Fri-Mon to wrap over the weekend, got %v", err)
+	}
+
+	for _, s := range []string{"", "08:00", "Mon 8:00-18:00", "Mon 08:00-24:01", "24:00-08:00", "Mo 08:00-18:00", "Mon 08:00-18:00 x", "Mon-Fri 08:00-18:00,"} {
+		if _, err := ParseHours(s); err == nil {
+			t.Errorf("Expected error for %q", s)
+		}
+	}
+}
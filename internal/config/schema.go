@@ -0,0 +1,265 @@
+package config
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Sources a configuration value can come from, lowest precedence first
+const (
+	SourceDefault = "default"
+	SourceOptions = "options" // Home Assistant options.json
+	SourceEnv     = "env"
+)
+
+// Field types reported by Schema
+const (
+	TypeString = "string"
+	TypeInt    = "int"
+	TypeBool   = "bool"
+	TypeList   = "list" // comma-separated in the environment
+	TypeJSON   = "json" // JSON array in the environment
+)
+
+// Redacted replaces the value of a secret field that is set
+const Redacted = "<redacted>"
+
+// hotReloadable fields can be changed at runtime through the web API
+// without a restart
+var hotReloadable = map[string]bool{
+	"inject_enabled": true, // /api/injection
+	"dry_run":        true, // /api/dry-run
+	"start_parked":   true, // /api/park
+}
+
+// secretFields are never returned in clear
+var secretFields = map[string]bool{
+	"mqtt_password":      true,
+	"web_auth_password":  true,
+	"web_admin_password": true,
+	"influx_token":       true,
+}
+
+// urlFields hold URLs that may carry credentials in their user info or
+// query, which Effective strips
+var urlFields = map[string]bool{
+	"upstream_url":           true,
+	"recovery_url":           true,
+	"influx_url":             true,
+	"web_acme_directory_url": true,
+}
+
+// secretParams are query parameter names, or parts of them, whose values
+// are redacted from URLs
+var secretParams = []string{"token", "password", "passwd", "pwd", "secret", "key", "auth", "sig", "credential"}
+
+// emptyEnv lists variables whose empty value is meaningful and overrides
+// the file
+var emptyEnv = map[string]bool{
+	"STATSD_PREFIX": true,
+	"MACROS_FILE":   true,
+}
+
+// FieldSchema describes one configuration field
+type FieldSchema struct {
+	Name          string `json:"name"` // options.json key
+	Env           string `json:"env"`  // environment variable
+	Type          string `json:"type"`
+	Default       any    `json:"default"`
+	HotReloadable bool   `json:"hot_reloadable"`
+	Secret        bool   `json:"secret,omitempty"`
+}
+
+// EffectiveField is the value a field ended up with and where it came from
+type EffectiveField struct {
+	Name   string `json:"name"`
+	Env    string `json:"env"`
+	Value  any    `json:"value"`
+	Source string `json:"source"`
+}
+
+// Schema lists every configuration field in declaration order
+func Schema() []FieldSchema {
+	def := reflect.ValueOf(Default()).Elem()
+	var fields []FieldSchema
+	eachField(func(i int, name string) {
+		f := def.Field(i)
+		fields = append(fields, FieldSchema{
+			Name:          name,
+			Env:           envName(name),
+			Type:          fieldType(f.Type()),
+			Default:       fieldValue(f),
+			HotReloadable: hotReloadable[name],
+			Secret:        secretFields[name],
+		})
+	})
+	return fields
+}
+
+// Effective lists the loaded value and source of every field, with secrets
+// redacted
+func (c *Config) Effective() []EffectiveField {
+	v := reflect.ValueOf(c).Elem()
+	var fields []EffectiveField
+	eachField(func(i int, name string) {
+		value := fieldValue(v.Field(i))
+		switch {
+		case secretFields[name] && !v.Field(i).IsZero():
+			value = Redacted
+		case urlFields[name]:
+			value = redactURL(v.Field(i).String())
+		case name == "upstreams":
+			value = redactUpstreams(c.Upstreams)
+		case name == "triggers":
+			value = redactTriggers(c.Triggers)
+		}
+		fields = append(fields, EffectiveField{
+			Name:   name,
+			Env:    envName(name),
+			Value:  value,
+			Source: c.Source(name),
+		})
+	})
+	return fields
+}
+
+// Source reports where the named field's value came from
+func (c *Config) Source(name string) string {
+	if source, ok := c.sources[name]; ok {
+		return source
+	}
+	return SourceDefault
+}
+
+// recordOptions marks the fields present in options.json
+func (c *Config) recordOptions(data []byte) {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return
+	}
+	eachField(func(_ int, name string) {
+		if _, ok := keys[name]; ok {
+			c.setSource(name, SourceOptions)
+		}
+	})
+}
+
+// recordEnv marks the fields whose environment variable is set
+func (c *Config) recordEnv() {
+	eachField(func(_ int, name string) {
+		env := envName(name)
+		if v, ok := os.LookupEnv(env); v != "" || (ok && emptyEnv[env]) {
+			c.setSource(name, SourceEnv)
+		}
+	})
+}
+
+func (c *Config) setSource(name, source string) {
+	if c.sources == nil {
+		c.sources = make(map[string]string)
+	}
+	c.sources[name] = source
+}
+
+// eachField calls fn with the index and options.json key of every
+// configurable field
+func eachField(fn func(i int, name string)) {
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fn(i, name)
+	}
+}
+
+// envName returns the environment variable of a field; every option is
+// the upper-case form of its options.json key
+func envName(name string) string {
+	return strings.ToUpper(name)
+}
+
+func fieldType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Int:
+		return TypeInt
+	case reflect.Bool, reflect.Pointer:
+		return TypeBool
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.String {
+			return TypeList
+		}
+		return TypeJSON
+	default:
+		return TypeString
+	}
+}
+
+// fieldValue returns a field's value for JSON output. Unset *bool fields
+// default to true and unset lists are reported empty.
+func fieldValue(f reflect.Value) any {
+	switch {
+	case f.Kind() == reflect.Pointer && f.IsNil():
+		return true
+	case f.Kind() == reflect.Pointer:
+		return f.Elem().Interface()
+	case f.Kind() == reflect.Slice && f.IsNil():
+		return reflect.MakeSlice(f.Type(), 0, 0).Interface()
+	default:
+		return f.Interface()
+	}
+}
+
+// redactURL removes the user info of a URL and the values of query
+// parameters that look like credentials. Values that are not URLs, such as
+// host:port addresses, are returned unchanged.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || (u.User == nil && u.RawQuery == "") {
+		return s
+	}
+	u.User = nil
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		for i, param := range params {
+			key, _, _ := strings.Cut(param, "=")
+			if k, err := url.QueryUnescape(key); err == nil && secretParam(k) {
+				params[i] = key + "=" + Redacted
+			}
+		}
+		u.RawQuery = strings.Join(params, "&")
+	}
+	return u.String()
+}
+
+func secretParam(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range secretParams {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactUpstreams(specs []UpstreamSpec) []UpstreamSpec {
+	out := make([]UpstreamSpec, len(specs))
+	for i, spec := range specs {
+		spec.Addr = redactURL(spec.Addr)
+		out[i] = spec
+	}
+	return out
+}
+
+func redactTriggers(rules []TriggerRule) []TriggerRule {
+	out := make([]TriggerRule, len(rules))
+	for i, rule := range rules {
+		rule.Webhook = redactURL(rule.Webhook)
+		out[i] = rule
+	}
+	return out
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	fields := make(map[string]FieldSchema)
+	for _, f := range Schema() {
+		fields[f.Name] = f
+	}
+
+	if _, ok := fields["reconnect_delay"]; ok || len(fields) == 0 {
+		t.Fatalf("Unexpected fields %v", fields)
+	}
+	if f := fields["upstream_port"]; f.Env != "UPSTREAM_PORT" || f.Type != TypeInt || f.Default != 8899 || f.HotReloadable {
+		t.Errorf("Unexpected upstream_port %+v", f)
+	}
+	if f := fields["inject_enabled"]; f.Type != TypeBool || f.Default != true || !f.HotReloadable {
+		t.Errorf("Unexpected inject_enabled %+v", f)
+	}
+	if f := fields["log_packet_sources"]; f.Type != TypeList {
+		t.Errorf("Unexpected log_packet_sources %+v", f)
+	}
+	if f := fields["polls"]; f.Type != TypeJSON {
+		t.Errorf("Unexpected polls %+v", f)
+	}
+	if f := fields["web_auth_password"]; !f.Secret || f.Type != TypeString {
+		t.Errorf("Unexpected web_auth_password %+v", f)
+	}
+}
+
+func TestLoad_Sources(t *testing.T) {
+	dir := t.TempDir()
+	optionsFile = filepath.Join(dir, "options.json")
+	defer func() { optionsFile = "/data/options.json" }()
+	options := `{"upstream_host": "10.0.0.1", "listen_port": 2000, "max_clients": 5, "influx_token": "from-file"}`
+	if err := os.WriteFile(optionsFile, []byte(options), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Clearenv()
+	os.Setenv("MAX_CLIENTS", "7")
+	os.Setenv("INFLUX_TOKEN", "s3cret")
+	os.Setenv("STATSD_PREFIX", "")
+
+	config, err := Load()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	effective := make(map[string]EffectiveField)
+	for _, f := range config.Effective() {
+		effective[f.Name] = f
+	}
+
+	for name, want := range map[string]EffectiveField{
+		"upstream_host": {Value: "10.0.0.1", Source: SourceOptions},
+		"listen_port":   {Value: 2000, Source: SourceOptions},
+		"max_clients":   {Value: 7, Source: SourceEnv},
+		"upstream_port": {Value: 8899, Source: SourceDefault},
+		"influx_token":  {Value: Redacted, Source: SourceEnv},
+		"statsd_prefix": {Value: "", Source: SourceEnv},
+		"mqtt_password": {Value: "", Source: SourceDefault},
+	} {
+		if got := effective[name]; got.Value != want.Value || got.Source != want.Source {
+			t.Errorf("%s: expected %v from %s, got %v from %s", name, want.Value, want.Source, got.Value, got.Source)
+		}
+	}
+	if got := effective["log_packet_directions"].Value.([]string); got == nil || len(got) != 0 {
+		t.Errorf("Expected an empty list, got %#v", got)
+	}
+}
+
+func TestEffective_RedactsURLs(t *testing.T) {
+	config := &Config{
+		UpstreamURL: "wss://user:pw@gw.local/serial?token=abc&fec=2",
+		RecoveryURL: "http://admin:pw@plug/relay",
+		InfluxURL:   "http://influx:8086",
+		Upstreams:   []UpstreamSpec{{Name: "b", Addr: "ws://gw?api_key=k1"}, {Name: "c", Addr: "10.0.0.2:8899"}},
+		Triggers:    []TriggerRule{{Name: "t", Webhook: "https://hooks.local/x?sig=s&id=1"}},
+	}
+	effective := make(map[string]any)
+	for _, f := range config.Effective() {
+		effective[f.Name] = f.Value
+	}
+
+	for name, want := range map[string]string{
+		"upstream_url": "wss://gw.local/serial?token=<redacted>&fec=2",
+		"recovery_url": "http://plug/relay",
+		"influx_url":   "http://influx:8086",
+	} {
+		if got := effective[name]; got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+	upstreams := effective["upstreams"].([]UpstreamSpec)
+	if upstreams[0].Addr != "ws://gw?api_key=<redacted>" || upstreams[1].Addr != "10.0.0.2:8899" {
+		t.Errorf("Unexpected upstreams %+v", upstreams)
+	}
+	if got := effective["triggers"].([]TriggerRule)[0].Webhook; got != "https://hooks.local/x?sig=<redacted>&id=1" {
+		t.Errorf("Unexpected webhook %q", got)
+	}
+	if config.Upstreams[0].Addr != "ws://gw?api_key=k1" || config.Triggers[0].Webhook != "https://hooks.local/x?sig=s&id=1" {
+		t.Error("Effective modified the config")
+	}
+}
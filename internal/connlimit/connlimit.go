@@ -0,0 +1,190 @@
+// Package connlimit throttles client connections per source IP, so a
+// client stuck in a reconnect loop cannot tie up the proxy or the device.
+package connlimit
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// window is the period over which connection attempts are counted
+const window = time.Minute
+
+var (
+	// ErrGreylisted is returned while an IP is greylisted
+	ErrGreylisted = errors.New("source IP is greylisted")
+	// ErrRateExceeded is returned for the attempt that gets an IP greylisted
+	ErrRateExceeded = errors.New("too many connection attempts")
+	// ErrTooManyConnections is returned when an IP already has the maximum
+	// number of open connections
+	ErrTooManyConnections = errors.New("too many connections from source IP")
+)
+
+// Reason codes identify why a connection was refused, in logs and stats
+const (
+	ReasonGreylisted   = "greylisted"
+	ReasonRateExceeded = "rate_exceeded"
+	ReasonPerIPLimit   = "per_ip_limit"
+)
+
+// Reason returns the reason code for an error returned by Allow
+func Reason(err error) string {
+	switch err {
+	case ErrGreylisted:
+		return ReasonGreylisted
+	case ErrRateExceeded:
+		return ReasonRateExceeded
+	case ErrTooManyConnections:
+		return ReasonPerIPLimit
+	}
+	return ""
+}
+
+// Greylisted describes an IP that is refused until Until
+type Greylisted struct {
+	IP       string `json:"ip"`
+	Until    string `json:"until"`
+	Rejected uint64 `json:"rejected"` // attempts refused while greylisted
+}
+
+// Stats reports the limiter state
+type Stats struct {
+	Greylisted []Greylisted      `json:"greylisted"`
+	Rejected   uint64            `json:"rejected"`    // all refused attempts
+	RejectedBy map[string]uint64 `json:"rejected_by"` // refused attempts by reason code
+}
+
+type source struct {
+	attempts []time.Time // within the last window
+	open     int
+	until    time.Time // greylisted until
+	rejected uint64    // while greylisted
+}
+
+// Limiter tracks connection attempts and open connections per IP
+type Limiter struct {
+	perMinute     int
+	maxConcurrent int
+	greylist      time.Duration
+
+	mu        sync.Mutex
+	sources   map[string]*source
+	rejected  map[string]uint64 // by reason code
+	lastPrune time.Time
+	now       func() time.Time // for tests
+}
+
+// New returns a limiter. perMinute limits connection attempts per IP in any
+// one-minute window; an IP exceeding it is refused for greylist.
+// maxConcurrent caps open connections per IP. Zero disables either limit.
+func New(perMinute, maxConcurrent int, greylist time.Duration) *Limiter {
+	return &Limiter{
+		perMinute:     perMinute,
+		maxConcurrent: maxConcurrent,
+		greylist:      greylist,
+		sources:       make(map[string]*source),
+		rejected:      make(map[string]uint64),
+		now:           time.Now,
+	}
+}
+
+// Allow records a connection attempt from ip. On success the connection
+// counts as open until Release is called.
+func (l *Limiter) Allow(ip string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.prune(now)
+
+	s := l.sources[ip]
+	if s == nil {
+		s = &source{}
+		l.sources[ip] = s
+	}
+
+	if now.Before(s.until) {
+		s.rejected++
+		l.rejected[ReasonGreylisted]++
+		return ErrGreylisted
+	}
+
+	if l.perMinute > 0 {
+		s.attempts = trim(s.attempts, now.Add(-window))
+		s.attempts = append(s.attempts, now)
+		if len(s.attempts) > l.perMinute {
+			s.until = now.Add(l.greylist)
+			s.attempts = nil
+			s.rejected = 1
+			l.rejected[ReasonRateExceeded]++
+			return ErrRateExceeded
+		}
+	}
+
+	if l.maxConcurrent > 0 && s.open >= l.maxConcurrent {
+		l.rejected[ReasonPerIPLimit]++
+		return ErrTooManyConnections
+	}
+
+	s.open++
+	return nil
+}
+
+// Release marks a connection allowed for ip as closed
+func (l *Limiter) Release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if s := l.sources[ip]; s != nil && s.open > 0 {
+		s.open--
+	}
+}
+
+// Stats returns the greylisted IPs and the number of refused attempts, in
+// total and by reason
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	st := Stats{Greylisted: []Greylisted{}, RejectedBy: make(map[string]uint64, len(l.rejected))}
+	for reason, n := range l.rejected {
+		st.Rejected += n
+		st.RejectedBy[reason] = n
+	}
+	for ip, s := range l.sources {
+		if now.Before(s.until) {
+			st.Greylisted = append(st.Greylisted, Greylisted{
+				IP:       ip,
+				Until:    s.until.Format(time.RFC3339),
+				Rejected: s.rejected,
+			})
+		}
+	}
+	sort.Slice(st.Greylisted, func(i, j int) bool { return st.Greylisted[i].IP < st.Greylisted[j].IP })
+	return st
+}
+
+// prune drops idle sources at most once per window. Called with mu held.
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < window {
+		return
+	}
+	l.lastPrune = now
+	for ip, s := range l.sources {
+		s.attempts = trim(s.attempts, now.Add(-window))
+		if s.open == 0 && len(s.attempts) == 0 && !now.Before(s.until) {
+			delete(l.sources, ip)
+		}
+	}
+}
+
+// trim removes attempts before since
+func trim(attempts []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(attempts) && attempts[i].Before(since) {
+		i++
+	}
+	return attempts[i:]
+}
@@ -0,0 +1,129 @@
+package connlimit
+
+import (
+	"testing"
+	"time"
+)
+
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time { return c.t }
+
+func newTestLimiter(perMinute, maxConcurrent int, greylist time.Duration) (*Limiter, *clock) {
+	c := &clock{t: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := New(perMinute, maxConcurrent, greylist)
+	l.now = c.now
+	return l, c
+}
+
+func TestLimiter_RateGreylists(t *testing.T) {
+	l, c := newTestLimiter(3, 0, 5*time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if err := l.Allow("10.0.0.1"); err != nil {
+			t.Fatalf("Expected attempt %d allowed, got %v", i+1, err)
+		}
+		l.Release("10.0.0.1")
+	}
+	if err := l.Allow("10.0.0.1"); err != ErrRateExceeded {
+		t.Fatalf("Expected ErrRateExceeded, got %v", err)
+	}
+	if err := l.Allow("10.0.0.2"); err != nil {
+		t.Errorf("Expected other IPs unaffected, got %v", err)
+	}
+
+	c.t = c.t.Add(2 * time.Minute)
+	if err := l.Allow("10.0.0.1"); err != ErrGreylisted {
+		t.Errorf("Expected ErrGreylisted during the greylist period, got %v", err)
+	}
+
+	st := l.Stats()
+	if len(st.Greylisted) != 1 || st.Greylisted[0].IP != "10.0.0.1" || st.Greylisted[0].Rejected != 2 {
+		t.Errorf("Unexpected greylist: %+v", st.Greylisted)
+	}
+	if st.Rejected != 2 {
+		t.Errorf("Expected 2 rejected attempts, got %d", st.Rejected)
+	}
+	if st.RejectedBy[ReasonRateExceeded] != 1 || st.RejectedBy[ReasonGreylisted] != 1 {
+		t.Errorf("Expected 1 rejection each for the rate and the greylist, got %v", st.RejectedBy)
+	}
+
+	c.t = c.t.Add(4 * time.Minute)
+	if err := l.Allow("10.0.0.1"); err != nil {
+		t.Errorf("Expected attempt allowed after the greylist expires, got %v", err)
+	}
+	if len(l.Stats().Greylisted) != 0 {
+		t.Error("Expected empty greylist after expiry")
+	}
+}
+
+func TestLimiter_SlidingWindow(t *testing.T) {
+	l, c := newTestLimiter(2, 0, time.Minute)
+
+	for i := 0; i < 10; i++ {
+		if err := l.Allow("10.0.0.1"); err != nil {
+			t.Fatalf("Expected attempt %d allowed at 2 per minute, got %v", i+1, err)
+		}
+		l.Release("10.0.0.1")
+		c.t = c.t.Add(31 * time.Second)
+	}
+}
+
+func TestLimiter_MaxConcurrent(t *testing.T) {
+	l, _ := newTestLimiter(0, 2, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if err := l.Allow("10.0.0.1"); err != nil {
+			t.Fatalf("Expected connection %d allowed, got %v", i+1, err)
+		}
+	}
+	if err := l.Allow("10.0.0.1"); err != ErrTooManyConnections {
+		t.Fatalf("Expected ErrTooManyConnections, got %v", err)
+	}
+	if len(l.Stats().Greylisted) != 0 {
+		t.Error("Expected the concurrency cap not to greylist")
+	}
+	if st := l.Stats(); st.RejectedBy[ReasonPerIPLimit] != 1 {
+		t.Errorf("Expected 1 rejection for the per-IP limit, got %v", st.RejectedBy)
+	}
+
+	l.Release("10.0.0.1")
+	if err := l.Allow("10.0.0.1"); err != nil {
+		t.Errorf("Expected connection allowed after a release, got %v", err)
+	}
+}
+
+func TestLimiter_Prune(t *testing.T) {
+	l, c := newTestLimiter(5, 0, time.Minute)
+
+	_ = l.Allow("10.0.0.1")
+	l.Release("10.0.0.1")
+	c.t = c.t.Add(2 * time.Minute)
+	_ = l.Allow("10.0.0.2")
+
+	l.mu.Lock()
+	_, kept := l.sources["10.0.0.1"]
+	l.mu.Unlock()
+	if kept {
+		t.Error("Expected idle source to be pruned")
+	}
+}
+
+func TestReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{ErrGreylisted, ReasonGreylisted},
+		{ErrRateExceeded, ReasonRateExceeded},
+		{ErrTooManyConnections, ReasonPerIPLimit},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		if got := Reason(tt.err); got != tt.want {
+			t.Errorf("Reason(%v): expected %q, got %q", tt.err, tt.want, got)
+		}
+	}
+}
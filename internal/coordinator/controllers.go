@@ -0,0 +1,177 @@
+package coordinator
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Host frame types that only a controlling application sends
+const (
+	ashRST       byte = 0xc0
+	znpSREQ      byte = 0x20
+	znpAREQ      byte = 0x40
+	zwaveRequest byte = 0x00
+)
+
+// CommandFrames counts the host commands for a coordinator of type typ in
+// data written by a client: ASH DATA and RST frames, ZNP synchronous and
+// asynchronous requests, deCONZ commands or Z-Wave requests, each with a
+// valid checksum. Monitoring clients send none of these. Frames split
+// across writes are not counted.
+func CommandFrames(typ string, data []byte) int {
+	n := 0
+	switch typ {
+	case TypeEZSP:
+		for _, frame := range ashFrames(data) {
+			if len(frame) >= 3 && crcCCITT(frame[:len(frame)-2]) == binary.BigEndian.Uint16(frame[len(frame)-2:]) &&
+				(frame[0]&0x80 == 0 || frame[0] == ashRST) {
+				n++
+			}
+		}
+	case TypeZNP:
+		for i := 0; i+5 <= len(data); i++ {
+			size := int(data[i+1])
+			if data[i] != znpSOF || size > znpMaxData || i+5+size > len(data) {
+				continue
+			}
+			frame := data[i+1 : i+4+size]
+			if kind := frame[1] & 0xe0; (kind == znpSREQ || kind == znpAREQ) && xorSum(frame) == data[i+4+size] {
+				n++
+				i += 4 + size
+			}
+		}
+	case TypeDeCONZ:
+		for _, frame := range slipFrames(data) {
+			if len(frame) < deconzMinFrame {
+				continue
+			}
+			body := frame[:len(frame)-2]
+			if int(binary.LittleEndian.Uint16(body[3:5])) == len(body) && deconzChecksum(body) == binary.LittleEndian.Uint16(frame[len(frame)-2:]) {
+				n++
+			}
+		}
+	case TypeZWave:
+		for i := 0; i+2 <= len(data); i++ {
+			size := int(data[i+1])
+			if data[i] != zwaveSOF || size < zwaveMinLength || i+2+size > len(data) {
+				continue
+			}
+			frame := data[i+1 : i+1+size]
+			if frame[1] == zwaveRequest && 0xff^xorSum(frame) == data[i+1+size] {
+				n++
+				i += 1 + size
+			}
+		}
+	}
+	return n
+}
+
+// Conflict describes clients that sent commands to the same coordinator
+// within the controller window
+type Conflict struct {
+	Clients  []string `json:"clients"`
+	Since    string   `json:"since"`
+	LastSeen string   `json:"last_seen"`
+}
+
+// Controllers tracks which clients send commands to one coordinator. Two
+// applications driving the same Zigbee or Z-Wave stick corrupt its state,
+// so a second client sending commands within the window is a conflict.
+type Controllers struct {
+	window time.Duration
+	mu     sync.Mutex
+	last   map[string]time.Time // client ID -> last command
+	since  time.Time            // start of the current conflict, zero if none
+	seen   time.Time            // last command during the conflict
+	known  map[string]bool      // clients already reported for the conflict
+}
+
+// NewControllers returns a tracker treating commands from different clients
+// within window as a conflict
+func NewControllers(window time.Duration) *Controllers {
+	return &Controllers{window: window, last: make(map[string]time.Time), known: make(map[string]bool)}
+}
+
+// Observe records a command from client at t. It returns the clients in
+// conflict when client starts a conflict or joins one it was not part of,
+// or nil.
+func (c *Controllers) Observe(client string, t time.Time) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.last[client] = t
+	c.prune(t)
+	if len(c.last) < 2 {
+		return nil
+	}
+	if c.since.IsZero() {
+		c.since = t
+	}
+	c.seen = t
+	if c.known[client] && len(c.known) == len(c.last) {
+		return nil
+	}
+	for id := range c.last {
+		c.known[id] = true
+	}
+	return c.clients()
+}
+
+// Forget drops a disconnected client. A nil tracker ignores it.
+func (c *Controllers) Forget(client string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.last, client)
+	c.prune(time.Now())
+}
+
+// Conflict returns the current conflict, or nil
+func (c *Controllers) Conflict() *Conflict {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prune(time.Now())
+	if c.since.IsZero() {
+		return nil
+	}
+	return &Conflict{
+		Clients:  c.clients(),
+		Since:    c.since.Format(time.RFC3339),
+		LastSeen: c.seen.Format(time.RFC3339),
+	}
+}
+
+// prune forgets clients without commands in the window before now and
+// ends the conflict once fewer than two remain
+func (c *Controllers) prune(now time.Time) {
+	for id, t := range c.last {
+		if now.Sub(t) > c.window {
+			delete(c.last, id)
+		}
+	}
+	for id := range c.known {
+		if _, ok := c.last[id]; !ok {
+			delete(c.known, id)
+		}
+	}
+	if len(c.last) < 2 {
+		c.since, c.seen = time.Time{}, time.Time{}
+		clear(c.known)
+	}
+}
+
+func (c *Controllers) clients() []string {
+	ids := make([]string, 0, len(c.last))
+	for id := range c.last {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
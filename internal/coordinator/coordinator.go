@@ -0,0 +1,145 @@
+// Package coordinator identifies the Zigbee or Z-Wave coordinator behind an
+// upstream from the first bytes it sends, so users can confirm the proxy is
+// talking to the device they expect.
+package coordinator
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Coordinator types reported in Info.Type
+const (
+	TypeEZSP   = "ezsp"   // Silicon Labs EmberZNet (ASH framing)
+	TypeZNP    = "znp"    // Texas Instruments Z-Stack
+	TypeDeCONZ = "deconz" // dresden elektronik ConBee/RaspBee
+	TypeZWave  = "zwave"  // Z-Wave Serial API
+)
+
+// ScanLimit is how many bytes are inspected after each upstream connect
+const ScanLimit = 4096
+
+// minScore is the evidence needed to report a coordinator: two frames with
+// a valid checksum, or one handshake frame
+const minScore = 2
+
+// Info describes a detected coordinator
+type Info struct {
+	Type       string            `json:"type"`
+	Name       string            `json:"name"`
+	Firmware   string            `json:"firmware,omitempty"`
+	Details    map[string]string `json:"details,omitempty"`
+	Frames     int               `json:"frames"` // valid frames seen while detecting
+	DetectedAt string            `json:"detected_at,omitempty"`
+}
+
+// match is the evidence one protocol parser found in a buffer
+type match struct {
+	info  Info
+	score int
+}
+
+// parsers are tried in order; on a tie the earlier one wins
+var parsers = []func([]byte) match{
+	scanEZSP,
+	scanZNP,
+	scanDeCONZ,
+	scanZWave,
+}
+
+// Detect inspects data sent by a device and returns the coordinator it most
+// likely is, or nil if no protocol has enough evidence
+func Detect(data []byte) *Info {
+	var best match
+	for _, parse := range parsers {
+		if m := parse(data); m.score > best.score {
+			best = m
+		}
+	}
+	if best.score < minScore {
+		return nil
+	}
+	return &best.info
+}
+
+// Detector inspects the first ScanLimit bytes of every upstream connection.
+// A result is kept across reconnects until a later connection identifies a
+// different coordinator or adds firmware details.
+type Detector struct {
+	scanning atomic.Bool
+	mu       sync.Mutex
+	buf      []byte
+	info     *Info
+}
+
+// NewDetector returns a detector scanning from the first byte observed
+func NewDetector() *Detector {
+	d := &Detector{}
+	d.scanning.Store(true)
+	return d
+}
+
+// Reset starts a new scan, for a new upstream connection
+func (d *Detector) Reset() {
+	d.mu.Lock()
+	d.buf = d.buf[:0]
+	d.mu.Unlock()
+	d.scanning.Store(true)
+}
+
+// Observe adds bytes received from the device. It reports whether the
+// detected coordinator changed. Once the scan is complete it returns
+// immediately.
+func (d *Detector) Observe(data []byte) bool {
+	if !d.scanning.Load() {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if room := ScanLimit - len(d.buf); len(data) > room {
+		data = data[:room]
+	}
+	d.buf = append(d.buf, data...)
+	if len(d.buf) >= ScanLimit {
+		d.scanning.Store(false)
+	}
+
+	info := Detect(d.buf)
+	if info == nil {
+		return false
+	}
+	if info.Firmware != "" {
+		// Nothing more to learn from this connection
+		d.scanning.Store(false)
+	}
+	if d.info != nil && d.info.Type == info.Type && (info.Firmware == "" || info.Firmware == d.info.Firmware) {
+		d.info.Frames = info.Frames
+		return false
+	}
+	info.DetectedAt = time.Now().Format(time.RFC3339)
+	d.info = info
+	return true
+}
+
+// Type returns the type of the detected coordinator, or "" if none
+func (d *Detector) Type() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.info == nil {
+		return ""
+	}
+	return d.info.Type
+}
+
+// Info returns the detected coordinator, or nil
+func (d *Detector) Info() *Info {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.info == nil {
+		return nil
+	}
+	info := *d.info
+	return &info
+}
@@ -0,0 +1,274 @@
+package coordinator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// ashFrame builds an escaped ASH frame with CRC and flag
+func ashFrame(body ...byte) []byte {
+	raw := binary.BigEndian.AppendUint16(append([]byte(nil), body...), crcCCITT(body))
+	var out []byte
+	for _, b := range raw {
+		switch b {
+		case ashFlag, ashEscape, ashXON, ashXOFF, ashSubstitute, ashCancel:
+			out = append(out, ashEscape, b^0x20)
+		default:
+			out = append(out, b)
+		}
+	}
+	return append(out, ashFlag)
+}
+
+// znpFrame builds a Z-Stack frame with its frame check sequence
+func znpFrame(cmd0, cmd1 byte, data ...byte) []byte {
+	frame := append([]byte{byte(len(data)), cmd0, cmd1}, data...)
+	return append(append([]byte{znpSOF}, frame...), xorSum(frame))
+}
+
+// deconzFrame builds a SLIP framed deCONZ command with its checksum
+func deconzFrame(cmd, seq byte, payload ...byte) []byte {
+	body := []byte{cmd, seq, 0x00}
+	body = binary.LittleEndian.AppendUint16(body, uint16(5+len(payload)))
+	body = append(body, payload...)
+	body = binary.LittleEndian.AppendUint16(body, deconzChecksum(body))
+	out := []byte{slipEnd}
+	for _, b := range body {
+		switch b {
+		case slipEnd:
+			out = append(out, slipEsc, slipEscEnd)
+		case slipEsc:
+			out = append(out, slipEsc, slipEscEsc)
+		default:
+			out = append(out, b)
+		}
+	}
+	return append(out, slipEnd)
+}
+
+// zwaveFrame builds a Z-Wave Serial API data frame with its checksum
+func zwaveFrame(typ, fn byte, data ...byte) []byte {
+	frame := append([]byte{byte(len(data) + 3), typ, fn}, data...)
+	return append(append([]byte{zwaveSOF}, frame...), 0xff^xorSum(frame))
+}
+
+func TestDetect_EZSP(t *testing.T) {
+	// RSTACK after a power-on reset, then the version response (protocol 8,
+	// stack type 2, stack 6.10.3.0) in a randomized DATA frame
+	version := ashDerandomize([]byte{0x00, 0x80, 0x00, 0x08, 0x02, 0x30, 0x6a})
+	data := append(ashFrame(ashRSTACK, 0x02, 0x02), ashFrame(append([]byte{0x01}, version...)...)...)
+
+	info := Detect(data)
+	if info == nil {
+		t.Fatal("Expected EZSP to be detected")
+	}
+	if info.Type != TypeEZSP || info.Firmware != "6.10.3.0" {
+		t.Errorf("Unexpected result %+v", info)
+	}
+	if info.Details["reset_reason"] != "power_on" || info.Details["ezsp_protocol"] != "8" || info.Details["ash_version"] != "2" {
+		t.Errorf("Unexpected details %v", info.Details)
+	}
+}
+
+func TestDetect_EZSPCancelledFrame(t *testing.T) {
+	// A cancel byte discards the frame in progress
+	data := append([]byte{0xc1, 0x02, ashCancel}, ashFrame(ashRSTACK, 0x02, 0x0b)...)
+	info := Detect(data)
+	if info == nil || info.Type != TypeEZSP || info.Details["reset_reason"] != "software" {
+		t.Errorf("Unexpected result %+v", info)
+	}
+}
+
+func TestDetect_ZNP(t *testing.T) {
+	// SYS_PING response, then SYS_VERSION: Z-Stack 3.x.0 2.7.1 rev 20210708
+	data := znpFrame(0x61, 0x01, 0x59, 0x06)
+	data = append(data, znpFrame(0x61, 0x02, 0x02, 0x01, 0x02, 0x07, 0x01, 0x14, 0x64, 0x34, 0x01)...)
+
+	info := Detect(data)
+	if info == nil || info.Type != TypeZNP {
+		t.Fatalf("Expected ZNP, got %+v", info)
+	}
+	if info.Firmware != "2.7.1" || info.Details["product"] != "Z-Stack 3.x.0" || info.Details["revision"] != "20210708" {
+		t.Errorf("Unexpected result %+v", info)
+	}
+	if info.Frames != 2 {
+		t.Errorf("Expected 2 frames, got %d", info.Frames)
+	}
+}
+
+func TestDetect_DeCONZ(t *testing.T) {
+	// Firmware 0x26780700 on a ConBee II
+	data := deconzFrame(deconzVersion, 0x01, 0x00, 0x07, 0x78, 0x26)
+
+	info := Detect(data)
+	if info == nil || info.Type != TypeDeCONZ {
+		t.Fatalf("Expected deCONZ, got %+v", info)
+	}
+	if info.Firmware != "0x26780700" || info.Details["platform"] != "ConBee II/RaspBee II" {
+		t.Errorf("Unexpected result %+v", info)
+	}
+}
+
+func TestDetect_ZWave(t *testing.T) {
+	version := append([]byte("Z-Wave 6.07\x00"), 0x01)
+	data := append([]byte{0x06}, zwaveFrame(zwaveResponse, zwaveGetVersion, version...)...)
+
+	info := Detect(data)
+	if info == nil || info.Type != TypeZWave {
+		t.Fatalf("Expected Z-Wave, got %+v", info)
+	}
+	if info.Firmware != "Z-Wave 6.07" || info.Details["library"] != "static_controller" {
+		t.Errorf("Unexpected result %+v", info)
+	}
+}
+
+func TestDetect_FramesWithoutHandshake(t *testing.T) {
+	// One valid frame is not enough evidence, two are
+	frame := zwaveFrame(0x00, 0x04, 0x00, 0x05, 0x02, 0x20, 0x01)
+	if info := Detect(frame); info != nil {
+		t.Errorf("Expected no result for a single frame, got %+v", info)
+	}
+	info := Detect(append(frame, frame...))
+	if info == nil || info.Type != TypeZWave || info.Firmware != "" {
+		t.Errorf("Unexpected result %+v", info)
+	}
+}
+
+func TestDetect_OtherTraffic(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"text":    bytes.Repeat([]byte("temp=21.5 hum=40\r\n"), 20),
+		"rs485":   bytes.Repeat([]byte{0xf7, 0x0b, 0x01, 0x19, 0x04, 0x40, 0x10, 0x00, 0x01, 0xb2, 0xee}, 20),
+		"counter": sequence(1024),
+		"empty":   nil,
+	} {
+		if info := Detect(data); info != nil {
+			t.Errorf("%s: unexpected result %+v", name, info)
+		}
+	}
+}
+
+func sequence(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+func TestDetector_SplitReads(t *testing.T) {
+	d := NewDetector()
+	data := znpFrame(0x41, 0x80, 0x00, 0x02, 0x01, 0x02, 0x07, 0x01)
+	if d.Observe(data[:4]) {
+		t.Error("Expected no detection from a partial frame")
+	}
+	if !d.Observe(data[4:]) {
+		t.Fatal("Expected detection once the frame is complete")
+	}
+	info := d.Info()
+	if info == nil || info.Type != TypeZNP || info.Firmware != "2.7" || info.DetectedAt == "" {
+		t.Errorf("Unexpected result %+v", info)
+	}
+	if d.Observe(data) {
+		t.Error("Expected the scan to stop once firmware is known")
+	}
+}
+
+func TestDetector_ResetKeepsResult(t *testing.T) {
+	d := NewDetector()
+	d.Observe(deconzFrame(deconzVersion, 0x01, 0x00, 0x07, 0x78, 0x26))
+
+	// A new connection without a handshake keeps the known firmware
+	d.Reset()
+	status := deconzFrame(0x07, 0x02, 0xa2)
+	if d.Observe(append(status, status...)) {
+		t.Error("Expected no change for the same coordinator")
+	}
+	if info := d.Info(); info == nil || info.Firmware != "0x26780700" {
+		t.Errorf("Expected the firmware to be kept, got %+v", info)
+	}
+
+	// A different coordinator replaces it
+	d.Reset()
+	if !d.Observe(ashFrame(ashRSTACK, 0x02, 0x02)) {
+		t.Fatal("Expected a new coordinator to be reported")
+	}
+	if info := d.Info(); info.Type != TypeEZSP {
+		t.Errorf("Expected EZSP, got %+v", info)
+	}
+}
+
+func TestDetector_ScanLimit(t *testing.T) {
+	d := NewDetector()
+	d.Observe(make([]byte, ScanLimit))
+	if d.Observe(ashFrame(ashRSTACK, 0x02, 0x02)) || d.Info() != nil {
+		t.Error("Expected no detection after the scan limit")
+	}
+}
+
+func TestCommandFrames(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  string
+		data []byte
+		want int
+	}{
+		{"ezsp data and reset", TypeEZSP, append(ashFrame(ashRST), ashFrame(0x01, 0x42, 0x21)...), 2},
+		{"ezsp ack only", TypeEZSP, ashFrame(0x81), 0},
+		{"znp requests", TypeZNP, append(znpFrame(0x21, 0x02), znpFrame(0x45, 0x00, 0x01)...), 2},
+		{"znp response", TypeZNP, znpFrame(0x61, 0x02, 0x02, 0x01), 0},
+		{"deconz command", TypeDeCONZ, deconzFrame(deconzVersion, 0x01, 0, 0, 0, 0), 1},
+		{"zwave request", TypeZWave, zwaveFrame(0x00, zwaveGetVersion), 1},
+		{"zwave ack and response", TypeZWave, append([]byte{0x06}, zwaveFrame(zwaveResponse, zwaveGetVersion)...), 0},
+		{"bad checksum", TypeZNP, []byte{znpSOF, 0x00, 0x21, 0x02, 0x00}, 0},
+		{"other protocol", TypeZWave, znpFrame(0x21, 0x02), 0},
+		{"unknown type", "", znpFrame(0x21, 0x02), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CommandFrames(tt.typ, tt.data); got != tt.want {
+				t.Errorf("Expected %d command frames, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestControllers(t *testing.T) {
+	c := NewControllers(time.Minute)
+	now := time.Now()
+
+	if got := c.Observe("client#1", now); got != nil {
+		t.Errorf("Expected no conflict with one client, got %v", got)
+	}
+	if got := c.Observe("client#1", now.Add(time.Second)); got != nil {
+		t.Errorf("Expected no conflict from repeated commands, got %v", got)
+	}
+	if got := c.Observe("client#2", now.Add(2*time.Second)); len(got) != 2 || got[0] != "client#1" || got[1] != "client#2" {
+		t.Fatalf("Expected a conflict between both clients, got %v", got)
+	}
+	// Reported once while the conflict lasts
+	if got := c.Observe("client#1", now.Add(3*time.Second)); got != nil {
+		t.Errorf("Expected the conflict to be reported once, got %v", got)
+	}
+	if c.Conflict() == nil {
+		t.Fatal("Expected an active conflict")
+	}
+
+	// A disconnecting client ends it
+	c.Forget("client#2")
+	if conflict := c.Conflict(); conflict != nil {
+		t.Errorf("Expected no conflict after the client left, got %+v", conflict)
+	}
+
+	// Commands further apart than the window do not conflict
+	if got := c.Observe("client#3", now.Add(2*time.Minute)); got != nil {
+		t.Errorf("Expected no conflict outside the window, got %v", got)
+	}
+
+	var disabled *Controllers
+	disabled.Forget("client#1")
+	if disabled.Conflict() != nil {
+		t.Error("Expected no conflict from a nil tracker")
+	}
+}
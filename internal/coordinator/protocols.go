@@ -0,0 +1,368 @@
+package coordinator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// EZSP over ASH: frames end with a flag byte, reserved bytes are escaped
+// and every frame carries a CRC-CCITT
+const (
+	ashFlag       byte = 0x7e
+	ashEscape     byte = 0x7d
+	ashXON        byte = 0x11
+	ashXOFF       byte = 0x13
+	ashSubstitute byte = 0x18
+	ashCancel     byte = 0x1a
+	ashRSTACK     byte = 0xc1
+	ashError      byte = 0xc2
+)
+
+var ashResetReasons = map[byte]string{
+	0x00: "unknown",
+	0x01: "external",
+	0x02: "power_on",
+	0x03: "watchdog",
+	0x06: "assert",
+	0x09: "bootloader",
+	0x0b: "software",
+}
+
+func scanEZSP(data []byte) match {
+	m := match{info: Info{Type: TypeEZSP, Name: "Silicon Labs EZSP"}}
+	for _, frame := range ashFrames(data) {
+		if len(frame) < 3 || crcCCITT(frame[:len(frame)-2]) != binary.BigEndian.Uint16(frame[len(frame)-2:]) {
+			continue
+		}
+		body := frame[:len(frame)-2]
+		m.info.Frames++
+		m.score++
+
+		switch control := body[0]; {
+		case (control == ashRSTACK || control == ashError) && len(body) == 3:
+			m.score++
+			m.info.Details = withDetail(m.info.Details, "ash_version", strconv.Itoa(int(body[1])))
+			m.info.Details = withDetail(m.info.Details, "reset_reason", resetReason(body[2]))
+		case control&0x80 == 0 && len(body) > 1:
+			// DATA frame: the EZSP version response names the stack
+			ezsp := ashDerandomize(body[1:])
+			if len(ezsp) >= 7 && ezsp[1]&0x80 != 0 && ezsp[2] == 0x00 {
+				m.score++
+				stack := binary.LittleEndian.Uint16(ezsp[5:7])
+				m.info.Firmware = fmt.Sprintf("%d.%d.%d.%d", stack>>12, stack>>8&0xf, stack>>4&0xf, stack&0xf)
+				m.info.Details = withDetail(m.info.Details, "ezsp_protocol", strconv.Itoa(int(ezsp[3])))
+				m.info.Details = withDetail(m.info.Details, "stack_type", strconv.Itoa(int(ezsp[4])))
+			}
+		}
+	}
+	return m
+}
+
+// ashFrames splits an ASH byte stream into unescaped frames without the
+// flag byte. Cancelled and substituted frames are left out.
+func ashFrames(data []byte) [][]byte {
+	var frames [][]byte
+	var cur []byte
+	escaped, bad := false, false
+	for _, b := range data {
+		switch b {
+		case ashFlag:
+			if !bad && len(cur) > 0 {
+				frames = append(frames, cur)
+			}
+			cur, escaped, bad = nil, false, false
+		case ashCancel:
+			cur, escaped, bad = nil, false, false
+		case ashSubstitute:
+			bad = true
+		case ashXON, ashXOFF:
+		case ashEscape:
+			escaped = true
+		default:
+			if escaped {
+				b ^= 0x20
+				escaped = false
+			}
+			cur = append(cur, b)
+		}
+	}
+	return frames
+}
+
+// ashDerandomize undoes the pseudo-random XOR applied to the data field of
+// ASH DATA frames
+func ashDerandomize(data []byte) []byte {
+	out := make([]byte, len(data))
+	rand := byte(0x42)
+	for i, b := range data {
+		out[i] = b ^ rand
+		if rand&1 != 0 {
+			rand = rand>>1 ^ 0xb8
+		} else {
+			rand >>= 1
+		}
+	}
+	return out
+}
+
+// crcCCITT is CRC-16/CCITT-FALSE as used by ASH
+func crcCCITT(data []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func resetReason(code byte) string {
+	if name, ok := ashResetReasons[code]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02x", code)
+}
+
+// Z-Stack monitor and test frames: SOF, length, two command bytes, data
+// and an XOR frame check sequence
+const (
+	znpSOF     byte = 0xfe
+	znpMaxData      = 250
+)
+
+var znpProducts = map[byte]string{
+	0: "Z-Stack 1.2",
+	1: "Z-Stack 3.x.0",
+	2: "Z-Stack 3.0.x",
+}
+
+func scanZNP(data []byte) match {
+	m := match{info: Info{Type: TypeZNP, Name: "TI Z-Stack (ZNP)"}}
+	for i := 0; i+5 <= len(data); i++ {
+		if data[i] != znpSOF {
+			continue
+		}
+		n := int(data[i+1])
+		if n > znpMaxData || i+5+n > len(data) {
+			continue
+		}
+		frame := data[i+1 : i+4+n]
+		cmd0, cmd1 := frame[1], frame[2]
+		// Devices only send asynchronous requests and synchronous responses
+		if kind := cmd0 & 0xe0; (kind != 0x40 && kind != 0x60) || xorSum(frame) != data[i+4+n] {
+			continue
+		}
+		m.info.Frames++
+		m.score++
+		payload := frame[3:]
+
+		switch {
+		case cmd0 == 0x61 && cmd1 == 0x02 && len(payload) >= 5:
+			// SYS_VERSION response
+			m.score++
+			m.info.Firmware = fmt.Sprintf("%d.%d.%d", payload[2], payload[3], payload[4])
+			m.info.Details = withDetail(m.info.Details, "transport_rev", strconv.Itoa(int(payload[0])))
+			m.info.Details = withDetail(m.info.Details, "product", znpProduct(payload[1]))
+			if len(payload) >= 9 {
+				m.info.Details = withDetail(m.info.Details, "revision", strconv.FormatUint(uint64(binary.LittleEndian.Uint32(payload[5:9])), 10))
+			}
+		case cmd0 == 0x41 && cmd1 == 0x80 && len(payload) >= 6:
+			// SYS_RESET_IND
+			m.score++
+			if m.info.Firmware == "" {
+				m.info.Firmware = fmt.Sprintf("%d.%d", payload[3], payload[4])
+			}
+			m.info.Details = withDetail(m.info.Details, "transport_rev", strconv.Itoa(int(payload[1])))
+			m.info.Details = withDetail(m.info.Details, "product", znpProduct(payload[2]))
+			m.info.Details = withDetail(m.info.Details, "hardware_rev", strconv.Itoa(int(payload[5])))
+		}
+		i += 4 + n
+	}
+	return m
+}
+
+func znpProduct(id byte) string {
+	if name, ok := znpProducts[id]; ok {
+		return name
+	}
+	return strconv.Itoa(int(id))
+}
+
+// deCONZ serial protocol: SLIP framed commands with a little-endian length
+// and a two's complement 16-bit checksum
+const (
+	slipEnd        byte = 0xc0
+	slipEsc        byte = 0xdb
+	slipEscEnd     byte = 0xdc
+	slipEscEsc     byte = 0xdd
+	deconzVersion  byte = 0x0d
+	deconzMinFrame      = 7
+)
+
+var deconzPlatforms = map[byte]string{
+	0x05: "ConBee/RaspBee",
+	0x07: "ConBee II/RaspBee II",
+	0x09: "ConBee III",
+}
+
+func scanDeCONZ(data []byte) match {
+	m := match{info: Info{Type: TypeDeCONZ, Name: "dresden elektronik deCONZ"}}
+	for _, frame := range slipFrames(data) {
+		if len(frame) < deconzMinFrame {
+			continue
+		}
+		body := frame[:len(frame)-2]
+		if int(binary.LittleEndian.Uint16(body[3:5])) != len(body) || deconzChecksum(body) != binary.LittleEndian.Uint16(frame[len(frame)-2:]) {
+			continue
+		}
+		m.info.Frames++
+		m.score++
+
+		if body[0] == deconzVersion && len(body) >= 9 {
+			m.score++
+			version := binary.LittleEndian.Uint32(body[5:9])
+			m.info.Firmware = fmt.Sprintf("0x%08x", version)
+			platform := byte(version >> 8)
+			if name, ok := deconzPlatforms[platform]; ok {
+				m.info.Details = withDetail(m.info.Details, "platform", name)
+			} else {
+				m.info.Details = withDetail(m.info.Details, "platform", fmt.Sprintf("0x%02x", platform))
+			}
+		}
+	}
+	return m
+}
+
+// slipFrames splits a SLIP byte stream into unescaped frames
+func slipFrames(data []byte) [][]byte {
+	var frames [][]byte
+	var cur []byte
+	escaped := false
+	for _, b := range data {
+		switch {
+		case b == slipEnd:
+			if len(cur) > 0 {
+				frames = append(frames, cur)
+			}
+			cur, escaped = nil, false
+		case b == slipEsc:
+			escaped = true
+		case escaped:
+			escaped = false
+			switch b {
+			case slipEscEnd:
+				cur = append(cur, slipEnd)
+			case slipEscEsc:
+				cur = append(cur, slipEsc)
+			default:
+				cur = append(cur, b)
+			}
+		default:
+			cur = append(cur, b)
+		}
+	}
+	return frames
+}
+
+func deconzChecksum(data []byte) uint16 {
+	var sum uint16
+	for _, b := range data {
+		sum += uint16(b)
+	}
+	return ^sum + 1
+}
+
+// Z-Wave Serial API data frames: SOF, length, type, function, data and a
+// checksum of 0xff XOR every byte after SOF
+const (
+	zwaveSOF          byte = 0x01
+	zwaveResponse     byte = 0x01
+	zwaveGetVersion   byte = 0x15
+	zwaveCapabilities byte = 0x07
+	zwaveMinLength         = 3
+)
+
+var zwaveLibraries = map[byte]string{
+	1: "static_controller",
+	2: "controller",
+	3: "enhanced_slave",
+	4: "slave",
+	5: "installer",
+	6: "routing_slave",
+	7: "bridge_controller",
+	8: "device_under_test",
+}
+
+func scanZWave(data []byte) match {
+	m := match{info: Info{Type: TypeZWave, Name: "Z-Wave Serial API"}}
+	for i := 0; i+2 <= len(data); i++ {
+		if data[i] != zwaveSOF {
+			continue
+		}
+		n := int(data[i+1])
+		if n < zwaveMinLength || i+2+n > len(data) {
+			continue
+		}
+		frame := data[i+1 : i+1+n] // length through the last data byte
+		if typ := frame[1]; typ > zwaveResponse || 0xff^xorSum(frame) != data[i+1+n] {
+			continue
+		}
+		m.info.Frames++
+		m.score++
+		payload := frame[3:]
+
+		if frame[1] == zwaveResponse {
+			switch frame[2] {
+			case zwaveGetVersion:
+				if end := bytes.IndexByte(payload, 0); end > 0 && bytes.HasPrefix(payload, []byte("Z-Wave")) {
+					m.score++
+					m.info.Firmware = string(payload[:end])
+					if end+1 < len(payload) {
+						m.info.Details = withDetail(m.info.Details, "library", zwaveLibrary(payload[end+1]))
+					}
+				}
+			case zwaveCapabilities:
+				if len(payload) >= 8 {
+					m.score++
+					m.info.Details = withDetail(m.info.Details, "application_version", fmt.Sprintf("%d.%d", payload[0], payload[1]))
+					m.info.Details = withDetail(m.info.Details, "manufacturer_id", fmt.Sprintf("0x%04x", binary.BigEndian.Uint16(payload[2:4])))
+					m.info.Details = withDetail(m.info.Details, "product_type", fmt.Sprintf("0x%04x", binary.BigEndian.Uint16(payload[4:6])))
+					m.info.Details = withDetail(m.info.Details, "product_id", fmt.Sprintf("0x%04x", binary.BigEndian.Uint16(payload[6:8])))
+				}
+			}
+		}
+		i += 1 + n
+	}
+	return m
+}
+
+func zwaveLibrary(id byte) string {
+	if name, ok := zwaveLibraries[id]; ok {
+		return name
+	}
+	return strconv.Itoa(int(id))
+}
+
+func xorSum(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum ^= b
+	}
+	return sum
+}
+
+// withDetail sets key in details, allocating the map on first use
+func withDetail(details map[string]string, key, value string) map[string]string {
+	if details == nil {
+		details = make(map[string]string)
+	}
+	details[key] = value
+	return details
+}
@@ -0,0 +1,66 @@
+// Package exporter pushes proxy metrics to external monitoring systems.
+package exporter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/metrics"
+)
+
+// Source returns the current metrics snapshot
+type Source func() metrics.Snapshot
+
+// periodic drives an exporter's flush function on a fixed interval
+type periodic struct {
+	interval time.Duration
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func newPeriodic(interval time.Duration) periodic {
+	ctx, cancel := context.WithCancel(context.Background())
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	return periodic{interval: interval, ctx: ctx, cancel: cancel}
+}
+
+// start calls flush with the previous and current snapshot on every tick
+func (p *periodic) start(source Source, flush func(snap, prev metrics.Snapshot, now time.Time)) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		ticker := time.NewTicker(p.interval)
+		defer ticker.Stop()
+
+		prev := source()
+		for {
+			select {
+			case <-p.ctx.Done():
+				return
+			case now := <-ticker.C:
+				snap := source()
+				flush(snap, prev, now)
+				prev = snap
+			}
+		}
+	}()
+}
+
+func (p *periodic) stop() {
+	p.cancel()
+	p.wg.Wait()
+}
+
+// avgBroadcast returns the mean broadcast latency between two snapshots
+func avgBroadcast(snap, prev metrics.Snapshot) time.Duration {
+	n := snap.BroadcastCount - prev.BroadcastCount
+	if n == 0 {
+		return 0
+	}
+	return (snap.BroadcastTotal - prev.BroadcastTotal) / time.Duration(n)
+}
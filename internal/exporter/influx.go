@@ -0,0 +1,133 @@
+package exporter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/metrics"
+)
+
+// measurement is the InfluxDB measurement name for all exported fields
+const measurement = "serial_tcp_proxy"
+
+// InfluxConfig configures the InfluxDB exporter. Database selects the v1
+// write API; Bucket (with Org and Token) selects the v2 write API.
+type InfluxConfig struct {
+	URL      string
+	Database string
+	Org      string
+	Bucket   string
+	Token    string
+	Interval time.Duration
+	Tags     map[string]string
+}
+
+// Influx periodically writes metrics as InfluxDB line protocol
+type Influx struct {
+	periodic
+	cfg    InfluxConfig
+	source Source
+	logger *logger.Logger
+	client *http.Client
+}
+
+func NewInflux(cfg InfluxConfig, source Source, log *logger.Logger) *Influx {
+	return &Influx{
+		periodic: newPeriodic(cfg.Interval),
+		cfg:      cfg,
+		source:   source,
+		logger:   log,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (e *Influx) Start() {
+	e.logger.Info("Exporting metrics to InfluxDB %s every %v", e.cfg.URL, e.interval)
+	e.start(e.source, func(snap, prev metrics.Snapshot, now time.Time) {
+		if err := e.write(formatLine(snap, prev, e.cfg.Tags, now)); err != nil {
+			e.logger.Warn("InfluxDB export failed: %v", err)
+		}
+	})
+}
+
+func (e *Influx) Stop() {
+	e.stop()
+}
+
+// writeURL builds the v1 or v2 write endpoint
+func (e *Influx) writeURL() string {
+	base := strings.TrimSuffix(e.cfg.URL, "/")
+	q := url.Values{}
+	q.Set("precision", "ns")
+	if e.cfg.Bucket != "" {
+		q.Set("org", e.cfg.Org)
+		q.Set("bucket", e.cfg.Bucket)
+		return base + "/api/v2/write?" + q.Encode()
+	}
+	q.Set("db", e.cfg.Database)
+	return base + "/write?" + q.Encode()
+}
+
+func (e *Influx) write(line string) error {
+	req, err := http.NewRequestWithContext(e.ctx, http.MethodPost, e.writeURL(), strings.NewReader(line))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if e.cfg.Token != "" {
+		req.Header.Set("Authorization", "Token "+e.cfg.Token)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// formatLine renders a snapshot as a single line-protocol point. Counters are
+// cumulative; broadcast latency is averaged over the interval since prev.
+func formatLine(snap, prev metrics.Snapshot, tags map[string]string, ts time.Time) string {
+	var b strings.Builder
+	b.WriteString(measurement)
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, ",%s=%s", escapeTag(k), escapeTag(tags[k]))
+	}
+
+	avgLatency := float64(avgBroadcast(snap, prev).Nanoseconds()) / 1e3
+
+	fmt.Fprintf(&b, " bytes_from_upstream=%di,packets_from_upstream=%di,bytes_to_upstream=%di,packets_to_upstream=%di",
+		snap.BytesFromUpstream, snap.PacketsFromUpstream, snap.BytesToUpstream, snap.PacketsToUpstream)
+	fmt.Fprintf(&b, ",dropped_packets=%di,retried_packets=%di,lost_packets=%di,upstream_reconnects=%di,clients=%di,upstream_connected=%t",
+		snap.DroppedPackets, snap.RetriedPackets, snap.LostPackets, snap.UpstreamReconnects, snap.Clients, snap.UpstreamConnected)
+	fmt.Fprintf(&b, ",broadcast_latency_avg_us=%g,broadcast_latency_max_us=%di",
+		avgLatency, snap.BroadcastMax.Microseconds())
+	fmt.Fprintf(&b, " %d\n", ts.UnixNano())
+
+	return b.String()
+}
+
+var tagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+func escapeTag(s string) string {
+	return tagEscaper.Replace(s)
+}
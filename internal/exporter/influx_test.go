@@ -0,0 +1,93 @@
+package exporter
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/metrics"
+)
+
+func newTestLogger() *logger.Logger {
+	log, _ := logger.New(false, "")
+	log.SetOutput(io.Discard)
+	return log
+}
+
+func TestFormatLine(t *testing.T) {
+	prev := metrics.Snapshot{BroadcastCount: 2, BroadcastTotal: 200 * time.Microsecond}
+	snap := metrics.Snapshot{
+		BytesFromUpstream:   120,
+		PacketsFromUpstream: 10,
+		BytesToUpstream:     30,
+		PacketsToUpstream:   3,
+		UpstreamConnected:   true,
+		Clients:             2,
+		BroadcastCount:      4,
+		BroadcastTotal:      600 * time.Microsecond,
+		BroadcastMax:        250 * time.Microsecond,
+	}
+	tags := map[string]string{"site": "home pi", "host": "ha"}
+
+	line := formatLine(snap, prev, tags, time.Unix(0, 42))
+
+	expected := `serial_tcp_proxy,host=ha,site=home\ pi ` +
+		"bytes_from_upstream=120i,packets_from_upstream=10i,bytes_to_upstream=30i,packets_to_upstream=3i," +
+		"dropped_packets=0i,retried_packets=0i,lost_packets=0i,upstream_reconnects=0i,clients=2i,upstream_connected=true," +
+		"broadcast_latency_avg_us=200,broadcast_latency_max_us=250i 42\n"
+	if line != expected {
+		t.Errorf("Unexpected line:\n got: %s\nwant: %s", line, expected)
+	}
+}
+
+func TestInflux_WriteV2(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	source := func() metrics.Snapshot { return metrics.Snapshot{Clients: 1} }
+	e := NewInflux(InfluxConfig{
+		URL:      srv.URL,
+		Org:      "home",
+		Bucket:   "serial",
+		Token:    "secret",
+		Interval: 20 * time.Millisecond,
+	}, source, newTestLogger())
+	e.Start()
+	defer e.Stop()
+
+	select {
+	case r := <-received:
+		if r.URL.Path != "/api/v2/write" {
+			t.Errorf("Expected v2 write path, got %s", r.URL.Path)
+		}
+		if r.URL.Query().Get("bucket") != "serial" || r.URL.Query().Get("org") != "home" {
+			t.Errorf("Unexpected query %s", r.URL.RawQuery)
+		}
+		if r.Header.Get("Authorization") != "Token secret" {
+			t.Errorf("Expected token authorization, got %q", r.Header.Get("Authorization"))
+		}
+		if body := <-bodies; !strings.Contains(body, "clients=1i") {
+			t.Errorf("Expected clients field in body, got %s", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for InfluxDB write")
+	}
+}
+
+func TestInflux_WriteURLV1(t *testing.T) {
+	e := NewInflux(InfluxConfig{URL: "http://influx:8086/", Database: "proxy"}, nil, newTestLogger())
+	if got := e.writeURL(); got != "http://influx:8086/write?db=proxy&precision=ns" {
+		t.Errorf("Unexpected v1 write URL %s", got)
+	}
+}
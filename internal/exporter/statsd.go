@@ -0,0 +1,120 @@
+package exporter
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/metrics"
+)
+
+// maxStatsdPayload keeps datagrams below a typical Ethernet MTU
+const maxStatsdPayload = 1432
+
+// StatsdConfig configures the statsd exporter
+type StatsdConfig struct {
+	Addr     string
+	Prefix   string
+	Interval time.Duration
+}
+
+// Statsd periodically emits metrics over UDP in statsd format. Counters are
+// sent as deltas since the previous flush, gauges as current values, and the
+// interval's mean broadcast latency as a timer.
+type Statsd struct {
+	periodic
+	cfg    StatsdConfig
+	source Source
+	logger *logger.Logger
+	conn   net.Conn
+}
+
+func NewStatsd(cfg StatsdConfig, source Source, log *logger.Logger) (*Statsd, error) {
+	conn, err := net.Dial("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Statsd{
+		periodic: newPeriodic(cfg.Interval),
+		cfg:      cfg,
+		source:   source,
+		logger:   log,
+		conn:     conn,
+	}, nil
+}
+
+func (e *Statsd) Start() {
+	e.logger.Info("Emitting statsd metrics to %s every %v", e.cfg.Addr, e.interval)
+	e.start(e.source, func(snap, prev metrics.Snapshot, _ time.Time) {
+		if err := e.send(formatStatsd(e.cfg.Prefix, snap, prev)); err != nil {
+			e.logger.Warn("statsd emit failed: %v", err)
+		}
+	})
+}
+
+func (e *Statsd) Stop() {
+	e.stop()
+	e.conn.Close()
+}
+
+// send packs lines into as few datagrams as possible
+func (e *Statsd) send(lines []string) error {
+	var buf strings.Builder
+	flush := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		_, err := e.conn.Write([]byte(buf.String()))
+		buf.Reset()
+		return err
+	}
+
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > maxStatsdPayload {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	return flush()
+}
+
+func formatStatsd(prefix string, snap, prev metrics.Snapshot) []string {
+	counter := func(name string, cur, old uint64) string {
+		return fmt.Sprintf("%s%s:%d|c", prefix, name, cur-old)
+	}
+	gauge := func(name string, v int64) string {
+		return fmt.Sprintf("%s%s:%d|g", prefix, name, v)
+	}
+
+	connected := int64(0)
+	if snap.UpstreamConnected {
+		connected = 1
+	}
+
+	lines := []string{
+		counter("bytes_from_upstream", snap.BytesFromUpstream, prev.BytesFromUpstream),
+		counter("packets_from_upstream", snap.PacketsFromUpstream, prev.PacketsFromUpstream),
+		counter("bytes_to_upstream", snap.BytesToUpstream, prev.BytesToUpstream),
+		counter("packets_to_upstream", snap.PacketsToUpstream, prev.PacketsToUpstream),
+		counter("dropped_packets", snap.DroppedPackets, prev.DroppedPackets),
+		counter("retried_packets", snap.RetriedPackets, prev.RetriedPackets),
+		counter("lost_packets", snap.LostPackets, prev.LostPackets),
+		counter("upstream_reconnects", snap.UpstreamReconnects, prev.UpstreamReconnects),
+		gauge("clients", int64(snap.Clients)),
+		gauge("upstream_connected", connected),
+	}
+
+	if snap.BroadcastCount > prev.BroadcastCount {
+		avg := avgBroadcast(snap, prev)
+		lines = append(lines, fmt.Sprintf("%sbroadcast_latency:%g|ms", prefix, float64(avg.Nanoseconds())/1e6))
+	}
+
+	return lines
+}
@@ -0,0 +1,64 @@
+package exporter
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/metrics"
+)
+
+func TestFormatStatsd(t *testing.T) {
+	prev := metrics.Snapshot{BytesFromUpstream: 100, PacketsFromUpstream: 10}
+	snap := metrics.Snapshot{
+		BytesFromUpstream:   160,
+		PacketsFromUpstream: 14,
+		UpstreamConnected:   true,
+		Clients:             3,
+		BroadcastCount:      2,
+		BroadcastTotal:      3 * time.Millisecond,
+	}
+
+	lines := formatStatsd("stp.", snap, prev)
+	joined := strings.Join(lines, "\n")
+
+	for _, want := range []string{
+		"stp.bytes_from_upstream:60|c",
+		"stp.packets_from_upstream:4|c",
+		"stp.clients:3|g",
+		"stp.upstream_connected:1|g",
+		"stp.broadcast_latency:1.5|ms",
+	} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("Expected %q in output:\n%s", want, joined)
+		}
+	}
+}
+
+func TestStatsd_Emit(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer pc.Close()
+
+	source := func() metrics.Snapshot { return metrics.Snapshot{Clients: 2} }
+	e, err := NewStatsd(StatsdConfig{Addr: pc.LocalAddr().String(), Prefix: "p.", Interval: 20 * time.Millisecond}, source, newTestLogger())
+	if err != nil {
+		t.Fatalf("NewStatsd failed: %v", err)
+	}
+	e.Start()
+	defer e.Stop()
+
+	buf := make([]byte, 2048)
+	_ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Failed to receive datagram: %v", err)
+	}
+
+	if !strings.Contains(string(buf[:n]), "p.clients:2|g") {
+		t.Errorf("Expected clients gauge, got %s", buf[:n])
+	}
+}
@@ -0,0 +1,26 @@
+// Package fec holds the forward error correction settings of quic://
+// links, shared by the configuration checks and the QUIC transport.
+package fec
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// MaxDepth is the largest number of earlier chunks a datagram repeats.
+const MaxDepth = 4
+
+// ParseQuery reads the fec parameter of a quic:// URL: the number of
+// earlier chunks each datagram repeats, or 0 to send the stream alone.
+func ParseQuery(query url.Values) (int, error) {
+	v := query.Get("fec")
+	if v == "" {
+		return 0, nil
+	}
+	depth, err := strconv.Atoi(v)
+	if err != nil || depth < 0 || depth > MaxDepth {
+		return 0, fmt.Errorf("fec must be between 0 and %d, got %q", MaxDepth, v)
+	}
+	return depth, nil
+}
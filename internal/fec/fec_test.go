@@ -0,0 +1,19 @@
+package fec
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	for _, v := range []string{"", "0", "2", "4"} {
+		if _, err := ParseQuery(url.Values{"fec": {v}}); err != nil {
+			t.Errorf("Expected fec=%q to be valid: %v", v, err)
+		}
+	}
+	for _, v := range []string{"-1", "5", "on"} {
+		if _, err := ParseQuery(url.Values{"fec": {v}}); err == nil {
+			t.Errorf("Expected fec=%q to be rejected", v)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Package framing splits a byte stream into frames.
+package framing
+
+import (
+	"sync"
+	"time"
+)
+
+// MaxFrameSize bounds a frame when the line never goes quiet
+const MaxFrameSize = 64 * 1024
+
+// GapFramer coalesces bytes into frames delimited by a quiet period on the
+// line, like Modbus RTU's 3.5 character silence. Bytes written within gap
+// of each other are emitted together once the line has been quiet for gap.
+type GapFramer struct {
+	gap    time.Duration
+	emit   func([]byte)
+	emitMu sync.Mutex // serializes emit calls and preserves frame order
+	mu     sync.Mutex
+	buf    []byte
+	timer  *time.Timer
+	closed bool
+}
+
+// NewGapFramer returns a framer that calls emit for every complete frame.
+// emit runs on the framer's timer goroutine.
+func NewGapFramer(gap time.Duration, emit func([]byte)) *GapFramer {
+	f := &GapFramer{gap: gap, emit: emit}
+	f.timer = time.AfterFunc(time.Hour, f.Flush)
+	f.timer.Stop()
+	return f
+}
+
+// Write adds received bytes to the current frame and restarts the gap timer
+func (f *GapFramer) Write(data []byte) {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	f.buf = append(f.buf, data...)
+	full := len(f.buf) >= MaxFrameSize
+	if !full {
+		f.timer.Reset(f.gap)
+	}
+	f.mu.Unlock()
+
+	if full {
+		f.Flush()
+	}
+}
+
+// Flush emits the pending bytes, if any, as a frame
+func (f *GapFramer) Flush() {
+	f.emitMu.Lock()
+	defer f.emitMu.Unlock()
+
+	f.mu.Lock()
+	frame := f.buf
+	f.buf = nil
+	closed := f.closed
+	f.mu.Unlock()
+
+	if len(frame) > 0 && !closed {
+		f.emit(frame)
+	}
+}
+
+// Stop discards pending bytes and stops the timer
+func (f *GapFramer) Stop() {
+	f.mu.Lock()
+	f.closed = true
+	f.buf = nil
+	f.timer.Stop()
+	f.mu.Unlock()
+}
+
+// Reset discards the pending bytes, such as the partial frame of a lost
+// connection, and keeps the framer running
+func (f *GapFramer) Reset() {
+	f.mu.Lock()
+	f.buf = nil
+	f.timer.Stop()
+	f.mu.Unlock()
+}
+
+// Buffered returns the number of bytes waiting for the gap
+func (f *GapFramer) Buffered() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.buf)
+}
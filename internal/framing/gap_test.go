@@ -0,0 +1,98 @@
+package framing
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+type collector struct {
+	mu     sync.Mutex
+	frames [][]byte
+}
+
+func (c *collector) emit(frame []byte) {
+	c.mu.Lock()
+	c.frames = append(c.frames, frame)
+	c.mu.Unlock()
+}
+
+func (c *collector) get() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([][]byte(nil), c.frames...)
+}
+
+func TestGapFramer_CoalescesSegments(t *testing.T) {
+	c := &collector{}
+	f := NewGapFramer(30*time.Millisecond, c.emit)
+	defer f.Stop()
+
+	// First frame arrives in three segments within the gap
+	f.Write([]byte{0x01})
+	time.Sleep(5 * time.Millisecond)
+	f.Write([]byte{0x03, 0x02})
+	time.Sleep(5 * time.Millisecond)
+	f.Write([]byte{0x00, 0x2a})
+
+	// Quiet line, then a second frame
+	time.Sleep(80 * time.Millisecond)
+	f.Write([]byte{0x02, 0x03})
+	time.Sleep(80 * time.Millisecond)
+
+	frames := c.get()
+	if len(frames) != 2 {
+		t.Fatalf("Expected 2 frames, got %d: %x", len(frames), frames)
+	}
+	if !bytes.Equal(frames[0], []byte{0x01, 0x03, 0x02, 0x00, 0x2a}) {
+		t.Errorf("Unexpected first frame %x", frames[0])
+	}
+	if !bytes.Equal(frames[1], []byte{0x02, 0x03}) {
+		t.Errorf("Unexpected second frame %x", frames[1])
+	}
+}
+
+func TestGapFramer_MaxSize(t *testing.T) {
+	c := &collector{}
+	f := NewGapFramer(time.Hour, c.emit)
+	defer f.Stop()
+
+	f.Write(make([]byte, MaxFrameSize))
+	if frames := c.get(); len(frames) != 1 || len(frames[0]) != MaxFrameSize {
+		t.Errorf("Expected one full frame, got %d frames", len(frames))
+	}
+}
+
+func TestGapFramer_Stop(t *testing.T) {
+	c := &collector{}
+	f := NewGapFramer(10*time.Millisecond, c.emit)
+
+	f.Write([]byte{0x01})
+	f.Stop()
+	time.Sleep(30 * time.Millisecond)
+
+	if frames := c.get(); len(frames) != 0 {
+		t.Errorf("Expected no frames after Stop, got %x", frames)
+	}
+}
+
+func TestGapFramer_Reset(t *testing.T) {
+	c := &collector{}
+	f := NewGapFramer(10*time.Millisecond, c.emit)
+	defer f.Stop()
+
+	// The partial frame is dropped and the framer keeps working
+	f.Write([]byte{0x01, 0x02})
+	f.Reset()
+	time.Sleep(30 * time.Millisecond)
+	if frames := c.get(); len(frames) != 0 {
+		t.Fatalf("Expected no frames after Reset, got %x", frames)
+	}
+
+	f.Write([]byte{0xaa})
+	time.Sleep(30 * time.Millisecond)
+	if frames := c.get(); len(frames) != 1 || !bytes.Equal(frames[0], []byte{0xaa}) {
+		t.Errorf("Expected frame aa after Reset, got %x", frames)
+	}
+}
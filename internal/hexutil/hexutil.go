@@ -0,0 +1,34 @@
+// Package hexutil parses the loosely formatted hex strings users type into
+// the UI, config files and API requests, and formats bytes the same way.
+package hexutil
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+var cleaner = strings.NewReplacer(" ", "", "\n", "", "\r", "", "\t", "")
+
+// Parse decodes a hex string, ignoring whitespace and a leading 0x prefix
+func Parse(s string) ([]byte, error) {
+	s = cleaner.Replace(s)
+	s = strings.TrimPrefix(s, "0x")
+	return hex.DecodeString(s)
+}
+
+// Format returns data as lowercase hex bytes separated by spaces, e.g.
+// "f7 0e 1f"
+func Format(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.Grow(len(data) * 3)
+	for i, b := range data {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(hex.EncodeToString([]byte{b}))
+	}
+	return sb.String()
+}
@@ -0,0 +1,41 @@
+package hexutil
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []byte
+		wantErr  bool
+	}{
+		{"f70e1f", []byte{0xf7, 0x0e, 0x1f}, false},
+		{"f7 0e 1f", []byte{0xf7, 0x0e, 0x1f}, false},
+		{"0xf70e\r\n1f", []byte{0xf7, 0x0e, 0x1f}, false},
+		{"", []byte{}, false},
+		{"f7 0", nil, true},
+		{"zz", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := Parse(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q): unexpected error state %v", tt.input, err)
+			continue
+		}
+		if !tt.wantErr && !bytes.Equal(got, tt.expected) {
+			t.Errorf("Parse(%q): expected %x, got %x", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	if got := Format([]byte{0xf7, 0x0e, 0x1f}); got != "f7 0e 1f" {
+		t.Errorf("Expected \"f7 0e 1f\", got %q", got)
+	}
+	if got := Format(nil); got != "" {
+		t.Errorf("Expected empty string, got %q", got)
+	}
+}
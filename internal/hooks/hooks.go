@@ -0,0 +1,169 @@
+// Package hooks runs configured commands on connection events, e.g. to
+// power-cycle a converter through a relay when its upstream goes down.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+)
+
+// Events a hook can be configured for, as set in PROXY_EVENT
+const (
+	UpstreamUp       = "upstream_up"
+	UpstreamDown     = "upstream_down"
+	ClientConnect    = "client_connect"
+	ClientDisconnect = "client_disconnect"
+)
+
+// queueSize bounds the events waiting while a hook runs
+const queueSize = 32
+
+// maxOutput bounds the output of one run that is logged
+const maxOutput = 16 << 10
+
+// envPrefix is prepended to the names of event variables
+const envPrefix = "PROXY_"
+
+type job struct {
+	event   string
+	command string
+	env     []string
+}
+
+// Runner runs hooks one at a time in event order, so a hook reacting to an
+// upstream going down has finished before the one for its return starts
+type Runner struct {
+	commands map[string]string
+	timeout  time.Duration
+	logger   *logger.Logger
+	jobs     chan job
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// New starts a Runner for the given commands, keyed by event. Empty commands
+// are ignored; without any, New returns nil, on which Fire and Close do
+// nothing.
+func New(commands map[string]string, timeout time.Duration, log *logger.Logger) *Runner {
+	r := &Runner{commands: make(map[string]string), timeout: timeout, logger: log}
+	for event, command := range commands {
+		if command != "" {
+			r.commands[event] = command
+		}
+	}
+	if len(r.commands) == 0 {
+		return nil
+	}
+
+	r.jobs = make(chan job, queueSize)
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for {
+			select {
+			case j := <-r.jobs:
+				r.run(j)
+			case <-r.ctx.Done():
+				return
+			}
+		}
+	}()
+	return r
+}
+
+// Fire queues the hook for event, if one is configured. Each of vars is
+// passed in the environment as PROXY_<key>, along with PROXY_EVENT. When
+// the queue is full the event is dropped with a warning.
+func (r *Runner) Fire(event string, vars map[string]string) {
+	if r == nil {
+		return
+	}
+	command, ok := r.commands[event]
+	if !ok {
+		return
+	}
+
+	env := []string{envPrefix + "EVENT=" + event}
+	for k, v := range vars {
+		env = append(env, envPrefix+k+"="+v)
+	}
+	select {
+	case r.jobs <- job{event: event, command: command, env: env}:
+	default:
+		r.logger.Warn("Hook %s dropped: %d hooks already waiting", event, queueSize)
+	}
+}
+
+// run executes one hook with sh -c and logs its output
+func (r *Runner) run(j job) {
+	ctx, cancel := context.WithTimeout(r.ctx, r.timeout)
+	defer cancel()
+
+	var out limitedBuffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", j.command)
+	cmd.Env = append(os.Environ(), j.env...)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	// Children keeping the output open must not stall the runner
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+	err := cmd.Run()
+	log := r.logger.With("hook", j.event)
+	for _, line := range strings.Split(strings.TrimRight(out.String(), "\n"), "\n") {
+		if line != "" {
+			log.Info("Hook %s: %s", j.event, line)
+		}
+	}
+	if out.truncated {
+		log.Warn("Hook %s: output truncated after %d bytes", j.event, maxOutput)
+	}
+
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		log.Warn("Hook %s killed after %v timeout", j.event, r.timeout)
+	case err != nil:
+		log.Warn("Hook %s failed: %v", j.event, err)
+	default:
+		log.Info("Hook %s finished in %v", j.event, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// Close stops the runner, killing a running hook and dropping queued ones
+func (r *Runner) Close() {
+	if r == nil {
+		return
+	}
+	r.cancel()
+	r.wg.Wait()
+}
+
+// limitedBuffer keeps the first maxOutput bytes written to it. exec
+// serializes the writes of stdout and stderr sharing one writer.
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := maxOutput - b.buf.Len(); len(p) > room {
+		b.buf.Write(p[:room])
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
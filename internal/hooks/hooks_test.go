@@ -0,0 +1,97 @@
+package hooks
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/pkg/testutil"
+)
+
+// syncBuffer collects log output written from the runner goroutine
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func newTestLogger(out *syncBuffer) *logger.Logger {
+	log, _ := logger.New(false, "")
+	log.SetOutput(out)
+	return log
+}
+
+func TestRunner_Fire(t *testing.T) {
+	var out syncBuffer
+	file := filepath.Join(t.TempDir(), "events")
+	r := New(map[string]string{
+		UpstreamDown: `echo "$PROXY_EVENT $PROXY_UPSTREAM" >> ` + file + `; echo relay off`,
+		UpstreamUp:   "",
+	}, time.Second, newTestLogger(&out))
+	t.Cleanup(r.Close)
+
+	r.Fire(UpstreamDown, map[string]string{"UPSTREAM": "meter1"})
+	r.Fire(UpstreamUp, nil) // not configured
+	r.Fire(UpstreamDown, map[string]string{"UPSTREAM": "meter2"})
+
+	testutil.Eventually(t, func() bool {
+		return strings.Count(out.String(), "finished in") == 2
+	}, "hooks did not finish")
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Hook did not run: %v", err)
+	}
+	if string(data) != "upstream_down meter1\nupstream_down meter2\n" {
+		t.Errorf("Unexpected hook runs %q", data)
+	}
+	if !strings.Contains(out.String(), "Hook upstream_down: relay off") {
+		t.Errorf("Expected the hook output logged, got %q", out.String())
+	}
+}
+
+func TestRunner_Timeout(t *testing.T) {
+	var out syncBuffer
+	r := New(map[string]string{
+		ClientConnect:    "sleep 10",
+		ClientDisconnect: "exit 3",
+	}, 100*time.Millisecond, newTestLogger(&out))
+	t.Cleanup(r.Close)
+
+	start := time.Now()
+	r.Fire(ClientConnect, nil)
+	r.Fire(ClientDisconnect, nil)
+	testutil.Eventually(t, func() bool {
+		return strings.Contains(out.String(), "Hook client_disconnect failed: exit status 3")
+	}, "second hook did not run after the first timed out")
+	if !strings.Contains(out.String(), "Hook client_connect killed after 100ms timeout") {
+		t.Errorf("Expected a timeout warning, got %q", out.String())
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("Timed out hook was not killed")
+	}
+}
+
+func TestNew_NoCommands(t *testing.T) {
+	r := New(map[string]string{UpstreamUp: ""}, time.Second, nil)
+	if r != nil {
+		t.Fatal("Expected nil runner without commands")
+	}
+	r.Fire(UpstreamUp, nil)
+	r.Close()
+}
@@ -0,0 +1,199 @@
+// Package inject prepares frames for packet injection, including rendering
+// templates with placeholders.
+package inject
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/hexutil"
+)
+
+// Renderer expands placeholders in injection data. Placeholders use the
+// form {{name[:arg...]}}:
+//
+//	{{ts[:enc]}}            current Unix time (default u32be)
+//	{{counter[:enc]}}       value incremented on every render (default u8)
+//	{{var:NAME[:enc]}}      request variable NAME (default u8)
+//	{{crc16[:enc]}}         CRC-16/Modbus of preceding bytes (default u16le)
+//	{{crc16_ccitt[:enc]}}   CRC-16/CCITT-FALSE of preceding bytes (default u16be)
+//	{{sum8}}, {{xor8}}      8-bit sum / XOR of preceding bytes
+//
+// enc is one of u8, u16be, u16le, u32be, u32le. In ASCII format ts, counter
+// and var render as decimal text and checksums are not available.
+type Renderer struct {
+	counter atomic.Uint32
+	now     func() time.Time
+}
+
+func NewRenderer() *Renderer {
+	return &Renderer{now: time.Now}
+}
+
+// IsTemplate reports whether data contains placeholders
+func IsTemplate(data string) bool {
+	return strings.Contains(data, "{{")
+}
+
+// Decode decodes data in the given format ("hex" or "ascii") as it is,
+// for injections that are not templates: text that looks like a
+// placeholder is sent unchanged.
+func Decode(format, data string) ([]byte, error) {
+	if format == "hex" {
+		return hexutil.Parse(data)
+	}
+	return []byte(data), nil
+}
+
+// Render decodes data in the given format ("hex" or "ascii"), expanding any
+// placeholders with vars. Injections are only rendered when they ask to be,
+// so that existing ASCII payloads containing "{{" are not changed.
+func (r *Renderer) Render(format, data string, vars map[string]string) ([]byte, error) {
+	if !IsTemplate(data) {
+		return Decode(format, data)
+	}
+
+	var out []byte
+	rest := data
+	for {
+		start := strings.Index(rest, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start:], "}}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder")
+		}
+
+		var err error
+		if out, err = appendLiteral(out, format, rest[:start]); err != nil {
+			return nil, err
+		}
+		if out, err = r.appendPlaceholder(out, format, rest[start+2:start+end], vars); err != nil {
+			return nil, err
+		}
+		rest = rest[start+end+2:]
+	}
+
+	return appendLiteral(out, format, rest)
+}
+
+func appendLiteral(out []byte, format, literal string) ([]byte, error) {
+	if format != "hex" {
+		return append(out, literal...), nil
+	}
+	b, err := hexutil.Parse(literal)
+	if err != nil {
+		return nil, err
+	}
+	return append(out, b...), nil
+}
+
+func (r *Renderer) appendPlaceholder(out []byte, format, spec string, vars map[string]string) ([]byte, error) {
+	parts := strings.Split(strings.TrimSpace(spec), ":")
+	name, args := parts[0], parts[1:]
+
+	var value uint64
+	enc := "u8"
+	switch name {
+	case "ts":
+		value, enc = uint64(r.now().Unix()), "u32be"
+	case "counter":
+		value = uint64(r.counter.Add(1))
+	case "var":
+		if len(args) == 0 {
+			return nil, fmt.Errorf("placeholder {{var}} requires a name")
+		}
+		raw, ok := vars[args[0]]
+		if !ok {
+			return nil, fmt.Errorf("missing variable %q", args[0])
+		}
+		v, err := strconv.ParseInt(raw, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("variable %q: %w", args[0], err)
+		}
+		value, args = uint64(v), args[1:]
+	case "crc16", "crc16_ccitt", "sum8", "xor8":
+		if format != "hex" {
+			return nil, fmt.Errorf("placeholder {{%s}} requires hex format", name)
+		}
+		value, enc = Checksum(name, out)
+	default:
+		return nil, fmt.Errorf("unknown placeholder {{%s}}", name)
+	}
+
+	if format != "hex" {
+		return strconv.AppendUint(out, value, 10), nil
+	}
+	if len(args) > 0 {
+		enc = args[0]
+	}
+	return appendEncoded(out, value, enc)
+}
+
+func appendEncoded(out []byte, v uint64, enc string) ([]byte, error) {
+	switch enc {
+	case "u8":
+		return append(out, byte(v)), nil
+	case "u16be":
+		return binary.BigEndian.AppendUint16(out, uint16(v)), nil
+	case "u16le":
+		return binary.LittleEndian.AppendUint16(out, uint16(v)), nil
+	case "u32be":
+		return binary.BigEndian.AppendUint32(out, uint32(v)), nil
+	case "u32le":
+		return binary.LittleEndian.AppendUint32(out, uint32(v)), nil
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", enc)
+	}
+}
+
+// Checksum computes the named checksum over data. It returns the value and
+// its natural encoding.
+func Checksum(name string, data []byte) (uint64, string) {
+	switch name {
+	case "crc16":
+		crc := uint16(0xffff)
+		for _, b := range data {
+			crc ^= uint16(b)
+			for i := 0; i < 8; i++ {
+				if crc&1 != 0 {
+					crc = crc>>1 ^ 0xa001
+				} else {
+					crc >>= 1
+				}
+			}
+		}
+		return uint64(crc), "u16le"
+	case "crc16_ccitt":
+		crc := uint16(0xffff)
+		for _, b := range data {
+			crc ^= uint16(b) << 8
+			for i := 0; i < 8; i++ {
+				if crc&0x8000 != 0 {
+					crc = crc<<1 ^ 0x1021
+				} else {
+					crc <<= 1
+				}
+			}
+		}
+		return uint64(crc), "u16be"
+	case "sum8":
+		var sum byte
+		for _, b := range data {
+			sum += b
+		}
+		return uint64(sum), "u8"
+	case "xor8":
+		var x byte
+		for _, b := range data {
+			x ^= b
+		}
+		return uint64(x), "u8"
+	}
+	return 0, "u8"
+}
@@ -0,0 +1,104 @@
+package inject
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestRender_PlainData(t *testing.T) {
+	r := NewRenderer()
+
+	data, err := r.Render("hex", "f7 0e 1f", nil)
+	if err != nil || !bytes.Equal(data, []byte{0xf7, 0x0e, 0x1f}) {
+		t.Errorf("Expected f70e1f, got %x (%v)", data, err)
+	}
+
+	data, err = r.Render("ascii", "AT\r\n", nil)
+	if err != nil || string(data) != "AT\r\n" {
+		t.Errorf("Expected AT\\r\\n, got %q (%v)", data, err)
+	}
+}
+
+func TestDecode_Literal(t *testing.T) {
+	// Without templating, placeholders are sent as they are
+	data, err := Decode("ascii", "SET {{name}}\r\n")
+	if err != nil || string(data) != "SET {{name}}\r\n" {
+		t.Errorf("Expected the text unchanged, got %q (%v)", data, err)
+	}
+	if _, err := Decode("hex", "01 {{crc16}}"); err == nil {
+		t.Error("Expected placeholders to be invalid hex")
+	}
+}
+
+func TestRender_Placeholders(t *testing.T) {
+	r := NewRenderer()
+	r.now = func() time.Time { return time.Unix(0x01020304, 0) }
+
+	data, err := r.Render("hex", "aa {{counter}} {{var:temp:u16be}} {{ts}} {{sum8}}", map[string]string{"temp": "0x0115"})
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+
+	expected := []byte{0xaa, 0x01, 0x01, 0x15, 0x01, 0x02, 0x03, 0x04}
+	var sum byte
+	for _, b := range expected {
+		sum += b
+	}
+	expected = append(expected, sum)
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Expected %x, got %x", expected, data)
+	}
+
+	// Counter increments per render
+	data, _ = r.Render("hex", "{{counter}}", nil)
+	if data[0] != 0x02 {
+		t.Errorf("Expected counter 2, got %d", data[0])
+	}
+}
+
+func TestRender_CRC16Modbus(t *testing.T) {
+	r := NewRenderer()
+
+	// Modbus "read holding registers" request with well-known CRC
+	data, err := r.Render("hex", "01 03 00 00 00 0a {{crc16}}", nil)
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+
+	expected := []byte{0x01, 0x03, 0x00, 0x00, 0x00, 0x0a, 0xc5, 0xcd}
+	if !bytes.Equal(data, expected) {
+		t.Errorf("Expected %x, got %x", expected, data)
+	}
+}
+
+func TestRender_ASCII(t *testing.T) {
+	r := NewRenderer()
+
+	data, err := r.Render("ascii", "SET {{var:level}}\r\n", map[string]string{"level": "42"})
+	if err != nil || string(data) != "SET 42\r\n" {
+		t.Errorf("Expected SET 42, got %q (%v)", data, err)
+	}
+
+	if _, err := r.Render("ascii", "X{{crc16}}", nil); err == nil {
+		t.Error("Expected error for checksum in ASCII format")
+	}
+}
+
+func TestRender_Errors(t *testing.T) {
+	r := NewRenderer()
+
+	invalid := []string{
+		"f7 {{var:missing}}",
+		"f7 {{unknown}}",
+		"f7 {{counter:u64}}",
+		"f7 {{counter",
+		"f7 0{{counter}}",
+		"{{var}}",
+	}
+	for _, tmpl := range invalid {
+		if _, err := r.Render("hex", tmpl, nil); err == nil {
+			t.Errorf("Expected error for template %q", tmpl)
+		}
+	}
+}
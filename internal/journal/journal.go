@@ -0,0 +1,189 @@
+// Package journal keeps WRITE_JOURNAL, an append-only record of every
+// write toward the upstream with who sent it and when. Unlike the packet
+// log it is not filtered, not rotated away by retention and independent of
+// LOG_PACKETS, so that it stays an authoritative account of who commanded
+// the device.
+package journal
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+)
+
+// Sources of writes not sent by a client
+const (
+	SourceInject = "INJECT" // /api/inject, macros and trigger responses
+	SourcePoll   = "POLL"   // POLLS queries
+	SourceInit   = "INIT"   // INIT_SEQUENCE frames sent on connect
+)
+
+// rotatedLayout is the timestamp suffix of rotated files. It has a fixed
+// width, so that sorting the names sorts the files by age.
+const rotatedLayout = "20060102-150405.000000"
+
+// Entry is one journaled write, stored as a line of JSON
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`            // client ID, or one of the Source constants
+	Name    string    `json:"name,omitempty"`    // announced by the client with IDENT
+	Addr    string    `json:"addr,omitempty"`    // client address
+	Session string    `json:"session,omitempty"` // client connection, as in the packet log
+	Data    string    `json:"data"`              // hex of the bytes written
+}
+
+// Journal appends entries to a file, rotating it when it grows past a size
+type Journal struct {
+	path     string
+	maxBytes int64
+	keep     int // rotated files kept, 0 keeps all
+	logger   *logger.Logger
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	failed bool // the last write failed, logged once until one succeeds
+	stuck  bool // the last rotation failed, logged once until one succeeds
+}
+
+// Open opens or creates the journal at path for appending. The file is
+// rotated once it would exceed maxBytes, and only the keep most recent
+// rotated files are kept, or all of them with keep 0.
+func Open(path string, maxBytes int64, keep int, log *logger.Logger) (*Journal, error) {
+	j := &Journal{path: path, maxBytes: maxBytes, keep: keep, logger: log}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Journal) open() error {
+	file, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	j.file, j.size = file, info.Size()
+	return nil
+}
+
+// Record appends a write of data made at t. The line is written before
+// Record returns, so it is not lost if the proxy is killed afterwards. A
+// nil Journal records nothing.
+func (j *Journal) Record(t time.Time, source, name, addr, session string, data []byte) {
+	if j == nil {
+		return
+	}
+	line, err := json.Marshal(Entry{
+		Time:    t,
+		Source:  source,
+		Name:    name,
+		Addr:    addr,
+		Session: session,
+		Data:    hex.EncodeToString(data),
+	})
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return
+	}
+	if j.size > 0 && j.size+int64(len(line)) > j.maxBytes {
+		j.rotate(t)
+	}
+	n, err := j.file.Write(line)
+	j.size += int64(n)
+	switch {
+	case err != nil && !j.failed:
+		j.failed = true
+		j.logger.Error("Failed to write to journal %s: %v", j.path, err)
+	case err == nil && j.failed:
+		j.failed = false
+		j.logger.Info("Writing to journal %s again", j.path)
+	}
+}
+
+// rotate renames the current file with the time of t and starts a new
+// one. On failure, writing goes on to the current file.
+func (j *Journal) rotate(t time.Time) {
+	rotated := j.path + "." + t.Format(rotatedLayout)
+	if err := os.Rename(j.path, rotated); err != nil {
+		if !j.stuck {
+			j.stuck = true
+			j.logger.Warn("Failed to rotate journal %s: %v", j.path, err)
+		}
+		return
+	}
+	j.stuck = false
+	j.file.Close()
+	if err := j.open(); err != nil {
+		j.file = nil
+		j.logger.Error("Failed to reopen journal %s: %v", j.path, err)
+		return
+	}
+	j.prune()
+}
+
+// prune removes the rotated files beyond the keep most recent
+func (j *Journal) prune() {
+	if j.keep == 0 {
+		return
+	}
+	rotated := Rotated(j.path)
+	for _, name := range rotated[:max(len(rotated)-j.keep, 0)] {
+		if err := os.Remove(name); err != nil {
+			j.logger.Warn("Failed to remove rotated journal %s: %v", name, err)
+		}
+	}
+}
+
+// Rotated returns the files rotated from the journal at path, oldest first
+func Rotated(path string) []string {
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	prefix := filepath.Base(path) + "."
+	var rotated []string
+	for _, e := range entries {
+		stamp, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(rotatedLayout, stamp); err == nil {
+			rotated = append(rotated, filepath.Join(filepath.Dir(path), e.Name()))
+		}
+	}
+	sort.Strings(rotated)
+	return rotated
+}
+
+// Close syncs and closes the file. A nil Journal is ignored.
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Sync()
+	if cerr := j.file.Close(); err == nil {
+		err = cerr
+	}
+	j.file = nil
+	return err
+}
@@ -0,0 +1,111 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+)
+
+func newTestLogger() *logger.Logger {
+	log, _ := logger.New(false, "")
+	log.SetOutput(io.Discard)
+	return log
+}
+
+func readEntries(t *testing.T, path string) []Entry {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Invalid line %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestJournal_Record(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "writes.jsonl")
+	j, err := Open(path, 1<<20, 0, newTestLogger())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	at := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	j.Record(at, "client#1", "controller", "192.168.1.20:51234", "7f3a9c01", []byte{0xf7, 0x0e})
+	j.Record(at, SourceInject, "", "", "", []byte{0x01})
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// Reopening appends
+	j, err = Open(path, 1<<20, 0, newTestLogger())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	j.Record(at, SourcePoll, "", "", "", []byte{0x02})
+	_ = j.Close()
+
+	entries := readEntries(t, path)
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %+v", entries)
+	}
+	want := Entry{Time: at, Source: "client#1", Name: "controller", Addr: "192.168.1.20:51234", Session: "7f3a9c01", Data: "f70e"}
+	if entries[0] != want {
+		t.Errorf("Expected %+v, got %+v", want, entries[0])
+	}
+	if entries[1].Source != SourceInject || entries[2].Source != SourcePoll || entries[2].Data != "02" {
+		t.Errorf("Unexpected entries %+v", entries[1:])
+	}
+
+	var none *Journal
+	none.Record(at, "client#1", "", "", "", []byte{0x01})
+	if err := none.Close(); err != nil {
+		t.Errorf("Close of a nil journal failed: %v", err)
+	}
+}
+
+func TestJournal_Rotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "writes.jsonl")
+	j, err := Open(path, 200, 2, newTestLogger())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer j.Close()
+
+	// Each entry is about 80 bytes, so every other one rotates the file
+	at := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		j.Record(at.Add(time.Duration(i)*time.Second), "client#1", "", "", "", []byte{byte(i)})
+	}
+
+	rotated := Rotated(path)
+	if len(rotated) != 2 {
+		t.Fatalf("Expected the 2 most recent rotated files, got %v", rotated)
+	}
+	last := readEntries(t, rotated[1])
+	current := readEntries(t, path)
+	if len(current) == 0 || len(last) == 0 || last[len(last)-1].Data >= current[0].Data {
+		t.Errorf("Expected the rotated file to hold the entries before the current one, got %+v and %+v", last, current)
+	}
+	if current[len(current)-1].Data != "09" {
+		t.Errorf("Expected the last entry in the current file, got %+v", current)
+	}
+	for _, name := range rotated {
+		if info, err := os.Stat(name); err != nil || info.Size() > 200 {
+			t.Errorf("Expected %s within 200 bytes: %v", name, err)
+		}
+	}
+}
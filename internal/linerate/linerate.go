@@ -0,0 +1,213 @@
+// Package linerate estimates the data rate of the serial line behind an
+// upstream from the timing of the bytes it delivers, and points out
+// patterns that usually mean the baud rate does not match the device or the
+// line is noisy.
+package linerate
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/rfc2217"
+)
+
+const (
+	// burstGap is the pause between reads that ends a burst
+	burstGap = 20 * time.Millisecond
+	// maxBurst bounds a measured burst, so continuous streams are measured
+	// too
+	maxBurst = time.Second
+	// minBurstBytes is how many bytes a burst needs after its first read
+	// to be measured
+	minBurstBytes = 32
+	// keepBursts is how many recent bursts the estimate is the median of
+	keepBursts = 16
+	// minBursts is how many bursts are measured before the rate is
+	// compared with the baud rate
+	minBursts = 3
+	// minScanBytes is how many bytes are seen before their values are
+	// judged
+	minScanBytes = 1024
+	// minErrors is how many line errors of a kind give a hint
+	minErrors = 3
+)
+
+// Hint codes
+const (
+	HintFasterThanBaud = "faster_than_baud" // data arrives faster than the line's baud rate allows
+	HintFramingErrors  = "framing_errors"   // the device server reports framing errors
+	HintLineNoise      = "line_noise"       // the device server reports parity errors or breaks
+	HintGarbage        = "garbage_bytes"    // byte values typical of a receiver at the wrong baud rate
+)
+
+// standardBauds are the rates MinBaud picks from
+var standardBauds = []int{300, 600, 1200, 2400, 4800, 9600, 14400, 19200, 38400, 57600, 115200, 230400, 460800, 921600}
+
+// suspectBytes are what a receiver at the wrong baud rate mostly decodes:
+// a few long runs of equal bits per character
+var suspectBytes = func() [256]bool {
+	var t [256]bool
+	for _, b := range []byte{0x80, 0xC0, 0xE0, 0xF0, 0xF8, 0xFC, 0xFE, 0xFF} {
+		t[b] = true
+	}
+	return t
+}()
+
+// Line is what is known about the serial line, e.g. from RFC 2217
+type Line struct {
+	Baud     int                 // 0 if unknown
+	CharBits float64             // bits per character, 0 for 8N1
+	Errors   *rfc2217.LineErrors // nil if not reported
+}
+
+// Hint is a likely problem with the line
+type Hint struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Report is the estimate for one upstream
+type Report struct {
+	BytesPerSecond float64             `json:"bytes_per_second"`   // median over recent bursts, 0 until measured
+	BitsPerSecond  int                 `json:"bits_per_second"`    // BytesPerSecond in line bits
+	MinBaud        int                 `json:"min_baud,omitempty"` // lowest standard baud rate carrying BitsPerSecond
+	ConfiguredBaud int                 `json:"configured_baud,omitempty"`
+	Bursts         int                 `json:"bursts"` // bursts the estimate is based on
+	Bytes          uint64              `json:"bytes"`  // bytes seen since the upstream connected
+	LineErrors     *rfc2217.LineErrors `json:"line_errors,omitempty"`
+	Hints          []Hint              `json:"hints,omitempty"`
+}
+
+// Estimator measures the bursts of data read from one upstream. The data
+// rate of a burst is the bytes after its first read divided by the time to
+// its last read, since the first read's bytes arrived before it started.
+type Estimator struct {
+	mu      sync.Mutex
+	start   time.Time // first read of the current burst
+	last    time.Time // latest read of the current burst
+	pending int       // bytes in the current burst after its first read
+	reads   int       // reads in the current burst
+	rates   []float64 // bytes per second of recent bursts, a ring
+	next    int
+	bytes   uint64
+	suspect uint64
+}
+
+// NewEstimator returns an empty estimator
+func NewEstimator() *Estimator {
+	return &Estimator{}
+}
+
+// Observe records one read of data at t
+func (e *Estimator) Observe(t time.Time, data []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.bytes += uint64(len(data))
+	for _, b := range data {
+		if suspectBytes[b] {
+			e.suspect++
+		}
+	}
+
+	if e.reads > 0 && t.Sub(e.last) <= burstGap {
+		e.pending += len(data)
+		e.reads++
+		e.last = t
+		if t.Sub(e.start) < maxBurst {
+			return
+		}
+		// Measure a long burst and go on with a new one from here
+		e.endBurst()
+		e.start, e.last, e.reads = t, t, 1
+		return
+	}
+	e.endBurst()
+	e.start, e.last, e.reads = t, t, 1
+}
+
+// endBurst measures the current burst if it is long enough
+func (e *Estimator) endBurst() {
+	if e.reads >= 3 && e.pending >= minBurstBytes {
+		if d := e.last.Sub(e.start); d > 0 {
+			rate := float64(e.pending) / d.Seconds()
+			if len(e.rates) < keepBursts {
+				e.rates = append(e.rates, rate)
+			} else {
+				e.rates[e.next] = rate
+				e.next = (e.next + 1) % keepBursts
+			}
+		}
+	}
+	e.pending, e.reads = 0, 0
+}
+
+// Reset forgets what was measured, e.g. when the upstream reconnects to a
+// device that may use other settings
+func (e *Estimator) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.pending, e.reads = 0, 0
+	e.rates, e.next = nil, 0
+	e.bytes, e.suspect = 0, 0
+}
+
+// Report returns the estimate at now and the hints it and line give
+func (e *Estimator) Report(line Line, now time.Time) Report {
+	e.mu.Lock()
+	if e.reads > 0 && now.Sub(e.last) > burstGap {
+		e.endBurst()
+	}
+	rates := append([]float64(nil), e.rates...)
+	r := Report{Bytes: e.bytes, Bursts: len(rates), ConfiguredBaud: line.Baud, LineErrors: line.Errors}
+	suspect := e.suspect
+	e.mu.Unlock()
+
+	charBits := line.CharBits
+	if charBits == 0 {
+		charBits = 10
+	}
+	if len(rates) > 0 {
+		sort.Float64s(rates)
+		r.BytesPerSecond = rates[len(rates)/2]
+		r.BitsPerSecond = int(r.BytesPerSecond * charBits)
+		r.MinBaud = minBaud(r.BitsPerSecond)
+	}
+
+	if line.Baud > 0 && r.Bursts >= minBursts && float64(r.BitsPerSecond) > 1.25*float64(line.Baud) {
+		r.Hints = append(r.Hints, Hint{HintFasterThanBaud, fmt.Sprintf(
+			"Data arrives at about %d bit/s, more than the %d baud set for the line; the device probably uses a higher baud rate",
+			r.BitsPerSecond, line.Baud)})
+	}
+	if errs := line.Errors; errs != nil {
+		if errs.Framing >= minErrors {
+			r.Hints = append(r.Hints, Hint{HintFramingErrors, fmt.Sprintf(
+				"The device server reported %d framing errors; the baud rate or framing probably does not match the device",
+				errs.Framing)})
+		}
+		if errs.Parity+errs.Break >= minErrors {
+			r.Hints = append(r.Hints, Hint{HintLineNoise, fmt.Sprintf(
+				"The device server reported %d parity errors and %d breaks; check the parity setting, wiring and termination",
+				errs.Parity, errs.Break)})
+		}
+	}
+	if r.Bytes >= minScanBytes && suspect*2 >= r.Bytes {
+		r.Hints = append(r.Hints, Hint{HintGarbage, fmt.Sprintf(
+			"%d%% of the bytes received are 0x80, 0xC0, 0xE0, 0xF0, 0xF8, 0xFC, 0xFE or 0xFF, as decoded by a receiver at the wrong baud rate",
+			suspect*100/r.Bytes)})
+	}
+	return r
+}
+
+// minBaud returns the lowest standard baud rate carrying bits per second,
+// or 0 if none does
+func minBaud(bits int) int {
+	for _, baud := range standardBauds {
+		if baud >= bits {
+			return baud
+		}
+	}
+	return 0
+}
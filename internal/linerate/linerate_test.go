@@ -0,0 +1,102 @@
+package linerate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/rfc2217"
+)
+
+var start = time.Unix(1700000000, 0)
+
+// feed observes bursts of reads of size bytes every interval, with a
+// second between bursts
+func feed(e *Estimator, bursts, reads, size int, interval time.Duration, b byte) time.Time {
+	t := start
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = b
+	}
+	for i := 0; i < bursts; i++ {
+		for j := 0; j < reads; j++ {
+			e.Observe(t, data)
+			t = t.Add(interval)
+		}
+		t = t.Add(time.Second)
+	}
+	return t
+}
+
+func hintCodes(r Report) []string {
+	var codes []string
+	for _, h := range r.Hints {
+		codes = append(codes, h.Code)
+	}
+	return codes
+}
+
+func TestEstimator_Rate(t *testing.T) {
+	e := NewEstimator()
+	// 16 bytes every 10ms is 1600 bytes/s, 16000 bit/s at 8N1
+	now := feed(e, 4, 10, 16, 10*time.Millisecond, 0x01)
+
+	r := e.Report(Line{Baud: 19200}, now)
+	if r.Bursts != 4 || r.BytesPerSecond != 1600 || r.BitsPerSecond != 16000 || r.MinBaud != 19200 {
+		t.Errorf("Unexpected report %+v", r)
+	}
+	if len(r.Hints) != 0 {
+		t.Errorf("Expected no hints, got %v", hintCodes(r))
+	}
+
+	r = e.Report(Line{Baud: 9600}, now)
+	if codes := hintCodes(r); len(codes) != 1 || codes[0] != HintFasterThanBaud {
+		t.Errorf("Expected %s, got %v", HintFasterThanBaud, codes)
+	}
+
+	e.Reset()
+	if r := e.Report(Line{}, now); r.Bursts != 0 || r.Bytes != 0 || r.BytesPerSecond != 0 {
+		t.Errorf("Expected an empty report after Reset, got %+v", r)
+	}
+}
+
+func TestEstimator_ShortBurstsIgnored(t *testing.T) {
+	e := NewEstimator()
+	// Two reads per burst, as for short request/response exchanges
+	now := feed(e, 10, 2, 64, 5*time.Millisecond, 0x01)
+	if r := e.Report(Line{Baud: 300}, now); r.Bursts != 0 || len(r.Hints) != 0 {
+		t.Errorf("Expected no measured bursts, got %+v", r)
+	}
+}
+
+func TestEstimator_ContinuousStream(t *testing.T) {
+	e := NewEstimator()
+	// One endless burst is measured a second at a time
+	t0 := start
+	for i := 0; i < 350; i++ {
+		e.Observe(t0, make([]byte, 10))
+		t0 = t0.Add(10 * time.Millisecond)
+	}
+	if r := e.Report(Line{}, t0); r.Bursts != 3 || r.BytesPerSecond != 1000 {
+		t.Errorf("Expected 3 bursts at 1000 bytes/s, got %+v", r)
+	}
+}
+
+func TestEstimator_LineErrorsAndGarbage(t *testing.T) {
+	e := NewEstimator()
+	now := feed(e, 1, 20, 64, 50*time.Millisecond, 0xF8)
+
+	r := e.Report(Line{Errors: &rfc2217.LineErrors{Framing: 5, Parity: 2, Break: 1}}, now)
+	codes := hintCodes(r)
+	want := []string{HintFramingErrors, HintLineNoise, HintGarbage}
+	if len(codes) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, codes)
+	}
+	for i := range want {
+		if codes[i] != want[i] {
+			t.Errorf("Expected %v, got %v", want, codes)
+		}
+	}
+	if r.LineErrors == nil || r.LineErrors.Framing != 5 {
+		t.Errorf("Expected the line errors in the report, got %+v", r.LineErrors)
+	}
+}
@@ -2,12 +2,20 @@ package logger
 
 import (
 	"bufio"
+	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/bufpool"
 )
 
 type LogLevel string
@@ -19,86 +27,438 @@ const (
 	LogPkt   LogLevel = "PKT"
 )
 
+// levelRanks orders the levels for SetLevel. Packets are not ranked
+// against the others; they are switched with SetPacketLogging.
+var levelRanks = map[LogLevel]int{
+	LogInfo:  0,
+	LogWarn:  1,
+	LogError: 2,
+}
+
+// ErrNoLogFile is returned by SetFileLogging without a log file path
+var ErrNoLogFile = errors.New("no log file configured")
+
+// QueueSize is the number of entries waiting for the writer goroutine.
+// Packets logged while the queue is full are dropped and counted; other
+// log lines wait for room.
+const QueueSize = 4096
+
+// entry is a log line or packet waiting to be formatted and written
+type entry struct {
+	at        time.Time
+	level     LogLevel
+	msg       string
+	direction string // packets only
+	data      []byte
+	frame     *bufpool.Frame // holds data when set, released once written
+	source    string
+	fields    string
+	subsystem string
+	flushed   chan struct{} // set for Flush markers
+	seq       uint64        // packet number in its direction, 0 if not numbered
+	offset    uint64        // bytes before this packet in its direction
+}
+
+// streamPos is how far a packet direction has got
+type streamPos struct {
+	packets uint64
+	bytes   uint64
+}
+
+// Entry is a written log line together with its parts, as passed to the
+// callback set with SetEntryCallback
+type Entry struct {
+	Time      time.Time
+	Level     LogLevel
+	Subsystem string            // set with Named, empty for the root logger
+	Message   string            // the line without timestamp, level and fields
+	Fields    map[string]string // key=value pairs appended to the line
+	Line      string            // the full text line
+
+	// Set for packet entries (LogPkt). Data is only valid during the
+	// callback; copy it to keep it.
+	Direction string // "UP->" or "->UP"
+	Source    string
+	Data      []byte
+	Seq       uint64 // packet number in its direction from 1, 0 without SetPacketOffsets
+	Offset    uint64 // bytes logged in the same direction before this packet
+}
+
 type Logger struct {
-	mu          sync.Mutex
+	mu          sync.Mutex // guards the writers, callback and delta state
 	stdWriter   io.Writer
 	fileWriter  *bufio.Writer
 	file        *os.File
-	logPackets  bool
-	flushTicker *time.Ticker
+	logPackets  atomic.Bool // packet lines to stdout and the log file
+	filePath    string      // LOG_FILE, "" without one
+	minLevel    int         // rank of the lowest level written to stdout
+	closed      bool
 	done        chan struct{}
-	logCallback func(string)
+	closeOnce   sync.Once
+	logCallback func(Entry)
+	hasCallback atomic.Bool // lets LogPacket skip work without taking mu
+	filter      PacketFilter
+	deltas      bool                 // append dt= to packet lines
+	lastPacket  map[string]time.Time // per direction, for deltas
+	offsets     atomic.Bool          // add seq= and off= to packet lines
+	posMu       sync.Mutex           // guards pos
+	pos         map[string]streamPos // per direction, for offsets
+	entries     chan entry           // nil writes synchronously
+	stopped     chan struct{}        // closed when the writer goroutine exits
+	dropped     atomic.Uint64
+	root        *Logger // shared state for loggers created by With
+	fields      string  // " key=value" pairs appended to every line
+	subsystem   string
+}
+
+// base returns the logger owning the writers and callback
+func (l *Logger) base() *Logger {
+	if l.root != nil {
+		return l.root
+	}
+	return l
+}
+
+// With returns a logger that appends key=value to every line it writes,
+// so related lines (e.g. one client session) can be filtered together. The
+// returned logger shares its output with l.
+func (l *Logger) With(key, value string) *Logger {
+	return &Logger{
+		root:      l.base(),
+		fields:    l.fields + " " + key + "=" + value,
+		subsystem: l.subsystem,
+	}
+}
+
+// Named returns a logger whose entries are attributed to a subsystem (e.g.
+// "upstream", "web"). The name is reported to SetEntryCallback and is not
+// part of the text line.
+func (l *Logger) Named(subsystem string) *Logger {
+	return &Logger{
+		root:      l.base(),
+		fields:    l.fields,
+		subsystem: subsystem,
+	}
+}
+
+// PacketFilter limits which packets are written to stdout and the log file.
+// Empty lists match everything; the log callback always receives every
+// packet.
+type PacketFilter struct {
+	Directions []string // e.g. "->UP", "UP->"
+	Sources    []string // path.Match patterns, e.g. "client#3", "client#*", "INJECT"
 }
 
+// Allows reports whether a packet with the given direction and source passes
+// the filter
+func (f PacketFilter) Allows(direction, source string) bool {
+	if len(f.Directions) > 0 && !contains(f.Directions, direction) {
+		return false
+	}
+	if len(f.Sources) == 0 {
+		return true
+	}
+	for _, pattern := range f.Sources {
+		if ok, _ := path.Match(pattern, source); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// directionLabels maps the direction names used in configuration and APIs
+// to the labels in packet lines
+var directionLabels = map[string]string{
+	"from_upstream": "UP->",
+	"to_upstream":   "->UP",
+}
+
+// DirectionLabel returns the packet line label for a direction name
+// ("from_upstream" or "to_upstream")
+func DirectionLabel(name string) (string, bool) {
+	label, ok := directionLabels[name]
+	return label, ok
+}
+
+// ParsePacketLine extracts the direction label and source from a line
+// written by LogPacket. ok is false for other lines.
+func ParsePacketLine(line string) (direction, source string, ok bool) {
+	_, rest, found := strings.Cut(line, " ["+string(LogPkt)+"] [")
+	if !found {
+		return "", "", false
+	}
+	direction, rest, found = strings.Cut(rest, "]")
+	if !found {
+		return "", "", false
+	}
+	if _, after, found := strings.Cut(rest, " bytes) from "); found {
+		source, _, _ = strings.Cut(strings.TrimRight(after, "\n"), " ")
+	}
+	return direction, source, true
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// NewSessionID returns a random identifier for correlating log lines
+func NewSessionID() string {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// New returns a logger whose lines are formatted and written by a
+// background goroutine, so callers never wait on stdout, the log file or
+// the log callback.
 func New(logPackets bool, logFile string) (*Logger, error) {
 	l := &Logger{
-		stdWriter:  os.Stdout,
-		logPackets: logPackets,
-		done:       make(chan struct{}),
+		stdWriter: os.Stdout,
+		filePath:  logFile,
+		done:      make(chan struct{}),
+		entries:   make(chan entry, QueueSize),
+		stopped:   make(chan struct{}),
 	}
 
+	l.logPackets.Store(logPackets)
+
 	if logPackets && logFile != "" {
-		file, err := os.OpenFile(logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-		if err != nil {
+		if err := l.openFile(); err != nil {
 			l.Warn("Failed to open log file %s: %v, packet logging to file disabled", logFile, err)
-		} else {
-			l.file = file
-			l.fileWriter = bufio.NewWriterSize(file, 4096)
-
-			// Start periodic flush
-			l.flushTicker = time.NewTicker(time.Second)
-			go l.flushLoop()
 		}
 	}
 
+	go l.run()
 	return l, nil
 }
 
-func (l *Logger) flushLoop() {
+// run writes queued entries, flushes the log file every second and reports
+// packets dropped because the queue was full
+func (l *Logger) run() {
+	defer close(l.stopped)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var reported uint64
+
 	for {
 		select {
-		case <-l.flushTicker.C:
+		case e := <-l.entries:
+			l.write(e)
+		case <-ticker.C:
 			l.mu.Lock()
 			if l.fileWriter != nil {
 				l.fileWriter.Flush()
 			}
 			l.mu.Unlock()
+			if n := l.dropped.Load(); n != reported {
+				l.write(entry{at: time.Now(), level: LogWarn,
+					msg: fmt.Sprintf("Log queue full, dropped %d packet entries", n-reported)})
+				reported = n
+			}
 		case <-l.done:
-			return
+			for {
+				select {
+				case e := <-l.entries:
+					l.write(e)
+				default:
+					return
+				}
+			}
 		}
 	}
 }
 
-func (l *Logger) Close() {
-	if l.flushTicker != nil {
-		l.flushTicker.Stop()
-		close(l.done)
+// enqueue hands e to the writer goroutine. Packets are dropped when the
+// queue is full unless wait is set.
+func (l *Logger) enqueue(e entry, wait bool) {
+	if l.entries == nil {
+		l.write(e)
+		return
 	}
+	select {
+	case <-l.stopped:
+		l.write(e)
+		return
+	default:
+	}
+	select {
+	case l.entries <- e:
+		return
+	default:
+	}
+	if !wait {
+		l.dropped.Add(1)
+		if e.frame != nil {
+			e.frame.Release()
+		}
+		return
+	}
+	select {
+	case l.entries <- e:
+	case <-l.stopped:
+		l.write(e)
+	}
+}
 
+// Flush waits until every entry queued so far has been written and the log
+// file buffer is flushed
+func (l *Logger) Flush() {
+	l = l.base()
+	if l.entries == nil {
+		return
+	}
+	e := entry{flushed: make(chan struct{})}
+	select {
+	case l.entries <- e:
+	case <-l.stopped:
+		return
+	}
+	select {
+	case <-e.flushed:
+	case <-l.stopped:
+	}
+}
+
+// TruncateFile empties the packet log file, keeping it open, and returns
+// how many bytes it held. Packets still queued are written to the emptied
+// file. A log file turned off with SetFileLogging is emptied too.
+func (l *Logger) TruncateFile() (int64, error) {
+	l = l.base()
 	l.mu.Lock()
 	defer l.mu.Unlock()
-
-	if l.fileWriter != nil {
-		l.fileWriter.Flush()
+	if l.file == nil {
+		if l.filePath == "" {
+			return 0, nil
+		}
+		info, err := os.Stat(l.filePath)
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+		return info.Size(), os.Truncate(l.filePath, 0)
+	}
+	if err := l.fileWriter.Flush(); err != nil {
+		return 0, err
 	}
-	if l.file != nil {
-		l.file.Close()
+	info, err := l.file.Stat()
+	if err != nil {
+		return 0, err
 	}
+	return info.Size(), l.file.Truncate(0)
 }
 
-func (l *Logger) log(level LogLevel, format string, args ...interface{}) {
-	timestamp := time.Now().Format(time.RFC3339Nano)
-	msg := fmt.Sprintf(format, args...)
-	line := fmt.Sprintf("%s [%s] %s\n", timestamp, level, msg)
+// Dropped returns the number of packets not logged because the queue was
+// full
+func (l *Logger) Dropped() uint64 {
+	return l.base().dropped.Load()
+}
+
+// Pending returns the number of entries waiting to be written
+func (l *Logger) Pending() int {
+	return len(l.base().entries)
+}
+
+// Close writes the remaining entries and closes the log file. Later calls
+// do nothing, so every owner of a shared logger may close it.
+func (l *Logger) Close() {
+	l = l.base()
+	l.closeOnce.Do(func() {
+		if l.entries != nil {
+			close(l.done)
+			<-l.stopped
+		}
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		_ = l.closeFile()
+		l.closed = true
+	})
+}
+
+// write formats e and delivers it to the outputs and the callback
+func (l *Logger) write(e entry) {
+	if e.flushed != nil {
+		l.mu.Lock()
+		if l.fileWriter != nil {
+			l.fileWriter.Flush()
+		}
+		l.mu.Unlock()
+		close(e.flushed)
+		return
+	}
 
 	l.mu.Lock()
-	defer l.mu.Unlock()
+	msg, fields := e.msg, e.fields
+	output := true
+	if e.level == LogPkt {
+		msg, fields = l.formatPacket(e)
+		if e.frame != nil {
+			defer e.frame.Release()
+		}
+		output = l.logPackets.Load() && l.filter.Allows(e.direction, e.source)
+	} else {
+		output = levelRanks[e.level] >= l.minLevel
+	}
+	line := fmt.Sprintf("%s [%s] %s%s\n", e.at.Format(time.RFC3339Nano), e.level, msg, fields)
+
+	if output {
+		fmt.Fprint(l.stdWriter, line)
+		if e.level == LogPkt && l.fileWriter != nil {
+			_, _ = l.fileWriter.WriteString(line)
+		}
+	}
+	callback := l.logCallback
+	l.mu.Unlock()
 
-	fmt.Fprint(l.stdWriter, line)
+	// Call callback outside of lock to prevent deadlock
+	if callback != nil {
+		callback(Entry{
+			Time:      e.at,
+			Level:     e.level,
+			Subsystem: e.subsystem,
+			Message:   msg,
+			Fields:    parseFields(fields),
+			Line:      line,
+			Direction: e.direction,
+			Source:    e.source,
+			Data:      e.data,
+			Seq:       e.seq,
+			Offset:    e.offset,
+		})
+	}
+}
 
-	if l.logCallback != nil {
-		l.logCallback(line)
+// parseFields splits " key=value" pairs
+func parseFields(fields string) map[string]string {
+	if fields == "" {
+		return nil
+	}
+	m := make(map[string]string)
+	for _, f := range strings.Fields(fields) {
+		if key, value, ok := strings.Cut(f, "="); ok {
+			m[key] = value
+		}
 	}
+	return m
+}
+
+func (l *Logger) log(level LogLevel, format string, args ...interface{}) {
+	e := entry{
+		at:        time.Now(),
+		level:     level,
+		msg:       fmt.Sprintf(format, args...),
+		fields:    l.fields,
+		subsystem: l.subsystem,
+	}
+	l.base().enqueue(e, true)
 }
 
 func (l *Logger) Info(format string, args ...interface{}) {
@@ -113,70 +473,254 @@ func (l *Logger) Error(format string, args ...interface{}) {
 	l.log(LogError, format, args...)
 }
 
+// LogPacket queues a packet line. It copies data and returns without
+// formatting or waiting for output; if the queue is full the packet is
+// dropped from the log and counted.
 func (l *Logger) LogPacket(direction string, data []byte, source string) {
+	l.logPacket(direction, data, nil, source)
+}
+
+// LogPacketFrame logs data held in f like LogPacket, keeping a reference to
+// f until the line is written instead of copying data
+func (l *Logger) LogPacketFrame(direction string, f *bufpool.Frame, data []byte, source string) {
+	l.logPacket(direction, data, f, source)
+}
+
+func (l *Logger) logPacket(direction string, data []byte, f *bufpool.Frame, source string) {
+	fields, subsystem := l.fields, l.subsystem
+	l = l.base()
+
+	// Packets are numbered before anything can drop them, so a gap in seq=
+	// shows a packet missing from the log rather than from the stream
+	var seq, offset uint64
+	if l.offsets.Load() {
+		seq, offset = l.advance(direction, len(data))
+	}
+
 	// If neither packet logging nor callback is enabled, return early
-	if !l.logPackets && l.logCallback == nil {
+	if !l.logPackets.Load() && !l.hasCallback.Load() {
 		return
 	}
 
-	timestamp := time.Now().Format(time.RFC3339Nano)
-	hexStr := hex.EncodeToString(data)
+	if f != nil {
+		f.Retain()
+	} else {
+		data = append([]byte(nil), data...)
+	}
+	l.enqueue(entry{
+		at:        time.Now(),
+		level:     LogPkt,
+		direction: direction,
+		data:      data,
+		frame:     f,
+		source:    source,
+		fields:    fields,
+		subsystem: subsystem,
+		seq:       seq,
+		offset:    offset,
+	}, false)
+}
+
+// advance counts a packet of n bytes in direction and returns its number
+// and the bytes before it
+func (l *Logger) advance(direction string, n int) (seq, offset uint64) {
+	l.posMu.Lock()
+	defer l.posMu.Unlock()
+	if l.pos == nil {
+		l.pos = make(map[string]streamPos)
+	}
+	p := l.pos[direction]
+	seq, offset = p.packets+1, p.bytes
+	l.pos[direction] = streamPos{packets: seq, bytes: p.bytes + uint64(n)}
+	return seq, offset
+}
+
+// formatPacket renders the message and fields of a packet line. Called
+// with mu held.
+func (l *Logger) formatPacket(e entry) (msg, fields string) {
+	hexStr := hex.EncodeToString(e.data)
 
 	// Format hex with spaces
-	var formattedHex string
-	for i := 0; i < len(hexStr); i += 2 {
+	var formattedHex strings.Builder
+	for i := 0; i+2 <= len(hexStr); i += 2 {
 		if i > 0 {
-			formattedHex += " "
+			formattedHex.WriteByte(' ')
+		}
+		formattedHex.WriteString(hexStr[i : i+2])
+	}
+
+	fields = e.fields
+	if l.deltas {
+		if last, ok := l.lastPacket[e.direction]; ok {
+			fields = " dt=" + max(e.at.Sub(last), 0).Round(time.Microsecond).String() + fields
 		}
-		if i+2 <= len(hexStr) {
-			formattedHex += hexStr[i : i+2]
+		if l.lastPacket == nil {
+			l.lastPacket = make(map[string]time.Time)
 		}
+		l.lastPacket[e.direction] = e.at
+	}
+	if e.seq > 0 {
+		fields = " seq=" + strconv.FormatUint(e.seq, 10) + " off=" + strconv.FormatUint(e.offset, 10) + fields
 	}
 
-	var line string
-	if source != "" {
-		line = fmt.Sprintf("%s [%s] [%s] %s (%d bytes) from %s\n",
-			timestamp, LogPkt, direction, formattedHex, len(data), source)
-	} else {
-		line = fmt.Sprintf("%s [%s] [%s] %s (%d bytes)\n",
-			timestamp, LogPkt, direction, formattedHex, len(data))
+	msg = fmt.Sprintf("[%s] %s (%d bytes)", e.direction, formattedHex.String(), len(e.data))
+	if e.source != "" {
+		msg += " from " + e.source
 	}
+	return msg, fields
+}
 
-	// Get callback reference while holding lock
+// SetOutput sets the output writer (for testing)
+func (l *Logger) SetOutput(w io.Writer) {
+	l = l.base()
 	l.mu.Lock()
-	callback := l.logCallback
+	defer l.mu.Unlock()
+	l.stdWriter = w
+}
 
-	// Only write to stdout/file if enabled
-	if l.logPackets {
-		fmt.Fprint(l.stdWriter, line)
+// IsPacketLoggingEnabled returns whether packet logging is enabled
+func (l *Logger) IsPacketLoggingEnabled() bool {
+	return l.base().logPackets.Load()
+}
 
-		if l.fileWriter != nil {
-			_, _ = l.fileWriter.WriteString(line)
+// SetPacketLogging turns packet lines on stdout and in the log file on or
+// off. The entry callback receives packets either way.
+func (l *Logger) SetPacketLogging(enabled bool) {
+	l.base().logPackets.Store(enabled)
+}
+
+// IsFileLoggingEnabled returns whether the log file is open
+func (l *Logger) IsFileLoggingEnabled() bool {
+	l = l.base()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file != nil
+}
+
+// SetFileLogging opens or closes the log file given to New. Packet lines
+// are only written to it while packet logging is enabled.
+func (l *Logger) SetFileLogging(enabled bool) error {
+	l = l.base()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !enabled {
+		return l.closeFile()
+	}
+	if l.filePath == "" {
+		return ErrNoLogFile
+	}
+	if l.closed || l.file != nil {
+		return nil
+	}
+	return l.openFile()
+}
+
+// openFile opens the log file for appending. Called with mu held or before
+// the logger is shared.
+func (l *Logger) openFile() error {
+	file, err := os.OpenFile(l.filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.fileWriter = bufio.NewWriterSize(file, 4096)
+	return nil
+}
+
+// closeFile flushes and closes the log file. Called with mu held.
+func (l *Logger) closeFile() error {
+	if l.file == nil {
+		return nil
+	}
+	err := l.fileWriter.Flush()
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	l.file, l.fileWriter = nil, nil
+	return err
+}
+
+// Level returns the lowest level of lines written to stdout
+func (l *Logger) Level() LogLevel {
+	l = l.base()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for level, rank := range levelRanks {
+		if rank == l.minLevel {
+			return level
 		}
 	}
-	l.mu.Unlock()
+	return LogInfo
+}
 
-	// Call callback outside of lock to prevent deadlock
-	if callback != nil {
-		callback(line)
+// ParseLevel returns the level named by s: info, warn or error, in any case
+func ParseLevel(s string) (LogLevel, error) {
+	level := LogLevel(strings.ToUpper(s))
+	if _, ok := levelRanks[level]; !ok {
+		return "", fmt.Errorf("invalid log level %q", s)
 	}
+	return level, nil
 }
 
-// SetOutput sets the output writer (for testing)
-func (l *Logger) SetOutput(w io.Writer) {
+// SetLevel hides lines below level (INFO, WARN or ERROR) from stdout.
+// Packet lines are controlled by SetPacketLogging, and the entry callback
+// receives every line.
+func (l *Logger) SetLevel(level LogLevel) error {
+	rank, ok := levelRanks[level]
+	if !ok {
+		return fmt.Errorf("invalid log level %q", level)
+	}
+	l = l.base()
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	l.stdWriter = w
+	l.minLevel = rank
+	return nil
 }
 
-// IsPacketLoggingEnabled returns whether packet logging is enabled
-func (l *Logger) IsPacketLoggingEnabled() bool {
-	return l.logPackets
+// SetPacketFilter limits the packets written to stdout and the log file
+func (l *Logger) SetPacketFilter(f PacketFilter) {
+	l = l.base()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.filter = f
+}
+
+// SetPacketDeltas enables the dt= field on packet lines: the time since the
+// previous packet in the same direction
+func (l *Logger) SetPacketDeltas(enabled bool) {
+	l = l.base()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.deltas = enabled
+	l.lastPacket = nil
+}
+
+// SetPacketOffsets enables the seq= and off= fields on packet lines: the
+// packet's number and the bytes logged before it in the same direction.
+// Enabling it restarts both at zero.
+func (l *Logger) SetPacketOffsets(enabled bool) {
+	l = l.base()
+	l.posMu.Lock()
+	defer l.posMu.Unlock()
+	l.offsets.Store(enabled)
+	l.pos = nil
 }
 
 // SetLogCallback sets a callback function that receives all log entries
 func (l *Logger) SetLogCallback(cb func(string)) {
+	if cb == nil {
+		l.SetEntryCallback(nil)
+		return
+	}
+	l.SetEntryCallback(func(e Entry) { cb(e.Line) })
+}
+
+// SetEntryCallback sets a callback function that receives all log entries
+// with their parts. It replaces any callback set with SetLogCallback.
+func (l *Logger) SetEntryCallback(cb func(Entry)) {
+	l = l.base()
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	l.logCallback = cb
+	l.hasCallback.Store(cb != nil)
 }
@@ -2,9 +2,14 @@ package logger
 
 import (
 	"bytes"
+	"io"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/bufpool"
 )
 
 func TestNew_NoPacketLogging(t *testing.T) {
@@ -14,7 +19,7 @@ func TestNew_NoPacketLogging(t *testing.T) {
 	}
 	defer logger.Close()
 
-	if logger.logPackets != false {
+	if logger.logPackets.Load() {
 		t.Error("Expected logPackets=false")
 	}
 }
@@ -33,7 +38,7 @@ func TestNew_WithPacketLogging(t *testing.T) {
 	}
 	defer logger.Close()
 
-	if logger.logPackets != true {
+	if !logger.logPackets.Load() {
 		t.Error("Expected logPackets=true")
 	}
 
@@ -45,8 +50,7 @@ func TestNew_WithPacketLogging(t *testing.T) {
 func TestLogger_Info(t *testing.T) {
 	var buf bytes.Buffer
 	logger := &Logger{
-		stdWriter:  &buf,
-		logPackets: false,
+		stdWriter: &buf,
 	}
 
 	logger.Info("Test message %d", 123)
@@ -63,8 +67,7 @@ func TestLogger_Info(t *testing.T) {
 func TestLogger_Warn(t *testing.T) {
 	var buf bytes.Buffer
 	logger := &Logger{
-		stdWriter:  &buf,
-		logPackets: false,
+		stdWriter: &buf,
 	}
 
 	logger.Warn("Warning message")
@@ -78,8 +81,7 @@ func TestLogger_Warn(t *testing.T) {
 func TestLogger_Error(t *testing.T) {
 	var buf bytes.Buffer
 	logger := &Logger{
-		stdWriter:  &buf,
-		logPackets: false,
+		stdWriter: &buf,
 	}
 
 	logger.Error("Error message")
@@ -93,8 +95,7 @@ func TestLogger_Error(t *testing.T) {
 func TestLogger_LogPacket_Disabled(t *testing.T) {
 	var buf bytes.Buffer
 	logger := &Logger{
-		stdWriter:  &buf,
-		logPackets: false,
+		stdWriter: &buf,
 	}
 
 	logger.LogPacket("UP→", []byte{0xf7, 0x0e}, "")
@@ -107,9 +108,9 @@ func TestLogger_LogPacket_Disabled(t *testing.T) {
 func TestLogger_LogPacket_Enabled(t *testing.T) {
 	var buf bytes.Buffer
 	logger := &Logger{
-		stdWriter:  &buf,
-		logPackets: true,
+		stdWriter: &buf,
 	}
+	logger.SetPacketLogging(true)
 
 	logger.LogPacket("UP→", []byte{0xf7, 0x0e, 0x1f}, "")
 
@@ -131,9 +132,9 @@ func TestLogger_LogPacket_Enabled(t *testing.T) {
 func TestLogger_LogPacket_WithSource(t *testing.T) {
 	var buf bytes.Buffer
 	logger := &Logger{
-		stdWriter:  &buf,
-		logPackets: true,
+		stdWriter: &buf,
 	}
+	logger.SetPacketLogging(true)
 
 	logger.LogPacket("→UP", []byte{0xf7, 0x0e}, "client#1")
 
@@ -146,9 +147,9 @@ func TestLogger_LogPacket_WithSource(t *testing.T) {
 func TestLogger_LogPacket_HexFormat(t *testing.T) {
 	var buf bytes.Buffer
 	logger := &Logger{
-		stdWriter:  &buf,
-		logPackets: true,
+		stdWriter: &buf,
 	}
+	logger.SetPacketLogging(true)
 
 	logger.LogPacket("UP→", []byte{0x00, 0xff, 0xab, 0xcd}, "")
 
@@ -161,8 +162,7 @@ func TestLogger_LogPacket_HexFormat(t *testing.T) {
 func TestLogger_SetOutput(t *testing.T) {
 	var buf1, buf2 bytes.Buffer
 	logger := &Logger{
-		stdWriter:  &buf1,
-		logPackets: false,
+		stdWriter: &buf1,
 	}
 
 	logger.Info("First message")
@@ -178,13 +178,471 @@ func TestLogger_SetOutput(t *testing.T) {
 }
 
 func TestLogger_IsPacketLoggingEnabled(t *testing.T) {
-	logger := &Logger{logPackets: true}
+	logger := &Logger{}
+	logger.SetPacketLogging(true)
 	if !logger.IsPacketLoggingEnabled() {
 		t.Error("Expected IsPacketLoggingEnabled=true")
 	}
 
-	logger.logPackets = false
+	logger.SetPacketLogging(false)
 	if logger.IsPacketLoggingEnabled() {
 		t.Error("Expected IsPacketLoggingEnabled=false")
 	}
 }
+
+func TestLogger_With(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &Logger{
+		stdWriter: &buf,
+	}
+	logger.SetPacketLogging(true)
+	var lines []string
+	logger.SetLogCallback(func(line string) { lines = append(lines, line) })
+
+	session := logger.With("session", "ab12cd34").With("gen", "2")
+	session.Info("Connected")
+	session.LogPacket("->UP", []byte{0x01}, "client#1")
+	logger.Info("Unrelated")
+
+	output := buf.String()
+	if !strings.Contains(output, "Connected session=ab12cd34 gen=2\n") {
+		t.Errorf("Expected fields after the message, got: %s", output)
+	}
+	if !strings.Contains(output, "(1 bytes) from client#1 session=ab12cd34 gen=2\n") {
+		t.Errorf("Expected fields on the packet line, got: %s", output)
+	}
+	if strings.Contains(lines[2], "session=") {
+		t.Errorf("Expected parent logger lines without fields, got: %s", lines[2])
+	}
+	if len(lines) != 3 {
+		t.Errorf("Expected child lines to reach the parent callback, got %d lines", len(lines))
+	}
+}
+
+func TestLogger_EntryCallback(t *testing.T) {
+	logger := &Logger{stdWriter: io.Discard}
+	var entries []Entry
+	logger.SetEntryCallback(func(e Entry) { entries = append(entries, e) })
+
+	up := logger.Named("upstream").With("session", "ab12cd34")
+	up.Warn("Connection lost")
+	up.LogPacket("UP->", []byte{0xf7, 0x0e}, "")
+	logger.Info("Started")
+
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+	e := entries[0]
+	if e.Level != LogWarn || e.Subsystem != "upstream" || e.Message != "Connection lost" || e.Fields["session"] != "ab12cd34" {
+		t.Errorf("Unexpected entry: %+v", e)
+	}
+	if !strings.HasSuffix(e.Line, " [WARN] Connection lost session=ab12cd34\n") {
+		t.Errorf("Expected text line unchanged by Named, got %q", e.Line)
+	}
+	if e := entries[1]; e.Level != LogPkt || e.Message != "[UP->] f7 0e (2 bytes)" || e.Subsystem != "upstream" {
+		t.Errorf("Unexpected packet entry: %+v", e)
+	}
+	if e := entries[1]; e.Direction != "UP->" || !bytes.Equal(e.Data, []byte{0xf7, 0x0e}) {
+		t.Errorf("Expected packet direction and data, got %+v", e)
+	}
+	if e := entries[2]; e.Subsystem != "" || e.Fields != nil {
+		t.Errorf("Expected root entry without subsystem or fields, got %+v", e)
+	}
+}
+
+func TestNewSessionID(t *testing.T) {
+	a, b := NewSessionID(), NewSessionID()
+	if len(a) != 8 {
+		t.Errorf("Expected 8 hex characters, got %q", a)
+	}
+	if a == b {
+		t.Errorf("Expected distinct session IDs, got %q twice", a)
+	}
+}
+
+func TestLogger_PacketFilter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &Logger{
+		stdWriter: &buf,
+	}
+	logger.SetPacketLogging(true)
+	var lines []string
+	logger.SetLogCallback(func(line string) { lines = append(lines, line) })
+	logger.SetPacketFilter(PacketFilter{Directions: []string{"->UP"}, Sources: []string{"client#3"}})
+
+	logger.LogPacket("->UP", []byte{0x01}, "client#3")
+	logger.LogPacket("->UP", []byte{0x02}, "client#4")
+	logger.LogPacket("UP->", []byte{0x03}, "")
+	logger.With("session", "ab12cd34").LogPacket("->UP", []byte{0x04}, "client#3")
+
+	output := buf.String()
+	if n := strings.Count(output, "[PKT]"); n != 2 {
+		t.Errorf("Expected 2 packets written, got %d: %s", n, output)
+	}
+	if strings.Contains(output, "from client#4") || strings.Contains(output, "[UP->]") {
+		t.Errorf("Expected filtered packets to be omitted, got: %s", output)
+	}
+	if len(lines) != 4 {
+		t.Errorf("Expected callback to receive every packet, got %d", len(lines))
+	}
+}
+
+func TestPacketFilter_Allows(t *testing.T) {
+	tests := []struct {
+		filter    PacketFilter
+		direction string
+		source    string
+		want      bool
+	}{
+		{PacketFilter{}, "UP->", "", true},
+		{PacketFilter{Directions: []string{"UP->"}}, "UP->", "", true},
+		{PacketFilter{Directions: []string{"UP->"}}, "->UP", "client#1", false},
+		{PacketFilter{Sources: []string{"client#*"}}, "->UP", "client#12", true},
+		{PacketFilter{Sources: []string{"client#*"}}, "->UP", "INJECT", false},
+		{PacketFilter{Sources: []string{"INJECT", "POLL"}}, "->UP", "POLL", true},
+		{PacketFilter{Sources: []string{"client#*"}}, "UP->", "", false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.Allows(tt.direction, tt.source); got != tt.want {
+			t.Errorf("Allows(%q, %q) with %+v: expected %v, got %v", tt.direction, tt.source, tt.filter, tt.want, got)
+		}
+	}
+}
+
+func TestLogger_PacketDeltas(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &Logger{
+		stdWriter: &buf,
+	}
+	logger.SetPacketLogging(true)
+	logger.SetPacketDeltas(true)
+
+	logger.LogPacket("UP->", []byte{0x01}, "")
+	logger.LogPacket("->UP", []byte{0x02}, "client#1")
+	time.Sleep(5 * time.Millisecond)
+	logger.With("session", "ab12cd34").LogPacket("UP->", []byte{0x03}, "")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines, got %d", len(lines))
+	}
+	if strings.Contains(lines[0], "dt=") || strings.Contains(lines[1], "dt=") {
+		t.Errorf("Expected no delta on the first packet of each direction, got: %s", buf.String())
+	}
+	i := strings.Index(lines[2], "(1 bytes) dt=")
+	if i < 0 || !strings.HasSuffix(lines[2], " session=ab12cd34") {
+		t.Fatalf("Expected dt= before the session field, got: %s", lines[2])
+	}
+	dt, err := time.ParseDuration(strings.Fields(lines[2][i+len("(1 bytes) dt="):])[0])
+	if err != nil || dt < 5*time.Millisecond {
+		t.Errorf("Expected a delta of at least 5ms, got %v (%v)", dt, err)
+	}
+}
+
+func TestLogger_PacketOffsets(t *testing.T) {
+	var buf bytes.Buffer
+	var entries []Entry
+	logger := &Logger{
+		stdWriter: &buf,
+	}
+	logger.SetPacketLogging(true)
+	logger.SetPacketOffsets(true)
+	logger.SetEntryCallback(func(e Entry) { entries = append(entries, e) })
+
+	logger.LogPacket("UP->", []byte{0x01, 0x02, 0x03}, "")
+	logger.LogPacket("->UP", []byte{0x10}, "client#1")
+	logger.With("session", "ab12cd34").LogPacket("UP->", []byte{0x04, 0x05}, "")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines, got %d", len(lines))
+	}
+	if !strings.HasSuffix(lines[0], "(3 bytes) seq=1 off=0") || !strings.HasSuffix(lines[1], "from client#1 seq=1 off=0") {
+		t.Errorf("Expected each direction to start at seq=1 off=0, got: %s", buf.String())
+	}
+	if !strings.HasSuffix(lines[2], "(2 bytes) seq=2 off=3 session=ab12cd34") {
+		t.Errorf("Expected seq=2 off=3 before the session field, got: %s", lines[2])
+	}
+	if len(entries) != 3 || entries[2].Seq != 2 || entries[2].Offset != 3 || entries[2].Fields["off"] != "3" {
+		t.Errorf("Unexpected entries %+v", entries)
+	}
+
+	// Numbering continues over packets nobody receives
+	logger.SetEntryCallback(nil)
+	logger.SetPacketLogging(false)
+	logger.LogPacket("UP->", []byte{0x06}, "")
+	logger.SetPacketLogging(true)
+	buf.Reset()
+	logger.LogPacket("UP->", []byte{0x07}, "")
+	if !strings.Contains(buf.String(), "seq=4 off=6") {
+		t.Errorf("Expected seq=4 off=6 after an unlogged packet, got: %s", buf.String())
+	}
+}
+
+// slowWriter simulates a stalled disk
+type slowWriter struct {
+	mu    sync.Mutex
+	delay time.Duration
+	buf   bytes.Buffer
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func (w *slowWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+func TestLogger_Async(t *testing.T) {
+	logger, _ := New(true, "")
+	defer logger.Close()
+	w := &slowWriter{}
+	logger.SetOutput(w)
+
+	logger.Info("first")
+	logger.LogPacket("->UP", []byte{0x01}, "client#1")
+	logger.Warn("second")
+	logger.Flush()
+
+	lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 lines after Flush, got %d: %s", len(lines), w.String())
+	}
+	if !strings.Contains(lines[0], "first") || !strings.Contains(lines[1], "[->UP] 01") || !strings.Contains(lines[2], "second") {
+		t.Errorf("Expected lines in call order, got: %s", w.String())
+	}
+}
+
+func TestLogger_AsyncCopiesData(t *testing.T) {
+	logger, _ := New(true, "")
+	defer logger.Close()
+	w := &slowWriter{}
+	logger.SetOutput(w)
+
+	data := []byte{0xaa, 0xbb}
+	logger.LogPacket("UP->", data, "")
+	data[0] = 0x00
+	logger.Flush()
+
+	if !strings.Contains(w.String(), "aa bb") {
+		t.Errorf("Expected the packet as it was logged, got: %s", w.String())
+	}
+}
+
+func TestLogger_LogPacketFrame(t *testing.T) {
+	logger, _ := New(true, "")
+	defer logger.Close()
+	w := &slowWriter{}
+	logger.SetOutput(w)
+
+	pool := bufpool.New("test-log-frame", 16)
+	f := pool.GetFrame()
+	f.Truncate(copy(f.Bytes(), []byte{0xaa, 0xbb}))
+	logger.LogPacketFrame("UP->", f, f.Bytes(), "")
+	f.Release()
+	logger.Flush()
+
+	if !strings.Contains(w.String(), "aa bb") {
+		t.Errorf("Expected the packet from the frame, got: %s", w.String())
+	}
+	if stats := pool.Stats(); stats.InUse != 0 {
+		t.Errorf("Expected the frame released once written, got %d in use", stats.InUse)
+	}
+}
+
+func TestLogger_DropsWhenFull(t *testing.T) {
+	logger, _ := New(true, "")
+	defer logger.Close()
+	w := &slowWriter{delay: 50 * time.Millisecond}
+	logger.SetOutput(w)
+
+	start := time.Now()
+	for i := 0; i < QueueSize*2; i++ {
+		logger.LogPacket("UP->", []byte{byte(i)}, "")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected LogPacket not to wait for a slow writer, took %v", elapsed)
+	}
+	if logger.Dropped() == 0 {
+		t.Error("Expected dropped packets when the queue is full")
+	}
+	if logger.Pending() == 0 {
+		t.Error("Expected pending entries")
+	}
+	logger.SetOutput(io.Discard)
+}
+
+func TestLogger_Close(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test_packets_*.log")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	logger, _ := New(true, tmpFile.Name())
+	logger.SetOutput(io.Discard)
+	logger.LogPacket("UP->", []byte{0x01, 0x02}, "")
+	logger.Close()
+	logger.Close()
+
+	data, _ := os.ReadFile(tmpFile.Name())
+	if !strings.Contains(string(data), "01 02") {
+		t.Errorf("Expected queued packet written on Close, got: %s", data)
+	}
+
+	// Lines logged after Close are written directly
+	var buf bytes.Buffer
+	logger.SetOutput(&buf)
+	logger.Info("late")
+	if !strings.Contains(buf.String(), "late") {
+		t.Errorf("Expected line logged after Close, got: %s", buf.String())
+	}
+
+	// The closed file is left alone
+	logger.LogPacket("UP->", []byte{0xab}, "")
+	logger.Close()
+	if data, _ := os.ReadFile(tmpFile.Name()); strings.Contains(string(data), "ab (1 bytes)") {
+		t.Errorf("Expected nothing written to the file after Close, got: %s", data)
+	}
+}
+
+func TestLogger_TruncateFile(t *testing.T) {
+	path := t.TempDir() + "/packets.log"
+	logger, _ := New(true, path)
+	logger.SetOutput(io.Discard)
+	defer logger.Close()
+
+	logger.LogPacket("UP->", []byte{0x01, 0x02}, "")
+	logger.Flush()
+	n, err := logger.TruncateFile()
+	if err != nil || n == 0 {
+		t.Fatalf("Expected the logged bytes truncated, got %d, %v", n, err)
+	}
+	logger.LogPacket("UP->", []byte{0xab}, "")
+	logger.Flush()
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "01 02") || strings.Count(string(data), "\n") != 1 {
+		t.Errorf("Expected only the new packet in the file, got: %q", data)
+	}
+
+	noFile, _ := New(true, "")
+	defer noFile.Close()
+	if n, err := noFile.TruncateFile(); n != 0 || err != nil {
+		t.Errorf("Expected nothing to truncate without a file, got %d, %v", n, err)
+	}
+}
+
+func TestLogger_SetFileLogging(t *testing.T) {
+	path := t.TempDir() + "/packets.log"
+	logger, _ := New(false, path)
+	logger.SetOutput(io.Discard)
+	defer logger.Close()
+
+	if logger.IsFileLoggingEnabled() {
+		t.Fatal("Expected no log file without packet logging")
+	}
+	logger.LogPacket("UP->", []byte{0x01}, "")
+	if err := logger.SetFileLogging(true); err != nil {
+		t.Fatalf("SetFileLogging: %v", err)
+	}
+	logger.SetPacketLogging(true)
+	logger.LogPacket("UP->", []byte{0x02}, "")
+	logger.Flush()
+	if err := logger.SetFileLogging(false); err != nil || logger.IsFileLoggingEnabled() {
+		t.Fatalf("Expected the file closed, got %v", err)
+	}
+	logger.LogPacket("UP->", []byte{0x03}, "")
+	logger.Flush()
+
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "01 (1 bytes)") || !strings.Contains(string(data), "02 (1 bytes)") || strings.Contains(string(data), "03 (1 bytes)") {
+		t.Errorf("Expected only the packet logged while enabled, got: %s", data)
+	}
+
+	noFile, _ := New(true, "")
+	defer noFile.Close()
+	if err := noFile.SetFileLogging(true); err != ErrNoLogFile {
+		t.Errorf("Expected ErrNoLogFile, got %v", err)
+	}
+}
+
+func TestLogger_SetLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &Logger{stdWriter: &buf}
+	var entries []Entry
+	logger.SetEntryCallback(func(e Entry) { entries = append(entries, e) })
+
+	if err := logger.SetLevel(LogWarn); err != nil || logger.Level() != LogWarn {
+		t.Fatalf("Expected level WARN, got %s, %v", logger.Level(), err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown")
+	if strings.Contains(buf.String(), "hidden") || !strings.Contains(buf.String(), "shown") {
+		t.Errorf("Expected only the warning on stdout, got: %s", buf.String())
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected the callback to receive both lines, got %d", len(entries))
+	}
+
+	for _, level := range []LogLevel{LogPkt, "DEBUG"} {
+		if err := logger.SetLevel(level); err == nil {
+			t.Errorf("Expected an error for %s", level)
+		}
+	}
+}
+
+// BenchmarkLogPacket_SlowDisk measures the caller's cost of logging a packet
+// while the output takes 1ms per line. Forwarding goroutines only pay for
+// the copy and the queue send.
+func BenchmarkLogPacket_SlowDisk(b *testing.B) {
+	logger, _ := New(true, "")
+	logger.SetOutput(&slowWriter{delay: time.Millisecond})
+	defer logger.Close()
+	packet := []byte{0xf7, 0x0e, 0x11, 0x41, 0x01, 0x00, 0x5f, 0x00}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		logger.LogPacket("->UP", packet, "client#1")
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(logger.Dropped()), "dropped")
+	logger.SetOutput(io.Discard)
+}
+
+func TestParsePacketLine(t *testing.T) {
+	tests := []struct {
+		line      string
+		direction string
+		source    string
+		ok        bool
+	}{
+		{"2024-01-15T10:30:50Z [PKT] [UP->] f7 0e (2 bytes)\n", "UP->", "", true},
+		{"2024-01-15T10:30:50Z [PKT] [->UP] 01 (1 bytes) from client#3 session=ab12cd34\n", "->UP", "client#3", true},
+		{"2024-01-15T10:30:50Z [PKT] [->UP] 01 (1 bytes) from INJECT\n", "->UP", "INJECT", true},
+		{"2024-01-15T10:30:50Z [INFO] Client connected\n", "", "", false},
+	}
+	for _, tt := range tests {
+		direction, source, ok := ParsePacketLine(tt.line)
+		if direction != tt.direction || source != tt.source || ok != tt.ok {
+			t.Errorf("ParsePacketLine(%q): expected %q %q %v, got %q %q %v",
+				tt.line, tt.direction, tt.source, tt.ok, direction, source, ok)
+		}
+	}
+
+	// Round trip through LogPacket
+	var buf bytes.Buffer
+	logger := &Logger{stdWriter: &buf}
+	logger.SetPacketLogging(true)
+	logger.LogPacket("->UP", []byte{0x01}, "client#7")
+	if direction, source, ok := ParsePacketLine(buf.String()); direction != "->UP" || source != "client#7" || !ok {
+		t.Errorf("Expected ->UP from client#7, got %q %q %v", direction, source, ok)
+	}
+}
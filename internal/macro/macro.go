@@ -0,0 +1,231 @@
+// Package macro stores named injection sequences and persists them to disk.
+package macro
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/hexutil"
+)
+
+// MaxDelayMs caps the delay between frames
+const MaxDelayMs = 60000
+
+// MaxBreakMs caps the length of a break step
+const MaxBreakMs = 10000
+
+// ErrNotFound is returned when a macro does not exist
+var ErrNotFound = errors.New("macro not found")
+
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// Frame is a single packet within a macro, or a break on the upstream
+// line when BreakMs is set
+type Frame struct {
+	Data    string `json:"data,omitempty"`
+	DelayMs int    `json:"delay_ms,omitempty"` // wait before sending this frame
+	BreakMs int    `json:"break_ms,omitempty"` // send a break this long instead of data
+}
+
+// IsBreak reports whether the frame is a break rather than data
+func (f Frame) IsBreak() bool {
+	return f.BreakMs > 0
+}
+
+// Macro is a named sequence of frames sent to one target. The frames of a
+// Template contain {{...}} placeholders rendered on every run.
+type Macro struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Target      string  `json:"target"` // "upstream" or "downstream"
+	Format      string  `json:"format"` // "hex" or "ascii"
+	Frames      []Frame `json:"frames"`
+	Template    bool    `json:"template,omitempty"`
+}
+
+// Validate checks the macro definition. The frames of a template are only
+// checked when rendered.
+func (m *Macro) Validate() error {
+	if !namePattern.MatchString(m.Name) {
+		return fmt.Errorf("invalid name: use 1-64 letters, digits, '.', '_' or '-'")
+	}
+	if m.Target != "upstream" && m.Target != "downstream" {
+		return fmt.Errorf("invalid target: must be 'upstream' or 'downstream'")
+	}
+	if m.Format != "hex" && m.Format != "ascii" {
+		return fmt.Errorf("invalid format: must be 'hex' or 'ascii'")
+	}
+	if len(m.Frames) == 0 {
+		return fmt.Errorf("at least one frame is required")
+	}
+	for i, f := range m.Frames {
+		if f.DelayMs < 0 || f.DelayMs > MaxDelayMs {
+			return fmt.Errorf("frame %d: delay_ms must be between 0 and %d", i, MaxDelayMs)
+		}
+		if f.BreakMs < 0 || f.BreakMs > MaxBreakMs {
+			return fmt.Errorf("frame %d: break_ms must be between 0 and %d", i, MaxBreakMs)
+		}
+		if f.IsBreak() {
+			if f.Data != "" {
+				return fmt.Errorf("frame %d: a break frame takes no data", i)
+			}
+			if m.Target != "upstream" {
+				return fmt.Errorf("frame %d: breaks can only be sent to the upstream", i)
+			}
+			continue
+		}
+		if m.Format == "hex" && !m.Template {
+			if _, err := hexutil.Parse(f.Data); err != nil {
+				return fmt.Errorf("frame %d: invalid hex: %v", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Store holds macros in memory and mirrors them to a JSON file. An empty
+// path keeps macros in memory only.
+type Store struct {
+	path   string
+	mu     sync.RWMutex
+	macros map[string]*Macro
+	broken error // why the file could not be loaded, so it is not overwritten
+}
+
+// NewStore loads macros from path if it exists. A file that cannot be
+// parsed is moved aside to path.bak, so that saving new macros does not
+// overwrite it; if it cannot be moved, the store is kept in memory only.
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path, macros: make(map[string]*Macro)}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		s.broken = err
+		return s, err
+	}
+
+	var list []*Macro
+	if err := json.Unmarshal(data, &list); err != nil {
+		if rerr := os.Rename(path, path+".bak"); rerr != nil {
+			s.broken = fmt.Errorf("failed to parse %s: %w", path, err)
+			return s, fmt.Errorf("failed to parse %s, macros will not be saved: %w", path, err)
+		}
+		return s, fmt.Errorf("failed to parse %s, moved it to %s.bak: %w", path, path, err)
+	}
+	for _, m := range list {
+		s.macros[m.Name] = m
+	}
+	return s, nil
+}
+
+// List returns all macros sorted by name
+func (s *Store) List() []*Macro {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*Macro, 0, len(s.macros))
+	for _, m := range s.macros {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Get returns a macro by name
+func (s *Store) Get(name string) (*Macro, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	m, ok := s.macros[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return m, nil
+}
+
+// Put validates and stores a macro, replacing any macro with the same name
+func (s *Store) Put(m *Macro) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, existed := s.macros[m.Name]
+	s.macros[m.Name] = m
+	if err := s.save(); err != nil {
+		if existed {
+			s.macros[m.Name] = prev
+		} else {
+			delete(s.macros, m.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes a macro
+func (s *Store) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev, ok := s.macros[name]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.macros, name)
+	if err := s.save(); err != nil {
+		s.macros[name] = prev
+		return err
+	}
+	return nil
+}
+
+// save writes all macros atomically. Caller must hold s.mu.
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	if s.broken != nil {
+		return fmt.Errorf("not saving macros over a file that could not be loaded: %w", s.broken)
+	}
+
+	list := make([]*Macro, 0, len(s.macros))
+	for _, m := range s.macros {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".macros-*.json")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
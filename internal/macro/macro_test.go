@@ -0,0 +1,133 @@
+package macro
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testMacro(name string) *Macro {
+	return &Macro{
+		Name:   name,
+		Target: "upstream",
+		Format: "hex",
+		Frames: []Frame{{Data: "f7 0e 01"}, {Data: "f7 0e 02", DelayMs: 100}},
+	}
+}
+
+func TestStore_Persistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "macros.json")
+
+	store, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+
+	if err := store.Put(testMacro("light-on")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Put(testMacro("light-off")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Delete("light-on"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	// Reload from disk
+	reloaded, err := NewStore(path)
+	if err != nil {
+		t.Fatalf("NewStore reload failed: %v", err)
+	}
+
+	list := reloaded.List()
+	if len(list) != 1 || list[0].Name != "light-off" {
+		t.Fatalf("Expected only light-off after reload, got %+v", list)
+	}
+	if len(list[0].Frames) != 2 || list[0].Frames[1].DelayMs != 100 {
+		t.Errorf("Frames not persisted correctly: %+v", list[0].Frames)
+	}
+
+	if _, err := reloaded.Get("light-on"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestStore_UnparsableFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "macros.json")
+	if err := os.WriteFile(path, []byte(`[{"name": "light-on",`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bad file is kept as a backup before new macros are saved
+	store, err := NewStore(path)
+	if err == nil {
+		t.Fatal("Expected a parse error")
+	}
+	if err := store.Put(testMacro("light-off")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if backup, err := os.ReadFile(path + ".bak"); err != nil || string(backup) != `[{"name": "light-on",` {
+		t.Errorf("Expected the unparsable file kept as .bak, got %q (%v)", backup, err)
+	}
+
+	// Without a way to move it aside, the file is not overwritten
+	if err := os.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(path + ".bak")
+	if err := os.MkdirAll(filepath.Join(path+".bak", "taken"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	store, _ = NewStore(path)
+	if err := store.Put(testMacro("light-on")); err == nil {
+		t.Error("Expected Put to refuse saving over the unparsable file")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "{" {
+		t.Errorf("Expected the file unchanged, got %q", data)
+	}
+}
+
+func TestMacro_Validate(t *testing.T) {
+	valid := testMacro("ok")
+	valid.Template = true
+	valid.Frames = append(valid.Frames, Frame{Data: "01 {{counter}} {{crc16}}"}, Frame{BreakMs: 250, DelayMs: 10})
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected valid macro, got %v", err)
+	}
+
+	invalid := []func(m *Macro){
+		func(m *Macro) { m.Name = "" },
+		func(m *Macro) { m.Name = "bad name" },
+		func(m *Macro) { m.Target = "sideways" },
+		func(m *Macro) { m.Format = "binary" },
+		func(m *Macro) { m.Frames = nil },
+		func(m *Macro) { m.Frames[0].Data = "zz" },
+		func(m *Macro) { m.Frames[0].Data = "01 {{crc16}}" }, // not a template
+		func(m *Macro) { m.Frames[0].DelayMs = -1 },
+		func(m *Macro) { m.Frames[0].DelayMs = MaxDelayMs + 1 },
+		func(m *Macro) { m.Frames[0].BreakMs = MaxBreakMs + 1 },
+		func(m *Macro) { m.Frames[0].BreakMs = 100 },
+		func(m *Macro) { m.Target = "downstream"; m.Frames[0] = Frame{BreakMs: 100} },
+	}
+	for i, mutate := range invalid {
+		m := testMacro("x")
+		mutate(m)
+		if err := m.Validate(); err == nil {
+			t.Errorf("Case %d: expected validation error", i)
+		}
+	}
+}
+
+func TestStore_MemoryOnly(t *testing.T) {
+	store, err := NewStore("")
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	if err := store.Put(testMacro("a")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if _, err := store.Get("a"); err != nil {
+		t.Errorf("Expected macro in memory, got %v", err)
+	}
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import "sync/atomic"
+
+// Upper bounds of the packet size histogram, in bytes
+var sizeBounds = []uint64{8, 16, 32, 64, 128, 256, 512, 1024, 4096}
+
+// Upper bounds of the broadcast latency histogram, in nanoseconds
+var latencyBounds = []uint64{
+	10e3, 25e3, 50e3, 100e3, 250e3, 500e3, // µs
+	1e6, 2.5e6, 5e6, 10e6, 25e6, 50e6, 100e6, // ms
+}
+
+// Bucket is one histogram bucket. Le is the inclusive upper bound; the
+// last bucket has none and counts everything larger.
+type Bucket struct {
+	Le    uint64 `json:"le,omitempty"`
+	Count uint64 `json:"count"`
+}
+
+// Histogram is a snapshot of a histogram's buckets
+type Histogram []Bucket
+
+// histogram counts observations per bucket without locking
+type histogram struct {
+	bounds []uint64
+	counts []atomic.Uint64 // len(bounds)+1, the last for overflow
+}
+
+func newHistogram(bounds []uint64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v uint64) {
+	i := 0
+	for i < len(h.bounds) && v > h.bounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+}
+
+func (h *histogram) snapshot() Histogram {
+	out := make(Histogram, len(h.counts))
+	for i := range h.counts {
+		if i < len(h.bounds) {
+			out[i].Le = h.bounds[i]
+		}
+		out[i].Count = h.counts[i].Load()
+	}
+	return out
+}
+
+// Count returns the number of observations
+func (h Histogram) Count() uint64 {
+	var n uint64
+	for _, b := range h {
+		n += b.Count
+	}
+	return n
+}
+
+// Quantile estimates the q-quantile (0 < q <= 1) by interpolating within
+// the bucket it falls in. Values in the overflow bucket are reported as
+// largest, the largest observation. It returns 0 when there are no
+// observations.
+func (h Histogram) Quantile(q float64, largest uint64) float64 {
+	total := h.Count()
+	if total == 0 {
+		return 0
+	}
+	rank := q * float64(total)
+	var seen float64
+	var lower uint64
+	for _, b := range h {
+		if b.Le == 0 {
+			return float64(largest)
+		}
+		if b.Count > 0 && seen+float64(b.Count) >= rank {
+			frac := (rank - seen) / float64(b.Count)
+			return float64(lower) + frac*float64(b.Le-lower)
+		}
+		seen += float64(b.Count)
+		lower = b.Le
+	}
+	return float64(largest)
+}
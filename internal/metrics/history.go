@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// Rate is traffic per second over a window
+type Rate struct {
+	BytesFromUpstream   float64 `json:"bytes_from_upstream"`
+	PacketsFromUpstream float64 `json:"packets_from_upstream"`
+	BytesToUpstream     float64 `json:"bytes_to_upstream"`
+	PacketsToUpstream   float64 `json:"packets_to_upstream"`
+	DroppedPackets      float64 `json:"dropped_packets"`
+}
+
+// Sample is a snapshot and when it was taken
+type Sample struct {
+	At       time.Time
+	Snapshot Snapshot
+}
+
+// History keeps periodic snapshots to compute rates over recent windows
+type History struct {
+	mu      sync.Mutex
+	samples []Sample // oldest first
+	span    time.Duration
+}
+
+// NewHistory returns a history keeping samples for span
+func NewHistory(span time.Duration) *History {
+	return &History{span: span}
+}
+
+// Add records a snapshot taken at at
+func (h *History) Add(at time.Time, snap Snapshot) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.samples = append(h.samples, Sample{At: at, Snapshot: snap})
+	for len(h.samples) > 1 && h.samples[0].At.Before(at.Add(-h.span)) {
+		h.samples = h.samples[1:]
+	}
+}
+
+// Since returns the oldest sample taken at or after t
+func (h *History) Since(t time.Time) (Sample, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.samples {
+		if !s.At.Before(t) {
+			return s, true
+		}
+	}
+	return Sample{}, false
+}
+
+// Rate returns the average rate from the oldest sample within window of now
+// to cur, the counters at now. Shortly after start the window is limited
+// to the samples taken so far.
+func (h *History) Rate(now time.Time, cur Snapshot, window time.Duration) Rate {
+	base, ok := h.Since(now.Add(-window))
+	if !ok {
+		return Rate{}
+	}
+	return base.RateTo(now, cur)
+}
+
+// RateTo returns the average rate from the sample to cur, the counters at
+// now
+func (s Sample) RateTo(now time.Time, cur Snapshot) Rate {
+	secs := now.Sub(s.At).Seconds()
+	if secs <= 0 {
+		return Rate{}
+	}
+	per := func(cur, prev uint64) float64 {
+		if cur < prev {
+			return 0
+		}
+		return float64(cur-prev) / secs
+	}
+	return Rate{
+		BytesFromUpstream:   per(cur.BytesFromUpstream, s.Snapshot.BytesFromUpstream),
+		PacketsFromUpstream: per(cur.PacketsFromUpstream, s.Snapshot.PacketsFromUpstream),
+		BytesToUpstream:     per(cur.BytesToUpstream, s.Snapshot.BytesToUpstream),
+		PacketsToUpstream:   per(cur.PacketsToUpstream, s.Snapshot.PacketsToUpstream),
+		DroppedPackets:      per(cur.DroppedPackets, s.Snapshot.DroppedPackets),
+	}
+}
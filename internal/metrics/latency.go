@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Latency is a snapshot of durations observed for one forwarding path
+type Latency struct {
+	Count uint64
+	Total time.Duration
+	Max   time.Duration
+	Hist  Histogram // in nanoseconds
+}
+
+// latency accumulates durations without locking
+type latency struct {
+	count   atomic.Uint64
+	totalNs atomic.Uint64
+	maxNs   atomic.Uint64
+	hist    *histogram
+}
+
+func newLatency() *latency {
+	return &latency{hist: newHistogram(latencyBounds)}
+}
+
+func (l *latency) observe(d time.Duration) {
+	ns := uint64(max(d, 0))
+	l.count.Add(1)
+	l.totalNs.Add(ns)
+	l.hist.observe(ns)
+	storeMax(&l.maxNs, ns)
+}
+
+func (l *latency) snapshot() Latency {
+	return Latency{
+		Count: l.count.Load(),
+		Total: time.Duration(l.totalNs.Load()),
+		Max:   time.Duration(l.maxNs.Load()),
+		Hist:  l.hist.snapshot(),
+	}
+}
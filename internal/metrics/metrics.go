@@ -0,0 +1,218 @@
+// Package metrics holds the proxy's runtime counters. Counters are
+// cumulative and safe for concurrent use; exporters derive rates by diffing
+// snapshots.
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters accumulates traffic and latency statistics
+type Counters struct {
+	bytesFromUpstream   atomic.Uint64
+	packetsFromUpstream atomic.Uint64
+	bytesToUpstream     atomic.Uint64
+	packetsToUpstream   atomic.Uint64
+	droppedPackets      atomic.Uint64
+	retriedPackets      atomic.Uint64
+	lostPackets         atomic.Uint64
+	dryRunPackets       atomic.Uint64
+	dryRunBytes         atomic.Uint64
+	slowPackets         atomic.Uint64
+	requests            atomic.Uint64
+	responseTimeouts    atomic.Uint64
+	broadcastCount      atomic.Uint64
+	broadcastTotalNs    atomic.Uint64
+	broadcastMaxNs      atomic.Uint64
+	maxSize             atomic.Uint64
+	lastFromUpstream    atomic.Int64 // unix nanoseconds, 0 before the first packet
+	lastToUpstream      atomic.Int64
+
+	initOnce      sync.Once
+	sizesFrom     *histogram
+	sizesTo       *histogram
+	broadcastHist *histogram
+	forwardTo     *latency
+	forwardFrom   *latency
+}
+
+// init creates the histograms, so the zero Counters is ready to use
+func (c *Counters) init() {
+	c.initOnce.Do(func() {
+		c.sizesFrom = newHistogram(sizeBounds)
+		c.sizesTo = newHistogram(sizeBounds)
+		c.broadcastHist = newHistogram(latencyBounds)
+		c.forwardTo = newLatency()
+		c.forwardFrom = newLatency()
+	})
+}
+
+// Snapshot is a point-in-time copy of the counters plus current gauges
+type Snapshot struct {
+	BytesFromUpstream   uint64
+	PacketsFromUpstream uint64
+	BytesToUpstream     uint64
+	PacketsToUpstream   uint64
+	DroppedPackets      uint64
+	RetriedPackets      uint64 // client packets written after a failed upstream write
+	LostPackets         uint64 // client packets given up on after a failed upstream write
+	DryRunPackets       uint64 // client packets withheld in dry-run mode
+	DryRunBytes         uint64
+	SlowPackets         uint64 // packets forwarded slower than LATENCY_BUDGET_MS
+	Requests            uint64 // client writes supervised with RESPONSE_TIMEOUT_MS
+	ResponseTimeouts    uint64 // requests the device did not answer in time
+	UpstreamReconnects  uint64
+	UpstreamConnected   bool
+	Clients             int
+	BroadcastCount      uint64
+	BroadcastTotal      time.Duration
+	BroadcastMax        time.Duration
+}
+
+// RecordFromUpstream counts a packet received from the upstream
+func (c *Counters) RecordFromUpstream(n int) {
+	c.init()
+	c.packetsFromUpstream.Add(1)
+	c.bytesFromUpstream.Add(uint64(n))
+	c.sizesFrom.observe(uint64(n))
+	storeMax(&c.maxSize, uint64(n))
+	c.lastFromUpstream.Store(time.Now().UnixNano())
+}
+
+// RecordToUpstream counts a packet written to the upstream
+func (c *Counters) RecordToUpstream(n int) {
+	c.init()
+	c.packetsToUpstream.Add(1)
+	c.bytesToUpstream.Add(uint64(n))
+	c.sizesTo.observe(uint64(n))
+	storeMax(&c.maxSize, uint64(n))
+	c.lastToUpstream.Store(time.Now().UnixNano())
+}
+
+// RecordDropped counts a packet that could not be forwarded
+func (c *Counters) RecordDropped() {
+	c.droppedPackets.Add(1)
+}
+
+// RecordRetried counts a client packet written to the upstream on a retry,
+// after its first write failed
+func (c *Counters) RecordRetried() {
+	c.retriedPackets.Add(1)
+}
+
+// RecordLost counts a client packet whose upstream write failed and that
+// could not be retried. Lost packets are also counted as dropped.
+func (c *Counters) RecordLost() {
+	c.lostPackets.Add(1)
+	c.droppedPackets.Add(1)
+}
+
+// RecordDryRun counts a client packet withheld from the upstream in dry-run
+// mode
+func (c *Counters) RecordDryRun(n int) {
+	c.dryRunPackets.Add(1)
+	c.dryRunBytes.Add(uint64(n))
+}
+
+// RecordForward records how long the proxy took to forward a packet: from
+// reading it off a client to writing it to the upstream, or from reading it
+// off the upstream to writing it to the last client
+func (c *Counters) RecordForward(toUpstream bool, d time.Duration) {
+	c.init()
+	if toUpstream {
+		c.forwardTo.observe(d)
+	} else {
+		c.forwardFrom.observe(d)
+	}
+}
+
+// RecordSlow counts a packet that exceeded the latency budget
+func (c *Counters) RecordSlow() {
+	c.slowPackets.Add(1)
+}
+
+// RecordRequest counts a client write awaiting an answer from the device
+func (c *Counters) RecordRequest() {
+	c.requests.Add(1)
+}
+
+// RecordResponseTimeout counts a request the device did not answer in time
+func (c *Counters) RecordResponseTimeout() {
+	c.responseTimeouts.Add(1)
+}
+
+// RecordBroadcast records how long fanning a packet out to clients took
+func (c *Counters) RecordBroadcast(d time.Duration) {
+	c.init()
+	ns := uint64(d.Nanoseconds())
+	c.broadcastCount.Add(1)
+	c.broadcastTotalNs.Add(ns)
+	c.broadcastHist.observe(ns)
+	storeMax(&c.broadcastMaxNs, ns)
+}
+
+func storeMax(v *atomic.Uint64, n uint64) {
+	for {
+		current := v.Load()
+		if n <= current || v.CompareAndSwap(current, n) {
+			return
+		}
+	}
+}
+
+// LastPackets returns when the last packet was received from and written to
+// the upstream. Either is zero if no packet has been counted yet.
+func (c *Counters) LastPackets() (fromUpstream, toUpstream time.Time) {
+	return unixNano(c.lastFromUpstream.Load()), unixNano(c.lastToUpstream.Load())
+}
+
+func unixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// PacketSizes returns the packet size histograms (in bytes) for each
+// direction and the largest packet seen
+func (c *Counters) PacketSizes() (fromUpstream, toUpstream Histogram, largest uint64) {
+	c.init()
+	return c.sizesFrom.snapshot(), c.sizesTo.snapshot(), c.maxSize.Load()
+}
+
+// BroadcastLatency returns the broadcast duration histogram, in
+// nanoseconds
+func (c *Counters) BroadcastLatency() Histogram {
+	c.init()
+	return c.broadcastHist.snapshot()
+}
+
+// ForwardLatency returns the forwarding durations for each direction
+func (c *Counters) ForwardLatency() (toUpstream, fromUpstream Latency) {
+	c.init()
+	return c.forwardTo.snapshot(), c.forwardFrom.snapshot()
+}
+
+// Snapshot returns the current counter values. Gauges are left zero for the
+// caller to fill in.
+func (c *Counters) Snapshot() Snapshot {
+	return Snapshot{
+		BytesFromUpstream:   c.bytesFromUpstream.Load(),
+		PacketsFromUpstream: c.packetsFromUpstream.Load(),
+		BytesToUpstream:     c.bytesToUpstream.Load(),
+		PacketsToUpstream:   c.packetsToUpstream.Load(),
+		DroppedPackets:      c.droppedPackets.Load(),
+		RetriedPackets:      c.retriedPackets.Load(),
+		LostPackets:         c.lostPackets.Load(),
+		DryRunPackets:       c.dryRunPackets.Load(),
+		DryRunBytes:         c.dryRunBytes.Load(),
+		SlowPackets:         c.slowPackets.Load(),
+		Requests:            c.requests.Load(),
+		ResponseTimeouts:    c.responseTimeouts.Load(),
+		BroadcastCount:      c.broadcastCount.Load(),
+		BroadcastTotal:      time.Duration(c.broadcastTotalNs.Load()),
+		BroadcastMax:        time.Duration(c.broadcastMaxNs.Load()),
+	}
+}
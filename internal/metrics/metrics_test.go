@@ -0,0 +1,161 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounters_Snapshot(t *testing.T) {
+	var c Counters
+
+	c.RecordFromUpstream(8)
+	c.RecordFromUpstream(4)
+	c.RecordToUpstream(3)
+	c.RecordDropped()
+	c.RecordDryRun(6)
+	c.RecordBroadcast(2 * time.Millisecond)
+	c.RecordBroadcast(5 * time.Millisecond)
+	c.RecordBroadcast(time.Millisecond)
+
+	s := c.Snapshot()
+
+	if s.PacketsFromUpstream != 2 || s.BytesFromUpstream != 12 {
+		t.Errorf("Expected 2 packets/12 bytes from upstream, got %d/%d", s.PacketsFromUpstream, s.BytesFromUpstream)
+	}
+
+	if s.PacketsToUpstream != 1 || s.BytesToUpstream != 3 {
+		t.Errorf("Expected 1 packet/3 bytes to upstream, got %d/%d", s.PacketsToUpstream, s.BytesToUpstream)
+	}
+
+	if s.DroppedPackets != 1 {
+		t.Errorf("Expected 1 dropped packet, got %d", s.DroppedPackets)
+	}
+
+	if s.DryRunPackets != 1 || s.DryRunBytes != 6 {
+		t.Errorf("Expected 1 packet/6 bytes withheld, got %d/%d", s.DryRunPackets, s.DryRunBytes)
+	}
+
+	if s.BroadcastCount != 3 {
+		t.Errorf("Expected 3 broadcasts, got %d", s.BroadcastCount)
+	}
+
+	if s.BroadcastTotal != 8*time.Millisecond {
+		t.Errorf("Expected total broadcast time 8ms, got %v", s.BroadcastTotal)
+	}
+
+	if s.BroadcastMax != 5*time.Millisecond {
+		t.Errorf("Expected max broadcast time 5ms, got %v", s.BroadcastMax)
+	}
+}
+
+func TestCounters_ForwardLatency(t *testing.T) {
+	var c Counters
+
+	c.RecordForward(true, 30*time.Microsecond)
+	c.RecordForward(true, 2*time.Millisecond)
+	c.RecordForward(false, time.Millisecond)
+	c.RecordSlow()
+
+	to, from := c.ForwardLatency()
+	if to.Count != 2 || to.Total != 2030*time.Microsecond || to.Max != 2*time.Millisecond {
+		t.Errorf("Unexpected to-upstream latency %+v", to)
+	}
+	if from.Count != 1 || from.Hist.Count() != 1 {
+		t.Errorf("Expected 1 from-upstream observation, got %+v", from)
+	}
+	if s := c.Snapshot(); s.SlowPackets != 1 {
+		t.Errorf("Expected 1 slow packet, got %d", s.SlowPackets)
+	}
+}
+
+func TestCounters_PacketSizes(t *testing.T) {
+	var c Counters
+
+	c.RecordFromUpstream(8)
+	c.RecordFromUpstream(9)
+	c.RecordFromUpstream(5000)
+	c.RecordToUpstream(100)
+
+	from, to, largest := c.PacketSizes()
+	if from[0].Le != 8 || from[0].Count != 1 || from[1].Count != 1 {
+		t.Errorf("Expected 8 and 9 bytes in the first two buckets, got %+v", from)
+	}
+	if last := from[len(from)-1]; last.Le != 0 || last.Count != 1 {
+		t.Errorf("Expected 5000 bytes in the overflow bucket, got %+v", last)
+	}
+	if to.Count() != 1 || to[4].Le != 128 || to[4].Count != 1 {
+		t.Errorf("Expected 100 bytes in the 128 bucket, got %+v", to)
+	}
+	if largest != 5000 {
+		t.Errorf("Expected largest packet 5000, got %d", largest)
+	}
+}
+
+func TestCounters_LastPackets(t *testing.T) {
+	var c Counters
+
+	if from, to := c.LastPackets(); !from.IsZero() || !to.IsZero() {
+		t.Errorf("Expected zero times before any packet, got %v/%v", from, to)
+	}
+
+	before := time.Now()
+	c.RecordFromUpstream(1)
+	from, to := c.LastPackets()
+	if from.Before(before) || time.Since(from) > time.Second {
+		t.Errorf("Unexpected last packet from upstream %v", from)
+	}
+	if !to.IsZero() {
+		t.Errorf("Expected no packet to upstream, got %v", to)
+	}
+}
+
+func TestHistogram_Quantile(t *testing.T) {
+	var c Counters
+	for i := 0; i < 90; i++ {
+		c.RecordBroadcast(20 * time.Microsecond) // 10-25µs bucket
+	}
+	for i := 0; i < 10; i++ {
+		c.RecordBroadcast(200 * time.Millisecond) // overflow
+	}
+	h := c.BroadcastLatency()
+	largest := uint64(200 * time.Millisecond)
+
+	if p50 := h.Quantile(0.5, largest); p50 < 10e3 || p50 > 25e3 {
+		t.Errorf("Expected p50 within 10-25µs, got %vns", p50)
+	}
+	if p99 := h.Quantile(0.99, largest); p99 != float64(largest) {
+		t.Errorf("Expected p99 reported as the maximum, got %vns", p99)
+	}
+	if q := (Histogram{}).Quantile(0.5, 0); q != 0 {
+		t.Errorf("Expected 0 for an empty histogram, got %v", q)
+	}
+}
+
+func TestHistory_Rate(t *testing.T) {
+	h := NewHistory(15 * time.Minute)
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// 100 bytes/s from upstream for 20 minutes, sampled every 5s
+	var now time.Time
+	for i := 0; i <= 240; i++ {
+		now = start.Add(time.Duration(i) * 5 * time.Second)
+		h.Add(now, Snapshot{BytesFromUpstream: uint64(i) * 500})
+	}
+	cur := Snapshot{BytesFromUpstream: 240 * 500}
+
+	for _, window := range []time.Duration{time.Minute, 15 * time.Minute} {
+		if r := h.Rate(now, cur, window); r.BytesFromUpstream != 100 {
+			t.Errorf("%v: expected 100 bytes/s, got %v", window, r.BytesFromUpstream)
+		}
+	}
+	if len(h.samples) > 15*12+1 {
+		t.Errorf("Expected samples older than 15m dropped, have %d", len(h.samples))
+	}
+
+	// Shortly after start the rate covers the time since the first sample
+	h = NewHistory(15 * time.Minute)
+	h.Add(start, Snapshot{})
+	if r := h.Rate(start.Add(10*time.Second), Snapshot{PacketsToUpstream: 50}, 5*time.Minute); r.PacketsToUpstream != 5 {
+		t.Errorf("Expected 5 packets/s, got %v", r.PacketsToUpstream)
+	}
+}
@@ -0,0 +1,358 @@
+// Package mqtt implements the small subset of MQTT 3.1.1 needed by the proxy:
+// connecting with credentials, QoS 0 publishing and subscribing, and
+// keep-alive pings.
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	packetConnect     byte = 0x10
+	packetConnAck     byte = 0x20
+	packetPublish     byte = 0x30
+	packetPubAck      byte = 0x40
+	packetSubscribe   byte = 0x82
+	packetSubAck      byte = 0x90
+	packetPingReq     byte = 0xc0
+	packetPingResp    byte = 0xd0
+	packetDisconnect  byte = 0xe0
+	maxRemainingBytes      = 268435455
+)
+
+// ErrClosed is returned when using a client that has been closed
+var ErrClosed = errors.New("mqtt: client closed")
+
+// Options configures a broker connection
+type Options struct {
+	Broker    string // host:port, optionally prefixed with tcp:// or mqtt://
+	ClientID  string
+	Username  string
+	Password  string
+	KeepAlive time.Duration
+}
+
+// Message is a PUBLISH received from the broker
+type Message struct {
+	Topic   string
+	Payload []byte
+}
+
+// Client is a minimal MQTT 3.1.1 client
+type Client struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeMu   sync.Mutex
+	messages  chan Message
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+	errMu     sync.Mutex
+	packetID  uint16
+	keepAlive time.Duration
+}
+
+// Dial connects to the broker and completes the CONNECT handshake
+func Dial(ctx context.Context, opts Options) (*Client, error) {
+	broker := opts.Broker
+	for _, prefix := range []string{"tcp://", "mqtt://"} {
+		broker = strings.TrimPrefix(broker, prefix)
+	}
+	if !strings.Contains(broker, ":") {
+		broker += ":1883"
+	}
+
+	keepAlive := opts.KeepAlive
+	if keepAlive <= 0 {
+		keepAlive = 30 * time.Second
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", broker)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn:      conn,
+		reader:    bufio.NewReader(conn),
+		messages:  make(chan Message, 64),
+		done:      make(chan struct{}),
+		keepAlive: keepAlive,
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err := c.connect(opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+
+	go c.readLoop()
+	go c.pingLoop()
+
+	return c, nil
+}
+
+func (c *Client) connect(opts Options) error {
+	var flags byte = 0x02 // clean session
+	if opts.Username != "" {
+		flags |= 0x80
+	}
+	if opts.Password != "" {
+		flags |= 0x40
+	}
+
+	var body []byte
+	body = appendString(body, "MQTT")
+	body = append(body, 0x04, flags)
+	body = binary.BigEndian.AppendUint16(body, uint16(c.keepAlive/time.Second))
+	body = appendString(body, opts.ClientID)
+	if opts.Username != "" {
+		body = appendString(body, opts.Username)
+	}
+	if opts.Password != "" {
+		body = appendString(body, opts.Password)
+	}
+
+	if err := c.writePacket(packetConnect, body); err != nil {
+		return err
+	}
+
+	header, payload, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if header&0xf0 != packetConnAck || len(payload) != 2 {
+		return fmt.Errorf("mqtt: unexpected packet 0x%02x during connect", header)
+	}
+	if payload[1] != 0 {
+		return fmt.Errorf("mqtt: connection refused (code %d)", payload[1])
+	}
+	return nil
+}
+
+// Subscribe requests QoS 0 delivery of messages on topic
+func (c *Client) Subscribe(topic string) error {
+	var body []byte
+	body = binary.BigEndian.AppendUint16(body, c.nextPacketID())
+	body = appendString(body, topic)
+	body = append(body, 0x00)
+	return c.writePacket(packetSubscribe, body)
+}
+
+// Publish sends payload to topic with QoS 0
+func (c *Client) Publish(topic string, payload []byte, retain bool) error {
+	header := packetPublish
+	if retain {
+		header |= 0x01
+	}
+
+	body := appendString(make([]byte, 0, len(topic)+len(payload)+2), topic)
+	body = append(body, payload...)
+	return c.writePacket(header, body)
+}
+
+// Messages returns the channel on which received messages are delivered
+func (c *Client) Messages() <-chan Message {
+	return c.messages
+}
+
+// Done is closed when the connection terminates
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error that terminated the connection, if any
+func (c *Client) Err() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+// Close sends DISCONNECT and closes the connection
+func (c *Client) Close() error {
+	_ = c.writePacket(packetDisconnect, nil)
+	c.shutdown(ErrClosed)
+	return nil
+}
+
+func (c *Client) shutdown(err error) {
+	c.closeOnce.Do(func() {
+		c.errMu.Lock()
+		c.err = err
+		c.errMu.Unlock()
+		c.conn.Close()
+		close(c.done)
+	})
+}
+
+func (c *Client) readLoop() {
+	for {
+		_ = c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		header, payload, err := c.readPacket()
+		if err != nil {
+			c.shutdown(err)
+			return
+		}
+
+		switch header & 0xf0 {
+		case packetPublish:
+			msg, ack, err := parsePublish(header, payload)
+			if err != nil {
+				c.shutdown(err)
+				return
+			}
+			if ack != nil {
+				_ = c.writePacket(packetPubAck, ack)
+			}
+			select {
+			case c.messages <- msg:
+			case <-c.done:
+				return
+			}
+		case packetSubAck:
+			if len(payload) >= 3 && payload[2] == 0x80 {
+				c.shutdown(errors.New("mqtt: subscription rejected by broker"))
+				return
+			}
+		case packetPingResp:
+		}
+	}
+}
+
+func (c *Client) pingLoop() {
+	ticker := time.NewTicker(c.keepAlive / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.writePacket(packetPingReq, nil); err != nil {
+				c.shutdown(err)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Client) nextPacketID() uint16 {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.packetID++
+	if c.packetID == 0 {
+		c.packetID = 1
+	}
+	return c.packetID
+}
+
+func (c *Client) writePacket(header byte, body []byte) error {
+	if len(body) > maxRemainingBytes {
+		return errors.New("mqtt: packet too large")
+	}
+
+	buf := make([]byte, 0, len(body)+5)
+	buf = append(buf, header)
+	buf = appendRemainingLength(buf, len(body))
+	buf = append(buf, body...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := c.conn.Write(buf)
+	_ = c.conn.SetWriteDeadline(time.Time{})
+	return err
+}
+
+func (c *Client) readPacket() (byte, []byte, error) {
+	header, err := c.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	return header, payload, nil
+}
+
+func parsePublish(header byte, payload []byte) (Message, []byte, error) {
+	if len(payload) < 2 {
+		return Message{}, nil, errors.New("mqtt: malformed publish")
+	}
+	topicLen := int(binary.BigEndian.Uint16(payload))
+	if len(payload) < 2+topicLen {
+		return Message{}, nil, errors.New("mqtt: malformed publish")
+	}
+	msg := Message{Topic: string(payload[2 : 2+topicLen])}
+	rest := payload[2+topicLen:]
+
+	var ack []byte
+	if qos := (header >> 1) & 0x03; qos > 0 {
+		if len(rest) < 2 {
+			return Message{}, nil, errors.New("mqtt: malformed publish")
+		}
+		if qos == 1 {
+			ack = rest[:2]
+		}
+		rest = rest[2:]
+	}
+	msg.Payload = rest
+	return msg, ack, nil
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func appendRemainingLength(b []byte, length int) []byte {
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if length == 0 {
+			return b
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeBroker accepts a single connection and records the packets it receives
+type fakeBroker struct {
+	ln      net.Listener
+	packets chan [2]interface{}
+	conn    chan net.Conn
+}
+
+func newFakeBroker(t *testing.T, connAckCode byte) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start fake broker: %v", err)
+	}
+
+	b := &fakeBroker{ln: ln, packets: make(chan [2]interface{}, 16), conn: make(chan net.Conn, 1)}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		b.conn <- conn
+		r := bufio.NewReader(conn)
+		for {
+			header, payload, err := readTestPacket(r)
+			if err != nil {
+				return
+			}
+			switch header & 0xf0 {
+			case packetConnect:
+				_, _ = conn.Write([]byte{packetConnAck, 0x02, 0x00, connAckCode})
+			case packetSubscribe & 0xf0:
+				_, _ = conn.Write([]byte{packetSubAck, 0x03, payload[0], payload[1], 0x00})
+			}
+			b.packets <- [2]interface{}{header, payload}
+		}
+	}()
+	return b
+}
+
+func readTestPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	return header, payload, err
+}
+
+func (b *fakeBroker) expect(t *testing.T, packetType byte) []byte {
+	t.Helper()
+	select {
+	case p := <-b.packets:
+		if p[0].(byte)&0xf0 != packetType&0xf0 {
+			t.Fatalf("Expected packet 0x%02x, got 0x%02x", packetType, p[0])
+		}
+		return p[1].([]byte)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timeout waiting for packet 0x%02x", packetType)
+		return nil
+	}
+}
+
+func TestClient_PublishSubscribe(t *testing.T) {
+	broker := newFakeBroker(t, 0)
+	defer broker.ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client, err := Dial(ctx, Options{
+		Broker:   "tcp://" + broker.ln.Addr().String(),
+		ClientID: "test",
+		Username: "user",
+		Password: "pass",
+	})
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer client.Close()
+
+	connect := broker.expect(t, packetConnect)
+	if flags := connect[7]; flags&0xc0 != 0xc0 {
+		t.Errorf("Expected username/password flags, got 0x%02x", flags)
+	}
+
+	if err := client.Subscribe("serial/rx"); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	sub := broker.expect(t, packetSubscribe)
+	if topic := string(sub[4 : 4+binary.BigEndian.Uint16(sub[2:])]); topic != "serial/rx" {
+		t.Errorf("Expected subscription to serial/rx, got %s", topic)
+	}
+
+	if err := client.Publish("serial/tx", []byte{0xf7, 0x0e}, false); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	pub := broker.expect(t, packetPublish)
+	if string(pub[2:11]) != "serial/tx" || string(pub[11:]) != string([]byte{0xf7, 0x0e}) {
+		t.Errorf("Unexpected publish payload %x", pub)
+	}
+
+	// Broker delivers a message on the subscribed topic
+	serverConn := <-broker.conn
+	msg := appendString(nil, "serial/rx")
+	msg = append(msg, 0x1f, 0x01)
+	_, _ = serverConn.Write(append([]byte{packetPublish, byte(len(msg))}, msg...))
+
+	select {
+	case m := <-client.Messages():
+		if m.Topic != "serial/rx" || string(m.Payload) != string([]byte{0x1f, 0x01}) {
+			t.Errorf("Unexpected message %s %x", m.Topic, m.Payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for message")
+	}
+}
+
+func TestDial_Refused(t *testing.T) {
+	broker := newFakeBroker(t, 5)
+	defer broker.ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if _, err := Dial(ctx, Options{Broker: broker.ln.Addr().String(), ClientID: "test"}); err == nil {
+		t.Error("Expected error when broker refuses connection")
+	}
+}
+
+func TestRemainingLength(t *testing.T) {
+	tests := []struct {
+		length   int
+		expected []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xff, 0x7f}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+	}
+
+	for _, tt := range tests {
+		got := appendRemainingLength(nil, tt.length)
+		if string(got) != string(tt.expected) {
+			t.Errorf("Length %d: expected %x, got %x", tt.length, tt.expected, got)
+		}
+	}
+}
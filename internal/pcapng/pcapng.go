@@ -0,0 +1,125 @@
+// Package pcapng writes packet captures in the pcapng format, so traffic
+// recorded by the proxy can be opened in Wireshark, and reads them back.
+package pcapng
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// LinkTypeUser0 is the link type for serial data without a standard
+// encapsulation. Wireshark can be told which dissector to use for it under
+// Preferences > Protocols > DLT_USER.
+const LinkTypeUser0 = 147
+
+// Direction is recorded in a packet's flags
+type Direction uint32
+
+const (
+	Inbound  Direction = 1 // received from the device
+	Outbound Direction = 2 // sent to the device
+)
+
+// Block types and option codes
+const (
+	blockSection   = 0x0A0D0D0A
+	blockInterface = 0x00000001
+	blockPacket    = 0x00000006
+
+	byteOrderMagic = 0x1A2B3C4D
+
+	optEnd     = 0
+	optComment = 1
+
+	// Interface description options
+	optIfName  = 2
+	optTSResol = 9
+
+	// Enhanced packet options
+	optFlags = 2
+)
+
+// Writer writes a capture with one interface
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter writes the section header and an interface description for
+// linkType named ifName. Timestamps are written with nanosecond resolution.
+func NewWriter(w io.Writer, linkType uint16, ifName string) (*Writer, error) {
+	shb := le32(nil, byteOrderMagic)
+	shb = le16(shb, 1) // major version
+	shb = le16(shb, 0) // minor version
+	shb = le64(shb, ^uint64(0))
+	shb = option(shb, optEnd, nil)
+	if err := writeBlock(w, blockSection, shb); err != nil {
+		return nil, err
+	}
+
+	idb := le16(nil, linkType)
+	idb = le16(idb, 0) // reserved
+	idb = le32(idb, 0) // no snapshot length limit
+	if ifName != "" {
+		idb = option(idb, optIfName, []byte(ifName))
+	}
+	idb = option(idb, optTSResol, []byte{9})
+	idb = option(idb, optEnd, nil)
+	if err := writeBlock(w, blockInterface, idb); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+// WritePacket writes one packet. dir is left out when zero, and comment
+// when empty.
+func (w *Writer) WritePacket(ts time.Time, data []byte, dir Direction, comment string) error {
+	ns := uint64(ts.UnixNano())
+	epb := le32(nil, 0) // interface ID
+	epb = le32(epb, uint32(ns>>32))
+	epb = le32(epb, uint32(ns))
+	epb = le32(epb, uint32(len(data)))
+	epb = le32(epb, uint32(len(data)))
+	epb = append(epb, pad(data)...)
+
+	if dir != 0 || comment != "" {
+		if dir != 0 {
+			epb = option(epb, optFlags, le32(nil, uint32(dir)))
+		}
+		if comment != "" {
+			epb = option(epb, optComment, []byte(comment))
+		}
+		epb = option(epb, optEnd, nil)
+	}
+	return writeBlock(w.w, blockPacket, epb)
+}
+
+// writeBlock frames a block body with its type and total length
+func writeBlock(w io.Writer, blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	b := make([]byte, 0, length)
+	b = le32(b, blockType)
+	b = le32(b, length)
+	b = append(b, body...)
+	b = le32(b, length)
+	_, err := w.Write(b)
+	return err
+}
+
+func option(b []byte, code uint16, value []byte) []byte {
+	b = le16(b, code)
+	b = le16(b, uint16(len(value)))
+	return append(b, pad(value)...)
+}
+
+// pad extends data to a multiple of 4 bytes
+func pad(data []byte) []byte {
+	if n := len(data) % 4; n != 0 {
+		return append(append([]byte(nil), data...), make([]byte, 4-n)...)
+	}
+	return data
+}
+
+func le16(b []byte, v uint16) []byte { return binary.LittleEndian.AppendUint16(b, v) }
+func le32(b []byte, v uint32) []byte { return binary.LittleEndian.AppendUint32(b, v) }
+func le64(b []byte, v uint64) []byte { return binary.LittleEndian.AppendUint64(b, v) }
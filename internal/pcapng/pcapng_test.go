@@ -0,0 +1,168 @@
+package pcapng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+type block struct {
+	typ  uint32
+	body []byte
+}
+
+// readBlocks splits a capture into blocks, checking that both length
+// fields agree and that blocks are 32-bit aligned
+func readBlocks(t *testing.T, data []byte) []block {
+	t.Helper()
+	var blocks []block
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("Expected a complete block, got %d bytes", len(data))
+		}
+		typ := binary.LittleEndian.Uint32(data)
+		length := binary.LittleEndian.Uint32(data[4:])
+		if length%4 != 0 || int(length) > len(data) {
+			t.Fatalf("Invalid block length %d", length)
+		}
+		if trailer := binary.LittleEndian.Uint32(data[length-4:]); trailer != length {
+			t.Fatalf("Expected trailing length %d, got %d", length, trailer)
+		}
+		blocks = append(blocks, block{typ, data[8 : length-4]})
+		data = data[length:]
+	}
+	return blocks
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, LinkTypeUser0, "meter")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ts := time.Unix(1700000000, 123456789)
+	if err := w.WritePacket(ts, []byte{0xf7, 0x0e, 0x11}, Outbound, "client#1"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := w.WritePacket(ts, []byte{0x01, 0x02, 0x03, 0x04}, 0, ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	blocks := readBlocks(t, buf.Bytes())
+	if len(blocks) != 4 {
+		t.Fatalf("Expected 4 blocks, got %d", len(blocks))
+	}
+	if blocks[0].typ != blockSection || binary.LittleEndian.Uint32(blocks[0].body) != byteOrderMagic {
+		t.Errorf("Expected a section header first, got type %#x", blocks[0].typ)
+	}
+	if blocks[1].typ != blockInterface || binary.LittleEndian.Uint16(blocks[1].body) != LinkTypeUser0 {
+		t.Errorf("Expected an interface description with link type %d", LinkTypeUser0)
+	}
+	if !bytes.Contains(blocks[1].body, []byte("meter")) {
+		t.Error("Expected the interface name in the interface description")
+	}
+
+	epb := blocks[2].body
+	if blocks[2].typ != blockPacket {
+		t.Fatalf("Expected an enhanced packet block, got type %#x", blocks[2].typ)
+	}
+	ns := uint64(binary.LittleEndian.Uint32(epb[4:]))<<32 | uint64(binary.LittleEndian.Uint32(epb[8:]))
+	if ns != uint64(ts.UnixNano()) {
+		t.Errorf("Expected timestamp %d, got %d", ts.UnixNano(), ns)
+	}
+	if captured := binary.LittleEndian.Uint32(epb[12:]); captured != 3 {
+		t.Errorf("Expected captured length 3, got %d", captured)
+	}
+	if !bytes.Equal(epb[20:23], []byte{0xf7, 0x0e, 0x11}) {
+		t.Errorf("Expected packet data f7 0e 11, got % x", epb[20:23])
+	}
+	// Options follow the data padded to 4 bytes: flags, then the comment
+	opts := epb[24:]
+	if code := binary.LittleEndian.Uint16(opts); code != optFlags || binary.LittleEndian.Uint32(opts[4:]) != uint32(Outbound) {
+		t.Errorf("Expected outbound flags, got option %d = % x", code, opts[4:8])
+	}
+	if !bytes.Contains(opts, []byte("client#1")) {
+		t.Error("Expected the comment in the packet options")
+	}
+
+	// A packet without direction or comment has no options
+	if len(blocks[3].body) != 20+4 {
+		t.Errorf("Expected a 24-byte packet body without options, got %d", len(blocks[3].body))
+	}
+}
+
+func TestReadPackets(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, LinkTypeUser0, "meter")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ts := time.Unix(1700000000, 123456789)
+	_ = w.WritePacket(ts, []byte{0xf7, 0x0e, 0x11}, Outbound, "->UP from client#1")
+	_ = w.WritePacket(ts.Add(time.Millisecond), []byte{0x01, 0x02, 0x03, 0x04, 0x05}, 0, "")
+
+	packets, err := ReadPackets(&buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(packets) != 2 {
+		t.Fatalf("Expected 2 packets, got %d", len(packets))
+	}
+	p := packets[0]
+	if !p.Time.Equal(ts) || !bytes.Equal(p.Data, []byte{0xf7, 0x0e, 0x11}) || p.Direction != Outbound || p.Comment != "->UP from client#1" {
+		t.Errorf("Unexpected first packet %+v", p)
+	}
+	if p := packets[1]; !bytes.Equal(p.Data, []byte{0x01, 0x02, 0x03, 0x04, 0x05}) || p.Direction != 0 || p.Comment != "" {
+		t.Errorf("Unexpected second packet %+v", p)
+	}
+}
+
+func TestReadPackets_BigEndianMicroseconds(t *testing.T) {
+	be := func(b []byte, v uint32) []byte { return binary.BigEndian.AppendUint32(b, v) }
+	block := func(typ uint32, body []byte) []byte {
+		b := be(be(nil, typ), uint32(12+len(body)))
+		return be(append(b, body...), uint32(12+len(body)))
+	}
+
+	shb := be(nil, byteOrderMagic)
+	shb = append(shb, 0, 1, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	idb := []byte{0, 147, 0, 0, 0, 0, 0, 0} // default resolution: microseconds
+	epb := be(be(be(nil, 0), 0), 1500000)   // 1.5 s
+	epb = be(be(epb, 2), 2)
+	epb = append(epb, 0xaa, 0xbb, 0, 0)
+
+	var data []byte
+	data = append(data, block(blockSection, shb)...)
+	data = append(data, block(blockInterface, idb)...)
+	data = append(data, block(0x00000005, []byte{0, 0, 0, 0})...) // skipped
+	data = append(data, block(blockPacket, epb)...)
+
+	packets, err := ReadPackets(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(packets) != 1 || !packets[0].Time.Equal(time.Unix(1, 500000000)) || !bytes.Equal(packets[0].Data, []byte{0xaa, 0xbb}) {
+		t.Errorf("Unexpected packets %+v", packets)
+	}
+}
+
+func TestReadPackets_Invalid(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"empty": nil,
+		"pcap":  {0xd4, 0xc3, 0xb2, 0xa1, 0x02, 0x00, 0x04, 0x00},
+		"text":  []byte("2025-11-28T00:00:00Z [PKT] [UP->] f7 (1 bytes)\n"),
+	} {
+		if _, err := ReadPackets(bytes.NewReader(data)); err != ErrNotPcapng {
+			t.Errorf("%s: expected ErrNotPcapng, got %v", name, err)
+		}
+	}
+
+	// A capture cut off inside a block
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf, LinkTypeUser0, "")
+	_ = w.WritePacket(time.Now(), []byte{0x01}, Inbound, "")
+	if _, err := ReadPackets(bytes.NewReader(buf.Bytes()[:buf.Len()-6])); err == nil || err == ErrNotPcapng {
+		t.Errorf("Expected a truncation error, got %v", err)
+	}
+}
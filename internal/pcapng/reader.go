@@ -0,0 +1,176 @@
+package pcapng
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// maxBlockSize bounds a block read from a capture
+const maxBlockSize = 16 << 20
+
+// ErrNotPcapng is returned for input that does not start with a section
+// header
+var ErrNotPcapng = errors.New("not a pcapng capture")
+
+// Packet is a packet read from a capture
+type Packet struct {
+	Time      time.Time
+	Data      []byte
+	Direction Direction // zero when the capture does not record it
+	Comment   string
+}
+
+// interfaceInfo is what the reader needs from an interface description
+type interfaceInfo struct {
+	tsResol byte // if_tsresol, 6 (microseconds) by default
+}
+
+// ReadPackets reads every enhanced packet block of a capture, in order.
+// Blocks of other types are skipped; several sections and either byte
+// order are supported.
+func ReadPackets(r io.Reader) ([]Packet, error) {
+	var (
+		order      binary.ByteOrder
+		interfaces []interfaceInfo
+		packets    []Packet
+	)
+	head := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, head); err != nil {
+			if err == io.EOF && order != nil {
+				return packets, nil
+			}
+			if order == nil {
+				return nil, ErrNotPcapng
+			}
+			return nil, fmt.Errorf("truncated block: %w", err)
+		}
+
+		if binary.LittleEndian.Uint32(head) == blockSection {
+			// The byte order magic tells how to read this section
+			magic := make([]byte, 4)
+			if _, err := io.ReadFull(r, magic); err != nil {
+				return nil, ErrNotPcapng
+			}
+			switch {
+			case binary.LittleEndian.Uint32(magic) == byteOrderMagic:
+				order = binary.LittleEndian
+			case binary.BigEndian.Uint32(magic) == byteOrderMagic:
+				order = binary.BigEndian
+			default:
+				return nil, ErrNotPcapng
+			}
+			interfaces = interfaces[:0]
+			length := order.Uint32(head[4:])
+			if length < 16 || length%4 != 0 || length > maxBlockSize {
+				return nil, fmt.Errorf("invalid section header length %d", length)
+			}
+			if _, err := io.CopyN(io.Discard, r, int64(length-12)); err != nil {
+				return nil, fmt.Errorf("truncated section header: %w", err)
+			}
+			continue
+		}
+		if order == nil {
+			return nil, ErrNotPcapng
+		}
+
+		typ, length := order.Uint32(head), order.Uint32(head[4:])
+		if length < 12 || length%4 != 0 || length > maxBlockSize {
+			return nil, fmt.Errorf("invalid block length %d", length)
+		}
+		block := make([]byte, length-8)
+		if _, err := io.ReadFull(r, block); err != nil {
+			return nil, fmt.Errorf("truncated block: %w", err)
+		}
+		body := block[:len(block)-4]
+
+		switch typ {
+		case blockInterface:
+			if len(body) < 8 {
+				return nil, errors.New("invalid interface description")
+			}
+			info := interfaceInfo{tsResol: 6}
+			for _, opt := range options(order, body[8:]) {
+				if opt.code == optTSResol && len(opt.value) == 1 {
+					info.tsResol = opt.value[0]
+				}
+			}
+			interfaces = append(interfaces, info)
+		case blockPacket:
+			p, err := readPacket(order, body, interfaces)
+			if err != nil {
+				return nil, err
+			}
+			packets = append(packets, p)
+		}
+	}
+}
+
+// readPacket decodes the body of an enhanced packet block
+func readPacket(order binary.ByteOrder, body []byte, interfaces []interfaceInfo) (Packet, error) {
+	if len(body) < 20 {
+		return Packet{}, errors.New("invalid packet block")
+	}
+	id := order.Uint32(body)
+	if int(id) >= len(interfaces) {
+		return Packet{}, fmt.Errorf("packet for unknown interface %d", id)
+	}
+	ts := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+	n := int(order.Uint32(body[12:]))
+	padded := (n + 3) &^ 3
+	if n > len(body)-20 || padded > len(body)-20 {
+		return Packet{}, errors.New("invalid packet length")
+	}
+
+	p := Packet{
+		Time: timestamp(ts, interfaces[id].tsResol),
+		Data: append([]byte(nil), body[20:20+n]...),
+	}
+	for _, opt := range options(order, body[20+padded:]) {
+		switch {
+		case opt.code == optFlags && len(opt.value) == 4:
+			p.Direction = Direction(order.Uint32(opt.value) & 0x3)
+		case opt.code == optComment:
+			p.Comment = string(opt.value)
+		}
+	}
+	return p, nil
+}
+
+type blockOption struct {
+	code  uint16
+	value []byte
+}
+
+// options splits an option list, stopping at the end option or at the
+// first malformed option
+func options(order binary.ByteOrder, b []byte) []blockOption {
+	var opts []blockOption
+	for len(b) >= 4 {
+		code, n := order.Uint16(b), int(order.Uint16(b[2:]))
+		if code == optEnd || 4+n > len(b) {
+			break
+		}
+		opts = append(opts, blockOption{code, b[4 : 4+n]})
+		b = b[min(len(b), 4+(n+3)&^3):]
+	}
+	return opts
+}
+
+// timestamp converts a packet timestamp in units of the interface's
+// if_tsresol: a negative power of ten, or of two if the top bit is set
+func timestamp(ts uint64, resol byte) time.Time {
+	if resol&0x80 != 0 {
+		secs := float64(ts) / math.Pow(2, float64(resol&0x7f))
+		return time.Unix(0, int64(secs*1e9))
+	}
+	exp := int(resol)
+	if exp <= 9 {
+		return time.Unix(0, int64(ts*uint64(math.Pow10(9-exp))))
+	}
+	return time.Unix(0, int64(ts/uint64(math.Pow10(exp-9))))
+}
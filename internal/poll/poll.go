@@ -0,0 +1,252 @@
+// Package poll sends query frames to the upstream on a schedule and caches
+// the latest response to each, so clients can read values without polling
+// the device themselves.
+package poll
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/hexutil"
+)
+
+const defaultTimeout = time.Second
+
+// Sender writes a query frame to the upstream
+type Sender func(data []byte) error
+
+// Result is the cached state of one poll
+type Result struct {
+	Name      string `json:"name"`
+	Query     string `json:"query"`
+	Response  string `json:"response,omitempty"`
+	UpdatedAt string `json:"updated_at,omitempty"`
+	LatencyMs int64  `json:"latency_ms,omitempty"`
+	Requests  uint64 `json:"requests"`
+	Responses uint64 `json:"responses"`
+	Timeouts  uint64 `json:"timeouts"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type poll struct {
+	config.PollRule
+	query    []byte
+	prefix   []byte
+	interval time.Duration
+	timeout  time.Duration
+
+	// Guarded by Engine.mu
+	pending   bool
+	seq       uint64
+	sentAt    time.Time
+	partial   []byte
+	response  []byte
+	updatedAt time.Time
+	latency   time.Duration
+	requests  uint64
+	responses uint64
+	timeouts  uint64
+	lastErr   string
+}
+
+// Engine schedules the configured polls
+type Engine struct {
+	polls  []*poll
+	send   Sender
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewEngine compiles the configured polls. Rules are expected to have been
+// validated by the config package.
+func NewEngine(rules []config.PollRule, send Sender) *Engine {
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &Engine{send: send, ctx: ctx, cancel: cancel}
+
+	for _, rc := range rules {
+		p := &poll{
+			PollRule: rc,
+			interval: time.Duration(rc.Interval) * time.Second,
+			timeout:  time.Duration(rc.Timeout) * time.Millisecond,
+		}
+		p.query, _ = hexutil.Parse(rc.Query)
+		p.prefix, _ = hexutil.Parse(rc.ResponsePrefix)
+		if p.timeout <= 0 {
+			p.timeout = min(defaultTimeout, p.interval)
+		}
+		e.polls = append(e.polls, p)
+	}
+	return e
+}
+
+// Start begins sending queries
+func (e *Engine) Start() {
+	for _, p := range e.polls {
+		e.wg.Add(1)
+		go e.run(p)
+	}
+}
+
+// Stop halts all polls
+func (e *Engine) Stop() {
+	if e == nil {
+		return
+	}
+	e.cancel()
+	e.wg.Wait()
+}
+
+func (e *Engine) run(p *poll) {
+	defer e.wg.Done()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		e.query(p)
+
+		select {
+		case <-ticker.C:
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
+
+func (e *Engine) query(p *poll) {
+	e.mu.Lock()
+	p.requests++
+	p.seq++
+	seq := p.seq
+	p.pending = true
+	p.partial = nil
+	p.sentAt = time.Now()
+	e.mu.Unlock()
+
+	if err := e.send(p.query); err != nil {
+		e.mu.Lock()
+		p.pending = false
+		p.lastErr = err.Error()
+		e.mu.Unlock()
+		return
+	}
+
+	time.AfterFunc(p.timeout, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if p.pending && p.seq == seq {
+			p.pending = false
+			p.partial = nil
+			p.timeouts++
+			p.lastErr = "timeout"
+		}
+	})
+}
+
+// Observe offers a frame received from the upstream to the pending polls.
+// A poll that is collecting a multi-part response takes the frame first;
+// otherwise the oldest pending poll whose prefix matches claims it.
+func (e *Engine) Observe(data []byte) {
+	if e == nil || len(e.polls) == 0 {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var target *poll
+	for _, p := range e.polls {
+		if p.pending && len(p.partial) > 0 {
+			target = p
+			break
+		}
+	}
+	if target == nil {
+		for _, p := range e.polls {
+			if !p.pending || !bytes.HasPrefix(data, p.prefix) {
+				continue
+			}
+			if target == nil || p.sentAt.Before(target.sentAt) {
+				target = p
+			}
+		}
+	}
+	if target == nil {
+		return
+	}
+
+	target.partial = append(target.partial, data...)
+	if target.ResponseLength > 0 && len(target.partial) < target.ResponseLength {
+		return
+	}
+
+	resp := target.partial
+	if target.ResponseLength > 0 {
+		resp = resp[:target.ResponseLength]
+	}
+	now := time.Now()
+	target.response = resp
+	target.updatedAt = now
+	target.latency = now.Sub(target.sentAt)
+	target.responses++
+	target.lastErr = ""
+	target.pending = false
+	target.partial = nil
+}
+
+// Results returns the cached state of every poll
+func (e *Engine) Results() []Result {
+	if e == nil {
+		return []Result{}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	results := make([]Result, 0, len(e.polls))
+	for _, p := range e.polls {
+		results = append(results, p.result())
+	}
+	return results
+}
+
+// Result returns the cached state of the named poll
+func (e *Engine) Result(name string) (Result, bool) {
+	if e == nil {
+		return Result{}, false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, p := range e.polls {
+		if p.Name == name {
+			return p.result(), true
+		}
+	}
+	return Result{}, false
+}
+
+// result must be called with Engine.mu held
+func (p *poll) result() Result {
+	r := Result{
+		Name:      p.Name,
+		Query:     hex.EncodeToString(p.query),
+		Requests:  p.requests,
+		Responses: p.responses,
+		Timeouts:  p.timeouts,
+		LastError: p.lastErr,
+	}
+	if !p.updatedAt.IsZero() {
+		r.Response = hex.EncodeToString(p.response)
+		r.UpdatedAt = p.updatedAt.Format(time.RFC3339Nano)
+		r.LatencyMs = p.latency.Milliseconds()
+	}
+	return r
+}
@@ -0,0 +1,91 @@
+package poll
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+)
+
+func TestEngine_CachesResponse(t *testing.T) {
+	sent := make(chan []byte, 4)
+	e := NewEngine([]config.PollRule{
+		{Name: "temp", Query: "01 03", Interval: 60, ResponsePrefix: "01 83", ResponseLength: 4},
+		{Name: "other", Query: "02 03", Interval: 60, ResponsePrefix: "02 83"},
+	}, func(data []byte) error {
+		sent <- data
+		return nil
+	})
+	e.Start()
+	defer e.Stop()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-sent:
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for queries")
+		}
+	}
+
+	// Unrelated data is ignored; the response arrives in two segments
+	e.Observe([]byte{0xff, 0xff})
+	e.Observe([]byte{0x01, 0x83})
+	e.Observe([]byte{0x00, 0x2a, 0x99})
+
+	r, ok := e.Result("temp")
+	if !ok {
+		t.Fatal("Expected result for temp")
+	}
+	if r.Response != "0183002a" {
+		t.Errorf("Expected response 0183002a, got %q", r.Response)
+	}
+	if r.Requests != 1 || r.Responses != 1 {
+		t.Errorf("Expected 1 request and 1 response, got %+v", r)
+	}
+
+	other, _ := e.Result("other")
+	if other.Response != "" {
+		t.Errorf("Expected no response for other, got %q", other.Response)
+	}
+
+	if _, ok := e.Result("missing"); ok {
+		t.Error("Expected no result for unknown poll")
+	}
+}
+
+func TestEngine_Timeout(t *testing.T) {
+	e := NewEngine([]config.PollRule{
+		{Name: "slow", Query: "01", Interval: 60, Timeout: 20},
+	}, func(data []byte) error { return nil })
+	e.Start()
+	defer e.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	r, _ := e.Result("slow")
+	if r.Timeouts != 1 || r.LastError != "timeout" {
+		t.Errorf("Expected one timeout, got %+v", r)
+	}
+
+	// A late response is not attributed to the expired query
+	e.Observe([]byte{0x01})
+	if r, _ := e.Result("slow"); r.Responses != 0 {
+		t.Errorf("Expected no responses, got %d", r.Responses)
+	}
+}
+
+func TestEngine_SendError(t *testing.T) {
+	e := NewEngine([]config.PollRule{
+		{Name: "down", Query: "01", Interval: 60},
+	}, func(data []byte) error { return errors.New("upstream not connected") })
+	e.Start()
+	defer e.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+
+	r, _ := e.Result("down")
+	if r.LastError != "upstream not connected" {
+		t.Errorf("Expected send error, got %+v", r)
+	}
+}
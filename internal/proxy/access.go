@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/client"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+)
+
+// Close reasons of clients disconnected for their access level
+const (
+	ReasonAccess   = "access"    // access hours ended
+	ReasonReadOnly = "read_only" // wrote without write access, with CLIENT_REFUSED_WRITES=reset
+)
+
+// accessRule is a CLIENT_ACCESS_RULES rule with its hours parsed
+type accessRule struct {
+	config.AccessRule
+	hours config.Hours
+}
+
+// newAccessRules parses the hours of rules, which the configuration has
+// validated. It reports whether any rule has hours.
+func newAccessRules(rules []config.AccessRule) ([]accessRule, bool) {
+	compiled := make([]accessRule, len(rules))
+	scheduled := false
+	for i, rule := range rules {
+		compiled[i].AccessRule = rule
+		if rule.Hours != "" {
+			compiled[i].hours, _ = config.ParseHours(rule.Hours)
+			scheduled = true
+		}
+	}
+	return compiled, scheduled
+}
+
+// accessDecision is the access level of a client and where it comes from,
+// for the log
+type accessDecision struct {
+	access  string
+	rule    int // index in CLIENT_ACCESS_RULES, -1 for CLIENT_ACCESS
+	outside int // first matching rule skipped for its hours, or -1
+	hours   string
+}
+
+func (d accessDecision) String() string {
+	source := "CLIENT_ACCESS"
+	if d.rule >= 0 {
+		source = fmt.Sprintf("CLIENT_ACCESS_RULES[%d]", d.rule)
+	}
+	if d.outside >= 0 {
+		source += fmt.Sprintf(", outside hours %q of CLIENT_ACCESS_RULES[%d]", d.hours, d.outside)
+	}
+	return source
+}
+
+// accessAt returns the access level at t of the first CLIENT_ACCESS_RULES
+// rule matching ip and name whose hours include t, or CLIENT_ACCESS
+func (ps *Server) accessAt(ip net.IP, name string, t time.Time) accessDecision {
+	d := accessDecision{rule: -1, outside: -1}
+	for i, rule := range ps.access {
+		if !rule.Matches(ip, name) {
+			continue
+		}
+		if !rule.hours.Contains(t) {
+			if d.outside < 0 {
+				d.outside, d.hours = i, rule.Hours
+			}
+			continue
+		}
+		d.access, d.rule = rule.Access, i
+		return d
+	}
+	d.access = ps.config.ClientAccess
+	if d.access == "" {
+		d.access = config.AccessWrite
+	}
+	return d
+}
+
+// clientAccess returns the current access level of the client by its
+// address and announced name
+func (ps *Server) clientAccess(cl *client.Client) accessDecision {
+	return ps.accessAt(net.ParseIP(hostOf(cl.Addr)), cl.Name(), time.Now())
+}
+
+// deniedConn refuses a new connection on port whose address has access
+// "deny". Clients taking part in the IDENT handshake are checked once their
+// name is known, as a rule for the name may admit them.
+func (ps *Server) deniedConn(conn net.Conn, port *clientPort) bool {
+	if ps.config.IdentTimeout > 0 && !port.raw && !port.hex {
+		return false
+	}
+	d := ps.accessAt(net.ParseIP(hostOf(conn.RemoteAddr().String())), "", time.Now())
+	if d.access != config.AccessDeny {
+		return false
+	}
+	ps.logger.Warn("Refusing connection from %s: access denied by %s", conn.RemoteAddr(), d)
+	return true
+}
+
+// setAccess resolves the client's access level once its name is known
+func (s *clientSession) setAccess() accessDecision {
+	d := s.ps.clientAccess(s.cl)
+	s.cl.SetAccess(d.access)
+	s.writable = d.access == config.AccessWrite
+	return d
+}
+
+// refreshAccess re-resolves the access level of a client under rules with
+// hours at t, logging a change, and returns the new level
+func (ps *Server) refreshAccess(cl *client.Client, t time.Time) string {
+	d := ps.accessAt(net.ParseIP(hostOf(cl.Addr)), cl.Name(), t)
+	switch old := cl.SetAccess(d.access); {
+	case old == d.access:
+	case d.access == config.AccessDeny:
+		cl.Log.Warn("Disconnecting client %s: access denied by %s", cl.ID, d)
+		cl.SetCloseReason(ReasonAccess)
+	default:
+		cl.Log.Info("Access of client %s changed from %s to %s by %s", cl.ID, old, d.access, d)
+	}
+	return d.access
+}
+
+// checkAccess re-resolves the access level before a write once a minute
+// while rules with hours are configured. It returns false if the client is
+// now denied.
+func (s *clientSession) checkAccess(t time.Time) bool {
+	if !s.ps.scheduled {
+		return true
+	}
+	if !t.Before(s.recheck) {
+		s.recheck = t.Truncate(time.Minute).Add(time.Minute)
+		if s.ps.refreshAccess(s.cl, t) == config.AccessDeny {
+			return false
+		}
+	}
+	// The minute sweep may have changed the level since the last write
+	writable := s.cl.Access() == config.AccessWrite
+	if writable && !s.writable {
+		s.refused = false
+	}
+	s.writable = writable
+	return true
+}
+
+// enforceHours disconnects clients whose access hours have ended and
+// updates the level of the others at every minute, so that idle clients
+// are covered too
+func (ps *Server) enforceHours() {
+	defer ps.wg.Done()
+
+	for {
+		now := time.Now()
+		timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		select {
+		case now := <-timer.C:
+			for _, cl := range ps.clients.GetAll() {
+				if ps.refreshAccess(cl, now) == config.AccessDeny {
+					ps.clients.Remove(cl.ID)
+				}
+			}
+		case <-ps.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// refuse handles data from a client without write access as set by
+// CLIENT_REFUSED_WRITES. The data is dropped and counted, and the first
+// refusal is logged. It returns false when the client must be
+// disconnected.
+func (s *clientSession) refuse() bool {
+	s.ps.metrics.RecordDropped()
+	s.cl.AddRefused()
+	switch s.ps.config.RefusedWrites {
+	case config.RefuseReset:
+		s.cl.Log.Warn("Resetting client %s: write without write access (%s)", s.cl.ID, s.cl.Access())
+		if tcpConn := tcpConnOf(s.cl.Conn); tcpConn != nil {
+			_ = tcpConn.SetLinger(0)
+		}
+		s.cl.SetCloseReason(ReasonReadOnly)
+		return false
+	case config.RefuseError:
+		message := s.ps.config.RefusedMessage
+		if message == "" {
+			message = config.DefaultRefusedMessage
+		}
+		if err := s.cl.Write([]byte(message + "\r\n")); err != nil {
+			s.cl.Log.Warn("Failed to send refusal to %s: %v", s.cl.ID, err)
+			return false
+		}
+	}
+	if s.refused {
+		return true
+	}
+	s.refused = true
+	if s.cl.Access() == config.AccessInject {
+		s.cl.Log.Warn("Dropping writes from %s: only packets sent through /api/inject reach the upstream", s.cl.ID)
+		return true
+	}
+	s.cl.Log.Warn("Dropping writes from %s: read-only access", s.cl.ID)
+	return true
+}
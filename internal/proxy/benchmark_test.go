@@ -1,15 +1,19 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/storage"
 )
 
 func newBenchLogger() *logger.Logger {
@@ -27,8 +31,90 @@ func getFreePort() (int, string) {
 	return port, addr
 }
 
+// slowWriter simulates log output on a slow disk
+type slowWriter struct {
+	delay time.Duration
+}
+
+func (w slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return len(p), nil
+}
+
 // BenchmarkLatency measures the latency of packet forwarding through the proxy
 func BenchmarkLatency(b *testing.B) {
+	benchmarkLatency(b, newBenchLogger(), nil)
+}
+
+// BenchmarkLatency_SlowPacketLog measures forwarding latency with packet
+// logging enabled and every log line taking 5ms to write. It should match
+// BenchmarkLatency, since log output happens off the forwarding path.
+func BenchmarkLatency_SlowPacketLog(b *testing.B) {
+	log, _ := logger.New(true, "")
+	log.SetOutput(slowWriter{delay: 5 * time.Millisecond})
+	benchmarkLatency(b, log, nil)
+	b.ReportMetric(float64(log.Dropped()), "log-dropped")
+
+	// Let Stop drain the remaining lines quickly
+	log.SetOutput(io.Discard)
+}
+
+// slowStore simulates a storage backend on a slow disk
+type slowStore struct {
+	storage.Storage
+	delay *atomic.Int64 // time.Duration per write
+}
+
+func (s slowStore) AddLog(e logger.Entry) error {
+	time.Sleep(time.Duration(s.delay.Load()))
+	return s.Storage.AddLog(e)
+}
+
+func (s slowStore) AddEvent(e storage.Event) error {
+	time.Sleep(time.Duration(s.delay.Load()))
+	return s.Storage.AddEvent(e)
+}
+
+// BenchmarkLatency_SlowStorage measures forwarding latency with packet
+// logging enabled and every line kept, as the web server does, in a
+// backend taking 5ms per write. Written directly, the backend holds up the
+// logger, which then drops most packets; queued, the logger keeps up and
+// only the storage queue drops. Forwarding should match BenchmarkLatency
+// either way.
+func BenchmarkLatency_SlowStorage(b *testing.B) {
+	for _, queued := range []bool{false, true} {
+		name := "direct"
+		if queued {
+			name = "queued"
+		}
+		b.Run(name, func(b *testing.B) {
+			log, _ := logger.New(true, "")
+			log.SetOutput(io.Discard)
+			delay := new(atomic.Int64)
+			delay.Store(int64(5 * time.Millisecond))
+			var store storage.Storage = slowStore{Storage: storage.NewMemory(storage.Limits{}), delay: delay}
+			var async *storage.Async
+			if queued {
+				async = storage.NewAsync(store, storage.DefaultQueue)
+				store = async
+			}
+			log.SetEntryCallback(func(e logger.Entry) { _ = store.AddLog(e) })
+
+			benchmarkLatency(b, log, store)
+			b.ReportMetric(float64(log.Dropped()), "log-dropped")
+			if async != nil {
+				b.ReportMetric(float64(async.Stats().Dropped[storage.WriteLogs]), "storage-dropped")
+			}
+
+			// Let Stop drain the remaining lines quickly
+			delay.Store(0)
+		})
+	}
+}
+
+// benchmarkLatency runs the echo round trip through a proxy logging to
+// log, keeping its history in store unless it is nil
+func benchmarkLatency(b *testing.B, log *logger.Logger, store storage.Storage) {
 	// Start mock upstream server
 	upstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -68,16 +154,18 @@ func BenchmarkLatency(b *testing.B) {
 		UpstreamPort: upstreamPort,
 		ListenPort:   proxyPort,
 		MaxClients:   10,
-		LogPackets:   false,
+		LogPackets:   log.IsPacketLoggingEnabled(),
 	}
 
-	log := newBenchLogger()
 	server := NewServer(cfg, log)
+	if store != nil {
+		server.SetStorage(store)
+	}
 
-	if err := server.Start(); err != nil {
+	if err := server.Start(context.Background()); err != nil {
 		b.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer server.Stop()
+	b.Cleanup(func() { _ = server.Stop(context.Background()) })
 
 	// Wait for upstream connection
 	time.Sleep(200 * time.Millisecond)
@@ -117,6 +205,7 @@ func BenchmarkLatency(b *testing.B) {
 			b.Logf("Latency exceeded 1ms: %v", elapsed)
 		}
 	}
+	b.StopTimer()
 }
 
 // BenchmarkThroughput measures the throughput of the proxy
@@ -164,10 +253,10 @@ func BenchmarkThroughput(b *testing.B) {
 	log := newBenchLogger()
 	server := NewServer(cfg, log)
 
-	if err := server.Start(); err != nil {
+	if err := server.Start(context.Background()); err != nil {
 		b.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer server.Stop()
+	defer server.Stop(context.Background())
 
 	time.Sleep(200 * time.Millisecond)
 
@@ -192,18 +281,28 @@ func BenchmarkThroughput(b *testing.B) {
 	}
 }
 
-// BenchmarkMultiClientBroadcast measures broadcast performance to multiple clients
+// BenchmarkMultiClientBroadcast measures broadcast performance to multiple
+// clients, read by a goroutine each or, for the _epoll runs, by the epoll
+// client engine
 func BenchmarkMultiClientBroadcast(b *testing.B) {
-	clientCounts := []int{1, 5, 10}
+	clientCounts := []int{1, 5, 10, 100, 500}
 
 	for _, numClients := range clientCounts {
 		b.Run(fmt.Sprintf("%d_clients", numClients), func(b *testing.B) {
-			benchmarkBroadcast(b, numClients)
+			benchmarkBroadcast(b, numClients, config.EngineGoroutine)
+		})
+	}
+	for _, numClients := range clientCounts {
+		b.Run(fmt.Sprintf("%d_clients_epoll", numClients), func(b *testing.B) {
+			if runtime.GOOS != "linux" {
+				b.Skip("the epoll engine requires Linux")
+			}
+			benchmarkBroadcast(b, numClients, config.EngineEpoll)
 		})
 	}
 }
 
-func benchmarkBroadcast(b *testing.B, numClients int) {
+func benchmarkBroadcast(b *testing.B, numClients int, engine string) {
 	// Start mock upstream server that sends data
 	upstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -242,15 +341,16 @@ func benchmarkBroadcast(b *testing.B, numClients int) {
 		ListenPort:   proxyPort,
 		MaxClients:   numClients + 1,
 		LogPackets:   false,
+		ClientEngine: engine,
 	}
 
 	log := newBenchLogger()
 	server := NewServer(cfg, log)
 
-	if err := server.Start(); err != nil {
+	if err := server.Start(context.Background()); err != nil {
 		b.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer server.Stop()
+	defer server.Stop(context.Background())
 
 	// Wait for upstream connection
 	select {
@@ -300,6 +400,18 @@ func benchmarkBroadcast(b *testing.B, numClients int) {
 
 // BenchmarkMemoryAllocation measures memory allocations during packet forwarding
 func BenchmarkMemoryAllocation(b *testing.B) {
+	benchmarkMemoryAllocation(b, newBenchLogger())
+}
+
+// BenchmarkMemoryAllocation_PacketLog measures allocations with packet
+// logging enabled, where every packet is also queued for the log writer
+func BenchmarkMemoryAllocation_PacketLog(b *testing.B) {
+	log, _ := logger.New(true, "")
+	log.SetOutput(io.Discard)
+	benchmarkMemoryAllocation(b, log)
+}
+
+func benchmarkMemoryAllocation(b *testing.B, log *logger.Logger) {
 	// Start mock upstream server
 	upstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -338,16 +450,14 @@ func BenchmarkMemoryAllocation(b *testing.B) {
 		UpstreamPort: upstreamPort,
 		ListenPort:   proxyPort,
 		MaxClients:   10,
-		LogPackets:   false,
 	}
 
-	log := newBenchLogger()
 	server := NewServer(cfg, log)
 
-	if err := server.Start(); err != nil {
+	if err := server.Start(context.Background()); err != nil {
 		b.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer server.Stop()
+	defer server.Stop(context.Background())
 
 	time.Sleep(200 * time.Millisecond)
 
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"strings"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/client"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/coordinator"
+)
+
+// logCoordinator reports a newly detected coordinator on link
+func (ps *Server) logCoordinator(link *upstreamLink) {
+	info := link.coord.Info()
+	if info == nil {
+		return
+	}
+	log := link.conn.Log()
+	if info.Firmware == "" {
+		log.Info("Detected %s coordinator", info.Name)
+		return
+	}
+	log.Info("Detected %s coordinator (firmware %s)", info.Name, info.Firmware)
+}
+
+// GetCoordinator returns the coordinator detected on the primary upstream,
+// or nil if its traffic matched no known protocol
+func (ps *Server) GetCoordinator() *coordinator.Info {
+	return ps.links[0].coord.Info()
+}
+
+// observeController looks for coordinator commands in data written by cl
+// and warns when another client sent commands to the same coordinator
+// within CLIENT_CONTROLLER_WINDOW
+func (ps *Server) observeController(cl *client.Client, data []byte) {
+	link := ps.directLink()
+	if cl.Upstream != "" {
+		link = ps.findLink(cl.Upstream)
+	}
+	if link == nil || link.ctrl == nil {
+		return
+	}
+	typ := link.coord.Type()
+	if typ == "" || coordinator.CommandFrames(typ, data) == 0 {
+		return
+	}
+	clients := link.ctrl.Observe(cl.ID, time.Now())
+	if clients == nil {
+		return
+	}
+
+	link.conn.Log().Warn("Clients %s are all sending commands to the coordinator; two controlling applications corrupt its network state",
+		strings.Join(clients, ", "))
+	ps.emit(Event{
+		Type:     EventControllerConflict,
+		Clients:  ps.clients.TotalCount(),
+		Upstream: &UpstreamInfo{Name: link.name, Addr: link.conn.GetAddr(), State: link.conn.GetState().String()},
+		Conflict: link.ctrl.Conflict(),
+	})
+}
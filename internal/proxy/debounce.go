@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// outage tracks the loss of one upstream for HEALTH_DEBOUNCE_SECONDS, so a
+// reconnect within that time is treated as a blip rather than an outage
+type outage struct {
+	mu        sync.Mutex
+	connected bool
+	lost      time.Time   // when the connection was lost, zero while connected
+	timer     *time.Timer // pending down notification
+}
+
+// connect records that the upstream is connected. It reports whether a
+// pending down notification was cancelled, i.e. the outage was a blip.
+func (o *outage) connect() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.connected = true
+	o.lost = time.Time{}
+	if o.timer == nil {
+		return false
+	}
+	o.timer.Stop()
+	o.timer = nil
+	return true
+}
+
+// lose records that a connected upstream was lost at t and runs notify
+// once it has stayed down for d. Further calls during the outage do
+// nothing, and notify is not run if the upstream connects first.
+func (o *outage) lose(t time.Time, d time.Duration, notify func()) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.connected {
+		return
+	}
+	o.connected = false
+	o.lost = t
+	o.timer = time.AfterFunc(d, func() {
+		o.mu.Lock()
+		pending := o.timer != nil
+		o.timer = nil
+		o.mu.Unlock()
+		if pending {
+			notify()
+		}
+	})
+}
+
+// since returns when the upstream was lost, or zero while it is connected
+// or was never connected
+func (o *outage) since() time.Time {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.lost
+}
+
+// healthDebounce returns HEALTH_DEBOUNCE_SECONDS as a duration
+func (ps *Server) healthDebounce() time.Duration {
+	return time.Duration(ps.config.HealthDebounce) * time.Second
+}
+
+// UpstreamDebounced reports whether the primary upstream is down for less
+// than HEALTH_DEBOUNCE_SECONDS after having been connected, so health
+// checks still count it as connected
+func (ps *Server) UpstreamDebounced() bool {
+	d := ps.healthDebounce()
+	if d <= 0 || ps.upstream.IsConnected() || ps.parked.Load() {
+		return false
+	}
+	lost := ps.links[0].outage.since()
+	return !lost.IsZero() && time.Since(lost) < d
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/hexutil"
+)
+
+// ErrDenied is returned for an injection matching a DENY_FRAMES rule
+var ErrDenied = errors.New("frame matches the deny list")
+
+// DenyStatus reports a deny rule's activity for the API
+type DenyStatus struct {
+	Name       string `json:"name"`
+	Blocked    uint64 `json:"blocked"`
+	Overridden uint64 `json:"overridden"`
+}
+
+type denyRule struct {
+	name       string
+	prefix     []byte
+	regex      *regexp.Regexp
+	blocked    atomic.Uint64
+	overridden atomic.Uint64
+}
+
+// denyList holds the compiled DENY_FRAMES rules. A nil list matches
+// nothing.
+type denyList struct {
+	rules []*denyRule
+}
+
+// newDenyList compiles rules, which the configuration has validated
+func newDenyList(rules []config.DenyRule) (*denyList, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	d := &denyList{}
+	for _, rc := range rules {
+		r := &denyRule{name: rc.Name}
+		var err error
+		if r.prefix, err = hexutil.Parse(rc.HexPrefix); err != nil {
+			return nil, fmt.Errorf("deny rule %q: invalid hex_prefix: %w", rc.Name, err)
+		}
+		if rc.Regex != "" {
+			if r.regex, err = regexp.Compile(rc.Regex); err != nil {
+				return nil, fmt.Errorf("deny rule %q: invalid regex: %w", rc.Name, err)
+			}
+		}
+		d.rules = append(d.rules, r)
+	}
+	return d, nil
+}
+
+// match returns the first rule matching data, or nil
+func (d *denyList) match(data []byte) *denyRule {
+	if d == nil {
+		return nil
+	}
+	var hexStr string
+	for _, r := range d.rules {
+		if len(r.prefix) > 0 && !bytes.HasPrefix(data, r.prefix) {
+			continue
+		}
+		if r.regex != nil {
+			if hexStr == "" {
+				hexStr = hex.EncodeToString(data)
+			}
+			if !r.regex.MatchString(hexStr) {
+				continue
+			}
+		}
+		return r
+	}
+	return nil
+}
+
+func (d *denyList) status() []DenyStatus {
+	if d == nil {
+		return nil
+	}
+	status := make([]DenyStatus, len(d.rules))
+	for i, r := range d.rules {
+		status[i] = DenyStatus{Name: r.name, Blocked: r.blocked.Load(), Overridden: r.overridden.Load()}
+	}
+	return status
+}
+
+// denyClient drops client data matching a deny rule, reporting whether it
+// did
+func (ps *Server) denyClient(id string, data []byte) bool {
+	r := ps.deny.match(data)
+	if r == nil {
+		return false
+	}
+	r.blocked.Add(1)
+	ps.metrics.RecordDropped()
+	ps.logger.Warn("Dropped frame from %s matching deny rule %q: % x", id, r.name, data)
+	return true
+}
+
+// denyInject checks an injection toward an upstream. An override lets a
+// matching frame through but is logged and counted.
+func (ps *Server) denyInject(data []byte, override bool) error {
+	r := ps.deny.match(data)
+	if r == nil {
+		return nil
+	}
+	if override {
+		r.overridden.Add(1)
+		ps.logger.Warn("Injecting frame matching deny rule %q by override: % x", r.name, data)
+		return nil
+	}
+	r.blocked.Add(1)
+	ps.logger.Warn("Refused injection matching deny rule %q: % x", r.name, data)
+	return fmt.Errorf("%w: rule %q", ErrDenied, r.name)
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/client"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/coordinator"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/hooks"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/recovery"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/storage"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/upstream"
+)
+
+// Event types
+const (
+	EventClientConnected    = "client_connected"
+	EventClientDisconnected = "client_disconnected"
+	EventUpstreamState      = "upstream_state"
+	EventRecovery           = "recovery"
+	EventControllerConflict = "controller_conflict"
+)
+
+// Event is a structured notification about clients and upstreams, pushed
+// to web clients alongside the log stream
+type Event struct {
+	Type     string                `json:"type"`
+	Time     string                `json:"time"`
+	Client   *ClientInfo           `json:"client,omitempty"`
+	Clients  int                   `json:"connected_clients"`
+	Upstream *UpstreamInfo         `json:"upstream,omitempty"`
+	Recovery *recovery.Attempt     `json:"recovery,omitempty"`
+	Conflict *coordinator.Conflict `json:"controller_conflict,omitempty"`
+}
+
+// eventHub holds the callback registered with SetEventCallback
+type eventHub struct {
+	mu sync.RWMutex
+	fn func(Event)
+}
+
+// SetEventCallback registers a callback invoked for every event
+func (ps *Server) SetEventCallback(fn func(Event)) {
+	ps.events.mu.Lock()
+	ps.events.fn = fn
+	ps.events.mu.Unlock()
+}
+
+func (ps *Server) emit(e Event) {
+	now := time.Now()
+	e.Time = now.Format(time.RFC3339)
+	if data, err := json.Marshal(e); err == nil {
+		if err := ps.store.AddEvent(storage.Event{Type: e.Type, Time: now, Data: data}); err != nil {
+			ps.logger.Warn("Failed to store %s event: %v", e.Type, err)
+		}
+	}
+	ps.events.mu.RLock()
+	fn := ps.events.fn
+	ps.events.mu.RUnlock()
+	if fn != nil {
+		fn(e)
+	}
+}
+
+// EventHistory returns the most recent events, oldest first, limited to
+// eventType unless it is empty
+func (ps *Server) EventHistory(eventType string) []Event {
+	stored, err := ps.store.Events(eventType)
+	if err != nil {
+		ps.logger.Warn("Failed to read event history: %v", err)
+	}
+	events := make([]Event, 0, len(stored))
+	for _, se := range stored {
+		var e Event
+		if err := json.Unmarshal(se.Data, &e); err == nil {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// onClientChange is the client manager callback
+func (ps *Server) onClientChange(c *client.Client, connected bool, total int) {
+	info := tcpClientInfo(c)
+	e := Event{Type: EventClientDisconnected, Client: &info, Clients: total}
+	if connected {
+		e.Type = EventClientConnected
+	}
+	ps.emit(e)
+	if !connected {
+		for _, link := range ps.links {
+			link.ctrl.Forget(c.ID)
+		}
+	}
+
+	event := hooks.ClientDisconnect
+	if connected {
+		event = hooks.ClientConnect
+	}
+	ps.hooks.Fire(event, map[string]string{
+		"CLIENT_ID":   c.ID,
+		"CLIENT_ADDR": c.Addr,
+		"CLIENT_NAME": c.Name(),
+		"CLIENTS":     strconv.Itoa(total),
+	})
+}
+
+// watchState emits an event for every state change of link's connection
+func (ps *Server) watchState(link *upstreamLink) {
+	link.conn.SetOnStateChange(func(state upstream.ConnectionState) {
+		// With an init sequence, held data is sent once it has run
+		if state == upstream.StateConnected {
+			link.coord.Reset()
+			link.rate.Reset()
+			if link.framer != nil {
+				link.framer.Reset()
+			}
+			if link.replies != nil {
+				link.replies.reset()
+			}
+		}
+		if state == upstream.StateConnected && (ps.initSeq == nil || link.conn != ps.upstream) {
+			go ps.flushHeld()
+		}
+		ps.fireUpstreamHook(link, state)
+		if link.conn == ps.upstream {
+			switch state {
+			case upstream.StateConnected:
+				ps.recovery.Connected()
+			case upstream.StateDisconnected:
+				ps.recovery.Failed(link.conn.ConsecutiveFailures())
+			}
+		}
+		session, _ := link.conn.Session()
+		ps.emit(Event{
+			Type:    EventUpstreamState,
+			Clients: ps.clients.TotalCount(),
+			Upstream: &UpstreamInfo{
+				Name:    link.name,
+				Addr:    link.conn.GetAddr(),
+				State:   state.String(),
+				Session: session,
+			},
+		})
+	})
+}
+
+// fireUpstreamHook runs ON_UPSTREAM_UP when link connects and
+// ON_UPSTREAM_DOWN when a connected link is lost, but not when it is parked.
+// With HEALTH_DEBOUNCE_SECONDS the down hook waits that long, and neither
+// hook runs if the link reconnects in time.
+func (ps *Server) fireUpstreamHook(link *upstreamLink, state upstream.ConnectionState) {
+	d := ps.healthDebounce()
+	if state == upstream.StateConnected {
+		if d > 0 && link.outage.connect() && link.up.Load() {
+			link.conn.Log().Info("Upstream reconnected within %v, outage not reported", d)
+			return
+		}
+		if !link.up.Swap(true) {
+			ps.runUpstreamHook(hooks.UpstreamUp, link, state)
+		}
+		return
+	}
+	// Shutting down is reported at once
+	if d > 0 && state != upstream.StateStopped && !ps.parked.Load() {
+		link.outage.lose(time.Now(), d, func() { ps.reportLost(link) })
+		return
+	}
+	if link.up.Swap(false) && !ps.parked.Load() {
+		ps.runUpstreamHook(hooks.UpstreamDown, link, state)
+	}
+}
+
+// reportLost runs ON_UPSTREAM_DOWN for a link still down after
+// HEALTH_DEBOUNCE_SECONDS
+func (ps *Server) reportLost(link *upstreamLink) {
+	state := link.conn.GetState()
+	if state == upstream.StateConnected {
+		return
+	}
+	if link.up.Swap(false) && !ps.parked.Load() {
+		ps.runUpstreamHook(hooks.UpstreamDown, link, state)
+	}
+}
+
+// runUpstreamHook reports a change of link's state to the hooks and the
+// status clients
+func (ps *Server) runUpstreamHook(event string, link *upstreamLink, state upstream.ConnectionState) {
+	ps.statusLn.notify(link, event == hooks.UpstreamUp)
+	ps.hooks.Fire(event, map[string]string{
+		"UPSTREAM":       link.name,
+		"UPSTREAM_ADDR":  link.conn.GetAddr(),
+		"UPSTREAM_STATE": state.String(),
+	})
+}
+
+// EmitWebClient emits a client event for a WebSocket client of the web UI
+func (ps *Server) EmitWebClient(info ClientInfo, connected bool) {
+	e := Event{Type: EventClientDisconnected, Client: &info, Clients: ps.clients.TotalCount()}
+	if connected {
+		e.Type = EventClientConnected
+	}
+	ps.emit(e)
+}
@@ -0,0 +1,241 @@
+package proxy
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/bufpool"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/client"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/rfc2217"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/upstream"
+)
+
+var (
+	// ErrFlashing is returned while flashing mode gives another client
+	// exclusive use of the upstream
+	ErrFlashing = errors.New("flashing mode is active")
+	// ErrClientNotFound is returned for an unknown client ID
+	ErrClientNotFound = errors.New("client not found")
+)
+
+// FlashStatus describes flashing mode
+type FlashStatus struct {
+	Active       bool   `json:"active"`
+	ClientID     string `json:"client_id,omitempty"`
+	Upstream     string `json:"upstream,omitempty"`
+	Since        string `json:"since,omitempty"`
+	AutoDetected bool   `json:"auto_detected,omitempty"`
+	RFC2217      bool   `json:"rfc2217,omitempty"` // the client controls the port over RFC 2217
+}
+
+// flashSession gives one client exclusive use of an upstream, e.g. for
+// esptool or avrdude
+type flashSession struct {
+	client  *client.Client
+	link    *upstreamLink
+	started time.Time
+	auto    bool
+	restore *rfc2217.Params // serial settings to restore afterwards
+
+	// Used only by the client's goroutine
+	checked bool
+	telnet  *rfc2217.Server
+	warned  bool // about missing serial control
+
+	rfc2217 atomic.Bool
+}
+
+// StartFlashing gives the client exclusive use of the upstream until it
+// disconnects or StopFlashing is called
+func (ps *Server) StartFlashing(clientID string) error {
+	cl := ps.clients.Get(clientID)
+	if cl == nil {
+		return ErrClientNotFound
+	}
+	return ps.beginFlashing(cl, false)
+}
+
+// StopFlashing ends flashing mode. It reports whether it was active.
+func (ps *Server) StopFlashing() bool {
+	fs := ps.flash.Swap(nil)
+	if fs == nil {
+		return false
+	}
+	ps.finishFlashing(fs)
+	return true
+}
+
+// FlashStatus returns the state of flashing mode
+func (ps *Server) FlashStatus() FlashStatus {
+	fs := ps.flash.Load()
+	if fs == nil {
+		return FlashStatus{}
+	}
+	return FlashStatus{
+		Active:       true,
+		ClientID:     fs.client.ID,
+		Upstream:     fs.link.name,
+		Since:        fs.started.Format(time.RFC3339),
+		AutoDetected: fs.auto,
+		RFC2217:      fs.rfc2217.Load(),
+	}
+}
+
+func (ps *Server) beginFlashing(cl *client.Client, auto bool) error {
+	fs := &flashSession{client: cl, link: ps.directLink(), started: time.Now(), auto: auto}
+	if !ps.flash.CompareAndSwap(nil, fs) {
+		if cur := ps.flash.Load(); cur != nil && cur.client == cl {
+			return nil
+		}
+		return ErrFlashing
+	}
+
+	// Flashing tools may pause longer than the upstream read timeout, e.g.
+	// while the chip erases flash
+	fs.link.conn.SetReadTimeout(0)
+
+	if st, err := fs.link.conn.SerialStatus(); err == nil {
+		restore := st.Settings
+		if st.Reported != nil {
+			restore = st.Reported.Merge(st.Settings)
+		}
+		fs.restore = &restore
+	}
+
+	how := "started"
+	if auto {
+		how = "auto-detected"
+	}
+	cl.Log.Info("Flashing mode %s for %s on upstream %s", how, cl.ID, fs.link.name)
+	return nil
+}
+
+// finishFlashing restores the upstream after fs was removed from ps.flash
+func (ps *Server) finishFlashing(fs *flashSession) {
+	fs.link.conn.SetReadTimeout(upstream.DefaultReadTimeout)
+	fs.client.Log.Info("Flashing mode ended for %s after %s", fs.client.ID, time.Since(fs.started).Round(time.Second))
+	go ps.flushHeld()
+
+	if fs.restore != nil && fs.rfc2217.Load() {
+		go func() {
+			if _, err := fs.link.conn.SetSerialParams(*fs.restore); err != nil {
+				fs.link.conn.Log().Warn("Failed to restore serial settings after flashing: %v", err)
+			}
+		}()
+	}
+}
+
+// endFlashingFor ends flashing mode if cl holds it
+func (ps *Server) endFlashingFor(cl *client.Client) {
+	if fs := ps.flash.Load(); fs != nil && fs.client == cl && ps.flash.CompareAndSwap(fs, nil) {
+		ps.finishFlashing(fs)
+	}
+}
+
+// flashingFor returns the flashing session held by cl, if any
+func (ps *Server) flashingFor(cl *client.Client) *flashSession {
+	if fs := ps.flash.Load(); fs != nil && fs.client == cl {
+		return fs
+	}
+	return nil
+}
+
+// detectFlashing starts flashing mode with FLASH_AUTO_DETECT for a client
+// whose first data is Telnet negotiation, as sent by esptool and pyserial
+// for rfc2217:// ports
+func (ps *Server) detectFlashing(cl *client.Client, data []byte) {
+	if !ps.config.FlashAutoDetect || !rfc2217.IsTelnet(data) {
+		return
+	}
+	if err := ps.beginFlashing(cl, true); err != nil {
+		cl.Log.Warn("Client %s looks like a flashing tool, but flashing mode is held by another client", cl.ID)
+	}
+}
+
+// flashToUpstream forwards data from the flashing client unchanged: no
+// transform, write scheduling or triggers. Telnet commands from RFC 2217
+// clients are answered and applied to the upstream.
+func (ps *Server) flashToUpstream(fs *flashSession, data []byte) {
+	if !fs.checked {
+		fs.checked = true
+		if rfc2217.IsTelnet(data) {
+			fs.telnet = rfc2217.NewServer(flashPort{fs}, fs.client.Write)
+			fs.rfc2217.Store(true)
+		}
+	}
+	if fs.telnet != nil {
+		data = fs.telnet.Decode(data)
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	fs.client.Log.LogPacket("->UP", data, fs.client.ID)
+	if ps.withhold(data) {
+		return
+	}
+	if err := writeLink(fs.link, data); err != nil {
+		fs.client.Log.Warn("Failed to write to upstream from %s: %v", fs.client.ID, err)
+		ps.metrics.RecordDropped()
+		return
+	}
+	ps.journalClient(fs.client, data)
+	ps.metrics.RecordToUpstream(len(data))
+}
+
+// flashFromUpstream delivers raw upstream data to the flashing client only
+func (ps *Server) flashFromUpstream(fs *flashSession, link *upstreamLink, data []byte, f *bufpool.Frame) {
+	logPacket(link.conn.Log(), "UP->", data, f, ps.sourceTag(link))
+	ps.metrics.RecordFromUpstream(len(data))
+	if link != fs.link {
+		return
+	}
+
+	if fs.rfc2217.Load() {
+		data = rfc2217.Escape(data)
+	}
+	if err := fs.client.Write(data); err != nil {
+		fs.client.Log.Warn("Failed to write to %s [%s]: %v", fs.client.Addr, fs.client.ID, err)
+		ps.clients.Remove(fs.client.ID)
+	}
+}
+
+// flashPort applies serial control from a flashing client to its upstream.
+// Upstreams without serial control acknowledge the change without applying
+// it, so the tool carries on; the line is then set by the converter.
+type flashPort struct {
+	fs *flashSession
+}
+
+func (p flashPort) SetParams(params rfc2217.Params) (rfc2217.Params, error) {
+	st, err := p.fs.link.conn.SetSerialParams(params)
+	if err != nil {
+		p.unsupported(err)
+		return params, err
+	}
+	if st.Reported != nil {
+		return *st.Reported, nil
+	}
+	return st.Settings, nil
+}
+
+func (p flashPort) SetLines(u rfc2217.LineUpdate) (rfc2217.Lines, error) {
+	lines, err := p.fs.link.conn.SetLines(u)
+	if err != nil {
+		p.unsupported(err)
+	}
+	return lines, err
+}
+
+func (p flashPort) unsupported(err error) {
+	if errors.Is(err, upstream.ErrNoSerialControl) {
+		if !p.fs.warned {
+			p.fs.warned = true
+			p.fs.client.Log.Warn("Upstream %s has no serial control; baud rate and DTR/RTS changes from %s are not applied",
+				p.fs.link.name, p.fs.client.ID)
+		}
+		return
+	}
+	p.fs.client.Log.Warn("Serial control from %s failed: %v", p.fs.client.ID, err)
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/hexutil"
+)
+
+// clientGroup is a CLIENT_GROUPS group with its filter parsed
+type clientGroup struct {
+	config.ClientGroup
+	prefixes [][]byte
+}
+
+// clientGroups are the configured groups, in order
+type clientGroups []*clientGroup
+
+// newClientGroups parses the filters of groups, which the configuration
+// has validated
+func newClientGroups(groups []config.ClientGroup) clientGroups {
+	compiled := make(clientGroups, len(groups))
+	for i, g := range groups {
+		compiled[i] = &clientGroup{ClientGroup: g}
+		for _, prefix := range g.Filter {
+			b, _ := hexutil.Parse(prefix)
+			compiled[i].prefixes = append(compiled[i].prefixes, b)
+		}
+	}
+	return compiled
+}
+
+// find returns the group with the given name, or nil
+func (groups clientGroups) find(name string) *clientGroup {
+	for _, g := range groups {
+		if g.Name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// accept reports whether an upstream frame passes the group's filter
+func (g *clientGroup) accept(data []byte) bool {
+	for _, prefix := range g.prefixes {
+		if bytes.HasPrefix(data, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// setGroup places the client in the first group matching its address and
+// announced name, if any. Called again once the name is known.
+func (s *clientSession) setGroup() {
+	ip, name := net.ParseIP(hostOf(s.cl.Addr)), s.cl.Name()
+	for _, g := range s.ps.groups {
+		if !g.Matches(ip, name) {
+			continue
+		}
+		if s.cl.Group() == g.Name {
+			return
+		}
+		accept := g.accept
+		if len(g.prefixes) == 0 {
+			accept = nil
+		}
+		s.cl.SetGroup(g.Name, accept)
+		s.cl.Log.Info("Client %s joined group %q", s.cl.ID, g.Name)
+		return
+	}
+	s.cl.SetGroup("", nil)
+}
+
+// groupTarget resolves an injection target of the form "group:<name>"
+func (ps *Server) groupTarget(target string) (*clientGroup, bool) {
+	name, ok := strings.CutPrefix(target, "group:")
+	if !ok {
+		return nil, false
+	}
+	return ps.groups.find(name), true
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/hexutil"
+)
+
+// heartbeatSource marks heartbeat frames in the packet log
+const heartbeatSource = "HEARTBEAT"
+
+// heartbeat sends CLIENT_HEARTBEAT_FRAME to the clients once nothing was
+// sent to them for CLIENT_HEARTBEAT_SECONDS, for client software that
+// takes a quiet bus for a dead link and reconnects
+type heartbeat struct {
+	frame    []byte
+	interval time.Duration
+	last     atomic.Int64  // unix nanoseconds of the last frame sent to clients
+	sent     atomic.Uint64 // heartbeat frames sent
+}
+
+// newHeartbeat returns the heartbeat configured in ps, or nil when disabled
+func (ps *Server) newHeartbeat() *heartbeat {
+	if ps.config.HeartbeatSecs <= 0 {
+		return nil
+	}
+	frame, err := hexutil.Parse(ps.config.HeartbeatFrame)
+	if err != nil || len(frame) == 0 {
+		ps.logger.Error("Heartbeat disabled: invalid CLIENT_HEARTBEAT_FRAME %q", ps.config.HeartbeatFrame)
+		return nil
+	}
+	return &heartbeat{frame: frame, interval: time.Duration(ps.config.HeartbeatSecs) * time.Second}
+}
+
+// touch records that data was sent to the clients at t
+func (h *heartbeat) touch(t time.Time) {
+	if h != nil {
+		h.last.Store(t.UnixNano())
+	}
+}
+
+// sendHeartbeats sends the heartbeat frame whenever the clients got
+// nothing for the interval while the upstream is connected. Nothing is
+// sent while flashing or parked, or without clients.
+func (ps *Server) sendHeartbeats() {
+	defer ps.wg.Done()
+
+	h := ps.heartbeat
+	h.touch(time.Now())
+	ps.logger.Info("Heartbeat: sending %s to clients after %v without traffic", hexutil.Format(h.frame), h.interval)
+
+	ticker := time.NewTicker(min(h.interval/4, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, h.last.Load())) < h.interval {
+				continue
+			}
+			if !ps.IsUpstreamConnected() || ps.clients.Count() == 0 || ps.flash.Load() != nil || ps.parked.Load() {
+				continue
+			}
+			ps.logger.LogPacket("UP->", h.frame, heartbeatSource)
+			ps.clients.Broadcast(h.frame)
+			h.touch(now)
+			h.sent.Add(1)
+		case <-ps.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/hexutil"
+)
+
+// maxHexLine bounds a line from a hex client; longer lines are discarded
+const maxHexLine = 64 * 1024
+
+// hexConn presents the binary stream to a client as text, for LISTEN_FORMAT
+// and RAW_LISTEN_FORMAT "hex": every Write becomes one line of hex bytes,
+// and every line read is decoded into one frame. Lines that are not hex are
+// answered with an ERR line and dropped.
+type hexConn struct {
+	net.Conn
+
+	// Used only by the goroutine calling Read
+	line    []byte // input up to the next newline
+	pending []byte // decoded frame not yet returned
+	raw     []byte
+	skip    bool // discarding the rest of an overlong line
+}
+
+func newHexConn(conn net.Conn) *hexConn {
+	return &hexConn{Conn: conn, raw: make([]byte, 4096)}
+}
+
+func (c *hexConn) Write(b []byte) (int, error) {
+	if _, err := c.Conn.Write([]byte(hexutil.Format(b) + "\r\n")); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read returns the bytes of one decoded line at a time, so each line is
+// forwarded as one frame
+func (c *hexConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		i := bytes.IndexByte(c.line, '\n')
+		if i < 0 {
+			if len(c.line) > maxHexLine {
+				if !c.skip {
+					c.reply("ERR line too long")
+				}
+				c.line, c.skip = c.line[:0], true
+			}
+			n, err := c.Conn.Read(c.raw)
+			c.line = append(c.line, c.raw[:n]...)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		line := c.line[:i]
+		if c.skip {
+			c.skip = false
+		} else if data, err := hexutil.Parse(string(line)); err != nil {
+			c.reply("ERR invalid hex")
+		} else {
+			c.pending = data
+		}
+		c.line = c.line[:copy(c.line, c.line[i+1:])]
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// reply sends a text line to the client. net.Conn serializes writes, so it
+// never splits a line written by Write.
+func (c *hexConn) reply(msg string) {
+	_, _ = c.Conn.Write([]byte(msg + "\r\n"))
+}
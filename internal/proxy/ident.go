@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"regexp"
+	"time"
+)
+
+// identPrefix starts the line a client may send to name itself, e.g.
+// "IDENT heatpump-controller\n"
+const identPrefix = "IDENT "
+
+// maxIdentLine bounds how much data is held back while waiting for the end
+// of an identity line
+const maxIdentLine = 64
+
+var validClientName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,32}$`)
+
+// sendBanner writes CLIENT_BANNER to a new connection before it receives
+// any upstream data
+func (ps *Server) sendBanner(conn net.Conn) error {
+	if ps.config.ClientBanner == "" {
+		return nil
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, err := conn.Write([]byte(ps.config.ClientBanner + "\r\n"))
+	_ = conn.SetWriteDeadline(time.Time{})
+	return err
+}
+
+// identifies reports whether a new connection gets the IDENT handshake.
+// Raw and hex clients do not, as it would corrupt their stream.
+func (ps *Server) identifies(conn net.Conn, raw bool) bool {
+	_, hex := conn.(*hexConn)
+	return ps.config.IdentTimeout > 0 && !raw && !hex
+}
+
+// identify waits up to CLIENT_IDENT_TIMEOUT for the client's first bytes.
+// If they form an identity line with a valid name, the name and any bytes
+// after the line are returned. Otherwise everything read is returned to be
+// forwarded as usual, so clients that do not take part are unaffected.
+func (ps *Server) identify(conn net.Conn) (string, []byte, error) {
+	timeout := time.Duration(ps.config.IdentTimeout) * time.Second
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	// A client identifying before it is registered is not closed by Stop
+	stop := context.AfterFunc(ps.ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	f := bufferPool.GetFrame()
+	defer f.Release()
+	buf := f.Bytes()
+
+	var pending []byte
+	for {
+		n, err := conn.Read(buf)
+		pending = append(pending, buf[:n]...)
+
+		if !maybeIdent(pending) || len(pending) > maxIdentLine {
+			return "", pending, nil
+		}
+		if i := bytes.IndexByte(pending, '\n'); i >= 0 {
+			name := string(bytes.TrimRight(pending[len(identPrefix):i], "\r"))
+			if !validClientName.MatchString(name) {
+				ps.logger.Warn("Ignoring invalid client name %q from %s", name, conn.RemoteAddr())
+				name = ""
+			}
+			return name, pending[i+1:], nil
+		}
+
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return "", pending, nil
+			}
+			return "", nil, err
+		}
+	}
+}
+
+// maybeIdent reports whether data is, or could grow into, an identity line
+func maybeIdent(data []byte) bool {
+	if len(data) < len(identPrefix) {
+		return bytes.HasPrefix([]byte(identPrefix), data)
+	}
+	return bytes.HasPrefix(data, []byte(identPrefix))
+}
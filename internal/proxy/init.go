@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/hexutil"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/journal"
+)
+
+// InitStatus reports the last execution of the upstream init sequence
+type InitStatus struct {
+	Frames     int    `json:"frames"`
+	Runs       uint64 `json:"runs"`
+	LastRun    string `json:"last_run,omitempty"`
+	FramesSent int    `json:"frames_sent"`
+	LastError  string `json:"last_error,omitempty"`
+}
+
+type initFrame struct {
+	data  []byte
+	delay time.Duration
+}
+
+// initSequence sends configured frames to the upstream after each connect
+type initSequence struct {
+	frames []initFrame
+	runMu  sync.Mutex // serializes runs across quick reconnects
+	mu     sync.Mutex
+	status InitStatus
+}
+
+func (ps *Server) newInitSequence() (*initSequence, error) {
+	seq := &initSequence{}
+	for i, f := range ps.config.InitSequence {
+		data, err := hexutil.Parse(f.Data)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %w", i, err)
+		}
+		seq.frames = append(seq.frames, initFrame{
+			data:  data,
+			delay: time.Duration(f.DelayMs) * time.Millisecond,
+		})
+	}
+	seq.status.Frames = len(seq.frames)
+	return seq, nil
+}
+
+// runInitSequence is the upstream connect callback
+func (ps *Server) runInitSequence() {
+	// Data held during the outage follows the init sequence
+	defer ps.flushHeld()
+
+	seq := ps.initSeq
+	seq.runMu.Lock()
+	defer seq.runMu.Unlock()
+
+	log := ps.upstream.Log()
+	if ps.flash.Load() != nil {
+		log.Info("Skipping upstream init sequence while flashing")
+		return
+	}
+	log.Info("Running upstream init sequence (%d frames)", len(seq.frames))
+
+	sent := 0
+	var runErr error
+	for _, f := range seq.frames {
+		if f.delay > 0 {
+			select {
+			case <-time.After(f.delay):
+			case <-ps.ctx.Done():
+				return
+			}
+		}
+		if err := ps.upstream.Write(f.data); err != nil {
+			runErr = err
+			break
+		}
+		ps.journalWrite(journal.SourceInit, f.data)
+		log.LogPacket("->UP", f.data, "INIT")
+		ps.metrics.RecordToUpstream(len(f.data))
+		sent++
+	}
+
+	seq.mu.Lock()
+	seq.status.Runs++
+	seq.status.LastRun = time.Now().Format(time.RFC3339)
+	seq.status.FramesSent = sent
+	seq.status.LastError = ""
+	if runErr != nil {
+		seq.status.LastError = runErr.Error()
+	}
+	seq.mu.Unlock()
+
+	if runErr != nil {
+		log.Warn("Upstream init sequence failed after %d of %d frames: %v", sent, len(seq.frames), runErr)
+		return
+	}
+	log.Info("Upstream init sequence complete")
+}
+
+// GetInitStatus returns the init sequence status, or nil if none is configured
+func (ps *Server) GetInitStatus() *InitStatus {
+	if ps.initSeq == nil {
+		return nil
+	}
+	ps.initSeq.mu.Lock()
+	defer ps.initSeq.mu.Unlock()
+	st := ps.initSeq.status
+	return &st
+}
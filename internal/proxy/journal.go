@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/client"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/journal"
+)
+
+// openJournal opens WRITE_JOURNAL, if set. It is called by Start before
+// anything is written to an upstream.
+func (ps *Server) openJournal() error {
+	cfg := ps.config
+	if cfg.WriteJournal == "" {
+		return nil
+	}
+	maxMB := cfg.JournalMaxMB
+	if maxMB == 0 {
+		maxMB = config.DefaultJournalMB
+	}
+	j, err := journal.Open(cfg.WriteJournal, int64(maxMB)<<20, cfg.JournalFiles, ps.logger.Named("journal"))
+	if err != nil {
+		return err
+	}
+	ps.journal = j
+	ps.logger.Info("Journaling upstream writes to %s", cfg.WriteJournal)
+	return nil
+}
+
+// journaled returns write recording the data cl writes in WRITE_JOURNAL
+// once the write succeeded, including retries and writes held during an
+// outage, or write itself without a journal
+func (ps *Server) journaled(cl *client.Client, write func([]byte) error) func([]byte) error {
+	if ps.journal == nil {
+		return write
+	}
+	return func(data []byte) error {
+		if err := write(data); err != nil {
+			return err
+		}
+		ps.journalClient(cl, data)
+		return nil
+	}
+}
+
+// journalClient records data written to the upstream by cl
+func (ps *Server) journalClient(cl *client.Client, data []byte) {
+	ps.journal.Record(time.Now(), cl.ID, cl.Name(), cl.Addr, cl.Session, data)
+}
+
+// journalWrite records data the proxy wrote to the upstream on its own
+// behalf, source being one of the journal.Source constants
+func (ps *Server) journalWrite(source string, data []byte) {
+	ps.journal.Record(time.Now(), source, "", "", "", data)
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// slowAlertInterval is the minimum time between latency budget warnings
+const slowAlertInterval = 10 * time.Second
+
+// slowAlert rate-limits latency budget warnings, so a stalled client or
+// upstream does not flood the log
+type slowAlert struct {
+	mu     sync.Mutex
+	last   time.Time
+	missed int // overruns since the last warning
+}
+
+// due reports whether a warning may be logged now and how many overruns
+// went unreported before this one
+func (a *slowAlert) due(now time.Time) (int, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if now.Sub(a.last) < slowAlertInterval {
+		a.missed++
+		return 0, false
+	}
+	missed := a.missed
+	a.last, a.missed = now, 0
+	return missed, true
+}
+
+// observeForward records how long the proxy took to forward a packet and
+// warns when it exceeds LATENCY_BUDGET_MS. The time covers only the proxy's
+// side: from reading the packet to writing it out, including the write
+// queue and slow clients, but not the device's response time.
+func (ps *Server) observeForward(toUpstream bool, d time.Duration, source string) {
+	ps.metrics.RecordForward(toUpstream, d)
+
+	budget := time.Duration(ps.config.LatencyBudgetMs) * time.Millisecond
+	if budget <= 0 || d <= budget {
+		return
+	}
+	ps.metrics.RecordSlow()
+
+	missed, ok := ps.slow.due(time.Now())
+	if !ok {
+		return
+	}
+	path := "from upstream " + source + " to clients"
+	if toUpstream {
+		path = "from " + source + " to the upstream"
+	}
+	ps.logger.Warn("Forwarding a packet %s took %s, over the %dms latency budget (%d more since the last warning)",
+		path, d.Round(time.Microsecond), ps.config.LatencyBudgetMs, missed)
+}
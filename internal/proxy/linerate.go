@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"strings"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/linerate"
+)
+
+// lineRate estimates the data rate of link's serial line. On an RFC 2217
+// upstream it is compared with the line settings and error counts.
+func (ps *Server) lineRate(link *upstreamLink) linerate.Report {
+	var line linerate.Line
+	if st, err := link.conn.SerialStatus(); err == nil {
+		params := st.Settings
+		if st.Reported != nil && st.Reported.BaudRate != 0 {
+			params = *st.Reported
+		}
+		line.Baud, line.CharBits = params.BaudRate, params.CharBits()
+	}
+	if errs, err := link.conn.LineErrors(); err == nil {
+		line.Errors = &errs
+	}
+	return link.rate.Report(line, time.Now())
+}
+
+// GetLineRate returns the data rate estimate of the primary upstream
+func (ps *Server) GetLineRate() linerate.Report {
+	return ps.lineRate(ps.links[0])
+}
+
+// checkLineRates warns once about every new hint on an upstream's line
+func (ps *Server) checkLineRates() {
+	for _, link := range ps.links {
+		report := ps.lineRate(link)
+		var codes []string
+		for _, hint := range report.Hints {
+			codes = append(codes, hint.Code)
+			if !strings.Contains(","+link.hints+",", ","+hint.Code+",") {
+				link.conn.Log().With("hint", hint.Code).Warn("%s", hint.Message)
+			}
+		}
+		link.hints = strings.Join(codes, ",")
+	}
+}
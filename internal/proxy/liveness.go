@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/client"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/upstream"
+)
+
+// Reasons recorded for clients reaped by CLIENT_LIVENESS_TIMEOUT
+const (
+	ReasonIdle      = "idle"      // sent nothing within the timeout
+	ReasonKeepalive = "keepalive" // did not answer TCP keepalive probes
+)
+
+// keepaliveProbes is how many unanswered probes fail a client with
+// CLIENT_LIVENESS_CHECK=keepalive
+const keepaliveProbes = 3
+
+// reapCounts counts reaped clients by reason
+type reapCounts struct {
+	mu sync.Mutex
+	n  map[string]uint64
+}
+
+func (r *reapCounts) add(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.n == nil {
+		r.n = make(map[string]uint64)
+	}
+	r.n[reason]++
+}
+
+func (r *reapCounts) snapshot() map[string]uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := make(map[string]uint64, len(r.n))
+	for reason, count := range r.n {
+		n[reason] = count
+	}
+	return n
+}
+
+// livenessTimeout returns CLIENT_LIVENESS_TIMEOUT, or 0 when disabled
+func (ps *Server) livenessTimeout() time.Duration {
+	return time.Duration(ps.config.LivenessTimeout) * time.Second
+}
+
+// checksKeepalive reports whether liveness is enforced by TCP keepalive
+// rather than by client data
+func (ps *Server) checksKeepalive() bool {
+	return ps.livenessTimeout() > 0 && ps.config.LivenessCheck == config.LivenessKeepalive
+}
+
+// clientKeepalive returns the keepalive options for client sockets so that
+// a peer that stopped answering fails within CLIENT_LIVENESS_TIMEOUT, or
+// none unless CLIENT_LIVENESS_CHECK=keepalive
+func (ps *Server) clientKeepalive() upstream.TCPOptions {
+	if !ps.checksKeepalive() {
+		return upstream.TCPOptions{}
+	}
+	timeout := ps.livenessTimeout()
+	return upstream.TCPOptions{
+		UserTimeout:       timeout,
+		KeepAliveIdle:     max(timeout/2, time.Second),
+		KeepAliveInterval: max(timeout/(2*keepaliveProbes), time.Second),
+		KeepAliveCount:    keepaliveProbes,
+	}
+}
+
+// readFailed records a client whose read failed because its keepalive
+// probes went unanswered
+func (ps *Server) readFailed(cl *client.Client, err error) {
+	if ps.checksKeepalive() && errors.Is(err, syscall.ETIMEDOUT) {
+		ps.reap(cl, ReasonKeepalive)
+	}
+}
+
+// reapIdle disconnects clients that sent nothing within
+// CLIENT_LIVENESS_TIMEOUT, so that dead connections do not hold
+// MAX_CLIENTS slots
+func (ps *Server) reapIdle() {
+	defer ps.wg.Done()
+
+	timeout := ps.livenessTimeout()
+	ticker := time.NewTicker(min(timeout/4, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, cl := range ps.clients.GetAll() {
+				if now.Sub(cl.LastRead()) >= timeout {
+					ps.reap(cl, ReasonIdle)
+					ps.clients.Remove(cl.ID)
+				}
+			}
+		case <-ps.ctx.Done():
+			return
+		}
+	}
+}
+
+// reap records why a client is disconnected for failing the liveness check
+func (ps *Server) reap(cl *client.Client, reason string) {
+	cl.SetCloseReason(reason)
+	ps.reaped.add(reason)
+	log := cl.Log.With("reason", reason)
+	if reason == ReasonIdle {
+		log.Warn("Reaping client %s: sent nothing for %ds (CLIENT_LIVENESS_TIMEOUT)", cl.ID, ps.config.LivenessTimeout)
+	} else {
+		log.Warn("Reaping client %s: keepalive probes unanswered for %ds (CLIENT_LIVENESS_TIMEOUT)", cl.ID, ps.config.LivenessTimeout)
+	}
+}
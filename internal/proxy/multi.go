@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/client"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/codec"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/coordinator"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/framing"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/linerate"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/upstream"
+)
+
+// upstreamLink is one upstream device. The primary upstream is always
+// links[0]; additional upstreams come from UPSTREAMS.
+type upstreamLink struct {
+	name      string
+	index     byte
+	conn      *upstream.Connection
+	transform codec.Transform // TRANSFORM_FROM_UPSTREAM state for this link
+	framer    *framing.GapFramer
+	coord     *coordinator.Detector
+	ctrl      *coordinator.Controllers // CLIENT_CONTROLLER_WINDOW, nil when disabled
+	rate      *linerate.Estimator
+	replies   *replyWatch // RESPONSE_TIMEOUT_MS, nil when disabled
+	hints     string      // line rate hint codes last warned about
+	up        atomic.Bool // connected, as last reported to the hooks
+	outage    outage      // HEALTH_DEBOUNCE_SECONDS state
+}
+
+// UpstreamInfo describes one upstream in multi-upstream mode
+type UpstreamInfo struct {
+	Name        string                `json:"name"`
+	Addr        string                `json:"addr"`
+	State       string                `json:"state"`
+	Session     string                `json:"session,omitempty"`
+	Protocol    string                `json:"protocol,omitempty"` // with UPSTREAM_DETECT
+	Coordinator *coordinator.Info     `json:"coordinator,omitempty"`
+	Conflict    *coordinator.Conflict `json:"controller_conflict,omitempty"`
+	LineRate    linerate.Report       `json:"line_rate"`
+}
+
+func (ps *Server) addExtraUpstreams() {
+	for i, spec := range ps.config.Upstreams {
+		link := &upstreamLink{name: spec.Name, index: byte(i + 1), transform: ps.newUpstreamTransform()}
+		ps.setupFraming(link)
+		link.conn = upstream.NewConnection(spec.Addr, ps.logger.Named("upstream").With("upstream", spec.Name), nil)
+		ps.links = append(ps.links, link)
+	}
+}
+
+// newUpstreamTransform returns a fresh TRANSFORM_FROM_UPSTREAM instance. The
+// name was validated when the config was loaded.
+func (ps *Server) newUpstreamTransform() codec.Transform {
+	t, _ := codec.New(ps.config.TransformFrom)
+	return t
+}
+
+// setupFraming enables gap-based framing for link when FRAME_GAP_MS is set
+func (ps *Server) setupFraming(link *upstreamLink) {
+	if ps.config.FrameGapMs <= 0 {
+		return
+	}
+	gap := time.Duration(ps.config.FrameGapMs) * time.Millisecond
+	link.framer = framing.NewGapFramer(gap, func(frame []byte) {
+		ps.decodeUpstream(link, frame, nil)
+	})
+}
+
+// multiUpstream reports whether more than one upstream is configured
+func (ps *Server) multiUpstream() bool {
+	return len(ps.links) > 1
+}
+
+// sourceTag returns the log/trigger source for frames from link. The
+// primary upstream keeps an empty source unless several are configured.
+func (ps *Server) sourceTag(link *upstreamLink) string {
+	if !ps.multiUpstream() {
+		return ""
+	}
+	return link.name
+}
+
+// tagFrame prefixes data with the source header used when
+// UPSTREAM_SOURCE_TAGS is enabled: upstream index (0 = primary) followed by
+// the payload length as uint16 big-endian.
+func tagFrame(index byte, data []byte) []byte {
+	out := make([]byte, 3, 3+len(data))
+	out[0] = index
+	binary.BigEndian.PutUint16(out[1:], uint16(len(data)))
+	return append(out, data...)
+}
+
+// findLink returns the upstream with the given name
+func (ps *Server) findLink(name string) *upstreamLink {
+	for _, link := range ps.links {
+		if link.name == name {
+			return link
+		}
+	}
+	return nil
+}
+
+// directLink returns the upstream used by flashing and raw clients, which
+// bypass the write scheduling: the configured write target, or the primary
+// upstream
+func (ps *Server) directLink() *upstreamLink {
+	if link := ps.findLink(ps.config.UpstreamWrite); link != nil {
+		return link
+	}
+	return ps.links[0]
+}
+
+// writeUpstream sends client data to the configured write target. It
+// returns net.ErrClosed if no target upstream is connected.
+func (ps *Server) writeUpstream(data []byte) error {
+	switch target := ps.config.UpstreamWrite; target {
+	case "":
+		return writeLink(ps.links[0], data)
+	case config.UpstreamAll:
+		var firstErr error
+		written := false
+		for _, link := range ps.links {
+			if err := writeLink(link, data); err != nil {
+				if firstErr == nil || firstErr == net.ErrClosed {
+					firstErr = err
+				}
+				continue
+			}
+			written = true
+		}
+		if written {
+			return nil
+		}
+		return firstErr
+	default:
+		link := ps.findLink(target)
+		if link == nil {
+			return net.ErrClosed
+		}
+		return writeLink(link, data)
+	}
+}
+
+// clientWriter returns the write function for data from a processed client:
+// its bound upstream (TLS_ROUTES), or the configured write target
+func (ps *Server) clientWriter(cl *client.Client) func([]byte) error {
+	if cl.Upstream == "" {
+		return ps.journaled(cl, ps.writeUpstream)
+	}
+	link := ps.findLink(cl.Upstream)
+	return ps.journaled(cl, func(data []byte) error {
+		return writeLink(link, data)
+	})
+}
+
+// rawWriter returns the write function for data from a raw client: the
+// direct upstream
+func (ps *Server) rawWriter(cl *client.Client) func([]byte) error {
+	return ps.journaled(cl, ps.writeDirect)
+}
+
+// writeDirect sends raw client data to the direct upstream
+func (ps *Server) writeDirect(data []byte) error {
+	return writeLink(ps.directLink(), data)
+}
+
+func writeLink(link *upstreamLink, data []byte) error {
+	if !link.conn.IsConnected() {
+		return net.ErrClosed
+	}
+	return link.conn.Write(data)
+}
+
+// injectTarget resolves an injection target of the form "upstream:<name>"
+func (ps *Server) injectTarget(target string) (*upstreamLink, bool) {
+	name, ok := strings.CutPrefix(target, "upstream:")
+	if !ok {
+		return nil, false
+	}
+	return ps.findLink(name), true
+}
+
+// GetUpstreams returns the state of every upstream
+func (ps *Server) GetUpstreams() []UpstreamInfo {
+	result := make([]UpstreamInfo, 0, len(ps.links))
+	for _, link := range ps.links {
+		session, _ := link.conn.Session()
+		result = append(result, UpstreamInfo{
+			Name:        link.name,
+			Addr:        link.conn.GetAddr(),
+			State:       link.conn.GetState().String(),
+			Session:     session,
+			Protocol:    link.conn.Protocol(),
+			Coordinator: link.coord.Info(),
+			Conflict:    link.ctrl.Conflict(),
+			LineRate:    ps.lineRate(link),
+		})
+	}
+	return result
+}
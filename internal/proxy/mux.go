@@ -0,0 +1,24 @@
+package proxy
+
+import "github.com/hoon-ch/serial-tcp-proxy/internal/transport"
+
+// MuxStatus describes the multiplexed sessions of the proxy: those peers
+// opened on MUX_LISTEN_PORT and those opened for mux:// upstreams
+type MuxStatus struct {
+	Listening bool                        `json:"listening"`
+	Listener  []transport.MuxSessionStats `json:"listener"`
+	Dialed    []transport.MuxSessionStats `json:"dialed"`
+}
+
+// MuxStatus returns the multiplexed sessions and their channels
+func (ps *Server) MuxStatus() MuxStatus {
+	st := MuxStatus{
+		Listener: []transport.MuxSessionStats{},
+		Dialed:   transport.MuxDialedSessions(),
+	}
+	if ps.muxLn != nil {
+		st.Listening = true
+		st.Listener = ps.muxLn.Sessions()
+	}
+	return st
+}
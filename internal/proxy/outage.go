@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/client"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+)
+
+// errHeld is returned by writeHeld for data that was held, or dropped
+// because the client's outage buffer is full
+var errHeld = errors.New("held while the upstream is down")
+
+// heldWrites holds a client's data while the upstream is down, for the
+// "buffer" outage policy
+type heldWrites struct {
+	cl    *client.Client
+	write func([]byte) error // writes to the client's upstream
+	limit int
+
+	mu     sync.Mutex
+	frames [][]byte
+	size   int
+	full   bool // the overflow was logged
+}
+
+// outagePolicy returns the outage policy and buffer size of the first
+// CLIENT_OUTAGE_POLICIES rule matching the client's address, or the
+// defaults
+func (ps *Server) outagePolicy(cl *client.Client) (string, int) {
+	policy, size := ps.config.OutagePolicy, ps.config.OutageBuffer
+	ip := net.ParseIP(hostOf(cl.Addr))
+	for _, rule := range ps.config.OutageRules {
+		if rule.Matches(ip) {
+			policy = rule.Policy
+			if rule.Buffer > 0 {
+				size = rule.Buffer
+			}
+			break
+		}
+	}
+	if policy == "" {
+		policy = config.OutageDrop
+	}
+	if size == 0 {
+		size = config.DefaultOutageBuffer
+	}
+	return policy, size
+}
+
+// holdFor sets up the outage buffer of a client with the "buffer" policy
+func (ps *Server) holdFor(cl *client.Client, write func([]byte) error) {
+	if policy, size := ps.outagePolicy(cl); policy == config.OutageBuffer {
+		ps.held.Store(cl, &heldWrites{cl: cl, write: write, limit: size})
+	}
+}
+
+// releaseHeld discards the outage buffer of a disconnected client
+func (ps *Server) releaseHeld(cl *client.Client) {
+	v, ok := ps.held.LoadAndDelete(cl)
+	if !ok {
+		return
+	}
+	h := v.(*heldWrites)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.size > 0 {
+		cl.Log.Warn("Discarding %d buffered bytes from %s", h.size, cl.ID)
+	}
+}
+
+// writeClient writes client data to its upstream, holding it if the client
+// has an outage buffer
+func (ps *Server) writeClient(cl *client.Client, data []byte, write func([]byte) error) error {
+	if v, ok := ps.held.Load(cl); ok {
+		return ps.writeHeld(v.(*heldWrites), data)
+	}
+	return write(data)
+}
+
+// writeHeld writes data unless the upstream is down or earlier data is
+// still held, in which case data is held in order. It returns errHeld for
+// data it held or dropped.
+func (ps *Server) writeHeld(h *heldWrites, data []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ps.sendHeld(h)
+	if len(h.frames) == 0 {
+		if err := h.write(data); !errors.Is(err, net.ErrClosed) {
+			return err
+		}
+	}
+
+	if h.size+len(data) > h.limit {
+		if !h.full {
+			h.full = true
+			h.cl.Log.Warn("Outage buffer of %s is full (%d bytes), dropping data", h.cl.ID, h.limit)
+		}
+		ps.metrics.RecordDropped()
+		return errHeld
+	}
+	if h.size == 0 {
+		h.cl.Log.Warn("Upstream not connected, buffering data from %s", h.cl.ID)
+	}
+	h.frames = append(h.frames, append([]byte(nil), data...))
+	h.size += len(data)
+	return errHeld
+}
+
+// sendHeld writes held data until the buffer is empty or the upstream is
+// down. The caller holds h.mu.
+func (ps *Server) sendHeld(h *heldWrites) {
+	sent := 0
+	for len(h.frames) > 0 {
+		data := h.frames[0]
+		if err := h.write(data); errors.Is(err, net.ErrClosed) {
+			break
+		} else if err != nil {
+			h.cl.Log.Warn("Failed to write buffered data from %s: %v", h.cl.ID, err)
+			ps.metrics.RecordDropped()
+		} else {
+			ps.metrics.RecordToUpstream(len(data))
+			sent += len(data)
+		}
+		h.frames[0] = nil
+		h.frames = h.frames[1:]
+		h.size -= len(data)
+	}
+	if len(h.frames) == 0 {
+		h.frames, h.full = nil, false
+	}
+	if sent > 0 {
+		h.cl.Log.Info("Sent %d buffered bytes from %s", sent, h.cl.ID)
+	}
+}
+
+// flushHeld sends the data held for every client, once an upstream is
+// connected. Held data waits while forwarding is paused or a client is
+// flashing, and is then sent before the client's next write. Frames
+// waiting for a write retry are older and go first.
+func (ps *Server) flushHeld() {
+	if ps.paused.Load() || ps.flash.Load() != nil {
+		return
+	}
+	ps.flushRetries()
+	ps.held.Range(func(_, v any) bool {
+		h := v.(*heldWrites)
+		h.mu.Lock()
+		ps.sendHeld(h)
+		h.mu.Unlock()
+		return true
+	})
+}
+
+// upstreamDown applies the "drop" or "close" outage policy to data from a
+// client without an outage buffer
+func (ps *Server) upstreamDown(cl *client.Client) {
+	ps.metrics.RecordDropped()
+	if policy, _ := ps.outagePolicy(cl); policy == config.OutageClose {
+		cl.Log.Warn("Upstream not connected, disconnecting %s", cl.ID)
+		ps.clients.Remove(cl.ID)
+		return
+	}
+	cl.Log.Warn("Upstream not connected, dropping packet from %s", cl.ID)
+}
@@ -0,0 +1,33 @@
+package proxy
+
+import "errors"
+
+// ErrParked is returned by InjectPacket while the proxy is parked
+var ErrParked = errors.New("proxy is parked")
+
+// SetParked parks or resumes the proxy, overriding START_PARKED until the
+// next restart. Parking closes every upstream connection and disconnects
+// TCP clients, and new clients are refused until resumed, so that another
+// program such as the converter's configuration utility can take the
+// converter's single socket. The web UI stays available.
+func (ps *Server) SetParked(parked bool) {
+	if ps.parked.Swap(parked) == parked {
+		return
+	}
+	for _, link := range ps.links {
+		link.conn.SetParked(parked)
+	}
+	if !parked {
+		ps.logger.Info("Proxy resumed: reconnecting to the upstream")
+		return
+	}
+	ps.logger.Info("Proxy parked: upstream released, clients refused until resumed")
+	for _, cl := range ps.clients.GetAll() {
+		ps.clients.Remove(cl.ID)
+	}
+}
+
+// Parked reports whether the proxy is parked
+func (ps *Server) Parked() bool {
+	return ps.parked.Load()
+}
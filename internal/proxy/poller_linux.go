@@ -0,0 +1,261 @@
+//go:build linux
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+)
+
+// pollEvents arms a connection for one readiness event. Level-triggered, so
+// re-arming a connection with unread data reports it again right away.
+const pollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// poller reads client connections for CLIENT_ENGINE=epoll. Idle clients
+// wait in one epoll instance instead of each holding a goroutine blocked in
+// Read; a client gets a goroutine only while it has data to read.
+type poller struct {
+	epfd   int
+	wake   [2]int // pipe that interrupts EpollWait once the context is done
+	log    *logger.Logger
+	mu     sync.Mutex
+	conns  map[int]*pollConn // by file descriptor
+	closed bool
+}
+
+// pollConn is a TCP client connection read by the poller
+type pollConn struct {
+	*net.TCPConn
+	p         *poller
+	rc        syscall.RawConn
+	fd        int
+	session   atomic.Pointer[clientSession]
+	busy      atomic.Bool // a goroutine is reading the connection
+	closeOnce sync.Once
+}
+
+func newPoller(log *logger.Logger) (*poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	p := &poller{epfd: epfd, log: log, conns: make(map[int]*pollConn)}
+	if err := syscall.Pipe2(p.wake[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	ev := &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(p.wake[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, p.wake[0], ev); err != nil {
+		p.closeFDs()
+		return nil, err
+	}
+	return p, nil
+}
+
+// wrap returns conn as a pollConn if it is a TCP connection; other
+// connections keep a goroutine of their own
+func (p *poller) wrap(conn net.Conn) net.Conn {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return conn
+	}
+	rc, err := tcp.SyscallConn()
+	if err != nil {
+		return conn
+	}
+	c := &pollConn{TCPConn: tcp, p: p, rc: rc, fd: -1}
+	if err := rc.Control(func(fd uintptr) { c.fd = int(fd) }); err != nil {
+		return conn
+	}
+	return c
+}
+
+// run hands readable connections to reader goroutines until ctx is done,
+// then ends the sessions of the remaining clients. Unlike goroutines blocked
+// in Read, idle polled clients would otherwise wait out the shutdown grace
+// period.
+func (p *poller) run(ctx context.Context) {
+	stop := context.AfterFunc(ctx, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if !p.closed {
+			_, _ = syscall.Write(p.wake[1], []byte{0})
+		}
+	})
+	defer stop()
+
+	events := make([]syscall.EpollEvent, 128)
+	for ctx.Err() == nil {
+		// Wait without a timeout; the wake pipe becomes readable on cancel
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			p.log.Error("Client poller failed: %v", err)
+			return
+		}
+		for _, ev := range events[:n] {
+			if int(ev.Fd) == p.wake[0] {
+				continue
+			}
+			p.mu.Lock()
+			c := p.conns[int(ev.Fd)]
+			p.mu.Unlock()
+			if c != nil {
+				go c.drain(ctx)
+			}
+		}
+	}
+
+	p.mu.Lock()
+	conns := make([]*pollConn, 0, len(p.conns))
+	for _, c := range p.conns {
+		conns = append(conns, c)
+	}
+	p.mu.Unlock()
+	for _, c := range conns {
+		c.session.Load().end()
+	}
+}
+
+// close releases the epoll instance once every client is closed
+func (p *poller) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		p.closeFDs()
+	}
+}
+
+func (p *poller) closeFDs() {
+	syscall.Close(p.wake[0])
+	syscall.Close(p.wake[1])
+	syscall.Close(p.epfd)
+}
+
+// watch starts reading the connection for s
+func (c *pollConn) watch(s *clientSession) error {
+	c.session.Store(s)
+	c.p.mu.Lock()
+	defer c.p.mu.Unlock()
+	if c.p.closed {
+		return net.ErrClosed
+	}
+	c.p.conns[c.fd] = c
+	err := c.control(syscall.EPOLL_CTL_ADD)
+	if err != nil {
+		delete(c.p.conns, c.fd)
+	}
+	return err
+}
+
+// control changes the connection's registration. The descriptor is used
+// under the connection's lock, so it cannot be closed and reused meanwhile.
+func (c *pollConn) control(op int) error {
+	var opErr error
+	err := c.rc.Control(func(fd uintptr) {
+		opErr = syscall.EpollCtl(c.p.epfd, op, int(fd), &syscall.EpollEvent{Events: pollEvents, Fd: int32(fd)})
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
+
+// drain reads and forwards data until the connection has none left, then
+// re-arms it. A stale event for a reused descriptor finds no data and only
+// re-arms.
+func (c *pollConn) drain(ctx context.Context) {
+	if !c.busy.CompareAndSwap(false, true) {
+		return
+	}
+	s := c.session.Load()
+	for {
+		if ctx.Err() != nil {
+			s.end()
+			return
+		}
+
+		f := bufferPool.GetFrame()
+		n, err := c.read(f.Bytes())
+		if errors.Is(err, syscall.EAGAIN) {
+			f.Release()
+			c.busy.Store(false)
+			c.p.mu.Lock()
+			if !c.p.closed {
+				_ = c.control(syscall.EPOLL_CTL_MOD)
+			}
+			c.p.mu.Unlock()
+			return
+		}
+		if err != nil || n == 0 {
+			f.Release()
+			if err != nil {
+				s.ps.readFailed(s.cl, err)
+			}
+			s.end()
+			return
+		}
+
+		f.Truncate(n)
+		ok := s.process(f.Bytes(), f)
+		f.Release()
+		if !ok {
+			s.end()
+			return
+		}
+	}
+}
+
+// read reads without waiting; it returns EAGAIN when no data is available
+func (c *pollConn) read(b []byte) (int, error) {
+	var n int
+	var opErr error
+	err := c.rc.Read(func(fd uintptr) bool {
+		for {
+			n, opErr = syscall.Read(int(fd), b)
+			if opErr != syscall.EINTR {
+				return true
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if opErr != nil {
+		return 0, opErr
+	}
+	return n, nil
+}
+
+// Close stops polling the connection before closing it. Closing from
+// outside, e.g. by Manager.Remove, ends the session like a read error does.
+func (c *pollConn) Close() error {
+	err := net.ErrClosed
+	first := false
+	c.closeOnce.Do(func() {
+		first = true
+		c.p.mu.Lock()
+		if c.p.conns[c.fd] == c {
+			delete(c.p.conns, c.fd)
+			if !c.p.closed {
+				_ = c.control(syscall.EPOLL_CTL_DEL)
+			}
+		}
+		c.p.mu.Unlock()
+		err = c.TCPConn.Close()
+	})
+	if s := c.session.Load(); first && s != nil {
+		// Callers such as Manager.Remove hold locks that end takes
+		go s.end()
+	}
+	return err
+}
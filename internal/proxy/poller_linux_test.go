@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/pkg/testutil"
+)
+
+func TestServer_EpollEngine(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   50,
+		ClientEngine: config.EngineEpoll,
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	upstream.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not connected")
+
+	// Idle clients hold no goroutine of their own
+	base := runtime.NumGoroutine()
+	clients := make([]net.Conn, 30)
+	for i := range clients {
+		clients[i] = testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	}
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == len(clients) }, "clients not registered")
+	testutil.Eventually(t, func() bool { return runtime.NumGoroutine() < base+len(clients)/2 }, "a goroutine per idle client")
+
+	upstream.Send([]byte{0xAA, 0xBB})
+	for _, c := range clients {
+		testutil.ExpectRead(t, c, []byte{0xAA, 0xBB})
+	}
+
+	if _, err := clients[0].Write([]byte{0x01, 0x02}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	upstream.Expect([]byte{0x01, 0x02})
+	if _, err := clients[1].Write([]byte{0x03}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	upstream.Expect([]byte{0x03})
+
+	// Clients leaving, or disconnected by the proxy, are removed
+	clients[2].Close()
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == len(clients)-1 }, "closed client not removed")
+	id := proxy.GetClients()[0].ID
+	if !proxy.DisconnectClient(id) {
+		t.Fatalf("Expected %s to be disconnected", id)
+	}
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == len(clients)-2 }, "disconnected client not removed")
+}
+
+func TestPoller_WakesOnCancel(t *testing.T) {
+	// The poller waits without a timeout and returns as soon as the
+	// context is done
+	p, err := newPoller(newTestLogger())
+	if err != nil {
+		t.Fatalf("Failed to create poller: %v", err)
+	}
+	defer p.close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.run(ctx)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("Poller did not return after cancel")
+	}
+}
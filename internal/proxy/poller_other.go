@@ -0,0 +1,30 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+)
+
+// poller is only implemented on Linux
+type poller struct{}
+
+type pollConn struct {
+	*net.TCPConn
+}
+
+func newPoller(*logger.Logger) (*poller, error) {
+	return nil, errors.New("CLIENT_ENGINE=epoll requires Linux")
+}
+
+func (p *poller) wrap(conn net.Conn) net.Conn { return conn }
+
+func (p *poller) run(context.Context) {}
+
+func (p *poller) close() {}
+
+func (c *pollConn) watch(*clientSession) error { return errors.ErrUnsupported }
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+)
+
+// ReasonReplaced is recorded for a client disconnected by a newer
+// connection on a port with LISTEN_SINGLE_CLIENT or RAW_LISTEN_SINGLE_CLIENT
+const ReasonReplaced = "replaced"
+
+// clientPort is how a listener serves its connections
+type clientPort struct {
+	name    string // environment variable of the port, for the log
+	profile string // LISTEN_PROFILE or RAW_LISTEN_PROFILE
+	raw     bool   // the unprocessed stream, without banner or IDENT handshake
+	hex     bool   // hex line format
+	single  bool   // a new connection replaces the current one
+
+	mu      sync.Mutex
+	current net.Conn // last connection served, with single
+}
+
+// clientPorts are the listeners' ways of serving clients
+type clientPorts struct {
+	plain  *clientPort // LISTEN_PORT
+	raw    *clientPort // RAW_LISTEN_PORT
+	tunnel *clientPort // TLS_LISTEN_PORT, QUIC_LISTEN_PORT and MUX_LISTEN_PORT
+}
+
+// newClientPorts applies the formats and profiles of the configuration. An
+// "esphome" port serves the raw stream, as ESPHome's stream_server passes
+// the UART through untouched.
+func newClientPorts(cfg *config.Config) clientPorts {
+	return clientPorts{
+		plain: &clientPort{
+			name:    "LISTEN_PORT",
+			profile: cfg.ListenProfile,
+			raw:     cfg.ListenProfile == config.ProfileESPHome,
+			hex:     cfg.ListenFormat == config.FormatHex,
+			single:  cfg.ListenSingle,
+		},
+		raw: &clientPort{
+			name:    "RAW_LISTEN_PORT",
+			profile: cfg.RawListenProfile,
+			raw:     true,
+			hex:     cfg.RawListenFormat == config.FormatHex,
+			single:  cfg.RawListenSingle,
+		},
+		tunnel: &clientPort{hex: cfg.ListenFormat == config.FormatHex},
+	}
+}
+
+// servesRaw reports whether any port has clients of the raw stream
+func (ports clientPorts) servesRaw(cfg *config.Config) bool {
+	return cfg.RawListenPort > 0 || ports.plain.raw
+}
+
+// String describes the profile and single client mode for the startup log,
+// e.g. " (esphome profile, single client)", or returns "" for defaults
+func (p *clientPort) String() string {
+	var opts []string
+	if p.profile != "" && p.profile != config.ProfileDefault {
+		opts = append(opts, p.profile+" profile")
+	}
+	if p.single {
+		opts = append(opts, "single client")
+	}
+	if len(opts) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(opts, ", ") + ")"
+}
+
+// replace disconnects the port's current client in favour of conn, as a
+// device bridge serving a single client does, so a client reconnecting
+// after a network change is not locked out by its stale connection
+func (p *clientPort) replace(ps *Server, conn net.Conn) {
+	p.mu.Lock()
+	prev := p.current
+	p.current = conn
+	p.mu.Unlock()
+	if prev == nil {
+		return
+	}
+	addr := prev.RemoteAddr().String()
+	for _, cl := range ps.clients.GetAll() {
+		if cl.Addr == addr {
+			cl.Log.Info("Client %s replaced by a new connection from %s on %s", cl.ID, conn.RemoteAddr(), p.name)
+			cl.SetCloseReason(ReasonReplaced)
+			ps.clients.Remove(cl.ID)
+			return
+		}
+	}
+	// Not registered yet, or already gone
+	prev.Close()
+}
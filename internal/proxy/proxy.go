@@ -2,24 +2,42 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/hoon-ch/serial-tcp-proxy/internal/bufpool"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/client"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/codec"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/connlimit"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/coordinator"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/hooks"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/journal"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/linerate"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/metrics"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/mqtt"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/poll"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/recovery"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/sched"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/storage"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/transport"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/trigger"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/upstream"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/values"
 )
 
 // Buffer pool for zero-copy packet forwarding
-var bufferPool = sync.Pool{
-	New: func() interface{} {
-		buf := make([]byte, 4096)
-		return &buf
-	},
-}
+var bufferPool = bufpool.New("client-read", 4096)
+
+// shutdownTimeout is how long Stop waits for clients when its context has
+// no deadline
+const shutdownTimeout = 5 * time.Second
 
 type Server struct {
 	config     *config.Config
@@ -27,11 +45,49 @@ type Server struct {
 	clients    *client.Manager
 	logger     *logger.Logger
 	listener   net.Listener
+	rawLn      net.Listener // RAW_LISTEN_PORT
+	tlsLn      net.Listener // TLS_LISTEN_PORT
+	tlsConf    *tls.Config
+	poller     *poller // CLIENT_ENGINE=epoll
 	listenerMu sync.RWMutex
+	quicLn     *transport.QUICListener
+	statusLn   *statusListener        // STATUS_LISTEN_PORT, nil when disabled
+	muxLn      *transport.MuxListener // MUX_LISTEN_PORT
 	ctx        context.Context
 	cancel     context.CancelFunc
 	wg         sync.WaitGroup
 	startTime  time.Time
+	metrics    metrics.Counters
+	store      storage.Storage // events and traffic samples, shared with the web server
+	triggers   *trigger.Engine
+	deny       *denyList    // DENY_FRAMES, checked on every write toward an upstream
+	access     []accessRule // CLIENT_ACCESS_RULES with their hours parsed
+	scheduled  bool         // some CLIENT_ACCESS_RULES rule has hours
+	groups     clientGroups // CLIENT_GROUPS with their filters parsed
+	hooks      *hooks.Runner
+	journal    *journal.Journal
+	recovery   *recovery.Engine
+	initSeq    *initSequence
+	polls      *poll.Engine
+	values     *values.Extractor
+	links      []*upstreamLink
+	ports      clientPorts
+	sched      *sched.Scheduler
+	connLimit  *connlimit.Limiter
+	memStats   memStatsCache
+	paused     atomic.Bool // forwarding paused from the web UI
+	noInject   atomic.Bool // INJECT_ENABLED=false or switched off at runtime
+	dryRun     atomic.Bool // client writes are logged and counted, not forwarded
+	slow       slowAlert
+	noReply    slowAlert
+	events     eventHub
+	flash      atomic.Pointer[flashSession]
+	held       sync.Map    // *client.Client to *heldWrites, for CLIENT_OUTAGE_POLICY=buffer
+	retries    *retryQueue // UPSTREAM_RETRY_FRAMES, nil when disabled
+	starting   atomic.Bool // waiting for the upstream before listening
+	parked     atomic.Bool // upstream released and clients refused
+	reaped     reapCounts  // clients failing CLIENT_LIVENESS_TIMEOUT
+	heartbeat  *heartbeat  // CLIENT_HEARTBEAT_SECONDS, nil when disabled
 }
 
 func NewServer(cfg *config.Config, log *logger.Logger) *Server {
@@ -39,33 +95,250 @@ func NewServer(cfg *config.Config, log *logger.Logger) *Server {
 
 	ps := &Server{
 		config:    cfg,
-		logger:    log,
-		clients:   client.NewManager(cfg.MaxClients, log),
+		logger:    log.Named("proxy"),
+		clients:   client.NewManager(cfg.MaxClients, log.Named("client")),
 		ctx:       ctx,
 		cancel:    cancel,
 		startTime: time.Now(),
+		store:     storage.NewMemory(storage.LimitsFor(cfg)),
+		retries:   newRetryQueue(cfg),
+		ports:     newClientPorts(cfg),
+	}
+
+	// Create upstream connections; received data arrives in pooled frames
+	ps.upstream = upstream.NewConnection(cfg.UpstreamAddr(), log.Named("upstream"), nil)
+	ps.links = []*upstreamLink{{name: cfg.UpstreamName, conn: ps.upstream, transform: ps.newUpstreamTransform()}}
+	ps.setupFraming(ps.links[0])
+	ps.addExtraUpstreams()
+	tcpOpts := upstream.TCPOptions{
+		UserTimeout:       time.Duration(cfg.TCPUserTimeout) * time.Second,
+		KeepAliveIdle:     time.Duration(cfg.TCPKeepIdle) * time.Second,
+		KeepAliveInterval: time.Duration(cfg.TCPKeepInterval) * time.Second,
+		KeepAliveCount:    cfg.TCPKeepCount,
+		DSCP:              cfg.SocketDSCP,
+		Priority:          cfg.SocketPriority,
+	}
+	for _, link := range ps.links {
+		link.coord = coordinator.NewDetector()
+		if cfg.ControllerSecs > 0 {
+			link.ctrl = coordinator.NewControllers(time.Duration(cfg.ControllerSecs) * time.Second)
+		}
+		link.rate = linerate.NewEstimator()
+		if cfg.ResponseTimeoutMs > 0 {
+			link.replies = &replyWatch{}
+		}
+		link.conn.SetTCPOptions(tcpOpts)
+		link.conn.SetDetectProtocol(cfg.UpstreamDetect)
+		link.conn.SetQuirks(upstream.Quirks{
+			Banner: cfg.HasQuirk(config.QuirkBanner),
+			Telnet: cfg.HasQuirk(config.QuirkTelnet),
+			OTA:    cfg.HasQuirk(config.QuirkOTA),
+		})
+		link.conn.SetOnFrame(func(f *bufpool.Frame) {
+			ps.receiveUpstream(link, f)
+		})
+		ps.watchState(link)
+	}
+	ps.hooks = hooks.New(map[string]string{
+		hooks.UpstreamUp:       cfg.OnUpstreamUp,
+		hooks.UpstreamDown:     cfg.OnUpstreamDown,
+		hooks.ClientConnect:    cfg.OnClientConnect,
+		hooks.ClientDisconnect: cfg.OnClientClose,
+	}, time.Duration(cfg.HookTimeout)*time.Second, log.Named("hooks"))
+	ps.clients.SetOnChange(ps.onClientChange)
+	ps.noInject.Store(!cfg.InjectionEnabled())
+	ps.dryRun.Store(cfg.DryRun)
+	if cfg.StartParked {
+		ps.SetParked(true)
+	}
+	mqttOpts := mqtt.Options{
+		Broker:   cfg.MQTTBroker,
+		ClientID: cfg.MQTTClientID,
+		Username: cfg.MQTTUsername,
+		Password: cfg.MQTTPassword,
+	}
+	ps.recovery = recovery.New(recovery.Options{
+		After:       cfg.RecoveryAfter,
+		Cooldown:    time.Duration(cfg.RecoveryPause) * time.Second,
+		MaxAttempts: cfg.RecoveryMax,
+		URL:         cfg.RecoveryURL,
+		Method:      cfg.RecoveryMethod,
+		MQTTTopic:   cfg.RecoveryTopic,
+		MQTTPayload: cfg.RecoveryPayload,
+		MQTT:        mqttOpts,
+	}, cfg.UpstreamName, log.Named("recovery"), func(a recovery.Attempt) {
+		ps.emit(Event{Type: EventRecovery, Clients: ps.clients.TotalCount(), Recovery: &a})
+	})
+	if cfg.UpstreamType == config.UpstreamTypeMQTT {
+		opts := transport.MQTTOptions{
+			Options: mqttOpts,
+			RxTopic: cfg.MQTTRxTopic,
+			TxTopic: cfg.MQTTTxTopic,
+		}
+		ps.upstream.SetDialer(func(ctx context.Context) (net.Conn, error) {
+			return transport.DialMQTT(ctx, opts)
+		})
+	}
+
+	ps.heartbeat = ps.newHeartbeat()
+
+	if len(cfg.InitSequence) > 0 {
+		seq, err := ps.newInitSequence()
+		if err != nil {
+			ps.logger.Error("Init sequence disabled: %v", err)
+		} else {
+			ps.initSeq = seq
+			ps.upstream.SetOnConnect(ps.runInitSequence)
+		}
+	}
+
+	if cfg.FairWrites {
+		ps.sched = sched.New()
+	}
+
+	if cfg.ConnectRate > 0 || cfg.MaxClientsPerIP > 0 {
+		greylist := time.Duration(cfg.GreylistSecs) * time.Second
+		ps.connLimit = connlimit.New(cfg.ConnectRate, cfg.MaxClientsPerIP, greylist)
+	}
+
+	if len(cfg.Values) > 0 {
+		ps.values = values.NewExtractor(cfg.Values)
 	}
 
-	// Create upstream connection with callback for received data
-	ps.upstream = upstream.NewConnection(cfg.UpstreamAddr(), log, ps.onUpstreamData)
+	if len(cfg.Polls) > 0 {
+		ps.polls = poll.NewEngine(cfg.Polls, ps.sendPoll)
+	}
+
+	ps.access, ps.scheduled = newAccessRules(cfg.AccessRules)
+	ps.groups = newClientGroups(cfg.ClientGroups)
+
+	if deny, err := newDenyList(cfg.DenyFrames); err != nil {
+		ps.logger.Error("Deny list disabled: %v", err)
+	} else {
+		ps.deny = deny
+	}
+
+	if len(cfg.Triggers) > 0 {
+		engine, err := trigger.NewEngine(cfg.Triggers, ps.injectTrigger, mqttOpts, log.Named("trigger"))
+		if err != nil {
+			ps.logger.Error("Triggers disabled: %v", err)
+		} else {
+			ps.triggers = engine
+		}
+	}
 
 	return ps
 }
 
-func (ps *Server) onUpstreamData(data []byte) {
+// receiveUpstream passes one read from an upstream through gap framing, if
+// enabled. The frame is shared, not copied, while it is broadcast and
+// logged.
+func (ps *Server) receiveUpstream(link *upstreamLink, f *bufpool.Frame) {
+	data := f.Bytes()
+	link.rate.Observe(time.Now(), data)
+	if link.coord.Observe(data) {
+		ps.logCoordinator(link)
+	}
+	if fs := ps.flash.Load(); fs != nil {
+		ps.flashFromUpstream(fs, link, data, f)
+		return
+	}
+	if ps.ports.servesRaw(ps.config) && link == ps.directLink() && !ps.paused.Load() {
+		ps.clients.BroadcastRaw(data)
+	}
+	if link.framer != nil {
+		link.framer.Write(data)
+		return
+	}
+	ps.decodeUpstream(link, data, f)
+}
+
+// decodeUpstream applies the upstream transform and handles each resulting
+// chunk. f holds data, or is nil when data was copied out of the read, e.g.
+// by the gap framer.
+func (ps *Server) decodeUpstream(link *upstreamLink, data []byte, f *bufpool.Frame) {
+	if link.transform != nil {
+		// Decoded frames are built in the transform's own buffers
+		f = nil
+	}
+	for _, frame := range codec.Apply(link.transform, data) {
+		ps.handleUpstreamData(link, frame, f)
+	}
+}
+
+func (ps *Server) handleUpstreamData(link *upstreamLink, data []byte, f *bufpool.Frame) {
+	received := time.Now()
+	source := ps.sourceTag(link)
+
 	// Log packet if enabled
-	ps.logger.LogPacket("UP->", data, "")
+	logPacket(link.conn.Log(), "UP->", data, f, source)
+	ps.metrics.RecordFromUpstream(len(data))
+	ps.trackReply(link)
+	ps.polls.Observe(data)
+	ps.values.Observe(trigger.FromUpstream, data)
+
+	if ps.paused.Load() || ps.flash.Load() != nil {
+		return
+	}
+	if !ps.noInject.Load() && !ps.triggers.Evaluate(trigger.FromUpstream, data, source) {
+		return
+	}
+
+	if ps.config.UpstreamTags {
+		data = tagFrame(link.index, data)
+	}
 
 	// Broadcast to all connected clients
-	ps.clients.Broadcast(data)
+	start := time.Now()
+	ps.clients.BroadcastFrom(link.name, data)
+	ps.heartbeat.touch(start)
+	ps.metrics.RecordBroadcast(time.Since(start))
+	ps.observeForward(false, time.Since(received), link.name)
 }
 
-func (ps *Server) Start() error {
-	// Start upstream connection
-	ps.upstream.Start()
+// Start connects the upstreams and opens the client listeners. ctx bounds
+// startup, including the WAIT_FOR_UPSTREAM wait; once Start returns the
+// server runs until Stop. After an error, call Stop to release what was
+// started.
+func (ps *Server) Start(ctx context.Context) error {
+	if err := ps.openJournal(); err != nil {
+		return fmt.Errorf("failed to open WRITE_JOURNAL: %w", err)
+	}
+
+	if ps.config.ClientEngine == config.EngineEpoll {
+		p, err := newPoller(ps.logger)
+		if err != nil {
+			return err
+		}
+		ps.poller = p
+		ps.wg.Add(1)
+		go func() {
+			defer ps.wg.Done()
+			p.run(ps.ctx)
+		}()
+	}
+
+	if ps.config.StatusListenPort > 0 {
+		if err := ps.listenStatus(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Start upstream connections
+	for _, link := range ps.links {
+		if err := link.conn.Start(ctx); err != nil {
+			return err
+		}
+	}
+	if wait := ps.config.UpstreamWait(); wait > 0 && !ps.parked.Load() {
+		if err := ps.waitForUpstream(ctx, wait); err != nil {
+			return err
+		}
+	}
 
 	// Start client listener
-	listener, err := net.Listen("tcp", ps.config.ListenAddr())
+	var lc net.ListenConfig
+	listener, err := lc.Listen(ctx, "tcp", ps.config.ListenAddr())
 	if err != nil {
 		return err
 	}
@@ -73,15 +346,135 @@ func (ps *Server) Start() error {
 	ps.listener = listener
 	ps.listenerMu.Unlock()
 
-	ps.logger.Info("Listening on %s", ps.config.ListenAddr())
+	ps.logger.Info("Listening on %s%s", ps.config.ListenAddr(), ps.ports.plain)
+	if ps.dryRun.Load() {
+		ps.logger.Warn("Dry-run mode: client writes are not forwarded to the upstream")
+	}
+
+	ps.wg.Add(1)
+	go ps.acceptLoop(listener, func(conn net.Conn) { ps.serveConn(conn, ps.ports.plain, "") })
+
+	if ps.config.RawListenPort > 0 {
+		rawLn, err := lc.Listen(ctx, "tcp", ps.config.RawListenAddr())
+		if err != nil {
+			return err
+		}
+		ps.listenerMu.Lock()
+		ps.rawLn = rawLn
+		ps.listenerMu.Unlock()
+		ps.logger.Info("Listening for raw clients on %s%s", ps.config.RawListenAddr(), ps.ports.raw)
+
+		ps.wg.Add(1)
+		go ps.acceptLoop(rawLn, func(conn net.Conn) { ps.serveConn(conn, ps.ports.raw, "") })
+	}
+
+	if ps.config.TLSListenPort > 0 {
+		if err := ps.listenTLS(); err != nil {
+			return err
+		}
+	}
+
+	if ps.config.QUICListenPort > 0 {
+		quicLn, err := transport.ListenQUIC(ps.config.QUICListenAddr(), ps.config.QUICCertFile, ps.config.QUICKeyFile)
+		if err != nil {
+			return err
+		}
+		ps.quicLn = quicLn
+		ps.logger.Info("Listening for QUIC clients on udp %s", ps.config.QUICListenAddr())
+
+		ps.wg.Add(1)
+		go ps.quicAcceptLoop()
+	}
+
+	if ps.config.MuxListenPort > 0 {
+		muxLn, err := transport.ListenMux(ps.config.MuxListenAddr(), ps.config.TLSCertFile, ps.config.TLSKeyFile)
+		if err != nil {
+			return err
+		}
+		ps.muxLn = muxLn
+		ps.logger.Info("Listening for mux peers on %s", ps.config.MuxListenAddr())
+
+		ps.wg.Add(1)
+		go ps.muxAcceptLoop()
+	}
+
+	if ps.sched != nil {
+		ps.sched.Start()
+	}
+
+	if ps.polls != nil {
+		ps.polls.Start()
+	}
 
 	ps.wg.Add(1)
-	go ps.acceptLoop()
+	go ps.sampleStats()
+
+	if ps.livenessTimeout() > 0 && !ps.checksKeepalive() {
+		ps.wg.Add(1)
+		go ps.reapIdle()
+	}
+
+	if ps.heartbeat != nil {
+		ps.wg.Add(1)
+		go ps.sendHeartbeats()
+	}
+
+	if ps.scheduled {
+		ps.wg.Add(1)
+		go ps.enforceHours()
+	}
+
+	if ps.responseTimeout() > 0 {
+		ps.wg.Add(1)
+		go ps.superviseReplies()
+	}
 
 	return nil
 }
 
-func (ps *Server) Stop() {
+// waitForUpstream blocks until the upstream is connected, the timeout
+// expires or the server is stopped, so that clients connecting at boot do
+// not lose their first packets. It returns ctx's error if ctx ends first.
+func (ps *Server) waitForUpstream(ctx context.Context, timeout time.Duration) error {
+	ps.starting.Store(true)
+	defer ps.starting.Store(false)
+
+	ps.logger.Info("Waiting up to %v for the upstream before accepting clients", timeout)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for !ps.IsUpstreamConnected() {
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			ps.logger.Warn("Upstream not connected after %v, accepting clients anyway", timeout)
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ps.ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+// IsStarting reports whether startup is still waiting for the upstream
+// (WAIT_FOR_UPSTREAM)
+func (ps *Server) IsStarting() bool {
+	return ps.starting.Load()
+}
+
+// Stop closes the listeners, gives connected clients until ctx is done to
+// finish, or shutdownTimeout if ctx has no deadline, then disconnects them
+// and the upstreams. It returns ctx's error if clients had to be cut off or
+// an upstream did not stop in time, and any error closing the storage.
+func (ps *Server) Stop(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, shutdownTimeout)
+		defer cancel()
+	}
 	ps.logger.Info("Shutting down proxy server...")
 
 	// Stop accepting new connections
@@ -92,88 +485,352 @@ func (ps *Server) Stop() {
 		ps.listener.Close()
 		ps.listener = nil
 	}
+	if ps.rawLn != nil {
+		ps.rawLn.Close()
+	}
+	if ps.tlsLn != nil {
+		ps.tlsLn.Close()
+	}
 	ps.listenerMu.Unlock()
+	ps.statusLn.close()
 
-	// Give existing clients time to finish (max 5 seconds)
+	if ps.quicLn != nil {
+		ps.quicLn.Close()
+	}
+	if ps.muxLn != nil {
+		ps.muxLn.Close()
+	}
+
+	// Give existing clients time to finish
 	done := make(chan struct{})
 	go func() {
 		ps.wg.Wait()
 		close(done)
 	}()
 
+	var errs []error
 	select {
 	case <-done:
-	case <-time.After(5 * time.Second):
+	case <-ctx.Done():
 		ps.logger.Warn("Timeout waiting for clients, forcing shutdown")
+		errs = append(errs, ctx.Err())
 	}
 
+	ps.polls.Stop()
+	ps.sched.Stop()
+
 	// Close all client connections
 	ps.clients.CloseAll()
+	if ps.poller != nil {
+		ps.poller.close()
+	}
 
-	// Stop upstream connection
-	ps.upstream.Stop()
+	// Stop upstream connections
+	// An upstream stops as soon as its connection is closed, so it gets its
+	// own deadline even when the clients used up ctx
+	upstreamCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+	defer cancel()
+	for _, link := range ps.links {
+		if err := link.conn.Stop(upstreamCtx); err != nil {
+			errs = append(errs, err)
+		}
+		if link.framer != nil {
+			link.framer.Stop()
+		}
+	}
+
+	ps.triggers.Close()
+	ps.hooks.Close()
+	if err := ps.journal.Close(); err != nil {
+		ps.logger.Warn("Failed to close journal: %v", err)
+		errs = append(errs, err)
+	}
+	if err := ps.store.Close(); err != nil {
+		ps.logger.Warn("Failed to close storage: %v", err)
+		errs = append(errs, err)
+	}
+
+	ps.logger.Info("Proxy server stopped")
 
 	// Close logger
 	ps.logger.Close()
 
-	ps.logger.Info("Proxy server stopped")
+	return errors.Join(errs...)
 }
 
-func (ps *Server) acceptLoop() {
+// acceptLoop accepts TCP clients and passes them to serve. It blocks in
+// Accept until a client arrives and ends when the listener is closed, by
+// Stop or once the server's context is done.
+func (ps *Server) acceptLoop(ln net.Listener, serve func(net.Conn)) {
 	defer ps.wg.Done()
+	stop := context.AfterFunc(ps.ctx, func() { _ = ln.Close() })
+	defer stop()
 
+	var delay time.Duration // after failures such as running out of file descriptors
 	for {
-		select {
-		case <-ps.ctx.Done():
-			return
-		default:
+		conn, err := ln.Accept()
+		if err != nil {
+			if !ps.retryAccept("Accept", err, &delay) {
+				return
+			}
+			continue
 		}
+		delay = 0
+
+		serve(conn)
+	}
+}
+
+// retryAccept waits out a growing delay after an accept error and reports
+// whether the loop should go on. It returns false once the listener is
+// closed or the server's context is done.
+func (ps *Server) retryAccept(what string, err error, delay *time.Duration) bool {
+	if ps.ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	*delay = min(max(2**delay, 5*time.Millisecond), time.Second)
+	ps.logger.Error("%s error: %v; retrying in %v", what, err, *delay)
+	select {
+	case <-time.After(*delay):
+		return true
+	case <-ps.ctx.Done():
+		return false
+	}
+}
 
-		// Set accept deadline to allow checking context
-		_ = ps.listener.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second))
+// quicAcceptLoop accepts clients arriving over the QUIC listener
+func (ps *Server) quicAcceptLoop() {
+	defer ps.wg.Done()
 
-		conn, err := ps.listener.Accept()
+	var delay time.Duration
+	for {
+		conn, err := ps.quicLn.Accept(ps.ctx)
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				continue
-			}
-			select {
-			case <-ps.ctx.Done():
+			if !ps.retryAccept("QUIC accept", err, &delay) {
 				return
-			default:
-				ps.logger.Error("Accept error: %v", err)
-				continue
 			}
+			continue
 		}
+		delay = 0
+
+		ps.serveConn(conn, ps.ports.tunnel, "")
+	}
+}
+
+// muxAcceptLoop accepts the channels peers open over the mux listener. Each
+// channel names an upstream and is served as a client bound to it.
+func (ps *Server) muxAcceptLoop() {
+	defer ps.wg.Done()
 
-		cl, err := ps.clients.Add(conn)
+	var delay time.Duration
+	for {
+		ch, err := ps.muxLn.Accept(ps.ctx)
 		if err != nil {
-			ps.logger.Warn("Rejecting connection from %s: %v", conn.RemoteAddr(), err)
-			conn.Close()
+			if !ps.retryAccept("Mux accept", err, &delay) {
+				return
+			}
 			continue
 		}
+		delay = 0
 
-		ps.wg.Add(1)
-		go ps.handleClient(cl)
+		if ps.findLink(ch.Name()) == nil {
+			ps.logger.Warn("Refusing mux channel %q from %s: unknown upstream", ch.Name(), ch.RemoteAddr())
+			ch.Reject("unknown upstream")
+			continue
+		}
+		if err := ch.Accept(); err != nil {
+			ps.logger.Warn("Failed to accept mux channel %q from %s: %v", ch.Name(), ch.RemoteAddr(), err)
+			continue
+		}
+		ps.logger.Info("Mux channel %q opened by %s", ch.Name(), ch.RemoteAddr())
+		ps.serveConn(ch, ps.ports.tunnel, ch.Name())
 	}
 }
 
-func (ps *Server) handleClient(cl *client.Client) {
-	defer ps.wg.Done()
-	defer ps.clients.Remove(cl.ID)
+// serveConn admits a connection accepted on port and starts its handler. A
+// client routed by TLS_ROUTES is bound to upstream.
+func (ps *Server) serveConn(conn net.Conn, port *clientPort, upstream string) {
+	if ps.parked.Load() {
+		ps.logger.Info("Refusing connection from %s: proxy is parked", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if !ps.admit(conn) {
+		conn.Close()
+		return
+	}
+	if ps.deniedConn(conn, port) {
+		ps.dropConn(conn)
+		return
+	}
+	if port.single {
+		port.replace(ps, conn)
+	}
+
+	// Raw clients get neither the banner nor the IDENT handshake, which
+	// would corrupt their stream
+	if !port.raw {
+		if err := ps.sendBanner(conn); err != nil {
+			ps.logger.Warn("Failed to send banner to %s: %v", conn.RemoteAddr(), err)
+			ps.dropConn(conn)
+			return
+		}
+	}
+	if port.hex {
+		conn = newHexConn(conn)
+	} else if ps.poller != nil {
+		conn = ps.poller.wrap(conn)
+	}
+
+	ps.wg.Add(1)
+	go ps.handleConn(conn, port.raw, upstream)
+}
+
+// register adds a connection to the client manager. With CLIENT_IDS=stable
+// its ID is derived from the source IP and announced name, so a client
+// that reconnects keeps its ID.
+func (ps *Server) register(conn net.Conn, raw bool, name, upstream string) (*client.Client, error) {
+	if upstream != "" {
+		var id string
+		if ps.config.ClientIDs == config.ClientIDsStable {
+			id = stableClientID(conn.RemoteAddr().String(), name)
+		}
+		return ps.clients.AddBound(conn, id, upstream)
+	}
+	if ps.config.ClientIDs == config.ClientIDsStable {
+		return ps.clients.AddAs(conn, stableClientID(conn.RemoteAddr().String(), name), raw)
+	}
+	if raw {
+		return ps.clients.AddRaw(conn)
+	}
+	return ps.clients.Add(conn)
+}
+
+// stableClientID returns "<name>@<ip>" for a named client and the IP
+// otherwise
+func stableClientID(addr, name string) string {
+	if name == "" {
+		return hostOf(addr)
+	}
+	return name + "@" + hostOf(addr)
+}
+
+// dropConn closes a connection that was admitted but not registered
+func (ps *Server) dropConn(conn net.Conn) {
+	ps.releaseConn(conn.RemoteAddr().String())
+	conn.Close()
+}
+
+// admit applies CONNECT_RATE_LIMIT and MAX_CLIENTS_PER_IP. Warnings carry
+// the reason code as reason=. Attempts from a greylisted IP are refused
+// without logging, since a client stuck in a reconnect loop would flood the
+// log.
+func (ps *Server) admit(conn net.Conn) bool {
+	if ps.connLimit == nil {
+		return true
+	}
+	ip := hostOf(conn.RemoteAddr().String())
+	err := ps.connLimit.Allow(ip)
+	if err == nil {
+		return true
+	}
+	log := ps.logger.With("reason", connlimit.Reason(err))
+	switch err {
+	case connlimit.ErrGreylisted:
+	case connlimit.ErrRateExceeded:
+		log.Warn("Greylisting %s for %ds: more than %d connection attempts per minute",
+			ip, ps.config.GreylistSecs, ps.config.ConnectRate)
+	case connlimit.ErrTooManyConnections:
+		log.Warn("Rejecting connection from %s: already %d connections from this IP (MAX_CLIENTS_PER_IP)",
+			conn.RemoteAddr(), ps.config.MaxClientsPerIP)
+	default:
+		log.Warn("Rejecting connection from %s: %v", conn.RemoteAddr(), err)
+	}
+	return false
+}
+
+// releaseConn ends the per-IP accounting of a connection admitted by admit
+func (ps *Server) releaseConn(addr string) {
+	if ps.connLimit != nil {
+		ps.connLimit.Release(hostOf(addr))
+	}
+}
+
+// hostOf returns the host part of a remote address
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// handleConn registers a connection as a client and forwards its data
+// until it closes. With stable IDs the ID includes the announced name, so
+// the client identifies itself before it is registered; otherwise it is
+// registered first and receives upstream data while identifying.
+func (ps *Server) handleConn(conn net.Conn, raw bool, upstream string) {
+	identify := ps.identifies(conn, raw)
+	first := ps.config.ClientIDs == config.ClientIDsStable && identify
+
+	var name string
+	var pending []byte
+	if first {
+		var err error
+		if name, pending, err = ps.identify(conn); err != nil {
+			ps.dropConn(conn)
+			ps.wg.Done()
+			return
+		}
+	}
+
+	cl, err := ps.register(conn, raw, name, upstream)
+	if err != nil {
+		ps.logger.Warn("Rejecting connection from %s: %v", conn.RemoteAddr(), err)
+		ps.dropConn(conn)
+		ps.wg.Done()
+		return
+	}
+	s := ps.startSession(cl)
 
-	// Enable TCP keepalive to detect dead connections
-	// This replaces read deadline - connections stay open indefinitely
-	// but dead connections are detected via OS-level keepalive probes
-	if tcpConn, ok := cl.Conn.(*net.TCPConn); ok {
-		_ = tcpConn.SetKeepAlive(true)
-		_ = tcpConn.SetKeepAlivePeriod(30 * time.Second)
+	if identify && !first {
+		if name, pending, err = ps.identify(conn); err != nil {
+			s.end()
+			return
+		}
+		cl.Touch(time.Now())
+	}
+	if name != "" {
+		cl.SetName(name)
+		cl.Log.Info("Client %s identified as %q", cl.ID, name)
 	}
+	s.setGroup()
+	if d := s.setAccess(); d.access == config.AccessDeny {
+		cl.Log.Warn("Refusing client %s: access denied by %s", cl.ID, d)
+		cl.SetCloseReason(ReasonAccess)
+		s.end()
+		return
+	}
+	if len(pending) > 0 && !s.process(pending, nil) {
+		s.end()
+		return
+	}
+	ps.serveClient(s)
+}
 
-	// Get buffer from pool for zero-copy
-	bufPtr := bufferPool.Get().(*[]byte)
-	buf := *bufPtr
-	defer bufferPool.Put(bufPtr)
+// serveClient reads from a registered client until it disconnects
+func (ps *Server) serveClient(s *clientSession) {
+	cl := s.cl
+
+	// With CLIENT_ENGINE=epoll the poller reads from here on, and this
+	// goroutine is not needed while the client is idle
+	if pc, ok := cl.Conn.(*pollConn); ok {
+		if err := pc.watch(s); err != nil {
+			s.end()
+		}
+		return
+	}
+	defer s.end()
 
 	for {
 		select {
@@ -182,42 +839,324 @@ func (ps *Server) handleClient(cl *client.Client) {
 		default:
 		}
 
-		// No read deadline - client connections stay open indefinitely
-		// TCP keepalive will detect and close dead connections
-		n, err := cl.Conn.Read(buf)
+		// Each read gets its own pooled frame, shared with the packet log
+		// rather than copied. No read deadline - client connections stay
+		// open indefinitely; TCP keepalive will detect and close dead
+		// connections.
+		f := bufferPool.GetFrame()
+		n, err := cl.Conn.Read(f.Bytes())
 		if err != nil {
+			f.Release()
+			ps.readFailed(cl, err)
 			return
 		}
 
+		ok := true
 		if n > 0 {
-			// Create a copy for logging and upstream write since buffer will be reused
-			data := make([]byte, n)
-			copy(data, buf[:n])
-
-			// Log packet if enabled
-			ps.logger.LogPacket("->UP", data, cl.ID)
-
-			// Forward to upstream only (not to other clients)
-			if ps.upstream.IsConnected() {
-				if err := ps.upstream.Write(data); err != nil {
-					ps.logger.Warn("Failed to write to upstream from %s: %v", cl.ID, err)
-				}
-			} else {
-				ps.logger.Warn("Upstream not connected, dropping packet from %s", cl.ID)
-			}
+			f.Truncate(n)
+			ok = s.process(f.Bytes(), f)
+		}
+		f.Release()
+		if !ok {
+			return
+		}
+	}
+}
+
+// forwardToUpstream logs, evaluates and writes one chunk of client data
+// read at the given time. f holds data, if it is a pooled read.
+func (ps *Server) forwardToUpstream(cl *client.Client, data []byte, f *bufpool.Frame, read time.Time) {
+	// Log packet if enabled
+	logPacket(cl.Log, "->UP", data, f, cl.ID)
+	ps.values.Observe(trigger.ToUpstream, data)
+	ps.observeController(cl, data)
+
+	if ps.paused.Load() || ps.flash.Load() != nil {
+		ps.metrics.RecordDropped()
+		return
+	}
+	if ps.denyClient(cl.ID, data) {
+		return
+	}
+	if !ps.noInject.Load() && !ps.triggers.Evaluate(trigger.ToUpstream, data, cl.ID) {
+		return
+	}
+	if ps.withhold(data) {
+		return
+	}
+
+	// Forward to upstream only (not to other clients)
+	write := ps.clientWriter(cl)
+	switch err := ps.writeClient(cl, data, write); {
+	case err == nil:
+		ps.metrics.RecordToUpstream(len(data))
+		ps.observeForward(true, time.Since(read), cl.ID)
+		ps.trackRequest(cl)
+	case errors.Is(err, errHeld):
+	case errors.Is(err, net.ErrClosed):
+		ps.upstreamDown(cl)
+	default:
+		ps.writeFailed(cl, data, write, err)
+	}
+}
+
+// forwardRaw writes data from a raw client unchanged: no transform, write
+// scheduling or triggers
+func (ps *Server) forwardRaw(cl *client.Client, data []byte, f *bufpool.Frame, read time.Time) {
+	logPacket(cl.Log, "->UP", data, f, cl.ID)
+	ps.observeController(cl, data)
+	if ps.paused.Load() || ps.flash.Load() != nil {
+		ps.metrics.RecordDropped()
+		return
+	}
+	if ps.denyClient(cl.ID, data) {
+		return
+	}
+	if ps.withhold(data) {
+		return
+	}
+	write := ps.rawWriter(cl)
+	switch err := ps.writeClient(cl, data, write); {
+	case err == nil:
+		ps.metrics.RecordToUpstream(len(data))
+		ps.observeForward(true, time.Since(read), cl.ID)
+		ps.trackRequest(cl)
+	case errors.Is(err, errHeld):
+	case errors.Is(err, net.ErrClosed):
+		ps.upstreamDown(cl)
+	default:
+		ps.writeFailed(cl, data, write, err)
+	}
+}
+
+// logPacket logs data, sharing f with the log queue when data is held in a
+// pooled frame
+func logPacket(log *logger.Logger, direction string, data []byte, f *bufpool.Frame, source string) {
+	if f != nil {
+		log.LogPacketFrame(direction, f, data, source)
+		return
+	}
+	log.LogPacket(direction, data, source)
+}
+
+// withhold counts client data instead of forwarding it in dry-run mode
+func (ps *Server) withhold(data []byte) bool {
+	if !ps.dryRun.Load() {
+		return false
+	}
+	ps.metrics.RecordDryRun(len(data))
+	return true
+}
+
+// clientPriority returns the scheduling weight of the first
+// CLIENT_PRIORITIES rule matching the client's address
+func (ps *Server) clientPriority(cl *client.Client) int {
+	ip := net.ParseIP(hostOf(cl.Addr))
+	for _, rule := range ps.config.ClientPriority {
+		if rule.Matches(ip) {
+			return rule.Priority
 		}
 	}
+	return 1
 }
 
 func (ps *Server) GetStatus() map[string]interface{} {
-	return map[string]interface{}{
+	status := map[string]interface{}{
 		"upstream_state":    ps.upstream.GetState().String(),
 		"upstream_addr":     ps.config.UpstreamAddr(),
 		"listen_addr":       ps.config.ListenAddr(),
 		"connected_clients": ps.clients.TotalCount(),
 		"max_clients":       ps.config.MaxClients,
 		"start_time":        ps.startTime.Format(time.RFC3339),
+		"runtime":           ps.GetRuntimeStats(),
+	}
+	if session, gen := ps.upstream.Session(); session != "" {
+		status["upstream_session"] = session
+		status["upstream_generation"] = gen
+	}
+	if protocol := ps.upstream.Protocol(); protocol != "" {
+		status["upstream_protocol"] = protocol
+	}
+	if ps.config.RawListenPort > 0 {
+		status["raw_listen_addr"] = ps.config.RawListenAddr()
+	}
+	if ps.poller != nil {
+		status["client_engine"] = config.EngineEpoll
+	}
+	if ps.multiUpstream() {
+		status["upstreams"] = ps.GetUpstreams()
+	}
+	if coord := ps.GetCoordinator(); coord != nil {
+		status["coordinator"] = coord
+	}
+	if conflict := ps.links[0].ctrl.Conflict(); conflict != nil {
+		status["controller_conflict"] = conflict
+	}
+	status["line_rate"] = ps.GetLineRate()
+	if initStatus := ps.GetInitStatus(); initStatus != nil {
+		status["init_sequence"] = initStatus
+	}
+	if ps.sched != nil {
+		status["write_queue"] = ps.sched.Pending()
+	}
+	if ps.connLimit != nil {
+		status["connection_limits"] = ps.connLimit.Stats()
+	}
+	if ps.paused.Load() {
+		status["forwarding_paused"] = true
+	}
+	if ps.noInject.Load() {
+		status["injection_disabled"] = true
+	}
+	if ps.dryRun.Load() {
+		status["dry_run"] = true
+	}
+	if ps.parked.Load() {
+		status["parked"] = true
+	}
+	if fs := ps.FlashStatus(); fs.Active {
+		status["flashing"] = fs
 	}
+	if ps.deny != nil {
+		status["deny_frames"] = ps.deny.status()
+	}
+	if ps.heartbeat != nil {
+		status["heartbeat_frames"] = ps.heartbeat.sent.Load()
+	}
+	return status
+}
+
+// SetForwardingPaused stops or resumes forwarding in both directions.
+// While paused, traffic is still logged but neither delivered to clients
+// nor written to the upstream; injected packets are unaffected.
+func (ps *Server) SetForwardingPaused(paused bool) {
+	if ps.paused.Swap(paused) == paused {
+		return
+	}
+	if paused {
+		ps.logger.Info("Forwarding paused")
+	} else {
+		ps.logger.Info("Forwarding resumed")
+		go ps.flushHeld()
+	}
+}
+
+// ForwardingPaused reports whether forwarding is paused
+func (ps *Server) ForwardingPaused() bool {
+	return ps.paused.Load()
+}
+
+// SetInjectionEnabled switches packet injection, macros and triggers on or
+// off, overriding INJECT_ENABLED until the next restart. While off the
+// proxy only forwards traffic.
+func (ps *Server) SetInjectionEnabled(enabled bool) {
+	if ps.noInject.Swap(!enabled) == !enabled {
+		return
+	}
+	if enabled {
+		ps.logger.Info("Packet injection enabled")
+	} else {
+		ps.logger.Info("Packet injection disabled")
+	}
+}
+
+// InjectionEnabled reports whether packet injection is enabled
+func (ps *Server) InjectionEnabled() bool {
+	return !ps.noInject.Load()
+}
+
+// SetDryRun switches dry-run mode on or off, overriding DRY_RUN until the
+// next restart. In dry-run mode client writes are logged and counted but
+// never reach the upstream; injections, polls and the init sequence are
+// not affected.
+func (ps *Server) SetDryRun(enabled bool) {
+	if ps.dryRun.Swap(enabled) == enabled {
+		return
+	}
+	if enabled {
+		ps.logger.Info("Dry-run mode enabled: client writes are not forwarded to the upstream")
+	} else {
+		ps.logger.Info("Dry-run mode disabled")
+	}
+}
+
+// DryRun reports whether dry-run mode is on
+func (ps *Server) DryRun() bool {
+	return ps.dryRun.Load()
+}
+
+// SetStorage replaces the in-memory store with st, e.g. the backend
+// selected by STORAGE_BACKEND. Call it before Start and before creating the
+// web server; the proxy closes st on Stop.
+func (ps *Server) SetStorage(st storage.Storage) {
+	ps.store = st
+}
+
+// Storage returns the store for events, traffic samples, log lines and
+// sessions
+func (ps *Server) Storage() storage.Storage {
+	return ps.store
+}
+
+// GetMetrics returns a snapshot of the traffic counters and current gauges
+func (ps *Server) GetMetrics() metrics.Snapshot {
+	snap := ps.metrics.Snapshot()
+	snap.UpstreamReconnects = ps.upstream.GetReconnectCount()
+	snap.UpstreamConnected = ps.upstream.IsConnected()
+	snap.Clients = ps.clients.TotalCount()
+	return snap
+}
+
+// GetTriggerStatus returns match statistics for the configured triggers
+func (ps *Server) GetTriggerStatus() []trigger.Status {
+	return ps.triggers.Status()
+}
+
+// GetPollResults returns the cached responses of all configured polls
+func (ps *Server) GetPollResults() []poll.Result {
+	return ps.polls.Results()
+}
+
+// GetPollResult returns the cached response of the named poll
+func (ps *Server) GetPollResult(name string) (poll.Result, bool) {
+	return ps.polls.Result(name)
+}
+
+// GetValues returns the latest extracted values
+func (ps *Server) GetValues() []values.Value {
+	return ps.values.Values()
+}
+
+// GetValue returns the latest value extracted by the named rule
+func (ps *Server) GetValue(name string) (values.Value, bool) {
+	return ps.values.Get(name)
+}
+
+// HasValueRule reports whether a value rule with the given name is configured
+func (ps *Server) HasValueRule(name string) bool {
+	return ps.values.Known(name)
+}
+
+// SetValueCallback registers a callback invoked whenever a value is extracted
+func (ps *Server) SetValueCallback(fn func(values.Value)) {
+	ps.values.SetOnUpdate(fn)
+}
+
+// sendPoll writes a scheduled poll query to the upstream
+func (ps *Server) sendPoll(data []byte) error {
+	if ps.flash.Load() != nil {
+		return ErrFlashing
+	}
+	if !ps.upstream.IsConnected() {
+		return net.ErrClosed
+	}
+	ps.upstream.Log().LogPacket("->UP", data, "POLL")
+	if err := ps.upstream.Write(data); err != nil {
+		return err
+	}
+	ps.journalWrite(journal.SourcePoll, data)
+	ps.metrics.RecordToUpstream(len(data))
+	return nil
 }
 
 // GetClientCount returns the total number of connected clients (TCP + Web)
@@ -260,6 +1199,12 @@ func (ps *Server) GetUpstreamLastConnected() time.Time {
 	return ps.upstream.GetLastConnected()
 }
 
+// GetLastPackets returns when the last packet was received from and written
+// to the upstream; zero times if none has been
+func (ps *Server) GetLastPackets() (fromUpstream, toUpstream time.Time) {
+	return ps.metrics.LastPackets()
+}
+
 // GetStartTime returns the server start time
 func (ps *Server) GetStartTime() time.Time {
 	return ps.startTime
@@ -277,8 +1222,12 @@ func (ps *Server) IsListening() bool {
 	return ps.listener != nil
 }
 
+// ErrInjectDisabled is returned by InjectPacket while injection is switched
+// off
+var ErrInjectDisabled = errors.New("packet injection is disabled")
+
 // ErrInvalidTarget is returned when an invalid target is specified for packet injection
-var ErrInvalidTarget = fmt.Errorf("invalid target: must be 'upstream' or 'downstream'")
+var ErrInvalidTarget = fmt.Errorf("invalid target: must be 'upstream', 'downstream', 'upstream:<name>' or 'group:<name>'")
 
 // ClientInfo represents information about a connected client
 type ClientInfo struct {
@@ -286,6 +1235,17 @@ type ClientInfo struct {
 	Addr        string `json:"addr"`
 	ConnectedAt string `json:"connected_at"`
 	Type        string `json:"type"` // "tcp" or "web"
+	Session     string `json:"session,omitempty"`
+	Name        string `json:"name,omitempty"`   // announced with CLIENT_IDENT_TIMEOUT
+	Raw         bool   `json:"raw,omitempty"`    // connected on RAW_LISTEN_PORT
+	Format      string `json:"format,omitempty"` // "hex" for hex line clients
+	Access      string `json:"access,omitempty"` // "write", "read" or "inject", see CLIENT_ACCESS
+	Upstream    string `json:"upstream,omitempty"`
+	Group       string `json:"group,omitempty"`
+	Refused     uint64 `json:"refused_writes,omitempty"`
+	Requests    uint64 `json:"requests,omitempty"`
+	Timeouts    uint64 `json:"response_timeouts,omitempty"`
+	CloseReason string `json:"close_reason,omitempty"` // "idle" or "keepalive" for reaped clients, "access" when access hours ended, "read_only" for a refused write
 }
 
 // GetClients returns information about all connected clients
@@ -294,17 +1254,37 @@ func (ps *Server) GetClients() []ClientInfo {
 	result := make([]ClientInfo, 0, len(tcpClients))
 
 	for _, c := range tcpClients {
-		result = append(result, ClientInfo{
-			ID:          c.ID,
-			Addr:        c.Addr,
-			ConnectedAt: c.ConnectedAt.Format("2006-01-02T15:04:05Z07:00"),
-			Type:        "tcp",
-		})
+		result = append(result, tcpClientInfo(c))
 	}
 
 	return result
 }
 
+func tcpClientInfo(c *client.Client) ClientInfo {
+	var format string
+	if _, ok := c.Conn.(*hexConn); ok {
+		format = config.FormatHex
+	}
+	requests, timeouts := c.Requests()
+	return ClientInfo{
+		ID:          c.ID,
+		Addr:        c.Addr,
+		ConnectedAt: c.ConnectedAt.Format("2006-01-02T15:04:05Z07:00"),
+		Type:        "tcp",
+		Session:     c.Session,
+		Name:        c.Name(),
+		Raw:         c.Raw,
+		Format:      format,
+		Access:      c.Access(),
+		Refused:     c.Refused(),
+		Requests:    requests,
+		Timeouts:    timeouts,
+		Upstream:    c.Upstream,
+		Group:       c.Group(),
+		CloseReason: c.CloseReason(),
+	}
+}
+
 // DisconnectClient disconnects a client by ID
 func (ps *Server) DisconnectClient(id string) bool {
 	client := ps.clients.Get(id)
@@ -315,20 +1295,109 @@ func (ps *Server) DisconnectClient(id string) bool {
 	return true
 }
 
-// InjectPacket injects a packet to the specified target (upstream or downstream)
+// InjectPacket injects a packet to the specified target (upstream or
+// downstream). Frames toward an upstream matching DENY_FRAMES are refused
+// with ErrDenied.
 func (ps *Server) InjectPacket(target string, data []byte) error {
+	return ps.injectPacket(target, data, false)
+}
+
+// InjectPacketOverride injects a packet like InjectPacket but lets frames
+// matching DENY_FRAMES through, for the admin account
+func (ps *Server) InjectPacketOverride(target string, data []byte) error {
+	return ps.injectPacket(target, data, true)
+}
+
+func (ps *Server) injectPacket(target string, data []byte, override bool) error {
+	if ps.noInject.Load() {
+		return ErrInjectDisabled
+	}
+	if ps.flash.Load() != nil {
+		return ErrFlashing
+	}
+	if ps.parked.Load() {
+		return ErrParked
+	}
+	if link, ok := ps.injectTarget(target); ok {
+		if link == nil {
+			return ErrInvalidTarget
+		}
+		if err := ps.denyInject(data, override); err != nil {
+			return err
+		}
+		if err := writeLink(link, data); err != nil {
+			return err
+		}
+		ps.journalWrite(journal.SourceInject, data)
+		link.conn.Log().LogPacket("->UP", data, "INJECT")
+		ps.metrics.RecordToUpstream(len(data))
+		return nil
+	}
+
+	if group, ok := ps.groupTarget(target); ok {
+		if group == nil {
+			return ErrInvalidTarget
+		}
+		ps.logger.LogPacket("UP->", data, "INJECT")
+		ps.clients.BroadcastGroup(group.Name, data)
+		ps.heartbeat.touch(time.Now())
+		return nil
+	}
+
 	if target == "upstream" {
-		if !ps.upstream.IsConnected() {
-			return net.ErrClosed
+		if err := ps.denyInject(data, override); err != nil {
+			return err
+		}
+		if err := ps.writeUpstream(data); err != nil {
+			return err
 		}
+		ps.journalWrite(journal.SourceInject, data)
 		// Log as if it came from a client (Client -> Upstream)
-		ps.logger.LogPacket("->UP", data, "INJECT")
-		return ps.upstream.Write(data)
+		ps.upstream.Log().LogPacket("->UP", data, "INJECT")
+		ps.metrics.RecordToUpstream(len(data))
+		return nil
 	} else if target == "downstream" {
 		// Log as if it came from upstream (Upstream -> Client)
 		ps.logger.LogPacket("UP->", data, "INJECT")
 		ps.clients.Broadcast(data)
+		ps.heartbeat.touch(time.Now())
 		return nil
 	}
 	return ErrInvalidTarget
 }
+
+// injectTrigger sends a trigger's response. A response to a client packet
+// goes back to that client only.
+func (ps *Server) injectTrigger(target string, data []byte) error {
+	if id, ok := trigger.ClientID(target); ok {
+		return ps.InjectToClient(id, data)
+	}
+	return ps.InjectPacket(target, data)
+}
+
+// InjectToClient injects a packet downstream to the client with the given
+// ID only, as if the upstream had sent it to that client. A client that
+// cannot take it is disconnected, like on a failed broadcast.
+func (ps *Server) InjectToClient(id string, data []byte) error {
+	if ps.noInject.Load() {
+		return ErrInjectDisabled
+	}
+	if ps.flash.Load() != nil {
+		return ErrFlashing
+	}
+	if ps.parked.Load() {
+		return ErrParked
+	}
+	cl := ps.clients.Get(id)
+	if cl == nil {
+		return ErrClientNotFound
+	}
+
+	cl.Log.LogPacket("UP->", data, "INJECT")
+	if err := cl.Write(data); err != nil {
+		cl.Log.Warn("Failed to inject to client %s: %v", cl.ID, err)
+		ps.clients.Remove(cl.ID)
+		return err
+	}
+	return nil
+}
@@ -1,15 +1,35 @@
 package proxy
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/hoon-ch/serial-tcp-proxy/internal/client"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/connlimit"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/coordinator"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/journal"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/linerate"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/transport"
+	"github.com/hoon-ch/serial-tcp-proxy/pkg/testutil"
 )
 
 func newTestLogger() *logger.Logger {
@@ -68,11 +88,11 @@ func TestServer_Integration(t *testing.T) {
 	log := newTestLogger()
 	proxy := NewServer(cfg, log)
 
-	err = proxy.Start()
+	err = proxy.Start(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer proxy.Stop()
+	defer proxy.Stop(context.Background())
 
 	// Wait for upstream connection
 	time.Sleep(100 * time.Millisecond)
@@ -142,8 +162,8 @@ func TestServer_MultipleClients(t *testing.T) {
 
 	log := newTestLogger()
 	proxy := NewServer(cfg, log)
-	_ = proxy.Start()
-	defer proxy.Stop()
+	_ = proxy.Start(context.Background())
+	defer proxy.Stop(context.Background())
 
 	time.Sleep(100 * time.Millisecond)
 
@@ -233,3 +253,2664 @@ func TestServer_IsUpstreamConnected(t *testing.T) {
 		t.Error("Expected upstream to be disconnected initially")
 	}
 }
+
+func TestServer_InitSequence(t *testing.T) {
+	upstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start mock upstream: %v", err)
+	}
+	defer upstreamListener.Close()
+
+	// Each connection should receive the full sequence; the first one is
+	// then dropped to force a reconnect
+	received := make(chan []byte, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := upstreamListener.Accept()
+			if err != nil {
+				return
+			}
+			var all []byte
+			buf := make([]byte, 64)
+			_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			for len(all) < 4 {
+				n, err := conn.Read(buf)
+				if err != nil {
+					break
+				}
+				all = append(all, buf[:n]...)
+			}
+			received <- all
+			if i == 0 {
+				conn.Close()
+			} else {
+				defer conn.Close()
+			}
+		}
+		time.Sleep(500 * time.Millisecond)
+	}()
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstreamListener.Addr().(*net.TCPAddr).Port,
+		MaxClients:   10,
+		InitSequence: []config.InitFrame{
+			{Data: "aa 01"},
+			{Data: "aa 02", DelayMs: 20},
+		},
+	}
+
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	cfg.ListenPort = proxyListener.Addr().(*net.TCPAddr).Port
+	proxyListener.Close()
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Stop(context.Background())
+
+	expected := []byte{0xaa, 0x01, 0xaa, 0x02}
+	for i := 0; i < 2; i++ {
+		select {
+		case data := <-received:
+			if !bytes.Equal(data, expected) {
+				t.Errorf("Connection %d: expected %x, got %x", i, expected, data)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("Timeout waiting for init sequence on connection %d", i)
+		}
+	}
+
+	// Status is updated after the last write
+	deadline := time.Now().Add(time.Second)
+	for {
+		st := proxy.GetInitStatus()
+		if st.Runs >= 2 {
+			if st.FramesSent != 2 || st.LastError != "" {
+				t.Errorf("Unexpected init status %+v", st)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 2 runs, got %+v", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, ok := proxy.GetStatus()["init_sequence"]; !ok {
+		t.Error("Expected init_sequence in status")
+	}
+}
+
+func TestServer_MultiUpstream(t *testing.T) {
+	// Two mock meters, each sending one frame and recording client writes
+	type meter struct {
+		ln       net.Listener
+		received chan []byte
+	}
+	startMeter := func(frame []byte) *meter {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to start mock upstream: %v", err)
+		}
+		m := &meter{ln: ln, received: make(chan []byte, 1)}
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			time.Sleep(200 * time.Millisecond) // let the client connect first
+			_, _ = conn.Write(frame)
+			buf := make([]byte, 64)
+			_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if n, err := conn.Read(buf); err == nil {
+				m.received <- buf[:n]
+			}
+		}()
+		return m
+	}
+	meter1 := startMeter([]byte{0x11})
+	defer meter1.ln.Close()
+	meter2 := startMeter([]byte{0x22})
+	defer meter2.ln.Close()
+
+	cfg := &config.Config{
+		UpstreamHost:  "127.0.0.1",
+		UpstreamPort:  meter1.ln.Addr().(*net.TCPAddr).Port,
+		UpstreamName:  "meter1",
+		Upstreams:     []config.UpstreamSpec{{Name: "meter2", Addr: meter2.ln.Addr().String()}},
+		UpstreamWrite: "meter2",
+		UpstreamTags:  true,
+		MaxClients:    10,
+	}
+
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	proxyAddr := proxyListener.Addr().String()
+	cfg.ListenPort = proxyListener.Addr().(*net.TCPAddr).Port
+	proxyListener.Close()
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Stop(context.Background())
+
+	client, err := net.DialTimeout("tcp", proxyAddr, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to connect client to proxy: %v", err)
+	}
+	defer client.Close()
+
+	// Both frames arrive with their source header
+	var got []byte
+	buf := make([]byte, 64)
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(got) < 8 {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("Failed to read tagged frames (got %x): %v", got, err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	frames := map[string]bool{}
+	for i := 0; i+4 <= len(got); i += 4 {
+		frames[string(got[i:i+4])] = true
+	}
+	if !frames[string([]byte{0x00, 0x00, 0x01, 0x11})] || !frames[string([]byte{0x01, 0x00, 0x01, 0x22})] {
+		t.Errorf("Unexpected tagged frames %x", got)
+	}
+
+	// Client writes are routed to meter2 only
+	_, _ = client.Write([]byte{0xab})
+	select {
+	case data := <-meter2.received:
+		if !bytes.Equal(data, []byte{0xab}) {
+			t.Errorf("Expected ab at meter2, got %x", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for write at meter2")
+	}
+	select {
+	case data := <-meter1.received:
+		t.Errorf("Expected no write at meter1, got %x", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if ups, ok := proxy.GetStatus()["upstreams"].([]UpstreamInfo); !ok || len(ups) != 2 {
+		t.Errorf("Expected 2 upstreams in status, got %v", proxy.GetStatus()["upstreams"])
+	}
+}
+
+func TestServer_Transforms(t *testing.T) {
+	upstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start mock upstream: %v", err)
+	}
+	defer upstreamListener.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := upstreamListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(200 * time.Millisecond) // let the client connect first
+		// One SLIP frame split across two writes
+		_, _ = conn.Write([]byte{0xc0, 0x01, 0xdb})
+		time.Sleep(20 * time.Millisecond)
+		_, _ = conn.Write([]byte{0xdc, 0x02, 0xc0})
+
+		buf := make([]byte, 64)
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if n, err := conn.Read(buf); err == nil {
+			received <- buf[:n]
+		}
+	}()
+
+	cfg := &config.Config{
+		UpstreamHost:  "127.0.0.1",
+		UpstreamPort:  upstreamListener.Addr().(*net.TCPAddr).Port,
+		MaxClients:    10,
+		TransformFrom: "slip-decode",
+		TransformTo:   "slip-encode",
+	}
+
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	proxyAddr := proxyListener.Addr().String()
+	cfg.ListenPort = proxyListener.Addr().(*net.TCPAddr).Port
+	proxyListener.Close()
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Stop(context.Background())
+
+	client, err := net.DialTimeout("tcp", proxyAddr, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to connect client to proxy: %v", err)
+	}
+	defer client.Close()
+
+	// Client sees the whole unstuffed frame
+	buf := make([]byte, 64)
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read frame: %v", err)
+	}
+	if expected := []byte{0x01, 0xc0, 0x02}; !bytes.Equal(buf[:n], expected) {
+		t.Errorf("Expected %x, got %x", expected, buf[:n])
+	}
+
+	// Client data is stuffed on its way upstream
+	_, _ = client.Write([]byte{0xdb})
+	select {
+	case data := <-received:
+		if expected := []byte{0xc0, 0xdb, 0xdd, 0xc0}; !bytes.Equal(data, expected) {
+			t.Errorf("Expected %x, got %x", expected, data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for encoded frame")
+	}
+}
+
+func TestServer_FrameGap(t *testing.T) {
+	upstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start mock upstream: %v", err)
+	}
+	defer upstreamListener.Close()
+
+	go func() {
+		conn, err := upstreamListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(200 * time.Millisecond) // let the client connect first
+		// One frame split across segments, then a separate frame
+		for _, seg := range [][]byte{{0x01, 0x03}, {0x02}, {0x00, 0x2a}} {
+			_, _ = conn.Write(seg)
+			time.Sleep(5 * time.Millisecond)
+		}
+		time.Sleep(150 * time.Millisecond)
+		_, _ = conn.Write([]byte{0x02, 0x03})
+		time.Sleep(time.Second)
+	}()
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstreamListener.Addr().(*net.TCPAddr).Port,
+		MaxClients:   10,
+		FrameGapMs:   50,
+	}
+
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	proxyAddr := proxyListener.Addr().String()
+	cfg.ListenPort = proxyListener.Addr().(*net.TCPAddr).Port
+	proxyListener.Close()
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Stop(context.Background())
+
+	client, err := net.DialTimeout("tcp", proxyAddr, time.Second)
+	if err != nil {
+		t.Fatalf("Failed to connect client to proxy: %v", err)
+	}
+	defer client.Close()
+
+	buf := make([]byte, 64)
+	for _, expected := range [][]byte{{0x01, 0x03, 0x02, 0x00, 0x2a}, {0x02, 0x03}} {
+		_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("Failed to read frame: %v", err)
+		}
+		if !bytes.Equal(buf[:n], expected) {
+			t.Errorf("Expected %x, got %x", expected, buf[:n])
+		}
+	}
+}
+
+func TestServer_FrameGapReconnect(t *testing.T) {
+	// A partial frame from a lost upstream connection is not prepended to
+	// the first frame of the next one
+	upstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start mock upstream: %v", err)
+	}
+	defer upstreamListener.Close()
+
+	ready := make(chan struct{})
+	go func() {
+		conn, err := upstreamListener.Accept()
+		if err != nil {
+			return
+		}
+		<-ready
+		_, _ = conn.Write([]byte{0x01, 0x02})
+		time.Sleep(20 * time.Millisecond)
+		conn.Close()
+
+		conn, err = upstreamListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		time.Sleep(50 * time.Millisecond)
+		_, _ = conn.Write([]byte{0xaa})
+		time.Sleep(time.Second)
+	}()
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstreamListener.Addr().(*net.TCPAddr).Port,
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+		FrameGapMs:   500,
+	}
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+
+	client := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 1 }, "client not registered")
+	close(ready)
+
+	testutil.ExpectRead(t, client, []byte{0xaa})
+}
+
+func TestServer_FairWrites(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+		FairWrites:   true,
+		ClientPriority: []config.PriorityRule{
+			{Match: "127.0.0.0/8", Priority: 2},
+		},
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+
+	upstream.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not connected")
+
+	client := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	if _, err := client.Write([]byte{0x01, 0x02}); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	upstream.Expect([]byte{0x01, 0x02})
+
+	if status := proxy.GetStatus(); status["write_queue"] != 0 {
+		t.Errorf("Expected empty write_queue, got %v", status["write_queue"])
+	}
+}
+
+func TestServer_RuntimeStats(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "192.168.1.100",
+		UpstreamPort: 8899,
+		MaxClients:   10,
+		FairWrites:   true,
+		FrameGapMs:   5,
+	}
+	proxy := NewServer(cfg, newTestLogger())
+
+	stats := proxy.GetRuntimeStats()
+	if stats.Goroutines <= 0 {
+		t.Errorf("Expected positive goroutine count, got %d", stats.Goroutines)
+	}
+	if stats.HeapAlloc == 0 || stats.Sys == 0 {
+		t.Errorf("Expected memory figures, got %+v", stats)
+	}
+	if _, ok := stats.Queues["write_scheduler"]; !ok {
+		t.Error("Expected write_scheduler queue depth with fair writes enabled")
+	}
+	if _, ok := stats.Queues["frame_gap_bytes"]; !ok {
+		t.Error("Expected frame_gap_bytes with FRAME_GAP_MS set")
+	}
+	if _, ok := stats.Queues["log_entries"]; !ok {
+		t.Error("Expected log_entries queue depth")
+	}
+
+	found := false
+	for _, p := range stats.BufferPools {
+		if p.Name == "client-read" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected client-read buffer pool, got %+v", stats.BufferPools)
+	}
+}
+
+func TestServer_SessionLogContext(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+	}
+
+	log := newTestLogger()
+	var mu sync.Mutex
+	var lines []string
+	log.SetLogCallback(func(line string) {
+		mu.Lock()
+		lines = append(lines, line)
+		mu.Unlock()
+	})
+
+	proxy := NewServer(cfg, log)
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+
+	upstream.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not connected")
+
+	status := proxy.GetStatus()
+	upSession, _ := status["upstream_session"].(string)
+	if upSession == "" || status["upstream_generation"] != uint64(1) {
+		t.Fatalf("Expected upstream session and generation 1, got %v / %v", status["upstream_session"], status["upstream_generation"])
+	}
+
+	client := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	testutil.Eventually(t, func() bool { return len(proxy.GetClients()) == 1 }, "client not registered")
+	clSession := proxy.GetClients()[0].Session
+	if clSession == "" {
+		t.Fatal("Expected client session ID")
+	}
+
+	_, _ = client.Write([]byte{0x01})
+	upstream.Expect([]byte{0x01})
+	upstream.Send([]byte{0x02})
+	testutil.ExpectRead(t, client, []byte{0x02})
+
+	log.Flush()
+	find := func(substr string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, l := range lines {
+			if strings.Contains(l, substr) {
+				return l
+			}
+		}
+		return ""
+	}
+
+	if l := find("[->UP] 01"); !strings.Contains(l, "session="+clSession) {
+		t.Errorf("Expected client session on ->UP line, got %q", l)
+	}
+	if l := find("[UP->] 02"); !strings.Contains(l, "session="+upSession+" gen=1") {
+		t.Errorf("Expected upstream session on UP-> line, got %q", l)
+	}
+	if l := find("Client connected"); !strings.Contains(l, "session="+clSession) {
+		t.Errorf("Expected client session on connect line, got %q", l)
+	}
+}
+
+func TestServer_CoordinatorDetection(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+	}
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+
+	upstream.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not connected")
+	if _, ok := proxy.GetStatus()["coordinator"]; ok {
+		t.Fatal("Expected no coordinator before any traffic")
+	}
+
+	// Z-Stack SYS_VERSION response, split across two reads
+	frame := []byte{0xfe, 0x09, 0x61, 0x02, 0x02, 0x01, 0x02, 0x07, 0x01, 0x14, 0x64, 0x34, 0x01, 0x00}
+	frame[len(frame)-1] = xorBytes(frame[1 : len(frame)-1])
+	upstream.Send(frame[:6])
+	time.Sleep(20 * time.Millisecond)
+	upstream.Send(frame[6:])
+
+	testutil.Eventually(t, func() bool { return proxy.GetCoordinator() != nil }, "coordinator not detected")
+	info, ok := proxy.GetStatus()["coordinator"].(*coordinator.Info)
+	if !ok || info.Type != coordinator.TypeZNP || info.Firmware != "2.7.1" {
+		t.Errorf("Unexpected coordinator in status: %+v", proxy.GetStatus()["coordinator"])
+	}
+}
+
+func TestServer_ControllerConflict(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost:   "127.0.0.1",
+		UpstreamPort:   upstream.Port(),
+		ListenPort:     testutil.FreePort(t),
+		MaxClients:     10,
+		ControllerSecs: 60,
+	}
+	proxy := NewServer(cfg, newTestLogger())
+	var mu sync.Mutex
+	var conflicts []Event
+	proxy.SetEventCallback(func(e Event) {
+		if e.Type == EventControllerConflict {
+			mu.Lock()
+			conflicts = append(conflicts, e)
+			mu.Unlock()
+		}
+	})
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+
+	upstream.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not connected")
+	frame := []byte{0xfe, 0x09, 0x61, 0x02, 0x02, 0x01, 0x02, 0x07, 0x01, 0x14, 0x64, 0x34, 0x01, 0x00}
+	frame[len(frame)-1] = xorBytes(frame[1 : len(frame)-1])
+	upstream.Send(frame)
+	testutil.Eventually(t, func() bool { return proxy.GetCoordinator() != nil }, "coordinator not detected")
+
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort)
+	controller := testutil.Dial(t, addr)
+	monitor := testutil.Dial(t, addr)
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 2 }, "clients not registered")
+
+	// SYS_PING request from the controller; the monitor writes no commands
+	ping := []byte{0xfe, 0x00, 0x21, 0x01, 0x20}
+	if _, err := controller.Write(ping); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	upstream.Expect(ping)
+	if _, err := monitor.Write([]byte("status?")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	upstream.Expect([]byte("status?"))
+	if _, ok := proxy.GetStatus()["controller_conflict"]; ok {
+		t.Fatal("Expected no conflict with a single controller")
+	}
+
+	second := testutil.Dial(t, addr)
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 3 }, "client not registered")
+	if _, err := second.Write(ping); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	upstream.Expect(ping)
+
+	conflict, ok := proxy.GetStatus()["controller_conflict"].(*coordinator.Conflict)
+	if !ok || len(conflict.Clients) != 2 {
+		t.Fatalf("Expected a conflict between two clients, got %+v", proxy.GetStatus()["controller_conflict"])
+	}
+	mu.Lock()
+	if len(conflicts) != 1 || conflicts[0].Conflict == nil {
+		t.Errorf("Expected one controller_conflict event, got %+v", conflicts)
+	}
+	mu.Unlock()
+
+	// The conflict ends when the second controller disconnects
+	second.Close()
+	testutil.Eventually(t, func() bool {
+		_, ok := proxy.GetStatus()["controller_conflict"]
+		return !ok
+	}, "conflict not cleared")
+}
+
+func TestServer_LineRateHints(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+	}
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+
+	upstream.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not connected")
+
+	// What a receiver at a far too low baud rate decodes
+	upstream.Send(bytes.Repeat([]byte{0xF0, 0xFF, 0x80, 0x01}, 512))
+
+	testutil.Eventually(t, func() bool { return proxy.GetLineRate().Bytes == 2048 }, "bytes not counted")
+	report, ok := proxy.GetStatus()["line_rate"].(linerate.Report)
+	if !ok || len(report.Hints) != 1 || report.Hints[0].Code != linerate.HintGarbage {
+		t.Errorf("Expected a %s hint in status, got %+v", linerate.HintGarbage, proxy.GetStatus()["line_rate"])
+	}
+}
+
+func xorBytes(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum ^= b
+	}
+	return sum
+}
+
+// expectClosed fails unless the proxy closes conn
+func expectClosed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(testutil.DefaultTimeout))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected connection closed by the proxy, got %v", err)
+	}
+}
+
+func TestServer_OutageBuffer(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: testutil.FreePort(t),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+		OutagePolicy: config.OutageBuffer,
+		OutageBuffer: 4,
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+
+	// Written while the upstream is down; the third write exceeds the
+	// buffer and is dropped
+	conn := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	testutil.Eventually(t, func() bool { return len(proxy.GetClients()) == 1 }, "client not registered")
+	for _, data := range [][]byte{{0x01, 0x02}, {0x03}, {0x04, 0x05}} {
+		_, _ = conn.Write(data)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	ln, err := net.Listen("tcp", cfg.UpstreamAddr())
+	if err != nil {
+		t.Fatalf("Failed to start upstream: %v", err)
+	}
+	defer ln.Close()
+	up, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	defer up.Close()
+	testutil.ExpectRead(t, up, []byte{0x01, 0x02, 0x03})
+
+	_, _ = conn.Write([]byte{0x06})
+	testutil.ExpectRead(t, up, []byte{0x06})
+
+	if dropped := proxy.GetMetrics().DroppedPackets; dropped != 1 {
+		t.Errorf("Expected 1 dropped packet, got %d", dropped)
+	}
+	conn.Close()
+}
+
+func TestServer_OutageClose(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: testutil.FreePort(t),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+		OutageRules:  []config.OutageRule{{Match: "127.0.0.0/8", Policy: config.OutageClose}},
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+
+	conn := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	testutil.Eventually(t, func() bool { return len(proxy.GetClients()) == 1 }, "client not registered")
+	_, _ = conn.Write([]byte{0x01})
+	expectClosed(t, conn)
+}
+
+func TestServer_ClientAccess(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+		IdentTimeout: 1,
+		ClientAccess: config.AccessRead,
+		AccessRules:  []config.AccessRule{{Match: "127.0.0.0/8", Name: "controller", Access: config.AccessWrite}},
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+
+	upstream.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not connected")
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort)
+
+	// The anonymous client is read-only: its writes are dropped, but it
+	// still receives upstream data
+	guest := testutil.Dial(t, addr)
+	_, _ = guest.Write([]byte{0x01})
+	testutil.Eventually(t, func() bool { return proxy.GetMetrics().DroppedPackets == 1 }, "write not dropped")
+
+	controller := testutil.Dial(t, addr)
+	_, _ = controller.Write([]byte("IDENT controller\n\x02"))
+	upstream.Expect([]byte{0x02})
+
+	access := map[string]string{}
+	for _, c := range proxy.GetClients() {
+		access[c.Name] = c.Access
+	}
+	if access[""] != config.AccessRead || access["controller"] != config.AccessWrite {
+		t.Errorf("Unexpected access levels %v", access)
+	}
+
+	upstream.Send([]byte{0x03})
+	testutil.ExpectRead(t, guest, []byte{0x03})
+	testutil.ExpectRead(t, controller, []byte{0x03})
+}
+
+func TestServer_ESPHomeProfile(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost:  "127.0.0.1",
+		UpstreamPort:  upstream.Port(),
+		ListenPort:    testutil.FreePort(t),
+		MaxClients:    10,
+		ClientBanner:  "serial-tcp-proxy",
+		IdentTimeout:  5,
+		ListenProfile: config.ProfileESPHome,
+		ListenSingle:  true,
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+
+	upstream.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not connected")
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort)
+
+	// No banner, and writes pass through without waiting for IDENT
+	first := testutil.Dial(t, addr)
+	_, _ = first.Write([]byte{0x01})
+	upstream.Expect([]byte{0x01})
+	upstream.Send([]byte{0x02})
+	testutil.ExpectRead(t, first, []byte{0x02})
+	if clients := proxy.GetClients(); len(clients) != 1 || !clients[0].Raw {
+		t.Errorf("Expected one raw client, got %+v", clients)
+	}
+
+	// A second connection takes over from the first
+	second := testutil.Dial(t, addr)
+	_ = first.SetReadDeadline(time.Now().Add(testutil.DefaultTimeout))
+	if _, err := first.Read(make([]byte, 16)); err == nil {
+		t.Error("Expected the first connection closed")
+	}
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 1 }, "first client not replaced")
+	upstream.Send([]byte{0x03})
+	testutil.ExpectRead(t, second, []byte{0x03})
+}
+
+func TestServer_RefusedWrites(t *testing.T) {
+	start := func(t *testing.T, action string) (*Server, *testutil.MockUpstream, string) {
+		upstream := testutil.NewMockUpstream(t)
+		cfg := &config.Config{
+			UpstreamHost:   "127.0.0.1",
+			UpstreamPort:   upstream.Port(),
+			ListenPort:     testutil.FreePort(t),
+			MaxClients:     10,
+			ClientAccess:   config.AccessRead,
+			RefusedWrites:  action,
+			RefusedMessage: "ERR read-only",
+		}
+		proxy := NewServer(cfg, newTestLogger())
+		if err := proxy.Start(context.Background()); err != nil {
+			t.Fatalf("Failed to start proxy: %v", err)
+		}
+		t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+		upstream.WaitConn()
+		testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not connected")
+		return proxy, upstream, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort)
+	}
+
+	t.Run("error", func(t *testing.T) {
+		proxy, _, addr := start(t, config.RefuseError)
+		guest := testutil.Dial(t, addr)
+		_, _ = guest.Write([]byte{0x01})
+		testutil.ExpectRead(t, guest, []byte("ERR read-only\r\n"))
+		_, _ = guest.Write([]byte{0x02})
+		testutil.ExpectRead(t, guest, []byte("ERR read-only\r\n"))
+		if clients := proxy.GetClients(); len(clients) != 1 || clients[0].Refused != 2 {
+			t.Errorf("Expected 2 refused writes, got %+v", clients)
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		proxy, upstream, addr := start(t, config.RefuseReset)
+		conn := testutil.Dial(t, addr)
+		testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 1 }, "client not registered")
+		_, _ = conn.Write([]byte{0x03})
+		_ = conn.SetReadDeadline(time.Now().Add(testutil.DefaultTimeout))
+		if _, err := conn.Read(make([]byte, 16)); !errors.Is(err, syscall.ECONNRESET) {
+			t.Errorf("Expected a connection reset, got %v", err)
+		}
+		testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 0 }, "client not disconnected")
+		select {
+		case data := <-upstream.Received():
+			t.Errorf("Expected the refused write not to reach the upstream, got % x", data)
+		default:
+		}
+	})
+}
+
+func TestServer_AccessHours(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	now := time.Now()
+	span := func(from, to time.Duration) string {
+		return now.Add(from).Format("15:04") + "-" + now.Add(to).Format("15:04")
+	}
+	inside, outside := span(-time.Hour, time.Hour), span(2*time.Hour, 3*time.Hour)
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+		AccessRules: []config.AccessRule{
+			{Match: "127.0.0.2", Access: config.AccessWrite, Hours: outside},
+			{Match: "127.0.0.2", Access: config.AccessDeny},
+			{Match: "127.0.0.1", Access: config.AccessWrite, Hours: inside},
+			{Match: "127.0.0.0/8", Access: config.AccessRead},
+		},
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	upstream.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not connected")
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort)
+
+	// Outside its hours the integrator falls through to the deny rule and
+	// is refused on accept
+	d := proxy.accessAt(net.ParseIP("127.0.0.2"), "", now)
+	if d.access != config.AccessDeny || !strings.Contains(d.String(), "outside hours") {
+		t.Errorf("Unexpected decision %q: %s", d.access, d)
+	}
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2")}, Timeout: testutil.DefaultTimeout}
+	if integrator, err := dialer.Dial("tcp", addr); err == nil {
+		_ = integrator.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := integrator.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("Expected the connection to be closed, got %v", err)
+		}
+		integrator.Close()
+	}
+	if d := proxy.accessAt(net.ParseIP("127.0.0.2"), "", now.Add(150*time.Minute)); d.access != config.AccessWrite {
+		t.Errorf("Expected write access within the hours, got %q", d.access)
+	}
+
+	conn := testutil.Dial(t, addr)
+	_, _ = conn.Write([]byte{0x01})
+	upstream.Expect([]byte{0x01})
+
+	// When the hours end the client drops to read access, and its writes
+	// are dropped
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 1 }, "client not registered")
+	cl := proxy.clients.GetAll()[0]
+	if access := proxy.refreshAccess(cl, now.Add(150*time.Minute)); access != config.AccessRead {
+		t.Fatalf("Expected read access after the hours, got %q", access)
+	}
+	_, _ = conn.Write([]byte{0x02})
+	testutil.Eventually(t, func() bool { return proxy.GetMetrics().DroppedPackets == 1 }, "write not dropped")
+}
+
+func TestServer_ConnectRateLimit(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: testutil.FreePort(t),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+		ConnectRate:  2,
+		GreylistSecs: 60,
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort)
+
+	for i := 0; i < 2; i++ {
+		conn := testutil.Dial(t, addr)
+		testutil.Eventually(t, func() bool { return len(proxy.GetClients()) == 1 }, "client not registered")
+		conn.Close()
+		testutil.Eventually(t, func() bool { return len(proxy.GetClients()) == 0 }, "client not removed")
+	}
+
+	expectClosed(t, testutil.Dial(t, addr))
+	expectClosed(t, testutil.Dial(t, addr))
+
+	limits, ok := proxy.GetStatus()["connection_limits"].(connlimit.Stats)
+	if !ok {
+		t.Fatal("Expected connection_limits in status")
+	}
+	if len(limits.Greylisted) != 1 || limits.Greylisted[0].IP != "127.0.0.1" {
+		t.Errorf("Expected 127.0.0.1 greylisted, got %+v", limits.Greylisted)
+	}
+	if limits.Rejected != 2 {
+		t.Errorf("Expected 2 rejected attempts, got %d", limits.Rejected)
+	}
+}
+
+func TestServer_MaxClientsPerIP(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost:    "127.0.0.1",
+		UpstreamPort:    testutil.FreePort(t),
+		ListenPort:      testutil.FreePort(t),
+		MaxClients:      10,
+		MaxClientsPerIP: 1,
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort)
+
+	first := testutil.Dial(t, addr)
+	testutil.Eventually(t, func() bool { return len(proxy.GetClients()) == 1 }, "client not registered")
+	expectClosed(t, testutil.Dial(t, addr))
+
+	first.Close()
+	testutil.Eventually(t, func() bool { return len(proxy.GetClients()) == 0 }, "client not removed")
+	testutil.Dial(t, addr)
+	testutil.Eventually(t, func() bool { return len(proxy.GetClients()) == 1 }, "client not accepted after the first left")
+
+	sec := proxy.GetStats().Security
+	if sec == nil || sec.RejectedConnections != 1 || sec.RejectedBy[connlimit.ReasonPerIPLimit] != 1 {
+		t.Errorf("Expected 1 per_ip_limit rejection in security stats, got %+v", sec)
+	}
+}
+
+func TestServer_BannerAndIdentity(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+		ClientBanner: "serial-tcp-proxy ready",
+		IdentTimeout: 5,
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+
+	upstream.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not connected")
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort)
+
+	named := testutil.Dial(t, addr)
+	testutil.ExpectRead(t, named, []byte("serial-tcp-proxy ready\r\n"))
+	_, _ = named.Write([]byte("IDENT "))
+	time.Sleep(20 * time.Millisecond)
+	_, _ = named.Write([]byte("controller\r\n\x01"))
+	upstream.Expect([]byte{0x01})
+
+	// A client that does not identify itself is forwarded immediately
+	anonymous := testutil.Dial(t, addr)
+	testutil.ExpectRead(t, anonymous, []byte("serial-tcp-proxy ready\r\n"))
+	_, _ = anonymous.Write([]byte{0x02})
+	upstream.Expect([]byte{0x02})
+
+	names := map[string]int{}
+	for _, c := range proxy.GetClients() {
+		names[c.Name]++
+	}
+	if names["controller"] != 1 || names[""] != 1 {
+		t.Errorf("Expected one named and one anonymous client, got %v", names)
+	}
+}
+
+func TestServer_ClientGroups(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+		IdentTimeout: 5,
+		ClientGroups: []config.ClientGroup{{Name: "dashboards", Client: "dashboard-*", Filter: []string{"a1"}}},
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+
+	upstream.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not connected")
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort)
+
+	dashboard := testutil.Dial(t, addr)
+	_, _ = dashboard.Write([]byte("IDENT dashboard-1\n\x01"))
+	upstream.Expect([]byte{0x01})
+	controller := testutil.Dial(t, addr)
+	_, _ = controller.Write([]byte("IDENT controller\n\x02"))
+	upstream.Expect([]byte{0x02})
+
+	groups := map[string]string{}
+	for _, c := range proxy.GetClients() {
+		groups[c.Name] = c.Group
+	}
+	if groups["dashboard-1"] != "dashboards" || groups["controller"] != "" {
+		t.Fatalf("Expected only dashboard-1 in dashboards, got %v", groups)
+	}
+
+	// The filter keeps frames without the a1 prefix from the group
+	upstream.Send([]byte{0xb2, 0x01})
+	testutil.ExpectRead(t, controller, []byte{0xb2, 0x01})
+	upstream.Send([]byte{0xa1, 0x02})
+	testutil.ExpectRead(t, controller, []byte{0xa1, 0x02})
+	testutil.ExpectRead(t, dashboard, []byte{0xa1, 0x02})
+
+	// An injection to the group reaches its clients only, whatever the filter
+	if err := proxy.InjectPacket("group:dashboards", []byte{0xc3}); err != nil {
+		t.Fatalf("InjectPacket failed: %v", err)
+	}
+	if err := proxy.InjectPacket("downstream", []byte{0xa1, 0x04}); err != nil {
+		t.Fatalf("InjectPacket failed: %v", err)
+	}
+	testutil.ExpectRead(t, dashboard, []byte{0xc3, 0xa1, 0x04})
+	testutil.ExpectRead(t, controller, []byte{0xa1, 0x04})
+
+	if err := proxy.InjectPacket("group:unknown", []byte{0xc3}); !errors.Is(err, ErrInvalidTarget) {
+		t.Errorf("Expected ErrInvalidTarget for an unknown group, got %v", err)
+	}
+}
+
+func TestServer_WriteJournal(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	path := filepath.Join(t.TempDir(), "writes.jsonl")
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+		IdentTimeout: 5,
+		WriteJournal: path,
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+
+	upstream.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not connected")
+
+	conn := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	_, _ = conn.Write([]byte("IDENT controller\n\x01\x02"))
+	upstream.Expect([]byte{0x01, 0x02})
+	if err := proxy.InjectPacket("upstream", []byte{0x03}); err != nil {
+		t.Fatalf("InjectPacket failed: %v", err)
+	}
+	upstream.Expect([]byte{0x03})
+	conn.Close()
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 0 }, "client not removed")
+	if err := proxy.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read journal: %v", err)
+	}
+	var entries []journal.Entry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var e journal.Entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Invalid journal line %q: %v", line, err)
+		}
+		entries = append(entries, e)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 journal entries, got %+v", entries)
+	}
+	if e := entries[0]; e.Source != "client#1" || e.Name != "controller" || e.Data != "0102" || e.Session == "" || e.Time.IsZero() {
+		t.Errorf("Unexpected client entry %+v", e)
+	}
+	if e := entries[1]; e.Source != journal.SourceInject || e.Data != "03" {
+		t.Errorf("Unexpected injection entry %+v", e)
+	}
+}
+
+func TestServer_StableClientIDs(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+		IdentTimeout: 5,
+		ClientIDs:    config.ClientIDsStable,
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+
+	upstream.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not connected")
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort)
+
+	ids := func() map[string]bool {
+		out := map[string]bool{}
+		for _, c := range proxy.GetClients() {
+			out[c.ID] = true
+		}
+		return out
+	}
+
+	// The same host reconnecting under the same name keeps its ID
+	for i := 0; i < 2; i++ {
+		named := testutil.Dial(t, addr)
+		_, _ = named.Write([]byte("IDENT zwave-js\n\x01"))
+		upstream.Expect([]byte{0x01})
+		if got := ids(); len(got) != 1 || !got["zwave-js@127.0.0.1"] {
+			t.Fatalf("Expected client zwave-js@127.0.0.1, got %v", got)
+		}
+		named.Close()
+		testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 0 }, "client not removed")
+	}
+
+	anonymous := testutil.Dial(t, addr)
+	_, _ = anonymous.Write([]byte{0x02})
+	upstream.Expect([]byte{0x02})
+	second := testutil.Dial(t, addr)
+	_, _ = second.Write([]byte{0x03})
+	upstream.Expect([]byte{0x03})
+	if got := ids(); len(got) != 2 || !got["127.0.0.1"] || !got["127.0.0.1#2"] {
+		t.Errorf("Expected clients 127.0.0.1 and 127.0.0.1#2, got %v", got)
+	}
+	anonymous.Close()
+	second.Close()
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 0 }, "clients not removed")
+
+	// A client still identifying is not registered yet, and Stop must not
+	// wait out its timeout
+	testutil.Dial(t, addr)
+	start := time.Now()
+	_ = proxy.Stop(context.Background())
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected Stop to close identifying clients, took %v", elapsed)
+	}
+}
+
+func TestServer_ForwardingPaused(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+
+	upstream.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not connected")
+	conn := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 1 }, "client not registered")
+
+	proxy.SetForwardingPaused(true)
+	if paused, _ := proxy.GetStatus()["forwarding_paused"].(bool); !paused {
+		t.Error("Expected forwarding_paused in status")
+	}
+
+	_, _ = conn.Write([]byte{0x01})
+	upstream.Send([]byte{0x02})
+	select {
+	case data := <-upstream.Received():
+		t.Fatalf("Expected nothing forwarded to upstream while paused, got %x", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Fatalf("Expected nothing forwarded to client while paused, got %d bytes", n)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	proxy.SetForwardingPaused(false)
+	_, _ = conn.Write([]byte{0x03})
+	upstream.Expect([]byte{0x03})
+	upstream.Send([]byte{0x04})
+	testutil.ExpectRead(t, conn, []byte{0x04})
+}
+
+func TestServer_Events(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	events := make(chan Event, 16)
+	proxy.SetEventCallback(func(e Event) { events <- e })
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+
+	next := func(eventType string) Event {
+		t.Helper()
+		timeout := time.After(testutil.DefaultTimeout)
+		for {
+			select {
+			case e := <-events:
+				if e.Type == eventType {
+					return e
+				}
+			case <-timeout:
+				t.Fatalf("Timed out waiting for %s event", eventType)
+			}
+		}
+	}
+
+	upstream.WaitConn()
+	for next(EventUpstreamState).Upstream.State != "Connected" {
+	}
+
+	conn := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	e := next(EventClientConnected)
+	if e.Client == nil || e.Client.Type != "tcp" || e.Clients != 1 || e.Time == "" {
+		t.Errorf("Unexpected client_connected event: %+v", e)
+	}
+
+	conn.Close()
+	e = next(EventClientDisconnected)
+	if e.Client == nil || e.Client.ID != "client#1" || e.Clients != 0 {
+		t.Errorf("Unexpected client_disconnected event: %+v", e)
+	}
+}
+
+func TestMaybeIdent(t *testing.T) {
+	tests := []struct {
+		data string
+		want bool
+	}{
+		{"", true},
+		{"ID", true},
+		{"IDENT ", true},
+		{"IDENT plc", true},
+		{"IDX", false},
+		{"\xf7\x0e", false},
+	}
+	for _, tt := range tests {
+		if got := maybeIdent([]byte(tt.data)); got != tt.want {
+			t.Errorf("maybeIdent(%q): expected %v, got %v", tt.data, tt.want, got)
+		}
+	}
+}
+
+func TestServer_GetStats(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+
+	upstream.WaitConn()
+	conn := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 1 }, "client not registered")
+
+	upstream.Send([]byte{0x01, 0x02, 0x03})
+	testutil.ExpectRead(t, conn, []byte{0x01, 0x02, 0x03})
+
+	st := proxy.GetStats()
+	if st.Totals.BytesFromUpstream != 3 || st.Totals.Broadcasts != 1 {
+		t.Errorf("Unexpected totals: %+v", st.Totals)
+	}
+	if st.PacketSizes.FromUpstream.Count() != 1 || st.PacketSizes.Max != 3 {
+		t.Errorf("Unexpected packet sizes: %+v", st.PacketSizes)
+	}
+	if st.Broadcast.Count != 1 || st.Broadcast.P50 <= 0 || st.Broadcast.Hist.Count() != 1 {
+		t.Errorf("Unexpected broadcast latency: %+v", st.Broadcast)
+	}
+	for _, w := range []string{"1m", "5m", "15m"} {
+		if _, ok := st.Rates[w]; !ok {
+			t.Errorf("Expected a %s rate", w)
+		}
+	}
+	if len(st.Upstreams) != 1 || !st.Upstreams[0].Connected {
+		t.Errorf("Unexpected upstreams: %+v", st.Upstreams)
+	}
+}
+
+func TestServer_Flashing(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	upstream.WaitConn()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort)
+	flasher := testutil.Dial(t, addr)
+	other := testutil.Dial(t, addr)
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 2 }, "clients not registered")
+
+	var flasherID, otherID string
+	for _, c := range proxy.GetClients() {
+		if c.Addr == flasher.LocalAddr().String() {
+			flasherID = c.ID
+		} else {
+			otherID = c.ID
+		}
+	}
+
+	if err := proxy.StartFlashing("client#missing"); err != ErrClientNotFound {
+		t.Errorf("Expected ErrClientNotFound, got %v", err)
+	}
+	if err := proxy.StartFlashing(flasherID); err != nil {
+		t.Fatalf("StartFlashing failed: %v", err)
+	}
+	if err := proxy.StartFlashing(otherID); err != ErrFlashing {
+		t.Errorf("Expected ErrFlashing for a second client, got %v", err)
+	}
+	if st := proxy.FlashStatus(); !st.Active || st.ClientID != flasherID || st.AutoDetected {
+		t.Errorf("Unexpected flashing status: %+v", st)
+	}
+
+	// Upstream data reaches the flashing client only, unchanged
+	upstream.Send([]byte{0xFF, 0x01})
+	testutil.ExpectRead(t, flasher, []byte{0xFF, 0x01})
+	_ = other.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := other.Read(make([]byte, 16)); err == nil {
+		t.Errorf("Expected no data for other clients, got %d bytes", n)
+	}
+	_ = other.SetReadDeadline(time.Time{})
+
+	// Only the flashing client may write
+	if _, err := other.Write([]byte{0x05}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := flasher.Write([]byte{0x06}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	upstream.Expect([]byte{0x06})
+
+	if err := proxy.InjectPacket("upstream", []byte{0x07}); err != ErrFlashing {
+		t.Errorf("Expected injection refused while flashing, got %v", err)
+	}
+
+	// Flashing ends when the client disconnects
+	flasher.Close()
+	testutil.Eventually(t, func() bool { return !proxy.FlashStatus().Active }, "flashing mode did not end")
+	upstream.Send([]byte{0x08})
+	testutil.ExpectRead(t, other, []byte{0x08})
+}
+
+func TestServer_FlashingAutoDetect(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost:    "127.0.0.1",
+		UpstreamPort:    upstream.Port(),
+		ListenPort:      testutil.FreePort(t),
+		MaxClients:      10,
+		FlashAutoDetect: true,
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	upstream.WaitConn()
+
+	conn := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+
+	// WILL COM-PORT-OPTION, SET-BAUDRATE 115200, then data with an escaped 0xFF
+	setBaud := []byte{0xFF, 0xFA, 44, 1, 0x00, 0x01, 0xC2, 0x00, 0xFF, 0xF0}
+	msg := append([]byte{0xFF, 0xFB, 44}, setBaud...)
+	msg = append(msg, 0x41, 0xFF, 0xFF)
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// DO COM-PORT-OPTION and the baud rate acknowledgement
+	testutil.ExpectRead(t, conn, []byte{0xFF, 0xFD, 44, 0xFF, 0xFA, 44, 101, 0x00, 0x01, 0xC2, 0x00, 0xFF, 0xF0})
+	upstream.Expect([]byte{0x41, 0xFF})
+
+	if st := proxy.FlashStatus(); !st.Active || !st.AutoDetected || !st.RFC2217 {
+		t.Errorf("Unexpected flashing status: %+v", st)
+	}
+
+	// Upstream data is escaped for the Telnet client
+	upstream.Send([]byte{0xFF, 0x02})
+	testutil.ExpectRead(t, conn, []byte{0xFF, 0xFF, 0x02})
+}
+
+func TestServer_RawPort(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost:  "127.0.0.1",
+		UpstreamPort:  upstream.Port(),
+		ListenPort:    testutil.FreePort(t),
+		RawListenPort: testutil.FreePort(t),
+		MaxClients:    10,
+		UpstreamTags:  true,
+		ClientBanner:  "hello",
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	upstream.WaitConn()
+
+	processed := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	testutil.ExpectRead(t, processed, []byte("hello\r\n"))
+	raw := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.RawListenPort))
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 2 }, "clients not registered")
+
+	rawClients := 0
+	for _, c := range proxy.GetClients() {
+		if c.Raw {
+			rawClients++
+		}
+	}
+	if rawClients != 1 {
+		t.Errorf("Expected 1 raw client, got %d", rawClients)
+	}
+
+	// The processed client gets the source header, the raw client the bytes
+	// as received and no banner
+	upstream.Send([]byte{0xAA, 0xBB})
+	testutil.ExpectRead(t, processed, []byte{0x00, 0x00, 0x02, 0xAA, 0xBB})
+	testutil.ExpectRead(t, raw, []byte{0xAA, 0xBB})
+
+	if _, err := raw.Write([]byte{0x01, 0x02}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	upstream.Expect([]byte{0x01, 0x02})
+
+	// Injections go to the processed stream only
+	if err := proxy.InjectPacket("downstream", []byte{0x03}); err != nil {
+		t.Fatalf("InjectPacket failed: %v", err)
+	}
+	testutil.ExpectRead(t, processed, []byte{0x03})
+	upstream.Send([]byte{0x04})
+	testutil.ExpectRead(t, raw, []byte{0x04})
+}
+
+func TestServer_HexFormat(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		ListenFormat: config.FormatHex,
+		MaxClients:   10,
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	upstream.WaitConn()
+
+	conn := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 1 }, "client not registered")
+	if clients := proxy.GetClients(); clients[0].Format != config.FormatHex {
+		t.Errorf("Expected client format hex, got %q", clients[0].Format)
+	}
+
+	upstream.Send([]byte{0xAA, 0x0B})
+	testutil.ExpectRead(t, conn, []byte("aa 0b\r\n"))
+
+	// Each line is one frame; invalid lines are answered and dropped
+	if _, err := conn.Write([]byte("zz\r\n\r\n01 02")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	testutil.ExpectRead(t, conn, []byte("ERR invalid hex\r\n"))
+	if _, err := conn.Write([]byte(" 03\n")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	upstream.Expect([]byte{0x01, 0x02, 0x03})
+}
+
+func TestServer_InjectionDisabled(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	disabled := false
+	cfg := &config.Config{
+		UpstreamHost:  "127.0.0.1",
+		UpstreamPort:  upstream.Port(),
+		ListenPort:    testutil.FreePort(t),
+		MaxClients:    10,
+		InjectEnabled: &disabled,
+		Triggers: []config.TriggerRule{
+			{Name: "drop", HexPrefix: "aa", Suppress: true},
+		},
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	upstream.WaitConn()
+
+	if err := proxy.InjectPacket("upstream", []byte{0x01}); err != ErrInjectDisabled {
+		t.Errorf("Expected ErrInjectDisabled, got %v", err)
+	}
+	if proxy.GetStatus()["injection_disabled"] != true {
+		t.Error("Expected injection_disabled in status")
+	}
+
+	// Triggers are off, so the packet they would suppress is forwarded
+	conn := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 1 }, "client not registered")
+	upstream.Send([]byte{0xAA, 0x01})
+	testutil.ExpectRead(t, conn, []byte{0xAA, 0x01})
+
+	proxy.SetInjectionEnabled(true)
+	if err := proxy.InjectPacket("upstream", []byte{0x02}); err != nil {
+		t.Fatalf("InjectPacket failed: %v", err)
+	}
+	upstream.Expect([]byte{0x02})
+}
+
+func TestServer_TriggerRespondsToSender(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+		Triggers: []config.TriggerRule{
+			{Name: "ping", Direction: "to_upstream", HexPrefix: "aa", Respond: "f0", Suppress: true},
+		},
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	upstream.WaitConn()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort)
+	sender := testutil.Dial(t, addr)
+	other := testutil.Dial(t, addr)
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 2 }, "clients not registered")
+
+	// The response goes back to the client that sent the packet only
+	if _, err := sender.Write([]byte{0xAA}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	testutil.ExpectRead(t, sender, []byte{0xF0})
+	upstream.Send([]byte{0x01})
+	testutil.ExpectRead(t, other, []byte{0x01})
+}
+
+func TestServer_DryRun(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+		DryRun:       true,
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	upstream.WaitConn()
+
+	conn := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	if _, err := conn.Write([]byte{0x01, 0x02}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	testutil.Eventually(t, func() bool { return proxy.GetStats().Totals.DryRunPackets == 1 }, "write not counted")
+	if totals := proxy.GetStats().Totals; totals.DryRunBytes != 2 || totals.PacketsToUpstream != 0 {
+		t.Errorf("Expected 2 bytes withheld and none forwarded, got %+v", totals)
+	}
+	if proxy.GetStatus()["dry_run"] != true {
+		t.Error("Expected dry_run in status")
+	}
+
+	// Upstream data still reaches the client
+	upstream.Send([]byte{0xAA})
+	testutil.ExpectRead(t, conn, []byte{0xAA})
+
+	proxy.SetDryRun(false)
+	if _, err := conn.Write([]byte{0x03}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	upstream.Expect([]byte{0x03})
+}
+
+func TestServer_DenyFrames(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+		DenyFrames: []config.DenyRule{
+			{Name: "factory-reset", HexPrefix: "1a c0"},
+			{Name: "bootloader", Regex: "^fe..0f"},
+		},
+	}
+
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	upstream.WaitConn()
+
+	// A denied client write is dropped, the next one forwarded
+	conn := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	if _, err := conn.Write([]byte{0x1A, 0xC0, 0x01}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	testutil.Eventually(t, func() bool { return proxy.deny.rules[0].blocked.Load() == 1 }, "client write not blocked")
+	if _, err := conn.Write([]byte{0x1A, 0x01}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	upstream.Expect([]byte{0x1A, 0x01})
+
+	err := proxy.InjectPacket("upstream", []byte{0xFE, 0x00, 0x0F})
+	if !errors.Is(err, ErrDenied) || !strings.Contains(err.Error(), "bootloader") {
+		t.Fatalf("Expected ErrDenied for the bootloader rule, got %v", err)
+	}
+	if err := proxy.InjectPacket("downstream", []byte{0x1A, 0xC0}); err != nil {
+		t.Errorf("Expected downstream injection to be allowed, got %v", err)
+	}
+	testutil.ExpectRead(t, conn, []byte{0x1A, 0xC0})
+
+	if err := proxy.InjectPacketOverride("upstream", []byte{0xFE, 0x00, 0x0F}); err != nil {
+		t.Fatalf("InjectPacketOverride failed: %v", err)
+	}
+	upstream.Expect([]byte{0xFE, 0x00, 0x0F})
+
+	status, _ := proxy.GetStatus()["deny_frames"].([]DenyStatus)
+	want := []DenyStatus{{Name: "factory-reset", Blocked: 1}, {Name: "bootloader", Blocked: 1, Overridden: 1}}
+	if !slices.Equal(status, want) {
+		t.Errorf("Expected deny status %+v, got %+v", want, status)
+	}
+}
+
+func TestServer_LatencyBudget(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost:    "127.0.0.1",
+		UpstreamPort:    8899,
+		ListenPort:      18899,
+		MaxClients:      10,
+		LatencyBudgetMs: 5,
+	}
+	proxy := NewServer(cfg, newTestLogger())
+
+	proxy.observeForward(true, time.Millisecond, "client#1")
+	proxy.observeForward(true, 20*time.Millisecond, "client#1")
+	proxy.observeForward(false, 8*time.Millisecond, "primary")
+
+	st := proxy.GetStats()
+	if st.Totals.SlowPackets != 2 {
+		t.Errorf("Expected 2 slow packets, got %d", st.Totals.SlowPackets)
+	}
+	if st.Forwarding.ToUpstream.Count != 2 || st.Forwarding.FromUpstream.Count != 1 {
+		t.Errorf("Expected 2/1 forwarded packets, got %d/%d", st.Forwarding.ToUpstream.Count, st.Forwarding.FromUpstream.Count)
+	}
+	if st.Forwarding.ToUpstream.Max != 20000 || st.Forwarding.BudgetMs != 5 {
+		t.Errorf("Expected max 20000us and budget 5ms, got %v and %d", st.Forwarding.ToUpstream.Max, st.Forwarding.BudgetMs)
+	}
+
+	// Only the first overrun within the alert interval is logged
+	var a slowAlert
+	now := time.Now()
+	if _, ok := a.due(now); !ok {
+		t.Error("Expected the first warning to be due")
+	}
+	if _, ok := a.due(now.Add(time.Second)); ok {
+		t.Error("Expected the second warning to be held back")
+	}
+	if missed, ok := a.due(now.Add(slowAlertInterval)); !ok || missed != 1 {
+		t.Errorf("Expected a warning reporting 1 missed overrun, got %d, %v", missed, ok)
+	}
+}
+
+func TestServer_WriteRetry(t *testing.T) {
+	cfg := &config.Config{UpstreamHost: "127.0.0.1", UpstreamPort: 1, MaxClients: 10, WriteRetryFrames: 2}
+	ps := NewServer(cfg, newTestLogger())
+	cl := &client.Client{ID: "client#1", Log: newTestLogger()}
+
+	connected := false
+	var written [][]byte
+	write := func(data []byte) error {
+		if !connected {
+			return net.ErrClosed
+		}
+		written = append(written, data)
+		return nil
+	}
+
+	// The third frame does not fit in the queue
+	reset := errors.New("connection reset by peer")
+	for _, b := range []byte{0x01, 0x02, 0x03} {
+		ps.writeFailed(cl, []byte{b}, write, reset)
+	}
+	ps.flushRetries()
+	if n := ps.pendingRetries(); n != 2 {
+		t.Fatalf("Expected 2 frames kept while the upstream is down, got %d", n)
+	}
+
+	connected = true
+	ps.flushRetries()
+	if len(written) != 2 || written[0][0] != 0x01 || written[1][0] != 0x02 {
+		t.Errorf("Expected frames 01 and 02 retried in order, got %x", written)
+	}
+	snap := ps.metrics.Snapshot()
+	if snap.RetriedPackets != 2 || snap.LostPackets != 1 || snap.DroppedPackets != 1 {
+		t.Errorf("Expected 2 retried and 1 lost, got %+v", snap)
+	}
+
+	// Frames older than the maximum age are not retried
+	ps.writeFailed(cl, []byte{0x04}, write, reset)
+	ps.retries.frames[0].failed = time.Now().Add(-time.Duration(config.DefaultWriteRetryMaxAge+1) * time.Millisecond)
+	ps.flushRetries()
+	if len(written) != 2 || ps.pendingRetries() != 0 {
+		t.Errorf("Expected the expired frame to be dropped, written %x", written)
+	}
+	if snap := ps.metrics.Snapshot(); snap.LostPackets != 2 {
+		t.Errorf("Expected 2 lost, got %d", snap.LostPackets)
+	}
+}
+
+func TestServer_WaitForUpstream(t *testing.T) {
+	// No upstream: the listener opens once the wait times out
+	cfg := &config.Config{
+		UpstreamHost:    "127.0.0.1",
+		UpstreamPort:    testutil.FreePort(t),
+		ListenPort:      testutil.FreePort(t),
+		MaxClients:      10,
+		WaitForUpstream: "300ms",
+	}
+	ps := NewServer(cfg, newTestLogger())
+	started := make(chan error, 1)
+	go func() { started <- ps.Start(context.Background()) }()
+	defer ps.Stop(context.Background())
+
+	testutil.Eventually(t, ps.IsStarting, "startup not waiting for the upstream")
+	if ps.IsListening() {
+		t.Error("Expected no client listener while waiting")
+	}
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Fatalf("Failed to start proxy: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Start did not return after the wait timed out")
+	}
+	if ps.IsStarting() || !ps.IsListening() {
+		t.Error("Expected the listener open after the timeout")
+	}
+
+	// With an upstream, Start returns as soon as it is connected
+	upstream := testutil.NewMockUpstream(t)
+	defer upstream.Close()
+	cfg = &config.Config{
+		UpstreamHost:    "127.0.0.1",
+		UpstreamPort:    upstream.Port(),
+		ListenPort:      testutil.FreePort(t),
+		MaxClients:      10,
+		WaitForUpstream: "10s",
+	}
+	ps2 := NewServer(cfg, newTestLogger())
+	begin := time.Now()
+	if err := ps2.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer ps2.Stop(context.Background())
+	if !ps2.IsUpstreamConnected() || time.Since(begin) > 5*time.Second {
+		t.Errorf("Expected Start to return once connected, took %v", time.Since(begin))
+	}
+}
+
+func TestServer_StartStopContext(t *testing.T) {
+	// A cancelled context cuts the wait for the upstream short
+	cfg := &config.Config{
+		UpstreamHost:    "127.0.0.1",
+		UpstreamPort:    testutil.FreePort(t),
+		ListenPort:      testutil.FreePort(t),
+		MaxClients:      10,
+		WaitForUpstream: "10s",
+	}
+	ps := NewServer(cfg, newTestLogger())
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := ps.Start(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline error, got %v", err)
+	}
+	if ps.IsListening() {
+		t.Error("Expected no client listener after a cancelled start")
+	}
+	if err := ps.Stop(context.Background()); err != nil {
+		t.Errorf("Unexpected error stopping: %v", err)
+	}
+
+	// Stop reports clients cut off at the deadline
+	upstream := testutil.NewMockUpstream(t)
+	cfg = &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+	}
+	ps = NewServer(cfg, newTestLogger())
+	if err := ps.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	testutil.Eventually(t, func() bool { return ps.GetClientCount() == 1 }, "client not registered")
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer stopCancel()
+	if err := ps.Stop(stopCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the deadline error, got %v", err)
+	}
+}
+
+func TestServer_AcceptEndsWithContext(t *testing.T) {
+	// Accept loops block without a deadline and end by closing their
+	// listener once the server's context is done
+	upstream := testutil.NewMockUpstream(t)
+	cfg := &config.Config{
+		UpstreamHost:  "127.0.0.1",
+		UpstreamPort:  upstream.Port(),
+		ListenPort:    testutil.FreePort(t),
+		RawListenPort: testutil.FreePort(t),
+		MaxClients:    10,
+	}
+	ps := NewServer(cfg, newTestLogger())
+	if err := ps.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer ps.Stop(context.Background())
+	upstream.WaitConn()
+
+	ps.cancel()
+	for _, port := range []int{cfg.ListenPort, cfg.RawListenPort} {
+		testutil.Eventually(t, func() bool {
+			conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second)
+			if err != nil {
+				return true
+			}
+			conn.Close()
+			return false
+		}, "listener still open after the context ended")
+	}
+}
+
+func TestServer_RetryAccept(t *testing.T) {
+	// Accept errors other than a closed listener, such as running out of
+	// file descriptors, are retried with a growing delay
+	ps := NewServer(&config.Config{}, newTestLogger())
+	defer ps.cancel()
+
+	var delay time.Duration
+	for _, want := range []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond} {
+		if !ps.retryAccept("Accept", errors.New("too many open files"), &delay) {
+			t.Fatal("Expected a transient accept error to be retried")
+		}
+		if delay != want {
+			t.Errorf("Expected delay %v, got %v", want, delay)
+		}
+	}
+
+	if ps.retryAccept("Accept", net.ErrClosed, &delay) {
+		t.Error("Expected a closed listener to end the loop")
+	}
+	ps.cancel()
+	if ps.retryAccept("Accept", errors.New("too many open files"), &delay) {
+		t.Error("Expected the loop to end once the context is done")
+	}
+}
+
+func TestServer_Park(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+	}
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	device := upstream.WaitConn()
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort)
+	conn := testutil.Dial(t, addr)
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 1 }, "client not registered")
+
+	// Parking releases the converter and disconnects the client
+	proxy.SetParked(true)
+	_ = device.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := device.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the upstream connection closed, got %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the client disconnected, got %v", err)
+	}
+	if proxy.GetStatus()["parked"] != true || proxy.GetStatus()["upstream_state"] != "Parked" {
+		t.Errorf("Expected parked status, got %v", proxy.GetStatus())
+	}
+	if err := proxy.InjectPacket("upstream", []byte{0x01}); !errors.Is(err, ErrParked) {
+		t.Errorf("Expected ErrParked, got %v", err)
+	}
+
+	// New clients are refused
+	refused := testutil.Dial(t, addr)
+	_ = refused.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := refused.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the new client refused, got %v", err)
+	}
+
+	proxy.SetParked(false)
+	upstream.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not reconnected after resuming")
+	conn = testutil.Dial(t, addr)
+	if _, err := conn.Write([]byte{0x02}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	upstream.Expect([]byte{0x02})
+}
+
+func TestServer_StartParked(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+	cfg := &config.Config{
+		UpstreamHost:    "127.0.0.1",
+		UpstreamPort:    upstream.Port(),
+		ListenPort:      testutil.FreePort(t),
+		MaxClients:      10,
+		StartParked:     true,
+		WaitForUpstream: "10s",
+	}
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+
+	// The wait is skipped and the upstream is left alone
+	if !proxy.Parked() || !proxy.IsListening() {
+		t.Error("Expected the proxy listening and parked")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if proxy.IsUpstreamConnected() {
+		t.Error("Expected no upstream connection while parked")
+	}
+	proxy.SetParked(false)
+	upstream.WaitConn()
+}
+
+func TestServer_TLSRoutes(t *testing.T) {
+	meter1 := testutil.NewMockUpstream(t)
+	meter2 := testutil.NewMockUpstream(t)
+	cfg := &config.Config{
+		UpstreamHost:  "127.0.0.1",
+		UpstreamPort:  meter1.Port(),
+		UpstreamName:  "meter1",
+		Upstreams:     []config.UpstreamSpec{{Name: "meter2", Addr: meter2.Addr()}},
+		ListenPort:    testutil.FreePort(t),
+		TLSListenPort: testutil.FreePort(t),
+		TLSRoutes: []config.TLSRoute{
+			{SNI: "meter1.*", Upstream: "meter1"},
+			{ALPN: "meter2", Upstream: "meter2"},
+		},
+		MaxClients: 10,
+	}
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	meter1.WaitConn()
+	meter2.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstreams not connected")
+
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.TLSListenPort)
+	dial := func(conf *tls.Config) net.Conn {
+		conf.InsecureSkipVerify = true
+		conn, err := tls.Dial("tcp", addr, conf)
+		if err != nil {
+			t.Fatalf("TLS dial failed: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	bySNI := dial(&tls.Config{ServerName: "METER1.local"})
+	byALPN := dial(&tls.Config{NextProtos: []string{"meter2"}})
+	merged := dial(&tls.Config{ServerName: "other.local"})
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 3 }, "TLS clients not registered")
+
+	bound := map[string]int{}
+	for _, c := range proxy.GetClients() {
+		bound[c.Upstream]++
+	}
+	if bound["meter1"] != 1 || bound["meter2"] != 1 || bound[""] != 1 {
+		t.Errorf("Unexpected client bindings %v", bound)
+	}
+
+	// Each routed client sees only its upstream; the unrouted one sees both
+	meter1.Send([]byte{0x11})
+	testutil.ExpectRead(t, bySNI, []byte{0x11})
+	testutil.ExpectRead(t, merged, []byte{0x11})
+	meter2.Send([]byte{0x22})
+	testutil.ExpectRead(t, byALPN, []byte{0x22})
+	testutil.ExpectRead(t, merged, []byte{0x22})
+	meter1.Send([]byte{0x33})
+	testutil.ExpectRead(t, bySNI, []byte{0x33})
+	meter2.Send([]byte{0x44})
+	testutil.ExpectRead(t, byALPN, []byte{0x44})
+
+	// and writes only to it
+	_, _ = byALPN.Write([]byte{0xa2})
+	meter2.Expect([]byte{0xa2})
+	_, _ = bySNI.Write([]byte{0xa1})
+	meter1.Expect([]byte{0xa1})
+	select {
+	case data := <-meter1.Received():
+		t.Errorf("Unexpected write at meter1: %x", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestServer_Hooks(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+	file := filepath.Join(t.TempDir(), "events")
+	record := `echo "$PROXY_EVENT $PROXY_UPSTREAM$PROXY_CLIENT_ID $PROXY_CLIENTS" >> ` + file
+	cfg := &config.Config{
+		UpstreamHost:    "127.0.0.1",
+		UpstreamPort:    upstream.Port(),
+		UpstreamName:    "meter",
+		ListenPort:      testutil.FreePort(t),
+		MaxClients:      10,
+		OnUpstreamUp:    record,
+		OnUpstreamDown:  record,
+		OnClientConnect: record,
+		HookTimeout:     5,
+	}
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+
+	device := upstream.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not connected")
+	testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 1 }, "client not registered")
+	device.Close()
+	upstream.WaitConn()
+
+	want := "upstream_up meter \nclient_connect client#1 1\nupstream_down meter \nupstream_up meter \n"
+	testutil.Eventually(t, func() bool {
+		data, _ := os.ReadFile(file)
+		return string(data) == want
+	}, "hooks did not run in order")
+}
+
+func TestServer_HealthDebounce(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+	file := filepath.Join(t.TempDir(), "events")
+	record := `echo "$PROXY_EVENT $PROXY_UPSTREAM" >> ` + file
+	cfg := &config.Config{
+		UpstreamHost:   "127.0.0.1",
+		UpstreamPort:   upstream.Port(),
+		UpstreamName:   "meter",
+		ListenPort:     testutil.FreePort(t),
+		MaxClients:     10,
+		OnUpstreamUp:   record,
+		OnUpstreamDown: record,
+		HookTimeout:    5,
+		HealthDebounce: 1,
+	}
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	hooksRun := func() string {
+		data, _ := os.ReadFile(file)
+		return string(data)
+	}
+
+	device := upstream.WaitConn()
+	testutil.Eventually(t, func() bool { return hooksRun() == "upstream_up meter\n" }, "up hook did not run")
+
+	// A quick reconnect is recorded as events but fires no hooks
+	device.Close()
+	upstream.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not reconnected")
+	time.Sleep(1500 * time.Millisecond)
+	if got := hooksRun(); got != "upstream_up meter\n" {
+		t.Errorf("Expected no hooks for a blip, got %q", got)
+	}
+	states := []string{}
+	for _, e := range proxy.EventHistory(EventUpstreamState) {
+		states = append(states, e.Upstream.State)
+	}
+	if !slices.Contains(states, "Disconnected") {
+		t.Errorf("Expected the disconnect in the event history, got %v", states)
+	}
+
+	// A longer outage counts as connected until the debounce time has passed
+	upstream.Close()
+	testutil.Eventually(t, func() bool { return !proxy.IsUpstreamConnected() }, "upstream not lost")
+	if !proxy.UpstreamDebounced() {
+		t.Error("Expected the outage to be debounced at first")
+	}
+	testutil.Eventually(t, func() bool { return hooksRun() == "upstream_up meter\nupstream_down meter\n" }, "down hook did not run")
+	if proxy.UpstreamDebounced() {
+		t.Error("Expected the outage to be reported after the debounce time")
+	}
+}
+
+func TestServer_StatusPort(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+	cfg := &config.Config{
+		UpstreamHost:     "127.0.0.1",
+		UpstreamPort:     upstream.Port(),
+		UpstreamName:     "meter",
+		ListenPort:       testutil.FreePort(t),
+		StatusListenPort: testutil.FreePort(t),
+		MaxClients:       10,
+	}
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	stopped := false
+	t.Cleanup(func() {
+		if !stopped {
+			_ = proxy.Stop(context.Background())
+		}
+	})
+
+	conn := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.StatusListenPort))
+	lines := bufio.NewReader(conn)
+	readLine := func() string {
+		_ = conn.SetReadDeadline(time.Now().Add(testutil.DefaultTimeout))
+		line, err := lines.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read status line: %v", err)
+		}
+		return line
+	}
+
+	// The state on connect may still be down while the upstream connects
+	device := upstream.WaitConn()
+	line := readLine()
+	if line == "DOWN meter\n" {
+		line = readLine()
+	}
+	if line != "UP meter\n" {
+		t.Fatalf("Expected the upstream reported up, got %q", line)
+	}
+
+	upstream.Close()
+	device.Close()
+	if line := readLine(); line != "DOWN meter\n" {
+		t.Errorf("Expected the upstream reported down, got %q", line)
+	}
+
+	// Stopping the proxy disconnects status clients
+	stopped = true
+	_ = proxy.Stop(context.Background())
+	_ = conn.SetReadDeadline(time.Now().Add(testutil.DefaultTimeout))
+	if _, err := lines.ReadString('\n'); err == nil {
+		t.Error("Expected the status connection closed")
+	}
+}
+
+func TestServer_Recovery(t *testing.T) {
+	calls := make(chan struct{}, 10)
+	plug := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls <- struct{}{}
+	}))
+	defer plug.Close()
+
+	cfg := &config.Config{
+		UpstreamHost:   "127.0.0.1",
+		UpstreamPort:   testutil.FreePort(t), // nothing listening
+		UpstreamName:   "gateway",
+		ListenPort:     testutil.FreePort(t),
+		MaxClients:     10,
+		RecoveryAfter:  2,
+		RecoveryURL:    plug.URL,
+		RecoveryMethod: http.MethodPost,
+		RecoveryMax:    1,
+	}
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+
+	select {
+	case <-calls:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Recovery endpoint not called")
+	}
+	testutil.Eventually(t, func() bool { return len(proxy.EventHistory(EventRecovery)) == 1 }, "recovery not recorded")
+	a := proxy.EventHistory(EventRecovery)[0].Recovery
+	if a.Upstream != "gateway" || a.Failures != 2 || a.Attempt != 1 || a.Error != "" {
+		t.Errorf("Unexpected recovery attempt %+v", a)
+	}
+}
+
+func TestServer_LivenessReapsIdleClients(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+	cfg := &config.Config{
+		UpstreamHost:    "127.0.0.1",
+		UpstreamPort:    upstream.Port(),
+		ListenPort:      testutil.FreePort(t),
+		MaxClients:      10,
+		LivenessTimeout: 1,
+	}
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	upstream.WaitConn()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort)
+	silent := testutil.Dial(t, addr)
+	talker := testutil.Dial(t, addr)
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 2 }, "clients not registered")
+
+	// The talker keeps sending while the silent client is reaped
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, _ = talker.Write([]byte{0x01})
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	_ = silent.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, err := silent.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+		t.Fatalf("Expected the silent client to be closed, got %v", err)
+	}
+	if n := proxy.GetClientCount(); n != 1 {
+		t.Errorf("Expected the talking client to stay connected, got %d clients", n)
+	}
+	if reaped := proxy.GetStats().Reaped; reaped[ReasonIdle] != 1 {
+		t.Errorf("Expected one idle client reaped, got %v", reaped)
+	}
+	testutil.Eventually(t, func() bool {
+		events := proxy.EventHistory(EventClientDisconnected)
+		return len(events) == 1 && events[0].Client.CloseReason == ReasonIdle
+	}, "no disconnect event with reason idle")
+}
+
+func TestServer_Heartbeat(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+	cfg := &config.Config{
+		UpstreamHost:   "127.0.0.1",
+		UpstreamPort:   upstream.Port(),
+		ListenPort:     testutil.FreePort(t),
+		MaxClients:     10,
+		HeartbeatFrame: "AA 55",
+		HeartbeatSecs:  1,
+	}
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	upstream.WaitConn()
+
+	conn := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 1 }, "client not registered")
+
+	// A quiet bus gets the heartbeat
+	testutil.ExpectRead(t, conn, []byte{0xAA, 0x55})
+
+	// Upstream traffic postpones it
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(300 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				upstream.Send([]byte{0x01})
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var got []byte
+	buf := make([]byte, 64)
+	deadline := time.Now().Add(2500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		_ = conn.SetReadDeadline(deadline)
+		n, err := conn.Read(buf)
+		got = append(got, buf[:n]...)
+		if err != nil {
+			break
+		}
+	}
+	close(stop)
+	<-done
+	if len(got) == 0 || bytes.IndexByte(got, 0xAA) >= 0 {
+		t.Errorf("Expected only upstream data while the bus is busy, got % X", got)
+	}
+	if sent := proxy.GetStatus()["heartbeat_frames"]; sent != uint64(1) {
+		t.Errorf("Expected 1 heartbeat frame, got %v", sent)
+	}
+}
+
+func TestServer_MuxRelay(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+	far := &config.Config{
+		UpstreamHost:  "127.0.0.1",
+		UpstreamPort:  upstream.Port(),
+		UpstreamName:  "meter",
+		ListenPort:    testutil.FreePort(t),
+		MuxListenPort: testutil.FreePort(t),
+		MaxClients:    10,
+	}
+	farProxy := NewServer(far, newTestLogger())
+	if err := farProxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start far proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = farProxy.Stop(context.Background()) })
+	upstream.WaitConn()
+
+	near := &config.Config{
+		UpstreamURL: fmt.Sprintf("mux://127.0.0.1:%d/meter?insecure=1", far.MuxListenPort),
+		ListenPort:  testutil.FreePort(t),
+		MaxClients:  10,
+	}
+	nearProxy := NewServer(near, newTestLogger())
+	if err := nearProxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start near proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = nearProxy.Stop(context.Background()) })
+	testutil.Eventually(t, nearProxy.IsUpstreamConnected, "mux channel not opened")
+
+	// The channel is a client of the far proxy bound to its upstream
+	testutil.Eventually(t, func() bool { return farProxy.GetClientCount() == 1 }, "channel not served as a client")
+	conn := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", near.ListenPort))
+	testutil.Eventually(t, func() bool { return nearProxy.GetClientCount() == 1 }, "client not registered")
+
+	upstream.Send([]byte{0x01, 0x02})
+	testutil.ExpectRead(t, conn, []byte{0x01, 0x02})
+	if _, err := conn.Write([]byte{0x03}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	upstream.Expect([]byte{0x03})
+
+	st := farProxy.MuxStatus()
+	if !st.Listening || len(st.Listener) != 1 || len(st.Listener[0].Channels) != 1 || st.Listener[0].Channels[0].Name != "meter" {
+		t.Errorf("Unexpected listener sessions %+v", st.Listener)
+	}
+	if dialed := nearProxy.MuxStatus().Dialed; len(dialed) != 1 || dialed[0].Channels[0].BytesOut != 1 {
+		t.Errorf("Unexpected dialed sessions %+v", dialed)
+	}
+}
+
+func TestServer_MuxUnknownUpstream(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+	far := &config.Config{
+		UpstreamHost:  "127.0.0.1",
+		UpstreamPort:  upstream.Port(),
+		UpstreamName:  "meter",
+		ListenPort:    testutil.FreePort(t),
+		MuxListenPort: testutil.FreePort(t),
+		MaxClients:    10,
+	}
+	farProxy := NewServer(far, newTestLogger())
+	if err := farProxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start far proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = farProxy.Stop(context.Background()) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := transport.DialMux(ctx, far.MuxListenAddr(), "boiler", true)
+	if err == nil || !strings.Contains(err.Error(), "unknown upstream") {
+		t.Errorf("Expected the channel to be refused, got %v", err)
+	}
+	if n := farProxy.GetClientCount(); n != 0 {
+		t.Errorf("Expected no clients, got %d", n)
+	}
+}
+
+func TestServer_InjectToClient(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+	}
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = proxy.Stop(context.Background()) })
+	upstream.WaitConn()
+
+	addr := fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort)
+	first := testutil.Dial(t, addr)
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 1 }, "first client not registered")
+	second := testutil.Dial(t, addr)
+	testutil.Eventually(t, func() bool { return proxy.GetClientCount() == 2 }, "second client not registered")
+
+	if err := proxy.InjectToClient("client#2", []byte{0x0A}); err != nil {
+		t.Fatalf("InjectToClient failed: %v", err)
+	}
+	// The first client only sees the next broadcast
+	upstream.Send([]byte{0x0B})
+	testutil.ExpectRead(t, second, []byte{0x0A, 0x0B})
+	testutil.ExpectRead(t, first, []byte{0x0B})
+
+	if err := proxy.InjectToClient("client#9", []byte{0x0C}); !errors.Is(err, ErrClientNotFound) {
+		t.Errorf("Expected ErrClientNotFound, got %v", err)
+	}
+	proxy.SetInjectionEnabled(false)
+	if err := proxy.InjectToClient("client#1", []byte{0x0C}); !errors.Is(err, ErrInjectDisabled) {
+		t.Errorf("Expected ErrInjectDisabled, got %v", err)
+	}
+}
+
+func TestServer_ResponseTimeout(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+	cfg := &config.Config{
+		UpstreamHost:      "127.0.0.1",
+		UpstreamPort:      upstream.Port(),
+		ListenPort:        testutil.FreePort(t),
+		MaxClients:        10,
+		FrameGapMs:        5,
+		ResponseTimeoutMs: 100,
+	}
+	proxy := NewServer(cfg, newTestLogger())
+	if err := proxy.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer proxy.Stop(context.Background())
+	upstream.WaitConn()
+	testutil.Eventually(t, proxy.IsUpstreamConnected, "upstream not connected")
+
+	conn := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	_, _ = conn.Write([]byte{0x01, 0x03})
+	upstream.Expect([]byte{0x01, 0x03})
+	upstream.Send([]byte{0x01, 0x83})
+	testutil.ExpectRead(t, conn, []byte{0x01, 0x83})
+
+	// The device never answers the second request
+	_, _ = conn.Write([]byte{0x02, 0x03})
+	upstream.Expect([]byte{0x02, 0x03})
+	testutil.Eventually(t, func() bool {
+		st := proxy.GetStats().Replies
+		return st != nil && st.Timeouts == 1
+	}, "timeout not counted")
+
+	st := proxy.GetStats().Replies
+	if st.Requests != 2 || st.TimeoutRatio["total"] != 0.5 {
+		t.Errorf("Expected 2 requests and a ratio of 0.5, got %+v", st)
+	}
+	if clients := proxy.GetClients(); len(clients) != 1 || clients[0].Requests != 2 || clients[0].Timeouts != 1 {
+		t.Errorf("Expected the client's requests counted, got %+v", clients)
+	}
+}
+
+func TestServer_StopAfterFailedStart(t *testing.T) {
+	// The write scheduler is created but never started when the client
+	// listener cannot be opened, and stopping must not wait for it
+	held, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer held.Close()
+
+	upstream := testutil.NewMockUpstream(t)
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   held.Addr().(*net.TCPAddr).Port,
+		MaxClients:   10,
+		FairWrites:   true,
+	}
+	ps := NewServer(cfg, newTestLogger())
+	if err := ps.Start(context.Background()); err == nil {
+		t.Fatal("Expected Start to fail with LISTEN_PORT in use")
+	}
+
+	stopped := make(chan error)
+	go func() { stopped <- ps.Stop(context.Background()) }()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Unexpected error stopping: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop hung after a failed Start")
+	}
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/client"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/metrics"
+)
+
+// pendingRequest is a client write awaiting the device's answer
+type pendingRequest struct {
+	cl       *client.Client
+	deadline time.Time
+}
+
+// replyWatch supervises request/reply traffic on one upstream with
+// RESPONSE_TIMEOUT_MS. Every client write is a request and the next frame
+// from the upstream answers the oldest one, as on a half-duplex bus where
+// the device answers in turn.
+type replyWatch struct {
+	mu      sync.Mutex
+	pending []pendingRequest
+}
+
+// request records a write by cl to be answered before deadline
+func (w *replyWatch) request(cl *client.Client, deadline time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = append(w.pending, pendingRequest{cl: cl, deadline: deadline})
+}
+
+// answer takes a frame received at now as the answer to the oldest request
+// still in time. It returns the requests that timed out before it.
+func (w *replyWatch) answer(now time.Time) []pendingRequest {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	expired := w.expireLocked(now)
+	if len(w.pending) > 0 {
+		w.pending = w.pending[1:]
+	}
+	return expired
+}
+
+// expire removes and returns the requests unanswered at now
+func (w *replyWatch) expire(now time.Time) []pendingRequest {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.expireLocked(now)
+}
+
+func (w *replyWatch) expireLocked(now time.Time) []pendingRequest {
+	n := 0
+	for n < len(w.pending) && now.After(w.pending[n].deadline) {
+		n++
+	}
+	expired := w.pending[:n:n]
+	w.pending = w.pending[n:]
+	return expired
+}
+
+// reset forgets the pending requests, which a lost connection will not
+// answer. They are not counted as timeouts.
+func (w *replyWatch) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = nil
+}
+
+// responseTimeout returns RESPONSE_TIMEOUT_MS, or 0 when request/reply
+// supervision is off
+func (ps *Server) responseTimeout() time.Duration {
+	return time.Duration(ps.config.ResponseTimeoutMs) * time.Millisecond
+}
+
+// requestLink returns the upstream a client's writes go to, or nil when
+// they go to every upstream
+func (ps *Server) requestLink(cl *client.Client) *upstreamLink {
+	switch {
+	case cl.Raw:
+		return ps.directLink()
+	case cl.Upstream != "":
+		return ps.findLink(cl.Upstream)
+	case ps.config.UpstreamWrite == "":
+		return ps.links[0]
+	case ps.config.UpstreamWrite == config.UpstreamAll:
+		return nil
+	}
+	return ps.findLink(ps.config.UpstreamWrite)
+}
+
+// trackRequest starts waiting for the answer to a write by cl
+func (ps *Server) trackRequest(cl *client.Client) {
+	link := ps.requestLink(cl)
+	if link == nil || link.replies == nil {
+		return
+	}
+	cl.AddRequest()
+	ps.metrics.RecordRequest()
+	link.replies.request(cl, time.Now().Add(ps.responseTimeout()))
+}
+
+// trackReply takes a frame from link as an answer
+func (ps *Server) trackReply(link *upstreamLink) {
+	if link.replies == nil {
+		return
+	}
+	ps.timedOut(link, link.replies.answer(time.Now()))
+}
+
+// timedOut counts the requests the device on link did not answer and logs
+// them, at most once every slowAlertInterval
+func (ps *Server) timedOut(link *upstreamLink, expired []pendingRequest) {
+	if len(expired) == 0 {
+		return
+	}
+	for _, r := range expired {
+		r.cl.AddTimeout()
+		ps.metrics.RecordResponseTimeout()
+	}
+	missed, ok := ps.noReply.due(time.Now())
+	if !ok {
+		return
+	}
+	cl := expired[len(expired)-1].cl
+	cl.Log.Warn("No response from upstream %s to client %s within %dms (%d more since the last warning)",
+		link.name, cl.ID, ps.config.ResponseTimeoutMs, missed+len(expired)-1)
+}
+
+// superviseReplies expires the requests of a device that stays silent
+func (ps *Server) superviseReplies() {
+	defer ps.wg.Done()
+
+	ticker := time.NewTicker(min(ps.responseTimeout(), time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, link := range ps.links {
+				ps.timedOut(link, link.replies.expire(now))
+			}
+		case <-ps.ctx.Done():
+			return
+		}
+	}
+}
+
+// ReplyStats count the client requests supervised with RESPONSE_TIMEOUT_MS
+// and those the device did not answer in time
+type ReplyStats struct {
+	TimeoutMs    int                `json:"timeout_ms"`
+	Requests     uint64             `json:"requests"`
+	Timeouts     uint64             `json:"timeouts"`
+	TimeoutRatio map[string]float64 `json:"timeout_ratio"` // share of requests timed out, keyed by window and "total"
+}
+
+// replyStats summarizes snap, the counters at now, over the rate windows
+func (ps *Server) replyStats(now time.Time, snap metrics.Snapshot) *ReplyStats {
+	st := &ReplyStats{
+		TimeoutMs:    ps.config.ResponseTimeoutMs,
+		Requests:     snap.Requests,
+		Timeouts:     snap.ResponseTimeouts,
+		TimeoutRatio: map[string]float64{"total": timeoutRatio(snap, metrics.Snapshot{})},
+	}
+	for _, w := range rateWindows {
+		base, ok, err := ps.store.SampleSince(now.Add(-w.d))
+		if err != nil {
+			ps.logger.Warn("Failed to read traffic samples: %v", err)
+		}
+		var ratio float64
+		if ok {
+			ratio = timeoutRatio(snap, base.Snapshot)
+		}
+		st.TimeoutRatio[w.name] = ratio
+	}
+	return st
+}
+
+// timeoutRatio returns the share of the requests since base that timed out
+func timeoutRatio(cur, base metrics.Snapshot) float64 {
+	if cur.Requests <= base.Requests || cur.ResponseTimeouts < base.ResponseTimeouts {
+		return 0
+	}
+	return float64(cur.ResponseTimeouts-base.ResponseTimeouts) / float64(cur.Requests-base.Requests)
+}
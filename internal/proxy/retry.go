@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/client"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+)
+
+// retryFrame is client data whose upstream write failed
+type retryFrame struct {
+	cl     *client.Client
+	data   []byte
+	write  func([]byte) error // writes to the client's upstream
+	failed time.Time
+}
+
+// retryQueue holds up to UPSTREAM_RETRY_FRAMES frames whose upstream write
+// failed, to write them again once the upstream has reconnected
+type retryQueue struct {
+	limit  int
+	maxAge time.Duration
+
+	mu     sync.Mutex
+	frames []retryFrame
+}
+
+// newRetryQueue returns the retry queue configured by cfg, or nil if
+// retries are disabled
+func newRetryQueue(cfg *config.Config) *retryQueue {
+	if cfg.WriteRetryFrames <= 0 {
+		return nil
+	}
+	maxAge := cfg.WriteRetryMaxAge
+	if maxAge == 0 {
+		maxAge = config.DefaultWriteRetryMaxAge
+	}
+	return &retryQueue{
+		limit:  cfg.WriteRetryFrames,
+		maxAge: time.Duration(maxAge) * time.Millisecond,
+	}
+}
+
+// writeFailed handles client data the upstream write rejected with err. It
+// is queued for a retry if the queue is enabled and has room, otherwise
+// dropped.
+func (ps *Server) writeFailed(cl *client.Client, data []byte, write func([]byte) error, err error) {
+	q := ps.retries
+	if q == nil {
+		cl.Log.Warn("Failed to write to upstream from %s: %v", cl.ID, err)
+		ps.metrics.RecordDropped()
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ps.expireRetries(time.Now())
+	if len(q.frames) >= q.limit {
+		cl.Log.Warn("Failed to write to upstream from %s: %v, retry queue full, dropping packet", cl.ID, err)
+		ps.metrics.RecordLost()
+		return
+	}
+	cl.Log.Warn("Failed to write to upstream from %s: %v, retrying after reconnect", cl.ID, err)
+	q.frames = append(q.frames, retryFrame{
+		cl:     cl,
+		data:   append([]byte(nil), data...),
+		write:  write,
+		failed: time.Now(),
+	})
+}
+
+// expireRetries drops frames that failed more than the maximum age before
+// now. The caller holds the queue lock.
+func (ps *Server) expireRetries(now time.Time) {
+	q := ps.retries
+	n := 0
+	for n < len(q.frames) && now.Sub(q.frames[n].failed) > q.maxAge {
+		ps.metrics.RecordLost()
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	ps.logger.Warn("Dropping %d packets not retried within %s", n, q.maxAge)
+	clear(q.frames[:n])
+	q.frames = q.frames[n:]
+}
+
+// flushRetries writes the frames waiting for a retry, in order, until the
+// queue is empty or the upstream is down again. A frame whose retry fails
+// too is lost.
+func (ps *Server) flushRetries() {
+	q := ps.retries
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	ps.expireRetries(time.Now())
+	sent := 0
+	for len(q.frames) > 0 {
+		f := q.frames[0]
+		err := f.write(f.data)
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
+		q.frames[0] = retryFrame{}
+		q.frames = q.frames[1:]
+		if err != nil {
+			f.cl.Log.Warn("Retried write to upstream from %s failed: %v", f.cl.ID, err)
+			ps.metrics.RecordLost()
+			continue
+		}
+		ps.metrics.RecordToUpstream(len(f.data))
+		ps.metrics.RecordRetried()
+		sent++
+	}
+	if len(q.frames) == 0 {
+		q.frames = nil
+	}
+	if sent > 0 {
+		ps.logger.Info("Retried %d packets after failed upstream writes", sent)
+	}
+}
+
+// pendingRetries returns the number of frames waiting for a retry
+func (ps *Server) pendingRetries() int {
+	q := ps.retries
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.frames)
+}
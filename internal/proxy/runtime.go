@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/bufpool"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/storage"
+)
+
+// memStatsMaxAge limits how often runtime.ReadMemStats runs, since status
+// is polled by every web client
+const memStatsMaxAge = time.Second
+
+// RuntimeStats highlights the process's resource usage
+type RuntimeStats struct {
+	Goroutines     int             `json:"goroutines"`
+	HeapAlloc      uint64          `json:"heap_alloc_bytes"`
+	HeapInuse      uint64          `json:"heap_inuse_bytes"`
+	HeapObjects    uint64          `json:"heap_objects"`
+	Sys            uint64          `json:"sys_bytes"`
+	TotalAlloc     uint64          `json:"total_alloc_bytes"`
+	NumGC          uint32          `json:"num_gc"`
+	GCPauseTotalMs float64         `json:"gc_pause_total_ms"`
+	LastGC         string          `json:"last_gc,omitempty"`
+	BufferPools    []bufpool.Stats `json:"buffer_pools"`
+	Queues         map[string]int  `json:"queues"`      // items waiting per subsystem
+	LogDropped     uint64          `json:"log_dropped"` // packets left out of the log because its queue was full
+	StorageDropped uint64          `json:"storage_dropped"`
+}
+
+type memStatsCache struct {
+	mu    sync.Mutex
+	stats runtime.MemStats
+	at    time.Time
+}
+
+func (c *memStatsCache) get() runtime.MemStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.at) >= memStatsMaxAge {
+		runtime.ReadMemStats(&c.stats)
+		c.at = time.Now()
+	}
+	return c.stats
+}
+
+// GetRuntimeStats returns memory, goroutine, buffer pool and queue figures
+func (ps *Server) GetRuntimeStats() RuntimeStats {
+	mem := ps.memStats.get()
+
+	stats := RuntimeStats{
+		Goroutines:     runtime.NumGoroutine(),
+		HeapAlloc:      mem.HeapAlloc,
+		HeapInuse:      mem.HeapInuse,
+		HeapObjects:    mem.HeapObjects,
+		Sys:            mem.Sys,
+		TotalAlloc:     mem.TotalAlloc,
+		NumGC:          mem.NumGC,
+		GCPauseTotalMs: float64(mem.PauseTotalNs) / float64(time.Millisecond),
+		BufferPools:    bufpool.All(),
+		Queues:         map[string]int{"log_entries": ps.logger.Pending()},
+		LogDropped:     ps.logger.Dropped(),
+	}
+	if mem.LastGC > 0 {
+		stats.LastGC = time.Unix(0, int64(mem.LastGC)).Format(time.RFC3339)
+	}
+
+	if async, ok := ps.store.(*storage.Async); ok {
+		// Log lines, events and samples left out of STORAGE_BACKEND=sqlite
+		// because its queue was full
+		queue := async.Stats()
+		stats.Queues["storage_writes"] = queue.Pending
+		for _, n := range queue.Dropped {
+			stats.StorageDropped += n
+		}
+	}
+	if ps.sched != nil {
+		stats.Queues["write_scheduler"] = ps.sched.Pending()
+	}
+	if ps.retries != nil {
+		stats.Queues["write_retries"] = ps.pendingRetries()
+	}
+	framed := 0
+	for _, link := range ps.links {
+		if link.framer != nil {
+			framed += link.framer.Buffered()
+		}
+	}
+	if ps.config.FrameGapMs > 0 {
+		stats.Queues["frame_gap_bytes"] = framed
+	}
+	return stats
+}
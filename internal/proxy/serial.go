@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/rfc2217"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/upstream"
+)
+
+// ErrUnknownUpstream is returned for an upstream name that is not configured
+var ErrUnknownUpstream = errors.New("unknown upstream")
+
+// MaxBreak caps the length of a break sent with SendBreak
+const MaxBreak = 10 * time.Second
+
+// serialLink returns the named upstream, or the primary one for ""
+func (ps *Server) serialLink(name string) (*upstreamLink, error) {
+	if name == "" {
+		return ps.links[0], nil
+	}
+	if link := ps.findLink(name); link != nil {
+		return link, nil
+	}
+	return nil, ErrUnknownUpstream
+}
+
+// SerialStatus returns the serial line settings of an RFC 2217 upstream
+func (ps *Server) SerialStatus(name string) (upstream.SerialStatus, error) {
+	link, err := ps.serialLink(name)
+	if err != nil {
+		return upstream.SerialStatus{}, err
+	}
+	return link.conn.SerialStatus()
+}
+
+// SetSerialParams changes the serial line settings of an RFC 2217 upstream
+func (ps *Server) SetSerialParams(name string, p rfc2217.Params) (upstream.SerialStatus, error) {
+	link, err := ps.serialLink(name)
+	if err != nil {
+		return upstream.SerialStatus{}, err
+	}
+	return link.conn.SetSerialParams(p)
+}
+
+// UpstreamLines returns the modem control lines of an RFC 2217 upstream
+func (ps *Server) UpstreamLines(name string) (rfc2217.Lines, error) {
+	link, err := ps.serialLink(name)
+	if err != nil {
+		return rfc2217.Lines{}, err
+	}
+	return link.conn.Lines()
+}
+
+// SetUpstreamLines sets DTR and/or RTS on an RFC 2217 upstream
+func (ps *Server) SetUpstreamLines(name string, update rfc2217.LineUpdate) (rfc2217.Lines, error) {
+	link, err := ps.serialLink(name)
+	if err != nil {
+		return rfc2217.Lines{}, err
+	}
+	link.conn.Log().Info("Setting modem lines: %s", describeLines(update))
+	return link.conn.SetLines(update)
+}
+
+// SendBreak holds the line of an RFC 2217 upstream in the break condition
+// for d, as some bootloaders and devices need to reset
+func (ps *Server) SendBreak(name string, d time.Duration) error {
+	link, err := ps.serialLink(name)
+	if err != nil {
+		return err
+	}
+	link.conn.Log().Info("Sending break for %v", d)
+	return link.conn.SendBreak(d)
+}
+
+// describeLines formats a line update for the log, e.g. "DTR=on RTS=off"
+func describeLines(update rfc2217.LineUpdate) string {
+	var parts []string
+	for _, l := range []struct {
+		name  string
+		state *bool
+	}{{"DTR", update.DTR}, {"RTS", update.RTS}} {
+		if l.state == nil {
+			continue
+		}
+		state := "off"
+		if *l.state {
+			state = "on"
+		}
+		parts = append(parts, l.name+"="+state)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/bufpool"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/client"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/codec"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/upstream"
+)
+
+// clientSession forwards the data read from one client, whichever engine
+// does the reading. Reads must be passed to process one at a time.
+type clientSession struct {
+	ps        *Server
+	cl        *client.Client
+	transform codec.Transform // TRANSFORM_TO_UPSTREAM state for this client
+	first     bool
+	writable  bool      // CLIENT_ACCESS allows writes to the upstream
+	refused   bool      // a refused write was logged
+	recheck   time.Time // next access check under rules with hours
+	endOnce   sync.Once
+}
+
+// startSession prepares a client for forwarding. The caller must call end
+// once the client is done.
+func (ps *Server) startSession(cl *client.Client) *clientSession {
+	// Enable TCP keepalive to detect dead connections
+	// This replaces read deadline - connections stay open indefinitely
+	// but dead connections are detected via OS-level keepalive probes
+	if tcpConn := tcpConnOf(cl.Conn); tcpConn != nil {
+		_ = tcpConn.SetKeepAlive(true)
+		_ = tcpConn.SetKeepAlivePeriod(30 * time.Second)
+		opts := ps.clientKeepalive()
+		opts.DSCP, opts.Priority = ps.config.SocketDSCP, ps.config.SocketPriority
+		if opts != (upstream.TCPOptions{}) {
+			if err := upstream.SetSocketOptions(tcpConn, opts); err != nil {
+				cl.Log.Warn("Failed to set socket options on client %s: %v", cl.ID, err)
+			}
+		}
+	}
+
+	// Each client gets its own TRANSFORM_TO_UPSTREAM state
+	transform, _ := codec.New(ps.config.TransformTo)
+	s := &clientSession{ps: ps, cl: cl, transform: transform, first: true}
+	s.setAccess()
+	s.setGroup()
+
+	if cl.Raw {
+		ps.holdFor(cl, ps.rawWriter(cl))
+	} else {
+		ps.holdFor(cl, ps.clientWriter(cl))
+	}
+
+	if ps.sched != nil && !cl.Raw {
+		ps.sched.Register(cl.ID, ps.clientPriority(cl), func(data []byte, queued time.Time) {
+			ps.forwardToUpstream(cl, data, nil, queued)
+		})
+	}
+	return s
+}
+
+// tcpConnOf returns the TCP connection under a client's connection, or nil
+// for QUIC and mux streams
+func tcpConnOf(conn net.Conn) *net.TCPConn {
+	switch c := conn.(type) {
+	case *hexConn:
+		conn = c.Conn
+	case *pollConn:
+		conn = c.TCPConn
+	case *tls.Conn:
+		conn = c.NetConn()
+	}
+	tcpConn, _ := conn.(*net.TCPConn)
+	return tcpConn
+}
+
+// process forwards one read. f holds data, or is nil when data is not
+// shared with the read buffer. It returns false when the client must be
+// disconnected.
+func (s *clientSession) process(data []byte, f *bufpool.Frame) bool {
+	ps, cl := s.ps, s.cl
+	read := time.Now()
+	cl.Touch(read)
+	if !s.checkAccess(read) {
+		return false
+	}
+	if !s.writable {
+		return s.refuse()
+	}
+	if s.first {
+		s.first = false
+		ps.detectFlashing(cl, data)
+	}
+	if fs := ps.flashingFor(cl); fs != nil {
+		ps.flashToUpstream(fs, data)
+		return true
+	}
+	if cl.Raw {
+		ps.forwardRaw(cl, data, f, read)
+		return true
+	}
+
+	if s.transform != nil {
+		f = nil
+	}
+	for _, frame := range codec.Apply(s.transform, data) {
+		if ps.sched != nil {
+			// Queued frames outlive the read
+			if f != nil {
+				frame = append([]byte(nil), frame...)
+			}
+			if !ps.sched.Enqueue(cl.ID, frame) {
+				return false
+			}
+			continue
+		}
+		ps.forwardToUpstream(cl, frame, f, read)
+	}
+	return true
+}
+
+// end disconnects the client and releases what startSession set up. It
+// may be called more than once.
+func (s *clientSession) end() {
+	s.endOnce.Do(func() {
+		ps, cl := s.ps, s.cl
+		if ps.sched != nil && !cl.Raw {
+			ps.sched.Unregister(cl.ID)
+		}
+		ps.endFlashingFor(cl)
+		ps.releaseHeld(cl)
+		ps.clients.Remove(cl.ID)
+		ps.releaseConn(cl.Addr)
+		ps.wg.Done()
+	})
+}
@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/metrics"
+)
+
+// statsInterval is how often the counters are sampled for rolling rates
+const statsInterval = 5 * time.Second
+
+// rateWindows are the windows rates are reported over
+var rateWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+}
+
+// Stats holds the numeric statistics served by /api/stats
+type Stats struct {
+	UptimeSeconds float64                 `json:"uptime_seconds"`
+	Totals        StatsTotals             `json:"totals"`
+	Rates         map[string]metrics.Rate `json:"rates"` // per second, keyed by window
+	PacketSizes   PacketSizeStats         `json:"packet_sizes"`
+	Broadcast     LatencyStats            `json:"broadcast_latency_us"`
+	Forwarding    ForwardingStats         `json:"forward_latency_us"`
+	Clients       int                     `json:"clients"`
+	Upstreams     []UpstreamStats         `json:"upstreams"`
+	Security      *SecurityStats          `json:"security,omitempty"`
+	Reaped        map[string]uint64       `json:"reaped_clients,omitempty"` // by reason, with CLIENT_LIVENESS_TIMEOUT
+	Replies       *ReplyStats             `json:"replies,omitempty"`        // with RESPONSE_TIMEOUT_MS
+}
+
+// SecurityStats count client connections refused by CONNECT_RATE_LIMIT and
+// MAX_CLIENTS_PER_IP
+type SecurityStats struct {
+	RejectedConnections uint64            `json:"rejected_connections"`
+	RejectedBy          map[string]uint64 `json:"rejected_by"` // keyed by reason code
+}
+
+// StatsTotals are the cumulative counters since start
+type StatsTotals struct {
+	BytesFromUpstream   uint64 `json:"bytes_from_upstream"`
+	PacketsFromUpstream uint64 `json:"packets_from_upstream"`
+	BytesToUpstream     uint64 `json:"bytes_to_upstream"`
+	PacketsToUpstream   uint64 `json:"packets_to_upstream"`
+	DroppedPackets      uint64 `json:"dropped_packets"`
+	RetriedPackets      uint64 `json:"retried_packets"` // written after a failed upstream write
+	LostPackets         uint64 `json:"lost_packets"`    // failed upstream writes not retried, also counted as dropped
+	DryRunPackets       uint64 `json:"dry_run_packets"` // withheld from the upstream in dry-run mode
+	DryRunBytes         uint64 `json:"dry_run_bytes"`
+	SlowPackets         uint64 `json:"slow_packets"` // over LATENCY_BUDGET_MS
+	UpstreamReconnects  uint64 `json:"upstream_reconnects"`
+	Broadcasts          uint64 `json:"broadcasts"`
+}
+
+// PacketSizeStats are packet size histograms in bytes
+type PacketSizeStats struct {
+	FromUpstream metrics.Histogram `json:"from_upstream"`
+	ToUpstream   metrics.Histogram `json:"to_upstream"`
+	Max          uint64            `json:"max"`
+}
+
+// ForwardingStats summarize how long the proxy took to forward packets in
+// each direction, from reading a packet to writing it out
+type ForwardingStats struct {
+	BudgetMs     int          `json:"budget_ms,omitempty"`
+	ToUpstream   LatencyStats `json:"to_upstream"`
+	FromUpstream LatencyStats `json:"from_upstream"`
+}
+
+// LatencyStats summarize durations, such as how long fanning a packet out
+// to clients took, in microseconds
+type LatencyStats struct {
+	Count uint64            `json:"count"`
+	Mean  float64           `json:"mean"`
+	P50   float64           `json:"p50"`
+	P90   float64           `json:"p90"`
+	P99   float64           `json:"p99"`
+	Max   float64           `json:"max"`
+	Hist  metrics.Histogram `json:"histogram_ns"`
+}
+
+// UpstreamStats reports the state and reconnects of one upstream
+type UpstreamStats struct {
+	Name       string `json:"name"`
+	Connected  bool   `json:"connected"`
+	Reconnects uint64 `json:"reconnects"`
+}
+
+// sampleStats records the counters every statsInterval for GetStats
+func (ps *Server) sampleStats() {
+	defer ps.wg.Done()
+
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	ps.addSample(time.Now())
+	for {
+		select {
+		case now := <-ticker.C:
+			ps.addSample(now)
+			ps.checkLineRates()
+		case <-ps.ctx.Done():
+			return
+		}
+	}
+}
+
+// addSample stores the counters at now
+func (ps *Server) addSample(now time.Time) {
+	if err := ps.store.AddSample(metrics.Sample{At: now, Snapshot: ps.metrics.Snapshot()}); err != nil {
+		ps.logger.Warn("Failed to store traffic sample: %v", err)
+	}
+}
+
+// rate returns the average rate from the oldest sample within window of now
+// to cur, the counters at now
+func (ps *Server) rate(now time.Time, cur metrics.Snapshot, window time.Duration) metrics.Rate {
+	base, ok, err := ps.store.SampleSince(now.Add(-window))
+	if err != nil {
+		ps.logger.Warn("Failed to read traffic samples: %v", err)
+	}
+	if !ok {
+		return metrics.Rate{}
+	}
+	return base.RateTo(now, cur)
+}
+
+// GetStats returns traffic totals, rolling rates, packet size histograms,
+// broadcast latency percentiles, upstream reconnect counts, refused
+// connections and reaped clients
+func (ps *Server) GetStats() Stats {
+	now := time.Now()
+	snap := ps.GetMetrics()
+
+	st := Stats{
+		UptimeSeconds: now.Sub(ps.startTime).Seconds(),
+		Totals: StatsTotals{
+			BytesFromUpstream:   snap.BytesFromUpstream,
+			PacketsFromUpstream: snap.PacketsFromUpstream,
+			BytesToUpstream:     snap.BytesToUpstream,
+			PacketsToUpstream:   snap.PacketsToUpstream,
+			DroppedPackets:      snap.DroppedPackets,
+			RetriedPackets:      snap.RetriedPackets,
+			LostPackets:         snap.LostPackets,
+			DryRunPackets:       snap.DryRunPackets,
+			DryRunBytes:         snap.DryRunBytes,
+			SlowPackets:         snap.SlowPackets,
+			UpstreamReconnects:  snap.UpstreamReconnects,
+			Broadcasts:          snap.BroadcastCount,
+		},
+		Rates:   make(map[string]metrics.Rate, len(rateWindows)),
+		Clients: snap.Clients,
+	}
+	for _, w := range rateWindows {
+		st.Rates[w.name] = ps.rate(now, snap, w.d)
+	}
+
+	st.PacketSizes.FromUpstream, st.PacketSizes.ToUpstream, st.PacketSizes.Max = ps.metrics.PacketSizes()
+
+	st.Broadcast = latencyStats(metrics.Latency{
+		Count: snap.BroadcastCount,
+		Total: snap.BroadcastTotal,
+		Max:   snap.BroadcastMax,
+		Hist:  ps.metrics.BroadcastLatency(),
+	})
+	to, from := ps.metrics.ForwardLatency()
+	st.Forwarding = ForwardingStats{
+		BudgetMs:     ps.config.LatencyBudgetMs,
+		ToUpstream:   latencyStats(to),
+		FromUpstream: latencyStats(from),
+	}
+
+	for _, link := range ps.links {
+		st.Upstreams = append(st.Upstreams, UpstreamStats{
+			Name:       link.name,
+			Connected:  link.conn.IsConnected(),
+			Reconnects: link.conn.GetReconnectCount(),
+		})
+	}
+
+	if ps.connLimit != nil {
+		limits := ps.connLimit.Stats()
+		st.Security = &SecurityStats{RejectedConnections: limits.Rejected, RejectedBy: limits.RejectedBy}
+	}
+	if ps.livenessTimeout() > 0 {
+		st.Reaped = ps.reaped.snapshot()
+	}
+	if ps.responseTimeout() > 0 {
+		st.Replies = ps.replyStats(now, snap)
+	}
+	return st
+}
+
+// latencyStats summarizes l in microseconds
+func latencyStats(l metrics.Latency) LatencyStats {
+	maxNs := uint64(l.Max)
+	us := func(ns float64) float64 { return ns / float64(time.Microsecond) }
+	st := LatencyStats{
+		Count: l.Count,
+		P50:   us(l.Hist.Quantile(0.5, maxNs)),
+		P90:   us(l.Hist.Quantile(0.9, maxNs)),
+		P99:   us(l.Hist.Quantile(0.99, maxNs)),
+		Max:   us(float64(maxNs)),
+		Hist:  l.Hist,
+	}
+	if l.Count > 0 {
+		st.Mean = us(float64(l.Total) / float64(l.Count))
+	}
+	return st
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// statusWriteTimeout bounds a write to a status client, so a stalled one
+// does not hold up the others
+const statusWriteTimeout = time.Second
+
+// statusListener serves STATUS_LISTEN_PORT. Every connection gets a line
+// with the state of each upstream, then a line whenever one comes up or
+// goes down, so that clients can pause their protocol during an outage
+// instead of timing out.
+type statusListener struct {
+	ln     net.Listener
+	mu     sync.Mutex // held while writing, so lines arrive in order
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+// statusLine returns the line announcing link's state, e.g. "DOWN primary"
+func statusLine(link *upstreamLink, up bool) []byte {
+	state := "DOWN"
+	if up {
+		state = "UP"
+	}
+	return []byte(state + " " + link.name + "\n")
+}
+
+// listenStatus opens STATUS_LISTEN_PORT. It is called before the upstreams
+// start, so that their state changes find the listener set and status
+// clients can connect during WAIT_FOR_UPSTREAM.
+func (ps *Server) listenStatus(ctx context.Context) error {
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", ps.config.StatusListenAddr())
+	if err != nil {
+		return err
+	}
+	ps.statusLn = &statusListener{ln: ln, conns: make(map[net.Conn]bool)}
+	ps.logger.Info("Listening for status clients on %s", ps.config.StatusListenAddr())
+
+	ps.wg.Add(1)
+	go ps.acceptLoop(ln, ps.serveStatus)
+	return nil
+}
+
+// serveStatus sends the current states to a new status client and keeps
+// it for the changes. Anything the client sends is discarded.
+func (ps *Server) serveStatus(conn net.Conn) {
+	sl := ps.statusLn
+	sl.mu.Lock()
+	if sl.closed {
+		sl.mu.Unlock()
+		conn.Close()
+		return
+	}
+	for _, link := range ps.links {
+		if !sl.write(conn, statusLine(link, link.up.Load())) {
+			sl.mu.Unlock()
+			return
+		}
+	}
+	sl.conns[conn] = true
+	sl.mu.Unlock()
+	ps.logger.Info("Status client connected from %s", conn.RemoteAddr())
+
+	ps.wg.Add(1)
+	go func() {
+		defer ps.wg.Done()
+		_, _ = io.Copy(io.Discard, conn)
+		sl.mu.Lock()
+		delete(sl.conns, conn)
+		sl.mu.Unlock()
+		conn.Close()
+	}()
+}
+
+// write sends line to conn, closing it on failure. The caller holds mu.
+func (sl *statusListener) write(conn net.Conn, line []byte) bool {
+	_ = conn.SetWriteDeadline(time.Now().Add(statusWriteTimeout))
+	if _, err := conn.Write(line); err != nil {
+		delete(sl.conns, conn)
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+// notify announces a state change of link to all status clients
+func (sl *statusListener) notify(link *upstreamLink, up bool) {
+	if sl == nil {
+		return
+	}
+	line := statusLine(link, up)
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	for conn := range sl.conns {
+		sl.write(conn, line)
+	}
+}
+
+// close stops accepting status clients and disconnects the connected ones
+func (sl *statusListener) close() {
+	if sl == nil {
+		return
+	}
+	sl.ln.Close()
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.closed = true
+	for conn := range sl.conns {
+		conn.Close()
+	}
+}
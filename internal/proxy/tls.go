@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/transport"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake of a client
+const tlsHandshakeTimeout = 10 * time.Second
+
+// listenTLS starts the client listener on TLS_LISTEN_PORT. It offers the
+// ALPN tokens of TLS_ROUTES, so a client asking for one of them gets it.
+func (ps *Server) listenTLS() error {
+	cert, err := transport.ServerCertificate(ps.config.TLSCertFile, ps.config.TLSKeyFile)
+	if err != nil {
+		return err
+	}
+	ps.tlsConf = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   ps.config.TLSProtocols(),
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	ln, err := net.Listen("tcp", ps.config.TLSListenAddr())
+	if err != nil {
+		return err
+	}
+	ps.listenerMu.Lock()
+	ps.tlsLn = ln
+	ps.listenerMu.Unlock()
+	ps.logger.Info("Listening for TLS clients on %s", ps.config.TLSListenAddr())
+
+	ps.wg.Add(1)
+	go ps.acceptLoop(ln, ps.serveTLS)
+	return nil
+}
+
+// serveTLS completes the handshake of a connection accepted on the TLS
+// listener, off the accept loop, and serves it bound to the upstream its
+// server name or protocol routes to. A client no route matches receives
+// the merged stream like a plain TCP client.
+func (ps *Server) serveTLS(conn net.Conn) {
+	ps.wg.Add(1)
+	go func() {
+		defer ps.wg.Done()
+
+		tc := tls.Server(conn, ps.tlsConf)
+		ctx, cancel := context.WithTimeout(ps.ctx, tlsHandshakeTimeout)
+		err := tc.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			ps.logger.Warn("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+
+		state := tc.ConnectionState()
+		upstream := ps.tlsRoute(state.ServerName, state.NegotiatedProtocol)
+		if upstream != "" {
+			ps.logger.Info("Routing TLS client %s to upstream %q (sni=%q alpn=%q)",
+				conn.RemoteAddr(), upstream, state.ServerName, state.NegotiatedProtocol)
+		}
+		ps.serveConn(tc, ps.ports.tunnel, upstream)
+	}()
+}
+
+// tlsRoute returns the upstream of the first TLS_ROUTES entry matching a
+// client, or "" if none does
+func (ps *Server) tlsRoute(serverName, protocol string) string {
+	for _, r := range ps.config.TLSRoutes {
+		if r.Matches(serverName, protocol) {
+			return r.Upstream
+		}
+	}
+	return ""
+}
@@ -0,0 +1,197 @@
+// Package recovery power-cycles an unreachable serial gateway, e.g. by
+// switching a smart plug through an HTTP endpoint or an MQTT topic, once the
+// upstream has failed to reconnect several times in a row.
+package recovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/mqtt"
+)
+
+// actionTimeout bounds one HTTP request or MQTT publish
+const actionTimeout = 10 * time.Second
+
+// Options configures the recovery action and its limits
+type Options struct {
+	After       int           // consecutive failed reconnects before acting
+	Cooldown    time.Duration // minimum time between actions
+	MaxAttempts int           // actions until the upstream connects again, 0 = unlimited
+	URL         string        // HTTP endpoint, empty for none
+	Method      string        // GET, POST or PUT
+	MQTTTopic   string        // topic published to, empty for none
+	MQTTPayload string
+	MQTT        mqtt.Options
+}
+
+// Attempt records one recovery action
+type Attempt struct {
+	Upstream string   `json:"upstream"`
+	Failures uint64   `json:"failures"` // failed reconnects before the action
+	Attempt  int      `json:"attempt"`  // since the upstream was last connected
+	Actions  []string `json:"actions"`  // "http" and/or "mqtt"
+	Error    string   `json:"error,omitempty"`
+}
+
+// Engine decides when to run the recovery action. It acts once the failures
+// reported since its last action reach Options.After, no sooner than
+// Options.Cooldown after that action, and at most Options.MaxAttempts times
+// until the upstream connects.
+type Engine struct {
+	opts     Options
+	upstream string
+	logger   *logger.Logger
+	client   *http.Client
+	report   func(Attempt)
+
+	mu       sync.Mutex
+	attempts int       // actions since the upstream was last connected
+	mark     uint64    // failures when the last action ran
+	last     time.Time // time of the last action
+	running  bool
+	gaveUp   bool
+}
+
+// New returns an Engine for the named upstream, or nil if opts.After is
+// zero. report receives every completed attempt.
+func New(opts Options, upstream string, log *logger.Logger, report func(Attempt)) *Engine {
+	if opts.After <= 0 {
+		return nil
+	}
+	return &Engine{
+		opts:     opts,
+		upstream: upstream,
+		logger:   log,
+		client:   &http.Client{Timeout: actionTimeout},
+		report:   report,
+	}
+}
+
+// Failed reports the upstream's consecutive failed reconnects, and starts
+// the recovery action in the background when it is due
+func (e *Engine) Failed(failures uint64) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.running || failures < e.mark+uint64(e.opts.After) {
+		return
+	}
+	if e.opts.MaxAttempts > 0 && e.attempts >= e.opts.MaxAttempts {
+		if !e.gaveUp {
+			e.logger.Warn("Upstream %s still unreachable after %d recovery attempts, giving up until it connects",
+				e.upstream, e.attempts)
+			e.gaveUp = true
+		}
+		return
+	}
+	if !e.last.IsZero() && time.Since(e.last) < e.opts.Cooldown {
+		return
+	}
+
+	e.attempts++
+	e.mark = failures
+	e.last = time.Now()
+	e.running = true
+	a := Attempt{Upstream: e.upstream, Failures: failures, Attempt: e.attempts}
+	e.logger.Warn("Upstream %s failed to reconnect %d times, running recovery action (attempt %d)",
+		e.upstream, failures, e.attempts)
+	go e.run(a)
+}
+
+// Connected resets the attempt count once the upstream is back
+func (e *Engine) Connected() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.attempts > 0 {
+		e.logger.Info("Upstream %s recovered after %d recovery attempts", e.upstream, e.attempts)
+	}
+	e.attempts = 0
+	e.mark = 0
+	e.gaveUp = false
+}
+
+func (e *Engine) run(a Attempt) {
+	var errs []error
+	if e.opts.URL != "" {
+		a.Actions = append(a.Actions, "http")
+		if err := e.callURL(a); err != nil {
+			errs = append(errs, fmt.Errorf("http: %w", err))
+		}
+	}
+	if e.opts.MQTTTopic != "" {
+		a.Actions = append(a.Actions, "mqtt")
+		if err := e.publish(); err != nil {
+			errs = append(errs, fmt.Errorf("mqtt: %w", err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		a.Error = strings.ReplaceAll(err.Error(), "\n", "; ")
+		e.logger.Warn("Recovery action for upstream %s failed: %s", e.upstream, a.Error)
+	}
+
+	e.mu.Lock()
+	e.running = false
+	e.mu.Unlock()
+	if e.report != nil {
+		e.report(a)
+	}
+}
+
+// callURL requests the configured endpoint. POST and PUT send the attempt
+// as JSON.
+func (e *Engine) callURL(a Attempt) error {
+	var body io.Reader
+	if e.opts.Method != http.MethodGet {
+		payload, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(e.opts.Method, e.opts.URL, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// publish sends the configured payload over a connection of its own
+func (e *Engine) publish() error {
+	ctx, cancel := context.WithTimeout(context.Background(), actionTimeout)
+	defer cancel()
+	opts := e.opts.MQTT
+	opts.ClientID += "-recovery"
+	client, err := mqtt.Dial(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Publish(e.opts.MQTTTopic, []byte(e.opts.MQTTPayload), false)
+}
@@ -0,0 +1,119 @@
+package recovery
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+)
+
+func newTestLogger() *logger.Logger {
+	log, _ := logger.New(false, "")
+	log.SetOutput(io.Discard)
+	return log
+}
+
+// newTestEngine returns an engine calling a test server answering with
+// status, and the channels receiving request bodies and attempts
+func newTestEngine(t *testing.T, opts Options, status int) (*Engine, chan Attempt, chan Attempt) {
+	t.Helper()
+	requests := make(chan Attempt, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a Attempt
+		_ = json.NewDecoder(r.Body).Decode(&a)
+		requests <- a
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+
+	reports := make(chan Attempt, 10)
+	opts.URL = srv.URL
+	opts.Method = http.MethodPost
+	return New(opts, "primary", newTestLogger(), func(a Attempt) { reports <- a }), requests, reports
+}
+
+func expectAttempt(t *testing.T, reports chan Attempt) Attempt {
+	t.Helper()
+	select {
+	case a := <-reports:
+		return a
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for a recovery attempt")
+		return Attempt{}
+	}
+}
+
+func expectNone(t *testing.T, reports chan Attempt) {
+	t.Helper()
+	select {
+	case a := <-reports:
+		t.Fatalf("Unexpected recovery attempt %+v", a)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEngine_Attempts(t *testing.T) {
+	e, requests, reports := newTestEngine(t, Options{After: 3, MaxAttempts: 2}, http.StatusOK)
+
+	e.Failed(1)
+	e.Failed(2)
+	expectNone(t, reports)
+	e.Failed(3)
+	a := expectAttempt(t, reports)
+	if a.Attempt != 1 || a.Failures != 3 || a.Upstream != "primary" || len(a.Actions) != 1 || a.Error != "" {
+		t.Errorf("Unexpected attempt %+v", a)
+	}
+	if req := <-requests; req.Failures != 3 {
+		t.Errorf("Expected the attempt posted, got %+v", req)
+	}
+
+	// Failures are counted again from the last action
+	e.Failed(5)
+	expectNone(t, reports)
+	e.Failed(6)
+	if a := expectAttempt(t, reports); a.Attempt != 2 {
+		t.Errorf("Expected attempt 2, got %+v", a)
+	}
+
+	// MaxAttempts reached until the upstream connects
+	e.Failed(9)
+	expectNone(t, reports)
+	e.Connected()
+	e.Failed(3)
+	if a := expectAttempt(t, reports); a.Attempt != 1 {
+		t.Errorf("Expected the count reset after connecting, got %+v", a)
+	}
+}
+
+func TestEngine_Cooldown(t *testing.T) {
+	e, _, reports := newTestEngine(t, Options{After: 1, Cooldown: time.Hour}, http.StatusOK)
+
+	e.Failed(1)
+	expectAttempt(t, reports)
+	e.Failed(2)
+	e.Connected()
+	e.Failed(1)
+	expectNone(t, reports)
+}
+
+func TestEngine_ActionError(t *testing.T) {
+	e, _, reports := newTestEngine(t, Options{After: 1}, http.StatusBadGateway)
+
+	e.Failed(1)
+	if a := expectAttempt(t, reports); a.Error != "http: status 502" {
+		t.Errorf("Expected the HTTP error recorded, got %q", a.Error)
+	}
+}
+
+func TestNew_Disabled(t *testing.T) {
+	e := New(Options{}, "primary", newTestLogger(), nil)
+	if e != nil {
+		t.Fatal("Expected nil engine when disabled")
+	}
+	e.Failed(100)
+	e.Connected()
+}
@@ -0,0 +1,357 @@
+// Package retention keeps the files the proxy writes under /data within a
+// disk budget and an age limit, so a busy bus cannot fill the host's data
+// partition. It covers the packet log with the files rotated from it and
+// the SQLite history database.
+package retention
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/storage"
+)
+
+// Kinds of files counted against the budget
+const (
+	PacketLogs = "packet_logs" // LOG_FILE and the files rotated from it
+	History    = "history"     // the SQLite database at STORAGE_PATH
+)
+
+// DefaultInterval is how often the limits are enforced
+const DefaultInterval = 5 * time.Minute
+
+// Limits bound the disk use of the covered files
+type Limits struct {
+	MaxBytes int64         // RETENTION_MAX_MB, 0 for no budget
+	MaxAge   time.Duration // RETENTION_MAX_AGE_DAYS, 0 keeps files until the budget
+}
+
+// File is a file counted against the budget
+type File struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Active   bool      `json:"active"` // written to, so emptied rather than deleted
+}
+
+// Artifact is the files of one kind
+type Artifact struct {
+	Kind  string `json:"kind"`
+	Bytes int64  `json:"bytes"`
+	Files []File `json:"files"`
+}
+
+// Usage is the disk use after the last run, as served by /api/storage
+type Usage struct {
+	MaxBytes     int64      `json:"max_bytes"`     // 0 for no budget
+	MaxAgeDays   int        `json:"max_age_days"`  // 0 for no age limit
+	UsedBytes    int64      `json:"used_bytes"`    // all artifacts
+	OverBudget   bool       `json:"over_budget"`   // nothing more could be removed
+	Artifacts    []Artifact `json:"artifacts"`     // packet logs, then history if enabled
+	LastRun      time.Time  `json:"last_run"`      // zero before the first run
+	DeletedFiles uint64     `json:"deleted_files"` // since start
+	FreedBytes   uint64     `json:"freed_bytes"`   // deleted or truncated since start
+}
+
+// Manager enforces the limits periodically
+type Manager struct {
+	limits   Limits
+	interval time.Duration
+	logFile  string // "" without a packet log file
+	history  string // "" unless STORAGE_BACKEND=sqlite
+	logger   *logger.Logger
+	store    storage.Storage
+	own      func(path string) bool // WRITE_JOURNAL and STORAGE_PATH files, never removed as logs
+
+	mu    sync.Mutex
+	usage Usage
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New returns a manager for the files configured in cfg. Packet log files
+// are emptied through log, history is pruned through store.
+func New(cfg *config.Config, log *logger.Logger, store storage.Storage) *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Manager{
+		limits: Limits{
+			MaxBytes: int64(cfg.RetentionMaxMB) << 20,
+			MaxAge:   time.Duration(cfg.RetentionMaxAge) * 24 * time.Hour,
+		},
+		interval: DefaultInterval,
+		logFile:  cfg.LogFile,
+		own:      ownFiles(cfg),
+		logger:   log,
+		store:    store,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	if cfg.StorageBackend == config.StorageSQLite {
+		m.history = cfg.StoragePath
+	}
+	m.usage.MaxBytes, m.usage.MaxAgeDays = m.limits.MaxBytes, cfg.RetentionMaxAge
+	return m
+}
+
+// Start enforces the limits now and then every interval until Stop
+func (m *Manager) Start() {
+	if m.limits.MaxBytes > 0 || m.limits.MaxAge > 0 {
+		m.logger.Info("Retention: budget %d MB, max age %v", m.limits.MaxBytes>>20, m.limits.MaxAge)
+	}
+	m.Run(time.Now())
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case now := <-ticker.C:
+				m.Run(now)
+			}
+		}
+	}()
+}
+
+// Stop ends the periodic runs
+func (m *Manager) Stop() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+// Usage returns the disk use found by the last run
+func (m *Manager) Usage() Usage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	u := m.usage
+	u.Artifacts = append([]Artifact(nil), u.Artifacts...)
+	return u
+}
+
+// Run enforces the limits once. Rotated log files past the age limit are
+// deleted and older history pruned; then, while over budget, rotated log
+// files are deleted oldest first and finally the active log file is
+// emptied. The history database cannot be shrunk that way, so a budget it
+// exceeds on its own is reported as over_budget.
+func (m *Manager) Run(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	logs, err := m.packetLogs()
+	if err != nil {
+		m.logger.Warn("Retention: failed to list log files: %v", err)
+		logs = []File{}
+	}
+
+	if m.limits.MaxAge > 0 {
+		cutoff := now.Add(-m.limits.MaxAge)
+		logs = m.removeLogs(logs, func(f File) bool { return f.Modified.Before(cutoff) })
+		if m.history != "" {
+			if err := m.store.Prune(cutoff); err != nil {
+				m.logger.Warn("Retention: failed to prune history: %v", err)
+			}
+		}
+	}
+
+	history := m.historyFiles()
+	used := sum(logs) + sum(history)
+	over := false
+	if m.limits.MaxBytes > 0 && used > m.limits.MaxBytes {
+		// Oldest first; the active file is always the newest
+		sort.SliceStable(logs, func(i, j int) bool {
+			if logs[i].Active != logs[j].Active {
+				return logs[j].Active
+			}
+			return logs[i].Modified.Before(logs[j].Modified)
+		})
+		excess := used - m.limits.MaxBytes
+		logs = m.removeLogs(logs, func(f File) bool {
+			if excess <= 0 {
+				return false
+			}
+			excess -= f.Size
+			return true
+		})
+		sortFiles(logs)
+		used = sum(logs) + sum(history)
+		over = used > m.limits.MaxBytes
+		if over && !m.usage.OverBudget {
+			m.logger.Warn("Retention: %d bytes used, over the budget of %d MB", used, m.limits.MaxBytes>>20)
+		}
+	}
+
+	artifacts := []Artifact{{Kind: PacketLogs, Bytes: sum(logs), Files: logs}}
+	if m.history != "" {
+		artifacts = append(artifacts, Artifact{Kind: History, Bytes: sum(history), Files: history})
+	}
+	m.usage.UsedBytes, m.usage.OverBudget = used, over
+	m.usage.Artifacts, m.usage.LastRun = artifacts, now
+}
+
+// removeLogs deletes the rotated log files drop selects, in order, and
+// empties the active one if selected. It returns the files left.
+func (m *Manager) removeLogs(logs []File, drop func(File) bool) []File {
+	kept := logs[:0]
+	for _, f := range logs {
+		if !drop(f) {
+			kept = append(kept, f)
+			continue
+		}
+		if f.Active {
+			n, err := m.logger.TruncateFile()
+			if err != nil {
+				m.logger.Warn("Retention: failed to empty %s: %v", f.Name, err)
+				kept = append(kept, f)
+				continue
+			}
+			m.logger.Warn("Retention: emptied %s (%d bytes)", f.Name, n)
+			m.usage.FreedBytes += uint64(n)
+			f.Size = 0
+			kept = append(kept, f)
+			continue
+		}
+		if err := os.Remove(filepath.Join(filepath.Dir(m.logFile), f.Name)); err != nil {
+			m.logger.Warn("Retention: failed to delete %s: %v", f.Name, err)
+			kept = append(kept, f)
+			continue
+		}
+		m.logger.Info("Retention: deleted %s (%d bytes)", f.Name, f.Size)
+		m.usage.DeletedFiles++
+		m.usage.FreedBytes += uint64(f.Size)
+	}
+	return kept
+}
+
+// packetLogs returns the packet log files, none without LOG_FILE or
+// before its directory exists
+func (m *Manager) packetLogs() ([]File, error) {
+	if m.logFile == "" {
+		return []File{}, nil
+	}
+	files, err := packetLogFiles(m.logFile, m.own)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []File{}, nil
+	}
+	return files, err
+}
+
+// historyFiles returns the SQLite database with its journal files
+func (m *Manager) historyFiles() []File {
+	files := []File{}
+	if m.history == "" {
+		return files
+	}
+	for _, path := range []string{m.history, m.history + "-wal", m.history + "-shm"} {
+		if info, err := os.Stat(path); err == nil {
+			files = append(files, File{Name: filepath.Base(path), Size: info.Size(), Modified: info.ModTime().UTC(), Active: true})
+		}
+	}
+	return files
+}
+
+// rotatedSuffix matches the names logrotate gives rotated files after the
+// original name: .1, .2.gz, -20251130 or -20251130.gz
+var rotatedSuffix = regexp.MustCompile(`^(\.[0-9]+|-[0-9]{8})(\.gz)?$`)
+
+// PacketLogFiles returns LOG_FILE and the files rotated from it by
+// logrotate (packets.log.1, packets.log.2.gz, packets.log-20251130). The
+// active file comes first, then the rest newest first. WRITE_JOURNAL,
+// STORAGE_PATH and the files that belong to them are never included, even
+// when their names look rotated.
+func PacketLogFiles(cfg *config.Config) ([]File, error) {
+	return packetLogFiles(cfg.LogFile, ownFiles(cfg))
+}
+
+// ownFiles returns a filter matching the files the proxy writes next to
+// the packet log for other purposes
+func ownFiles(cfg *config.Config) func(path string) bool {
+	var paths, prefixes []string
+	if cfg.WriteJournal != "" {
+		journal := absPath(cfg.WriteJournal)
+		paths = append(paths, journal)
+		prefixes = append(prefixes, journal+".") // rotated journals
+	}
+	if cfg.StoragePath != "" {
+		db := absPath(cfg.StoragePath)
+		paths = append(paths, db, db+"-wal", db+"-shm", db+"-journal")
+	}
+	return func(path string) bool {
+		path = absPath(path)
+		for _, p := range paths {
+			if path == p {
+				return true
+			}
+		}
+		for _, p := range prefixes {
+			if strings.HasPrefix(path, p) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+func packetLogFiles(path string, own func(string) bool) ([]File, error) {
+	dir, base := filepath.Dir(path), filepath.Base(path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []File{}
+	for _, e := range entries {
+		name := e.Name()
+		rotated := strings.HasPrefix(name, base) && rotatedSuffix.MatchString(name[len(base):])
+		if !e.Type().IsRegular() || (name != base && !rotated) || (rotated && own(filepath.Join(dir, name))) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, File{Name: name, Size: info.Size(), Modified: info.ModTime().UTC(), Active: name == base})
+	}
+	sortFiles(files)
+	return files, nil
+}
+
+// sortFiles puts the active file first, then the rest newest first
+func sortFiles(files []File) {
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].Active != files[j].Active {
+			return files[i].Active
+		}
+		return files[i].Modified.After(files[j].Modified)
+	})
+}
+
+func sum(files []File) int64 {
+	var n int64
+	for _, f := range files {
+		n += f.Size
+	}
+	return n
+}
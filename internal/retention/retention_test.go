@@ -0,0 +1,181 @@
+package retention
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/storage"
+)
+
+// writeFile creates name in dir with size bytes, last modified at
+func writeFile(t *testing.T, dir, name string, size int, at time.Time) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+	if err := os.Chtimes(path, at, at); err != nil {
+		t.Fatalf("Failed to set time of %s: %v", name, err)
+	}
+}
+
+func newManager(t *testing.T, cfg *config.Config, store storage.Storage) *Manager {
+	t.Helper()
+	log, _ := logger.New(cfg.LogPackets, cfg.LogFile)
+	log.SetOutput(io.Discard)
+	t.Cleanup(log.Close)
+	return New(cfg, log, store)
+}
+
+func exists(dir, name string) bool {
+	_, err := os.Stat(filepath.Join(dir, name))
+	return err == nil
+}
+
+func TestManager_Budget(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeFile(t, dir, "packets.log", 400<<10, now)
+	writeFile(t, dir, "packets.log.1", 400<<10, now.Add(-time.Hour))
+	writeFile(t, dir, "packets.log.2.gz", 400<<10, now.Add(-2*time.Hour))
+	writeFile(t, dir, "other.log", 4<<20, now.Add(-3*time.Hour))
+
+	cfg := &config.Config{LogPackets: true, LogFile: filepath.Join(dir, "packets.log"), RetentionMaxMB: 1}
+	m := newManager(t, cfg, storage.NewMemory(storage.Limits{}))
+	m.Run(now)
+
+	if exists(dir, "packets.log.2.gz") || !exists(dir, "packets.log.1") || !exists(dir, "other.log") {
+		t.Error("Expected only the oldest rotated file deleted")
+	}
+	u := m.Usage()
+	if u.UsedBytes != 800<<10 || u.OverBudget || u.DeletedFiles != 1 || u.FreedBytes != 400<<10 || u.MaxBytes != 1<<20 {
+		t.Errorf("Unexpected usage %+v", u)
+	}
+	if len(u.Artifacts) != 1 || u.Artifacts[0].Kind != PacketLogs || len(u.Artifacts[0].Files) != 2 || !u.Artifacts[0].Files[0].Active {
+		t.Errorf("Unexpected artifacts %+v", u.Artifacts)
+	}
+
+	// The active file is emptied once nothing else is left
+	writeFile(t, dir, "packets.log.1", 2<<20, now.Add(-time.Hour))
+	m.Run(now)
+	if exists(dir, "packets.log.1") {
+		t.Error("Expected the rotated file deleted")
+	}
+	if info, _ := os.Stat(cfg.LogFile); info.Size() != 400<<10 {
+		t.Errorf("Expected the active file kept while under budget, got %d bytes", info.Size())
+	}
+	writeFile(t, dir, "packets.log.1", 100<<10, now.Add(-time.Hour))
+	if err := os.Truncate(cfg.LogFile, 2<<20); err != nil {
+		t.Fatalf("Failed to grow the log file: %v", err)
+	}
+	m.Run(now)
+	if info, _ := os.Stat(cfg.LogFile); info.Size() != 0 || exists(dir, "packets.log.1") {
+		t.Errorf("Expected the rotated file deleted and the active file emptied, got %d bytes", info.Size())
+	}
+	if u := m.Usage(); u.UsedBytes != 0 || u.OverBudget {
+		t.Errorf("Unexpected usage %+v", u)
+	}
+}
+
+func TestManager_KeepsNeighbours(t *testing.T) {
+	// Only names logrotate gives rotated files count as packet logs; the
+	// journal and the database next to LOG_FILE survive the budget even
+	// when their names share its prefix
+	dir := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	writeFile(t, dir, "packets.log", 0, time.Now())
+	for _, name := range []string{"packets.log.1", "packets.log.2.gz", "packets.log-20251130", "packets.log-20251129.gz"} {
+		writeFile(t, dir, name, 10, old)
+	}
+	neighbours := []string{
+		"packets.log.journal", "packets.log.journal.20251130-120000.000000",
+		"packets.log.db", "packets.log.db-wal", "packets.log.db-shm",
+		"packets.log.bak", "packets.log-old", "packets.log.1.txt",
+		"packets.log.3", // WRITE_JOURNAL, however unlikely
+	}
+	for _, name := range neighbours {
+		writeFile(t, dir, name, 10, old)
+	}
+
+	cfg := &config.Config{
+		LogPackets:      true,
+		LogFile:         filepath.Join(dir, "packets.log"),
+		WriteJournal:    filepath.Join(dir, "packets.log.3"),
+		StoragePath:     filepath.Join(dir, "packets.log.db"),
+		RetentionMaxAge: 1,
+	}
+	files, err := PacketLogFiles(cfg)
+	if err != nil {
+		t.Fatalf("Failed to list packet logs: %v", err)
+	}
+	if len(files) != 5 {
+		t.Errorf("Expected the log and 4 rotated files, got %+v", files)
+	}
+
+	newManager(t, cfg, storage.NewMemory(storage.Limits{})).Run(time.Now())
+	if exists(dir, "packets.log.1") || exists(dir, "packets.log-20251129.gz") {
+		t.Error("Expected the old rotated logs to be deleted")
+	}
+	for _, name := range neighbours {
+		if !exists(dir, name) {
+			t.Errorf("Expected %s to survive", name)
+		}
+	}
+}
+
+func TestManager_MaxAge(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeFile(t, dir, "packets.log", 10, now)
+	writeFile(t, dir, "packets.log.1", 10, now.Add(-24*time.Hour))
+	writeFile(t, dir, "packets.log.2", 10, now.Add(-72*time.Hour))
+
+	cfg := &config.Config{
+		LogPackets:      true,
+		LogFile:         filepath.Join(dir, "packets.log"),
+		StorageBackend:  config.StorageSQLite,
+		StoragePath:     filepath.Join(dir, "storage.db"),
+		RetentionMaxAge: 2,
+	}
+	db, err := storage.OpenSQLite(cfg.StoragePath, storage.Limits{})
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	defer db.Close()
+	_ = db.AddLog(logger.Entry{Time: now.Add(-72 * time.Hour), Level: logger.LogInfo, Line: "old"})
+	_ = db.AddLog(logger.Entry{Time: now, Level: logger.LogInfo, Line: "new"})
+
+	m := newManager(t, cfg, db)
+	m.Run(now)
+
+	if exists(dir, "packets.log.2") || !exists(dir, "packets.log.1") || !exists(dir, "packets.log") {
+		t.Error("Expected only the file older than 2 days deleted")
+	}
+	if entries, _ := db.Logs(); len(entries) != 1 || entries[0].Line != "new" {
+		t.Errorf("Expected old history pruned, got %+v", entries)
+	}
+	u := m.Usage()
+	if len(u.Artifacts) != 2 || u.Artifacts[1].Kind != History || u.Artifacts[1].Bytes == 0 || u.MaxAgeDays != 2 {
+		t.Errorf("Unexpected usage %+v", u)
+	}
+}
+
+func TestManager_NoLimits(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "packets.log.1", 10, time.Now().Add(-365*24*time.Hour))
+
+	m := newManager(t, &config.Config{LogPackets: true, LogFile: filepath.Join(dir, "packets.log")}, storage.NewMemory(storage.Limits{}))
+	m.Start()
+	m.Stop()
+	if !exists(dir, "packets.log.1") {
+		t.Error("Expected files kept without limits")
+	}
+	if u := m.Usage(); u.UsedBytes != 10 || u.LastRun.IsZero() {
+		t.Errorf("Unexpected usage %+v", u)
+	}
+}
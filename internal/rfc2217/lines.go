@@ -0,0 +1,165 @@
+package rfc2217
+
+import (
+	"errors"
+	"time"
+)
+
+// SET-CONTROL values for the modem control outputs
+const (
+	ctlQueryDTR = 7
+	ctlDTROn    = 8
+	ctlDTROff   = 9
+	ctlQueryRTS = 10
+	ctlRTSOn    = 11
+	ctlRTSOff   = 12
+)
+
+// NOTIFY-MODEMSTATE bits
+const (
+	modemCTS = 0x10
+	modemDSR = 0x20
+	modemRI  = 0x40
+	modemDCD = 0x80
+)
+
+// NOTIFY-LINESTATE error bits
+const (
+	lineOverrun   = 0x02
+	lineParity    = 0x04
+	lineFraming   = 0x08
+	lineBreak     = 0x10
+	lineErrorMask = lineOverrun | lineParity | lineFraming | lineBreak
+)
+
+// LineErrors count the receive errors the device server reported since the
+// connection started. A framing error usually means the baud rate or
+// framing does not match the device; parity errors and breaks also come
+// from line noise.
+type LineErrors struct {
+	Overrun uint64 `json:"overrun"`
+	Parity  uint64 `json:"parity"`
+	Framing uint64 `json:"framing"`
+	Break   uint64 `json:"break"`
+}
+
+// count adds the errors flagged in a NOTIFY-LINESTATE value
+func (e *LineErrors) count(state byte) {
+	for _, bit := range []struct {
+		mask byte
+		n    *uint64
+	}{
+		{lineOverrun, &e.Overrun},
+		{lineParity, &e.Parity},
+		{lineFraming, &e.Framing},
+		{lineBreak, &e.Break},
+	} {
+		if state&bit.mask != 0 {
+			*bit.n++
+		}
+	}
+}
+
+// Lines are the modem control lines of the remote port. CTS, DSR, DCD and
+// RI are inputs reported by the device server; DTR and RTS are the outputs
+// as last confirmed by it.
+type Lines struct {
+	CTS bool `json:"cts"`
+	DSR bool `json:"dsr"`
+	DCD bool `json:"dcd"`
+	RI  bool `json:"ri"`
+	DTR bool `json:"dtr"`
+	RTS bool `json:"rts"`
+}
+
+// LineUpdate sets the modem control outputs. Nil fields are left unchanged.
+type LineUpdate struct {
+	DTR *bool `json:"dtr,omitempty"`
+	RTS *bool `json:"rts,omitempty"`
+}
+
+// Lines returns the last reported modem control lines
+func (c *Conn) Lines() Lines {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lines
+}
+
+// LineErrors returns the receive errors reported so far
+func (c *Conn) LineErrors() LineErrors {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lineErrors
+}
+
+// SetLines sets DTR and/or RTS and waits for the server to confirm
+func (c *Conn) SetLines(u LineUpdate) (Lines, error) {
+	c.configMu.Lock()
+	defer c.configMu.Unlock()
+
+	var cmds []command
+	if u.DTR != nil {
+		cmds = append(cmds, control(pick(*u.DTR, ctlDTROn, ctlDTROff)))
+	}
+	if u.RTS != nil {
+		cmds = append(cmds, control(pick(*u.RTS, ctlRTSOn, ctlRTSOff)))
+	}
+	err := c.exchange(cmds)
+	return c.Lines(), err
+}
+
+// SendBreak holds the line in the break condition for d, then releases it.
+// The break is released even if the server did not confirm it started.
+func (c *Conn) SendBreak(d time.Duration) error {
+	c.configMu.Lock()
+	defer c.configMu.Unlock()
+
+	err := c.exchange([]command{control(ctlBreakOn)})
+	if err != nil && !errors.Is(err, ErrNotConfirmed) {
+		return err
+	}
+	time.Sleep(d)
+	if offErr := c.exchange([]command{control(ctlBreakOff)}); offErr != nil {
+		return offErr
+	}
+	return err
+}
+
+// lineQueries ask for the output states and enable modem state and line
+// error notifications, which makes most servers report the inputs right
+// away
+func lineQueries() []command {
+	return []command{
+		control(ctlQueryDTR),
+		control(ctlQueryRTS),
+		{code: cmdSetModemMask, frame: subcommand(cmdSetModemMask, 0xFF)},
+		{code: cmdSetLineMask, frame: subcommand(cmdSetLineMask, lineErrorMask)},
+	}
+}
+
+// updateLines records a SET-CONTROL answer or NOTIFY-MODEMSTATE. Called
+// with mu held.
+func (c *Conn) updateLines(code, value byte) {
+	switch {
+	case code == cmdNotifyModemState:
+		c.lines.CTS = value&modemCTS != 0
+		c.lines.DSR = value&modemDSR != 0
+		c.lines.RI = value&modemRI != 0
+		c.lines.DCD = value&modemDCD != 0
+	case value == ctlDTROn || value == ctlDTROff:
+		c.lines.DTR = value == ctlDTROn
+	case value == ctlRTSOn || value == ctlRTSOff:
+		c.lines.RTS = value == ctlRTSOn
+	}
+}
+
+func control(value byte) command {
+	return command{code: cmdSetControl, frame: subcommand(cmdSetControl, value)}
+}
+
+func pick(on bool, ifOn, ifOff byte) byte {
+	if on {
+		return ifOn
+	}
+	return ifOff
+}
@@ -0,0 +1,136 @@
+package rfc2217
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// Params are serial line settings. Zero values leave a setting unchanged.
+type Params struct {
+	BaudRate    int    `json:"baud_rate,omitempty"`
+	DataBits    int    `json:"data_bits,omitempty"`    // 5-8
+	Parity      string `json:"parity,omitempty"`       // none, odd, even, mark, space
+	StopBits    string `json:"stop_bits,omitempty"`    // 1, 1.5, 2
+	FlowControl string `json:"flow_control,omitempty"` // none, xonxoff, rtscts
+}
+
+var (
+	parityCodes = map[string]byte{"none": 1, "odd": 2, "even": 3, "mark": 4, "space": 5}
+	stopCodes   = map[string]byte{"1": 1, "2": 2, "1.5": 3}
+	flowCodes   = map[string]byte{"none": 1, "xonxoff": 2, "rtscts": 3}
+)
+
+// CharBits returns how many bits one character takes on the line, start
+// and stop bits included. Unset fields count as 8N1.
+func (p Params) CharBits() float64 {
+	bits := 1.0 + 8 + 1 // start, data, stop
+	if p.DataBits != 0 {
+		bits += float64(p.DataBits - 8)
+	}
+	if p.Parity != "" && p.Parity != "none" {
+		bits++
+	}
+	switch p.StopBits {
+	case "1.5":
+		bits += 0.5
+	case "2":
+		bits++
+	}
+	return bits
+}
+
+// Validate checks that every set field has a supported value
+func (p Params) Validate() error {
+	if p.BaudRate < 0 {
+		return fmt.Errorf("invalid baud rate: %d", p.BaudRate)
+	}
+	if p.DataBits != 0 && (p.DataBits < 5 || p.DataBits > 8) {
+		return fmt.Errorf("invalid data bits: %d", p.DataBits)
+	}
+	if _, ok := parityCodes[p.Parity]; p.Parity != "" && !ok {
+		return fmt.Errorf("invalid parity: %q", p.Parity)
+	}
+	if _, ok := stopCodes[p.StopBits]; p.StopBits != "" && !ok {
+		return fmt.Errorf("invalid stop bits: %q", p.StopBits)
+	}
+	if _, ok := flowCodes[p.FlowControl]; p.FlowControl != "" && !ok {
+		return fmt.Errorf("invalid flow control: %q", p.FlowControl)
+	}
+	return nil
+}
+
+// Merge returns p with the fields set in update replaced
+func (p Params) Merge(update Params) Params {
+	if update.BaudRate != 0 {
+		p.BaudRate = update.BaudRate
+	}
+	if update.DataBits != 0 {
+		p.DataBits = update.DataBits
+	}
+	if update.Parity != "" {
+		p.Parity = update.Parity
+	}
+	if update.StopBits != "" {
+		p.StopBits = update.StopBits
+	}
+	if update.FlowControl != "" {
+		p.FlowControl = update.FlowControl
+	}
+	return p
+}
+
+// ParseQuery reads settings from URL query parameters, e.g.
+// rfc2217://host:port?baud=115200&parity=even
+func ParseQuery(q url.Values) (Params, error) {
+	var p Params
+	for key, dst := range map[string]*int{"baud": &p.BaudRate, "data_bits": &p.DataBits} {
+		if v := q.Get(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return Params{}, fmt.Errorf("invalid %s: %q", key, v)
+			}
+			*dst = n
+		}
+	}
+	p.Parity = q.Get("parity")
+	p.StopBits = q.Get("stop_bits")
+	p.FlowControl = q.Get("flow_control")
+	return p, p.Validate()
+}
+
+type command struct {
+	code  byte
+	frame []byte
+}
+
+// commands returns the subnegotiations setting p. With query set, unset
+// fields are requested with a zero value, which asks the server for the
+// current setting.
+func (p Params) commands(query bool) []command {
+	var cmds []command
+	add := func(code byte, set bool, data ...byte) {
+		if set || query {
+			cmds = append(cmds, command{code: code, frame: subcommand(code, data...)})
+		}
+	}
+
+	baud := make([]byte, 4)
+	binary.BigEndian.PutUint32(baud, uint32(p.BaudRate))
+	add(cmdSetBaudRate, p.BaudRate != 0, baud...)
+	add(cmdSetDataSize, p.DataBits != 0, byte(p.DataBits))
+	add(cmdSetParity, p.Parity != "", parityCodes[p.Parity])
+	add(cmdSetStopSize, p.StopBits != "", stopCodes[p.StopBits])
+	add(cmdSetControl, p.FlowControl != "", flowCodes[p.FlowControl])
+	return cmds
+}
+
+func nameOf(codes map[string]byte, code byte) string {
+	for name, c := range codes {
+		if c == code {
+			return name
+		}
+	}
+	return ""
+}
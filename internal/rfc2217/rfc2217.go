@@ -0,0 +1,275 @@
+// Package rfc2217 implements the client side of the Telnet Com Port Control
+// Option (RFC 2217), which serial device servers such as ser2net use to let
+// the remote end change the serial line settings of their port.
+package rfc2217
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Telnet commands and options
+const (
+	iac  = 255
+	dont = 254
+	do   = 253
+	wont = 252
+	will = 251
+	sb   = 250
+	se   = 240
+
+	optBinary  = 0
+	optSGA     = 3
+	optComPort = 44
+)
+
+// Com Port Control Option commands. The server answers with the command
+// code plus serverOffset.
+const (
+	cmdSignature   = 0
+	cmdSetBaudRate = 1
+	cmdSetDataSize = 2
+	cmdSetParity   = 3
+	cmdSetStopSize = 4
+	cmdSetControl  = 5
+
+	cmdNotifyLineState  = 6
+	cmdNotifyModemState = 7
+	cmdSetLineMask      = 10
+	cmdSetModemMask     = 11
+
+	serverOffset = 100
+)
+
+// confirmTimeout is how long Configure waits for the server to confirm
+const confirmTimeout = 2 * time.Second
+
+// ErrNotConfirmed is returned when the device server does not answer a
+// settings change in time
+var ErrNotConfirmed = errors.New("device server did not confirm the settings")
+
+// Conn is a Telnet connection to an RFC 2217 device server. Read returns
+// serial data with Telnet commands removed; Write escapes it.
+type Conn struct {
+	net.Conn
+
+	writeMu sync.Mutex
+
+	// Read side, used only by the goroutine calling Read
+	raw []byte
+	dec decoder
+
+	mu          sync.Mutex
+	local       map[byte]bool // options enabled on our side
+	remote      map[byte]bool // options enabled on the server side
+	reported    Params
+	lines       Lines
+	lineErrors  LineErrors
+	outstanding map[byte]int // commands sent but not yet answered
+	answered    chan struct{}
+
+	configMu sync.Mutex
+}
+
+// NewConn wraps a TCP connection to a device server. Call Start before
+// reading.
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{
+		Conn:        conn,
+		local:       make(map[byte]bool),
+		remote:      make(map[byte]bool),
+		outstanding: make(map[byte]int),
+		answered:    make(chan struct{}, 1),
+	}
+}
+
+// Start negotiates binary mode and the Com Port Control Option, then sends
+// p. Settings left unset are queried so Reported fills in, as are the
+// modem control lines.
+func (c *Conn) Start(p Params) error {
+	c.mu.Lock()
+	c.local[optBinary], c.local[optSGA], c.local[optComPort] = true, true, true
+	c.remote[optBinary], c.remote[optSGA] = true, true
+	c.mu.Unlock()
+
+	msg := []byte{
+		iac, will, optComPort,
+		iac, will, optBinary, iac, do, optBinary,
+		iac, will, optSGA, iac, do, optSGA,
+	}
+	return c.sendCommands(msg, append(p.commands(true), lineQueries()...))
+}
+
+// StartTelnet negotiates binary mode only, for a Telnet server without the
+// Com Port Control Option. The serial settings are left as they are.
+func (c *Conn) StartTelnet() error {
+	c.mu.Lock()
+	c.local[optBinary], c.local[optSGA] = true, true
+	c.remote[optBinary], c.remote[optSGA] = true, true
+	c.mu.Unlock()
+
+	return c.send([]byte{
+		iac, will, optBinary, iac, do, optBinary,
+		iac, will, optSGA, iac, do, optSGA,
+	})
+}
+
+// Configure changes the settings set in p and waits for the server to
+// confirm them. It returns the settings the server reported.
+func (c *Conn) Configure(p Params) (Params, error) {
+	c.configMu.Lock()
+	defer c.configMu.Unlock()
+
+	err := c.exchange(p.commands(false))
+	return c.Reported(), err
+}
+
+// exchange sends cmds and waits until the server has answered them.
+// Called with configMu held.
+func (c *Conn) exchange(cmds []command) error {
+	if len(cmds) == 0 {
+		return nil
+	}
+	if err := c.sendCommands(nil, cmds); err != nil {
+		return err
+	}
+
+	// Answers arrive in order, so once every command of the same kind sent
+	// so far has been answered, the last answer is the one for ours
+	timeout := time.After(confirmTimeout)
+	for !c.answeredAll(cmds) {
+		select {
+		case <-c.answered:
+		case <-timeout:
+			c.mu.Lock()
+			for _, cmd := range cmds {
+				c.outstanding[cmd.code] = 0
+			}
+			c.mu.Unlock()
+			return ErrNotConfirmed
+		}
+	}
+	return nil
+}
+
+// sendCommands sends prefix followed by cmds and counts them as outstanding
+func (c *Conn) sendCommands(prefix []byte, cmds []command) error {
+	msg := prefix
+	c.mu.Lock()
+	for _, cmd := range cmds {
+		msg = append(msg, cmd.frame...)
+		c.outstanding[cmd.code]++
+	}
+	c.mu.Unlock()
+	return c.send(msg)
+}
+
+func (c *Conn) answeredAll(cmds []command) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cmd := range cmds {
+		if c.outstanding[cmd.code] > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Reported returns the settings last reported by the server
+func (c *Conn) Reported() Params {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reported
+}
+
+// Read reads serial data, handling any Telnet commands in between
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if len(c.raw) < len(b) {
+		c.raw = make([]byte, len(b))
+	}
+	for {
+		n, err := c.Conn.Read(c.raw[:len(b)])
+		if out := c.dec.decode(c.raw[:n], b, c.negotiate, c.subnegotiation); out > 0 || err != nil {
+			return out, err
+		}
+	}
+}
+
+// Write sends serial data, escaping IAC bytes
+func (c *Conn) Write(b []byte) (int, error) {
+	escaped := b
+	for i, ch := range b {
+		if ch == iac {
+			escaped = append(append([]byte{}, b[:i]...), Escape(b[i:])...)
+			break
+		}
+	}
+	if err := c.send(escaped); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *Conn) send(b []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(b)
+	return err
+}
+
+// negotiate answers an option request
+func (c *Conn) negotiate(verb, opt byte) {
+	c.mu.Lock()
+	reply := answer(verb, opt, c.local, c.remote, clientLocal, clientRemote)
+	c.mu.Unlock()
+
+	if reply != nil {
+		_ = c.send(reply)
+	}
+}
+
+// subnegotiation records the settings or line state in a server response
+func (c *Conn) subnegotiation(sub []byte) {
+	if len(sub) < 3 || sub[0] != optComPort || sub[1] <= serverOffset {
+		return
+	}
+	code, data := sub[1]-serverOffset, sub[2:]
+
+	c.mu.Lock()
+	switch code {
+	case cmdSetBaudRate:
+		if len(data) >= 4 {
+			c.reported.BaudRate = int(binary.BigEndian.Uint32(data))
+		}
+	case cmdSetDataSize:
+		c.reported.DataBits = int(data[0])
+	case cmdSetParity:
+		c.reported.Parity = nameOf(parityCodes, data[0])
+	case cmdSetStopSize:
+		c.reported.StopBits = nameOf(stopCodes, data[0])
+	case cmdSetControl:
+		if name := nameOf(flowCodes, data[0]); name != "" {
+			c.reported.FlowControl = name
+		}
+		c.updateLines(code, data[0])
+	case cmdNotifyModemState:
+		c.updateLines(code, data[0])
+	case cmdNotifyLineState:
+		c.lineErrors.count(data[0])
+	}
+	if c.outstanding[code] > 0 {
+		c.outstanding[code]--
+	}
+	c.mu.Unlock()
+
+	select {
+	case c.answered <- struct{}{}:
+	default:
+	}
+}
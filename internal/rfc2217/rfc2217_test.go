@@ -0,0 +1,471 @@
+package rfc2217
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer is a minimal RFC 2217 device server. It answers settings
+// commands, echoes them in its state and collects serial data.
+type fakeServer struct {
+	t       *testing.T
+	conn    net.Conn
+	replies chan []byte
+
+	mu       sync.Mutex
+	settings map[byte][]byte
+	dtr, rts byte
+	modem    byte
+	data     []byte
+	breaks   []byte // break SET-CONTROL values received
+	silent   bool   // do not answer commands
+}
+
+func newTestConn(t *testing.T) (*Conn, *fakeServer) {
+	t.Helper()
+	client, server := net.Pipe()
+	fs := &fakeServer{
+		t:       t,
+		conn:    server,
+		replies: make(chan []byte, 64),
+		settings: map[byte][]byte{
+			cmdSetBaudRate: {0, 0, 0x25, 0x80}, // 9600
+			cmdSetDataSize: {8},
+			cmdSetParity:   {1},
+			cmdSetStopSize: {1},
+			cmdSetControl:  {1},
+		},
+		dtr:   ctlDTROff,
+		rts:   ctlRTSOff,
+		modem: modemDSR | modemDCD,
+	}
+	go fs.serve()
+	go fs.reply()
+	c := NewConn(client)
+	t.Cleanup(func() {
+		c.Close()
+		server.Close()
+	})
+	return c, fs
+}
+
+func (fs *fakeServer) serve() {
+	buf := make([]byte, 256)
+	var pending []byte
+	for {
+		n, err := fs.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		pending = append(pending, buf[:n]...)
+		pending = fs.handle(pending)
+	}
+}
+
+// reply writes answers in order, without blocking serve on net.Pipe
+func (fs *fakeServer) reply() {
+	for b := range fs.replies {
+		if _, err := fs.conn.Write(b); err != nil {
+			return
+		}
+	}
+}
+
+// handle consumes complete sequences from b and returns the rest
+func (fs *fakeServer) handle(b []byte) []byte {
+	for len(b) > 0 {
+		if b[0] != iac {
+			fs.mu.Lock()
+			fs.data = append(fs.data, b[0])
+			fs.mu.Unlock()
+			b = b[1:]
+			continue
+		}
+		if len(b) < 2 {
+			return b
+		}
+		switch b[1] {
+		case iac:
+			fs.mu.Lock()
+			fs.data = append(fs.data, iac)
+			fs.mu.Unlock()
+			b = b[2:]
+		case will, wont, do, dont:
+			if len(b) < 3 {
+				return b
+			}
+			b = b[3:]
+		case sb:
+			end := bytes.Index(b, []byte{iac, se})
+			if end < 0 {
+				return b
+			}
+			fs.command(bytes.ReplaceAll(b[2:end], []byte{iac, iac}, []byte{iac}))
+			b = b[end+2:]
+		default:
+			b = b[2:]
+		}
+	}
+	return b
+}
+
+func (fs *fakeServer) command(sub []byte) {
+	if len(sub) < 3 || sub[0] != optComPort {
+		return
+	}
+	cmd, value := sub[1], sub[2:]
+
+	fs.mu.Lock()
+	if silent := fs.silent; silent {
+		fs.mu.Unlock()
+		return
+	}
+	var reply []byte
+	switch {
+	case cmd == cmdSetModemMask:
+		reply = append(subcommand(cmd+serverOffset, value...), subcommand(cmdNotifyModemState+serverOffset, fs.modem)...)
+	case cmd == cmdSetControl && value[0] >= ctlQueryBreak && value[0] <= ctlBreakOff:
+		fs.breaks = append(fs.breaks, value[0])
+		reply = subcommand(cmd+serverOffset, value[0])
+	case cmd == cmdSetControl && value[0] >= ctlQueryDTR:
+		switch value[0] {
+		case ctlDTROn, ctlDTROff:
+			fs.dtr = value[0]
+		case ctlRTSOn, ctlRTSOff:
+			fs.rts = value[0]
+		}
+		state := fs.dtr
+		if value[0] >= ctlQueryRTS {
+			state = fs.rts
+		}
+		reply = subcommand(cmd+serverOffset, state)
+	default:
+		if !bytes.Equal(value, make([]byte, len(value))) {
+			fs.settings[cmd] = append([]byte{}, value...)
+		}
+		reply = subcommand(cmd+serverOffset, fs.settings[cmd]...)
+	}
+	fs.mu.Unlock()
+
+	fs.replies <- reply
+}
+
+func (fs *fakeServer) received() []byte {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return append([]byte{}, fs.data...)
+}
+
+// readLoop reads from c until it is closed, forwarding serial data
+func readLoop(c *Conn) <-chan []byte {
+	ch := make(chan []byte, 16)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := c.Read(buf)
+			if n > 0 {
+				ch <- append([]byte{}, buf[:n]...)
+			}
+			if err != nil {
+				close(ch)
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func TestConn_StartQueriesSettings(t *testing.T) {
+	c, _ := newTestConn(t)
+	readLoop(c)
+
+	if err := c.Start(Params{BaudRate: 115200}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	want := Params{BaudRate: 115200, DataBits: 8, Parity: "none", StopBits: "1", FlowControl: "none"}
+	deadline := time.Now().Add(2 * time.Second)
+	for c.Reported() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected reported %+v, got %+v", want, c.Reported())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConn_Configure(t *testing.T) {
+	c, fs := newTestConn(t)
+	readLoop(c)
+	if err := c.Start(Params{}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	got, err := c.Configure(Params{BaudRate: 0xFF00, Parity: "even", StopBits: "2"})
+	if err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+	if got.BaudRate != 0xFF00 || got.Parity != "even" || got.StopBits != "2" {
+		t.Errorf("Unexpected reported settings: %+v", got)
+	}
+
+	fs.mu.Lock()
+	fs.silent = true
+	fs.mu.Unlock()
+	if _, err := c.Configure(Params{DataBits: 7}); err != ErrNotConfirmed {
+		t.Errorf("Expected ErrNotConfirmed, got %v", err)
+	}
+}
+
+func TestConn_Lines(t *testing.T) {
+	c, fs := newTestConn(t)
+	readLoop(c)
+	if err := c.Start(Params{}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	on, off := true, false
+	lines, err := c.SetLines(LineUpdate{DTR: &on, RTS: &off})
+	if err != nil {
+		t.Fatalf("SetLines failed: %v", err)
+	}
+	want := Lines{DSR: true, DCD: true, DTR: true}
+	if lines != want {
+		t.Errorf("Expected %+v, got %+v", want, lines)
+	}
+	fs.mu.Lock()
+	dtr := fs.dtr
+	fs.mu.Unlock()
+	if dtr != ctlDTROn {
+		t.Errorf("Expected server DTR on, got %d", dtr)
+	}
+
+	// A modem state notification updates the inputs only
+	fs.replies <- subcommand(cmdNotifyModemState+serverOffset, modemCTS|modemRI)
+	deadline := time.Now().Add(2 * time.Second)
+	for want := (Lines{CTS: true, RI: true, DTR: true}); c.Lines() != want; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %+v, got %+v", want, c.Lines())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Flow control answers leave the outputs alone
+	if _, err := c.Configure(Params{FlowControl: "rtscts"}); err != nil {
+		t.Fatalf("Configure failed: %v", err)
+	}
+	if !c.Lines().DTR {
+		t.Error("Expected DTR to stay on")
+	}
+}
+
+func TestConn_SendBreak(t *testing.T) {
+	c, fs := newTestConn(t)
+	readLoop(c)
+	if err := c.Start(Params{}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+
+	start := time.Now()
+	if err := c.SendBreak(50 * time.Millisecond); err != nil {
+		t.Fatalf("SendBreak failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected the break to last 50ms, returned after %v", elapsed)
+	}
+	fs.mu.Lock()
+	breaks := append([]byte{}, fs.breaks...)
+	fs.mu.Unlock()
+	if !bytes.Equal(breaks, []byte{ctlBreakOn, ctlBreakOff}) {
+		t.Errorf("Expected break on then off, got %v", breaks)
+	}
+
+	// An unconfirmed break is still released
+	fs.mu.Lock()
+	fs.silent = true
+	fs.mu.Unlock()
+	if err := c.SendBreak(time.Millisecond); err != ErrNotConfirmed {
+		t.Errorf("Expected ErrNotConfirmed, got %v", err)
+	}
+}
+
+func TestConn_LineErrors(t *testing.T) {
+	c, fs := newTestConn(t)
+	readLoop(c)
+	if err := c.Start(Params{}); err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		fs.mu.Lock()
+		mask := fs.settings[cmdSetLineMask]
+		fs.mu.Unlock()
+		if bytes.Equal(mask, []byte{lineErrorMask}) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the line state mask %#x, got %x", lineErrorMask, mask)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	fs.replies <- subcommand(cmdNotifyLineState+serverOffset, lineFraming|0x01)
+	fs.replies <- subcommand(cmdNotifyLineState+serverOffset, lineFraming|lineParity)
+	want := LineErrors{Framing: 2, Parity: 1}
+	for c.LineErrors() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %+v, got %+v", want, c.LineErrors())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConn_DataEscaping(t *testing.T) {
+	c, fs := newTestConn(t)
+	data := readLoop(c)
+
+	payload := []byte{0x01, iac, 0x02}
+	if _, err := c.Write(payload); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !bytes.Equal(fs.received(), payload) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected server to receive %x, got %x", payload, fs.received())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Serial data with an escaped IAC, interleaved with negotiation
+	go func() {
+		_, _ = fs.conn.Write([]byte{0x10, iac, iac, iac, will, optBinary, 0x11})
+	}()
+	var got []byte
+	for len(got) < 3 {
+		select {
+		case b := <-data:
+			got = append(got, b...)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out reading data, got %x", got)
+		}
+	}
+	if !bytes.Equal(got, []byte{0x10, iac, 0x11}) {
+		t.Errorf("Expected 10ff11, got %x", got)
+	}
+}
+
+func TestConn_NegotiationReplies(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := NewConn(client)
+	defer c.Close()
+	readLoop(c)
+
+	// Unsupported option: refused once
+	go func() { _, _ = server.Write([]byte{iac, do, 24}) }()
+	reply := make([]byte, 3)
+	_ = server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(server, reply); err != nil || !bytes.Equal(reply, []byte{iac, wont, 24}) {
+		t.Fatalf("Expected WONT 24, got %x (%v)", reply, err)
+	}
+
+	// Supported option: accepted
+	go func() { _, _ = server.Write([]byte{iac, do, optComPort}) }()
+	if _, err := io.ReadFull(server, reply); err != nil || !bytes.Equal(reply, []byte{iac, will, optComPort}) {
+		t.Fatalf("Expected WILL COM-PORT-OPTION, got %x (%v)", reply, err)
+	}
+}
+
+func TestParams_CharBits(t *testing.T) {
+	for _, tc := range []struct {
+		p    Params
+		want float64
+	}{
+		{Params{}, 10},
+		{Params{DataBits: 7, Parity: "even", StopBits: "1"}, 10},
+		{Params{DataBits: 8, Parity: "odd", StopBits: "2"}, 12},
+		{Params{DataBits: 5, Parity: "none", StopBits: "1.5"}, 7.5},
+	} {
+		if got := tc.p.CharBits(); got != tc.want {
+			t.Errorf("%+v: expected %v bits, got %v", tc.p, tc.want, got)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	q := map[string][]string{"baud": {"115200"}, "parity": {"even"}, "stop_bits": {"1.5"}}
+	p, err := ParseQuery(q)
+	if err != nil {
+		t.Fatalf("ParseQuery failed: %v", err)
+	}
+	if p != (Params{BaudRate: 115200, Parity: "even", StopBits: "1.5"}) {
+		t.Errorf("Unexpected params: %+v", p)
+	}
+
+	for _, bad := range []map[string][]string{
+		{"baud": {"fast"}},
+		{"data_bits": {"9"}},
+		{"parity": {"sometimes"}},
+		{"flow_control": {"dsrdtr"}},
+	} {
+		if _, err := ParseQuery(bad); err == nil {
+			t.Errorf("Expected error for %v", bad)
+		}
+	}
+}
+
+func TestParams_Commands(t *testing.T) {
+	cmds := Params{BaudRate: 9600}.commands(false)
+	if len(cmds) != 1 || cmds[0].code != cmdSetBaudRate {
+		t.Fatalf("Expected one baud rate command, got %+v", cmds)
+	}
+	want := []byte{iac, sb, optComPort, cmdSetBaudRate}
+	want = binary.BigEndian.AppendUint32(want, 9600)
+	want = append(want, iac, se)
+	if !bytes.Equal(cmds[0].frame, want) {
+		t.Errorf("Expected %x, got %x", want, cmds[0].frame)
+	}
+
+	if n := len((Params{}).commands(true)); n != 5 {
+		t.Errorf("Expected 5 queries, got %d", n)
+	}
+}
+
+func TestComPortAnswer(t *testing.T) {
+	for _, tc := range []struct {
+		data                []byte
+		answered, supported bool
+	}{
+		{[]byte{iac, will, optSGA}, false, false},
+		{[]byte{iac, will, optSGA, iac, do, optComPort}, true, true},
+		{[]byte{iac, dont, optComPort}, true, false},
+		{[]byte{iac, wont, optComPort}, true, false},
+		{[]byte{iac, sb, optComPort, 10, iac, se}, true, true},
+	} {
+		answered, supported := ComPortAnswer(tc.data)
+		if answered != tc.answered || supported != tc.supported {
+			t.Errorf("%x: expected %v/%v, got %v/%v", tc.data, tc.answered, tc.supported, answered, supported)
+		}
+	}
+}
+
+func TestConn_StartTelnet(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := NewConn(client)
+	defer c.Close()
+
+	go func() { _ = c.StartTelnet() }()
+	got := make([]byte, 12)
+	_ = server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatalf("Failed to read negotiation: %v", err)
+	}
+	if bytes.Contains(got, []byte{optComPort}) || !bytes.Contains(got, []byte{iac, do, optBinary}) {
+		t.Errorf("Unexpected negotiation %x", got)
+	}
+}
@@ -0,0 +1,168 @@
+package rfc2217
+
+import "encoding/binary"
+
+// SET-CONTROL values handled by the server besides flow control and the
+// modem control outputs
+const (
+	ctlQueryFlow  = 0
+	ctlQueryBreak = 4
+	ctlBreakOn    = 5
+	ctlBreakOff   = 6
+)
+
+// signature is sent in answer to a SIGNATURE request
+const signature = "serial-tcp-proxy"
+
+// Port is the serial port a Server controls on behalf of its client
+type Port interface {
+	// SetParams changes the settings set in p and returns the settings in
+	// effect
+	SetParams(p Params) (Params, error)
+	// SetLines sets DTR and/or RTS and returns the line state
+	SetLines(u LineUpdate) (Lines, error)
+}
+
+// Server answers a client that controls a serial port over RFC 2217, such
+// as esptool or pyserial with an rfc2217:// port, and passes settings
+// changes to a Port. It is not safe for concurrent use; Decode is called
+// from the goroutine reading the client.
+type Server struct {
+	port  Port
+	write func([]byte) error
+
+	dec    decoder
+	local  map[byte]bool
+	remote map[byte]bool
+	params Params
+	lines  Lines
+	brk    bool
+}
+
+// NewServer returns a server answering through write
+func NewServer(port Port, write func([]byte) error) *Server {
+	return &Server{
+		port:   port,
+		write:  write,
+		local:  make(map[byte]bool),
+		remote: make(map[byte]bool),
+	}
+}
+
+// Decode handles the Telnet commands in data read from the client and
+// returns the serial data in it
+func (s *Server) Decode(data []byte) []byte {
+	out := make([]byte, len(data))
+	n := s.dec.decode(data, out, s.negotiate, s.command)
+	return out[:n]
+}
+
+func (s *Server) negotiate(verb, opt byte) {
+	if reply := answer(verb, opt, s.local, s.remote, serverLocal, serverRemote); reply != nil {
+		_ = s.write(reply)
+	}
+}
+
+// command runs a Com Port Control command and answers it. A zero value
+// queries the current setting.
+func (s *Server) command(sub []byte) {
+	if len(sub) < 2 || sub[0] != optComPort || sub[1] >= serverOffset {
+		return
+	}
+	cmd, data := sub[1], sub[2:]
+
+	reply := data
+	switch cmd {
+	case cmdSetBaudRate:
+		if len(data) < 4 {
+			return
+		}
+		if baud := binary.BigEndian.Uint32(data); baud != 0 {
+			s.setParams(Params{BaudRate: int(baud)})
+		}
+		reply = binary.BigEndian.AppendUint32(nil, uint32(s.params.BaudRate))
+	case cmdSetDataSize, cmdSetParity, cmdSetStopSize, cmdSetControl:
+		if len(data) < 1 {
+			return
+		}
+		reply = []byte{s.setting(cmd, data[0])}
+	case cmdSignature:
+		reply = []byte(signature)
+	}
+	_ = s.write(subcommand(cmd+serverOffset, reply...))
+}
+
+// setting applies a one-byte setting and returns its value in effect
+func (s *Server) setting(cmd, value byte) byte {
+	switch cmd {
+	case cmdSetDataSize:
+		if value != 0 {
+			s.setParams(Params{DataBits: int(value)})
+		}
+		return byte(s.params.DataBits)
+	case cmdSetParity:
+		if name := nameOf(parityCodes, value); name != "" {
+			s.setParams(Params{Parity: name})
+		}
+		return parityCodes[s.params.Parity]
+	case cmdSetStopSize:
+		if name := nameOf(stopCodes, value); name != "" {
+			s.setParams(Params{StopBits: name})
+		}
+		return stopCodes[s.params.StopBits]
+	}
+
+	// SET-CONTROL
+	switch value {
+	case ctlQueryFlow:
+		if code, ok := flowCodes[s.params.FlowControl]; ok {
+			return code
+		}
+		return flowCodes["none"]
+	case ctlQueryBreak:
+		return pick(s.brk, ctlBreakOn, ctlBreakOff)
+	case ctlBreakOn, ctlBreakOff:
+		s.brk = value == ctlBreakOn
+	case ctlQueryDTR:
+		return pick(s.lines.DTR, ctlDTROn, ctlDTROff)
+	case ctlDTROn, ctlDTROff:
+		on := value == ctlDTROn
+		s.setLines(LineUpdate{DTR: &on})
+		return pick(s.lines.DTR, ctlDTROn, ctlDTROff)
+	case ctlQueryRTS:
+		return pick(s.lines.RTS, ctlRTSOn, ctlRTSOff)
+	case ctlRTSOn, ctlRTSOff:
+		on := value == ctlRTSOn
+		s.setLines(LineUpdate{RTS: &on})
+		return pick(s.lines.RTS, ctlRTSOn, ctlRTSOff)
+	default:
+		if name := nameOf(flowCodes, value); name != "" {
+			s.setParams(Params{FlowControl: name})
+		}
+	}
+	return value
+}
+
+// setParams passes a change to the port. If the port cannot apply it, the
+// change is acknowledged anyway so the client carries on.
+func (s *Server) setParams(p Params) {
+	got, err := s.port.SetParams(p)
+	s.params = s.params.Merge(p)
+	if err == nil {
+		s.params = s.params.Merge(got)
+	}
+}
+
+func (s *Server) setLines(u LineUpdate) {
+	got, err := s.port.SetLines(u)
+	if err == nil {
+		s.lines = got
+		return
+	}
+	if u.DTR != nil {
+		s.lines.DTR = *u.DTR
+	}
+	if u.RTS != nil {
+		s.lines.RTS = *u.RTS
+	}
+}
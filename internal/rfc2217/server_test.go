@@ -0,0 +1,115 @@
+package rfc2217
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+type fakePort struct {
+	params Params
+	lines  Lines
+	err    error
+}
+
+func (p *fakePort) SetParams(params Params) (Params, error) {
+	if p.err != nil {
+		return Params{}, p.err
+	}
+	p.params = p.params.Merge(params)
+	return p.params, nil
+}
+
+func (p *fakePort) SetLines(u LineUpdate) (Lines, error) {
+	if p.err != nil {
+		return Lines{}, p.err
+	}
+	if u.DTR != nil {
+		p.lines.DTR = *u.DTR
+	}
+	if u.RTS != nil {
+		p.lines.RTS = *u.RTS
+	}
+	return p.lines, nil
+}
+
+func newTestServer(port Port) (*Server, *bytes.Buffer) {
+	var out bytes.Buffer
+	return NewServer(port, func(b []byte) error {
+		out.Write(b)
+		return nil
+	}), &out
+}
+
+func TestServer_Negotiation(t *testing.T) {
+	s, out := newTestServer(&fakePort{})
+
+	data := s.Decode([]byte{iac, will, optComPort, iac, do, optBinary, iac, do, 24, 'h', 'i'})
+	if string(data) != "hi" {
+		t.Errorf("Expected data \"hi\", got %q", data)
+	}
+	want := []byte{iac, do, optComPort, iac, will, optBinary, iac, wont, 24}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("Expected replies %x, got %x", want, out.Bytes())
+	}
+
+	// Repeated requests are not answered again
+	out.Reset()
+	s.Decode([]byte{iac, will, optComPort})
+	if out.Len() != 0 {
+		t.Errorf("Expected no reply, got %x", out.Bytes())
+	}
+}
+
+func TestServer_Commands(t *testing.T) {
+	port := &fakePort{}
+	s, out := newTestServer(port)
+
+	// Split across reads
+	cmd := subcommand(cmdSetBaudRate, 0, 0, 0x25, 0x80)
+	s.Decode(cmd[:3])
+	s.Decode(cmd[3:])
+	if port.params.BaudRate != 9600 {
+		t.Errorf("Expected port set to 9600 baud, got %d", port.params.BaudRate)
+	}
+	if want := subcommand(cmdSetBaudRate+serverOffset, 0, 0, 0x25, 0x80); !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("Expected %x, got %x", want, out.Bytes())
+	}
+
+	tests := []struct {
+		name  string
+		cmd   []byte
+		reply []byte
+	}{
+		{"parity", subcommand(cmdSetParity, 3), subcommand(cmdSetParity+serverOffset, 3)},
+		{"query parity", subcommand(cmdSetParity, 0), subcommand(cmdSetParity+serverOffset, 3)},
+		{"DTR on", subcommand(cmdSetControl, ctlDTROn), subcommand(cmdSetControl+serverOffset, ctlDTROn)},
+		{"query RTS", subcommand(cmdSetControl, ctlQueryRTS), subcommand(cmdSetControl+serverOffset, ctlRTSOff)},
+		{"purge", subcommand(12, 3), subcommand(12+serverOffset, 3)},
+	}
+	for _, tt := range tests {
+		out.Reset()
+		s.Decode(tt.cmd)
+		if !bytes.Equal(out.Bytes(), tt.reply) {
+			t.Errorf("%s: expected %x, got %x", tt.name, tt.reply, out.Bytes())
+		}
+	}
+	if port.params.Parity != "even" || !port.lines.DTR {
+		t.Errorf("Expected even parity and DTR on, got %+v %+v", port.params, port.lines)
+	}
+}
+
+func TestServer_PortWithoutControl(t *testing.T) {
+	s, out := newTestServer(&fakePort{err: errors.New("not supported")})
+
+	// Changes are acknowledged so the client carries on
+	s.Decode(subcommand(cmdSetBaudRate, 0, 0x0E, 0x10, 0x00))
+	if want := subcommand(cmdSetBaudRate+serverOffset, 0, 0x0E, 0x10, 0x00); !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("Expected %x, got %x", want, out.Bytes())
+	}
+	out.Reset()
+	s.Decode(subcommand(cmdSetControl, ctlRTSOn))
+	if want := subcommand(cmdSetControl+serverOffset, ctlRTSOn); !bytes.Equal(out.Bytes(), want) {
+		t.Errorf("Expected %x, got %x", want, out.Bytes())
+	}
+}
@@ -0,0 +1,185 @@
+package rfc2217
+
+import "slices"
+
+// maxSubnegotiation bounds how much of a subnegotiation is kept
+const maxSubnegotiation = 64
+
+// Options each side agrees to enable. The client announces the Com Port
+// Control Option; the server only accepts it.
+var (
+	clientLocal  = []byte{optBinary, optSGA, optComPort}
+	clientRemote = []byte{optBinary, optSGA}
+	serverLocal  = []byte{optBinary, optSGA}
+	serverRemote = []byte{optBinary, optSGA, optComPort}
+)
+
+type decodeState int
+
+const (
+	stData decodeState = iota
+	stIAC
+	stOption
+	stSub
+	stSubIAC
+)
+
+// decoder separates Telnet commands from data. It keeps its state between
+// calls, so commands may be split across reads.
+type decoder struct {
+	state decodeState
+	verb  byte
+	sub   []byte
+}
+
+// decode copies the data bytes of in to out, calling onOption for option
+// negotiation and onSub for subnegotiations. out must be at least as long
+// as in.
+func (d *decoder) decode(in, out []byte, onOption func(verb, opt byte), onSub func(sub []byte)) int {
+	n := 0
+	for _, ch := range in {
+		switch d.state {
+		case stData:
+			if ch == iac {
+				d.state = stIAC
+				continue
+			}
+			out[n] = ch
+			n++
+		case stIAC:
+			switch ch {
+			case iac:
+				out[n] = iac
+				n++
+				d.state = stData
+			case will, wont, do, dont:
+				d.verb = ch
+				d.state = stOption
+			case sb:
+				d.sub = d.sub[:0]
+				d.state = stSub
+			default:
+				d.state = stData
+			}
+		case stOption:
+			onOption(d.verb, ch)
+			d.state = stData
+		case stSub:
+			if ch == iac {
+				d.state = stSubIAC
+			} else if len(d.sub) < maxSubnegotiation {
+				d.sub = append(d.sub, ch)
+			}
+		case stSubIAC:
+			switch ch {
+			case se:
+				onSub(d.sub)
+				d.state = stData
+			case iac:
+				if len(d.sub) < maxSubnegotiation {
+					d.sub = append(d.sub, iac)
+				}
+				d.state = stSub
+			default:
+				d.state = stSub
+			}
+		}
+	}
+	return n
+}
+
+// Filter removes Telnet commands from a stream without answering them, for
+// servers that negotiate but carry the data either way
+type Filter struct {
+	dec decoder
+}
+
+// Strip copies the data bytes of in to out, which must be at least as long
+// as in, and returns how many were copied. Doubled IAC bytes become one.
+func (f *Filter) Strip(in, out []byte) int {
+	return f.dec.decode(in, out, func(verb, opt byte) {}, func(sub []byte) {})
+}
+
+// answer returns the reply to an option request, or nil. local and remote
+// hold the options enabled on either side; supportedLocal and
+// supportedRemote the ones we agree to. Replies are only sent when an
+// option changes state, so negotiation cannot loop.
+func answer(verb, opt byte, local, remote map[byte]bool, supportedLocal, supportedRemote []byte) []byte {
+	switch verb {
+	case do:
+		if !slices.Contains(supportedLocal, opt) {
+			return []byte{iac, wont, opt}
+		}
+		if !local[opt] {
+			local[opt] = true
+			return []byte{iac, will, opt}
+		}
+	case dont:
+		if local[opt] {
+			local[opt] = false
+			return []byte{iac, wont, opt}
+		}
+	case will:
+		if !slices.Contains(supportedRemote, opt) {
+			return []byte{iac, dont, opt}
+		}
+		if !remote[opt] {
+			remote[opt] = true
+			return []byte{iac, do, opt}
+		}
+	case wont:
+		if remote[opt] {
+			remote[opt] = false
+			return []byte{iac, dont, opt}
+		}
+	}
+	return nil
+}
+
+// IsTelnet reports whether data, the first bytes a client sent, starts
+// with Telnet option negotiation
+func IsTelnet(data []byte) bool {
+	return len(data) >= 2 && data[0] == iac && data[1] >= will && data[1] <= dont
+}
+
+// OfferComPort returns the request asking a Telnet server whether it
+// supports the Com Port Control Option
+func OfferComPort() []byte {
+	return []byte{iac, will, optComPort}
+}
+
+// ComPortAnswer looks through data, the first bytes a Telnet server sent,
+// for negotiation of the Com Port Control Option. answered is false if
+// there is none; supported reports whether the server agreed to it.
+func ComPortAnswer(data []byte) (answered, supported bool) {
+	var d decoder
+	d.decode(data, make([]byte, len(data)), func(verb, opt byte) {
+		if opt == optComPort && !answered {
+			answered, supported = true, verb == do || verb == will
+		}
+	}, func(sub []byte) {
+		if len(sub) > 0 && sub[0] == optComPort && !answered {
+			answered, supported = true, true
+		}
+	})
+	return answered, supported
+}
+
+// subcommand builds a Com Port Control subnegotiation
+func subcommand(cmd byte, data ...byte) []byte {
+	out := []byte{iac, sb, optComPort, cmd}
+	out = append(out, Escape(data)...)
+	return append(out, iac, se)
+}
+
+// Escape doubles IAC bytes so data passes a Telnet connection unchanged
+func Escape(b []byte) []byte {
+	out := make([]byte, 0, len(b)+1)
+	for _, ch := range b {
+		out = append(out, ch)
+		if ch == iac {
+			out = append(out, iac)
+		}
+	}
+	return out
+}
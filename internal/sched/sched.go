@@ -0,0 +1,209 @@
+// Package sched schedules client writes toward the upstream so that one
+// busy client cannot starve the others.
+package sched
+
+import (
+	"sync"
+	"time"
+)
+
+// QueueSize is the number of frames a client may have waiting. A client
+// whose queue is full blocks on its next write, which throttles only that
+// client's reader.
+const QueueSize = 64
+
+// Writer delivers one frame queued by a client at the given time
+type Writer func(data []byte, queued time.Time)
+
+// frame is a queued client write
+type frame struct {
+	data   []byte
+	queued time.Time
+}
+
+type queue struct {
+	id      string
+	weight  int
+	write   Writer
+	frames  chan frame
+	removed bool // guarded by Scheduler.mu
+}
+
+// Scheduler drains per-client queues in weighted round-robin order: each
+// round, a client with weight N gets up to N frames written before the
+// next client is served.
+type Scheduler struct {
+	mu     sync.Mutex
+	queues []*queue
+	byID   map[string]*queue
+	notify chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+
+	started bool // guarded by mu
+	stopped bool // guarded by mu
+}
+
+// New returns a scheduler. Writers are called from a single goroutine, so
+// frames reach the upstream one at a time and in per-client order.
+func New() *Scheduler {
+	return &Scheduler{
+		byID:   make(map[string]*queue),
+		notify: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start launches the dispatcher. It does nothing once Stop was called.
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started || s.stopped {
+		return
+	}
+	s.started = true
+	go s.run()
+}
+
+// Stop ends the dispatcher. Frames still queued are discarded and blocked
+// Enqueue calls return false. It returns at once if Start was never called,
+// as when the proxy fails to start.
+func (s *Scheduler) Stop() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		s.mu.Lock()
+		s.stopped = true
+		started := s.started
+		s.mu.Unlock()
+		close(s.stop)
+		if !started {
+			close(s.done)
+		}
+	})
+	<-s.done
+}
+
+// Register adds a queue for the client whose frames are delivered through
+// write. weight below 1 is treated as 1.
+func (s *Scheduler) Register(id string, weight int, write Writer) {
+	if weight < 1 {
+		weight = 1
+	}
+	q := &queue{id: id, weight: weight, write: write, frames: make(chan frame, QueueSize)}
+
+	s.mu.Lock()
+	s.queues = append(s.queues, q)
+	s.byID[id] = q
+	s.mu.Unlock()
+}
+
+// Unregister removes the client's queue once its remaining frames are
+// written
+func (s *Scheduler) Unregister(id string) {
+	s.mu.Lock()
+	if q, ok := s.byID[id]; ok {
+		q.removed = true
+		delete(s.byID, id)
+	}
+	s.mu.Unlock()
+	s.wake()
+}
+
+// Enqueue queues a frame for the client, blocking while its queue is full.
+// It returns false if the client is not registered or the scheduler has
+// stopped.
+func (s *Scheduler) Enqueue(id string, data []byte) bool {
+	s.mu.Lock()
+	q, ok := s.byID[id]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	select {
+	case q.frames <- frame{data: data, queued: time.Now()}:
+		s.wake()
+		return true
+	case <-s.stop:
+		return false
+	}
+}
+
+// Pending returns the number of frames waiting across all clients
+func (s *Scheduler) Pending() int {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, q := range s.queues {
+		n += len(q.frames)
+	}
+	return n
+}
+
+func (s *Scheduler) wake() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) run() {
+	defer close(s.done)
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		if !s.round() {
+			select {
+			case <-s.notify:
+			case <-s.stop:
+				return
+			}
+		}
+	}
+}
+
+// round serves every queue once and reports whether any frame was written
+func (s *Scheduler) round() bool {
+	s.mu.Lock()
+	queues := make([]*queue, 0, len(s.queues))
+	kept := s.queues[:0]
+	for _, q := range s.queues {
+		if q.removed && len(q.frames) == 0 {
+			continue
+		}
+		kept = append(kept, q)
+		queues = append(queues, q)
+	}
+	for i := len(kept); i < len(s.queues); i++ {
+		s.queues[i] = nil
+	}
+	s.queues = kept
+	s.mu.Unlock()
+
+	wrote := false
+	for _, q := range queues {
+	serve:
+		for i := 0; i < q.weight; i++ {
+			select {
+			case f := <-q.frames:
+				q.write(f.data, f.queued)
+				wrote = true
+			default:
+				break serve
+			}
+		}
+	}
+	return wrote
+}
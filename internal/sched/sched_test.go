@@ -0,0 +1,150 @@
+package sched
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	mu    sync.Mutex
+	order []string
+}
+
+func (r *recorder) writer(id string) Writer {
+	return func(data []byte, _ time.Time) {
+		r.mu.Lock()
+		r.order = append(r.order, fmt.Sprintf("%s:%d", id, data[0]))
+		r.mu.Unlock()
+	}
+}
+
+func (r *recorder) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.order...)
+}
+
+func TestScheduler_RoundRobin(t *testing.T) {
+	r := &recorder{}
+	s := New()
+	s.Register("monitor", 1, r.writer("monitor"))
+	s.Register("controller", 1, r.writer("controller"))
+
+	// The monitor floods its queue before the controller sends anything
+	for i := 0; i < 5; i++ {
+		s.Enqueue("monitor", []byte{byte(i)})
+	}
+	s.Enqueue("controller", []byte{0})
+
+	if !s.round() {
+		t.Fatal("Expected the first round to write frames")
+	}
+	got := r.get()
+	expected := []string{"monitor:0", "controller:0"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	if s.Pending() != 4 {
+		t.Errorf("Expected 4 pending frames, got %d", s.Pending())
+	}
+}
+
+func TestScheduler_Weights(t *testing.T) {
+	r := &recorder{}
+	s := New()
+	s.Register("a", 1, r.writer("a"))
+	s.Register("b", 3, r.writer("b"))
+
+	for i := 0; i < 4; i++ {
+		s.Enqueue("a", []byte{byte(i)})
+		s.Enqueue("b", []byte{byte(i)})
+	}
+
+	s.round()
+	got := r.get()
+	expected := []string{"a:0", "b:0", "b:1", "b:2"}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestScheduler_UnregisterDrains(t *testing.T) {
+	r := &recorder{}
+	s := New()
+	s.Start()
+	defer s.Stop()
+
+	s.Register("client#1", 1, r.writer("client#1"))
+	for i := 0; i < 3; i++ {
+		if !s.Enqueue("client#1", []byte{byte(i)}) {
+			t.Fatal("Expected Enqueue to succeed")
+		}
+	}
+	s.Unregister("client#1")
+
+	if s.Enqueue("client#1", []byte{9}) {
+		t.Error("Expected Enqueue to fail after Unregister")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(r.get()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := r.get(); len(got) != 3 {
+		t.Errorf("Expected 3 frames written after Unregister, got %v", got)
+	}
+}
+
+func TestScheduler_StopUnblocksEnqueue(t *testing.T) {
+	// A stuck upstream write holds the dispatcher
+	release := make(chan struct{})
+	s := New()
+	s.Register("client#1", 1, func([]byte, time.Time) { <-release })
+	s.Start()
+
+	result := make(chan bool)
+	go func() {
+		for {
+			if !s.Enqueue("client#1", []byte{0}) {
+				result <- false
+				return
+			}
+		}
+	}()
+
+	// Wait for the queue to fill up behind the blocked write
+	deadline := time.Now().Add(time.Second)
+	for s.Pending() < QueueSize && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	go s.Stop()
+	select {
+	case <-result:
+	case <-time.After(time.Second):
+		t.Fatal("Enqueue still blocked after Stop")
+	}
+	close(release)
+}
+
+func TestScheduler_StopWithoutStart(t *testing.T) {
+	s := New()
+	s.Register("client#1", 1, func([]byte, time.Time) {})
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked on a scheduler that was never started")
+	}
+
+	// Starting after Stop does nothing
+	s.Start()
+	s.Stop()
+}
@@ -0,0 +1,272 @@
+// Package simulator runs a scripted stand-in for a serial-TCP converter, so
+// the proxy can be exercised without hardware.
+package simulator
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/hexutil"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+)
+
+// Rule answers a received frame that starts with Match
+type Rule struct {
+	Name    string `yaml:"name" json:"name"`
+	Match   string `yaml:"match" json:"match"`       // hex prefix, empty matches any frame
+	Respond string `yaml:"respond" json:"respond"`   // hex frame sent back
+	DelayMs int    `yaml:"delay_ms" json:"delay_ms"` // wait before responding
+}
+
+// Periodic is a frame sent to every connection on a fixed interval, like a
+// device broadcasting its state
+type Periodic struct {
+	Data       string `yaml:"data" json:"data"`
+	IntervalMs int    `yaml:"interval_ms" json:"interval_ms"`
+}
+
+// Script describes how the simulated device behaves. Received frames are
+// checked against Rules in order; the first match is answered. Frames no
+// rule matches are echoed back when Echo is set.
+type Script struct {
+	Echo     bool       `yaml:"echo" json:"echo"`
+	Rules    []Rule     `yaml:"rules" json:"rules"`
+	Periodic []Periodic `yaml:"periodic" json:"periodic"`
+}
+
+// EchoScript returns a script that echoes every frame
+func EchoScript() *Script {
+	return &Script{Echo: true}
+}
+
+// LoadScript reads a YAML (or JSON) script file
+func LoadScript(path string) (*Script, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var script Script
+	if err := yaml.Unmarshal(data, &script); err != nil {
+		return nil, fmt.Errorf("failed to parse script: %w", err)
+	}
+	if err := script.Validate(); err != nil {
+		return nil, err
+	}
+	return &script, nil
+}
+
+// Validate checks that the script is well formed
+func (s *Script) Validate() error {
+	for i, r := range s.Rules {
+		if _, err := hexutil.Parse(r.Match); err != nil {
+			return fmt.Errorf("rule %d: invalid match: %w", i, err)
+		}
+		if b, err := hexutil.Parse(r.Respond); err != nil || len(b) == 0 {
+			return fmt.Errorf("rule %d: respond must be non-empty hex", i)
+		}
+		if r.DelayMs < 0 || r.DelayMs > 60000 {
+			return fmt.Errorf("rule %d: delay_ms must be between 0 and 60000", i)
+		}
+	}
+	for i, p := range s.Periodic {
+		if b, err := hexutil.Parse(p.Data); err != nil || len(b) == 0 {
+			return fmt.Errorf("periodic %d: data must be non-empty hex", i)
+		}
+		if p.IntervalMs < 10 {
+			return fmt.Errorf("periodic %d: interval_ms must be at least 10", i)
+		}
+	}
+	return nil
+}
+
+type rule struct {
+	name    string
+	match   []byte
+	respond []byte
+	delay   time.Duration
+}
+
+// Server accepts TCP connections and plays the script on each of them
+type Server struct {
+	addr     string
+	echo     bool
+	rules    []rule
+	periodic []Periodic
+	logger   *logger.Logger
+	listener net.Listener
+	conns    map[net.Conn]*sync.Mutex
+	mu       sync.Mutex
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewServer returns a simulator listening on addr once started. The script
+// must be valid.
+func NewServer(addr string, script *Script, log *logger.Logger) *Server {
+	s := &Server{
+		addr:     addr,
+		echo:     script.Echo,
+		periodic: script.Periodic,
+		logger:   log,
+		conns:    make(map[net.Conn]*sync.Mutex),
+		stop:     make(chan struct{}),
+	}
+	for _, r := range script.Rules {
+		match, _ := hexutil.Parse(r.Match)
+		respond, _ := hexutil.Parse(r.Respond)
+		s.rules = append(s.rules, rule{
+			name:    r.Name,
+			match:   match,
+			respond: respond,
+			delay:   time.Duration(r.DelayMs) * time.Millisecond,
+		})
+	}
+	return s
+}
+
+// Start begins listening
+func (s *Server) Start() error {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	s.listener = ln
+	s.logger.Info("Mock upstream listening on %s (%d rules, echo %v)", ln.Addr(), len(s.rules), s.echo)
+
+	s.wg.Add(1)
+	go s.acceptLoop()
+
+	for _, p := range s.periodic {
+		data, _ := hexutil.Parse(p.Data)
+		s.wg.Add(1)
+		go s.periodicLoop(data, time.Duration(p.IntervalMs)*time.Millisecond)
+	}
+	return nil
+}
+
+// Addr returns the listening address
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Stop closes the listener and all connections
+func (s *Server) Stop() {
+	close(s.stop)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) acceptLoop() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = &sync.Mutex{}
+		s.mu.Unlock()
+		s.logger.Info("Mock upstream: connection from %s", conn.RemoteAddr())
+
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		frame := append([]byte(nil), buf[:n]...)
+		s.logger.LogPacket("->MOCK", frame, conn.RemoteAddr().String())
+
+		if r := s.match(frame); r != nil {
+			if r.delay > 0 {
+				select {
+				case <-time.After(r.delay):
+				case <-s.stop:
+					return
+				}
+			}
+			s.send(conn, r.respond)
+		} else if s.echo {
+			s.send(conn, frame)
+		}
+	}
+}
+
+func (s *Server) match(frame []byte) *rule {
+	for i := range s.rules {
+		if bytes.HasPrefix(frame, s.rules[i].match) {
+			return &s.rules[i]
+		}
+	}
+	return nil
+}
+
+// send writes one frame, serialized with periodic frames on the same
+// connection
+func (s *Server) send(conn net.Conn, data []byte) {
+	s.mu.Lock()
+	writeMu := s.conns[conn]
+	s.mu.Unlock()
+	if writeMu == nil {
+		return
+	}
+
+	writeMu.Lock()
+	_, err := conn.Write(data)
+	writeMu.Unlock()
+	if err == nil {
+		s.logger.LogPacket("MOCK->", data, conn.RemoteAddr().String())
+	}
+}
+
+func (s *Server) periodicLoop(data []byte, interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		conns := make([]net.Conn, 0, len(s.conns))
+		for conn := range s.conns {
+			conns = append(conns, conn)
+		}
+		s.mu.Unlock()
+
+		for _, conn := range conns {
+			s.send(conn, data)
+		}
+	}
+}
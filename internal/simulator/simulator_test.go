@@ -0,0 +1,120 @@
+package simulator
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+)
+
+func newTestLogger() *logger.Logger {
+	log, _ := logger.New(false, "")
+	log.SetOutput(io.Discard)
+	return log
+}
+
+func startServer(t *testing.T, script *Script) (*Server, net.Conn) {
+	t.Helper()
+	s := NewServer("127.0.0.1:0", script, newTestLogger())
+	if err := s.Start(); err != nil {
+		t.Fatalf("Failed to start simulator: %v", err)
+	}
+	t.Cleanup(s.Stop)
+
+	conn, err := net.DialTimeout("tcp", s.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return s, conn
+}
+
+func readFrame(t *testing.T, conn net.Conn) []byte {
+	t.Helper()
+	buf := make([]byte, 64)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	return buf[:n]
+}
+
+func TestLoadScript(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "responses.yaml")
+	content := `echo: true
+rules:
+  - name: read-temp
+    match: "01 03"
+    respond: "01 03 02 00 e1"
+    delay_ms: 20
+periodic:
+  - data: "f7 0e"
+    interval_ms: 1000
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	script, err := LoadScript(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !script.Echo || len(script.Rules) != 1 || len(script.Periodic) != 1 {
+		t.Errorf("Unexpected script: %+v", script)
+	}
+	if script.Rules[0].DelayMs != 20 {
+		t.Errorf("Expected delay_ms 20, got %d", script.Rules[0].DelayMs)
+	}
+
+	if err := os.WriteFile(path, []byte("rules:\n  - match: zz\n    respond: 01\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadScript(path); err == nil {
+		t.Error("Expected error for invalid match")
+	}
+}
+
+func TestServer_Rules(t *testing.T) {
+	_, conn := startServer(t, &Script{
+		Rules: []Rule{
+			{Match: "01 03", Respond: "01 03 02 00 e1"},
+			{Match: "", Respond: "ee"},
+		},
+	})
+
+	_, _ = conn.Write([]byte{0x01, 0x03, 0x00, 0x10})
+	if got := readFrame(t, conn); !bytes.Equal(got, []byte{0x01, 0x03, 0x02, 0x00, 0xe1}) {
+		t.Errorf("Expected 01030200e1, got %x", got)
+	}
+
+	// The empty match is a catch-all
+	_, _ = conn.Write([]byte{0x05})
+	if got := readFrame(t, conn); !bytes.Equal(got, []byte{0xee}) {
+		t.Errorf("Expected ee, got %x", got)
+	}
+}
+
+func TestServer_Echo(t *testing.T) {
+	_, conn := startServer(t, EchoScript())
+
+	_, _ = conn.Write([]byte{0xaa, 0xbb})
+	if got := readFrame(t, conn); !bytes.Equal(got, []byte{0xaa, 0xbb}) {
+		t.Errorf("Expected aabb, got %x", got)
+	}
+}
+
+func TestServer_Periodic(t *testing.T) {
+	_, conn := startServer(t, &Script{
+		Periodic: []Periodic{{Data: "f7 0e", IntervalMs: 20}},
+	})
+
+	if got := readFrame(t, conn); !bytes.HasPrefix(got, []byte{0xf7, 0x0e}) {
+		t.Errorf("Expected periodic frame f70e, got %x", got)
+	}
+}
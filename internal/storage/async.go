@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/metrics"
+)
+
+// DefaultQueue is how many writes Async holds for its worker
+const DefaultQueue = 4096
+
+// Kinds of queued writes, as counted in QueueStats
+const (
+	WriteLogs    = "logs"
+	WriteEvents  = "events"
+	WriteSamples = "samples"
+)
+
+// QueueStats report the writes an Async backend holds and those it left out
+type QueueStats struct {
+	Pending int               // writes waiting for the worker
+	Dropped map[string]uint64 // by kind, because the queue was full
+	Failed  uint64            // writes the backend returned an error for
+}
+
+type asyncOp struct {
+	kind    string
+	write   func(Storage) error
+	flushed chan struct{} // set for a flush marker instead of a write
+}
+
+// Async hands the log lines, events and traffic samples added to a slow
+// backend such as SQLite to a worker goroutine, so that the logger and the
+// forwarding path never wait for the disk. When the queue is full, writes
+// are dropped and counted. Reads and sessions go to the backend directly;
+// reads first wait for the writes queued before them.
+type Async struct {
+	Storage
+
+	ops     chan asyncOp
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+	failed  atomic.Uint64
+	dropped map[string]*atomic.Uint64
+}
+
+// NewAsync starts a worker writing to st through a queue of queue writes
+func NewAsync(st Storage, queue int) *Async {
+	a := &Async{
+		Storage: st,
+		ops:     make(chan asyncOp, queue),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		dropped: map[string]*atomic.Uint64{
+			WriteLogs:    new(atomic.Uint64),
+			WriteEvents:  new(atomic.Uint64),
+			WriteSamples: new(atomic.Uint64),
+		},
+	}
+	go a.run()
+	return a
+}
+
+// run writes queued operations until Close, then drains the queue
+func (a *Async) run() {
+	defer close(a.stopped)
+	for {
+		select {
+		case op := <-a.ops:
+			a.do(op)
+		case <-a.done:
+			for {
+				select {
+				case op := <-a.ops:
+					a.do(op)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *Async) do(op asyncOp) {
+	if op.flushed != nil {
+		close(op.flushed)
+		return
+	}
+	if err := op.write(a.Storage); err != nil {
+		a.failed.Add(1)
+	}
+}
+
+// enqueue queues a write, dropping it if the queue is full or the worker
+// has stopped. It never blocks.
+func (a *Async) enqueue(kind string, write func(Storage) error) error {
+	select {
+	case <-a.done:
+		a.dropped[kind].Add(1)
+		return nil
+	default:
+	}
+	select {
+	case a.ops <- asyncOp{kind: kind, write: write}:
+	default:
+		a.dropped[kind].Add(1)
+	}
+	return nil
+}
+
+// Flush waits until every write queued so far has been done
+func (a *Async) Flush() {
+	op := asyncOp{flushed: make(chan struct{})}
+	select {
+	case a.ops <- op:
+	case <-a.stopped:
+		return
+	}
+	select {
+	case <-op.flushed:
+	case <-a.stopped:
+	}
+}
+
+// Stats returns the queue length and the writes dropped or failed so far
+func (a *Async) Stats() QueueStats {
+	st := QueueStats{Pending: len(a.ops), Dropped: make(map[string]uint64), Failed: a.failed.Load()}
+	for kind, n := range a.dropped {
+		st.Dropped[kind] = n.Load()
+	}
+	return st
+}
+
+// AddLog queues e. Its Data is not kept, so the caller may reuse it.
+func (a *Async) AddLog(e logger.Entry) error {
+	e.Data = nil
+	return a.enqueue(WriteLogs, func(st Storage) error { return st.AddLog(e) })
+}
+
+// AddEvent queues e
+func (a *Async) AddEvent(e Event) error {
+	return a.enqueue(WriteEvents, func(st Storage) error { return st.AddEvent(e) })
+}
+
+// AddSample queues s
+func (a *Async) AddSample(s metrics.Sample) error {
+	return a.enqueue(WriteSamples, func(st Storage) error { return st.AddSample(s) })
+}
+
+// Logs returns the kept lines, including those queued before the call
+func (a *Async) Logs() ([]logger.Entry, error) {
+	a.Flush()
+	return a.Storage.Logs()
+}
+
+// LogStats counts the kept lines, including those queued before the call
+func (a *Async) LogStats() (LogStats, error) {
+	a.Flush()
+	return a.Storage.LogStats()
+}
+
+// Events returns the kept events, including those queued before the call
+func (a *Async) Events(eventType string) ([]Event, error) {
+	a.Flush()
+	return a.Storage.Events(eventType)
+}
+
+// SampleSince returns the oldest sample taken at or after t, including
+// those queued before the call
+func (a *Async) SampleSince(t time.Time) (metrics.Sample, bool, error) {
+	a.Flush()
+	return a.Storage.SampleSince(t)
+}
+
+// Prune removes lines and events recorded before t, after the queued writes
+func (a *Async) Prune(t time.Time) error {
+	a.Flush()
+	return a.Storage.Prune(t)
+}
+
+// Close writes what is queued and closes the backend
+func (a *Async) Close() error {
+	a.once.Do(func() { close(a.done) })
+	<-a.stopped
+	return a.Storage.Close()
+}
@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/metrics"
+)
+
+// Memory keeps everything in memory; it is lost on restart
+type Memory struct {
+	limits Limits
+
+	logMu    sync.Mutex
+	logs     []logger.Entry // non-packet lines
+	packets  []logger.Entry
+	logBytes int // approximate size of both
+
+	eventMu sync.Mutex
+	events  []Event
+
+	samples *metrics.History
+
+	sessionMu sync.RWMutex
+	sessions  map[string]Session
+}
+
+// NewMemory returns an empty in-memory store
+func NewMemory(limits Limits) *Memory {
+	limits = limits.withDefaults()
+	return &Memory{
+		limits:   limits,
+		samples:  metrics.NewHistory(limits.SampleSpan),
+		sessions: make(map[string]Session),
+	}
+}
+
+// entryOverhead is the fixed size of a logger.Entry on 64-bit platforms
+const entryOverhead = 168
+
+// entrySize approximates the memory held by a kept entry
+func entrySize(e logger.Entry) int {
+	n := entryOverhead + len(e.Line) + len(e.Message)
+	for k, v := range e.Fields {
+		n += len(k) + len(v) + 32 // map entry overhead
+	}
+	return n
+}
+
+// AddLog adds e to the log or packet lines and drops the oldest lines
+// beyond the limits
+func (m *Memory) AddLog(e logger.Entry) error {
+	e.Data = nil
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+	if e.Level == logger.LogPkt {
+		m.packets = append(m.packets, e)
+		for len(m.packets) > m.limits.PacketLines {
+			m.logBytes -= entrySize(m.packets[0])
+			m.packets = m.packets[1:]
+		}
+	} else {
+		m.logs = append(m.logs, e)
+		for len(m.logs) > m.limits.LogLines {
+			m.logBytes -= entrySize(m.logs[0])
+			m.logs = m.logs[1:]
+		}
+	}
+	m.logBytes += entrySize(e)
+	m.pruneLogs(e.Time)
+	return nil
+}
+
+// pruneLogs drops lines logged more than LogMaxAge before now. Called with
+// logMu held.
+func (m *Memory) pruneLogs(now time.Time) {
+	if m.limits.LogMaxAge <= 0 {
+		return
+	}
+	cutoff := now.Add(-m.limits.LogMaxAge)
+	for len(m.logs) > 0 && m.logs[0].Time.Before(cutoff) {
+		m.logBytes -= entrySize(m.logs[0])
+		m.logs = m.logs[1:]
+	}
+	for len(m.packets) > 0 && m.packets[0].Time.Before(cutoff) {
+		m.logBytes -= entrySize(m.packets[0])
+		m.packets = m.packets[1:]
+	}
+}
+
+// Logs returns the log and packet lines in time order
+func (m *Memory) Logs() ([]logger.Entry, error) {
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+	m.pruneLogs(time.Now())
+
+	merged := make([]logger.Entry, 0, len(m.logs)+len(m.packets))
+	logs, packets := m.logs, m.packets
+	for len(logs) > 0 && len(packets) > 0 {
+		if packets[0].Time.Before(logs[0].Time) {
+			merged = append(merged, packets[0])
+			packets = packets[1:]
+		} else {
+			merged = append(merged, logs[0])
+			logs = logs[1:]
+		}
+	}
+	merged = append(merged, logs...)
+	return append(merged, packets...), nil
+}
+
+// LogStats returns how many lines are kept
+func (m *Memory) LogStats() (LogStats, error) {
+	m.logMu.Lock()
+	defer m.logMu.Unlock()
+	return LogStats{Lines: len(m.logs), Packets: len(m.packets), Bytes: m.logBytes}, nil
+}
+
+// AddEvent keeps e, dropping the oldest event beyond the limit
+func (m *Memory) AddEvent(e Event) error {
+	m.eventMu.Lock()
+	defer m.eventMu.Unlock()
+	if len(m.events) >= m.limits.Events {
+		m.events = append(m.events[:0], m.events[len(m.events)-m.limits.Events+1:]...)
+	}
+	m.events = append(m.events, e)
+	return nil
+}
+
+// Prune drops lines and events older than t
+func (m *Memory) Prune(t time.Time) error {
+	m.logMu.Lock()
+	for len(m.logs) > 0 && m.logs[0].Time.Before(t) {
+		m.logBytes -= entrySize(m.logs[0])
+		m.logs = m.logs[1:]
+	}
+	for len(m.packets) > 0 && m.packets[0].Time.Before(t) {
+		m.logBytes -= entrySize(m.packets[0])
+		m.packets = m.packets[1:]
+	}
+	m.logMu.Unlock()
+
+	m.eventMu.Lock()
+	defer m.eventMu.Unlock()
+	kept := m.events[:0]
+	for _, e := range m.events {
+		if !e.Time.Before(t) {
+			kept = append(kept, e)
+		}
+	}
+	m.events = kept
+	return nil
+}
+
+// Events returns the kept events of eventType, or all if it is empty
+func (m *Memory) Events(eventType string) ([]Event, error) {
+	m.eventMu.Lock()
+	defer m.eventMu.Unlock()
+	events := make([]Event, 0, len(m.events))
+	for _, e := range m.events {
+		if eventType == "" || e.Type == eventType {
+			events = append(events, e)
+		}
+	}
+	return events, nil
+}
+
+// AddSample keeps s for SampleSpan
+func (m *Memory) AddSample(s metrics.Sample) error {
+	m.samples.Add(s.At, s.Snapshot)
+	return nil
+}
+
+// SampleSince returns the oldest sample taken at or after t
+func (m *Memory) SampleSince(t time.Time) (metrics.Sample, bool, error) {
+	s, ok := m.samples.Since(t)
+	return s, ok, nil
+}
+
+// PutSession adds or replaces a session
+func (m *Memory) PutSession(s Session) error {
+	m.sessionMu.Lock()
+	m.sessions[s.Token] = s
+	m.sessionMu.Unlock()
+	return nil
+}
+
+// Session returns the session with token
+func (m *Memory) Session(token string) (Session, bool, error) {
+	m.sessionMu.RLock()
+	s, ok := m.sessions[token]
+	m.sessionMu.RUnlock()
+	return s, ok, nil
+}
+
+// TouchSession records activity on an existing session
+func (m *Memory) TouchSession(token string, lastSeen, expires time.Time) error {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+	if s, ok := m.sessions[token]; ok {
+		s.LastSeen, s.ExpiresAt = lastSeen, expires
+		m.sessions[token] = s
+	}
+	return nil
+}
+
+// Sessions returns all sessions, oldest first
+func (m *Memory) Sessions() ([]Session, error) {
+	m.sessionMu.RLock()
+	sessions := make([]Session, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.sessionMu.RUnlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.Before(sessions[j].CreatedAt) })
+	return sessions, nil
+}
+
+// DeleteSession removes a session
+func (m *Memory) DeleteSession(token string) error {
+	m.sessionMu.Lock()
+	delete(m.sessions, token)
+	m.sessionMu.Unlock()
+	return nil
+}
+
+// DeleteExpiredSessions removes sessions expired at now
+func (m *Memory) DeleteExpiredSessions(now time.Time) error {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+	for token, s := range m.sessions {
+		if now.After(s.ExpiresAt) {
+			delete(m.sessions, token)
+		}
+	}
+	return nil
+}
+
+// Close does nothing
+func (m *Memory) Close() error {
+	return nil
+}
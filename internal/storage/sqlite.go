@@ -0,0 +1,377 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/metrics"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+// pruneEvery is how many log lines are added between deletions of lines
+// beyond the limits. Logs and LogStats prune first, so the extra lines are
+// never returned.
+const pruneEvery = 128
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS logs (
+	id          INTEGER PRIMARY KEY,
+	time        INTEGER NOT NULL,
+	packet      INTEGER NOT NULL,
+	level       TEXT NOT NULL,
+	subsystem   TEXT NOT NULL,
+	message     TEXT NOT NULL,
+	fields      TEXT,
+	line        TEXT NOT NULL,
+	direction   TEXT NOT NULL,
+	source      TEXT NOT NULL,
+	seq         INTEGER NOT NULL,
+	byte_offset INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS logs_packet ON logs (packet, id);
+CREATE INDEX IF NOT EXISTS logs_time ON logs (time);
+CREATE TABLE IF NOT EXISTS events (
+	id   INTEGER PRIMARY KEY,
+	time INTEGER NOT NULL,
+	type TEXT NOT NULL,
+	data TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS samples (
+	id   INTEGER PRIMARY KEY,
+	time INTEGER NOT NULL,
+	data TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS samples_time ON samples (time);
+CREATE TABLE IF NOT EXISTS sessions (
+	token       TEXT PRIMARY KEY,
+	created     INTEGER NOT NULL,
+	expires     INTEGER NOT NULL,
+	last_seen   INTEGER NOT NULL DEFAULT 0,
+	remote_addr TEXT NOT NULL DEFAULT '',
+	user_agent  TEXT NOT NULL DEFAULT ''
+);
+`
+
+// sqliteColumns are columns added after their table was first created, so
+// databases from older versions get them on open
+var sqliteColumns = []struct{ table, column, definition string }{
+	{"sessions", "last_seen", "INTEGER NOT NULL DEFAULT 0"},
+	{"sessions", "remote_addr", "TEXT NOT NULL DEFAULT ''"},
+	{"sessions", "user_agent", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// addColumns adds the sqliteColumns a database does not have yet
+func addColumns(db *sql.DB) error {
+	for _, c := range sqliteColumns {
+		var n int
+		err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, c.table, c.column).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, c.table, c.column, c.definition)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SQLite keeps everything in a SQLite database, so log lines, events and
+// sessions survive a restart. Traffic samples are cleared on open, as the
+// counters they are compared with start again from zero.
+type SQLite struct {
+	db     *sql.DB
+	limits Limits
+	added  atomic.Uint64 // log lines added, for pruneEvery
+}
+
+// OpenSQLite opens or creates the database at path
+func OpenSQLite(path string, limits Limits) (*SQLite, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("create storage directory: %w", err)
+		}
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// One connection serializes writers, which SQLite would otherwise make
+	// wait for each other's locks
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open storage %s: %w", path, err)
+	}
+	if err := addColumns(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open storage %s: %w", path, err)
+	}
+	if _, err := db.Exec(`DELETE FROM samples`); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open storage %s: %w", path, err)
+	}
+	return &SQLite{db: db, limits: limits.withDefaults()}, nil
+}
+
+// AddLog inserts e, deleting lines beyond the limits every pruneEvery lines
+func (s *SQLite) AddLog(e logger.Entry) error {
+	var fields []byte
+	if len(e.Fields) > 0 {
+		fields, _ = json.Marshal(e.Fields)
+	}
+	_, err := s.db.Exec(`INSERT INTO logs (time, packet, level, subsystem, message, fields, line, direction, source, seq, byte_offset)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Time.UnixNano(), e.Level == logger.LogPkt, string(e.Level), e.Subsystem, e.Message, fields,
+		e.Line, e.Direction, e.Source, int64(e.Seq), int64(e.Offset))
+	if err != nil {
+		return err
+	}
+	if s.added.Add(1)%pruneEvery == 0 {
+		return s.pruneLogs(e.Time)
+	}
+	return nil
+}
+
+// pruneLogs deletes the oldest lines beyond the limits and lines logged
+// more than LogMaxAge before now
+func (s *SQLite) pruneLogs(now time.Time) error {
+	for packet, limit := range map[bool]int{false: s.limits.LogLines, true: s.limits.PacketLines} {
+		_, err := s.db.Exec(`DELETE FROM logs WHERE packet = ? AND id <= (
+			SELECT id FROM logs WHERE packet = ? ORDER BY id DESC LIMIT 1 OFFSET ?)`,
+			packet, packet, limit)
+		if err != nil {
+			return err
+		}
+	}
+	if s.limits.LogMaxAge > 0 {
+		if _, err := s.db.Exec(`DELETE FROM logs WHERE time < ?`, now.Add(-s.limits.LogMaxAge).UnixNano()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Logs returns the log and packet lines in time order
+func (s *SQLite) Logs() ([]logger.Entry, error) {
+	if err := s.pruneLogs(time.Now()); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT time, level, subsystem, message, fields, line, direction, source, seq, byte_offset
+		FROM logs ORDER BY time, packet, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []logger.Entry
+	for rows.Next() {
+		var e logger.Entry
+		var at, seq, offset int64
+		var level string
+		var fields []byte
+		if err := rows.Scan(&at, &level, &e.Subsystem, &e.Message, &fields, &e.Line, &e.Direction, &e.Source, &seq, &offset); err != nil {
+			return nil, err
+		}
+		e.Time, e.Level = time.Unix(0, at), logger.LogLevel(level)
+		e.Seq, e.Offset = uint64(seq), uint64(offset)
+		if len(fields) > 0 {
+			if err := json.Unmarshal(fields, &e.Fields); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// LogStats returns how many lines are kept
+func (s *SQLite) LogStats() (LogStats, error) {
+	var st LogStats
+	if err := s.pruneLogs(time.Now()); err != nil {
+		return st, err
+	}
+	var bytes sql.NullInt64
+	err := s.db.QueryRow(`SELECT
+		COUNT(*) FILTER (WHERE packet = 0),
+		COUNT(*) FILTER (WHERE packet = 1),
+		SUM(LENGTH(line) + LENGTH(message) + IFNULL(LENGTH(fields), 0))
+		FROM logs`).Scan(&st.Lines, &st.Packets, &bytes)
+	st.Bytes = int(bytes.Int64)
+	return st, err
+}
+
+// AddEvent inserts e and deletes the oldest events beyond the limit
+func (s *SQLite) AddEvent(e Event) error {
+	if _, err := s.db.Exec(`INSERT INTO events (time, type, data) VALUES (?, ?, ?)`,
+		e.Time.UnixNano(), e.Type, string(e.Data)); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`DELETE FROM events WHERE id <= (
+		SELECT id FROM events ORDER BY id DESC LIMIT 1 OFFSET ?)`, s.limits.Events)
+	return err
+}
+
+// Events returns the kept events of eventType, or all if it is empty
+func (s *SQLite) Events(eventType string) ([]Event, error) {
+	rows, err := s.db.Query(`SELECT time, type, data FROM events
+		WHERE ? = '' OR type = ? ORDER BY id`, eventType, eventType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []Event{}
+	for rows.Next() {
+		var e Event
+		var at int64
+		var data string
+		if err := rows.Scan(&at, &e.Type, &data); err != nil {
+			return nil, err
+		}
+		e.Time, e.Data = time.Unix(0, at), []byte(data)
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// Prune deletes lines and events older than t. The freed pages are reused
+// by later inserts rather than returned to the file system.
+func (s *SQLite) Prune(t time.Time) error {
+	if _, err := s.db.Exec(`DELETE FROM logs WHERE time < ?`, t.UnixNano()); err != nil {
+		return err
+	}
+	_, err := s.db.Exec(`DELETE FROM events WHERE time < ?`, t.UnixNano())
+	return err
+}
+
+// AddSample inserts a sample and deletes those older than SampleSpan,
+// keeping at least one
+func (s *SQLite) AddSample(sample metrics.Sample) error {
+	data, err := json.Marshal(sample.Snapshot)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`INSERT INTO samples (time, data) VALUES (?, ?)`,
+		sample.At.UnixNano(), string(data)); err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`DELETE FROM samples WHERE time < ? AND id < (SELECT MAX(id) FROM samples)`,
+		sample.At.Add(-s.limits.SampleSpan).UnixNano())
+	return err
+}
+
+// SampleSince returns the oldest sample taken at or after t
+func (s *SQLite) SampleSince(t time.Time) (metrics.Sample, bool, error) {
+	var at int64
+	var data string
+	err := s.db.QueryRow(`SELECT time, data FROM samples WHERE time >= ? ORDER BY time, id LIMIT 1`,
+		t.UnixNano()).Scan(&at, &data)
+	if err == sql.ErrNoRows {
+		return metrics.Sample{}, false, nil
+	}
+	if err != nil {
+		return metrics.Sample{}, false, err
+	}
+	sample := metrics.Sample{At: time.Unix(0, at)}
+	if err := json.Unmarshal([]byte(data), &sample.Snapshot); err != nil {
+		return metrics.Sample{}, false, err
+	}
+	return sample, true, nil
+}
+
+// PutSession adds or replaces a session
+func (s *SQLite) PutSession(session Session) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO sessions (token, created, expires, last_seen, remote_addr, user_agent)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		session.Token, session.CreatedAt.UnixNano(), session.ExpiresAt.UnixNano(), unixNano(session.LastSeen),
+		session.RemoteAddr, session.UserAgent)
+	return err
+}
+
+// sessionColumns are selected by Session and Sessions, in scanSession order
+const sessionColumns = `token, created, expires, last_seen, remote_addr, user_agent`
+
+func scanSession(row interface{ Scan(...any) error }) (Session, error) {
+	var session Session
+	var created, expires, lastSeen int64
+	if err := row.Scan(&session.Token, &created, &expires, &lastSeen, &session.RemoteAddr, &session.UserAgent); err != nil {
+		return Session{}, err
+	}
+	session.CreatedAt, session.ExpiresAt = time.Unix(0, created), time.Unix(0, expires)
+	if lastSeen != 0 {
+		session.LastSeen = time.Unix(0, lastSeen)
+	}
+	return session, nil
+}
+
+// unixNano returns t in nanoseconds, or 0 for the zero time
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// Session returns the session with token
+func (s *SQLite) Session(token string) (Session, bool, error) {
+	session, err := scanSession(s.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE token = ?`, token))
+	if err == sql.ErrNoRows {
+		return Session{}, false, nil
+	}
+	if err != nil {
+		return Session{}, false, err
+	}
+	return session, true, nil
+}
+
+// TouchSession records activity on an existing session
+func (s *SQLite) TouchSession(token string, lastSeen, expires time.Time) error {
+	_, err := s.db.Exec(`UPDATE sessions SET last_seen = ?, expires = ? WHERE token = ?`,
+		lastSeen.UnixNano(), expires.UnixNano(), token)
+	return err
+}
+
+// Sessions returns all sessions, oldest first
+func (s *SQLite) Sessions() ([]Session, error) {
+	rows, err := s.db.Query(`SELECT ` + sessionColumns + ` FROM sessions ORDER BY created`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var sessions []Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteSession removes a session
+func (s *SQLite) DeleteSession(token string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE token = ?`, token)
+	return err
+}
+
+// DeleteExpiredSessions removes sessions expired at now
+func (s *SQLite) DeleteExpiredSessions(now time.Time) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE expires < ?`, now.UnixNano())
+	return err
+}
+
+// Close closes the database
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
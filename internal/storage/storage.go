@@ -0,0 +1,137 @@
+// Package storage keeps the data the proxy and web API serve after the
+// fact: recent log and packet lines, client and upstream events, traffic
+// samples and login sessions. Backends are selected with STORAGE_BACKEND.
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/metrics"
+)
+
+// Retention defaults for limits that are not set
+const (
+	DefaultLogLines   = 1000 // each of log and packet lines
+	DefaultEvents     = 200
+	DefaultSampleSpan = 15 * time.Minute
+)
+
+// Storage is implemented by every backend. It is safe for concurrent use.
+type Storage interface {
+	// AddLog keeps a log or packet line. e.Data is not kept.
+	AddLog(e logger.Entry) error
+	// Logs returns the kept log and packet lines in time order
+	Logs() ([]logger.Entry, error)
+	// LogStats returns how many lines are kept
+	LogStats() (LogStats, error)
+
+	// AddEvent keeps an event with its JSON encoding
+	AddEvent(e Event) error
+	// Events returns the kept events, oldest first, limited to eventType
+	// unless it is empty
+	Events(eventType string) ([]Event, error)
+
+	// AddSample keeps a snapshot of the traffic counters
+	AddSample(s metrics.Sample) error
+	// SampleSince returns the oldest sample taken at or after t
+	SampleSince(t time.Time) (metrics.Sample, bool, error)
+
+	// PutSession adds or replaces a login session
+	PutSession(s Session) error
+	// Session returns the session with token
+	Session(token string) (Session, bool, error)
+	// TouchSession records activity on an existing session, leaving a
+	// deleted one deleted
+	TouchSession(token string, lastSeen, expires time.Time) error
+	// Sessions returns all sessions, oldest first
+	Sessions() ([]Session, error)
+	// DeleteSession removes a session
+	DeleteSession(token string) error
+	// DeleteExpiredSessions removes sessions expired at now
+	DeleteExpiredSessions(now time.Time) error
+
+	// Prune removes log and packet lines and events recorded before t,
+	// for RETENTION_MAX_AGE_DAYS
+	Prune(t time.Time) error
+
+	Close() error
+}
+
+// Limits bound what a backend keeps
+type Limits struct {
+	LogLines    int           // log lines, WEB_LOG_BUFFER
+	PacketLines int           // packet lines, WEB_PACKET_BUFFER
+	LogMaxAge   time.Duration // WEB_LOG_MAX_AGE, 0 keeps lines until the limits
+	Events      int
+	SampleSpan  time.Duration // how far back traffic samples are kept
+}
+
+// LogStats reports the kept log and packet lines
+type LogStats struct {
+	Lines   int
+	Packets int
+	Bytes   int // approximate size of the kept lines
+}
+
+// Event is a client or upstream event
+type Event struct {
+	Type string
+	Time time.Time
+	Data []byte // JSON
+}
+
+// Session is a web UI login
+type Session struct {
+	Token      string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time // end of the session, moved by activity with an idle timeout
+	LastSeen   time.Time // last request using the session
+	RemoteAddr string    // where the login came from
+	UserAgent  string
+}
+
+// LimitsFor returns the limits configured in cfg
+func LimitsFor(cfg *config.Config) Limits {
+	return Limits{
+		LogLines:    cfg.WebLogLines,
+		PacketLines: cfg.WebPacketLines,
+		LogMaxAge:   time.Duration(cfg.WebLogMaxAge) * time.Second,
+	}.withDefaults()
+}
+
+// withDefaults fills in unset limits
+func (l Limits) withDefaults() Limits {
+	if l.LogLines <= 0 {
+		l.LogLines = DefaultLogLines
+	}
+	if l.PacketLines <= 0 {
+		l.PacketLines = DefaultLogLines
+	}
+	if l.Events <= 0 {
+		l.Events = DefaultEvents
+	}
+	if l.SampleSpan <= 0 {
+		l.SampleSpan = DefaultSampleSpan
+	}
+	return l
+}
+
+// Open returns the backend selected by STORAGE_BACKEND. SQLite writes go
+// through an Async queue, as they wait for the disk.
+func Open(cfg *config.Config) (Storage, error) {
+	switch cfg.StorageBackend {
+	case "", config.StorageMemory:
+		return NewMemory(LimitsFor(cfg)), nil
+	case config.StorageSQLite:
+		db, err := OpenSQLite(cfg.StoragePath, LimitsFor(cfg))
+		if err != nil {
+			return nil, err
+		}
+		return NewAsync(db, DefaultQueue), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+}
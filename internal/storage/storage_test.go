@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/metrics"
+)
+
+// backends returns a fresh store of every backend with limits
+func backends(t *testing.T, limits Limits) map[string]Storage {
+	t.Helper()
+	db, err := OpenSQLite(filepath.Join(t.TempDir(), "storage.db"), limits)
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	queued, err := OpenSQLite(filepath.Join(t.TempDir(), "queued.db"), limits)
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	async := NewAsync(queued, DefaultQueue)
+	t.Cleanup(func() { async.Close() })
+	return map[string]Storage{"memory": NewMemory(limits), "sqlite": db, "sqlite-async": async}
+}
+
+func TestStorage_Logs(t *testing.T) {
+	base := time.Now().Add(-time.Minute)
+	for name, st := range backends(t, Limits{LogLines: 3, PacketLines: 2}) {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 5; i++ {
+				at := base.Add(time.Duration(i) * time.Second)
+				_ = st.AddLog(logger.Entry{Time: at, Level: logger.LogInfo, Line: fmt.Sprintf("info %d", i), Fields: map[string]string{"n": fmt.Sprint(i)}})
+				_ = st.AddLog(logger.Entry{Time: at, Level: logger.LogPkt, Line: fmt.Sprintf("pkt %d", i), Direction: "UP->", Seq: uint64(i + 1), Data: []byte{1}})
+			}
+
+			entries, err := st.Logs()
+			if err != nil {
+				t.Fatalf("Logs: %v", err)
+			}
+			var lines []string
+			for _, e := range entries {
+				lines = append(lines, e.Line)
+			}
+			if got, want := fmt.Sprint(lines), "[info 2 info 3 pkt 3 info 4 pkt 4]"; got != want {
+				t.Errorf("Expected %s, got %s", want, got)
+			}
+			last := entries[len(entries)-1]
+			if last.Level != logger.LogPkt || last.Direction != "UP->" || last.Seq != 5 || last.Data != nil || !last.Time.Equal(base.Add(4*time.Second)) {
+				t.Errorf("Unexpected packet entry %+v", last)
+			}
+			if entries[0].Fields["n"] != "2" {
+				t.Errorf("Expected fields kept, got %v", entries[0].Fields)
+			}
+
+			stats, err := st.LogStats()
+			if err != nil || stats.Lines != 3 || stats.Packets != 2 || stats.Bytes <= 0 {
+				t.Errorf("Unexpected stats %+v, %v", stats, err)
+			}
+		})
+	}
+}
+
+func TestStorage_LogMaxAge(t *testing.T) {
+	now := time.Now()
+	for name, st := range backends(t, Limits{LogMaxAge: time.Minute}) {
+		t.Run(name, func(t *testing.T) {
+			_ = st.AddLog(logger.Entry{Time: now.Add(-2 * time.Minute), Level: logger.LogInfo, Line: "old"})
+			_ = st.AddLog(logger.Entry{Time: now, Level: logger.LogInfo, Line: "new"})
+			if entries, _ := st.Logs(); len(entries) != 1 || entries[0].Line != "new" {
+				t.Errorf("Expected only the new line, got %+v", entries)
+			}
+		})
+	}
+}
+
+func TestStorage_Events(t *testing.T) {
+	at := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, st := range backends(t, Limits{Events: 3}) {
+		t.Run(name, func(t *testing.T) {
+			for i, typ := range []string{"a", "b", "a", "b", "a"} {
+				_ = st.AddEvent(Event{Type: typ, Time: at, Data: []byte(fmt.Sprintf(`{"n":%d}`, i))})
+			}
+			all, err := st.Events("")
+			if err != nil || len(all) != 3 || string(all[0].Data) != `{"n":2}` || !all[0].Time.Equal(at) {
+				t.Errorf("Expected the last 3 events, got %+v, %v", all, err)
+			}
+			if b, _ := st.Events("b"); len(b) != 1 || string(b[0].Data) != `{"n":3}` {
+				t.Errorf("Expected one b event, got %+v", b)
+			}
+		})
+	}
+}
+
+func TestStorage_Prune(t *testing.T) {
+	now := time.Now()
+	for name, st := range backends(t, Limits{}) {
+		t.Run(name, func(t *testing.T) {
+			for _, at := range []time.Time{now.Add(-2 * time.Hour), now} {
+				_ = st.AddLog(logger.Entry{Time: at, Level: logger.LogInfo, Line: "info"})
+				_ = st.AddLog(logger.Entry{Time: at, Level: logger.LogPkt, Line: "pkt"})
+				_ = st.AddEvent(Event{Type: "a", Time: at, Data: []byte(`{}`)})
+			}
+			if err := st.Prune(now.Add(-time.Hour)); err != nil {
+				t.Fatalf("Prune: %v", err)
+			}
+			if entries, _ := st.Logs(); len(entries) != 2 {
+				t.Errorf("Expected 2 lines kept, got %+v", entries)
+			}
+			if events, _ := st.Events(""); len(events) != 1 || !events[0].Time.Equal(now) {
+				t.Errorf("Expected the new event kept, got %+v", events)
+			}
+		})
+	}
+}
+
+func TestStorage_Samples(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for name, st := range backends(t, Limits{SampleSpan: time.Minute}) {
+		t.Run(name, func(t *testing.T) {
+			if _, ok, err := st.SampleSince(start); ok || err != nil {
+				t.Errorf("Expected no sample, got %v, %v", ok, err)
+			}
+			for i := 0; i <= 30; i++ {
+				_ = st.AddSample(metrics.Sample{At: start.Add(time.Duration(i) * 5 * time.Second), Snapshot: metrics.Snapshot{BytesToUpstream: uint64(i)}})
+			}
+			// Samples older than a minute before the newest are gone
+			s, ok, err := st.SampleSince(start)
+			if !ok || err != nil || s.Snapshot.BytesToUpstream != 18 || !s.At.Equal(start.Add(90*time.Second)) {
+				t.Errorf("Unexpected oldest sample %+v, %v, %v", s, ok, err)
+			}
+			if s, _, _ := st.SampleSince(start.Add(141 * time.Second)); s.Snapshot.BytesToUpstream != 29 {
+				t.Errorf("Expected sample 29, got %+v", s)
+			}
+		})
+	}
+}
+
+func TestStorage_Sessions(t *testing.T) {
+	now := time.Now()
+	for name, st := range backends(t, Limits{}) {
+		t.Run(name, func(t *testing.T) {
+			_ = st.PutSession(Session{Token: "live", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+			_ = st.PutSession(Session{Token: "expired", CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(-time.Hour)})
+
+			s, ok, err := st.Session("live")
+			if !ok || err != nil || !s.ExpiresAt.Equal(now.Add(time.Hour)) {
+				t.Errorf("Unexpected session %+v, %v, %v", s, ok, err)
+			}
+			all, err := st.Sessions()
+			if err != nil || len(all) != 2 || all[0].Token != "expired" || all[1].Token != "live" {
+				t.Errorf("Expected sessions oldest first, got %+v, %v", all, err)
+			}
+			_ = st.TouchSession("live", now.Add(time.Minute), now.Add(2*time.Hour))
+			if s, _, _ := st.Session("live"); !s.LastSeen.Equal(now.Add(time.Minute)) || !s.ExpiresAt.Equal(now.Add(2*time.Hour)) {
+				t.Errorf("Expected the session touched, got %+v", s)
+			}
+			_ = st.DeleteExpiredSessions(now)
+			if _, ok, _ := st.Session("expired"); ok {
+				t.Error("Expected the expired session deleted")
+			}
+			_ = st.DeleteSession("live")
+			if _, ok, _ := st.Session("live"); ok {
+				t.Error("Expected the session deleted")
+			}
+			_ = st.TouchSession("live", now, now.Add(time.Hour))
+			if _, ok, _ := st.Session("live"); ok {
+				t.Error("Expected a touch not to recreate a deleted session")
+			}
+		})
+	}
+}
+
+func TestSQLite_SessionColumns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.db")
+	old, err := sql.Open("sqlite", "file:"+path)
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	_, err = old.Exec(`CREATE TABLE sessions (token TEXT PRIMARY KEY, created INTEGER NOT NULL, expires INTEGER NOT NULL)`)
+	old.Close()
+	if err != nil {
+		t.Fatalf("Failed to create old schema: %v", err)
+	}
+
+	db, err := OpenSQLite(path, Limits{})
+	if err != nil {
+		t.Fatalf("Failed to open SQLite with old schema: %v", err)
+	}
+	defer db.Close()
+	now := time.Now()
+	in := Session{Token: "t", CreatedAt: now, ExpiresAt: now.Add(time.Hour), LastSeen: now, RemoteAddr: "10.0.0.1:5000", UserAgent: "curl"}
+	if err := db.PutSession(in); err != nil {
+		t.Fatalf("Failed to store session: %v", err)
+	}
+	if s, ok, _ := db.Session("t"); !ok || s.RemoteAddr != in.RemoteAddr || s.UserAgent != in.UserAgent || !s.LastSeen.Equal(now) {
+		t.Errorf("Expected %+v, got %+v", in, s)
+	}
+}
+
+func TestSQLite_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "storage.db")
+	db, err := OpenSQLite(path, Limits{})
+	if err != nil {
+		t.Fatalf("Failed to open SQLite: %v", err)
+	}
+	now := time.Now()
+	_ = db.PutSession(Session{Token: "t", CreatedAt: now, ExpiresAt: now.Add(time.Hour)})
+	_ = db.AddLog(logger.Entry{Time: now, Level: logger.LogInfo, Line: "kept"})
+	_ = db.AddSample(metrics.Sample{At: now})
+	db.Close()
+
+	db, err = OpenSQLite(path, Limits{})
+	if err != nil {
+		t.Fatalf("Failed to reopen SQLite: %v", err)
+	}
+	defer db.Close()
+	if _, ok, _ := db.Session("t"); !ok {
+		t.Error("Expected the session kept across a restart")
+	}
+	if entries, _ := db.Logs(); len(entries) != 1 {
+		t.Errorf("Expected the log line kept, got %d", len(entries))
+	}
+	if _, ok, _ := db.SampleSince(time.Time{}); ok {
+		t.Error("Expected samples cleared on open")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	st, err := Open(&config.Config{StorageBackend: config.StorageMemory})
+	if _, ok := st.(*Memory); !ok || err != nil {
+		t.Errorf("Expected a memory store, got %T, %v", st, err)
+	}
+	st, err = Open(&config.Config{StorageBackend: config.StorageSQLite, StoragePath: filepath.Join(t.TempDir(), "s.db")})
+	if async, ok := st.(*Async); !ok || err != nil {
+		t.Fatalf("Expected a queued SQLite store, got %T, %v", st, err)
+	} else if _, ok := async.Storage.(*SQLite); !ok {
+		t.Fatalf("Expected a SQLite store, got %T", async.Storage)
+	}
+	st.Close()
+	if _, err := Open(&config.Config{StorageBackend: "bolt"}); err == nil {
+		t.Error("Expected an error for an unknown backend")
+	}
+}
+
+// blockingStore holds every write until release is closed
+type blockingStore struct {
+	Storage
+	release chan struct{}
+}
+
+func (s blockingStore) AddLog(e logger.Entry) error {
+	<-s.release
+	return s.Storage.AddLog(e)
+}
+
+func TestAsync_Drops(t *testing.T) {
+	release := make(chan struct{})
+	async := NewAsync(blockingStore{Storage: NewMemory(Limits{}), release: release}, 2)
+	defer async.Close()
+
+	// The worker holds the first line; two more fill the queue
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		_ = async.AddLog(logger.Entry{Time: time.Now(), Level: logger.LogInfo, Line: fmt.Sprint(i)})
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Expected writes not to wait for the backend, took %s", d)
+	}
+	if n := async.Stats().Dropped[WriteLogs]; n < 3 {
+		t.Errorf("Expected at least 3 lines dropped, got %d", n)
+	}
+
+	close(release)
+	entries, err := async.Logs()
+	if err != nil {
+		t.Fatalf("Logs: %v", err)
+	}
+	st := async.Stats()
+	if len(entries)+int(st.Dropped[WriteLogs]) != 6 || st.Pending != 0 {
+		t.Errorf("Expected every line kept or dropped, got %d kept and %+v", len(entries), st)
+	}
+}
@@ -0,0 +1,292 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Forward error correction on QUIC links: serial data is written to the
+// reliable stream as usual, and every write is also sent as an unreliable
+// QUIC datagram that repeats the last few writes. The receiver delivers
+// bytes from whichever copy arrives first, so a lost packet is usually
+// filled in by the next datagram instead of stalling the stream until it
+// is retransmitted. The stream still carries everything, so a loss the
+// datagrams cannot cover only costs the usual retransmission delay.
+
+const (
+	fecPreamble     byte = 0x02 // followed by the depth
+	fecDatagramSize      = 1100 // below the datagram payload QUIC allows on common paths
+	fecChunkHeader       = 10   // 8-byte stream offset, 2-byte length
+	fecMaxReady          = 64 << 10
+	fecMaxStash          = 64
+)
+
+type fecChunk struct {
+	off  uint64
+	data []byte
+}
+
+// fecEncoder splits writes into chunks and packs each into a datagram
+// together with the depth chunks sent before it, newest first.
+type fecEncoder struct {
+	depth   int
+	sent    uint64
+	history []fecChunk
+}
+
+// encode returns the datagrams that carry b.
+func (e *fecEncoder) encode(b []byte) [][]byte {
+	size := fecDatagramSize/(e.depth+1) - fecChunkHeader
+
+	var msgs [][]byte
+	for len(b) > 0 {
+		n := min(len(b), size)
+		chunk := fecChunk{off: e.sent, data: append([]byte(nil), b[:n]...)}
+		e.sent += uint64(n)
+		b = b[n:]
+
+		msg := appendFECChunk(nil, chunk)
+		for i := len(e.history) - 1; i >= 0; i-- {
+			msg = appendFECChunk(msg, e.history[i])
+		}
+		msgs = append(msgs, msg)
+
+		e.history = append(e.history, chunk)
+		if len(e.history) > e.depth {
+			e.history = e.history[1:]
+		}
+	}
+	return msgs
+}
+
+func appendFECChunk(msg []byte, c fecChunk) []byte {
+	msg = binary.BigEndian.AppendUint64(msg, c.off)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(c.data)))
+	return append(msg, c.data...)
+}
+
+func decodeFEC(msg []byte) ([]fecChunk, error) {
+	var chunks []fecChunk
+	for len(msg) > 0 {
+		if len(msg) < fecChunkHeader {
+			return nil, errors.New("short FEC chunk header")
+		}
+		off := binary.BigEndian.Uint64(msg)
+		n := int(binary.BigEndian.Uint16(msg[8:]))
+		msg = msg[fecChunkHeader:]
+		if len(msg) < n {
+			return nil, errors.New("short FEC chunk")
+		}
+		chunks = append(chunks, fecChunk{off: off, data: msg[:n]})
+		msg = msg[n:]
+	}
+	return chunks, nil
+}
+
+// fecConn is a QUICConn that also sends its writes as datagrams and reads
+// from the stream and the peer's datagrams at once.
+type fecConn struct {
+	*QUICConn
+
+	wmu sync.Mutex
+	enc fecEncoder
+
+	mu        sync.Mutex
+	changed   chan struct{} // closed and replaced whenever the fields below change
+	ready     []byte
+	delivered uint64 // stream offset of the end of ready
+	stash     map[uint64][]byte
+	err       error
+	closed    bool
+	deadline  time.Time
+}
+
+func newFECConn(qc *QUICConn, depth int) *fecConn {
+	c := &fecConn{
+		QUICConn: qc,
+		enc:      fecEncoder{depth: depth},
+		changed:  make(chan struct{}),
+		stash:    make(map[uint64][]byte),
+	}
+	go c.readStream()
+	go c.readDatagrams()
+	return c
+}
+
+// Write sends b as datagrams and on the stream.
+func (c *fecConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	for _, msg := range c.enc.encode(b) {
+		_ = c.conn.SendDatagram(msg) // best effort, the stream carries b as well
+	}
+	return c.Stream.Write(b)
+}
+
+// Read returns bytes in stream order, whichever copy delivered them.
+func (c *fecConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.ready) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if err := c.waitLocked(c.deadline); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, c.ready)
+	c.ready = c.ready[n:]
+	if len(c.ready) == 0 {
+		c.ready = nil
+	}
+	c.signalLocked()
+	return n, nil
+}
+
+func (c *fecConn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.Stream.SetWriteDeadline(t)
+}
+
+func (c *fecConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.signalLocked()
+	c.mu.Unlock()
+	return nil
+}
+
+// Close closes the stream and the underlying QUIC connection.
+func (c *fecConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	if c.err == nil {
+		c.err = net.ErrClosed
+	}
+	c.signalLocked()
+	c.mu.Unlock()
+	return c.QUICConn.Close()
+}
+
+func (c *fecConn) readStream() {
+	buf := make([]byte, 4096)
+	var off uint64
+	for {
+		n, err := c.Stream.Read(buf)
+
+		c.mu.Lock()
+		for len(c.ready) >= fecMaxReady && !c.closed {
+			_ = c.waitLocked(time.Time{})
+		}
+		c.addLocked(off, buf[:n])
+		off += uint64(n)
+		if err != nil && c.err == nil {
+			c.err = err
+			c.signalLocked()
+		}
+		done := err != nil || c.closed
+		c.mu.Unlock()
+
+		if done {
+			return
+		}
+	}
+}
+
+func (c *fecConn) readDatagrams() {
+	for {
+		msg, err := c.conn.ReceiveDatagram(context.Background())
+		if err != nil {
+			return
+		}
+		c.receive(msg)
+	}
+}
+
+// receive delivers the chunks of a datagram, oldest first. Datagrams that
+// arrive while the reader is behind are dropped; the stream has their data.
+func (c *fecConn) receive(msg []byte) {
+	chunks, err := decodeFEC(msg)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.ready) >= fecMaxReady {
+		return
+	}
+	for i := len(chunks) - 1; i >= 0; i-- {
+		c.addLocked(chunks[i].off, chunks[i].data)
+	}
+}
+
+// addLocked delivers the part of data at stream offset off that has not
+// been delivered yet. Data past a gap is stashed until the gap is filled.
+func (c *fecConn) addLocked(off uint64, data []byte) {
+	if off > c.delivered {
+		if len(c.stash) < fecMaxStash {
+			c.stash[off] = data
+		}
+		return
+	}
+
+	for {
+		if end := off + uint64(len(data)); end > c.delivered {
+			c.ready = append(c.ready, data[c.delivered-off:]...)
+			c.delivered = end
+			c.signalLocked()
+		}
+
+		found := false
+		for o, d := range c.stash {
+			if o <= c.delivered {
+				delete(c.stash, o)
+				off, data, found = o, d, true
+				break
+			}
+		}
+		if !found {
+			return
+		}
+	}
+}
+
+func (c *fecConn) signalLocked() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// waitLocked releases mu until the fields change or the deadline passes.
+func (c *fecConn) waitLocked(deadline time.Time) error {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	changed := c.changed
+	c.mu.Unlock()
+	defer c.mu.Lock()
+
+	select {
+	case <-changed:
+		return nil
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	}
+}
@@ -0,0 +1,163 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func newTestFECConn() *fecConn {
+	return &fecConn{changed: make(chan struct{}), stash: make(map[uint64][]byte)}
+}
+
+func readFEC(t *testing.T, c *fecConn, n int) []byte {
+	t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	return buf
+}
+
+func TestFEC_RecoversLostDatagrams(t *testing.T) {
+	enc := fecEncoder{depth: 2}
+	var msgs [][]byte
+	for _, w := range []string{"ab", "cd", "ef", "gh"} {
+		msgs = append(msgs, enc.encode([]byte(w))...)
+	}
+
+	// The second and third datagrams are lost; the fourth repeats their data
+	c := newTestFECConn()
+	c.receive(msgs[0])
+	c.receive(msgs[3])
+	if got := readFEC(t, c, 8); string(got) != "abcdefgh" {
+		t.Errorf("Expected abcdefgh, got %q", got)
+	}
+
+	// The stream's copy arrives later and is not delivered twice
+	c.mu.Lock()
+	c.addLocked(0, []byte("abcdefgh"))
+	c.mu.Unlock()
+	if len(c.ready) != 0 {
+		t.Errorf("Expected stream data to be dropped as duplicate, got %q", c.ready)
+	}
+}
+
+func TestFEC_WaitsForGap(t *testing.T) {
+	// A loss longer than the depth is filled in by the stream, and the
+	// datagram that arrived past the gap is delivered after it
+	enc := fecEncoder{depth: 1}
+	var msgs [][]byte
+	for _, w := range []string{"ab", "cd", "ef", "gh"} {
+		msgs = append(msgs, enc.encode([]byte(w))...)
+	}
+
+	c := newTestFECConn()
+	c.receive(msgs[0])
+	c.receive(msgs[3])
+	if got := readFEC(t, c, 2); string(got) != "ab" {
+		t.Fatalf("Expected ab, got %q", got)
+	}
+
+	c.mu.Lock()
+	c.addLocked(0, []byte("abcd"))
+	c.mu.Unlock()
+	if got := readFEC(t, c, 6); string(got) != "cdefgh" {
+		t.Errorf("Expected cdefgh, got %q", got)
+	}
+}
+
+func TestFEC_SplitsLargeWrites(t *testing.T) {
+	enc := fecEncoder{depth: 2}
+	data := bytes.Repeat([]byte{0x5a}, 3000)
+	msgs := enc.encode(data)
+	if len(msgs) < 2 {
+		t.Fatalf("Expected a large write to span several datagrams, got %d", len(msgs))
+	}
+
+	c := newTestFECConn()
+	for _, msg := range msgs {
+		if len(msg) > fecDatagramSize {
+			t.Errorf("Datagram of %d bytes exceeds %d", len(msg), fecDatagramSize)
+		}
+		c.receive(msg)
+	}
+	if got := readFEC(t, c, len(data)); !bytes.Equal(got, data) {
+		t.Error("Expected the datagrams to reassemble the write")
+	}
+}
+
+func TestFEC_ReadDeadline(t *testing.T) {
+	c := newTestFECConn()
+	_ = c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected a timeout with nothing to read")
+	}
+}
+
+func TestQUIC_FECRoundTrip(t *testing.T) {
+	ln, err := ListenQUIC("127.0.0.1:0", "", "")
+	if err != nil {
+		t.Fatalf("Failed to start QUIC listener: %v", err)
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	data := bytes.Repeat([]byte{0xf7, 0x0e, 0x01}, 1000)
+	accepted := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept(ctx)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, ok := conn.(*fecConn); !ok {
+			t.Errorf("Expected the listener to enable FEC, got %T", conn)
+		}
+
+		buf := make([]byte, len(data))
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		accepted <- buf
+		_, _ = conn.Write(buf)
+		time.Sleep(100 * time.Millisecond)
+	}()
+
+	conn, err := DialQUIC(ctx, ln.Addr().String(), true, 2)
+	if err != nil {
+		t.Fatalf("Failed to dial QUIC listener: %v", err)
+	}
+	defer conn.Close()
+	if _, ok := conn.(*fecConn); !ok {
+		t.Errorf("Expected FEC to be negotiated, got %T", conn)
+	}
+
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	select {
+	case got := <-accepted:
+		if !bytes.Equal(got, data) {
+			t.Error("Listener received corrupted data")
+		}
+	case <-ctx.Done():
+		t.Fatal("Timeout waiting for server to receive data")
+	}
+
+	buf := make([]byte, len(data))
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("Dialer received corrupted data")
+	}
+}
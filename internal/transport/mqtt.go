@@ -0,0 +1,112 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/mqtt"
+)
+
+// MQTTOptions configures the MQTT serial bridge transport. Bytes from the
+// device arrive as messages on RxTopic; bytes written toward the device are
+// published to TxTopic.
+type MQTTOptions struct {
+	mqtt.Options
+	RxTopic string
+	TxTopic string
+}
+
+// mqttConn exposes an MQTT topic pair as a net.Conn byte stream
+type mqttConn struct {
+	client       *mqtt.Client
+	opts         MQTTOptions
+	pending      []byte
+	deadlineMu   sync.Mutex
+	readDeadline time.Time
+}
+
+// DialMQTT connects to the broker and subscribes to the receive topic
+func DialMQTT(ctx context.Context, opts MQTTOptions) (net.Conn, error) {
+	client, err := mqtt.Dial(ctx, opts.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.Subscribe(opts.RxTopic); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &mqttConn{client: client, opts: opts}, nil
+}
+
+func (c *mqttConn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		c.deadlineMu.Lock()
+		deadline := c.readDeadline
+		c.deadlineMu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case msg := <-c.client.Messages():
+			c.pending = msg.Payload
+		case <-c.client.Done():
+			return 0, c.client.Err()
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *mqttConn) Write(b []byte) (int, error) {
+	if err := c.client.Publish(c.opts.TxTopic, b, false); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *mqttConn) Close() error {
+	return c.client.Close()
+}
+
+func (c *mqttConn) LocalAddr() net.Addr {
+	return mqttAddr(c.opts.ClientID)
+}
+
+func (c *mqttConn) RemoteAddr() net.Addr {
+	return mqttAddr(c.opts.Broker)
+}
+
+func (c *mqttConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *mqttConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.readDeadline = t
+	c.deadlineMu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline is a no-op; publishes carry their own write timeout
+func (c *mqttConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+type mqttAddr string
+
+func (a mqttAddr) Network() string { return "mqtt" }
+func (a mqttAddr) String() string  { return string(a) }
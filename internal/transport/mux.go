@@ -0,0 +1,716 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MuxALPN is the ALPN protocol identifier negotiated on multiplexed links.
+const MuxALPN = "serial-tcp-proxy-mux"
+
+// Mux frames carry a 5-byte header: type, channel ID (uint16) and payload
+// length (uint16), big-endian, followed by the payload.
+const (
+	muxOpen  byte = 1 // open a channel, payload is its name; echoed to accept it
+	muxData  byte = 2 // serial data of a channel
+	muxClose byte = 3 // close a channel, payload is the reason if any
+
+	muxHeaderLen  = 5
+	muxMaxPayload = 0xFFFF
+)
+
+const (
+	// muxQueue is how many frames a channel buffers for its reader. A
+	// channel whose reader falls further behind is closed, so it cannot
+	// hold up the others.
+	muxQueue = 256
+	// muxWriteTimeout bounds a frame write; a session that cannot send
+	// for that long fails with all its channels
+	muxWriteTimeout = 10 * time.Second
+	// muxHandshakeTimeout bounds the TLS handshake of an accepted session
+	muxHandshakeTimeout = 10 * time.Second
+)
+
+// ErrMuxStalled closes a channel whose reader did not keep up
+var ErrMuxStalled = errors.New("mux channel receive buffer full")
+
+// MuxChannelStats count the traffic of one channel
+type MuxChannelStats struct {
+	ID        uint16    `json:"id"`
+	Name      string    `json:"name"`
+	Opened    time.Time `json:"opened"`
+	BytesIn   uint64    `json:"bytes_in"`
+	BytesOut  uint64    `json:"bytes_out"`
+	FramesIn  uint64    `json:"frames_in"`
+	FramesOut uint64    `json:"frames_out"`
+}
+
+// MuxSessionStats describe one multiplexed connection and its open
+// channels
+type MuxSessionStats struct {
+	Remote   string            `json:"remote"`
+	Started  time.Time         `json:"started"`
+	Opened   uint64            `json:"channels_opened"` // since the session started, counting reopened channels
+	Channels []MuxChannelStats `json:"channels"`
+}
+
+// muxSession is one TLS connection carrying channels. The dialing side
+// opens channels by name; the listening side accepts or rejects them.
+type muxSession struct {
+	conn    net.Conn
+	started time.Time
+	pool    *muxPool // dialing side only; the session leaves it when closed
+	key     string   // in pool
+	accept  func(*MuxChannel)
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	channels map[uint16]*MuxChannel
+	nextID   uint16
+	opened   uint64
+	err      error // why the session ended, nil while running
+}
+
+func newMuxSession(conn net.Conn) *muxSession {
+	return &muxSession{conn: conn, started: time.Now(), channels: make(map[uint16]*MuxChannel)}
+}
+
+// readLoop dispatches incoming frames until the connection fails
+func (s *muxSession) readLoop() {
+	hdr := make([]byte, muxHeaderLen)
+	for {
+		if _, err := io.ReadFull(s.conn, hdr); err != nil {
+			s.fail(err)
+			return
+		}
+		typ, id := hdr[0], binary.BigEndian.Uint16(hdr[1:])
+		payload := make([]byte, binary.BigEndian.Uint16(hdr[3:]))
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.fail(err)
+			return
+		}
+		s.handle(typ, id, payload)
+	}
+}
+
+func (s *muxSession) handle(typ byte, id uint16, payload []byte) {
+	s.mu.Lock()
+	ch := s.channels[id]
+	if typ == muxOpen && ch == nil && s.accept != nil {
+		ch = newMuxChannel(s, id, string(payload))
+		s.channels[id] = ch
+		s.opened++
+		s.mu.Unlock()
+		s.accept(ch)
+		return
+	}
+	s.mu.Unlock()
+	if ch == nil {
+		return
+	}
+
+	switch typ {
+	case muxOpen:
+		ch.readyOnce.Do(func() { close(ch.ready) })
+	case muxData:
+		ch.deliver(payload)
+	case muxClose:
+		err := io.EOF
+		if reason := string(payload); !ch.isReady() {
+			err = fmt.Errorf("mux channel %q refused: %s", ch.name, reason)
+		} else if reason != "" {
+			err = fmt.Errorf("mux channel closed by peer: %s", reason)
+		}
+		s.remove(ch, err, "", false)
+	}
+}
+
+// writeFrame sends one frame. A failed write ends the session.
+func (s *muxSession) writeFrame(typ byte, id uint16, payload []byte) error {
+	frame := make([]byte, muxHeaderLen, muxHeaderLen+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint16(frame[1:], id)
+	binary.BigEndian.PutUint16(frame[3:], uint16(len(payload)))
+	frame = append(frame, payload...)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(muxWriteTimeout))
+	if _, err := s.conn.Write(frame); err != nil {
+		s.fail(err)
+		return err
+	}
+	return nil
+}
+
+// register adds a new channel on the dialing side. It returns nil if the
+// session has failed or has no channel IDs left. The caller sends the
+// open frame, outside the pool lock.
+func (s *muxSession) register(name string) *MuxChannel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil || len(s.channels) >= muxMaxPayload {
+		return nil
+	}
+	for {
+		s.nextID++
+		if _, used := s.channels[s.nextID]; !used && s.nextID != 0 {
+			break
+		}
+	}
+	ch := newMuxChannel(s, s.nextID, name)
+	s.channels[ch.id] = ch
+	s.opened++
+	return ch
+}
+
+// remove closes a channel with err, telling the peer with reason if
+// notify is set. The dialing side closes the session with its last
+// channel.
+func (s *muxSession) remove(ch *MuxChannel, err error, reason string, notify bool) {
+	if s.pool != nil {
+		s.pool.mu.Lock()
+	}
+	s.mu.Lock()
+	current := s.channels[ch.id] == ch
+	if current {
+		delete(s.channels, ch.id)
+	}
+	idle := current && s.pool != nil && len(s.channels) == 0 && s.err == nil
+	s.mu.Unlock()
+	if idle && s.pool.sessions[s.key] == s {
+		delete(s.pool.sessions, s.key)
+	}
+	if s.pool != nil {
+		s.pool.mu.Unlock()
+	}
+
+	ch.finish(err)
+	if current && notify {
+		_ = s.writeFrame(muxClose, ch.id, []byte(reason))
+	}
+	if idle {
+		s.fail(net.ErrClosed)
+	}
+}
+
+// fail ends the session and every channel on it
+func (s *muxSession) fail(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = fmt.Errorf("mux session: %w", err)
+	channels := s.channels
+	s.channels = make(map[uint16]*MuxChannel)
+	s.mu.Unlock()
+
+	_ = s.conn.Close()
+	for _, ch := range channels {
+		ch.finish(s.err)
+	}
+	if s.pool != nil {
+		s.pool.drop(s)
+	}
+}
+
+func (s *muxSession) stats() MuxSessionStats {
+	s.mu.Lock()
+	st := MuxSessionStats{Remote: s.conn.RemoteAddr().String(), Started: s.started, Opened: s.opened}
+	channels := make([]*MuxChannel, 0, len(s.channels))
+	for _, ch := range s.channels {
+		channels = append(channels, ch)
+	}
+	s.mu.Unlock()
+
+	st.Channels = make([]MuxChannelStats, 0, len(channels))
+	for _, ch := range channels {
+		st.Channels = append(st.Channels, ch.Stats())
+	}
+	sort.Slice(st.Channels, func(i, j int) bool { return st.Channels[i].ID < st.Channels[j].ID })
+	return st
+}
+
+// MuxChannel is one serial stream within a multiplexed connection. It is
+// a net.Conn; Read must not be called concurrently, and write deadlines
+// are replaced by the session's own write timeout.
+type MuxChannel struct {
+	s      *muxSession
+	id     uint16
+	name   string
+	opened time.Time
+
+	in      chan []byte
+	pending []byte // rest of the frame being read, used by Read only
+
+	ready     chan struct{} // closed once the channel is accepted
+	readyOnce sync.Once
+	done      chan struct{}
+	doneOnce  sync.Once
+	err       error // set before done is closed
+
+	readDeadline atomic.Int64 // unix nanoseconds, 0 for none
+
+	bytesIn, bytesOut   atomic.Uint64
+	framesIn, framesOut atomic.Uint64
+}
+
+func newMuxChannel(s *muxSession, id uint16, name string) *MuxChannel {
+	return &MuxChannel{
+		s:      s,
+		id:     id,
+		name:   name,
+		opened: time.Now(),
+		in:     make(chan []byte, muxQueue),
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Name returns the name the channel was opened with
+func (c *MuxChannel) Name() string {
+	return c.name
+}
+
+// Accept confirms a channel the peer opened
+func (c *MuxChannel) Accept() error {
+	c.readyOnce.Do(func() { close(c.ready) })
+	return c.s.writeFrame(muxOpen, c.id, []byte(c.name))
+}
+
+// Reject refuses a channel the peer opened, telling it why
+func (c *MuxChannel) Reject(reason string) {
+	c.s.remove(c, net.ErrClosed, reason, true)
+}
+
+// Stats returns the traffic of the channel so far
+func (c *MuxChannel) Stats() MuxChannelStats {
+	return MuxChannelStats{
+		ID:        c.id,
+		Name:      c.name,
+		Opened:    c.opened,
+		BytesIn:   c.bytesIn.Load(),
+		BytesOut:  c.bytesOut.Load(),
+		FramesIn:  c.framesIn.Load(),
+		FramesOut: c.framesOut.Load(),
+	}
+}
+
+func (c *MuxChannel) isReady() bool {
+	select {
+	case <-c.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver queues data for Read, closing a channel that fell behind
+func (c *MuxChannel) deliver(data []byte) {
+	c.framesIn.Add(1)
+	c.bytesIn.Add(uint64(len(data)))
+	select {
+	case c.in <- data:
+	default:
+		c.s.remove(c, ErrMuxStalled, ErrMuxStalled.Error(), true)
+	}
+}
+
+func (c *MuxChannel) finish(err error) {
+	c.doneOnce.Do(func() {
+		c.err = err
+		close(c.done)
+	})
+}
+
+// Read returns data the peer sent on this channel
+func (c *MuxChannel) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		data, err := c.next()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = data
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// next waits for the next frame, the read deadline or the end of the
+// channel. Frames received before the end are still returned.
+func (c *MuxChannel) next() ([]byte, error) {
+	var timeout <-chan time.Time
+	if d := c.readDeadline.Load(); d != 0 {
+		wait := time.Until(time.Unix(0, d))
+		if wait <= 0 {
+			return nil, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case data := <-c.in:
+		return data, nil
+	case <-c.done:
+		select {
+		case data := <-c.in:
+			return data, nil
+		default:
+			return nil, c.err
+		}
+	case <-timeout:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+// Write sends b to the peer, split into frames as needed
+func (c *MuxChannel) Write(b []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), muxMaxPayload)]
+		if err := c.s.writeFrame(muxData, c.id, chunk); err != nil {
+			return written, err
+		}
+		c.framesOut.Add(1)
+		c.bytesOut.Add(uint64(len(chunk)))
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+// Close closes the channel and tells the peer. Other channels on the
+// connection are not affected.
+func (c *MuxChannel) Close() error {
+	c.s.remove(c, net.ErrClosed, "", true)
+	return nil
+}
+
+func (c *MuxChannel) LocalAddr() net.Addr {
+	return c.s.conn.LocalAddr()
+}
+
+func (c *MuxChannel) RemoteAddr() net.Addr {
+	return c.s.conn.RemoteAddr()
+}
+
+func (c *MuxChannel) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline applies to Reads started after the call
+func (c *MuxChannel) SetReadDeadline(t time.Time) error {
+	var d int64
+	if !t.IsZero() {
+		d = t.UnixNano()
+	}
+	c.readDeadline.Store(d)
+	return nil
+}
+
+func (c *MuxChannel) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// muxPool holds the sessions of the dialing side, one per address, so
+// every channel to the same peer shares its connection
+type muxPool struct {
+	mu       sync.Mutex
+	sessions map[string]*muxSession
+}
+
+var dialedMux = &muxPool{sessions: make(map[string]*muxSession)}
+
+// open returns a new channel on the session for key, dialing one if there
+// is none
+func (p *muxPool) open(ctx context.Context, key, name string, dial func(context.Context) (net.Conn, error)) (*MuxChannel, error) {
+	ch, err := p.register(ctx, key, name, dial)
+	if err != nil {
+		return nil, err
+	}
+	if err := ch.s.writeFrame(muxOpen, ch.id, []byte(name)); err != nil {
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (p *muxPool) register(ctx context.Context, key, name string, dial func(context.Context) (net.Conn, error)) (*MuxChannel, error) {
+	p.mu.Lock()
+	if s := p.sessions[key]; s != nil {
+		if ch := s.register(name); ch != nil {
+			p.mu.Unlock()
+			return ch, nil
+		}
+	}
+	p.mu.Unlock()
+
+	conn, err := dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s := p.sessions[key]; s != nil {
+		// Another channel connected meanwhile; share its session
+		if ch := s.register(name); ch != nil {
+			_ = conn.Close()
+			return ch, nil
+		}
+	}
+	s := newMuxSession(conn)
+	s.pool, s.key = p, key
+	p.sessions[key] = s
+	go s.readLoop()
+	return s.register(name), nil
+}
+
+// drop removes a failed session
+func (p *muxPool) drop(s *muxSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sessions[s.key] == s {
+		delete(p.sessions, s.key)
+	}
+}
+
+func (p *muxPool) stats() []MuxSessionStats {
+	p.mu.Lock()
+	sessions := make([]*muxSession, 0, len(p.sessions))
+	for _, s := range p.sessions {
+		sessions = append(sessions, s)
+	}
+	p.mu.Unlock()
+	return sessionStats(sessions)
+}
+
+func sessionStats(sessions []*muxSession) []MuxSessionStats {
+	stats := make([]MuxSessionStats, 0, len(sessions))
+	for _, s := range sessions {
+		stats = append(stats, s.stats())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Remote < stats[j].Remote })
+	return stats
+}
+
+// DialMux opens the channel name to the mux listener at addr. Channels to
+// the same address share one TLS connection, which is dialed with the
+// first channel and closed with the last. When insecure is true the
+// server certificate is not verified.
+func DialMux(ctx context.Context, addr, name string, insecure bool) (net.Conn, error) {
+	if name == "" || len(name) > muxMaxPayload {
+		return nil, fmt.Errorf("invalid mux channel name %q", name)
+	}
+	key := addr
+	if insecure {
+		key += "?insecure"
+	}
+	dial := func(ctx context.Context) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		d := &tls.Dialer{Config: &tls.Config{
+			ServerName:         host,
+			NextProtos:         []string{MuxALPN},
+			InsecureSkipVerify: insecure, //nolint:gosec // opt-in for self-signed peers
+			MinVersion:         tls.VersionTLS12,
+		}}
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	ch, err := dialedMux.open(ctx, key, name, dial)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-ch.ready:
+		return ch, nil
+	case <-ch.done:
+		return nil, ch.err
+	case <-ctx.Done():
+		ch.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// MuxDialedSessions returns the sessions DialMux holds open
+func MuxDialedSessions() []MuxSessionStats {
+	return dialedMux.stats()
+}
+
+// MuxListener accepts multiplexed TLS connections and yields the channels
+// opened on them.
+type MuxListener struct {
+	ln      net.Listener
+	conf    *tls.Config
+	accepts chan *MuxChannel
+	done    chan struct{}
+	once    sync.Once // closes done
+
+	mu       sync.Mutex
+	sessions map[*muxSession]struct{}
+	closed   bool
+}
+
+// ListenMux starts a mux listener. If certFile and keyFile are empty, an
+// ephemeral self-signed certificate is generated.
+func ListenMux(addr, certFile, keyFile string) (*MuxListener, error) {
+	cert, err := ServerCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return newMuxListener(ln, cert), nil
+}
+
+// newMuxListener serves mux peers connecting to ln
+func newMuxListener(ln net.Listener, cert tls.Certificate) *MuxListener {
+	l := &MuxListener{
+		ln: ln,
+		conf: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{MuxALPN},
+			MinVersion:   tls.VersionTLS12,
+		},
+		accepts:  make(chan *MuxChannel, 16),
+		done:     make(chan struct{}),
+		sessions: make(map[*muxSession]struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// acceptLoop serves the peers connecting to the listener. Errors such as
+// running out of file descriptors are retried with a growing delay; the
+// loop ends once the listener is closed.
+func (l *MuxListener) acceptLoop() {
+	defer l.once.Do(func() { close(l.done) })
+
+	var delay time.Duration
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+			select {
+			case <-time.After(delay):
+				continue
+			case <-l.done:
+				return
+			}
+		}
+		delay = 0
+		go l.serve(conn)
+	}
+}
+
+// serve runs one session until it fails
+func (l *MuxListener) serve(conn net.Conn) {
+	tc := tls.Server(conn, l.conf)
+	ctx, cancel := context.WithTimeout(context.Background(), muxHandshakeTimeout)
+	err := tc.HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	s := newMuxSession(tc)
+	s.accept = func(ch *MuxChannel) {
+		select {
+		case l.accepts <- ch:
+		default:
+			ch.Reject("listener busy")
+		}
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		tc.Close()
+		return
+	}
+	l.sessions[s] = struct{}{}
+	l.mu.Unlock()
+
+	s.readLoop()
+
+	l.mu.Lock()
+	delete(l.sessions, s)
+	l.mu.Unlock()
+}
+
+// Accept waits for the next channel a peer opens. The caller must Accept
+// or Reject it.
+func (l *MuxListener) Accept(ctx context.Context) (*MuxChannel, error) {
+	select {
+	case ch := <-l.accepts:
+		return ch, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Sessions returns the connected peers and their channels
+func (l *MuxListener) Sessions() []MuxSessionStats {
+	l.mu.Lock()
+	sessions := make([]*muxSession, 0, len(l.sessions))
+	for s := range l.sessions {
+		sessions = append(sessions, s)
+	}
+	l.mu.Unlock()
+	return sessionStats(sessions)
+}
+
+// Addr returns the listener's TCP address.
+func (l *MuxListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Close stops the listener and closes every session.
+func (l *MuxListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	sessions := make([]*muxSession, 0, len(l.sessions))
+	for s := range l.sessions {
+		sessions = append(sessions, s)
+	}
+	l.mu.Unlock()
+
+	l.once.Do(func() { close(l.done) })
+	err := l.ln.Close()
+	for _, s := range sessions {
+		s.fail(net.ErrClosed)
+	}
+	return err
+}
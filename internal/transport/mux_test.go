@@ -0,0 +1,198 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// echoMux accepts channels on ln and echoes their data, refusing "bad"
+func echoMux(ctx context.Context, ln *MuxListener) {
+	for {
+		ch, err := ln.Accept(ctx)
+		if err != nil {
+			return
+		}
+		if ch.Name() == "bad" {
+			ch.Reject("unknown upstream")
+			continue
+		}
+		if err := ch.Accept(); err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			_, _ = io.Copy(ch, ch)
+		}()
+	}
+}
+
+func roundTrip(t *testing.T, conn net.Conn, data []byte) {
+	t.Helper()
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Expected %q, got %q", data, got)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMux_Channels(t *testing.T) {
+	ln, err := ListenMux("127.0.0.1:0", "", "")
+	if err != nil {
+		t.Fatalf("Failed to start mux listener: %v", err)
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go echoMux(ctx, ln)
+
+	addr := ln.Addr().String()
+	a, err := DialMux(ctx, addr, "meter1", true)
+	if err != nil {
+		t.Fatalf("Failed to open channel meter1: %v", err)
+	}
+	b, err := DialMux(ctx, addr, "meter2", true)
+	if err != nil {
+		t.Fatalf("Failed to open channel meter2: %v", err)
+	}
+	roundTrip(t, a, []byte("hello"))
+	roundTrip(t, b, bytes.Repeat([]byte{0x55}, 70000))
+
+	sessions := MuxDialedSessions()
+	if len(sessions) != 1 || len(sessions[0].Channels) != 2 {
+		t.Fatalf("Expected both channels on one session, got %+v", sessions)
+	}
+	if st := sessions[0].Channels[1]; st.Name != "meter2" || st.BytesOut != 70000 || st.FramesOut != 2 {
+		t.Errorf("Unexpected channel stats %+v", st)
+	}
+
+	// Closing one channel leaves the other working
+	a.Close()
+	waitFor(t, func() bool {
+		s := ln.Sessions()
+		return len(s) == 1 && len(s[0].Channels) == 1
+	}, "channel not closed on the listener")
+	roundTrip(t, b, []byte("still there"))
+	if s := ln.Sessions(); s[0].Opened != 2 || s[0].Channels[0].Name != "meter2" {
+		t.Errorf("Unexpected listener session %+v", s[0])
+	}
+
+	if _, err := DialMux(ctx, addr, "bad", true); err == nil || !strings.Contains(err.Error(), "unknown upstream") {
+		t.Errorf("Expected the channel to be refused, got %v", err)
+	}
+
+	// The connection closes with its last channel
+	b.Close()
+	waitFor(t, func() bool { return len(MuxDialedSessions()) == 0 }, "session not closed with its last channel")
+	waitFor(t, func() bool { return len(ln.Sessions()) == 0 }, "listener kept the session")
+}
+
+func TestMux_ListenerClose(t *testing.T) {
+	ln, err := ListenMux("127.0.0.1:0", "", "")
+	if err != nil {
+		t.Fatalf("Failed to start mux listener: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go echoMux(ctx, ln)
+
+	conn, err := DialMux(ctx, ln.Addr().String(), "meter1", true)
+	if err != nil {
+		t.Fatalf("Failed to open channel: %v", err)
+	}
+	defer conn.Close()
+
+	// A read deadline times out like on a socket
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	var ne net.Error
+	if _, err := conn.Read(make([]byte, 1)); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+
+	ln.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.As(err, &ne) && ne.Timeout() {
+		t.Errorf("Expected the channel to fail with its session, got %v", err)
+	}
+}
+
+// flakyListener fails its first Accept calls like a listener that ran out
+// of file descriptors
+type flakyListener struct {
+	net.Listener
+	failures atomic.Int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, errors.New("accept: too many open files")
+	}
+	return l.Listener.Accept()
+}
+
+func TestMux_AcceptRetries(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	cert, err := ServerCertificate("", "")
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	flaky := &flakyListener{Listener: inner}
+	flaky.failures.Store(3)
+	ln := newMuxListener(flaky, cert)
+	defer ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go echoMux(ctx, ln)
+
+	conn, err := DialMux(ctx, ln.Addr().String(), "meter1", true)
+	if err != nil {
+		t.Fatalf("Expected the listener to recover from accept errors: %v", err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, []byte{0xf7, 0x0e})
+}
+
+func TestMux_AcceptEndsWithListener(t *testing.T) {
+	ln, err := ListenMux("127.0.0.1:0", "", "")
+	if err != nil {
+		t.Fatalf("Failed to start mux listener: %v", err)
+	}
+	defer ln.Close()
+
+	// The TCP listener failing for good ends Accept instead of leaving it
+	// waiting for channels that never come
+	ln.ln.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := ln.Accept(ctx); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected net.ErrClosed, got %v", err)
+	}
+}
@@ -0,0 +1,272 @@
+// Package transport provides alternative stream transports used between the
+// proxy and its upstream or between two proxy instances.
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/fec"
+	"github.com/quic-go/quic-go"
+)
+
+// QUICALPN is the ALPN protocol identifier negotiated on QUIC links.
+const QUICALPN = "serial-tcp-proxy"
+
+// quicPreamble is written by the dialing side when it opens the stream.
+// QUIC streams only become visible to the peer once data is sent, so the
+// preamble lets the listener accept the stream before any serial data flows.
+// A dialer that asks for FEC sends fecPreamble instead.
+const quicPreamble byte = 0x01
+
+var quicConfig = &quic.Config{
+	MaxIdleTimeout:  30 * time.Second,
+	KeepAlivePeriod: 10 * time.Second,
+	EnableDatagrams: true,
+}
+
+// QUICConn exposes a single bidirectional QUIC stream as a net.Conn.
+type QUICConn struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (c *QUICConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *QUICConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes the stream and the underlying QUIC connection.
+func (c *QUICConn) Close() error {
+	c.Stream.CancelRead(0)
+	err := c.Stream.Close()
+	_ = c.conn.CloseWithError(0, "")
+	return err
+}
+
+// DialQUIC connects to a QUIC listener and opens the data stream.
+// When insecure is true the server certificate is not verified, which is
+// required when the peer uses a generated self-signed certificate. A
+// non-zero fecDepth enables forward error correction with that depth if
+// the peer supports QUIC datagrams, see fec.ParseQuery.
+func DialQUIC(ctx context.Context, addr string, insecure bool, fecDepth int) (net.Conn, error) {
+	tlsConf := &tls.Config{
+		NextProtos:         []string{QUICALPN},
+		InsecureSkipVerify: insecure, //nolint:gosec // opt-in for self-signed peers
+		MinVersion:         tls.VersionTLS13,
+	}
+
+	conn, err := quic.DialAddr(ctx, addr, tlsConf, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		_ = conn.CloseWithError(0, "")
+		return nil, err
+	}
+
+	preamble := []byte{quicPreamble}
+	if fecDepth > 0 && conn.ConnectionState().SupportsDatagrams {
+		preamble = []byte{fecPreamble, byte(fecDepth)}
+	}
+	if _, err := stream.Write(preamble); err != nil {
+		_ = conn.CloseWithError(0, "")
+		return nil, err
+	}
+
+	qc := &QUICConn{Stream: stream, conn: conn}
+	if preamble[0] == fecPreamble {
+		return newFECConn(qc, fecDepth), nil
+	}
+	return qc, nil
+}
+
+// QUICListener accepts QUIC connections and yields their data stream.
+// Each connection opens its stream in its own goroutine, so a peer that
+// never does cannot hold up the others.
+type QUICListener struct {
+	ln      *quic.Listener
+	ctx     context.Context
+	cancel  context.CancelFunc
+	accepts chan net.Conn
+	done    chan struct{}
+	once    sync.Once // closes done
+}
+
+// ListenQUIC starts a QUIC listener. If certFile and keyFile are empty, an
+// ephemeral self-signed certificate is generated.
+func ListenQUIC(addr, certFile, keyFile string) (*QUICListener, error) {
+	cert, err := ServerCertificate(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{QUICALPN},
+		MinVersion:   tls.VersionTLS13,
+	}
+
+	ln, err := quic.ListenAddr(addr, tlsConf, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &QUICListener{
+		ln:      ln,
+		ctx:     ctx,
+		cancel:  cancel,
+		accepts: make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l, nil
+}
+
+// acceptLoop accepts connections until the listener is closed. quic-go
+// only fails Accept once the listener is closed.
+func (l *QUICListener) acceptLoop() {
+	defer l.once.Do(func() { close(l.done) })
+
+	for {
+		conn, err := l.ln.Accept(l.ctx)
+		if err != nil {
+			return
+		}
+		go l.serve(conn)
+	}
+}
+
+// serve waits for the connection's data stream and hands it to Accept
+func (l *QUICListener) serve(conn quic.Connection) {
+	qc, err := acceptStream(l.ctx, conn)
+	if err != nil {
+		_ = conn.CloseWithError(1, "handshake failed")
+		return
+	}
+
+	select {
+	case l.accepts <- qc:
+	case <-l.done:
+		qc.Close()
+	}
+}
+
+// Accept waits for the next peer and its data stream. It returns
+// net.ErrClosed once the listener is closed.
+func (l *QUICListener) Accept(ctx context.Context) (net.Conn, error) {
+	select {
+	case conn := <-l.accepts:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func acceptStream(ctx context.Context, conn quic.Connection) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(stream, buf[:1]); err != nil {
+		return nil, err
+	}
+	switch buf[0] {
+	case quicPreamble:
+	case fecPreamble:
+		if _, err := io.ReadFull(stream, buf[1:]); err != nil {
+			return nil, err
+		}
+		if buf[1] == 0 || buf[1] > fec.MaxDepth {
+			return nil, fmt.Errorf("unsupported FEC depth %d", buf[1])
+		}
+	default:
+		return nil, errors.New("unexpected stream preamble")
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+
+	qc := &QUICConn{Stream: stream, conn: conn}
+	if buf[0] == fecPreamble {
+		return newFECConn(qc, int(buf[1])), nil
+	}
+	return qc, nil
+}
+
+// Addr returns the listener's UDP address.
+func (l *QUICListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Close stops the listener and drops peers that have not opened their
+// stream yet.
+func (l *QUICListener) Close() error {
+	l.cancel()
+	l.once.Do(func() { close(l.done) })
+	return l.ln.Close()
+}
+
+// ServerCertificate loads the certificate of a TLS or QUIC listener. If
+// certFile and keyFile are empty, an ephemeral self-signed certificate is
+// generated.
+func ServerCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	var cert tls.Certificate
+	var err error
+	if certFile != "" && keyFile != "" {
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	} else {
+		cert, err = selfSignedCertificate()
+	}
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	return cert, nil
+}
+
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "serial-tcp-proxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,123 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestQUIC_RoundTrip(t *testing.T) {
+	ln, err := ListenQUIC("127.0.0.1:0", "", "")
+	if err != nil {
+		t.Fatalf("Failed to start QUIC listener: %v", err)
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	accepted := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept(ctx)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 16)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		accepted <- buf[:n]
+		_, _ = conn.Write([]byte{0xaa, 0xbb})
+		time.Sleep(100 * time.Millisecond)
+	}()
+
+	conn, err := DialQUIC(ctx, ln.Addr().String(), true, 0)
+	if err != nil {
+		t.Fatalf("Failed to dial QUIC listener: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte{0xf7, 0x0e}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	select {
+	case data := <-accepted:
+		if string(data) != string([]byte{0xf7, 0x0e}) {
+			t.Errorf("Expected f70e, got %x", data)
+		}
+	case <-ctx.Done():
+		t.Fatal("Timeout waiting for server to receive data")
+	}
+
+	buf := make([]byte, 16)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(buf[:n]) != string([]byte{0xaa, 0xbb}) {
+		t.Errorf("Expected aabb, got %x", buf[:n])
+	}
+}
+
+func TestDialQUIC_RejectsUnverifiedCertificate(t *testing.T) {
+	ln, err := ListenQUIC("127.0.0.1:0", "", "")
+	if err != nil {
+		t.Fatalf("Failed to start QUIC listener: %v", err)
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if _, err := DialQUIC(ctx, ln.Addr().String(), false, 0); err == nil {
+		t.Error("Expected certificate verification error for self-signed listener")
+	}
+}
+
+func TestQUICListener_StalledPeer(t *testing.T) {
+	ln, err := ListenQUIC("127.0.0.1:0", "", "")
+	if err != nil {
+		t.Fatalf("Failed to start QUIC listener: %v", err)
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// completes the handshake but never opens the data stream
+	tlsConf := &tls.Config{NextProtos: []string{QUICALPN}, InsecureSkipVerify: true} //nolint:gosec // test peer
+	stalled, err := quic.DialAddr(ctx, ln.Addr().String(), tlsConf, quicConfig)
+	if err != nil {
+		t.Fatalf("Failed to dial QUIC listener: %v", err)
+	}
+	defer stalled.CloseWithError(0, "")
+
+	conn, err := DialQUIC(ctx, ln.Addr().String(), true, 0)
+	if err != nil {
+		t.Fatalf("Failed to dial QUIC listener: %v", err)
+	}
+	defer conn.Close()
+
+	acceptCtx, acceptCancel := context.WithTimeout(ctx, 2*time.Second)
+	defer acceptCancel()
+	accepted, err := ln.Accept(acceptCtx)
+	if err != nil {
+		t.Fatalf("Expected the second peer to be accepted: %v", err)
+	}
+	accepted.Close()
+
+	ln.Close()
+	if _, err := ln.Accept(ctx); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected net.ErrClosed after Close, got %v", err)
+	}
+}
@@ -0,0 +1,347 @@
+// Package trigger evaluates packet-matching rules and runs their actions:
+// injecting a canned response, calling a webhook, publishing to MQTT or
+// raising an alert in the log.
+package trigger
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/hexutil"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/mqtt"
+)
+
+// Packet directions as seen by the rules
+const (
+	FromUpstream = "from_upstream"
+	ToUpstream   = "to_upstream"
+)
+
+// Injector sends a frame to "upstream", "downstream", "group:<name>" or,
+// for a response to a client packet, ClientTarget followed by the client ID
+type Injector func(target string, data []byte) error
+
+// ClientTarget prefixes the ID of the client a response to its packet goes
+// back to, so that other clients do not receive it
+const ClientTarget = "client:"
+
+const (
+	// actionQueue is how many webhook calls and MQTT publishes may wait.
+	// Further ones are dropped, so that a busy bus cannot pile up requests.
+	actionQueue = 256
+
+	// actionWorkers run the queued webhook calls and MQTT publishes
+	actionWorkers = 4
+)
+
+// Event is the payload delivered to webhooks and MQTT
+type Event struct {
+	Trigger   string `json:"trigger"`
+	Direction string `json:"direction"`
+	Source    string `json:"source,omitempty"`
+	Data      string `json:"data"`
+	Timestamp string `json:"timestamp"`
+}
+
+// Status reports a rule's activity for the API
+type Status struct {
+	Name      string `json:"name"`
+	Matches   uint64 `json:"matches"`
+	LastFired string `json:"last_fired,omitempty"`
+}
+
+type rule struct {
+	config.TriggerRule
+	prefix    []byte
+	regex     *regexp.Regexp
+	response  []byte
+	cooldown  time.Duration
+	matches   uint64
+	lastFired time.Time
+}
+
+// Engine holds the compiled rules
+type Engine struct {
+	rules     []*rule
+	mu        sync.Mutex
+	logger    *logger.Logger
+	inject    Injector
+	mqttOpts  mqtt.Options
+	mqttMu    sync.Mutex
+	mqttConn  *mqtt.Client
+	webClient *http.Client
+
+	actions   chan func()
+	dropped   atomic.Uint64 // actions dropped since the queue was last full
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewEngine compiles the configured rules. mqttOpts is used lazily for rules
+// that publish to MQTT.
+func NewEngine(rules []config.TriggerRule, inject Injector, mqttOpts mqtt.Options, log *logger.Logger) (*Engine, error) {
+	e := &Engine{
+		logger:    log,
+		inject:    inject,
+		mqttOpts:  mqttOpts,
+		webClient: &http.Client{Timeout: 5 * time.Second},
+		actions:   make(chan func(), actionQueue),
+		stop:      make(chan struct{}),
+	}
+
+	for _, rc := range rules {
+		r := &rule{TriggerRule: rc, cooldown: time.Duration(rc.Cooldown) * time.Second}
+		var err error
+		if rc.HexPrefix != "" {
+			if r.prefix, err = hexutil.Parse(rc.HexPrefix); err != nil {
+				return nil, fmt.Errorf("trigger %q: invalid hex_prefix: %w", rc.Name, err)
+			}
+		}
+		if rc.Regex != "" {
+			if r.regex, err = regexp.Compile(rc.Regex); err != nil {
+				return nil, fmt.Errorf("trigger %q: invalid regex: %w", rc.Name, err)
+			}
+		}
+		if rc.Respond != "" {
+			if r.response, err = hexutil.Parse(rc.Respond); err != nil {
+				return nil, fmt.Errorf("trigger %q: invalid respond: %w", rc.Name, err)
+			}
+		}
+		e.rules = append(e.rules, r)
+	}
+
+	for i := 0; i < actionWorkers; i++ {
+		go e.runQueue()
+	}
+	return e, nil
+}
+
+// runQueue runs queued actions until Close
+func (e *Engine) runQueue() {
+	for {
+		select {
+		case action := <-e.actions:
+			action()
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// queue hands a network action to the workers, dropping it when the queue
+// is full. The first drop is logged, and the count once the queue drains.
+func (e *Engine) queue(name string, action func()) {
+	select {
+	case e.actions <- action:
+		if n := e.dropped.Swap(0); n > 0 {
+			e.logger.Warn("Trigger actions are queued again, %d were dropped", n)
+		}
+	default:
+		if e.dropped.Add(1) == 1 {
+			e.logger.Warn("Trigger %s: action queue full, dropping webhook calls and MQTT publishes", name)
+		}
+	}
+}
+
+// Evaluate runs all matching rules for a packet. It returns false if a
+// matching rule suppresses forwarding of the packet.
+func (e *Engine) Evaluate(direction string, data []byte, source string) bool {
+	if e == nil || len(e.rules) == 0 {
+		return true
+	}
+
+	forward := true
+	var hexStr string
+	for _, r := range e.rules {
+		if r.Direction != "" && r.Direction != direction {
+			continue
+		}
+		if r.prefix != nil && !bytes.HasPrefix(data, r.prefix) {
+			continue
+		}
+		if r.regex != nil {
+			if hexStr == "" {
+				hexStr = hex.EncodeToString(data)
+			}
+			if !r.regex.MatchString(hexStr) {
+				continue
+			}
+		}
+
+		if r.Suppress {
+			forward = false
+		}
+
+		if !e.fire(r) {
+			continue
+		}
+		e.runActions(r, direction, data, source)
+	}
+	return forward
+}
+
+// fire records a match and reports whether the rule is outside its cooldown
+func (e *Engine) fire(r *rule) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	r.matches++
+	if r.cooldown > 0 && now.Sub(r.lastFired) < r.cooldown {
+		return false
+	}
+	r.lastFired = now
+	return true
+}
+
+func (e *Engine) runActions(r *rule, direction string, data []byte, source string) {
+	if r.response != nil {
+		// Reply to whoever sent the matching packet, unless the rule names
+		// a target: the device, or only the client that sent it
+		target := r.Target
+		switch {
+		case target != "":
+		case direction == ToUpstream && source != "":
+			target = ClientTarget + source
+		case direction == ToUpstream:
+			target = "downstream"
+		default:
+			target = "upstream"
+		}
+		if err := e.inject(target, r.response); err != nil {
+			e.logger.Warn("Trigger %s: failed to send response: %v", r.Name, err)
+		}
+	}
+
+	if r.Alert {
+		e.logger.Warn("Trigger alert %s: %s packet %x from %s", r.Name, direction, data, sourceOrDevice(source))
+	}
+
+	if r.Webhook == "" && r.MQTTTopic == "" {
+		return
+	}
+
+	event := Event{
+		Trigger:   r.Name,
+		Direction: direction,
+		Source:    source,
+		Data:      hex.EncodeToString(data),
+		Timestamp: time.Now().Format(time.RFC3339Nano),
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	// Network actions run on the workers to keep the forwarding path fast
+	if r.Webhook != "" {
+		e.queue(r.Name, func() { e.callWebhook(r.Name, r.Webhook, payload) })
+	}
+	if r.MQTTTopic != "" {
+		e.queue(r.Name, func() { e.publishMQTT(r.Name, r.MQTTTopic, payload) })
+	}
+}
+
+func (e *Engine) callWebhook(name, url string, payload []byte) {
+	resp, err := e.webClient.Post(url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		e.logger.Warn("Trigger %s: webhook failed: %v", name, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		e.logger.Warn("Trigger %s: webhook returned status %d", name, resp.StatusCode)
+	}
+}
+
+func (e *Engine) publishMQTT(name, topic string, payload []byte) {
+	e.mqttMu.Lock()
+	defer e.mqttMu.Unlock()
+
+	if e.mqttConn != nil {
+		select {
+		case <-e.mqttConn.Done():
+			e.mqttConn = nil
+		default:
+		}
+	}
+
+	if e.mqttConn == nil {
+		if e.mqttOpts.Broker == "" {
+			e.logger.Warn("Trigger %s: MQTT_BROKER is not configured", name)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		opts := e.mqttOpts
+		opts.ClientID += "-triggers"
+		client, err := mqtt.Dial(ctx, opts)
+		if err != nil {
+			e.logger.Warn("Trigger %s: MQTT connect failed: %v", name, err)
+			return
+		}
+		e.mqttConn = client
+	}
+
+	if err := e.mqttConn.Publish(topic, payload, false); err != nil {
+		e.logger.Warn("Trigger %s: MQTT publish failed: %v", name, err)
+	}
+}
+
+// Status returns per-rule match statistics
+func (e *Engine) Status() []Status {
+	if e == nil {
+		return []Status{}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	result := make([]Status, 0, len(e.rules))
+	for _, r := range e.rules {
+		st := Status{Name: r.Name, Matches: r.matches}
+		if !r.lastFired.IsZero() {
+			st.LastFired = r.lastFired.Format(time.RFC3339)
+		}
+		result = append(result, st)
+	}
+	return result
+}
+
+// Close stops the action workers, dropping queued actions, and releases
+// the MQTT connection, if any
+func (e *Engine) Close() {
+	if e == nil {
+		return
+	}
+	e.closeOnce.Do(func() { close(e.stop) })
+	e.mqttMu.Lock()
+	defer e.mqttMu.Unlock()
+	if e.mqttConn != nil {
+		e.mqttConn.Close()
+		e.mqttConn = nil
+	}
+}
+
+func sourceOrDevice(source string) string {
+	if source == "" {
+		return "device"
+	}
+	return source
+}
+
+// ClientID returns the client a target made with ClientTarget names
+func ClientID(target string) (string, bool) {
+	return strings.CutPrefix(target, ClientTarget)
+}
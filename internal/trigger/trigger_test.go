@@ -0,0 +1,198 @@
+package trigger
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/mqtt"
+)
+
+func newTestLogger() *logger.Logger {
+	log, _ := logger.New(false, "")
+	log.SetOutput(io.Discard)
+	return log
+}
+
+type injected struct {
+	target string
+	data   []byte
+}
+
+type recorder struct {
+	mu    sync.Mutex
+	calls []injected
+}
+
+func (r *recorder) inject(target string, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, injected{target, data})
+	return nil
+}
+
+func TestEngine_RespondToPoll(t *testing.T) {
+	rec := &recorder{}
+	engine, err := NewEngine([]config.TriggerRule{{
+		Name:      "poll",
+		Direction: FromUpstream,
+		HexPrefix: "f7 0e",
+		Respond:   "f7 0e 80",
+	}}, rec.inject, mqtt.Options{}, newTestLogger())
+	if err != nil {
+		t.Fatalf("NewEngine failed: %v", err)
+	}
+
+	if !engine.Evaluate(FromUpstream, []byte{0xf7, 0x0e, 0x01}, "") {
+		t.Error("Expected packet to be forwarded")
+	}
+	engine.Evaluate(FromUpstream, []byte{0xf7, 0x12}, "")
+	engine.Evaluate(ToUpstream, []byte{0xf7, 0x0e, 0x01}, "client#1")
+
+	if len(rec.calls) != 1 {
+		t.Fatalf("Expected 1 response, got %d", len(rec.calls))
+	}
+	if rec.calls[0].target != "upstream" || string(rec.calls[0].data) != string([]byte{0xf7, 0x0e, 0x80}) {
+		t.Errorf("Unexpected response %s %x", rec.calls[0].target, rec.calls[0].data)
+	}
+
+	status := engine.Status()
+	if len(status) != 1 || status[0].Matches != 1 {
+		t.Errorf("Expected 1 match, got %+v", status)
+	}
+}
+
+func TestEngine_RespondToTarget(t *testing.T) {
+	rec := &recorder{}
+	engine, err := NewEngine([]config.TriggerRule{{
+		Name:      "status",
+		Direction: FromUpstream,
+		HexPrefix: "f7 0e",
+		Respond:   "f7 0e 80",
+		Target:    "group:dashboards",
+	}}, rec.inject, mqtt.Options{}, newTestLogger())
+	if err != nil {
+		t.Fatalf("NewEngine failed: %v", err)
+	}
+
+	engine.Evaluate(FromUpstream, []byte{0xf7, 0x0e, 0x01}, "")
+	if len(rec.calls) != 1 || rec.calls[0].target != "group:dashboards" {
+		t.Errorf("Expected a response to group:dashboards, got %+v", rec.calls)
+	}
+}
+
+func TestEngine_RegexSuppressAndCooldown(t *testing.T) {
+	rec := &recorder{}
+	engine, err := NewEngine([]config.TriggerRule{{
+		Name:     "client-poll",
+		Regex:    "^aa..cc$",
+		Respond:  "01",
+		Suppress: true,
+		Cooldown: 60,
+	}}, rec.inject, mqtt.Options{}, newTestLogger())
+	if err != nil {
+		t.Fatalf("NewEngine failed: %v", err)
+	}
+
+	if engine.Evaluate(ToUpstream, []byte{0xaa, 0xbb, 0xcc}, "client#1") {
+		t.Error("Expected matching packet to be suppressed")
+	}
+	engine.Evaluate(ToUpstream, []byte{0xaa, 0x00, 0xcc}, "client#1")
+
+	if len(rec.calls) != 1 {
+		t.Fatalf("Expected cooldown to limit responses to 1, got %d", len(rec.calls))
+	}
+	if id, ok := ClientID(rec.calls[0].target); !ok || id != "client#1" {
+		t.Errorf("Expected response to go back to client#1, got %s", rec.calls[0].target)
+	}
+
+	if status := engine.Status(); status[0].Matches != 2 {
+		t.Errorf("Expected 2 matches, got %d", status[0].Matches)
+	}
+}
+
+func TestEngine_Webhook(t *testing.T) {
+	events := make(chan Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev Event
+		_ = json.NewDecoder(r.Body).Decode(&ev)
+		events <- ev
+	}))
+	defer srv.Close()
+
+	engine, err := NewEngine([]config.TriggerRule{{
+		Name:    "alarm",
+		Webhook: srv.URL,
+	}}, (&recorder{}).inject, mqtt.Options{}, newTestLogger())
+	if err != nil {
+		t.Fatalf("NewEngine failed: %v", err)
+	}
+
+	engine.Evaluate(FromUpstream, []byte{0x01, 0x02}, "")
+
+	select {
+	case ev := <-events:
+		if ev.Trigger != "alarm" || ev.Data != "0102" || ev.Direction != FromUpstream {
+			t.Errorf("Unexpected event %+v", ev)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for webhook")
+	}
+}
+
+func TestEngine_ActionQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+	}))
+	defer srv.Close()
+
+	engine, err := NewEngine([]config.TriggerRule{{
+		Name:    "busy",
+		Webhook: srv.URL,
+	}}, (&recorder{}).inject, mqtt.Options{}, newTestLogger())
+	if err != nil {
+		t.Fatalf("NewEngine failed: %v", err)
+	}
+
+	// Stuck webhooks hold the workers; matches beyond the queue are dropped
+	// instead of starting more requests
+	sent := actionQueue + actionWorkers + 50
+	for i := 0; i < sent; i++ {
+		engine.Evaluate(FromUpstream, []byte{0x01}, "")
+	}
+	if dropped := engine.dropped.Load(); dropped < 50 {
+		t.Errorf("Expected at least 50 actions dropped, got %d", dropped)
+	}
+
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	engine.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if calls > actionQueue+actionWorkers {
+		t.Errorf("Expected at most %d webhook calls, got %d", actionQueue+actionWorkers, calls)
+	}
+}
+
+func TestEngine_NilIsNoop(t *testing.T) {
+	var engine *Engine
+	if !engine.Evaluate(FromUpstream, []byte{0x01}, "") {
+		t.Error("Expected nil engine to forward packets")
+	}
+	if len(engine.Status()) != 0 {
+		t.Error("Expected empty status for nil engine")
+	}
+	engine.Close()
+}
@@ -0,0 +1,122 @@
+package upstream
+
+import (
+	"errors"
+	"net"
+	"os"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/rfc2217"
+)
+
+// Protocols told apart by UPSTREAM_DETECT
+const (
+	ProtocolRaw     = "raw"     // the serial data as is
+	ProtocolTelnet  = "telnet"  // Telnet without serial control
+	ProtocolRFC2217 = "rfc2217" // Telnet with the Com Port Control Option
+)
+
+// detectWindow is how long a new connection is watched for the server to
+// open Telnet negotiation, and then how long it may take to answer the
+// Com Port Control Option
+const detectWindow = time.Second
+
+// SetDetectProtocol enables telling raw TCP, Telnet and RFC 2217 device
+// servers apart on connect, for host:port and tcp:// addresses
+func (u *Connection) SetDetectProtocol(enabled bool) {
+	u.detect = enabled
+}
+
+// Protocol returns the protocol detected on the current connection, or ""
+// if detection is off or the upstream is disconnected
+func (u *Connection) Protocol() string {
+	u.connMu.RLock()
+	defer u.connMu.RUnlock()
+	return u.protocol
+}
+
+// dialDetect connects to host and watches what the server sends first.
+// Nothing, or data that is not Telnet negotiation, means raw TCP; nothing
+// is ever sent to such a server, so the serial line sees no probe bytes.
+// A Telnet server is then asked for the Com Port Control Option.
+func (u *Connection) dialDetect(host string) (net.Conn, string, error) {
+	raw, err := u.dialTCP(host)
+	if err != nil {
+		return nil, "", err
+	}
+
+	seen, err := readUntil(raw, nil, time.Now().Add(detectWindow), func(b []byte) bool { return len(b) >= 2 })
+	if err != nil {
+		raw.Close()
+		return nil, "", err
+	}
+	if len(seen) == 0 {
+		return raw, ProtocolRaw, nil
+	}
+	if !rfc2217.IsTelnet(seen) {
+		return &prefixConn{Conn: raw, prefix: seen}, ProtocolRaw, nil
+	}
+
+	if answered, _ := rfc2217.ComPortAnswer(seen); !answered {
+		if _, err := raw.Write(rfc2217.OfferComPort()); err != nil {
+			raw.Close()
+			return nil, "", err
+		}
+		seen, err = readUntil(raw, seen, time.Now().Add(detectWindow), func(b []byte) bool {
+			answered, _ := rfc2217.ComPortAnswer(b)
+			return answered
+		})
+		if err != nil {
+			raw.Close()
+			return nil, "", err
+		}
+	}
+
+	// What was read so far is decoded again by the Telnet connection, so
+	// its negotiation is answered and its data passed on
+	conn := rfc2217.NewConn(&prefixConn{Conn: raw, prefix: seen})
+	protocol, start := ProtocolTelnet, conn.StartTelnet
+	if _, supported := rfc2217.ComPortAnswer(seen); supported {
+		// Settings are only queried; rfc2217:// addresses set them
+		protocol, start = ProtocolRFC2217, func() error { return conn.Start(rfc2217.Params{}) }
+	}
+	if err := start(); err != nil {
+		raw.Close()
+		return nil, "", err
+	}
+	return conn, protocol, nil
+}
+
+// readUntil appends what conn sends to buf until done reports true or the
+// deadline passes. Reaching the deadline is not an error.
+func readUntil(conn net.Conn, buf []byte, deadline time.Time, done func([]byte) bool) ([]byte, error) {
+	defer conn.SetReadDeadline(time.Time{})
+	chunk := make([]byte, 512)
+	for !done(buf) {
+		_ = conn.SetReadDeadline(deadline)
+		n, err := conn.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return buf, nil
+		}
+		if err != nil {
+			return buf, err
+		}
+	}
+	return buf, nil
+}
+
+// prefixConn returns the bytes read while detecting before reading on
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,90 @@
+package upstream
+
+import (
+	"net"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/rfc2217"
+)
+
+// Quirks are workarounds for firmware serial bridges such as Tasmota and
+// ESP-Link, selected with UPSTREAM_QUIRKS
+type Quirks struct {
+	Banner bool // discard what the bridge sends during bannerWindow after connecting
+	Telnet bool // strip Telnet negotiation on host:port and tcp:// addresses without answering it
+	OTA    bool // retry every second during otaWindow after the connection drops
+}
+
+const (
+	// bannerWindow is how long after connecting a bridge's boot messages
+	// and the noise of its UART starting up are discarded
+	bannerWindow = 2 * time.Second
+
+	// otaWindow covers a bridge rebooting after a firmware update, during
+	// which reconnecting does not back off
+	otaWindow = 2 * time.Minute
+)
+
+// SetQuirks enables workarounds for firmware serial bridges. It must be
+// called before Start.
+func (u *Connection) SetQuirks(q Quirks) {
+	u.quirks = q
+}
+
+// retryFast reports whether a failed attempt is retried after a second
+// instead of backing off, lost being when the last connection dropped
+func (q Quirks) retryFast(lost time.Time) bool {
+	return q.OTA && !lost.IsZero() && time.Since(lost) < otaWindow
+}
+
+// bannerFilter drops reads during bannerWindow after connecting
+type bannerFilter struct {
+	until time.Time // zero without the banner quirk
+}
+
+func (q Quirks) bannerFilter() bannerFilter {
+	if !q.Banner {
+		return bannerFilter{}
+	}
+	return bannerFilter{until: time.Now().Add(bannerWindow)}
+}
+
+// drop reports whether data just read is part of the banner
+func (b bannerFilter) drop(data []byte, log *logger.Logger) bool {
+	if b.until.IsZero() || !time.Now().Before(b.until) {
+		return false
+	}
+	log.Info("Discarded %d bytes sent by the bridge after connecting (banner quirk)", len(data))
+	return true
+}
+
+// telnetConn strips the Telnet commands a bridge sends without answering
+// them, and escapes IAC bytes written to it
+type telnetConn struct {
+	net.Conn
+	filter rfc2217.Filter
+	raw    []byte
+}
+
+func (c *telnetConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if len(c.raw) < len(b) {
+		c.raw = make([]byte, len(b))
+	}
+	for {
+		n, err := c.Conn.Read(c.raw[:len(b)])
+		if out := c.filter.Strip(c.raw[:n], b); out > 0 || err != nil {
+			return out, err
+		}
+	}
+}
+
+func (c *telnetConn) Write(b []byte) (int, error) {
+	if _, err := c.Conn.Write(rfc2217.Escape(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,149 @@
+package upstream
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/rfc2217"
+)
+
+// ErrNoSerialControl is returned for upstreams that cannot change serial
+// line settings
+var ErrNoSerialControl = errors.New("upstream does not support serial control")
+
+// SerialStatus describes the serial line settings of an RFC 2217 upstream
+type SerialStatus struct {
+	Settings rfc2217.Params  `json:"settings"`           // requested, applied on every connect
+	Reported *rfc2217.Params `json:"reported,omitempty"` // confirmed by the device server
+}
+
+// serialParams returns the settings from an rfc2217:// address, or nil for
+// other transports. The address was validated when the config was loaded.
+func serialParams(addr string) *rfc2217.Params {
+	target, err := url.Parse(addr)
+	if err != nil || target.Scheme != "rfc2217" {
+		return nil
+	}
+	p, _ := rfc2217.ParseQuery(target.Query())
+	return &p
+}
+
+// dialRFC2217 connects to a device server and sends the requested settings
+func (u *Connection) dialRFC2217(host string) (net.Conn, error) {
+	raw, err := u.dialTCP(host)
+	if err != nil {
+		return nil, err
+	}
+	conn := rfc2217.NewConn(raw)
+	if err := conn.Start(u.requestedSerial()); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (u *Connection) requestedSerial() rfc2217.Params {
+	u.serialMu.Lock()
+	defer u.serialMu.Unlock()
+	return *u.serial
+}
+
+func (u *Connection) serialConn() *rfc2217.Conn {
+	u.connMu.RLock()
+	defer u.connMu.RUnlock()
+	conn, _ := u.conn.(*rfc2217.Conn)
+	return conn
+}
+
+// SerialStatus returns the requested and reported serial line settings
+func (u *Connection) SerialStatus() (SerialStatus, error) {
+	if u.serial == nil {
+		return SerialStatus{}, ErrNoSerialControl
+	}
+	st := SerialStatus{Settings: u.requestedSerial()}
+	if conn := u.serialConn(); conn != nil {
+		reported := conn.Reported()
+		st.Reported = &reported
+	}
+	return st, nil
+}
+
+// SetSerialParams changes the serial line settings set in p. They are sent
+// to the device server right away if connected, and again on every
+// reconnect.
+func (u *Connection) SetSerialParams(p rfc2217.Params) (SerialStatus, error) {
+	if u.serial == nil {
+		return SerialStatus{}, ErrNoSerialControl
+	}
+	if err := p.Validate(); err != nil {
+		return SerialStatus{}, err
+	}
+
+	u.serialMu.Lock()
+	*u.serial = u.serial.Merge(p)
+	st := SerialStatus{Settings: *u.serial}
+	u.serialMu.Unlock()
+
+	u.logger.Info("Serial settings changed: %+v", st.Settings)
+
+	conn := u.serialConn()
+	if conn == nil {
+		return st, nil
+	}
+	reported, err := conn.Configure(p)
+	st.Reported = &reported
+	return st, err
+}
+
+// Lines returns the modem control lines of an RFC 2217 upstream. It
+// returns net.ErrClosed while disconnected.
+func (u *Connection) Lines() (rfc2217.Lines, error) {
+	if u.serial == nil {
+		return rfc2217.Lines{}, ErrNoSerialControl
+	}
+	conn := u.serialConn()
+	if conn == nil {
+		return rfc2217.Lines{}, net.ErrClosed
+	}
+	return conn.Lines(), nil
+}
+
+// LineErrors returns the receive errors the device server of an RFC 2217
+// upstream reported on the current connection. It returns net.ErrClosed
+// while disconnected.
+func (u *Connection) LineErrors() (rfc2217.LineErrors, error) {
+	if u.serial == nil {
+		return rfc2217.LineErrors{}, ErrNoSerialControl
+	}
+	conn := u.serialConn()
+	if conn == nil {
+		return rfc2217.LineErrors{}, net.ErrClosed
+	}
+	return conn.LineErrors(), nil
+}
+
+// SetLines sets DTR and/or RTS on an RFC 2217 upstream
+func (u *Connection) SetLines(update rfc2217.LineUpdate) (rfc2217.Lines, error) {
+	if u.serial == nil {
+		return rfc2217.Lines{}, ErrNoSerialControl
+	}
+	conn := u.serialConn()
+	if conn == nil {
+		return rfc2217.Lines{}, net.ErrClosed
+	}
+	return conn.SetLines(update)
+}
+
+// SendBreak sends a break of length d on an RFC 2217 upstream
+func (u *Connection) SendBreak(d time.Duration) error {
+	if u.serial == nil {
+		return ErrNoSerialControl
+	}
+	conn := u.serialConn()
+	if conn == nil {
+		return net.ErrClosed
+	}
+	return conn.SendBreak(d)
+}
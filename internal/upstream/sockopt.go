@@ -0,0 +1,56 @@
+package upstream
+
+import (
+	"net"
+	"time"
+)
+
+// TCPOptions tune how quickly a TCP peer that stopped answering is
+// detected and how its traffic is marked for QoS. Zero fields keep the
+// system defaults.
+type TCPOptions struct {
+	// UserTimeout is how long sent data may remain unacknowledged before
+	// the connection fails (TCP_USER_TIMEOUT, Linux only)
+	UserTimeout time.Duration
+	// KeepAliveIdle is how long the connection may be idle before the
+	// first keepalive probe
+	KeepAliveIdle time.Duration
+	// KeepAliveInterval is the time between probes (Linux only)
+	KeepAliveInterval time.Duration
+	// KeepAliveCount is how many unanswered probes fail the connection
+	// (Linux only)
+	KeepAliveCount int
+	// DSCP marks outgoing packets with this Differentiated Services code
+	// point, 0-63 (IP_TOS or IPV6_TCLASS, Linux only)
+	DSCP int
+	// Priority is the queueing priority of outgoing packets on the host,
+	// 0-6 (SO_PRIORITY, Linux only)
+	Priority int
+}
+
+// SetTCPOptions sets the socket options applied to TCP upstream
+// connections, including the one under rfc2217://. It must be called
+// before Start.
+func (u *Connection) SetTCPOptions(o TCPOptions) {
+	u.tcpOpts = o
+}
+
+// SetSocketOptions applies o to another TCP connection, such as an
+// accepted client
+func SetSocketOptions(conn *net.TCPConn, o TCPOptions) error {
+	return setTCPOptions(conn, o)
+}
+
+// dialTCP opens a TCP connection with the configured socket options
+func (u *Connection) dialTCP(addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok && u.tcpOpts != (TCPOptions{}) {
+		if err := setTCPOptions(tcp, u.tcpOpts); err != nil {
+			u.logger.Warn("Failed to set TCP options on upstream: %v", err)
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,49 @@
+//go:build linux
+
+package upstream
+
+import (
+	"net"
+	"syscall"
+)
+
+// tcpUserTimeout is TCP_USER_TIMEOUT, which package syscall does not define
+const tcpUserTimeout = 0x12
+
+func setTCPOptions(conn *net.TCPConn, o TCPOptions) error {
+	if o.KeepAliveIdle > 0 {
+		if err := conn.SetKeepAlive(true); err != nil {
+			return err
+		}
+	}
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	// The traffic class is set per address family; IP_TOS also applies to
+	// IPv4-mapped addresses on an IPv6 socket
+	tosLevel, tosOpt := syscall.IPPROTO_IP, syscall.IP_TOS
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		tosLevel, tosOpt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+
+	var sockErr error
+	set := func(fd uintptr, level, opt, value int) {
+		if sockErr == nil && value > 0 {
+			sockErr = syscall.SetsockoptInt(int(fd), level, opt, value)
+		}
+	}
+	err = rc.Control(func(fd uintptr) {
+		set(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, int(o.KeepAliveIdle.Seconds()))
+		set(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, int(o.KeepAliveInterval.Seconds()))
+		set(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, o.KeepAliveCount)
+		set(fd, syscall.IPPROTO_TCP, tcpUserTimeout, int(o.UserTimeout.Milliseconds()))
+		set(fd, tosLevel, tosOpt, o.DSCP<<2)
+		set(fd, syscall.SOL_SOCKET, syscall.SO_PRIORITY, o.Priority)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,64 @@
+//go:build linux
+
+package upstream
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestConnection_TCPOptions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	conn := NewConnection(ln.Addr().String(), newTestLogger(), nil)
+	conn.SetTCPOptions(TCPOptions{
+		UserTimeout:       5 * time.Second,
+		KeepAliveIdle:     10 * time.Second,
+		KeepAliveInterval: 2 * time.Second,
+		KeepAliveCount:    3,
+		DSCP:              46,
+		Priority:          5,
+	})
+	c, err := conn.dialTCP(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer c.Close()
+
+	rc, err := c.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("Failed to get raw connection: %v", err)
+	}
+	tests := []struct {
+		name     string
+		level    int
+		opt      int
+		expected int
+	}{
+		{"SO_KEEPALIVE", syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1},
+		{"TCP_KEEPIDLE", syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, 10},
+		{"TCP_KEEPINTVL", syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, 2},
+		{"TCP_KEEPCNT", syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, 3},
+		{"TCP_USER_TIMEOUT", syscall.IPPROTO_TCP, tcpUserTimeout, 5000},
+		{"IP_TOS", syscall.IPPROTO_IP, syscall.IP_TOS, 46 << 2},
+		{"SO_PRIORITY", syscall.SOL_SOCKET, syscall.SO_PRIORITY, 5},
+	}
+	rc.Control(func(fd uintptr) {
+		for _, tt := range tests {
+			got, err := syscall.GetsockoptInt(int(fd), tt.level, tt.opt)
+			if err != nil {
+				t.Errorf("Failed to read %s: %v", tt.name, err)
+				continue
+			}
+			if got != tt.expected {
+				t.Errorf("Expected %s=%d, got %d", tt.name, tt.expected, got)
+			}
+		}
+	})
+}
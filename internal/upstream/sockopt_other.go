@@ -0,0 +1,17 @@
+//go:build !linux
+
+package upstream
+
+import "net"
+
+// setTCPOptions applies the keepalive idle time; the other options,
+// including QoS marking, need Linux
+func setTCPOptions(conn *net.TCPConn, o TCPOptions) error {
+	if o.KeepAliveIdle <= 0 {
+		return nil
+	}
+	if err := conn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return conn.SetKeepAlivePeriod(o.KeepAliveIdle)
+}
@@ -3,19 +3,22 @@ package upstream
 import (
 	"context"
 	"net"
+	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/hoon-ch/serial-tcp-proxy/internal/bufpool"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/fec"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/rfc2217"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/transport"
 )
 
 // Buffer pool for zero-copy packet forwarding
-var bufferPool = sync.Pool{
-	New: func() interface{} {
-		buf := make([]byte, 4096)
-		return &buf
-	},
-}
+var bufferPool = bufpool.New("upstream-read", 4096)
 
 type ConnectionState int
 
@@ -24,6 +27,7 @@ const (
 	StateConnecting
 	StateConnected
 	StateStopped
+	StateParked // closed on request until unparked
 )
 
 func (s ConnectionState) String() string {
@@ -36,13 +40,20 @@ func (s ConnectionState) String() string {
 		return "Connected"
 	case StateStopped:
 		return "Stopped"
+	case StateParked:
+		return "Parked"
 	default:
 		return "Unknown"
 	}
 }
 
+// Dialer opens a custom upstream transport. It is used instead of the
+// address-based transport selection when set via SetDialer.
+type Dialer func(ctx context.Context) (net.Conn, error)
+
 type Connection struct {
 	addr          string
+	dialer        Dialer
 	conn          net.Conn
 	connMu        sync.RWMutex
 	writeMu       sync.Mutex
@@ -50,29 +61,59 @@ type Connection struct {
 	stateMu       sync.RWMutex
 	logger        *logger.Logger
 	onData        func([]byte)
+	onFrame       func(*bufpool.Frame)
+	onConnect     func()
+	onState       func(ConnectionState)
 	ctx           context.Context
 	cancel        context.CancelFunc
 	wg            sync.WaitGroup
 	lastConnected time.Time
 	lastConnMu    sync.RWMutex
+	connects      atomic.Uint64
+	failures      atomic.Uint64   // connection attempts failed since the last connect
+	session       string          // guarded by connMu
+	sessionLog    *logger.Logger  // guarded by connMu
+	serial        *rfc2217.Params // rfc2217:// only, guarded by serialMu
+	serialMu      sync.Mutex
+	readTimeout   atomic.Int64 // time.Duration, 0 = none
+	tcpOpts       TCPOptions
+	parked        atomic.Bool
+	wake          chan struct{} // signals a change of parked
+	detect        bool          // UPSTREAM_DETECT
+	detected      string        // protocol found by the last dial, used by the connection loop only
+	protocol      string        // of the current connection, guarded by connMu
+	quirks        Quirks        // UPSTREAM_QUIRKS
 }
 
+// DefaultReadTimeout is how long the upstream may stay silent before the
+// connection is considered dead and re-established
+const DefaultReadTimeout = time.Minute
+
 func NewConnection(addr string, log *logger.Logger, onData func([]byte)) *Connection {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Connection{
+	u := &Connection{
 		addr:   addr,
 		logger: log,
 		onData: onData,
 		ctx:    ctx,
 		cancel: cancel,
 		state:  StateDisconnected,
+		serial: serialParams(addr),
+		wake:   make(chan struct{}, 1),
 	}
+	u.readTimeout.Store(int64(DefaultReadTimeout))
+	return u
 }
 
 func (u *Connection) setState(state ConnectionState) {
 	u.stateMu.Lock()
+	changed := u.state != state
 	u.state = state
 	u.stateMu.Unlock()
+
+	if changed && u.onState != nil {
+		u.onState(state)
+	}
 }
 
 func (u *Connection) GetState() ConnectionState {
@@ -91,16 +132,128 @@ func (u *Connection) GetLastConnected() time.Time {
 	return u.lastConnected
 }
 
+// GetReconnectCount returns how many times the connection was re-established
+// after the initial connect
+func (u *Connection) GetReconnectCount() uint64 {
+	if n := u.connects.Load(); n > 1 {
+		return n - 1
+	}
+	return 0
+}
+
+// ConsecutiveFailures returns how many connection attempts failed in a row
+// since the upstream was last connected or parked
+func (u *Connection) ConsecutiveFailures() uint64 {
+	return u.failures.Load()
+}
+
+// Session returns the session ID and generation of the current connection.
+// The ID is empty while disconnected.
+func (u *Connection) Session() (string, uint64) {
+	u.connMu.RLock()
+	defer u.connMu.RUnlock()
+	return u.session, u.connects.Load()
+}
+
+// Log returns a logger tagged with the current connection's session, or
+// the plain logger while disconnected
+func (u *Connection) Log() *logger.Logger {
+	u.connMu.RLock()
+	defer u.connMu.RUnlock()
+	if u.sessionLog != nil {
+		return u.sessionLog
+	}
+	return u.logger
+}
+
 func (u *Connection) GetAddr() string {
 	return u.addr
 }
 
-func (u *Connection) Start() {
+// SetDialer overrides how the upstream transport is opened. It must be
+// called before Start.
+func (u *Connection) SetDialer(d Dialer) {
+	u.dialer = d
+}
+
+// SetOnConnect registers a callback run in its own goroutine each time the
+// connection is (re)established. It must be called before Start.
+func (u *Connection) SetOnConnect(fn func()) {
+	u.onConnect = fn
+}
+
+// SetOnFrame registers a callback receiving each read in a pooled frame
+// instead of a copy passed to onData. The frame is released when the
+// callback returns; the callback retains it to keep the data. It must be
+// called before Start.
+func (u *Connection) SetOnFrame(fn func(*bufpool.Frame)) {
+	u.onFrame = fn
+}
+
+// SetOnStateChange registers a callback invoked on every state change. It
+// must be called before Start.
+func (u *Connection) SetOnStateChange(fn func(ConnectionState)) {
+	u.onState = fn
+}
+
+// SetReadTimeout changes how long the upstream may stay silent before it is
+// reconnected. Zero disables the timeout. It applies to the current
+// connection right away.
+func (u *Connection) SetReadTimeout(d time.Duration) {
+	u.readTimeout.Store(int64(d))
+
+	u.connMu.RLock()
+	defer u.connMu.RUnlock()
+	if u.conn != nil {
+		_ = u.conn.SetReadDeadline(u.readDeadline())
+	}
+}
+
+// readDeadline returns the deadline for the next read
+func (u *Connection) readDeadline() time.Time {
+	if d := time.Duration(u.readTimeout.Load()); d > 0 {
+		return time.Now().Add(d)
+	}
+	return time.Time{}
+}
+
+// SetParked closes the connection and keeps it closed until unparked, so
+// that another program can connect to the device. It may be called before
+// Start.
+func (u *Connection) SetParked(parked bool) {
+	u.parked.Store(parked)
+	if parked {
+		u.connMu.RLock()
+		if u.conn != nil {
+			u.conn.Close()
+		}
+		u.connMu.RUnlock()
+	}
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// IsParked reports whether the connection is parked
+func (u *Connection) IsParked() bool {
+	return u.parked.Load()
+}
+
+// Start connects in the background and keeps reconnecting until Stop. It
+// fails only if ctx is already done.
+func (u *Connection) Start(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	u.wg.Add(1)
 	go u.connectionLoop()
+	return nil
 }
 
-func (u *Connection) Stop() {
+// Stop closes the connection and waits until ctx is done for the
+// connection loop to exit, returning ctx's error if it did not
+func (u *Connection) Stop(ctx context.Context) error {
 	u.setState(StateStopped)
 	u.cancel()
 
@@ -110,8 +263,18 @@ func (u *Connection) Stop() {
 	}
 	u.connMu.Unlock()
 
-	u.wg.Wait()
+	done := make(chan struct{})
+	go func() {
+		u.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	u.logger.Info("Upstream connection stopped")
+	return nil
 }
 
 func (u *Connection) connectionLoop() {
@@ -119,6 +282,7 @@ func (u *Connection) connectionLoop() {
 
 	backoff := time.Second
 	maxBackoff := 30 * time.Second
+	var lost time.Time // when the last connection dropped
 
 	for {
 		select {
@@ -131,19 +295,38 @@ func (u *Connection) connectionLoop() {
 			return
 		}
 
+		if u.parked.Load() {
+			u.setState(StateParked)
+			u.logger.Info("Upstream parked")
+			for u.parked.Load() {
+				select {
+				case <-u.ctx.Done():
+					return
+				case <-u.wake:
+				}
+			}
+			backoff = time.Second
+			u.failures.Store(0)
+		}
+
 		u.setState(StateConnecting)
 		u.logger.Info("Connecting to upstream %s", u.addr)
 
-		conn, err := net.DialTimeout("tcp", u.addr, 10*time.Second)
+		conn, err := u.dial()
 		if err != nil {
 			u.logger.Error("Failed to connect to upstream: %v", err)
+			u.failures.Add(1)
 			u.setState(StateDisconnected)
 
 			select {
 			case <-u.ctx.Done():
 				return
+			case <-u.wake:
+				continue
 			case <-time.After(backoff):
-				backoff = min(backoff*2, maxBackoff)
+				if !u.quirks.retryFast(lost) {
+					backoff = min(backoff*2, maxBackoff)
+				}
 				continue
 			}
 		}
@@ -151,63 +334,152 @@ func (u *Connection) connectionLoop() {
 		// Reset backoff on successful connection
 		backoff = time.Second
 
+		// Each connection generation gets its own session ID
+		gen := u.connects.Add(1)
+		session := logger.NewSessionID()
+		log := u.logger.With("session", session).With("gen", strconv.FormatUint(gen, 10))
+
 		u.connMu.Lock()
+		if u.parked.Load() {
+			// Parked while dialing
+			u.connMu.Unlock()
+			conn.Close()
+			continue
+		}
 		u.conn = conn
+		u.session = session
+		u.sessionLog = log
+		u.protocol, u.detected = u.detected, ""
 		u.connMu.Unlock()
+		u.failures.Store(0)
 		u.setState(StateConnected)
 
 		u.lastConnMu.Lock()
 		u.lastConnected = time.Now()
 		u.lastConnMu.Unlock()
 
-		u.logger.Info("Connected to upstream %s", u.addr)
+		log.Info("Connected to upstream %s", u.addr)
+		if protocol := u.Protocol(); protocol != "" {
+			log.Info("Detected upstream protocol: %s", protocol)
+		}
+
+		if u.onConnect != nil {
+			go u.onConnect()
+		}
 
 		// Read loop
-		u.readLoop(conn)
+		u.readLoop(conn, log)
 
 		// Connection lost
 		u.connMu.Lock()
 		u.conn = nil
+		u.session = ""
+		u.sessionLog = nil
+		u.protocol = ""
 		u.connMu.Unlock()
 
-		if u.GetState() != StateStopped {
+		if u.GetState() != StateStopped && !u.parked.Load() {
 			u.setState(StateDisconnected)
-			u.logger.Warn("Upstream connection lost, reconnecting...")
+			log.Warn("Upstream connection lost, reconnecting...")
+			lost = time.Now()
+			if u.quirks.OTA {
+				log.Info("Retrying every second for %s in case the bridge is rebooting (ota quirk)", otaWindow)
+			}
 		}
 	}
 }
 
-func (u *Connection) readLoop(conn net.Conn) {
-	// Get buffer from pool for zero-copy
-	bufPtr := bufferPool.Get().(*[]byte)
-	buf := *bufPtr
-	defer bufferPool.Put(bufPtr)
+// dial opens the transport selected by the address scheme. Plain host:port
+// addresses (or tcp://) use TCP; ws:// and wss:// consume the stream over a
+// WebSocket; quic:// connects to another proxy's QUIC listener; mux://
+// opens a channel on another proxy's mux listener; rfc2217:// speaks the
+// Telnet Com Port Control Option to a serial device server.
+func (u *Connection) dial() (net.Conn, error) {
+	if u.dialer != nil {
+		ctx, cancel := context.WithTimeout(u.ctx, 10*time.Second)
+		defer cancel()
+		return u.dialer(ctx)
+	}
 
-	for {
-		select {
-		case <-u.ctx.Done():
-			return
-		default:
+	if !strings.Contains(u.addr, "://") {
+		return u.dialPlain(u.addr)
+	}
+
+	target, err := url.Parse(u.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(u.ctx, 10*time.Second)
+	defer cancel()
+
+	switch target.Scheme {
+	case "ws", "wss":
+		return dialWebSocket(ctx, u.addr)
+	case "quic":
+		insecure := target.Query().Get("insecure")
+		depth, err := fec.ParseQuery(target.Query())
+		if err != nil {
+			return nil, err
 		}
+		return transport.DialQUIC(ctx, target.Host, insecure == "1" || insecure == "true", depth)
+	case "mux":
+		insecure := target.Query().Get("insecure")
+		return transport.DialMux(ctx, target.Host, strings.Trim(target.Path, "/"), insecure == "1" || insecure == "true")
+	case "rfc2217":
+		return u.dialRFC2217(target.Host)
+	default:
+		return u.dialPlain(target.Host)
+	}
+}
+
+// dialPlain connects over TCP, detecting the protocol if enabled
+func (u *Connection) dialPlain(host string) (net.Conn, error) {
+	if !u.detect {
+		conn, err := u.dialTCP(host)
+		if err != nil || !u.quirks.Telnet {
+			return conn, err
+		}
+		return &telnetConn{Conn: conn}, nil
+	}
+	conn, protocol, err := u.dialDetect(host)
+	u.detected = protocol
+	return conn, err
+}
 
-		_ = conn.SetReadDeadline(time.Now().Add(time.Minute))
-		n, err := conn.Read(buf)
+// readLoop reads from conn until it fails or is closed. Reads block without
+// a deadline unless a read timeout is set; Stop, parking and the end of
+// the context close conn to end the loop.
+func (u *Connection) readLoop(conn net.Conn, log *logger.Logger) {
+	stop := context.AfterFunc(u.ctx, func() { _ = conn.Close() })
+	defer stop()
+
+	banner := u.quirks.bannerFilter()
+	for {
+		// Each read gets its own frame, shared with whoever retains it
+		f := bufferPool.GetFrame()
+		if deadline := u.readDeadline(); !deadline.IsZero() {
+			_ = conn.SetReadDeadline(deadline)
+		}
+		n, err := conn.Read(f.Bytes())
 		if err != nil {
-			if u.GetState() != StateStopped {
-				u.logger.Warn("Upstream read error: %v", err)
+			f.Release()
+			if u.ctx.Err() == nil && u.GetState() != StateStopped && !u.parked.Load() {
+				log.Warn("Upstream read error: %v", err)
 			}
 			return
 		}
 
-		if n > 0 {
-			// Create a copy for the callback since buffer will be reused
-			data := make([]byte, n)
-			copy(data, buf[:n])
-
-			if u.onData != nil {
-				u.onData(data)
+		if n > 0 && !banner.drop(f.Bytes()[:n], log) {
+			f.Truncate(n)
+			if u.onFrame != nil {
+				u.onFrame(f)
+			} else if u.onData != nil {
+				// Create a copy for the callback since the frame is reused
+				u.onData(append([]byte(nil), f.Bytes()...))
 			}
 		}
+		f.Release()
 	}
 }
 
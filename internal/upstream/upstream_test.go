@@ -1,13 +1,23 @@
 package upstream
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/rfc2217"
+	"github.com/hoon-ch/serial-tcp-proxy/pkg/testutil"
 )
 
 func newTestLogger() *logger.Logger {
@@ -38,6 +48,7 @@ func TestConnectionState_String(t *testing.T) {
 		{StateConnecting, "Connecting"},
 		{StateConnected, "Connected"},
 		{StateStopped, "Stopped"},
+		{StateParked, "Parked"},
 	}
 
 	for _, tt := range tests {
@@ -66,6 +77,22 @@ func TestConnection_SetState(t *testing.T) {
 	}
 }
 
+func TestConnection_OnStateChange(t *testing.T) {
+	log := newTestLogger()
+	conn := NewConnection("127.0.0.1:19999", log, nil)
+
+	var states []ConnectionState
+	conn.SetOnStateChange(func(s ConnectionState) { states = append(states, s) })
+
+	conn.setState(StateConnecting)
+	conn.setState(StateConnecting) // unchanged, not reported
+	conn.setState(StateConnected)
+
+	if len(states) != 2 || states[0] != StateConnecting || states[1] != StateConnected {
+		t.Errorf("Expected [Connecting Connected], got %v", states)
+	}
+}
+
 func TestConnection_ConnectAndReceive(t *testing.T) {
 	// Start mock upstream server
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
@@ -97,8 +124,8 @@ func TestConnection_ConnectAndReceive(t *testing.T) {
 		time.Sleep(100 * time.Millisecond)
 	}()
 
-	conn.Start()
-	defer conn.Stop()
+	_ = conn.Start(context.Background())
+	defer conn.Stop(context.Background())
 
 	// Wait for connection and data
 	time.Sleep(200 * time.Millisecond)
@@ -138,8 +165,8 @@ func TestConnection_Reconnect(t *testing.T) {
 		close(connReady)
 	}()
 
-	conn.Start()
-	defer conn.Stop()
+	_ = conn.Start(context.Background())
+	defer conn.Stop(context.Background())
 
 	// Wait for first connection from server side
 	select {
@@ -224,8 +251,8 @@ func TestConnection_Write(t *testing.T) {
 
 	log := newTestLogger()
 	conn := NewConnection(listener.Addr().String(), log, nil)
-	conn.Start()
-	defer conn.Stop()
+	_ = conn.Start(context.Background())
+	defer conn.Stop(context.Background())
 
 	time.Sleep(100 * time.Millisecond)
 
@@ -272,7 +299,7 @@ func TestConnection_Stop(t *testing.T) {
 
 	log := newTestLogger()
 	conn := NewConnection(listener.Addr().String(), log, nil)
-	conn.Start()
+	_ = conn.Start(context.Background())
 
 	time.Sleep(100 * time.Millisecond)
 
@@ -283,7 +310,7 @@ func TestConnection_Stop(t *testing.T) {
 	// Stop should complete gracefully
 	done := make(chan struct{})
 	go func() {
-		conn.Stop()
+		_ = conn.Stop(context.Background())
 		close(done)
 	}()
 
@@ -298,3 +325,386 @@ func TestConnection_Stop(t *testing.T) {
 		t.Errorf("Expected state=Stopped, got %s", conn.GetState())
 	}
 }
+
+func TestConnection_WebSocket(t *testing.T) {
+	received := make(chan []byte, 1)
+
+	// Start mock WebSocket upstream
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		_ = ws.WriteMessage(websocket.BinaryMessage, []byte{0xf7, 0x0e})
+		_ = ws.WriteMessage(websocket.BinaryMessage, []byte{0x1f})
+
+		_, data, err := ws.ReadMessage()
+		if err == nil {
+			received <- data
+		}
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	var receivedData []byte
+	var mu sync.Mutex
+	onData := func(data []byte) {
+		mu.Lock()
+		receivedData = append(receivedData, data...)
+		mu.Unlock()
+	}
+
+	log := newTestLogger()
+	conn := NewConnection("ws"+strings.TrimPrefix(srv.URL, "http"), log, onData)
+	_ = conn.Start(context.Background())
+	defer conn.Stop(context.Background())
+
+	for i := 0; i < 20; i++ {
+		if conn.IsConnected() {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if !conn.IsConnected() {
+		t.Fatal("Expected WebSocket connection to be established")
+	}
+
+	testData := []byte{0xf7, 0x12, 0x01}
+	if err := conn.Write(testData); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	select {
+	case data := <-received:
+		if string(data) != string(testData) {
+			t.Errorf("Expected %x, got %x", testData, data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timeout waiting for WebSocket frame")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []byte{0xf7, 0x0e, 0x1f}
+	if string(receivedData) != string(expected) {
+		t.Errorf("Expected %x, got %x", expected, receivedData)
+	}
+}
+
+// serveRFC2217 answers every Com Port Control command on c with the value
+// it was sent and reports requested baud rates on bauds
+func serveRFC2217(c net.Conn, bauds chan<- uint32) {
+	buf := make([]byte, 512)
+	var pending []byte
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return
+		}
+		pending = append(pending, buf[:n]...)
+		for {
+			start := bytes.Index(pending, []byte{255, 250, 44})
+			end := bytes.Index(pending, []byte{255, 240})
+			if start < 0 || end < start {
+				break
+			}
+			cmd, value := pending[start+3], pending[start+4:end]
+			if cmd == 1 && len(value) == 4 && binary.BigEndian.Uint32(value) != 0 {
+				bauds <- binary.BigEndian.Uint32(value)
+			}
+			reply := append([]byte{255, 250, 44, cmd + 100}, value...)
+			_, _ = c.Write(append(reply, 255, 240))
+			pending = pending[end+2:]
+		}
+	}
+}
+
+func TestConnection_SerialParams(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer listener.Close()
+
+	bauds := make(chan uint32, 4)
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// Serial data containing an escaped IAC byte
+		_, _ = c.Write([]byte{0x01, 255, 255, 0x02})
+		serveRFC2217(c, bauds)
+	}()
+
+	received := make(chan []byte, 4)
+	conn := NewConnection("rfc2217://"+listener.Addr().String()+"?baud=9600", newTestLogger(), func(data []byte) {
+		received <- data
+	})
+	_ = conn.Start(context.Background())
+	defer conn.Stop(context.Background())
+
+	select {
+	case baud := <-bauds:
+		if baud != 9600 {
+			t.Errorf("Expected 9600 baud on connect, got %d", baud)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for baud rate")
+	}
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, []byte{0x01, 0xFF, 0x02}) {
+			t.Errorf("Expected 01ff02, got %x", data)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for data")
+	}
+
+	st, err := conn.SetSerialParams(rfc2217.Params{BaudRate: 115200, Parity: "even"})
+	if err != nil {
+		t.Fatalf("SetSerialParams failed: %v", err)
+	}
+	if st.Settings.BaudRate != 115200 || st.Settings.Parity != "even" {
+		t.Errorf("Unexpected settings: %+v", st.Settings)
+	}
+	if st.Reported == nil || st.Reported.BaudRate != 115200 || st.Reported.Parity != "even" {
+		t.Errorf("Unexpected reported settings: %+v", st.Reported)
+	}
+
+	if _, err := conn.SetSerialParams(rfc2217.Params{Parity: "sometimes"}); err == nil {
+		t.Error("Expected error for invalid parity")
+	}
+
+	on := true
+	lines, err := conn.SetLines(rfc2217.LineUpdate{DTR: &on})
+	if err != nil {
+		t.Fatalf("SetLines failed: %v", err)
+	}
+	if !lines.DTR || lines.RTS {
+		t.Errorf("Expected DTR on and RTS off, got %+v", lines)
+	}
+}
+
+func TestConnection_SerialParamsUnsupported(t *testing.T) {
+	conn := NewConnection("127.0.0.1:19999", newTestLogger(), nil)
+	if _, err := conn.SerialStatus(); err != ErrNoSerialControl {
+		t.Errorf("Expected ErrNoSerialControl, got %v", err)
+	}
+	if _, err := conn.SetSerialParams(rfc2217.Params{BaudRate: 9600}); err != ErrNoSerialControl {
+		t.Errorf("Expected ErrNoSerialControl, got %v", err)
+	}
+	if _, err := conn.Lines(); err != ErrNoSerialControl {
+		t.Errorf("Expected ErrNoSerialControl, got %v", err)
+	}
+}
+
+func TestConnection_Parked(t *testing.T) {
+	mock := testutil.NewMockUpstream(t)
+	conn := NewConnection(mock.Addr(), newTestLogger(), nil)
+
+	// Parked before Start: no connection is made
+	conn.SetParked(true)
+	_ = conn.Start(context.Background())
+	defer conn.Stop(context.Background())
+	testutil.Eventually(t, func() bool { return conn.GetState() == StateParked }, "connection not parked")
+	time.Sleep(100 * time.Millisecond)
+	if err := conn.Write([]byte{0x01}); err == nil {
+		t.Error("Expected write to fail while parked")
+	}
+
+	conn.SetParked(false)
+	server := mock.WaitConn()
+	testutil.Eventually(t, conn.IsConnected, "connection not established after unparking")
+
+	// Parking closes the open connection and keeps it closed
+	conn.SetParked(true)
+	testutil.Eventually(t, func() bool { return conn.GetState() == StateParked }, "connection not parked")
+	_ = server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the device side to see the close, got %v", err)
+	}
+
+	conn.SetParked(false)
+	mock.WaitConn()
+	testutil.Eventually(t, conn.IsConnected, "connection not re-established after unparking")
+	if conn.IsParked() {
+		t.Error("Expected IsParked=false")
+	}
+}
+
+func TestConnection_ConsecutiveFailures(t *testing.T) {
+	addr := fmt.Sprintf("127.0.0.1:%d", testutil.FreePort(t))
+	conn := NewConnection(addr, newTestLogger(), nil)
+	_ = conn.Start(context.Background())
+	defer conn.Stop(context.Background())
+
+	// Attempts are made at once and after a 1s backoff
+	testutil.Eventually(t, func() bool { return conn.ConsecutiveFailures() >= 2 }, "failures not counted")
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", addr, err)
+	}
+	defer ln.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for !conn.IsConnected() {
+		if time.Now().After(deadline) {
+			t.Fatal("Connection not established")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := conn.ConsecutiveFailures(); n != 0 {
+		t.Errorf("Expected failures reset on connect, got %d", n)
+	}
+}
+
+func TestConnection_DetectProtocol(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		protocol string
+		serve    func(c net.Conn)
+		want     []byte
+	}{
+		{"silent", ProtocolRaw, func(c net.Conn) {
+			time.Sleep(1500 * time.Millisecond)
+			_, _ = c.Write([]byte{0x01, 0xFF})
+		}, []byte{0x01, 0xFF}},
+		{"data first", ProtocolRaw, func(c net.Conn) {
+			_, _ = c.Write([]byte{0xF7, 0x01, 0x02})
+		}, []byte{0xF7, 0x01, 0x02}},
+		{"telnet", ProtocolTelnet, func(c net.Conn) {
+			_, _ = c.Write([]byte{255, 251, 3})
+			offer := make([]byte, 3)
+			if _, err := io.ReadFull(c, offer); err != nil || !bytes.Equal(offer, []byte{255, 251, 44}) {
+				return
+			}
+			_, _ = c.Write([]byte{255, 254, 44, 0x10, 255, 255})
+		}, []byte{0x10, 0xFF}},
+		{"rfc2217", ProtocolRFC2217, func(c net.Conn) {
+			_, _ = c.Write([]byte{255, 253, 44, 0x20})
+			serveRFC2217(c, make(chan uint32, 4))
+		}, []byte{0x20}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to start mock server: %v", err)
+			}
+			defer listener.Close()
+			go func() {
+				c, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				tc.serve(c)
+				time.Sleep(time.Second)
+			}()
+
+			var mu sync.Mutex
+			var received []byte
+			conn := NewConnection(listener.Addr().String(), newTestLogger(), func(data []byte) {
+				mu.Lock()
+				received = append(received, data...)
+				mu.Unlock()
+			})
+			conn.SetDetectProtocol(true)
+			_ = conn.Start(context.Background())
+			defer conn.Stop(context.Background())
+
+			testutil.Eventually(t, func() bool { return conn.Protocol() != "" }, "protocol was not detected")
+			if got := conn.Protocol(); got != tc.protocol {
+				t.Errorf("Expected %s, got %s", tc.protocol, got)
+			}
+			testutil.Eventually(t, func() bool {
+				mu.Lock()
+				defer mu.Unlock()
+				return bytes.Equal(received, tc.want)
+			}, fmt.Sprintf("expected %x from upstream", tc.want))
+		})
+	}
+}
+
+func TestConnection_Quirks(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start mock server: %v", err)
+	}
+	defer listener.Close()
+	sent := make(chan struct{})
+	written := make(chan []byte, 1)
+	go func() {
+		c, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		// Boot messages and Telnet negotiation right after connecting
+		_, _ = c.Write([]byte("\r\nESP-Link starting\r\n"))
+		_, _ = c.Write([]byte{255, 253, 1, 255, 251, 3})
+		time.Sleep(bannerWindow + 500*time.Millisecond)
+		_, _ = c.Write([]byte{0x10, 255, 255, 255, 251, 1, 0x11})
+		close(sent)
+		buf := make([]byte, 16)
+		_ = c.SetReadDeadline(time.Now().Add(testutil.DefaultTimeout))
+		n, _ := c.Read(buf)
+		written <- buf[:n]
+	}()
+
+	var mu sync.Mutex
+	var received []byte
+	conn := NewConnection(listener.Addr().String(), newTestLogger(), func(data []byte) {
+		mu.Lock()
+		received = append(received, data...)
+		mu.Unlock()
+	})
+	conn.SetQuirks(Quirks{Banner: true, Telnet: true})
+	_ = conn.Start(context.Background())
+	defer conn.Stop(context.Background())
+
+	select {
+	case <-sent:
+	case <-time.After(bannerWindow + testutil.DefaultTimeout):
+		t.Fatal("Mock bridge did not connect")
+	}
+	testutil.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) >= 3
+	}, "data after the banner was not received")
+	mu.Lock()
+	if !bytes.Equal(received, []byte{0x10, 0xFF, 0x11}) {
+		t.Errorf("Expected banner and negotiation stripped, got % X", received)
+	}
+	mu.Unlock()
+
+	// The negotiation is not answered; written IAC bytes are escaped
+	if err := conn.Write([]byte{0xFF}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if got := <-written; !bytes.Equal(got, []byte{0xFF, 0xFF}) {
+		t.Errorf("Expected only the escaped write, got % X", got)
+	}
+}
+
+func TestQuirks_RetryFast(t *testing.T) {
+	ota := Quirks{OTA: true}
+	if ota.retryFast(time.Time{}) {
+		t.Error("Expected backoff before any connection dropped")
+	}
+	if !ota.retryFast(time.Now().Add(-time.Minute)) {
+		t.Error("Expected fast retries a minute after the connection dropped")
+	}
+	if ota.retryFast(time.Now().Add(-otaWindow)) {
+		t.Error("Expected backoff once the window has passed")
+	}
+	if (Quirks{}).retryFast(time.Now()) {
+		t.Error("Expected backoff without the ota quirk")
+	}
+}
@@ -0,0 +1,249 @@
+// Package values extracts named numeric and string values from frames
+// according to declarative rules.
+package values
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/hexutil"
+)
+
+// Value is the latest extracted value of a rule. Numeric types produce a
+// float64, string and hex types a string.
+type Value struct {
+	Name      string      `json:"name"`
+	Value     interface{} `json:"value"`
+	Unit      string      `json:"unit,omitempty"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	Stale     bool        `json:"stale,omitempty"`
+}
+
+type rule struct {
+	config.ValueRule
+	match      []byte
+	length     int
+	staleAfter time.Duration
+	order      binary.ByteOrder
+	scale      float64
+}
+
+// Extractor applies value rules to frames and keeps the latest results
+type Extractor struct {
+	rules    []*rule
+	mu       sync.RWMutex
+	latest   map[string]Value
+	onUpdate func(Value)
+}
+
+// NewExtractor compiles the configured rules. Rules are expected to have
+// been validated by the config package.
+func NewExtractor(rules []config.ValueRule) *Extractor {
+	e := &Extractor{latest: make(map[string]Value)}
+	for _, rc := range rules {
+		r := &rule{
+			ValueRule:  rc,
+			length:     rc.Length,
+			staleAfter: time.Duration(rc.StaleAfter) * time.Second,
+			order:      binary.BigEndian,
+			scale:      rc.Scale,
+		}
+		r.match, _ = hexutil.Parse(rc.Match)
+		if rc.Endian == "little" {
+			r.order = binary.LittleEndian
+		}
+		if r.scale == 0 {
+			r.scale = 1
+		}
+		if size, ok := config.ValueTypeSize(rc.Type); ok {
+			r.length = size
+		}
+		if r.Direction == "" {
+			r.Direction = "from_upstream"
+		}
+		e.rules = append(e.rules, r)
+	}
+	return e
+}
+
+// SetOnUpdate registers a callback invoked for every extracted value
+func (e *Extractor) SetOnUpdate(fn func(Value)) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.onUpdate = fn
+	e.mu.Unlock()
+}
+
+// Observe applies the rules for direction to a frame
+func (e *Extractor) Observe(direction string, data []byte) {
+	if e == nil {
+		return
+	}
+
+	var updates []Value
+	for _, r := range e.rules {
+		if r.Direction != "any" && r.Direction != direction {
+			continue
+		}
+		if !bytes.HasPrefix(data, r.match) {
+			continue
+		}
+		v, ok := r.decode(data)
+		if !ok {
+			continue
+		}
+		updates = append(updates, Value{Name: r.Name, Value: v, Unit: r.Unit, UpdatedAt: time.Now()})
+	}
+	if len(updates) == 0 {
+		return
+	}
+
+	e.mu.Lock()
+	for _, v := range updates {
+		e.latest[v.Name] = v
+	}
+	onUpdate := e.onUpdate
+	e.mu.Unlock()
+
+	if onUpdate != nil {
+		for _, v := range updates {
+			onUpdate(v)
+		}
+	}
+}
+
+// Values returns the latest value of every rule that has matched, in
+// configuration order
+func (e *Extractor) Values() []Value {
+	if e == nil {
+		return []Value{}
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	now := time.Now()
+	result := make([]Value, 0, len(e.latest))
+	for _, r := range e.rules {
+		if v, ok := e.latest[r.Name]; ok {
+			result = append(result, r.withStale(v, now))
+		}
+	}
+	return result
+}
+
+// Get returns the latest value of the named rule
+func (e *Extractor) Get(name string) (Value, bool) {
+	if e == nil {
+		return Value{}, false
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	v, ok := e.latest[name]
+	if !ok {
+		return Value{}, false
+	}
+	for _, r := range e.rules {
+		if r.Name == name {
+			v = r.withStale(v, time.Now())
+		}
+	}
+	return v, true
+}
+
+// Known reports whether a rule with the given name is configured
+func (e *Extractor) Known(name string) bool {
+	if e == nil {
+		return false
+	}
+	for _, r := range e.rules {
+		if r.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// withStale marks v stale if it is older than the rule's stale_after
+func (r *rule) withStale(v Value, now time.Time) Value {
+	v.Stale = r.staleAfter > 0 && now.Sub(v.UpdatedAt) > r.staleAfter
+	return v
+}
+
+func (r *rule) decode(data []byte) (interface{}, bool) {
+	if r.Offset > len(data) {
+		return nil, false
+	}
+	field := data[r.Offset:]
+	if r.length > 0 {
+		if len(field) < r.length {
+			return nil, false
+		}
+		field = field[:r.length]
+	}
+
+	var n float64
+	switch r.Type {
+	case "string":
+		return strings.TrimRight(string(field), "\x00"), true
+	case "hex":
+		return hex.EncodeToString(field), true
+	case "u8":
+		n = float64(field[0])
+	case "i8":
+		n = float64(int8(field[0]))
+	case "u16":
+		n = float64(r.order.Uint16(field))
+	case "i16":
+		n = float64(int16(r.order.Uint16(field)))
+	case "u32":
+		n = float64(r.order.Uint32(field))
+	case "i32":
+		n = float64(int32(r.order.Uint32(field)))
+	case "f32":
+		n = float64(math.Float32frombits(r.order.Uint32(field)))
+	case "f64":
+		n = math.Float64frombits(r.order.Uint64(field))
+	case "bcd":
+		var ok bool
+		if n, ok = decodeBCD(field, r.order == binary.LittleEndian); !ok {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+	// NaN and infinities cannot be encoded as JSON, and would take every
+	// value out of /api/values and the value events
+	n *= r.scale
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return nil, false
+	}
+	return n, true
+}
+
+// decodeBCD decodes packed BCD, two digits per byte
+func decodeBCD(b []byte, littleEndian bool) (float64, bool) {
+	var n float64
+	for i := range b {
+		c := b[i]
+		if littleEndian {
+			c = b[len(b)-1-i]
+		}
+		hi, lo := c>>4, c&0x0f
+		if hi > 9 || lo > 9 {
+			return 0, false
+		}
+		n = n*100 + float64(hi*10+lo)
+	}
+	return n, true
+}
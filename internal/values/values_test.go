@@ -0,0 +1,122 @@
+package values
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+)
+
+func TestExtractor_Types(t *testing.T) {
+	frame := []byte{0x01, 0x03, 0xff, 0x38, 0x2a, 0x00, 0x12, 0x34, 'o', 'k', 0x00}
+
+	tests := []struct {
+		rule     config.ValueRule
+		expected interface{}
+	}{
+		{config.ValueRule{Offset: 2, Type: "i16", Scale: 0.1}, -20.0},
+		{config.ValueRule{Offset: 2, Type: "u16"}, 65336.0},
+		{config.ValueRule{Offset: 4, Type: "u16", Endian: "little"}, 42.0},
+		{config.ValueRule{Offset: 4, Type: "u8"}, 42.0},
+		{config.ValueRule{Offset: 6, Length: 2, Type: "bcd"}, 1234.0},
+		{config.ValueRule{Offset: 8, Length: 3, Type: "string"}, "ok"},
+		{config.ValueRule{Offset: 6, Length: 2, Type: "hex"}, "1234"},
+	}
+
+	for _, tt := range tests {
+		tt.rule.Name = "v"
+		tt.rule.Match = "01 03"
+		e := NewExtractor([]config.ValueRule{tt.rule})
+		e.Observe("from_upstream", frame)
+
+		v, ok := e.Get("v")
+		if !ok {
+			t.Errorf("%s: expected a value", tt.rule.Type)
+			continue
+		}
+		if f, isFloat := tt.expected.(float64); isFloat {
+			got, _ := v.Value.(float64)
+			if diff := got - f; diff > 1e-9 || diff < -1e-9 {
+				t.Errorf("%s: expected %v, got %v", tt.rule.Type, f, v.Value)
+			}
+		} else if v.Value != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.rule.Type, tt.expected, v.Value)
+		}
+	}
+}
+
+func TestExtractor_NonFinite(t *testing.T) {
+	e := NewExtractor([]config.ValueRule{
+		{Name: "f32", Match: "01", Offset: 1, Type: "f32"},
+		{Name: "f64", Match: "02", Offset: 1, Type: "f64"},
+	})
+
+	e.Observe("from_upstream", []byte{0x01, 0x41, 0xa8, 0x00, 0x00})       // 21.0
+	e.Observe("from_upstream", []byte{0x01, 0x7f, 0xc0, 0x00, 0x00})       // NaN
+	e.Observe("from_upstream", []byte{0x02, 0x7f, 0xf0, 0, 0, 0, 0, 0, 0}) // +Inf
+
+	// The last finite reading is kept and the values still encode
+	if v, ok := e.Get("f32"); !ok || v.Value != 21.0 {
+		t.Errorf("Expected f32 to stay 21, got %+v", v)
+	}
+	if _, ok := e.Get("f64"); ok {
+		t.Error("Expected no f64 value from an infinity")
+	}
+	if _, err := json.Marshal(e.Values()); err != nil {
+		t.Errorf("Failed to encode values: %v", err)
+	}
+}
+
+func TestExtractor_Matching(t *testing.T) {
+	e := NewExtractor([]config.ValueRule{
+		{Name: "temp", Match: "01 03", Offset: 2, Type: "u8", Unit: "°C"},
+	})
+
+	var updates []Value
+	e.SetOnUpdate(func(v Value) { updates = append(updates, v) })
+
+	e.Observe("from_upstream", []byte{0x02, 0x03, 0x10}) // wrong prefix
+	e.Observe("to_upstream", []byte{0x01, 0x03, 0x10})   // wrong direction
+	e.Observe("from_upstream", []byte{0x01, 0x03})       // too short
+
+	if len(e.Values()) != 0 || len(updates) != 0 {
+		t.Fatalf("Expected no values, got %+v", e.Values())
+	}
+
+	e.Observe("from_upstream", []byte{0x01, 0x03, 0x15})
+	v, ok := e.Get("temp")
+	if !ok || v.Value != 21.0 || v.Unit != "°C" {
+		t.Errorf("Unexpected value %+v", v)
+	}
+	if len(updates) != 1 {
+		t.Errorf("Expected 1 update, got %d", len(updates))
+	}
+}
+
+func TestExtractor_Stale(t *testing.T) {
+	e := NewExtractor([]config.ValueRule{
+		{Name: "fresh", Type: "u8"},
+		{Name: "stale", Type: "u8", StaleAfter: 1},
+	})
+	e.Observe("from_upstream", []byte{0x01})
+
+	if !e.Known("stale") || e.Known("missing") {
+		t.Error("Known returned unexpected results")
+	}
+
+	// Age the stored values
+	e.mu.Lock()
+	for name, v := range e.latest {
+		v.UpdatedAt = v.UpdatedAt.Add(-2 * time.Second)
+		e.latest[name] = v
+	}
+	e.mu.Unlock()
+
+	if v, _ := e.Get("stale"); !v.Stale {
+		t.Error("Expected value to be stale")
+	}
+	if v, _ := e.Get("fresh"); v.Stale {
+		t.Error("Expected value without stale_after to never be stale")
+	}
+}
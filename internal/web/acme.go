@@ -0,0 +1,39 @@
+package web
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager returns a certificate manager for WEB_ACME_DOMAINS. The
+// manager answers TLS-ALPN-01 challenges on the web port and HTTP-01
+// challenges through its HTTPHandler, and renews certificates before they
+// expire.
+func (s *Server) newACMEManager() *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(s.config.ACMEDomains...),
+		Cache:      autocert.DirCache(s.config.ACMECacheDir),
+		Email:      s.config.ACMEEmail,
+	}
+	if s.config.ACMEDirectory != "" {
+		m.Client = &acme.Client{DirectoryURL: s.config.ACMEDirectory}
+	}
+	return m
+}
+
+// httpsRedirect sends plain HTTP requests to the HTTPS web UI
+func (s *Server) httpsRedirect(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if port := s.webPort(); port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
@@ -0,0 +1,121 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/capdiff"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/pcapng"
+)
+
+// maxCaptureUpload bounds the request body of a capture comparison
+const maxCaptureUpload = 64 << 20
+
+// defaultDiffLimit is how many differences are listed unless limit is set
+const defaultDiffLimit = 1000
+
+// CaptureDiffResponse is the result of comparing two captures
+type CaptureDiffResponse struct {
+	capdiff.Result
+	Truncated bool `json:"truncated"` // more differences than listed
+}
+
+// handleCaptureDiff compares two pcapng captures uploaded as the multipart
+// files "a" and "b". Query parameters gap_ms, transform and direction
+// select the framing; limit caps the differences listed.
+func (s *Server) handleCaptureDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	opts := capdiff.Options{
+		Transform: query.Get("transform"),
+		Direction: query.Get("direction"),
+	}
+	if v := query.Get("gap_ms"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 {
+			http.Error(w, "Invalid gap_ms", http.StatusBadRequest)
+			return
+		}
+		opts.Gap = time.Duration(ms) * time.Millisecond
+	}
+	if err := opts.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultDiffLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxCaptureUpload)
+	if err := r.ParseMultipartForm(maxCaptureUpload); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Captures exceed %d MiB", maxCaptureUpload>>20), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Expected a multipart form with captures a and b", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	a, err := readCaptureFrames(r, "a", opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := readCaptureFrames(r, "b", opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	res, err := capdiff.Diff(a, b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	resp := CaptureDiffResponse{Result: res}
+	if len(resp.Differences) > limit {
+		resp.Differences = resp.Differences[:limit]
+		resp.Truncated = true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.logger.Error("Failed to encode capture diff response: %v", err)
+	}
+}
+
+// readCaptureFrames reads the uploaded capture in field and splits it into
+// frames
+func readCaptureFrames(r *http.Request, field string, opts capdiff.Options) ([]capdiff.Frame, error) {
+	f, _, err := r.FormFile(field)
+	if err != nil {
+		return nil, fmt.Errorf("capture %q is required", field)
+	}
+	defer f.Close()
+
+	packets, err := pcapng.ReadPackets(f)
+	if err != nil {
+		return nil, fmt.Errorf("capture %q: %v", field, err)
+	}
+	frames, err := capdiff.Frames(packets, opts)
+	if err != nil {
+		return nil, fmt.Errorf("capture %q: %v", field, err)
+	}
+	return frames, nil
+}
@@ -0,0 +1,63 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+)
+
+// SourceAPI marks a hot-reloadable field changed through the web API since
+// startup
+const SourceAPI = "api"
+
+// ConfigSchemaResponse lists every configuration field
+type ConfigSchemaResponse struct {
+	Fields []config.FieldSchema `json:"fields"`
+}
+
+// ConfigEffectiveResponse lists the value and source of every field
+type ConfigEffectiveResponse struct {
+	Fields []config.EffectiveField `json:"fields"`
+}
+
+// handleConfigSchema returns the name, type, default and hot-reload flag of
+// every configuration field
+func (s *Server) handleConfigSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.writeConfigJSON(w, ConfigSchemaResponse{Fields: config.Schema()})
+}
+
+// handleConfigEffective returns the value every configuration field ended
+// up with and whether it came from the defaults, options.json, the
+// environment or a later API call. Secrets are redacted.
+func (s *Server) handleConfigEffective(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	runtime := map[string]bool{
+		"inject_enabled": s.proxy.InjectionEnabled(),
+		"dry_run":        s.proxy.DryRun(),
+		"start_parked":   s.proxy.Parked(),
+	}
+	fields := s.config.Effective()
+	for i, f := range fields {
+		if current, ok := runtime[f.Name]; ok && current != f.Value {
+			fields[i].Value = current
+			fields[i].Source = SourceAPI
+		}
+	}
+	s.writeConfigJSON(w, ConfigEffectiveResponse{Fields: fields})
+}
+
+func (s *Server) writeConfigJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.logger.Error("Failed to encode config: %v", err)
+	}
+}
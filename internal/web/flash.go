@@ -0,0 +1,45 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/proxy"
+)
+
+// FlashRequest selects the client that gets exclusive use of the upstream
+type FlashRequest struct {
+	ClientID string `json:"client_id"`
+}
+
+// handleFlashing shows (GET), starts (POST) or ends (DELETE) flashing mode
+func (s *Server) handleFlashing(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req FlashRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ClientID == "" {
+			http.Error(w, "client_id is required", http.StatusBadRequest)
+			return
+		}
+		switch err := s.proxy.StartFlashing(req.ClientID); {
+		case errors.Is(err, proxy.ErrClientNotFound):
+			http.Error(w, "Client not found", http.StatusNotFound)
+			return
+		case errors.Is(err, proxy.ErrFlashing):
+			http.Error(w, "Flashing mode is held by another client", http.StatusConflict)
+			return
+		}
+	case http.MethodDelete:
+		s.proxy.StopFlashing()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.proxy.FlashStatus()); err != nil {
+		s.logger.Error("Failed to encode flashing status: %v", err)
+	}
+}
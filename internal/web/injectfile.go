@@ -0,0 +1,141 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Limits of a file injection
+const (
+	maxInjectFile      = 16 << 20
+	maxInjectChunk     = 64 << 10
+	defaultInjectChunk = 256
+	maxInjectDelayMs   = 60000
+)
+
+// InjectFileResponse reports what a file injection sent
+type InjectFileResponse struct {
+	Success bool `json:"success"`
+	Bytes   int  `json:"bytes"`
+	Chunks  int  `json:"chunks"`
+}
+
+// handleInjectFile streams the multipart file "file" to an injection
+// target in chunks. Query parameters target and client_id select where it
+// goes like the body of /api/inject; chunk_size and delay_ms set the size
+// of each packet and the pause between them.
+func (s *Server) handleInjectFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.proxy.InjectionEnabled() {
+		http.Error(w, "Packet injection is disabled", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	req := InjectRequest{Target: query.Get("target"), ClientID: query.Get("client_id")}
+	if req.Target == "" {
+		req.Target = "upstream"
+	}
+	if req.ClientID != "" && req.Target != "downstream" {
+		http.Error(w, errClientTarget.Error(), http.StatusBadRequest)
+		return
+	}
+	chunkSize := defaultInjectChunk
+	if v := query.Get("chunk_size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxInjectChunk {
+			http.Error(w, fmt.Sprintf("chunk_size must be between 1 and %d", maxInjectChunk), http.StatusBadRequest)
+			return
+		}
+		chunkSize = n
+	}
+	var delay time.Duration
+	if v := query.Get("delay_ms"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms < 0 || ms > maxInjectDelayMs {
+			http.Error(w, fmt.Sprintf("delay_ms must be between 0 and %d", maxInjectDelayMs), http.StatusBadRequest)
+			return
+		}
+		delay = time.Duration(ms) * time.Millisecond
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxInjectFile+1<<20)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart form with a file", http.StatusBadRequest)
+		return
+	}
+	var file io.Reader
+	var name string
+	for file == nil {
+		part, err := mr.NextPart()
+		if err != nil {
+			http.Error(w, `File "file" is required`, http.StatusBadRequest)
+			return
+		}
+		if part.FormName() == "file" {
+			file, name = io.LimitReader(part, maxInjectFile+1), part.FileName()
+		}
+	}
+
+	// Chunks are sent as they are read, so the file is never held in full
+	resp := InjectFileResponse{Success: true}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(file, buf)
+		if n > 0 {
+			if resp.Bytes+n > maxInjectFile {
+				http.Error(w, fmt.Sprintf("File exceeds %d MiB after sending %d bytes", maxInjectFile>>20, resp.Bytes), http.StatusRequestEntityTooLarge)
+				return
+			}
+			if resp.Chunks > 0 && delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-r.Context().Done():
+					s.logger.Warn("File injection of %q canceled after %d bytes", name, resp.Bytes)
+					return
+				}
+			}
+			if err := s.inject(req, append([]byte(nil), buf[:n]...)); err != nil {
+				http.Error(w, fmt.Sprintf("Injection failed after %d bytes: %v", resp.Bytes, err), injectStatus(err))
+				return
+			}
+			resp.Bytes += n
+			resp.Chunks++
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, fmt.Sprintf("File exceeds %d MiB after sending %d bytes", maxInjectFile>>20, resp.Bytes), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Reading the file failed after sending %d bytes: %v", resp.Bytes, err), http.StatusBadRequest)
+			return
+		}
+	}
+	s.logger.Info("Injected file %q to %s: %d bytes in %d chunks", name, injectDestination(req), resp.Bytes, resp.Chunks)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.logger.Error("Failed to encode inject file response: %v", err)
+	}
+}
+
+// injectDestination describes where an injection request sends its data
+func injectDestination(req InjectRequest) string {
+	if req.ClientID != "" {
+		return req.ClientID
+	}
+	return req.Target
+}
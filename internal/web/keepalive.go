@@ -0,0 +1,37 @@
+package web
+
+import "time"
+
+// Defaults for WEB_STATUS_INTERVAL, WEB_SSE_HEARTBEAT and
+// WEB_WS_PING_INTERVAL
+const (
+	defaultStatusInterval = 2 * time.Second
+	defaultSSEHeartbeat   = 15 * time.Second
+	defaultWSPing         = 30 * time.Second
+)
+
+// secondsOr converts a configured number of seconds, or returns def if it
+// is not set
+func secondsOr(secs int, def time.Duration) time.Duration {
+	if secs <= 0 {
+		return def
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// statusTicker returns a channel receiving a tick every status interval
+// and a function stopping it. With WEB_STATUS_PUSH=false the channel is
+// nil, so periodic status messages are never sent.
+func (s *Server) statusTicker() (<-chan time.Time, func()) {
+	if !s.config.StatusPushEnabled() {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(s.statusInterval)
+	return ticker.C, ticker.Stop
+}
+
+// wsPongWait is how long a WebSocket client may stay silent, including
+// pong replies, before it is disconnected: two ping intervals
+func (s *Server) wsPongWait() time.Duration {
+	return 2 * s.wsPing
+}
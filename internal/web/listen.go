@@ -0,0 +1,80 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// bindRetryInterval is the pause between attempts to bind WEB_PORT while
+// it is in use
+const bindRetryInterval = time.Second
+
+// WebListen reports the port the web UI is served on, in /api/status and
+// /api/health
+type WebListen struct {
+	Port       int  `json:"port"`
+	Configured int  `json:"configured_port"` // WEB_PORT
+	Fallback   bool `json:"fallback"`        // served on one of WEB_FALLBACK_PORTS
+	Attempts   int  `json:"bind_attempts"`   // tries to bind WEB_PORT
+}
+
+// listen binds WEB_PORT. While the port is in use, as when a crashed
+// instance has not released it yet, it retries for WEB_BIND_RETRY_SECONDS,
+// then tries WEB_FALLBACK_PORTS in order. The port bound is recorded for
+// the status.
+func (s *Server) listen(ctx context.Context) (net.Listener, error) {
+	var lc net.ListenConfig
+	port := s.config.WebPort
+	deadline := time.Now().Add(time.Duration(s.config.WebBindRetry) * time.Second)
+	state := WebListen{Port: port, Configured: port}
+
+	var bindErr error
+	for {
+		state.Attempts++
+		ln, err := lc.Listen(ctx, "tcp", fmt.Sprintf(":%d", port))
+		if err == nil {
+			if state.Attempts > 1 {
+				s.logger.Info("Bound web UI port %d after %d attempts", port, state.Attempts)
+			}
+			s.listenState.Store(&state)
+			return ln, nil
+		}
+		bindErr = err
+		if !errors.Is(err, syscall.EADDRINUSE) || !time.Now().Add(bindRetryInterval).Before(deadline) {
+			break
+		}
+		if state.Attempts == 1 {
+			s.logger.Warn("Web UI port %d is in use, retrying for up to %ds", port, s.config.WebBindRetry)
+		}
+		select {
+		case <-time.After(bindRetryInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	for _, fallback := range s.config.WebFallbackPorts {
+		ln, err := lc.Listen(ctx, "tcp", fmt.Sprintf(":%d", fallback))
+		if err != nil {
+			s.logger.Warn("Failed to bind fallback web UI port %d: %v", fallback, err)
+			continue
+		}
+		state.Port, state.Fallback = ln.Addr().(*net.TCPAddr).Port, true
+		s.logger.Warn("Failed to bind web UI port %d: %v; serving on fallback port %d instead", port, bindErr, state.Port)
+		s.listenState.Store(&state)
+		return ln, nil
+	}
+	return nil, fmt.Errorf("failed to bind web UI port %d after %d attempts: %w", port, state.Attempts, bindErr)
+}
+
+// webPort returns the port the web UI is served on, WEB_PORT before Start
+func (s *Server) webPort() int {
+	if state := s.listenState.Load(); state != nil {
+		return state.Port
+	}
+	return s.config.WebPort
+}
@@ -0,0 +1,110 @@
+package web
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+)
+
+// Log lines are sent to web clients in batches, so packet logging at high
+// rates costs one JSON message and one flush per batch rather than per line
+const (
+	logBatchInterval = 50 * time.Millisecond // longest a line waits
+	logBatchSize     = 32                    // lines sent at once
+)
+
+// queueLog adds a line to the next batch. The batch is sent once it is full
+// or logBatchInterval after its first line.
+func (s *Server) queueLog(line string) {
+	s.logBatchMu.Lock()
+	s.logBatch = append(s.logBatch, line)
+	full := len(s.logBatch) >= logBatchSize
+	if !full && s.logTimer == nil {
+		s.logTimer = time.AfterFunc(logBatchInterval, s.flushLogs)
+	}
+	s.logBatchMu.Unlock()
+
+	if full {
+		s.flushLogs()
+	}
+}
+
+// flushLogs sends the pending batch to SSE and WebSocket clients. Batches
+// are sent one at a time so lines keep their order.
+func (s *Server) flushLogs() {
+	s.logFlushMu.Lock()
+	defer s.logFlushMu.Unlock()
+
+	s.logBatchMu.Lock()
+	batch := s.logBatch
+	s.logBatch = nil
+	if s.logTimer != nil {
+		s.logTimer.Stop()
+		s.logTimer = nil
+	}
+	s.logBatchMu.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	s.clientsMu.Lock()
+	for clientChan := range s.clients {
+		select {
+		case clientChan <- batch:
+		default:
+			// Drop the batch if client is too slow
+		}
+	}
+	s.clientsMu.Unlock()
+
+	// The whole batch is marshaled once and shared by every WebSocket client
+	// whose subscription keeps all of it
+	var shared []byte
+	for _, client := range s.openWSClients() {
+		lines := client.wantedLogs(batch)
+		if len(lines) == 0 {
+			continue
+		}
+		if len(lines) < len(batch) {
+			if data, err := logsMessage(lines); err == nil {
+				client.queue(data)
+			}
+			continue
+		}
+		if shared == nil {
+			data, err := logsMessage(batch)
+			if err != nil {
+				return
+			}
+			shared = data
+		}
+		client.queue(shared)
+	}
+}
+
+// logsMessage encodes lines as a WebSocket message: "log" for a single
+// line, as before batching, and "logs" with an array for several
+func logsMessage(lines []string) ([]byte, error) {
+	if len(lines) == 1 {
+		return json.Marshal(wsMessage{Type: "log", Data: lines[0]})
+	}
+	return json.Marshal(wsMessage{Type: "logs", Data: lines})
+}
+
+// wantedLogs returns the lines of a batch that pass the client's
+// subscription, without copying when all of them do
+func (c *wsClient) wantedLogs(lines []string) []string {
+	for i, line := range lines {
+		if c.wants("log", line) {
+			continue
+		}
+		out := slices.Clone(lines[:i])
+		for _, line := range lines[i+1:] {
+			if c.wants("log", line) {
+				out = append(out, line)
+			}
+		}
+		return out
+	}
+	return lines
+}
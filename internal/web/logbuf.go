@@ -0,0 +1,52 @@
+package web
+
+import (
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/storage"
+)
+
+// LogBufferStats reports the log buffer replayed to new web clients
+type LogBufferStats struct {
+	Lines      int    `json:"lines"`
+	MaxLines   int    `json:"max_lines"`
+	Packets    int    `json:"packets"`
+	MaxPackets int    `json:"max_packets"`
+	MaxAge     string `json:"max_age,omitempty"`
+	Bytes      int    `json:"bytes"` // approximate size of both buffers
+}
+
+// bufferedLogs returns the kept log and packet lines in time order
+func (s *Server) bufferedLogs() []logger.Entry {
+	entries, err := s.store.Logs()
+	if err != nil {
+		s.logger.Warn("Failed to read buffered logs: %v", err)
+	}
+	return entries
+}
+
+// entryLines returns the formatted lines of entries
+func entryLines(entries []logger.Entry) []string {
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		lines[i] = e.Line
+	}
+	return lines
+}
+
+// logBufferStats returns the size of the log buffers
+func (s *Server) logBufferStats() LogBufferStats {
+	limits := storage.LimitsFor(s.config)
+	st := LogBufferStats{
+		MaxLines:   limits.LogLines,
+		MaxPackets: limits.PacketLines,
+	}
+	kept, err := s.store.LogStats()
+	if err != nil {
+		s.logger.Warn("Failed to read log buffer size: %v", err)
+	}
+	st.Lines, st.Packets, st.Bytes = kept.Lines, kept.Packets, kept.Bytes
+	if limits.LogMaxAge > 0 {
+		st.MaxAge = limits.LogMaxAge.String()
+	}
+	return st
+}
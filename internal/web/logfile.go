@@ -0,0 +1,113 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/retention"
+)
+
+// LogFilesResponse represents the response for the log files endpoint
+type LogFilesResponse struct {
+	Files []retention.File `json:"files"`
+}
+
+// logFiles returns LOG_FILE and the files rotated from it
+func (s *Server) logFiles() ([]retention.File, error) {
+	return retention.PacketLogFiles(s.config)
+}
+
+// handleLogFiles lists the packet log files available for download. The
+// log files, like the file itself, are only served to the admin account.
+func (s *Server) handleLogFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.isAdmin(r) {
+		http.Error(w, "log files require the admin account", http.StatusForbidden)
+		return
+	}
+	if s.config.LogFile == "" {
+		http.Error(w, "No log file configured", http.StatusNotFound)
+		return
+	}
+
+	files, err := s.logFiles()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list log files: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(LogFilesResponse{Files: files}); err != nil {
+		s.logger.Warn("Failed to encode log files response: %v", err)
+	}
+}
+
+// handleLogFile downloads the packet log file, or the rotated file given
+// by the name query parameter as listed by /api/logs/files. Range requests
+// are supported, so a download can be resumed.
+func (s *Server) handleLogFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.isAdmin(r) {
+		http.Error(w, "log files require the admin account", http.StatusForbidden)
+		return
+	}
+	if s.config.LogFile == "" {
+		http.Error(w, "No log file configured", http.StatusNotFound)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = filepath.Base(s.config.LogFile)
+	}
+	// Only names from the listing are served, so nothing outside the log
+	// directory can be reached
+	files, err := s.logFiles()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list log files: %v", err), http.StatusInternalServerError)
+		return
+	}
+	var found *retention.File
+	for i := range files {
+		if files[i].Name == name {
+			found = &files[i]
+		}
+	}
+	if found == nil {
+		http.Error(w, fmt.Sprintf("Log file %q not found", name), http.StatusNotFound)
+		return
+	}
+	if found.Active {
+		// Packets still held in the write buffer are included
+		s.logger.Flush()
+	}
+
+	f, err := os.Open(filepath.Join(filepath.Dir(s.config.LogFile), name))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open log file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to open log file: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	contentType := "text/plain; charset=utf-8"
+	if strings.HasSuffix(name, ".gz") {
+		contentType = "application/gzip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
@@ -0,0 +1,167 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+)
+
+// maxLoggingDuration bounds how long a temporary logging change may last
+const maxLoggingDuration = 7 * 24 * time.Hour
+
+// LoggingRequest changes logging at runtime. Fields left out keep their
+// setting.
+type LoggingRequest struct {
+	Packets  *bool  `json:"packets"`
+	File     *bool  `json:"file"`
+	Level    string `json:"level"`
+	Duration string `json:"duration"` // restore the previous settings after this long, e.g. "30m"
+}
+
+// LoggingState is the logging in effect, as served by /api/logging
+type LoggingState struct {
+	Packets  bool       `json:"packets"`             // packet lines on stdout and in the log file
+	File     bool       `json:"file"`                // log file open
+	Level    string     `json:"level"`               // lowest level on stdout: info, warn or error
+	LogFile  string     `json:"log_file,omitempty"`  // LOG_FILE
+	RevertAt *time.Time `json:"revert_at,omitempty"` // when a temporary change ends
+}
+
+// loggingState returns the current settings. Called with loggingMu held.
+func (s *Server) loggingState() LoggingState {
+	st := LoggingState{
+		Packets: s.logger.IsPacketLoggingEnabled(),
+		File:    s.logger.IsFileLoggingEnabled(),
+		Level:   strings.ToLower(string(s.logger.Level())),
+		LogFile: s.config.LogFile,
+	}
+	if s.loggingRevert != nil {
+		at := s.loggingRevertAt
+		st.RevertAt = &at
+	}
+	return st
+}
+
+// applyLogging sets packets, file and level as in st. Called with
+// loggingMu held.
+func (s *Server) applyLogging(st LoggingState) error {
+	s.logger.SetPacketLogging(st.Packets)
+	level, err := logger.ParseLevel(st.Level)
+	if err != nil {
+		return err
+	}
+	if err := s.logger.SetLevel(level); err != nil {
+		return err
+	}
+	return s.logger.SetFileLogging(st.File)
+}
+
+// handleLogging shows (GET) or changes (POST, PUT) packet logging, the log
+// file and the log level without a restart. With duration the previous
+// settings come back on their own, so troubleshooting logs are not left on.
+func (s *Server) handleLogging(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.loggingMu.Lock()
+		st := s.loggingState()
+		s.loggingMu.Unlock()
+		s.writeLoggingState(w, st)
+		return
+	case http.MethodPost, http.MethodPut:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req LoggingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Level != "" {
+		if _, err := logger.ParseLevel(req.Level); err != nil {
+			http.Error(w, "level must be info, warn or error", http.StatusBadRequest)
+			return
+		}
+	}
+	var duration time.Duration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 || d > maxLoggingDuration {
+			http.Error(w, fmt.Sprintf("duration must be a positive duration up to %v, e.g. 30m", maxLoggingDuration), http.StatusBadRequest)
+			return
+		}
+		duration = d
+	}
+	if req.File != nil && *req.File && s.config.LogFile == "" {
+		http.Error(w, "No log file configured", http.StatusBadRequest)
+		return
+	}
+
+	s.loggingMu.Lock()
+	defer s.loggingMu.Unlock()
+
+	// A change made during a temporary one ends with it, back to the
+	// settings from before the first
+	current := s.loggingState()
+	if s.loggingRevert != nil {
+		s.loggingRevert.Stop()
+		s.loggingRevert = nil
+	} else {
+		s.loggingBase = current
+	}
+	next := current
+	next.RevertAt = nil
+	if req.Packets != nil {
+		next.Packets = *req.Packets
+	}
+	if req.File != nil {
+		next.File = *req.File
+	}
+	if req.Level != "" {
+		next.Level = strings.ToLower(req.Level)
+	}
+	if err := s.applyLogging(next); err != nil && !errors.Is(err, logger.ErrNoLogFile) {
+		s.logger.Error("Failed to change logging: %v", err)
+		http.Error(w, fmt.Sprintf("Failed to change logging: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	s.loggingGen++
+	if duration > 0 {
+		base, gen := s.loggingBase, s.loggingGen
+		s.loggingRevertAt = time.Now().Add(duration)
+		s.loggingRevert = time.AfterFunc(duration, func() { s.restoreLogging(gen, base) })
+		s.logger.Info("Logging changed for %v: packets=%v file=%v level=%s", duration, next.Packets, next.File, next.Level)
+	} else {
+		s.logger.Info("Logging changed: packets=%v file=%v level=%s", next.Packets, next.File, next.Level)
+	}
+	s.writeLoggingState(w, s.loggingState())
+}
+
+// restoreLogging ends the temporary logging change gen
+func (s *Server) restoreLogging(gen uint64, base LoggingState) {
+	s.loggingMu.Lock()
+	defer s.loggingMu.Unlock()
+	if gen != s.loggingGen || s.loggingRevert == nil {
+		return // replaced or stopped meanwhile
+	}
+	s.loggingRevert = nil
+	if err := s.applyLogging(base); err != nil && !errors.Is(err, logger.ErrNoLogFile) {
+		s.logger.Error("Failed to restore logging: %v", err)
+		return
+	}
+	s.logger.Info("Logging restored: packets=%v file=%v level=%s", base.Packets, base.File, base.Level)
+}
+
+func (s *Server) writeLoggingState(w http.ResponseWriter, st LoggingState) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		s.logger.Error("Failed to encode logging settings: %v", err)
+	}
+}
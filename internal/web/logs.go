@@ -0,0 +1,102 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+)
+
+// LogEntry is one buffered log line as served by /api/logs
+type LogEntry struct {
+	Time      string            `json:"time"`
+	Level     string            `json:"level"`
+	Subsystem string            `json:"subsystem,omitempty"`
+	Message   string            `json:"message"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
+// LogsResponse represents the response for the logs endpoint
+type LogsResponse struct {
+	Entries  []LogEntry `json:"entries"`
+	Buffered int        `json:"buffered"` // lines held in the buffer
+}
+
+// levelRank orders levels for the level= filter. Packets rank lowest, so
+// level=pkt returns everything and level=info leaves packets out.
+var levelRank = map[logger.LogLevel]int{
+	logger.LogPkt:   0,
+	logger.LogInfo:  1,
+	logger.LogWarn:  2,
+	logger.LogError: 3,
+}
+
+// handleLogs serves the buffered log lines as JSON. Query parameters:
+// level (minimum level: pkt, info, warn or error), since (RFC 3339 time,
+// only later lines) and limit (at most this many of the newest lines).
+func (s *Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	minRank := 0
+	if level := query.Get("level"); level != "" {
+		rank, ok := levelRank[logger.LogLevel(strings.ToUpper(level))]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Invalid level %q", level), http.StatusBadRequest)
+			return
+		}
+		minRank = rank
+	}
+	var since time.Time
+	if v := query.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			http.Error(w, "Invalid since: expected an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	limit := 0
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	buffer := s.bufferedLogs()
+	var matched []logger.Entry
+	for _, e := range buffer {
+		if levelRank[e.Level] >= minRank && e.Time.After(since) {
+			matched = append(matched, e)
+		}
+	}
+
+	if limit > 0 && len(matched) > limit {
+		matched = matched[len(matched)-limit:]
+	}
+	resp := LogsResponse{Entries: make([]LogEntry, 0, len(matched)), Buffered: len(buffer)}
+	for _, e := range matched {
+		resp.Entries = append(resp.Entries, LogEntry{
+			Time:      e.Time.Format(time.RFC3339Nano),
+			Level:     string(e.Level),
+			Subsystem: e.Subsystem,
+			Message:   e.Message,
+			Fields:    e.Fields,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.logger.Error("Failed to encode logs response: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/inject"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/macro"
+)
+
+// MacroRunRequest carries template variables for a macro run
+type MacroRunRequest struct {
+	Vars map[string]string `json:"vars,omitempty"`
+}
+
+// handleMacros lists macros (GET) or creates/replaces one (POST)
+func (s *Server) handleMacros(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"macros": s.macros.List(),
+		}); err != nil {
+			s.logger.Error("Failed to encode macros response: %v", err)
+		}
+	case http.MethodPost:
+		var m macro.Macro
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		s.putMacro(w, &m)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleMacro serves /api/macros/{name} and /api/macros/{name}/run
+func (s *Server) handleMacro(w http.ResponseWriter, r *http.Request) {
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/macros/"), "/")
+	if name == "" || (action != "" && action != "run") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if action == "run" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.runMacro(w, r, name)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		m, err := s.macros.Get(name)
+		if err != nil {
+			http.Error(w, "Macro not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(m); err != nil {
+			s.logger.Error("Failed to encode macro response: %v", err)
+		}
+	case http.MethodPut:
+		var m macro.Macro
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if m.Name == "" {
+			m.Name = name
+		}
+		if m.Name != name {
+			http.Error(w, "Macro name does not match URL", http.StatusBadRequest)
+			return
+		}
+		s.putMacro(w, &m)
+	case http.MethodDelete:
+		if err := s.macros.Delete(name); err != nil {
+			if errors.Is(err, macro.ErrNotFound) {
+				http.Error(w, "Macro not found", http.StatusNotFound)
+			} else {
+				http.Error(w, fmt.Sprintf("Failed to save macros: %v", err), http.StatusInternalServerError)
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]bool{"success": true}); err != nil {
+			s.logger.Error("Failed to encode macro response: %v", err)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) putMacro(w http.ResponseWriter, m *macro.Macro) {
+	if err := m.Validate(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid macro: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := s.macros.Put(m); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save macros: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(m); err != nil {
+		s.logger.Error("Failed to encode macro response: %v", err)
+	}
+}
+
+// runMacro renders and injects every frame in order, waiting each frame's
+// delay first. The request returns once the last frame has been sent.
+func (s *Server) runMacro(w http.ResponseWriter, r *http.Request, name string) {
+	if !s.proxy.InjectionEnabled() {
+		http.Error(w, "Packet injection is disabled", http.StatusForbidden)
+		return
+	}
+
+	m, err := s.macros.Get(name)
+	if err != nil {
+		http.Error(w, "Macro not found", http.StatusNotFound)
+		return
+	}
+
+	var req MacroRunRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+	vars := req.Vars
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+	for key, values := range r.URL.Query() {
+		if _, ok := vars[key]; !ok && len(values) > 0 {
+			vars[key] = values[0]
+		}
+	}
+
+	// Render all frames up front so a bad template sends nothing
+	frames := make([][]byte, len(m.Frames))
+	for i, f := range m.Frames {
+		if f.IsBreak() {
+			continue
+		}
+		if !m.Template {
+			frames[i], err = inject.Decode(m.Format, f.Data)
+		} else {
+			frames[i], err = s.renderer.Render(m.Format, f.Data, vars)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid template in frame %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	sent := 0
+	for i, data := range frames {
+		if delay := m.Frames[i].DelayMs; delay > 0 {
+			timer := time.NewTimer(time.Duration(delay) * time.Millisecond)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				s.logger.Warn("Macro %s cancelled after %d of %d frames", name, sent, len(frames))
+				return
+			}
+		}
+		if f := m.Frames[i]; f.IsBreak() {
+			if err := s.proxy.SendBreak("", time.Duration(f.BreakMs)*time.Millisecond); err != nil {
+				http.Error(w, fmt.Sprintf("Break failed at frame %d: %v", i, err), breakStatus(err))
+				return
+			}
+		} else if err := s.proxy.InjectPacket(m.Target, data); err != nil {
+			http.Error(w, fmt.Sprintf("Injection failed at frame %d: %v", i, err), injectStatus(err))
+			return
+		}
+		sent++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"frames_sent": sent,
+	}); err != nil {
+		s.logger.Error("Failed to encode macro run response: %v", err)
+	}
+}
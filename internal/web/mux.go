@@ -0,0 +1,20 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handleMux reports the multiplexed sessions with their channels and
+// traffic counters
+func (s *Server) handleMux(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.proxy.MuxStatus()); err != nil {
+		s.logger.Warn("Failed to encode mux response: %v", err)
+	}
+}
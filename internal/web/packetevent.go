@@ -0,0 +1,147 @@
+package web
+
+import (
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+)
+
+// Thresholds of the ASCII detection. A direction is judged on roughly its
+// last textWindow bytes, so one binary frame in a text protocol does not
+// flip it.
+const (
+	textWindow         = 512
+	textDirectionRatio = 0.9  // printable share of recent bytes in a direction
+	textPacketRatio    = 0.75 // printable share of the packet itself
+)
+
+// PacketEvent is a packet sent to web clients with WEB_PACKET_EVENTS
+type PacketEvent struct {
+	Time        time.Time `json:"time"`
+	Direction   string    `json:"direction"` // from_upstream, to_upstream
+	Source      string    `json:"source"`
+	Seq         uint64    `json:"seq,omitempty"` // with LOG_PACKET_OFFSETS
+	Length      int       `json:"length"`
+	Hex         string    `json:"hex"`
+	ASCII       string    `json:"ascii"`        // printable bytes as is, others escaped as \xNN
+	LikelyASCII bool      `json:"likely_ascii"` // the direction carries mostly text
+}
+
+// directionNames maps packet line labels to the direction names of the API
+var directionNames = map[string]string{
+	"UP->": "from_upstream",
+	"->UP": "to_upstream",
+}
+
+// textDetector tracks how much of the recent traffic in one direction is
+// printable
+type textDetector struct {
+	printable float64
+	total     float64
+}
+
+// observe adds a packet and reports whether it is likely text
+func (d *textDetector) observe(data []byte) bool {
+	printable := 0
+	for _, b := range data {
+		if isText(b) {
+			printable++
+		}
+	}
+	d.printable += float64(printable)
+	d.total += float64(len(data))
+	if d.total > textWindow {
+		scale := textWindow / d.total
+		d.printable *= scale
+		d.total = textWindow
+	}
+	return d.printable >= textDirectionRatio*d.total &&
+		float64(printable) >= textPacketRatio*float64(len(data))
+}
+
+// isText reports whether b is printable ASCII or common whitespace
+func isText(b byte) bool {
+	return b >= 0x20 && b < 0x7f || b == '\t' || b == '\r' || b == '\n'
+}
+
+// escapeASCII renders data as text, escaping backslashes and bytes that
+// are not printable so the original bytes can be recovered
+func escapeASCII(data []byte) string {
+	const digits = "0123456789abcdef"
+	var sb strings.Builder
+	sb.Grow(len(data))
+	for _, b := range data {
+		switch {
+		case b == '\\':
+			sb.WriteString(`\\`)
+		case isText(b):
+			sb.WriteByte(b)
+		default:
+			sb.WriteString(`\x`)
+			sb.WriteByte(digits[b>>4])
+			sb.WriteByte(digits[b&0x0f])
+		}
+	}
+	return sb.String()
+}
+
+// textDetectors holds a detector per direction
+type textDetectors struct {
+	mu        sync.Mutex
+	direction map[string]*textDetector
+}
+
+// packetEvent builds the event for a packet log entry, or returns false for
+// entries of another direction
+func (t *textDetectors) packetEvent(e logger.Entry) (PacketEvent, bool) {
+	name, ok := directionNames[e.Direction]
+	if !ok {
+		return PacketEvent{}, false
+	}
+	t.mu.Lock()
+	if t.direction == nil {
+		t.direction = make(map[string]*textDetector)
+	}
+	d := t.direction[name]
+	if d == nil {
+		d = &textDetector{}
+		t.direction[name] = d
+	}
+	likely := d.observe(e.Data)
+	t.mu.Unlock()
+
+	return PacketEvent{
+		Time:        e.Time,
+		Direction:   name,
+		Source:      e.Source,
+		Seq:         e.Seq,
+		Length:      len(e.Data),
+		Hex:         hex.EncodeToString(e.Data),
+		ASCII:       escapeASCII(e.Data),
+		LikelyASCII: likely,
+	}, true
+}
+
+// broadcastPacket sends a packet event to SSE and WebSocket clients. It
+// runs in the log callback, while e.Data is still valid.
+func (s *Server) broadcastPacket(e logger.Entry) {
+	ev, ok := s.textDetect.packetEvent(e)
+	if !ok {
+		return
+	}
+
+	s.clientsMu.Lock()
+	for packetChan := range s.packetClients {
+		select {
+		case packetChan <- ev:
+		default:
+			// Drop the packet if client is too slow
+		}
+	}
+	s.clientsMu.Unlock()
+
+	s.broadcastToWebSocket("packet", ev)
+}
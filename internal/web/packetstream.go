@@ -0,0 +1,153 @@
+package web
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+)
+
+// Formats of /api/packets/stream
+const (
+	streamNDJSON   = "ndjson"
+	streamProtobuf = "protobuf"
+)
+
+// streamWriteTimeout is how long a write to a stream may block before the
+// recorder is considered gone
+const streamWriteTimeout = 30 * time.Second
+
+// StreamPacket is one line of an NDJSON packet stream
+type StreamPacket struct {
+	Seq       uint32    `json:"seq"` // per stream from 1; gaps mean packets were dropped
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"` // from_upstream, to_upstream
+	Source    string    `json:"source,omitempty"`
+	Length    int       `json:"length"`
+	Data      string    `json:"data"` // hex
+}
+
+// handlePacketStream serves packets as an unbounded stream for recorders:
+// NDJSON, or with format=protobuf varint length-prefixed Packet messages.
+// Packets wait in a bounded queue while the recorder reads slower than
+// they arrive, and are dropped once it is full, so a slow recorder never
+// holds up the proxy. direction and source filter as on /api/ws/packets.
+func (s *Server) handlePacketStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	encode, contentType := encodeNDJSONPacket, "application/x-ndjson"
+	switch query.Get("format") {
+	case "", streamNDJSON:
+	case streamProtobuf:
+		encode, contentType = encodeProtobufPacket, "application/x-protobuf"
+	default:
+		http.Error(w, "format must be ndjson or protobuf", http.StatusBadRequest)
+		return
+	}
+	sub := wsSubscription{
+		Directions: splitQuery(query.Get("direction")),
+		Sources:    splitQuery(query.Get("source")),
+	}
+	filter, err := sub.compile()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.proxy.AddWebClient(); err != nil {
+		http.Error(w, "Max clients reached", http.StatusServiceUnavailable)
+		return
+	}
+	tap := &packetTap{
+		remote: r.RemoteAddr,
+		encode: encode,
+		send:   make(chan []byte, tapQueueSize),
+		filter: filter.packets,
+	}
+	s.addTap(tap)
+	s.logger.Info("Packet stream connected from %s", r.RemoteAddr)
+	defer s.closeTap(tap)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case msg := <-tap.send:
+			if err := rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return
+			}
+			// Write what is queued, then flush once. The writes block
+			// while the recorder's TCP window is full.
+			for more := true; more; {
+				if _, err := w.Write(msg); err != nil {
+					return
+				}
+				select {
+				case msg = <-tap.send:
+				default:
+					more = false
+				}
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// encodeNDJSONPacket encodes a packet as a line of JSON
+func encodeNDJSONPacket(seq uint32, e logger.Entry) []byte {
+	line, _ := json.Marshal(StreamPacket{
+		Seq:       seq,
+		Time:      e.Time,
+		Direction: directionNames[e.Direction],
+		Source:    e.Source,
+		Length:    len(e.Data),
+		Data:      hex.EncodeToString(e.Data),
+	})
+	return append(line, '\n')
+}
+
+// encodeProtobufPacket encodes a packet as a Packet message preceded by its
+// length as a varint:
+//
+//	message Packet {
+//	  uint32 seq = 1;
+//	  int64 time_unix_nano = 2;
+//	  Direction direction = 3; // FROM_UPSTREAM = 0, TO_UPSTREAM = 1
+//	  string source = 4;
+//	  bytes data = 5;
+//	}
+func encodeProtobufPacket(seq uint32, e logger.Entry) []byte {
+	msg := make([]byte, 0, 32+len(e.Source)+len(e.Data))
+	msg = binary.AppendUvarint(append(msg, 1<<3), uint64(seq))
+	msg = binary.AppendUvarint(append(msg, 2<<3), uint64(e.Time.UnixNano()))
+	if direction := tapDirections[e.Direction]; direction != 0 {
+		msg = binary.AppendUvarint(append(msg, 3<<3), uint64(direction))
+	}
+	if e.Source != "" {
+		msg = binary.AppendUvarint(append(msg, 4<<3|2), uint64(len(e.Source)))
+		msg = append(msg, e.Source...)
+	}
+	if len(e.Data) > 0 {
+		msg = binary.AppendUvarint(append(msg, 5<<3|2), uint64(len(e.Data)))
+		msg = append(msg, e.Data...)
+	}
+	return append(binary.AppendUvarint(make([]byte, 0, len(msg)+binary.MaxVarintLen32), uint64(len(msg))), msg...)
+}
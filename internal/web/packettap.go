@@ -0,0 +1,212 @@
+package web
+
+import (
+	"encoding/binary"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+)
+
+// Every packet sent on /api/ws/packets is one binary WebSocket message:
+//
+//	0      version (tapVersion)
+//	1      direction: 0 from the upstream, 1 to the upstream
+//	2-5    sequence number, big-endian; gaps mean the tap dropped packets
+//	6-13   time the packet was read, Unix nanoseconds, big-endian
+//	14     source length n
+//	15..   source (n bytes), then the packet data
+const (
+	tapVersion    = 1
+	tapHeaderSize = 15
+	tapQueueSize  = 1024 // packets waiting per tap before new ones are dropped
+)
+
+// tapDirections maps packet log directions to the direction byte
+var tapDirections = map[string]byte{
+	"UP->": 0,
+	"->UP": 1,
+}
+
+// packetTap is a client of /api/ws/packets or /api/packets/stream
+type packetTap struct {
+	conn    *websocket.Conn // nil for /api/packets/stream
+	remote  string
+	encode  func(seq uint32, e logger.Entry) []byte
+	send    chan []byte
+	filter  logger.PacketFilter
+	seq     atomic.Uint32
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// handlePacketTap streams packets as binary WebSocket messages. The
+// direction and source query parameters filter packets like a WebSocket
+// subscription (comma-separated).
+func (s *Server) handlePacketTap(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	sub := wsSubscription{
+		Directions: splitQuery(query.Get("direction")),
+		Sources:    splitQuery(query.Get("source")),
+	}
+	filter, err := sub.compile()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.proxy.AddWebClient(); err != nil {
+		http.Error(w, "Max clients reached", http.StatusServiceUnavailable)
+		return
+	}
+	responseHeader := http.Header{}
+	responseHeader.Set("X-Accel-Buffering", "no")
+	conn, err := wsUpgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		s.logger.Error("WebSocket upgrade failed: %v", err)
+		s.proxy.RemoveWebClient()
+		return
+	}
+
+	tap := &packetTap{
+		conn:   conn,
+		remote: r.RemoteAddr,
+		encode: encodeTapMessage,
+		send:   make(chan []byte, tapQueueSize),
+		filter: filter.packets,
+	}
+	s.addTap(tap)
+	s.logger.Info("Packet tap connected from %s", r.RemoteAddr)
+
+	go s.tapWritePump(tap)
+	go s.tapReadPump(tap)
+}
+
+// splitQuery splits a comma-separated query parameter, ignoring blanks
+func splitQuery(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// addTap registers a tap to receive packets
+func (s *Server) addTap(tap *packetTap) {
+	s.tapsMu.Lock()
+	s.taps[tap] = true
+	s.tapCount.Store(int32(len(s.taps)))
+	s.tapsMu.Unlock()
+}
+
+// tapPacket sends a packet log entry to every packet tap whose filter it
+// passes. e.Data is copied, so the caller may reuse it afterwards.
+func (s *Server) tapPacket(e logger.Entry) {
+	if s.tapCount.Load() == 0 {
+		return
+	}
+	if _, ok := tapDirections[e.Direction]; !ok {
+		return
+	}
+
+	s.tapsMu.Lock()
+	defer s.tapsMu.Unlock()
+	for tap := range s.taps {
+		if !tap.filter.Allows(e.Direction, e.Source) {
+			continue
+		}
+		select {
+		case tap.send <- tap.encode(tap.seq.Add(1), e):
+		default:
+			tap.dropped.Add(1)
+		}
+	}
+}
+
+// encodeTapMessage encodes a packet as a binary /api/ws/packets message
+func encodeTapMessage(seq uint32, e logger.Entry) []byte {
+	source := e.Source
+	if len(source) > 255 {
+		source = source[:255]
+	}
+	msg := make([]byte, tapHeaderSize, tapHeaderSize+len(source)+len(e.Data))
+	msg[0] = tapVersion
+	msg[1] = tapDirections[e.Direction]
+	binary.BigEndian.PutUint32(msg[2:6], seq)
+	binary.BigEndian.PutUint64(msg[6:14], uint64(e.Time.UnixNano()))
+	msg[14] = byte(len(source))
+	return append(append(msg, source...), e.Data...)
+}
+
+// closeTap unregisters a packet tap and closes its connection
+func (s *Server) closeTap(tap *packetTap) {
+	tap.once.Do(func() {
+		s.tapsMu.Lock()
+		delete(s.taps, tap)
+		s.tapCount.Store(int32(len(s.taps)))
+		s.tapsMu.Unlock()
+		s.proxy.RemoveWebClient()
+		if tap.conn != nil {
+			tap.conn.Close()
+		}
+		if n := tap.dropped.Load(); n > 0 {
+			s.logger.Warn("Packet tap from %s closed, %d packets dropped", tap.remote, n)
+		} else {
+			s.logger.Info("Packet tap from %s closed", tap.remote)
+		}
+	})
+}
+
+// tapWritePump sends queued packets and pings
+func (s *Server) tapWritePump(tap *packetTap) {
+	pingTicker := time.NewTicker(s.wsPing)
+	defer func() {
+		pingTicker.Stop()
+		s.closeTap(tap)
+	}()
+
+	for {
+		select {
+		case msg := <-tap.send:
+			if err := tap.conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
+				return
+			}
+			if err := tap.conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				return
+			}
+		case <-pingTicker.C:
+			if err := tap.conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
+				return
+			}
+			if err := tap.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// tapReadPump discards anything the client sends and handles pongs and
+// close
+func (s *Server) tapReadPump(tap *packetTap) {
+	defer s.closeTap(tap)
+
+	tap.conn.SetReadLimit(wsReadLimit)
+	pongWait := s.wsPongWait()
+	if err := tap.conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
+		return
+	}
+	tap.conn.SetPongHandler(func(string) error {
+		return tap.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		if _, _, err := tap.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
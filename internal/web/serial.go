@@ -0,0 +1,188 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/proxy"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/rfc2217"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/upstream"
+)
+
+// handleUpstreamSerial shows (GET) or changes (PUT) the serial line
+// settings of an RFC 2217 upstream. ?upstream= selects one in
+// multi-upstream mode.
+func (s *Server) handleUpstreamSerial(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("upstream")
+
+	var (
+		st  upstream.SerialStatus
+		err error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		st, err = s.proxy.SerialStatus(name)
+	case http.MethodPut:
+		var p rfc2217.Params
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := p.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		st, err = s.proxy.SetSerialParams(name, p)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case s.serialError(w, err):
+		return
+	case errors.Is(err, rfc2217.ErrNotConfirmed):
+		// The settings are kept and re-sent on reconnect; report what we have
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusGatewayTimeout)
+		_ = json.NewEncoder(w).Encode(st)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		s.logger.Error("Failed to encode serial settings: %v", err)
+	}
+}
+
+// handleUpstreamLines shows the modem control lines (GET) or sets DTR/RTS
+// (PUT) of an RFC 2217 upstream
+func (s *Server) handleUpstreamLines(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("upstream")
+
+	var (
+		lines rfc2217.Lines
+		err   error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		lines, err = s.proxy.UpstreamLines(name)
+	case http.MethodPut:
+		var update rfc2217.LineUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if update.DTR == nil && update.RTS == nil {
+			http.Error(w, "dtr or rts is required", http.StatusBadRequest)
+			return
+		}
+		lines, err = s.proxy.SetUpstreamLines(name, update)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case s.serialError(w, err):
+		return
+	case errors.Is(err, rfc2217.ErrNotConfirmed):
+		http.Error(w, "Device server did not confirm the change", http.StatusGatewayTimeout)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(lines); err != nil {
+		s.logger.Error("Failed to encode modem lines: %v", err)
+	}
+}
+
+// defaultBreakMs is the break length when a request gives none
+const defaultBreakMs = 250
+
+// BreakRequest sends a break on an RFC 2217 upstream
+type BreakRequest struct {
+	DurationMs int `json:"duration_ms"` // defaults to 250
+}
+
+// handleUpstreamBreak sends a break (POST) on an RFC 2217 upstream. The
+// request returns once the break has ended.
+func (s *Server) handleUpstreamBreak(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := BreakRequest{DurationMs: defaultBreakMs}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	}
+	d := time.Duration(req.DurationMs) * time.Millisecond
+	if d <= 0 || d > proxy.MaxBreak {
+		http.Error(w, fmt.Sprintf("duration_ms must be between 1 and %d", proxy.MaxBreak.Milliseconds()), http.StatusBadRequest)
+		return
+	}
+
+	err := s.proxy.SendBreak(r.URL.Query().Get("upstream"), d)
+	switch {
+	case s.serialError(w, err):
+		return
+	case errors.Is(err, rfc2217.ErrNotConfirmed):
+		http.Error(w, "Device server did not confirm the break", http.StatusGatewayTimeout)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"success":     true,
+		"duration_ms": req.DurationMs,
+	}); err != nil {
+		s.logger.Error("Failed to encode break response: %v", err)
+	}
+}
+
+// breakStatus maps a SendBreak error to an HTTP status for macro runs
+func breakStatus(err error) int {
+	switch {
+	case errors.Is(err, upstream.ErrNoSerialControl):
+		return http.StatusConflict
+	case errors.Is(err, net.ErrClosed):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, rfc2217.ErrNotConfirmed):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// serialError writes the response for errors shared by the serial control
+// endpoints and reports whether it did
+func (s *Server) serialError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, proxy.ErrUnknownUpstream):
+		http.Error(w, "Upstream not found", http.StatusNotFound)
+	case errors.Is(err, upstream.ErrNoSerialControl):
+		http.Error(w, "Upstream does not support serial control", http.StatusConflict)
+	case errors.Is(err, net.ErrClosed):
+		http.Error(w, "Upstream not connected", http.StatusServiceUnavailable)
+	default:
+		return false
+	}
+	return true
+}
@@ -6,31 +6,62 @@ import (
 	"crypto/subtle"
 	"embed"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/buildinfo"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/coordinator"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/inject"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/macro"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/proxy"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/retention"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/storage"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/values"
 )
 
 //go:embed static
 var staticFS embed.FS
 
-// WebSocket upgrader with permissive origin check for Home Assistant Ingress
+// WebSocket upgrader. The socket accepts commands that write to the bus,
+// so browsers may only open it from the web UI's own origin.
 var wsUpgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins for Home Assistant Ingress compatibility
-	},
+	CheckOrigin:     sameOrigin,
+}
+
+// sameOrigin reports whether a WebSocket handshake comes from the page's own
+// host. Without it, any site a logged-in user visits could open the socket
+// with the session cookie. Clients other than browsers send no Origin. Home
+// Assistant Ingress forwards the host the browser used as X-Forwarded-Host,
+// which a page cannot set on a handshake.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	forwarded := r.Header.Get("X-Forwarded-Host")
+	return forwarded != "" && strings.EqualFold(u.Host, strings.TrimSpace(strings.Split(forwarded, ",")[0]))
 }
 
 // wsClient represents a WebSocket client connection
@@ -43,49 +74,90 @@ type wsClient struct {
 	id          string
 	addr        string
 	connectedAt time.Time
+	session     string // session token used to connect, re-checked per command
+	filterMu    sync.Mutex
+	filter      wsFilter
 }
 
 // Session represents an authenticated session
-type Session struct {
-	Token     string
-	CreatedAt time.Time
-	ExpiresAt time.Time
-}
-
 const (
-	sessionCookieName = "session_token"
-	sessionDuration   = 24 * time.Hour
+	sessionCookieName  = "session_token"
+	defaultSessionLife = 24 * time.Hour  // WEB_SESSION_LIFETIME
+	sessionTouchEvery  = time.Minute     // how often activity is written to a session
+	shutdownTimeout    = 5 * time.Second // for Stop without a deadline
 )
 
 type Server struct {
-	config        *config.Config
-	proxy         *proxy.Server
-	logger        *logger.Logger
-	httpServer    *http.Server
-	clients       map[chan string]bool
-	clientsMu     sync.Mutex
-	wsClients     map[*wsClient]bool
-	wsClientsMu   sync.Mutex
-	wsClientCount uint64
-	logBuffer     []string
-	logBufferMu   sync.Mutex
-	sessions      map[string]*Session
-	sessionsMu    sync.RWMutex
+	config          *config.Config
+	proxy           *proxy.Server
+	logger          *logger.Logger
+	httpServer      *http.Server
+	acmeServer      *http.Server           // HTTP-01 challenges and redirects
+	clients         map[chan []string]bool // SSE clients, sent batches of log lines
+	valueClients    map[chan values.Value]bool
+	eventClients    map[chan proxy.Event]bool
+	packetClients   map[chan PacketEvent]bool // SSE clients, with WEB_PACKET_EVENTS
+	textDetect      textDetectors
+	clientsMu       sync.Mutex
+	wsClients       map[*wsClient]bool
+	wsClientsMu     sync.Mutex
+	wsClientCount   uint64
+	taps            map[*packetTap]bool // /api/ws/packets clients
+	tapsMu          sync.Mutex
+	tapCount        atomic.Int32    // len(taps), checked without the lock for every packet
+	store           storage.Storage // log lines replayed to new clients, sessions
+	statusInterval  time.Duration   // WEB_STATUS_INTERVAL
+	sseHeartbeat    time.Duration   // WEB_SSE_HEARTBEAT
+	wsPing          time.Duration   // WEB_WS_PING_INTERVAL
+	sessionLife     time.Duration   // WEB_SESSION_LIFETIME
+	sessionIdle     time.Duration   // WEB_SESSION_IDLE_TIMEOUT, 0 disables
+	logBatch        []string        // log lines not yet sent to web clients
+	logTimer        *time.Timer
+	logBatchMu      sync.Mutex
+	logFlushMu      sync.Mutex
+	renderer        *inject.Renderer
+	macros          *macro.Store
+	build           buildinfo.Info // reported by /api/health
+	retention       *retention.Manager
+	loggingMu       sync.Mutex
+	loggingRevert   *time.Timer // restores loggingBase after a temporary change
+	loggingRevertAt time.Time
+	loggingBase     LoggingState // settings before the temporary change
+	loggingGen      uint64       // counts changes, so a stale revert is ignored
+	listenState     atomic.Pointer[WebListen]
 }
 
 func NewServer(cfg *config.Config, p *proxy.Server, l *logger.Logger) *Server {
 	s := &Server{
-		config:    cfg,
-		proxy:     p,
-		logger:    l,
-		clients:   make(map[chan string]bool),
-		wsClients: make(map[*wsClient]bool),
-		logBuffer: make([]string, 0, 1000),
-		sessions:  make(map[string]*Session),
+		config:         cfg,
+		proxy:          p,
+		logger:         l,
+		clients:        make(map[chan []string]bool),
+		valueClients:   make(map[chan values.Value]bool),
+		eventClients:   make(map[chan proxy.Event]bool),
+		packetClients:  make(map[chan PacketEvent]bool),
+		wsClients:      make(map[*wsClient]bool),
+		taps:           make(map[*packetTap]bool),
+		store:          p.Storage(),
+		statusInterval: secondsOr(cfg.WebStatusInterval, defaultStatusInterval),
+		sseHeartbeat:   secondsOr(cfg.WebSSEHeartbeat, defaultSSEHeartbeat),
+		wsPing:         secondsOr(cfg.WebWSPing, defaultWSPing),
+		sessionLife:    secondsOr(cfg.WebSessionLife, defaultSessionLife),
+		sessionIdle:    time.Duration(cfg.WebSessionIdle) * time.Second,
+		renderer:       inject.NewRenderer(),
+		build:          buildinfo.Read("dev"),
+	}
+
+	macros, err := macro.NewStore(cfg.MacrosFile)
+	if err != nil {
+		l.Warn("Failed to load macros from %s: %v", cfg.MacrosFile, err)
 	}
+	s.macros = macros
 
-	// Register log callback
-	l.SetLogCallback(s.broadcastLog)
+	// Register log and value callbacks
+	l.SetEntryCallback(s.broadcastLog)
+	p.SetValueCallback(s.broadcastValue)
+	p.SetEventCallback(s.broadcastEvent)
 
 	// Start session cleanup goroutine
 	go s.cleanupExpiredSessions()
@@ -102,49 +174,77 @@ func generateSessionToken() (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
-// createSession creates a new session and returns the token
-func (s *Server) createSession() (string, error) {
+// createSession creates a new session for the login request r and returns
+// the token
+func (s *Server) createSession(r *http.Request) (string, error) {
 	token, err := generateSessionToken()
 	if err != nil {
 		return "", err
 	}
 
-	session := &Session{
-		Token:     token,
-		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(sessionDuration),
+	now := time.Now()
+	session := storage.Session{
+		Token:      token,
+		CreatedAt:  now,
+		ExpiresAt:  s.sessionExpiry(now, now),
+		LastSeen:   now,
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+	}
+	if err := s.store.PutSession(session); err != nil {
+		return "", err
 	}
-
-	s.sessionsMu.Lock()
-	s.sessions[token] = session
-	s.sessionsMu.Unlock()
 
 	return token, nil
 }
 
-// validateSession checks if a session token is valid
-func (s *Server) validateSession(token string) bool {
-	s.sessionsMu.RLock()
-	session, exists := s.sessions[token]
-	s.sessionsMu.RUnlock()
+// sessionExpiry returns when a session created at created and last used at
+// seen ends: after WEB_SESSION_LIFETIME, or WEB_SESSION_IDLE_TIMEOUT after
+// seen if that is earlier
+func (s *Server) sessionExpiry(created, seen time.Time) time.Time {
+	expires := created.Add(s.sessionLife)
+	if s.sessionIdle > 0 && seen.Add(s.sessionIdle).Before(expires) {
+		return seen.Add(s.sessionIdle)
+	}
+	return expires
+}
 
+// validateSession checks if a session token is valid. A valid session
+// counts as active, which extends it under WEB_SESSION_IDLE_TIMEOUT; the
+// activity is written at most once per sessionTouchEvery, or a quarter of
+// the idle timeout if that is shorter.
+func (s *Server) validateSession(token string) bool {
+	session, exists, err := s.store.Session(token)
+	if err != nil {
+		s.logger.Warn("Failed to look up session: %v", err)
+	}
 	if !exists {
 		return false
 	}
 
-	if time.Now().After(session.ExpiresAt) {
+	now := time.Now()
+	if now.After(session.ExpiresAt) {
 		s.deleteSession(token)
 		return false
 	}
 
+	touchEvery := sessionTouchEvery
+	if s.sessionIdle > 0 {
+		touchEvery = min(touchEvery, s.sessionIdle/4)
+	}
+	if now.Sub(session.LastSeen) >= touchEvery {
+		if err := s.store.TouchSession(token, now, s.sessionExpiry(session.CreatedAt, now)); err != nil {
+			s.logger.Warn("Failed to update session: %v", err)
+		}
+	}
 	return true
 }
 
 // deleteSession removes a session
 func (s *Server) deleteSession(token string) {
-	s.sessionsMu.Lock()
-	delete(s.sessions, token)
-	s.sessionsMu.Unlock()
+	if err := s.store.DeleteSession(token); err != nil {
+		s.logger.Warn("Failed to delete session: %v", err)
+	}
 }
 
 // cleanupExpiredSessions periodically removes expired sessions
@@ -152,15 +252,10 @@ func (s *Server) cleanupExpiredSessions() {
 	ticker := time.NewTicker(1 * time.Hour)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		s.sessionsMu.Lock()
-		now := time.Now()
-		for token, session := range s.sessions {
-			if now.After(session.ExpiresAt) {
-				delete(s.sessions, token)
-			}
+	for now := range ticker.C {
+		if err := s.store.DeleteExpiredSessions(now); err != nil {
+			s.logger.Warn("Failed to delete expired sessions: %v", err)
 		}
-		s.sessionsMu.Unlock()
 	}
 }
 
@@ -197,7 +292,22 @@ func (s *Server) isAuthenticated(r *http.Request) bool {
 		return true
 	}
 
-	return false
+	return s.isAdmin(r)
+}
+
+// isAdmin reports whether the request carries the WEB_ADMIN_USERNAME
+// account via Basic Auth. Sessions from the login page are never admin.
+func (s *Server) isAdmin(r *http.Request) bool {
+	if s.config.WebAdminUsername == "" {
+		return false
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(s.config.WebAdminUsername)) == 1
+	passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(s.config.WebAdminPassword)) == 1
+	return usernameMatch && passwordMatch
 }
 
 // authMiddleware wraps a handler with authentication
@@ -234,7 +344,9 @@ func (s *Server) authHandler(next http.Handler) http.Handler {
 	})
 }
 
-func (s *Server) Start() error {
+// Start opens the web UI listener and serves it in the background. ctx
+// bounds opening the listeners; use Stop to shut the server down.
+func (s *Server) Start(ctx context.Context) error {
 	mux := http.NewServeMux()
 
 	// API endpoints
@@ -246,12 +358,43 @@ func (s *Server) Start() error {
 
 	// Protected endpoints require authentication when enabled
 	mux.HandleFunc("/api/status", s.authMiddleware(s.handleStatus))
+	mux.HandleFunc("/api/stats", s.authMiddleware(s.handleStats))
+	mux.HandleFunc("/api/version", s.authMiddleware(s.handleVersion))
 	mux.HandleFunc("/api/config", s.authMiddleware(s.handleConfig))
+	mux.HandleFunc("/api/config/schema", s.authMiddleware(s.handleConfigSchema))
+	mux.HandleFunc("/api/config/effective", s.authMiddleware(s.handleConfigEffective))
+	mux.HandleFunc("/api/logs", s.authMiddleware(s.handleLogs))
+	mux.HandleFunc("/api/logs/file", s.authMiddleware(s.handleLogFile))
+	mux.HandleFunc("/api/logs/files", s.authMiddleware(s.handleLogFiles))
+	mux.HandleFunc("/api/storage", s.authMiddleware(s.handleStorage))
+	mux.HandleFunc("/api/logging", s.authMiddleware(s.handleLogging))
 	mux.HandleFunc("/api/events", s.authMiddleware(s.handleEvents)) // Legacy SSE endpoint
 	mux.HandleFunc("/api/ws", s.authMiddleware(s.handleWebSocket))  // WebSocket endpoint
+	mux.HandleFunc("/api/events/history", s.authMiddleware(s.handleEventHistory))
+	mux.HandleFunc("/api/ws/packets", s.authMiddleware(s.handlePacketTap))
+	mux.HandleFunc("/api/packets/stream", s.authMiddleware(s.handlePacketStream))
 	mux.HandleFunc("/api/inject", s.authMiddleware(s.handleInject))
+	mux.HandleFunc("/api/inject/file", s.authMiddleware(s.handleInjectFile))
+	mux.HandleFunc("/api/injection", s.authMiddleware(s.handleInjection))
+	mux.HandleFunc("/api/dry-run", s.authMiddleware(s.handleDryRun))
+	mux.HandleFunc("/api/park", s.authMiddleware(s.handlePark))
+	mux.HandleFunc("/api/upstream/serial", s.authMiddleware(s.handleUpstreamSerial))
+	mux.HandleFunc("/api/upstream/lines", s.authMiddleware(s.handleUpstreamLines))
+	mux.HandleFunc("/api/upstream/break", s.authMiddleware(s.handleUpstreamBreak))
+	mux.HandleFunc("/api/mux", s.authMiddleware(s.handleMux))
+	mux.HandleFunc("/api/flashing", s.authMiddleware(s.handleFlashing))
 	mux.HandleFunc("/api/clients", s.authMiddleware(s.handleClients))
 	mux.HandleFunc("/api/clients/disconnect", s.authMiddleware(s.handleDisconnectClient))
+	mux.HandleFunc("/api/triggers", s.authMiddleware(s.handleTriggers))
+	mux.HandleFunc("/api/values", s.authMiddleware(s.handleValues))
+	mux.HandleFunc("/api/values/", s.authMiddleware(s.handleValue))
+	mux.HandleFunc("/api/poll", s.authMiddleware(s.handlePolls))
+	mux.HandleFunc("/api/poll/", s.authMiddleware(s.handlePoll))
+	mux.HandleFunc("/api/macros", s.authMiddleware(s.handleMacros))
+	mux.HandleFunc("/api/macros/", s.authMiddleware(s.handleMacro))
+	mux.HandleFunc("/api/sessions", s.authMiddleware(s.handleSessions))
+	mux.HandleFunc("/api/sessions/", s.authMiddleware(s.handleSession))
+	mux.HandleFunc("/api/captures/diff", s.authMiddleware(s.handleCaptureDiff))
 
 	// Static files (protected)
 	staticRoot, err := fs.Sub(staticFS, "static")
@@ -260,15 +403,23 @@ func (s *Server) Start() error {
 	}
 	mux.Handle("/", s.authHandler(http.FileServer(http.FS(staticRoot))))
 
+	ln, err := s.listen(ctx)
+	if err != nil {
+		return err
+	}
 	s.httpServer = &http.Server{
-		Addr:    fmt.Sprintf(":%d", s.config.WebPort),
+		Addr:    ln.Addr().String(),
 		Handler: mux,
 	}
 
-	s.logger.Info("Web UI listening on http://localhost:%d", s.config.WebPort)
+	if s.config.ACMEEnabled() {
+		return s.startACME(ctx, ln)
+	}
+
+	s.logger.Info("Web UI listening on http://localhost:%d", s.webPort())
 
 	go func() {
-		if err := s.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := s.httpServer.Serve(ln); err != nil && err != http.ErrServerClosed {
 			s.logger.Error("Web server error: %v", err)
 		}
 	}()
@@ -276,14 +427,109 @@ func (s *Server) Start() error {
 	return nil
 }
 
-func (s *Server) Stop() {
-	if s.httpServer != nil {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// startACME serves the web UI over HTTPS on ln with certificates from ACME
+func (s *Server) startACME(ctx context.Context, ln net.Listener) error {
+	m := s.newACMEManager()
+	s.httpServer.TLSConfig = m.TLSConfig()
+
+	if s.config.ACMEHTTPPort > 0 {
+		s.acmeServer = &http.Server{
+			Addr:    fmt.Sprintf(":%d", s.config.ACMEHTTPPort),
+			Handler: m.HTTPHandler(http.HandlerFunc(s.httpsRedirect)),
+		}
+		var lc net.ListenConfig
+		acmeLn, err := lc.Listen(ctx, "tcp", s.acmeServer.Addr)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		go func() {
+			if err := s.acmeServer.Serve(acmeLn); err != nil && err != http.ErrServerClosed {
+				s.logger.Error("ACME HTTP-01 listener error: %v", err)
+			}
+		}()
+	}
+
+	s.logger.Info("Web UI listening on https://%s:%d (ACME certificates cached in %s)",
+		s.config.ACMEDomains[0], s.webPort(), s.config.ACMECacheDir)
+
+	go func() {
+		if err := s.httpServer.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+			s.logger.Error("Web server error: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// Stop shuts the web UI down, waiting for requests in progress until ctx
+// is done, or for shutdownTimeout if ctx has no deadline
+func (s *Server) Stop(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, shutdownTimeout)
 		defer cancel()
-		if err := s.httpServer.Shutdown(ctx); err != nil {
-			s.logger.Error("Web server shutdown error: %v", err)
+	}
+	s.loggingMu.Lock()
+	if s.loggingRevert != nil {
+		s.loggingRevert.Stop()
+		s.loggingRevert = nil
+	}
+	s.loggingMu.Unlock()
+
+	var errs []error
+	if s.acmeServer != nil {
+		errs = append(errs, s.acmeServer.Shutdown(ctx))
+	}
+	if s.httpServer != nil {
+		errs = append(errs, s.httpServer.Shutdown(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// getStatus returns the proxy status with the web server's own queue
+// depths added to the runtime section
+func (s *Server) getStatus() map[string]interface{} {
+	status := s.proxy.GetStatus()
+	rt, ok := status["runtime"].(proxy.RuntimeStats)
+	if !ok {
+		return status
+	}
+
+	sse := 0
+	s.clientsMu.Lock()
+	for ch := range s.clients {
+		sse += len(ch)
+	}
+	for ch := range s.valueClients {
+		sse += len(ch)
+	}
+	s.clientsMu.Unlock()
+
+	ws := 0
+	s.wsClientsMu.Lock()
+	for c := range s.wsClients {
+		ws += len(c.send)
+	}
+	s.wsClientsMu.Unlock()
+
+	rt.Queues["sse_events"] = sse
+	rt.Queues["websocket_messages"] = ws
+
+	s.tapsMu.Lock()
+	if len(s.taps) > 0 {
+		tapped := 0
+		for tap := range s.taps {
+			tapped += len(tap.send)
 		}
+		rt.Queues["packet_tap"] = tapped
 	}
+	s.tapsMu.Unlock()
+	status["log_buffer"] = s.logBufferStats()
+	if state := s.listenState.Load(); state != nil {
+		status["web"] = *state
+	}
+	return status
 }
 
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
@@ -292,13 +538,26 @@ func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	status := s.proxy.GetStatus()
+	status := s.getStatus()
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(status); err != nil {
 		s.logger.Error("Failed to encode status: %v", err)
 	}
 }
 
+// handleStats serves numeric statistics only, for dashboards
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.proxy.GetStats()); err != nil {
+		s.logger.Error("Failed to encode stats: %v", err)
+	}
+}
+
 // HealthStatus represents the overall health status
 type HealthStatus string
 
@@ -306,6 +565,7 @@ const (
 	HealthStatusHealthy   HealthStatus = "healthy"
 	HealthStatusDegraded  HealthStatus = "degraded"
 	HealthStatusUnhealthy HealthStatus = "unhealthy"
+	HealthStatusStarting  HealthStatus = "starting" // waiting for the upstream before listening
 )
 
 // HealthCheckStatus represents individual check status
@@ -313,6 +573,7 @@ type HealthCheckStatus string
 
 const (
 	CheckHealthy   HealthCheckStatus = "healthy"
+	CheckDegraded  HealthCheckStatus = "degraded"
 	CheckUnhealthy HealthCheckStatus = "unhealthy"
 )
 
@@ -322,6 +583,8 @@ type UpstreamCheck struct {
 	Connected     bool              `json:"connected"`
 	Address       string            `json:"address"`
 	LastConnected string            `json:"last_connected,omitempty"`
+	Parked        bool              `json:"parked,omitempty"`
+	Debounced     bool              `json:"debounced,omitempty"` // down for less than HEALTH_DEBOUNCE_SECONDS
 }
 
 // ClientsCheck represents clients health check details
@@ -333,33 +596,67 @@ type ClientsCheck struct {
 
 // WebServerCheck represents web server health check details
 type WebServerCheck struct {
+	Status         HealthCheckStatus `json:"status"`
+	Port           int               `json:"port"`
+	ConfiguredPort int               `json:"configured_port,omitempty"` // WEB_PORT, when serving on a fallback port
+}
+
+// webServerCheck reports the web server as degraded while it serves on a
+// fallback port, where links and the add-on's ingress do not reach it
+func (s *Server) webServerCheck() WebServerCheck {
+	check := WebServerCheck{Status: CheckHealthy, Port: s.webPort()}
+	if state := s.listenState.Load(); state != nil && state.Fallback {
+		check.Status, check.ConfiguredPort = CheckDegraded, state.Configured
+	}
+	return check
+}
+
+// DataCheck reports how long the upstream has been silent, when
+// HEALTH_DATA_DEGRADED_SECONDS or HEALTH_DATA_UNHEALTHY_SECONDS is set
+type DataCheck struct {
+	Status         HealthCheckStatus `json:"status"`
+	LastReceived   string            `json:"last_received,omitempty"`
+	LastSent       string            `json:"last_sent,omitempty"`
+	SilentSeconds  int64             `json:"silent_seconds"`
+	DegradedAfter  int               `json:"degraded_after,omitempty"`
+	UnhealthyAfter int               `json:"unhealthy_after,omitempty"`
+}
+
+// CoordinatorCheck describes the coordinator detected behind the upstream
+type CoordinatorCheck struct {
 	Status HealthCheckStatus `json:"status"`
-	Port   int               `json:"port"`
+	*coordinator.Info
 }
 
 // HealthChecks contains all health check results
 type HealthChecks struct {
-	Upstream  UpstreamCheck  `json:"upstream"`
-	Clients   ClientsCheck   `json:"clients"`
-	WebServer WebServerCheck `json:"web_server"`
+	Upstream    UpstreamCheck     `json:"upstream"`
+	Clients     ClientsCheck      `json:"clients"`
+	WebServer   WebServerCheck    `json:"web_server"`
+	Data        *DataCheck        `json:"data,omitempty"`
+	Coordinator *CoordinatorCheck `json:"coordinator,omitempty"`
 }
 
 // HealthResponse represents the health check response
 type HealthResponse struct {
 	Status    HealthStatus `json:"status"`
 	Version   string       `json:"version"`
+	Commit    string       `json:"commit,omitempty"`
 	Uptime    int64        `json:"uptime"`
 	Checks    HealthChecks `json:"checks"`
 	Timestamp string       `json:"timestamp"`
 }
 
-// Version is set at build time via -ldflags
-// This should be set to the same value as main.Version
-var Version = "dev"
+// SetBuildInfo sets the build reported by /api/health. Call it before
+// Start; the default is version "dev".
+func (s *Server) SetBuildInfo(info buildinfo.Info) {
+	s.build = info
+}
 
-// SetVersion allows setting the version from main package
-func SetVersion(v string) {
-	Version = v
+// SetRetention sets the manager whose disk use /api/storage reports. Call
+// it before Start.
+func (s *Server) SetRetention(m *retention.Manager) {
+	s.retention = m
 }
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
@@ -370,10 +667,12 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 
 	isListening := s.proxy.IsListening()
 	isUpstreamConnected := s.proxy.IsUpstreamConnected()
+	// A brief reconnect does not change the reported health
+	debounced := s.proxy.UpstreamDebounced()
 
 	// Determine upstream check status
 	upstreamStatus := CheckUnhealthy
-	if isUpstreamConnected {
+	if isUpstreamConnected || debounced {
 		upstreamStatus = CheckHealthy
 	}
 
@@ -386,9 +685,11 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 
 	// Determine overall health status
 	var overallStatus HealthStatus
-	if !isListening {
+	if s.proxy.IsStarting() {
+		overallStatus = HealthStatusStarting
+	} else if !isListening {
 		overallStatus = HealthStatusUnhealthy
-	} else if isUpstreamConnected {
+	} else if isUpstreamConnected || debounced {
 		overallStatus = HealthStatusHealthy
 	} else {
 		overallStatus = HealthStatusDegraded
@@ -399,7 +700,8 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 
 	response := HealthResponse{
 		Status:  overallStatus,
-		Version: Version,
+		Version: s.build.Version,
+		Commit:  s.build.Commit,
 		Uptime:  uptime,
 		Checks: HealthChecks{
 			Upstream: UpstreamCheck{
@@ -407,23 +709,38 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 				Connected:     isUpstreamConnected,
 				Address:       s.proxy.GetUpstreamAddr(),
 				LastConnected: lastConnectedStr,
+				Parked:        s.proxy.Parked(),
+				Debounced:     debounced,
 			},
 			Clients: ClientsCheck{
 				Status: CheckHealthy,
 				Count:  s.proxy.GetClientCount(),
 				Max:    s.proxy.GetMaxClients(),
 			},
-			WebServer: WebServerCheck{
-				Status: CheckHealthy,
-				Port:   s.config.WebPort,
-			},
+			WebServer: s.webServerCheck(),
 		},
 		Timestamp: time.Now().Format(time.RFC3339),
 	}
+	if response.Checks.WebServer.Status == CheckDegraded && response.Status == HealthStatusHealthy {
+		response.Status = HealthStatusDegraded
+	}
+	if data := s.dataCheck(); data != nil {
+		response.Checks.Data = data
+		switch {
+		case response.Status == HealthStatusStarting:
+		case data.Status == CheckUnhealthy:
+			response.Status = HealthStatusUnhealthy
+		case data.Status == CheckDegraded && response.Status == HealthStatusHealthy:
+			response.Status = HealthStatusDegraded
+		}
+	}
+	if coord := s.proxy.GetCoordinator(); coord != nil {
+		response.Checks.Coordinator = &CoordinatorCheck{Status: CheckHealthy, Info: coord}
+	}
 
 	// Set HTTP status code based on health
 	httpStatus := http.StatusOK
-	if overallStatus == HealthStatusUnhealthy {
+	if response.Status == HealthStatusUnhealthy || response.Status == HealthStatusStarting {
 		httpStatus = http.StatusServiceUnavailable
 	}
 
@@ -434,6 +751,40 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// dataCheck measures upstream silence from the last packet received, or
+// from the start if none has been. Reconnects do not reset it, so a link
+// that connects but carries no data still turns stale. It returns nil when
+// no threshold is configured.
+func (s *Server) dataCheck() *DataCheck {
+	if s.config.HealthDegraded <= 0 && s.config.HealthUnhealthy <= 0 {
+		return nil
+	}
+	received, sent := s.proxy.GetLastPackets()
+	check := &DataCheck{
+		Status:         CheckHealthy,
+		DegradedAfter:  s.config.HealthDegraded,
+		UnhealthyAfter: s.config.HealthUnhealthy,
+	}
+	since := s.proxy.GetStartTime()
+	if !received.IsZero() {
+		since = received
+		check.LastReceived = received.Format(time.RFC3339)
+	}
+	if !sent.IsZero() {
+		check.LastSent = sent.Format(time.RFC3339)
+	}
+	silent := time.Since(since)
+	check.SilentSeconds = int64(silent.Seconds())
+
+	switch {
+	case s.config.HealthUnhealthy > 0 && silent >= time.Duration(s.config.HealthUnhealthy)*time.Second:
+		check.Status = CheckUnhealthy
+	case s.config.HealthDegraded > 0 && silent >= time.Duration(s.config.HealthDegraded)*time.Second:
+		check.Status = CheckDegraded
+	}
+	return check
+}
+
 // PublicConfig contains only non-sensitive configuration fields for API exposure
 type PublicConfig struct {
 	UpstreamHost string `json:"upstream_host"`
@@ -455,7 +806,7 @@ func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
 		UpstreamPort: s.config.UpstreamPort,
 		ListenPort:   s.config.ListenPort,
 		MaxClients:   s.config.MaxClients,
-		LogPackets:   s.config.LogPackets,
+		LogPackets:   s.logger.IsPacketLoggingEnabled(),
 		WebPort:      s.config.WebPort,
 	}
 
@@ -494,18 +845,29 @@ func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	flusher.Flush()
 
-	// Create a channel for this client
-	clientChan := make(chan string, 10)
+	// Create channels for this client
+	clientChan := make(chan []string, 10)
+	valueChan := make(chan values.Value, 10)
+	eventChan := make(chan proxy.Event, 10)
+	packetChan := make(chan PacketEvent, 64)
 
 	// Register client
 	s.clientsMu.Lock()
 	s.clients[clientChan] = true
+	s.valueClients[valueChan] = true
+	s.eventClients[eventChan] = true
+	if s.config.WebPacketEvents {
+		s.packetClients[packetChan] = true
+	}
 	s.clientsMu.Unlock()
 
 	// Ensure client is removed when connection closes
 	defer func() {
 		s.clientsMu.Lock()
 		delete(s.clients, clientChan)
+		delete(s.valueClients, valueChan)
+		delete(s.eventClients, eventChan)
+		delete(s.packetClients, packetChan)
 		s.clientsMu.Unlock()
 		close(clientChan)
 		s.proxy.RemoveWebClient()
@@ -517,32 +879,55 @@ func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
 		flusher.Flush()
 	}
 
+	// Log lines are written one event each, but flushed once per batch
+	writeLogs := func(lines []string) {
+		for _, line := range lines {
+			fmt.Fprintf(w, "event: log\ndata: %s\n\n", line)
+		}
+		flusher.Flush()
+	}
+
 	// Send initial status
-	if statusData, err := json.Marshal(s.proxy.GetStatus()); err == nil {
+	if statusData, err := json.Marshal(s.getStatus()); err == nil {
 		writeEvent("status", string(statusData))
 	}
 
 	// Send buffered logs
-	s.logBufferMu.Lock()
-	for _, msg := range s.logBuffer {
-		writeEvent("log", msg)
+	writeLogs(entryLines(s.bufferedLogs()))
+
+	// Send current values
+	for _, v := range s.proxy.GetValues() {
+		if valueData, err := json.Marshal(v); err == nil {
+			writeEvent("value", string(valueData))
+		}
 	}
-	s.logBufferMu.Unlock()
 
-	// Periodic status update ticker (2 seconds)
-	statusTicker := time.NewTicker(2 * time.Second)
-	defer statusTicker.Stop()
+	// Periodic status updates, unless disabled
+	statusTicks, stopStatus := s.statusTicker()
+	defer stopStatus()
 
-	// Heartbeat ticker to keep connection alive through proxies (15 seconds)
-	heartbeatTicker := time.NewTicker(15 * time.Second)
+	// Heartbeat ticker to keep connection alive through proxies
+	heartbeatTicker := time.NewTicker(s.sseHeartbeat)
 	defer heartbeatTicker.Stop()
 
 	for {
 		select {
-		case msg := <-clientChan:
-			writeEvent("log", msg)
-		case <-statusTicker.C:
-			if statusData, err := json.Marshal(s.proxy.GetStatus()); err == nil {
+		case lines := <-clientChan:
+			writeLogs(lines)
+		case v := <-valueChan:
+			if valueData, err := json.Marshal(v); err == nil {
+				writeEvent("value", string(valueData))
+			}
+		case e := <-eventChan:
+			if eventData, err := json.Marshal(e); err == nil {
+				writeEvent(e.Type, string(eventData))
+			}
+		case p := <-packetChan:
+			if packetData, err := json.Marshal(p); err == nil {
+				writeEvent("packet", string(packetData))
+			}
+		case <-statusTicks:
+			if statusData, err := json.Marshal(s.getStatus()); err == nil {
 				writeEvent("status", string(statusData))
 			}
 		case <-heartbeatTicker.C:
@@ -555,28 +940,52 @@ func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) broadcastLog(msg string) {
-	// Add to buffer
-	s.logBufferMu.Lock()
-	s.logBuffer = append(s.logBuffer, msg)
-	if len(s.logBuffer) > 1000 {
-		s.logBuffer = s.logBuffer[1:]
+func (s *Server) broadcastLog(e logger.Entry) {
+	if e.Level == logger.LogPkt {
+		s.tapPacket(e)
+		if s.config.WebPacketEvents {
+			s.broadcastPacket(e)
+		}
+		// Data is only valid during the callback
+		e.Data = nil
 	}
-	s.logBufferMu.Unlock()
 
-	// Broadcast to SSE clients
+	// Keep for new clients. A failure is not logged, as that would log
+	// again from within the log callback.
+	_ = s.store.AddLog(e)
+
+	// Broadcast to SSE and WebSocket clients with the next batch
+	s.queueLog(e.Line)
+}
+
+// broadcastValue pushes an extracted value to SSE and WebSocket clients
+func (s *Server) broadcastValue(v values.Value) {
 	s.clientsMu.Lock()
-	for clientChan := range s.clients {
+	for valueChan := range s.valueClients {
 		select {
-		case clientChan <- msg:
+		case valueChan <- v:
 		default:
-			// Drop message if client is too slow
+			// Drop update if client is too slow
 		}
 	}
 	s.clientsMu.Unlock()
 
-	// Broadcast to WebSocket clients
-	s.broadcastToWebSocket("log", msg)
+	s.broadcastToWebSocket("value", v)
+}
+
+// broadcastEvent pushes a client or upstream event to SSE and WebSocket
+// clients
+func (s *Server) broadcastEvent(e proxy.Event) {
+	s.clientsMu.Lock()
+	for eventChan := range s.eventClients {
+		select {
+		case eventChan <- e:
+		default:
+		}
+	}
+	s.clientsMu.Unlock()
+
+	s.broadcastToWebSocket(e.Type, e)
 }
 
 // WebSocket message types
@@ -618,35 +1027,54 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		addr:        r.RemoteAddr,
 		connectedAt: time.Now(),
 	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && s.validateSession(cookie.Value) {
+		client.session = cookie.Value
+	}
 
 	// Register client
 	s.wsClientsMu.Lock()
 	s.wsClients[client] = true
 	s.wsClientsMu.Unlock()
+	s.proxy.EmitWebClient(client.info(), true)
+
+	// The write pump has not started yet, so the initial messages must not
+	// block: once the channel is full, the rest is skipped. Values left out
+	// are sent with their next update.
+	queue := func(data []byte) bool {
+		select {
+		case client.send <- data:
+			return true
+		default:
+			return false
+		}
+	}
 
 	// Send initial status
-	if statusData, err := json.Marshal(s.proxy.GetStatus()); err == nil {
+	if statusData, err := json.Marshal(s.getStatus()); err == nil {
 		msg := wsMessage{Type: "status", Data: json.RawMessage(statusData)}
 		if data, err := json.Marshal(msg); err == nil {
-			client.send <- data
+			queue(data)
 		}
 	}
 
-	// Send buffered logs (copy buffer to avoid holding lock during channel sends)
-	s.logBufferMu.Lock()
-	bufferedLogs := make([]string, len(s.logBuffer))
-	copy(bufferedLogs, s.logBuffer)
-	s.logBufferMu.Unlock()
+	// Send current values
+	for _, v := range s.proxy.GetValues() {
+		data, err := json.Marshal(wsMessage{Type: "value", Data: v})
+		if err == nil && !queue(data) {
+			break
+		}
+	}
 
-	for _, logMsg := range bufferedLogs {
-		msg := wsMessage{Type: "log", Data: logMsg}
-		if data, err := json.Marshal(msg); err == nil {
-			select {
-			case client.send <- data:
-			default:
-				// Channel full, skip remaining buffered logs
-				break
-			}
+	// Send buffered logs in batches (copy buffer to avoid holding lock
+	// during channel sends)
+	lines := entryLines(s.bufferedLogs())
+	for len(lines) > 0 {
+		n := min(len(lines), logBatchSize)
+		data, err := logsMessage(lines[:n])
+		lines = lines[n:]
+		if err == nil && !queue(data) {
+			// Channel full, skip remaining buffered logs
+			lines = nil
 		}
 	}
 
@@ -655,6 +1083,15 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	go client.readPump()
 }
 
+func (c *wsClient) info() proxy.ClientInfo {
+	return proxy.ClientInfo{
+		ID:          c.id,
+		Addr:        c.addr,
+		ConnectedAt: c.connectedAt.Format(time.RFC3339),
+		Type:        "web",
+	}
+}
+
 // close safely closes the client and cleans up resources
 func (c *wsClient) close() {
 	c.closedMu.Lock()
@@ -672,6 +1109,7 @@ func (c *wsClient) close() {
 
 	// Decrement web client count
 	c.server.proxy.RemoveWebClient()
+	c.server.proxy.EmitWebClient(c.info(), false)
 
 	// Close connection
 	c.conn.Close()
@@ -679,10 +1117,10 @@ func (c *wsClient) close() {
 
 // writePump pumps messages from the send channel to the WebSocket connection
 func (c *wsClient) writePump() {
-	ticker := time.NewTicker(2 * time.Second) // Status update interval
-	pingTicker := time.NewTicker(30 * time.Second)
+	statusTicks, stopStatus := c.server.statusTicker()
+	pingTicker := time.NewTicker(c.server.wsPing)
 	defer func() {
-		ticker.Stop()
+		stopStatus()
 		pingTicker.Stop()
 		c.close()
 	}()
@@ -700,9 +1138,12 @@ func (c *wsClient) writePump() {
 			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				return
 			}
-		case <-ticker.C:
+		case <-statusTicks:
+			if !c.wants("status", nil) {
+				continue
+			}
 			// Send periodic status update
-			if statusData, err := json.Marshal(c.server.proxy.GetStatus()); err == nil {
+			if statusData, err := json.Marshal(c.server.getStatus()); err == nil {
 				msg := wsMessage{Type: "status", Data: json.RawMessage(statusData)}
 				if data, err := json.Marshal(msg); err == nil {
 					if err := c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second)); err != nil {
@@ -724,29 +1165,33 @@ func (c *wsClient) writePump() {
 	}
 }
 
-// readPump pumps messages from the WebSocket connection (handles pongs and close)
+// readPump pumps messages from the WebSocket connection (commands, pongs and close)
 func (c *wsClient) readPump() {
 	defer func() {
 		// Safely close client and cleanup resources
 		c.close()
 	}()
 
-	c.conn.SetReadLimit(512)
-	if err := c.conn.SetReadDeadline(time.Now().Add(60 * time.Second)); err != nil {
+	c.conn.SetReadLimit(wsReadLimit)
+	pongWait := c.server.wsPongWait()
+	if err := c.conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
 		return
 	}
 	c.conn.SetPongHandler(func(string) error {
-		return c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	})
 
 	for {
-		_, _, err := c.conn.ReadMessage()
+		msgType, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				c.server.logger.Error("WebSocket error: %v", err)
 			}
 			break
 		}
+		if msgType == websocket.TextMessage {
+			c.server.handleCommand(c, message)
+		}
 	}
 }
 
@@ -758,6 +1203,15 @@ func (s *Server) broadcastToWebSocket(msgType string, data interface{}) {
 		return
 	}
 
+	for _, client := range s.openWSClients() {
+		if client.wants(msgType, data) {
+			client.queue(jsonData)
+		}
+	}
+}
+
+// openWSClients returns the WebSocket clients not yet closed
+func (s *Server) openWSClients() []*wsClient {
 	s.wsClientsMu.Lock()
 	clients := make([]*wsClient, 0, len(s.wsClients))
 	for client := range s.wsClients {
@@ -765,28 +1219,53 @@ func (s *Server) broadcastToWebSocket(msgType string, data interface{}) {
 	}
 	s.wsClientsMu.Unlock()
 
+	open := clients[:0]
 	for _, client := range clients {
-		// Check if client is already closed before sending
 		client.closedMu.Lock()
-		if client.closed {
-			client.closedMu.Unlock()
-			continue
+		if !client.closed {
+			open = append(open, client)
 		}
 		client.closedMu.Unlock()
+	}
+	return open
+}
 
-		select {
-		case client.send <- jsonData:
-		default:
-			// Client too slow, close connection
-			go client.close()
-		}
+// queue sends a message to the client, closing it if it is too slow
+func (c *wsClient) queue(data []byte) {
+	select {
+	case c.send <- data:
+	default:
+		// Client too slow, close connection
+		go c.close()
 	}
 }
 
 type InjectRequest struct {
-	Target string `json:"target"` // "upstream" or "downstream"
-	Format string `json:"format"` // "hex" or "ascii"
-	Data   string `json:"data"`
+	Target   string            `json:"target"` // "upstream", "downstream", "upstream:<name>" or "group:<name>"
+	Format   string            `json:"format"` // "hex" or "ascii"
+	Data     string            `json:"data"`   // may contain {{...}} placeholders
+	Vars     map[string]string `json:"vars,omitempty"`
+	ClientID string            `json:"client_id,omitempty"` // with target "downstream", send to this client only
+	Force    bool              `json:"force,omitempty"`     // send frames matching DENY_FRAMES, admin account only
+	Template bool              `json:"template,omitempty"`  // render the placeholders in Data, sent literally otherwise
+}
+
+// errClientTarget rejects a client_id with a target other than downstream
+var errClientTarget = errors.New("client_id requires target downstream")
+
+// errAdminRequired rejects a forced injection without the admin account
+var errAdminRequired = errors.New("force requires the admin account")
+
+// inject sends rendered data as req asks: to one client if req.ClientID
+// is set, otherwise to req.Target
+func (s *Server) inject(req InjectRequest, data []byte) error {
+	if req.ClientID != "" {
+		return s.proxy.InjectToClient(req.ClientID, data)
+	}
+	if req.Force {
+		return s.proxy.InjectPacketOverride(req.Target, data)
+	}
+	return s.proxy.InjectPacket(req.Target, data)
 }
 
 func (s *Server) handleInject(w http.ResponseWriter, r *http.Request) {
@@ -794,33 +1273,45 @@ func (s *Server) handleInject(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	if !s.proxy.InjectionEnabled() {
+		http.Error(w, "Packet injection is disabled", http.StatusForbidden)
+		return
+	}
 
 	var req InjectRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
+	if req.ClientID != "" && req.Target != "downstream" {
+		http.Error(w, errClientTarget.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Force && !s.isAdmin(r) {
+		s.logger.Warn("Forced injection refused: %s from %s", r.URL.Path, r.RemoteAddr)
+		http.Error(w, errAdminRequired.Error(), http.StatusForbidden)
+		return
+	}
 
-	var data []byte
-	if req.Format == "hex" {
-		// Clean hex string: remove spaces, newlines, 0x prefix
-		hexStr := strings.ReplaceAll(req.Data, " ", "")
-		hexStr = strings.ReplaceAll(hexStr, "\n", "")
-		hexStr = strings.ReplaceAll(hexStr, "\r", "")
-		hexStr = strings.TrimPrefix(hexStr, "0x")
-
-		var err error
-		data, err = hex.DecodeString(hexStr)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Invalid Hex: %v", err), http.StatusBadRequest)
-			return
+	// Query parameters provide template variables unless set in the body
+	vars := req.Vars
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+	for key, values := range r.URL.Query() {
+		if _, ok := vars[key]; !ok && len(values) > 0 {
+			vars[key] = values[0]
 		}
-	} else {
-		data = []byte(req.Data)
 	}
 
-	if err := s.proxy.InjectPacket(req.Target, data); err != nil {
-		http.Error(w, fmt.Sprintf("Injection failed: %v", err), http.StatusInternalServerError)
+	data, err := s.renderInject(req, vars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := s.inject(req, data); err != nil {
+		http.Error(w, fmt.Sprintf("Injection failed: %v", err), injectStatus(err))
 		return
 	}
 
@@ -831,6 +1322,20 @@ func (s *Server) handleInject(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// injectStatus returns the HTTP status for an InjectPacket error
+func injectStatus(err error) int {
+	switch {
+	case errors.Is(err, proxy.ErrInjectDisabled), errors.Is(err, proxy.ErrDenied):
+		return http.StatusForbidden
+	case errors.Is(err, proxy.ErrFlashing), errors.Is(err, proxy.ErrParked):
+		return http.StatusConflict
+	case errors.Is(err, proxy.ErrClientNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 // ClientsResponse represents the response for the clients endpoint
 type ClientsResponse struct {
 	Clients    []proxy.ClientInfo `json:"clients"`
@@ -852,12 +1357,7 @@ func (s *Server) handleClients(w http.ResponseWriter, r *http.Request) {
 	// Add web clients
 	s.wsClientsMu.Lock()
 	for client := range s.wsClients {
-		clients = append(clients, proxy.ClientInfo{
-			ID:          client.id,
-			Addr:        client.addr,
-			ConnectedAt: client.connectedAt.Format(time.RFC3339),
-			Type:        "web",
-		})
+		clients = append(clients, client.info())
 	}
 	s.wsClientsMu.Unlock()
 
@@ -875,6 +1375,135 @@ func (s *Server) handleClients(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) handleTriggers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"triggers": s.proxy.GetTriggerStatus(),
+	}); err != nil {
+		s.logger.Error("Failed to encode triggers response: %v", err)
+	}
+}
+
+// handleEventHistory lists the most recent client, upstream and recovery
+// events, optionally only those of ?type=
+func (s *Server) handleEventHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"events": s.proxy.EventHistory(r.URL.Query().Get("type")),
+	}); err != nil {
+		s.logger.Error("Failed to encode event history response: %v", err)
+	}
+}
+
+func (s *Server) handleValues(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"values": s.proxy.GetValues(),
+	}); err != nil {
+		s.logger.Error("Failed to encode values response: %v", err)
+	}
+}
+
+// ValueResponse is the single-value representation served for REST sensors
+type ValueResponse struct {
+	Value     interface{} `json:"value"`
+	Unit      string      `json:"unit,omitempty"`
+	UpdatedAt string      `json:"updated_at"`
+}
+
+// handleValue serves one extracted value as JSON, or as plain text when
+// requested with ?format=text or Accept: text/plain. Missing and stale values
+// return 503 so sensors become unavailable instead of showing old data.
+func (s *Server) handleValue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/values/")
+	if !s.proxy.HasValueRule(name) {
+		http.Error(w, "Value not found", http.StatusNotFound)
+		return
+	}
+
+	v, ok := s.proxy.GetValue(name)
+	if !ok {
+		http.Error(w, "Value not available yet", http.StatusServiceUnavailable)
+		return
+	}
+	if v.Stale {
+		http.Error(w, "Value is stale", http.StatusServiceUnavailable)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "text" || strings.HasPrefix(r.Header.Get("Accept"), "text/plain") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		switch val := v.Value.(type) {
+		case float64:
+			fmt.Fprint(w, strconv.FormatFloat(val, 'f', -1, 64))
+		default:
+			fmt.Fprint(w, val)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ValueResponse{
+		Value:     v.Value,
+		Unit:      v.Unit,
+		UpdatedAt: v.UpdatedAt.Format(time.RFC3339),
+	}); err != nil {
+		s.logger.Error("Failed to encode value response: %v", err)
+	}
+}
+
+func (s *Server) handlePolls(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"polls": s.proxy.GetPollResults(),
+	}); err != nil {
+		s.logger.Error("Failed to encode polls response: %v", err)
+	}
+}
+
+func (s *Server) handlePoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, ok := s.proxy.GetPollResult(strings.TrimPrefix(r.URL.Path, "/api/poll/"))
+	if !ok {
+		http.Error(w, "Poll not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		s.logger.Error("Failed to encode poll response: %v", err)
+	}
+}
+
 type DisconnectRequest struct {
 	ClientID string `json:"client_id"`
 }
@@ -896,20 +1525,9 @@ func (s *Server) handleDisconnectClient(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Check if it's a web client
-	if strings.HasPrefix(req.ClientID, "web#") {
-		success := s.disconnectWebClient(req.ClientID)
-		if !success {
-			http.Error(w, "Client not found", http.StatusNotFound)
-			return
-		}
-	} else {
-		// TCP client
-		success := s.proxy.DisconnectClient(req.ClientID)
-		if !success {
-			http.Error(w, "Client not found", http.StatusNotFound)
-			return
-		}
+	if !s.disconnectClient(req.ClientID) {
+		http.Error(w, "Client not found", http.StatusNotFound)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -919,6 +1537,14 @@ func (s *Server) handleDisconnectClient(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// disconnectClient disconnects a web or TCP client by ID
+func (s *Server) disconnectClient(id string) bool {
+	if strings.HasPrefix(id, "web#") {
+		return s.disconnectWebClient(id)
+	}
+	return s.proxy.DisconnectClient(id)
+}
+
 // disconnectWebClient disconnects a web client by ID
 func (s *Server) disconnectWebClient(id string) bool {
 	s.wsClientsMu.Lock()
@@ -982,7 +1608,7 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create session
-	token, err := s.createSession()
+	token, err := s.createSession(r)
 	if err != nil {
 		s.logger.Error("Failed to create session: %v", err)
 		w.Header().Set("Content-Type", "application/json")
@@ -999,8 +1625,9 @@ func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
 		Value:    token,
 		Path:     "/",
 		HttpOnly: true,
+		Secure:   s.config.ACMEEnabled(),
 		SameSite: http.SameSiteLaxMode,
-		MaxAge:   int(sessionDuration.Seconds()),
+		MaxAge:   int(s.sessionLife.Seconds()),
 	})
 
 	s.logger.Info("User '%s' logged in from %s", req.Username, r.RemoteAddr)
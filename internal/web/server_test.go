@@ -1,20 +1,31 @@
 package web
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/hoon-ch/serial-tcp-proxy/internal/buildinfo"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/pcapng"
 	"github.com/hoon-ch/serial-tcp-proxy/internal/proxy"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/retention"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/storage"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/values"
+	"github.com/hoon-ch/serial-tcp-proxy/pkg/testutil"
 )
 
 func newTestLogger() *logger.Logger {
@@ -45,11 +56,11 @@ func TestHealthEndpoint_Degraded(t *testing.T) {
 	log := newTestLogger()
 	p := proxy.NewServer(cfg, log)
 
-	err = p.Start()
+	err = p.Start(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	// Create web server
 	webServer := NewServer(cfg, p, log)
@@ -142,11 +153,11 @@ func TestHealthEndpoint_Healthy(t *testing.T) {
 	log := newTestLogger()
 	p := proxy.NewServer(cfg, log)
 
-	err = p.Start()
+	err = p.Start(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	// Wait for upstream connection
 	time.Sleep(200 * time.Millisecond)
@@ -187,6 +198,45 @@ func TestHealthEndpoint_Healthy(t *testing.T) {
 	}
 }
 
+func TestHealthEndpoint_DataFreshness(t *testing.T) {
+	cfg := &config.Config{HealthDegraded: 1}
+	upstream, _, webServer, _ := startWSTest(t, cfg)
+
+	health := func() (int, HealthResponse) {
+		w := httptest.NewRecorder()
+		webServer.handleHealth(w, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+		var h HealthResponse
+		if err := json.NewDecoder(w.Body).Decode(&h); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		return w.Code, h
+	}
+
+	// Connected, but the upstream has sent nothing since the start
+	time.Sleep(1100 * time.Millisecond)
+	code, h := health()
+	if h.Status != HealthStatusDegraded || h.Checks.Data == nil || h.Checks.Data.Status != CheckDegraded {
+		t.Fatalf("Expected degraded data check, got %s %+v", h.Status, h.Checks.Data)
+	}
+	if code != http.StatusOK || h.Checks.Data.LastReceived != "" || h.Checks.Data.SilentSeconds < 1 {
+		t.Errorf("Unexpected response %d %+v", code, h.Checks.Data)
+	}
+
+	cfg.HealthUnhealthy = 1
+	if code, h := health(); code != http.StatusServiceUnavailable || h.Status != HealthStatusUnhealthy {
+		t.Errorf("Expected 503 unhealthy, got %d %s", code, h.Status)
+	}
+
+	upstream.Send([]byte{0x01})
+	testutil.Eventually(t, func() bool {
+		_, h := health()
+		return h.Status == HealthStatusHealthy
+	}, "health not restored by upstream data")
+	if _, h := health(); h.Checks.Data.LastReceived == "" || h.Checks.Data.Status != CheckHealthy {
+		t.Errorf("Expected last_received after data, got %+v", h.Checks.Data)
+	}
+}
+
 func TestHealthEndpoint_MethodNotAllowed(t *testing.T) {
 	cfg := &config.Config{
 		UpstreamHost: "127.0.0.1",
@@ -235,11 +285,11 @@ func TestHealthEndpoint_ResponseFormat(t *testing.T) {
 	log := newTestLogger()
 	p := proxy.NewServer(cfg, log)
 
-	err = p.Start()
+	err = p.Start(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	webServer := NewServer(cfg, p, log)
 
@@ -344,11 +394,11 @@ func TestHealthEndpoint_ClientCount(t *testing.T) {
 	log := newTestLogger()
 	p := proxy.NewServer(cfg, log)
 
-	err = p.Start()
+	err = p.Start(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	time.Sleep(200 * time.Millisecond)
 
@@ -678,11 +728,11 @@ func TestHealthEndpoint_NoAuthRequired(t *testing.T) {
 	log := newTestLogger()
 	p := proxy.NewServer(cfg, log)
 
-	err = p.Start()
+	err = p.Start(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	time.Sleep(200 * time.Millisecond)
 
@@ -723,11 +773,11 @@ func TestHandleStatus_Success(t *testing.T) {
 	log := newTestLogger()
 	p := proxy.NewServer(cfg, log)
 
-	err = p.Start()
+	err = p.Start(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	webServer := NewServer(cfg, p, log)
 
@@ -752,6 +802,18 @@ func TestHandleStatus_Success(t *testing.T) {
 	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
 		t.Fatalf("Failed to decode response: %v", err)
 	}
+
+	rt, ok := status["runtime"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected runtime section, got %v", status["runtime"])
+	}
+	if g, _ := rt["goroutines"].(float64); g <= 0 {
+		t.Errorf("Expected positive goroutine count, got %v", rt["goroutines"])
+	}
+	queues, _ := rt["queues"].(map[string]interface{})
+	if _, ok := queues["websocket_messages"]; !ok {
+		t.Errorf("Expected websocket_messages queue depth, got %v", queues)
+	}
 }
 
 func TestHandleStatus_MethodNotAllowed(t *testing.T) {
@@ -780,6 +842,229 @@ func TestHandleStatus_MethodNotAllowed(t *testing.T) {
 	}
 }
 
+func TestHandleStats(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 8899,
+		ListenPort:   18899,
+		MaxClients:   10,
+		WebPort:      18080,
+	}
+
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	webServer := NewServer(cfg, p, log)
+
+	w := httptest.NewRecorder()
+	webServer.handleStats(w, httptest.NewRequest(http.MethodGet, "/api/stats", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var stats map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	for _, key := range []string{"totals", "rates", "packet_sizes", "broadcast_latency_us", "upstreams"} {
+		if _, ok := stats[key]; !ok {
+			t.Errorf("Expected %s in response, got %v", key, stats)
+		}
+	}
+	if _, ok := stats["upstream_host"]; ok {
+		t.Error("Expected no config fields in stats")
+	}
+
+	w = httptest.NewRecorder()
+	webServer.handleStats(w, httptest.NewRequest(http.MethodPost, "/api/stats", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", w.Code)
+	}
+}
+
+func TestHandleUpstreamSerialControl(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 8899,
+		ListenPort:   18899,
+		MaxClients:   10,
+		WebPort:      18080,
+	}
+
+	log := newTestLogger()
+	webServer := NewServer(cfg, proxy.NewServer(cfg, log), log)
+
+	tests := []struct {
+		method, url, body string
+		status            int
+	}{
+		{http.MethodGet, "/api/upstream/serial", "", http.StatusConflict},
+		{http.MethodPut, "/api/upstream/serial", `{"baud_rate":9600}`, http.StatusConflict},
+		{http.MethodPut, "/api/upstream/serial", `{"parity":"sometimes"}`, http.StatusBadRequest},
+		{http.MethodPut, "/api/upstream/serial", `not json`, http.StatusBadRequest},
+		{http.MethodGet, "/api/upstream/serial?upstream=missing", "", http.StatusNotFound},
+		{http.MethodDelete, "/api/upstream/serial", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/api/upstream/lines", "", http.StatusConflict},
+		{http.MethodPut, "/api/upstream/lines", `{"dtr":false}`, http.StatusConflict},
+		{http.MethodPut, "/api/upstream/lines", `{}`, http.StatusBadRequest},
+		{http.MethodGet, "/api/upstream/lines?upstream=missing", "", http.StatusNotFound},
+		{http.MethodPost, "/api/upstream/break", "", http.StatusConflict},
+		{http.MethodPost, "/api/upstream/break", `{"duration_ms":100}`, http.StatusConflict},
+		{http.MethodPost, "/api/upstream/break", `{"duration_ms":20000}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/upstream/break?upstream=missing", "", http.StatusNotFound},
+		{http.MethodGet, "/api/upstream/break", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler := webServer.handleUpstreamSerial
+		if strings.HasPrefix(tt.url, "/api/upstream/lines") {
+			handler = webServer.handleUpstreamLines
+		} else if strings.HasPrefix(tt.url, "/api/upstream/break") {
+			handler = webServer.handleUpstreamBreak
+		}
+		handler(w, httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("%s %s %s: expected status %d, got %d", tt.method, tt.url, tt.body, tt.status, w.Code)
+		}
+	}
+}
+
+func TestHandleFlashing(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 8899,
+		ListenPort:   18899,
+		MaxClients:   10,
+		WebPort:      18080,
+	}
+
+	log := newTestLogger()
+	webServer := NewServer(cfg, proxy.NewServer(cfg, log), log)
+
+	tests := []struct {
+		method, body string
+		status       int
+	}{
+		{http.MethodGet, "", http.StatusOK},
+		{http.MethodPost, `{}`, http.StatusBadRequest},
+		{http.MethodPost, `{"client_id":"client#9"}`, http.StatusNotFound},
+		{http.MethodDelete, "", http.StatusOK},
+		{http.MethodPut, "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		webServer.handleFlashing(w, httptest.NewRequest(tt.method, "/api/flashing", strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.body, tt.status, w.Code)
+		}
+		if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), `"active":false`) {
+			t.Errorf("%s: expected inactive status, got %s", tt.method, w.Body.String())
+		}
+	}
+}
+
+func TestHandleInjection(t *testing.T) {
+	disabled := false
+	cfg := &config.Config{
+		UpstreamHost:  "127.0.0.1",
+		UpstreamPort:  8899,
+		ListenPort:    18899,
+		MaxClients:    10,
+		WebPort:       18080,
+		InjectEnabled: &disabled,
+
+		WebAdminUsername: "maintainer",
+		WebAdminPassword: "secret",
+	}
+
+	log := newTestLogger()
+	webServer := NewServer(cfg, proxy.NewServer(cfg, log), log)
+
+	w := httptest.NewRecorder()
+	webServer.handleInjection(w, httptest.NewRequest(http.MethodGet, "/api/injection", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"enabled":false`) {
+		t.Errorf("Expected disabled injection, got %d %s", w.Code, w.Body.String())
+	}
+
+	// Injections and macro runs are refused
+	w = httptest.NewRecorder()
+	webServer.handleInject(w, httptest.NewRequest(http.MethodPost, "/api/inject", strings.NewReader(`{"target":"upstream","data":"01"}`)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for injection, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	webServer.handleMacro(w, httptest.NewRequest(http.MethodPost, "/api/macros/seq/run", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403 for macro run, got %d", w.Code)
+	}
+
+	// Only the admin account may switch injection back on
+	w = httptest.NewRecorder()
+	webServer.handleInjection(w, httptest.NewRequest(http.MethodPut, "/api/injection", strings.NewReader(`{"enabled":true}`)))
+	if w.Code != http.StatusForbidden || webServer.proxy.InjectionEnabled() {
+		t.Errorf("Expected status 403 without the admin account, got %d", w.Code)
+	}
+
+	put := func(body string) *http.Request {
+		req := httptest.NewRequest(http.MethodPut, "/api/injection", strings.NewReader(body))
+		req.SetBasicAuth("maintainer", "secret")
+		return req
+	}
+	w = httptest.NewRecorder()
+	webServer.handleInjection(w, put(`{}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without enabled, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	webServer.handleInjection(w, put(`{"enabled":true}`))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"enabled":true`) {
+		t.Errorf("Expected enabled injection, got %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	webServer.handleInject(w, httptest.NewRequest(http.MethodPost, "/api/inject", strings.NewReader(`{"target":"upstream","data":"01"}`)))
+	if w.Code == http.StatusForbidden {
+		t.Error("Expected injection allowed after enabling it")
+	}
+}
+
+func TestHandleDryRun(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 8899,
+		ListenPort:   18899,
+		MaxClients:   10,
+		WebPort:      18080,
+	}
+
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	webServer := NewServer(cfg, p, log)
+
+	tests := []struct {
+		method, body string
+		status       int
+		enabled      string
+	}{
+		{http.MethodGet, "", http.StatusOK, `"enabled":false`},
+		{http.MethodPut, `{"enabled":true}`, http.StatusOK, `"enabled":true`},
+		{http.MethodPut, `{"enabled":"yes"}`, http.StatusBadRequest, ""},
+		{http.MethodPost, "", http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		webServer.handleDryRun(w, httptest.NewRequest(tt.method, "/api/dry-run", strings.NewReader(tt.body)))
+		if w.Code != tt.status {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.body, tt.status, w.Code)
+		}
+		if tt.enabled != "" && !strings.Contains(w.Body.String(), tt.enabled) {
+			t.Errorf("%s %s: expected %s, got %s", tt.method, tt.body, tt.enabled, w.Body.String())
+		}
+	}
+	if !p.DryRun() {
+		t.Error("Expected dry-run mode enabled")
+	}
+}
+
 func TestHandleConfig_Success(t *testing.T) {
 	cfg := &config.Config{
 		UpstreamHost: "192.168.1.100",
@@ -791,6 +1076,7 @@ func TestHandleConfig_Success(t *testing.T) {
 	}
 
 	log := newTestLogger()
+	log.SetPacketLogging(cfg.LogPackets) // as created from cfg by main
 	p := proxy.NewServer(cfg, log)
 	webServer := NewServer(cfg, p, log)
 
@@ -976,11 +1262,11 @@ func TestHandleInject_HexWithSpaces(t *testing.T) {
 	log := newTestLogger()
 	p := proxy.NewServer(cfg, log)
 
-	err = p.Start()
+	err = p.Start(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	time.Sleep(200 * time.Millisecond)
 
@@ -1037,11 +1323,11 @@ func TestHandleInject_ASCII(t *testing.T) {
 	log := newTestLogger()
 	p := proxy.NewServer(cfg, log)
 
-	err = p.Start()
+	err = p.Start(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	time.Sleep(200 * time.Millisecond)
 
@@ -1081,11 +1367,11 @@ func TestHandleInject_NoUpstream(t *testing.T) {
 	log := newTestLogger()
 	p := proxy.NewServer(cfg, log)
 
-	err = p.Start()
+	err = p.Start(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	webServer := NewServer(cfg, p, log)
 
@@ -1118,34 +1404,32 @@ func TestBroadcastLog(t *testing.T) {
 	webServer := NewServer(cfg, p, log)
 
 	// Create a client channel and register it
-	clientChan := make(chan string, 10)
+	clientChan := make(chan []string, 10)
 	webServer.clientsMu.Lock()
 	webServer.clients[clientChan] = true
 	webServer.clientsMu.Unlock()
 
 	// Broadcast a message
-	webServer.broadcastLog("test message")
+	webServer.broadcastLog(logger.Entry{Line: "test message"})
 
-	// Check if client received message
+	// Check if client received message with the next batch
 	select {
 	case msg := <-clientChan:
-		if msg != "test message" {
-			t.Errorf("Expected 'test message', got '%s'", msg)
+		if len(msg) != 1 || msg[0] != "test message" {
+			t.Errorf("Expected ['test message'], got %q", msg)
 		}
-	case <-time.After(100 * time.Millisecond):
+	case <-time.After(logBatchInterval + 100*time.Millisecond):
 		t.Error("Timeout waiting for broadcast message")
 	}
 
 	// Check if message is in buffer
-	webServer.logBufferMu.Lock()
 	found := false
-	for _, m := range webServer.logBuffer {
-		if m == "test message" {
+	for _, m := range webServer.bufferedLogs() {
+		if m.Line == "test message" {
 			found = true
 			break
 		}
 	}
-	webServer.logBufferMu.Unlock()
 
 	if !found {
 		t.Error("Message not found in log buffer")
@@ -1173,12 +1457,10 @@ func TestBroadcastLog_BufferLimit(t *testing.T) {
 
 	// Fill buffer beyond limit
 	for i := 0; i < 1005; i++ {
-		webServer.broadcastLog("message")
+		webServer.broadcastLog(logger.Entry{Line: "message"})
 	}
 
-	webServer.logBufferMu.Lock()
-	bufferLen := len(webServer.logBuffer)
-	webServer.logBufferMu.Unlock()
+	bufferLen := webServer.logBufferStats().Lines
 
 	if bufferLen > 1000 {
 		t.Errorf("Expected buffer len <= 1000, got %d", bufferLen)
@@ -1199,18 +1481,19 @@ func TestBroadcastLog_SlowClient(t *testing.T) {
 	webServer := NewServer(cfg, p, log)
 
 	// Create a slow client (buffer size 1)
-	slowClient := make(chan string, 1)
+	slowClient := make(chan []string, 1)
 	webServer.clientsMu.Lock()
 	webServer.clients[slowClient] = true
 	webServer.clientsMu.Unlock()
 
 	// Fill the channel
-	slowClient <- "existing"
+	slowClient <- []string{"existing"}
 
 	// This should not block even though client is full
 	done := make(chan bool)
 	go func() {
-		webServer.broadcastLog("new message")
+		webServer.broadcastLog(logger.Entry{Line: "new message"})
+		webServer.flushLogs()
 		done <- true
 	}()
 
@@ -1228,18 +1511,72 @@ func TestBroadcastLog_SlowClient(t *testing.T) {
 	close(slowClient)
 }
 
-func TestSetVersion(t *testing.T) {
-	originalVersion := Version
-	defer func() { Version = originalVersion }()
+func TestBroadcastLog_Batching(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 8899,
+		ListenPort:   18899,
+		MaxClients:   10,
+	}
+
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	webServer := NewServer(cfg, p, log)
+	log.Flush()
+	webServer.flushLogs()
+
+	clientChan := make(chan []string, 10)
+	webServer.clientsMu.Lock()
+	webServer.clients[clientChan] = true
+	webServer.clientsMu.Unlock()
+	t.Cleanup(func() {
+		webServer.clientsMu.Lock()
+		delete(webServer.clients, clientChan)
+		webServer.clientsMu.Unlock()
+	})
+
+	for i := 0; i < logBatchSize+3; i++ {
+		webServer.broadcastLog(logger.Entry{Line: fmt.Sprintf("line %d", i)})
+	}
+
+	// A full batch is sent at once, the rest after the batch interval
+	select {
+	case lines := <-clientChan:
+		if len(lines) != logBatchSize || lines[0] != "line 0" {
+			t.Errorf("Expected a full batch starting with 'line 0', got %q", lines)
+		}
+	default:
+		t.Fatal("Expected the full batch to be sent immediately")
+	}
+	select {
+	case lines := <-clientChan:
+		if len(lines) != 3 || lines[2] != fmt.Sprintf("line %d", logBatchSize+2) {
+			t.Errorf("Expected the remaining 3 lines, got %q", lines)
+		}
+	case <-time.After(logBatchInterval + time.Second):
+		t.Fatal("Timeout waiting for the remaining lines")
+	}
+}
 
-	SetVersion("1.2.3")
-	if Version != "1.2.3" {
-		t.Errorf("Expected version '1.2.3', got '%s'", Version)
+func TestSetBuildInfo(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 8899,
+		ListenPort:   18899,
+		MaxClients:   10,
 	}
+	log := newTestLogger()
+	webServer := NewServer(cfg, proxy.NewServer(cfg, log), log)
+	webServer.SetBuildInfo(buildinfo.Info{Version: "v2.0.0-beta", Commit: "abc123"})
 
-	SetVersion("v2.0.0-beta")
-	if Version != "v2.0.0-beta" {
-		t.Errorf("Expected version 'v2.0.0-beta', got '%s'", Version)
+	w := httptest.NewRecorder()
+	webServer.handleHealth(w, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+	var resp HealthResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode health: %v", err)
+	}
+	if resp.Version != "v2.0.0-beta" || resp.Commit != "abc123" {
+		t.Errorf("Expected version v2.0.0-beta at abc123, got %s at %s", resp.Version, resp.Commit)
 	}
 }
 
@@ -1290,16 +1627,16 @@ func TestServerStartStop(t *testing.T) {
 	log := newTestLogger()
 	p := proxy.NewServer(cfg, log)
 
-	err = p.Start()
+	err = p.Start(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	webServer := NewServer(cfg, p, log)
 
 	// Start web server
-	err = webServer.Start()
+	err = webServer.Start(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to start web server: %v", err)
 	}
@@ -1319,7 +1656,7 @@ func TestServerStartStop(t *testing.T) {
 	}
 
 	// Stop web server
-	webServer.Stop()
+	_ = webServer.Stop(context.Background())
 
 	// Give server time to stop
 	time.Sleep(100 * time.Millisecond)
@@ -1331,6 +1668,62 @@ func TestServerStartStop(t *testing.T) {
 	}
 }
 
+func TestServerListen_RetryAndFallback(t *testing.T) {
+	held, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	defer held.Close()
+	port := held.Addr().(*net.TCPAddr).Port
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 9999,
+		ListenPort:   18899,
+		MaxClients:   10,
+		WebPort:      port,
+	}
+	log := newTestLogger()
+	webServer := NewServer(cfg, proxy.NewServer(cfg, log), log)
+
+	// Without fallback ports, a port in use fails Start
+	if _, err := webServer.listen(context.Background()); err == nil {
+		t.Fatal("Expected an error for a port in use")
+	}
+
+	// The port is bound once the holder releases it
+	cfg.WebBindRetry = 5
+	time.AfterFunc(1500*time.Millisecond, func() { held.Close() })
+	ln, err := webServer.listen(context.Background())
+	if err != nil {
+		t.Fatalf("Expected the port to be bound after a retry: %v", err)
+	}
+	state := webServer.listenState.Load()
+	if state.Port != port || state.Fallback || state.Attempts < 2 {
+		t.Errorf("Expected port %d bound after retrying, got %+v", port, state)
+	}
+	if check := webServer.webServerCheck(); check.Status != CheckHealthy || check.Port != port {
+		t.Errorf("Expected a healthy web server on port %d, got %+v", port, check)
+	}
+
+	// While it stays in use, a fallback port is served and reported
+	cfg.WebBindRetry = 1
+	cfg.WebFallbackPorts = []int{0}
+	fallback, err := webServer.listen(context.Background())
+	if err != nil {
+		t.Fatalf("Expected a fallback port: %v", err)
+	}
+	defer fallback.Close()
+	ln.Close()
+	state = webServer.listenState.Load()
+	if !state.Fallback || state.Port == port || state.Port != fallback.Addr().(*net.TCPAddr).Port || state.Configured != port {
+		t.Errorf("Expected a fallback port other than %d, got %+v", port, state)
+	}
+	if check := webServer.webServerCheck(); check.Status != CheckDegraded || check.ConfiguredPort != port {
+		t.Errorf("Expected a degraded web server check, got %+v", check)
+	}
+}
+
 func TestServerStop_NilServer(t *testing.T) {
 	cfg := &config.Config{
 		UpstreamHost: "127.0.0.1",
@@ -1345,7 +1738,7 @@ func TestServerStop_NilServer(t *testing.T) {
 	webServer := NewServer(cfg, p, log)
 
 	// Stop without Start should not panic
-	webServer.Stop()
+	_ = webServer.Stop(context.Background())
 }
 
 type noFlusher struct {
@@ -1421,19 +1814,19 @@ func TestHandleEvents_SSE(t *testing.T) {
 	log := newTestLogger()
 	p := proxy.NewServer(cfg, log)
 
-	err = p.Start()
+	err = p.Start(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	time.Sleep(200 * time.Millisecond)
 
 	webServer := NewServer(cfg, p, log)
 
 	// Add some log messages to buffer
-	webServer.broadcastLog("buffered message 1")
-	webServer.broadcastLog("buffered message 2")
+	webServer.broadcastLog(logger.Entry{Line: "buffered message 1"})
+	webServer.broadcastLog(logger.Entry{Line: "buffered message 2"})
 
 	// Create a context that can be cancelled
 	ctx, cancel := context.WithCancel(context.Background())
@@ -1509,11 +1902,11 @@ func TestHandleEvents_ClientRegistration(t *testing.T) {
 	log := newTestLogger()
 	p := proxy.NewServer(cfg, log)
 
-	err = p.Start()
+	err = p.Start(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	webServer := NewServer(cfg, p, log)
 
@@ -1594,11 +1987,11 @@ func TestHandleInject_HexWithNewlines(t *testing.T) {
 	log := newTestLogger()
 	p := proxy.NewServer(cfg, log)
 
-	err = p.Start()
+	err = p.Start(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	time.Sleep(200 * time.Millisecond)
 
@@ -1687,8 +2080,8 @@ func TestNewServer(t *testing.T) {
 	if webServer.clients == nil {
 		t.Error("Clients map not initialized")
 	}
-	if webServer.logBuffer == nil {
-		t.Error("Log buffer not initialized")
+	if webServer.store == nil {
+		t.Error("Storage not initialized")
 	}
 }
 
@@ -1732,11 +2125,11 @@ func TestHandleInject_Downstream(t *testing.T) {
 	log := newTestLogger()
 	p := proxy.NewServer(cfg, log)
 
-	err = p.Start()
+	err = p.Start(context.Background())
 	if err != nil {
 		t.Fatalf("Failed to start proxy: %v", err)
 	}
-	defer p.Stop()
+	defer p.Stop(context.Background())
 
 	time.Sleep(200 * time.Millisecond)
 
@@ -1947,3 +2340,1419 @@ func TestRemoveWebClient_NegativeProtection(t *testing.T) {
 		t.Errorf("Web client count went negative: %d", count)
 	}
 }
+
+func TestHandleTriggers(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 8899,
+		ListenPort:   18899,
+		MaxClients:   10,
+		WebPort:      18080,
+		Triggers: []config.TriggerRule{
+			{Name: "alarm", HexPrefix: "f7", Alert: true},
+		},
+	}
+
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	webServer := NewServer(cfg, p, log)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/triggers", nil)
+	w := httptest.NewRecorder()
+
+	webServer.handleTriggers(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Triggers []struct {
+			Name    string `json:"name"`
+			Matches uint64 `json:"matches"`
+		} `json:"triggers"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+
+	if len(result.Triggers) != 1 || result.Triggers[0].Name != "alarm" {
+		t.Errorf("Unexpected triggers %+v", result.Triggers)
+	}
+}
+
+func TestHandleInject_Template(t *testing.T) {
+	// Start mock upstream that captures injected bytes
+	upstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start mock upstream: %v", err)
+	}
+	defer upstreamListener.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := upstreamListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 64)
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, err := conn.Read(buf)
+		if err == nil {
+			received <- buf[:n]
+		}
+	}()
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstreamListener.Addr().(*net.TCPAddr).Port,
+		ListenPort:   0,
+		MaxClients:   10,
+		WebPort:      18080,
+	}
+
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	cfg.ListenPort = proxyListener.Addr().(*net.TCPAddr).Port
+	proxyListener.Close()
+
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer p.Stop(context.Background())
+
+	time.Sleep(200 * time.Millisecond)
+
+	webServer := NewServer(cfg, p, log)
+
+	body := `{"target": "upstream", "format": "hex", "template": true, "data": "01 03 {{var:reg:u16be}} 00 0a {{crc16}}"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/inject?reg=0", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	webServer.handleInject(w, req)
+
+	resp := w.Result()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		t.Fatalf("Expected status 200, got %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	select {
+	case data := <-received:
+		expected := "01030000000ac5cd"
+		if fmt.Sprintf("%x", data) != expected {
+			t.Errorf("Expected %s, got %x", expected, data)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for injected data")
+	}
+}
+
+func TestHandleInject_LiteralPlaceholders(t *testing.T) {
+	// ASCII payloads that happen to contain "{{" are sent byte for byte
+	// unless the request asks for a template
+	upstream, _, webServer, _ := startWSTest(t, &config.Config{})
+
+	body := `{"target": "upstream", "format": "ascii", "data": "{{ts}}"}`
+	w := httptest.NewRecorder()
+	webServer.handleInject(w, httptest.NewRequest(http.MethodPost, "/api/inject", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	upstream.Expect([]byte("{{ts}}"))
+}
+
+func TestHandleInject_InvalidTemplate(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 8899,
+		ListenPort:   18899,
+		MaxClients:   10,
+		WebPort:      18080,
+	}
+
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	webServer := NewServer(cfg, p, log)
+
+	body := `{"target": "upstream", "format": "hex", "template": true, "data": "f7 {{var:missing}}"}`
+	req := httptest.NewRequest(http.MethodPost, "/api/inject", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	webServer.handleInject(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "Invalid template") {
+		t.Errorf("Expected template error, got %s", w.Body.String())
+	}
+}
+
+func TestHandleMacros_CRUD(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 8899,
+		ListenPort:   18899,
+		MaxClients:   10,
+		WebPort:      18080,
+		MacrosFile:   filepath.Join(t.TempDir(), "macros.json"),
+	}
+
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	webServer := NewServer(cfg, p, log)
+
+	// Create
+	body := `{"name": "light-on", "target": "upstream", "format": "hex", "frames": [{"data": "f7 0e 01"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/api/macros", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	webServer.handleMacros(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Invalid macro is rejected
+	req = httptest.NewRequest(http.MethodPut, "/api/macros/bad", strings.NewReader(`{"target": "upstream", "format": "hex", "frames": []}`))
+	w = httptest.NewRecorder()
+	webServer.handleMacro(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid macro, got %d", w.Code)
+	}
+
+	// Macros survive a restart
+	webServer = NewServer(cfg, p, log)
+	req = httptest.NewRequest(http.MethodGet, "/api/macros/light-on", nil)
+	w = httptest.NewRecorder()
+	webServer.handleMacro(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200 after reload, got %d", w.Code)
+	}
+
+	// Delete
+	req = httptest.NewRequest(http.MethodDelete, "/api/macros/light-on", nil)
+	w = httptest.NewRecorder()
+	webServer.handleMacro(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200 on delete, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/macros", nil)
+	w = httptest.NewRecorder()
+	webServer.handleMacros(w, req)
+	var list struct {
+		Macros []json.RawMessage `json:"macros"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(list.Macros) != 0 {
+		t.Errorf("Expected no macros after delete, got %d", len(list.Macros))
+	}
+}
+
+func TestHandleMacro_Run(t *testing.T) {
+	upstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start mock upstream: %v", err)
+	}
+	defer upstreamListener.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := upstreamListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var all []byte
+		buf := make([]byte, 64)
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		for len(all) < 4 {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			all = append(all, buf[:n]...)
+		}
+		received <- all
+	}()
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstreamListener.Addr().(*net.TCPAddr).Port,
+		MaxClients:   10,
+		WebPort:      18080,
+	}
+
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	cfg.ListenPort = proxyListener.Addr().(*net.TCPAddr).Port
+	proxyListener.Close()
+
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer p.Stop(context.Background())
+
+	time.Sleep(200 * time.Millisecond)
+
+	webServer := NewServer(cfg, p, log)
+	body := `{"name": "seq", "target": "upstream", "format": "hex", "template": true, "frames": [{"data": "aa bb"}, {"data": "{{var:n}} cc", "delay_ms": 50}]}`
+	req := httptest.NewRequest(http.MethodPost, "/api/macros", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	webServer.handleMacros(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Missing variable fails before anything is sent
+	req = httptest.NewRequest(http.MethodPost, "/api/macros/seq/run", nil)
+	w = httptest.NewRecorder()
+	webServer.handleMacro(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for missing variable, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/macros/seq/run", strings.NewReader(`{"vars": {"n": "0x11"}}`))
+	w = httptest.NewRecorder()
+	webServer.handleMacro(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	select {
+	case data := <-received:
+		if fmt.Sprintf("%x", data) != "aabb11cc" {
+			t.Errorf("Expected aabb11cc, got %x", data)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for macro frames")
+	}
+}
+
+func TestHandlePoll(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 8899,
+		ListenPort:   18899,
+		MaxClients:   10,
+		WebPort:      18080,
+		Polls: []config.PollRule{
+			{Name: "boiler", Query: "01 03", Interval: 10},
+		},
+	}
+
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	webServer := NewServer(cfg, p, log)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/poll/boiler", nil)
+	w := httptest.NewRecorder()
+	webServer.handlePoll(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	var result struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if result.Name != "boiler" || result.Query != "0103" {
+		t.Errorf("Unexpected poll result %+v", result)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/poll/missing", nil)
+	w = httptest.NewRecorder()
+	webServer.handlePoll(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/poll", nil)
+	w = httptest.NewRecorder()
+	webServer.handlePolls(w, req)
+	if !strings.Contains(w.Body.String(), `"boiler"`) {
+		t.Errorf("Expected boiler in poll list, got %s", w.Body.String())
+	}
+}
+
+func TestHandleValues(t *testing.T) {
+	// Mock upstream sends one frame carrying a temperature
+	upstreamListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start mock upstream: %v", err)
+	}
+	defer upstreamListener.Close()
+
+	go func() {
+		conn, err := upstreamListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte{0x01, 0x03, 0x00, 0xd7})
+		time.Sleep(time.Second)
+	}()
+
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstreamListener.Addr().(*net.TCPAddr).Port,
+		MaxClients:   10,
+		WebPort:      18080,
+		Values: []config.ValueRule{
+			{Name: "boiler_temp", Match: "01 03", Offset: 2, Type: "u16", Scale: 0.1, Unit: "°C"},
+		},
+	}
+
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	cfg.ListenPort = proxyListener.Addr().(*net.TCPAddr).Port
+	proxyListener.Close()
+
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	webServer := NewServer(cfg, p, log)
+
+	// Register an SSE value listener to observe the push
+	valueChan := make(chan values.Value, 1)
+	webServer.clientsMu.Lock()
+	webServer.valueClients[valueChan] = true
+	webServer.clientsMu.Unlock()
+
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer p.Stop(context.Background())
+
+	select {
+	case v := <-valueChan:
+		if v.Name != "boiler_temp" {
+			t.Errorf("Expected boiler_temp update, got %s", v.Name)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Timeout waiting for value update")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/values", nil)
+	w := httptest.NewRecorder()
+	webServer.handleValues(w, req)
+
+	var result struct {
+		Values []struct {
+			Name  string  `json:"name"`
+			Value float64 `json:"value"`
+			Unit  string  `json:"unit"`
+		} `json:"values"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(result.Values) != 1 {
+		t.Fatalf("Expected 1 value, got %d", len(result.Values))
+	}
+	if v := result.Values[0]; v.Value < 21.49 || v.Value > 21.51 || v.Unit != "°C" {
+		t.Errorf("Unexpected value %+v", v)
+	}
+
+	// Single value as plain text
+	req = httptest.NewRequest(http.MethodGet, "/api/values/boiler_temp?format=text", nil)
+	w = httptest.NewRecorder()
+	webServer.handleValue(w, req)
+	if w.Code != http.StatusOK || w.Body.String() != "21.5" {
+		t.Errorf("Expected 200 with 21.5, got %d %q", w.Code, w.Body.String())
+	}
+
+	// Single value as JSON
+	req = httptest.NewRequest(http.MethodGet, "/api/values/boiler_temp", nil)
+	w = httptest.NewRecorder()
+	webServer.handleValue(w, req)
+	var single ValueResponse
+	if err := json.NewDecoder(w.Body).Decode(&single); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if single.Unit != "°C" || single.UpdatedAt == "" {
+		t.Errorf("Unexpected single value %+v", single)
+	}
+}
+
+func TestHandleValue_Unavailable(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 8899,
+		ListenPort:   18899,
+		MaxClients:   10,
+		WebPort:      18080,
+		Values: []config.ValueRule{
+			{Name: "boiler_temp", Type: "u8", StaleAfter: 60},
+		},
+	}
+
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	webServer := NewServer(cfg, p, log)
+
+	tests := []struct {
+		path     string
+		expected int
+	}{
+		{"/api/values/missing", http.StatusNotFound},
+		{"/api/values/boiler_temp", http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		w := httptest.NewRecorder()
+		webServer.handleValue(w, req)
+		if w.Code != tt.expected {
+			t.Errorf("%s: expected status %d, got %d", tt.path, tt.expected, w.Code)
+		}
+	}
+}
+
+func TestACME_RedirectAndHostPolicy(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 9999,
+		MaxClients:   10,
+		WebPort:      8443,
+		ACMEDomains:  []string{"proxy.example.com"},
+		ACMECacheDir: t.TempDir(),
+		ACMEHTTPPort: 80,
+	}
+	log := newTestLogger()
+	webServer := NewServer(cfg, proxy.NewServer(cfg, log), log)
+
+	req := httptest.NewRequest(http.MethodGet, "http://proxy.example.com/api/status?x=1", nil)
+	w := httptest.NewRecorder()
+	webServer.httpsRedirect(w, req)
+	if w.Code != http.StatusMovedPermanently {
+		t.Errorf("Expected status 301, got %d", w.Code)
+	}
+	if loc := w.Header().Get("Location"); loc != "https://proxy.example.com:8443/api/status?x=1" {
+		t.Errorf("Unexpected redirect location %q", loc)
+	}
+
+	m := webServer.newACMEManager()
+	if err := m.HostPolicy(context.Background(), "proxy.example.com"); err != nil {
+		t.Errorf("Expected configured domain to be allowed: %v", err)
+	}
+	if err := m.HostPolicy(context.Background(), "other.example.com"); err == nil {
+		t.Error("Expected other domains to be rejected")
+	}
+
+	// ACME challenges are served ahead of the redirect
+	h := m.HTTPHandler(http.HandlerFunc(webServer.httpsRedirect))
+	req = httptest.NewRequest(http.MethodGet, "http://proxy.example.com/.well-known/acme-challenge/unknown", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected unknown challenge token to return 404, got %d", w.Code)
+	}
+}
+
+func TestHandleLogs(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 8899,
+		ListenPort:   18899,
+		MaxClients:   10,
+	}
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	webServer := NewServer(cfg, p, log)
+
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	log.Flush()
+	webServer.store = storage.NewMemory(storage.LimitsFor(cfg)) // drop lines logged by NewServer
+	for i, e := range []logger.Entry{
+		{Level: logger.LogInfo, Subsystem: "upstream", Message: "Connected", Fields: map[string]string{"session": "ab12cd34"}},
+		{Level: logger.LogPkt, Message: "[UP->] f7 (1 bytes)"},
+		{Level: logger.LogWarn, Subsystem: "proxy", Message: "Greylisting"},
+		{Level: logger.LogError, Subsystem: "web", Message: "Failed"},
+	} {
+		e.Time = base.Add(time.Duration(i) * time.Second)
+		webServer.broadcastLog(e)
+	}
+
+	get := func(query string) (int, LogsResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/api/logs"+query, nil)
+		w := httptest.NewRecorder()
+		webServer.handleLogs(w, req)
+		var resp LogsResponse
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+		}
+		return w.Code, resp
+	}
+
+	code, resp := get("")
+	if code != http.StatusOK || len(resp.Entries) != 4 || resp.Buffered != 4 {
+		t.Fatalf("Expected all 4 entries, got %d %+v", code, resp)
+	}
+	if e := resp.Entries[0]; e.Level != "INFO" || e.Subsystem != "upstream" || e.Fields["session"] != "ab12cd34" || e.Time != "2025-01-01T00:00:00Z" {
+		t.Errorf("Unexpected entry: %+v", e)
+	}
+
+	if _, resp := get("?level=warn"); len(resp.Entries) != 2 || resp.Entries[0].Message != "Greylisting" {
+		t.Errorf("Expected WARN and ERROR entries, got %+v", resp.Entries)
+	}
+	if _, resp := get("?level=info"); len(resp.Entries) != 3 {
+		t.Errorf("Expected packets excluded at level=info, got %+v", resp.Entries)
+	}
+	if _, resp := get("?since=2025-01-01T00:00:01Z"); len(resp.Entries) != 2 {
+		t.Errorf("Expected 2 entries after since, got %+v", resp.Entries)
+	}
+	if _, resp := get("?limit=1"); len(resp.Entries) != 1 || resp.Entries[0].Message != "Failed" {
+		t.Errorf("Expected the newest entry, got %+v", resp.Entries)
+	}
+
+	for _, query := range []string{"?level=debug", "?since=yesterday", "?limit=0"} {
+		if code, _ := get(query); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", query, code)
+		}
+	}
+}
+
+func TestHandleLogFile(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 8899,
+		ListenPort:   18899,
+		MaxClients:   10,
+		LogFile:      filepath.Join(dir, "packets.log"),
+
+		WebAdminUsername: "maintainer",
+		WebAdminPassword: "secret",
+	}
+	log := newTestLogger()
+	webServer := NewServer(cfg, proxy.NewServer(cfg, log), log)
+
+	old := time.Now().Add(-time.Hour)
+	for name, content := range map[string]string{"packets.log": "active\n", "packets.log.1": "rotated\n", "other.log": "x"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	_ = os.Chtimes(filepath.Join(dir, "packets.log.1"), old, old)
+
+	// Other users, including a logged-in non-admin, get 403
+	for _, user := range []string{"", "viewer"} {
+		for path, handler := range map[string]http.HandlerFunc{
+			"/api/logs/files": webServer.handleLogFiles,
+			"/api/logs/file":  webServer.handleLogFile,
+		} {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			if user != "" {
+				req.SetBasicAuth(user, "secret")
+			}
+			w := httptest.NewRecorder()
+			handler(w, req)
+			if w.Code != http.StatusForbidden {
+				t.Errorf("%s as %q: expected 403, got %d", path, user, w.Code)
+			}
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/logs/files", nil)
+	req.SetBasicAuth("maintainer", "secret")
+	w := httptest.NewRecorder()
+	webServer.handleLogFiles(w, req)
+	var list LogFilesResponse
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(list.Files) != 2 || !list.Files[0].Active || list.Files[1].Name != "packets.log.1" || list.Files[1].Size != 8 {
+		t.Errorf("Unexpected files %+v", list.Files)
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/logs/file"+query, nil)
+		req.SetBasicAuth("maintainer", "secret")
+		w := httptest.NewRecorder()
+		webServer.handleLogFile(w, req)
+		return w
+	}
+	if w := get(""); w.Code != http.StatusOK || w.Body.String() != "active\n" || !strings.Contains(w.Header().Get("Content-Disposition"), `"packets.log"`) {
+		t.Errorf("Unexpected active file %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	if w := get("?name=packets.log.1"); w.Code != http.StatusOK || w.Body.String() != "rotated\n" {
+		t.Errorf("Unexpected rotated file %d %q", w.Code, w.Body.String())
+	}
+	for _, name := range []string{"other.log", "../packets.log", "missing"} {
+		if w := get("?name=" + name); w.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", name, w.Code)
+		}
+	}
+
+	cfg.LogFile = ""
+	if w := get(""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without LOG_FILE, got %d", w.Code)
+	}
+}
+
+func TestHandleStorage(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{
+		UpstreamHost:   "127.0.0.1",
+		UpstreamPort:   8899,
+		ListenPort:     18899,
+		MaxClients:     10,
+		LogPackets:     true,
+		LogFile:        filepath.Join(dir, "packets.log"),
+		RetentionMaxMB: 100,
+	}
+	log := newTestLogger()
+	webServer := NewServer(cfg, proxy.NewServer(cfg, log), log)
+
+	w := httptest.NewRecorder()
+	webServer.handleStorage(w, httptest.NewRequest(http.MethodGet, "/api/storage", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without a retention manager, got %d", w.Code)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "packets.log.1"), make([]byte, 100), 0644); err != nil {
+		t.Fatalf("Failed to write log file: %v", err)
+	}
+	keeper := retention.New(cfg, log, webServer.store)
+	keeper.Run(time.Now())
+	webServer.SetRetention(keeper)
+
+	w = httptest.NewRecorder()
+	webServer.handleStorage(w, httptest.NewRequest(http.MethodGet, "/api/storage", nil))
+	var usage retention.Usage
+	if err := json.NewDecoder(w.Body).Decode(&usage); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if usage.MaxBytes != 100<<20 || usage.UsedBytes != 100 || len(usage.Artifacts) != 1 || usage.Artifacts[0].Files[0].Name != "packets.log.1" {
+		t.Errorf("Unexpected usage %+v", usage)
+	}
+}
+
+func TestHandleVersion(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamURL:   "rfc2217://127.0.0.1:4001",
+		Upstreams:     []config.UpstreamSpec{{Name: "relay", Addr: "mux://relay.example:18905/meter"}},
+		ListenPort:    18899,
+		MaxClients:    10,
+		TransformFrom: "slip-decode",
+	}
+	log := newTestLogger()
+	webServer := NewServer(cfg, proxy.NewServer(cfg, log), log)
+	webServer.SetBuildInfo(buildinfo.Info{Version: "1.2.3", Commit: "abc123", BuildDate: "2026-01-02T03:04:05Z"})
+
+	w := httptest.NewRecorder()
+	webServer.handleVersion(w, httptest.NewRequest(http.MethodGet, "/api/version", nil))
+	var resp VersionResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Version != "1.2.3" || resp.Commit != "abc123" || resp.BuildDate != "2026-01-02T03:04:05Z" || resp.OS != runtime.GOOS {
+		t.Errorf("Unexpected build info %+v", resp)
+	}
+	for name, want := range map[string]bool{"serial": true, "mux": true, "tls": false, "mqtt": false, "decoders": true} {
+		if f, ok := resp.Features[name]; !ok || !f.Compiled || f.Enabled != want {
+			t.Errorf("Expected feature %s compiled and enabled=%v, got %+v", name, want, f)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	webServer.handleVersion(w, httptest.NewRequest(http.MethodPost, "/api/version", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", w.Code)
+	}
+}
+
+func TestHandleLogging(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 8899,
+		ListenPort:   18899,
+		MaxClients:   10,
+		LogFile:      filepath.Join(dir, "packets.log"),
+	}
+	log, _ := logger.New(false, cfg.LogFile)
+	log.SetOutput(io.Discard)
+	webServer := NewServer(cfg, proxy.NewServer(cfg, log), log)
+	t.Cleanup(func() { _ = webServer.Stop(context.Background()) })
+
+	send := func(method, body string) (int, LoggingState) {
+		w := httptest.NewRecorder()
+		webServer.handleLogging(w, httptest.NewRequest(method, "/api/logging", strings.NewReader(body)))
+		var st LoggingState
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&st); err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+		}
+		return w.Code, st
+	}
+
+	if code, st := send(http.MethodGet, ""); code != http.StatusOK || st.Packets || st.File || st.Level != "info" || st.LogFile != cfg.LogFile {
+		t.Errorf("Unexpected initial state %d %+v", code, st)
+	}
+
+	code, st := send(http.MethodPost, `{"packets":true,"file":true,"level":"WARN"}`)
+	if code != http.StatusOK || !st.Packets || !st.File || st.Level != "warn" || st.RevertAt != nil {
+		t.Fatalf("Unexpected state %d %+v", code, st)
+	}
+	if !log.IsPacketLoggingEnabled() || !log.IsFileLoggingEnabled() || log.Level() != logger.LogWarn {
+		t.Error("Expected the logger changed")
+	}
+	if _, err := os.Stat(cfg.LogFile); err != nil {
+		t.Errorf("Expected the log file created: %v", err)
+	}
+
+	// A temporary change goes back to the settings before it
+	code, st = send(http.MethodPost, `{"packets":false,"level":"error","duration":"50ms"}`)
+	if code != http.StatusOK || st.Packets || st.Level != "error" || st.RevertAt == nil {
+		t.Fatalf("Unexpected state %d %+v", code, st)
+	}
+	if code, st = send(http.MethodPost, `{"file":false,"duration":"100ms"}`); code != http.StatusOK || st.File {
+		t.Fatalf("Unexpected state %d %+v", code, st)
+	}
+	testutil.Eventually(t, func() bool {
+		_, st := send(http.MethodGet, "")
+		return st.RevertAt == nil
+	}, "temporary change was not reverted")
+	if _, st := send(http.MethodGet, ""); !st.Packets || !st.File || st.Level != "warn" {
+		t.Errorf("Expected the settings from before the temporary changes, got %+v", st)
+	}
+
+	for _, body := range []string{`{"level":"debug"}`, `{"duration":"-1s"}`, `{"duration":"soon"}`, `not json`} {
+		if code, _ := send(http.MethodPost, body); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, code)
+		}
+	}
+	cfg.LogFile = ""
+	if code, _ := send(http.MethodPost, `{"file":true}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without LOG_FILE, got %d", code)
+	}
+	log.Close()
+}
+
+func TestBufferLog_Limits(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost:   "127.0.0.1",
+		UpstreamPort:   8899,
+		ListenPort:     18899,
+		MaxClients:     10,
+		WebLogLines:    2,
+		WebPacketLines: 3,
+	}
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	webServer := NewServer(cfg, p, log)
+	log.Flush()
+
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	fill := func(limits storage.Limits) {
+		webServer.store = storage.NewMemory(limits)
+		for i := 0; i < 5; i++ {
+			at := base.Add(time.Duration(i) * time.Second)
+			_ = webServer.store.AddLog(logger.Entry{Time: at, Level: logger.LogInfo, Line: fmt.Sprintf("info %d", i)})
+			_ = webServer.store.AddLog(logger.Entry{Time: at, Level: logger.LogPkt, Line: fmt.Sprintf("pkt %d", i)})
+		}
+	}
+	fill(storage.LimitsFor(cfg))
+
+	var lines []string
+	for _, e := range webServer.bufferedLogs() {
+		lines = append(lines, e.Line)
+	}
+	expected := "pkt 2,info 3,pkt 3,info 4,pkt 4"
+	if got := strings.Join(lines, ","); got != expected {
+		t.Errorf("Expected %s, got %s", expected, got)
+	}
+
+	st := webServer.logBufferStats()
+	if st.Lines != 2 || st.Packets != 3 || st.MaxLines != 2 || st.MaxPackets != 3 {
+		t.Errorf("Unexpected stats: %+v", st)
+	}
+	if st.Bytes <= 0 {
+		t.Errorf("Expected bytes accounted, got %d", st.Bytes)
+	}
+
+	// Lines older than the maximum age are dropped
+	limits := storage.LimitsFor(cfg)
+	limits.LogMaxAge = time.Second
+	fill(limits)
+	_ = webServer.store.AddLog(logger.Entry{Time: base.Add(5 * time.Second), Level: logger.LogInfo, Line: "info 5"})
+	if st := webServer.logBufferStats(); st.Lines != 2 || st.Packets != 1 {
+		t.Errorf("Expected lines older than 1s dropped, got %+v", st)
+	}
+}
+
+// captureForm builds a multipart body with the captures a and b, each
+// given as packets alternating to and from the upstream
+func captureForm(t *testing.T, a, b [][]byte) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for name, packets := range map[string][][]byte{"a": a, "b": b} {
+		part, _ := form.CreateFormFile(name, name+".pcapng")
+		w, err := pcapng.NewWriter(part, pcapng.LinkTypeUser0, "")
+		if err != nil {
+			t.Fatalf("Failed to write capture: %v", err)
+		}
+		for i, data := range packets {
+			dir := pcapng.Outbound
+			if i%2 == 1 {
+				dir = pcapng.Inbound
+			}
+			_ = w.WritePacket(time.Unix(1700000000, int64(i)*int64(time.Second)), data, dir, "")
+		}
+	}
+	form.Close()
+	return &body, form.FormDataContentType()
+}
+
+func TestHandleCaptureDiff(t *testing.T) {
+	cfg := &config.Config{UpstreamHost: "127.0.0.1", UpstreamPort: 8899, MaxClients: 10}
+	log := newTestLogger()
+	webServer := NewServer(cfg, proxy.NewServer(cfg, log), log)
+
+	// Firmware 2 answers the second query differently and adds a third one
+	body, contentType := captureForm(t,
+		[][]byte{{0x01}, {0x81, 0x00}, {0x02}, {0x82, 0x00}},
+		[][]byte{{0x01}, {0x81, 0x00}, {0x02}, {0x82, 0x01}, {0x03}, {0x83}},
+	)
+	req := httptest.NewRequest(http.MethodPost, "/api/captures/diff", body)
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	webServer.handleCaptureDiff(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp CaptureDiffResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.FramesA != 4 || resp.FramesB != 6 || resp.Same != 3 || resp.Changed != 1 || resp.Added != 2 || resp.Truncated {
+		t.Errorf("Unexpected summary %+v", resp)
+	}
+	if d := resp.Differences[0]; d.Type != "changed" || d.Direction != "from_upstream" || d.A.Data != "82 00" || d.B.Data != "82 01" {
+		t.Errorf("Unexpected first difference %+v", d)
+	}
+
+	// limit shortens the list, not the counts
+	body, contentType = captureForm(t, [][]byte{{0x01}}, [][]byte{{0x02}, {0x03}, {0x04}})
+	req = httptest.NewRequest(http.MethodPost, "/api/captures/diff?limit=1", body)
+	req.Header.Set("Content-Type", contentType)
+	w = httptest.NewRecorder()
+	webServer.handleCaptureDiff(w, req)
+	resp = CaptureDiffResponse{}
+	_ = json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Differences) != 1 || !resp.Truncated || resp.Changed != 1 || resp.Added != 2 {
+		t.Errorf("Expected a truncated list, got %+v", resp)
+	}
+}
+
+func TestHandleCaptureDiff_Invalid(t *testing.T) {
+	cfg := &config.Config{UpstreamHost: "127.0.0.1", UpstreamPort: 8899, MaxClients: 10}
+	log := newTestLogger()
+	webServer := NewServer(cfg, proxy.NewServer(cfg, log), log)
+
+	for name, tc := range map[string]struct {
+		query       string
+		body        string
+		contentType string
+	}{
+		"unknown transform": {query: "?transform=zip"},
+		"negative gap":      {query: "?gap_ms=-5"},
+		"not multipart":     {body: "{}", contentType: "application/json"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/captures/diff"+tc.query, strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+		w := httptest.NewRecorder()
+		webServer.handleCaptureDiff(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", name, w.Code)
+		}
+	}
+
+	// A capture that is not pcapng
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, name := range []string{"a", "b"} {
+		part, _ := form.CreateFormFile(name, name+".txt")
+		_, _ = part.Write([]byte("not a capture"))
+	}
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/captures/diff", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	webServer.handleCaptureDiff(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "not a pcapng capture") {
+		t.Errorf("Expected 400 for a text file, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandleConfigSchemaAndEffective(t *testing.T) {
+	cfg := &config.Config{UpstreamHost: "127.0.0.1", UpstreamPort: 8899, MaxClients: 10, WebAuthPassword: "hunter2"}
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	webServer := NewServer(cfg, p, log)
+
+	w := httptest.NewRecorder()
+	webServer.handleConfigSchema(w, httptest.NewRequest(http.MethodGet, "/api/config/schema", nil))
+	var schema ConfigSchemaResponse
+	if err := json.NewDecoder(w.Body).Decode(&schema); err != nil {
+		t.Fatalf("Failed to decode schema: %v", err)
+	}
+	if len(schema.Fields) == 0 || schema.Fields[0].Name != "upstream_host" {
+		t.Errorf("Unexpected schema %+v", schema.Fields)
+	}
+
+	// Switching injection off at runtime is reported as coming from the API
+	p.SetInjectionEnabled(false)
+	w = httptest.NewRecorder()
+	webServer.handleConfigEffective(w, httptest.NewRequest(http.MethodGet, "/api/config/effective", nil))
+	if strings.Contains(w.Body.String(), "hunter2") {
+		t.Error("Expected the password to be redacted")
+	}
+	var effective ConfigEffectiveResponse
+	if err := json.NewDecoder(w.Body).Decode(&effective); err != nil {
+		t.Fatalf("Failed to decode effective config: %v", err)
+	}
+	for _, f := range effective.Fields {
+		switch f.Name {
+		case "inject_enabled":
+			if f.Value != false || f.Source != SourceAPI {
+				t.Errorf("Unexpected inject_enabled %+v", f)
+			}
+		case "dry_run":
+			if f.Value != false || f.Source != config.SourceDefault {
+				t.Errorf("Unexpected dry_run %+v", f)
+			}
+		case "web_auth_password":
+			if f.Value != config.Redacted {
+				t.Errorf("Unexpected web_auth_password %+v", f)
+			}
+		}
+	}
+
+	w = httptest.NewRecorder()
+	webServer.handleConfigSchema(w, httptest.NewRequest(http.MethodPost, "/api/config/schema", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", w.Code)
+	}
+}
+
+func TestHealthEndpoint_Starting(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost:    "127.0.0.1",
+		UpstreamPort:    testutil.FreePort(t),
+		ListenPort:      testutil.FreePort(t),
+		MaxClients:      10,
+		WaitForUpstream: "500ms",
+	}
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	webServer := NewServer(cfg, p, log)
+	go func() { _ = p.Start(context.Background()) }()
+	defer p.Stop(context.Background())
+
+	testutil.Eventually(t, p.IsStarting, "startup not waiting for the upstream")
+	w := httptest.NewRecorder()
+	webServer.handleHealth(w, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+	var h HealthResponse
+	if err := json.NewDecoder(w.Body).Decode(&h); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if w.Code != http.StatusServiceUnavailable || h.Status != HealthStatusStarting {
+		t.Errorf("Expected 503 starting, got %d %s", w.Code, h.Status)
+	}
+
+	// Once the wait times out the proxy listens without an upstream
+	testutil.Eventually(t, p.IsListening, "listener not opened after the wait")
+	w = httptest.NewRecorder()
+	webServer.handleHealth(w, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+	h = HealthResponse{}
+	_ = json.NewDecoder(w.Body).Decode(&h)
+	if h.Status != HealthStatusDegraded {
+		t.Errorf("Expected degraded after the wait, got %s", h.Status)
+	}
+}
+
+func TestHandlePark(t *testing.T) {
+	cfg := &config.Config{UpstreamHost: "127.0.0.1", UpstreamPort: 8899, MaxClients: 10}
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	webServer := NewServer(cfg, p, log)
+
+	w := httptest.NewRecorder()
+	webServer.handlePark(w, httptest.NewRequest(http.MethodPut, "/api/park", strings.NewReader(`{"enabled":true}`)))
+	if w.Code != http.StatusOK || !p.Parked() {
+		t.Fatalf("Expected the proxy parked, got %d %s", w.Code, w.Body.String())
+	}
+
+	// Injections are refused while parked
+	w = httptest.NewRecorder()
+	webServer.handleInject(w, httptest.NewRequest(http.MethodPost, "/api/inject", strings.NewReader(`{"target":"upstream","data":"01"}`)))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status 409 for injection, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	webServer.handleHealth(w, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+	var h HealthResponse
+	_ = json.NewDecoder(w.Body).Decode(&h)
+	if !h.Checks.Upstream.Parked {
+		t.Errorf("Expected parked in the upstream check, got %+v", h.Checks.Upstream)
+	}
+
+	w = httptest.NewRecorder()
+	webServer.handlePark(w, httptest.NewRequest(http.MethodPut, "/api/park", strings.NewReader(`{"enabled":false}`)))
+	if w.Code != http.StatusOK || p.Parked() {
+		t.Errorf("Expected the proxy resumed, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandleEventHistory(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 8899,
+		ListenPort:   18899,
+		MaxClients:   10,
+		WebPort:      18080,
+	}
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	webServer := NewServer(cfg, p, log)
+	p.EmitWebClient(proxy.ClientInfo{ID: "web#1", Type: "web"}, true)
+	p.EmitWebClient(proxy.ClientInfo{ID: "web#1", Type: "web"}, false)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/events/history?type="+proxy.EventClientDisconnected, nil)
+	w := httptest.NewRecorder()
+	webServer.handleEventHistory(w, req)
+
+	var result struct {
+		Events []proxy.Event `json:"events"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(result.Events) != 1 || result.Events[0].Client.ID != "web#1" || result.Events[0].Time == "" {
+		t.Errorf("Unexpected events %+v", result.Events)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/events/history", nil)
+	w = httptest.NewRecorder()
+	webServer.handleEventHistory(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405, got %d", w.Code)
+	}
+}
+
+func TestHandleInject_ClientID(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: 8899,
+		ListenPort:   18899,
+		MaxClients:   10,
+		WebPort:      18080,
+	}
+	log := newTestLogger()
+	webServer := NewServer(cfg, proxy.NewServer(cfg, log), log)
+
+	for body, want := range map[string]int{
+		`{"target": "upstream", "format": "hex", "data": "01", "client_id": "client#1"}`:   http.StatusBadRequest,
+		`{"target": "downstream", "format": "hex", "data": "01", "client_id": "client#1"}`: http.StatusNotFound,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/inject", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		webServer.handleInject(w, req)
+		if w.Code != want {
+			t.Errorf("%s: expected status %d, got %d: %s", body, want, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestHandleInject_DenyFrames(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+	cfg := &config.Config{
+		UpstreamHost:     "127.0.0.1",
+		UpstreamPort:     upstream.Port(),
+		ListenPort:       testutil.FreePort(t),
+		MaxClients:       10,
+		WebPort:          18080,
+		WebAuthEnabled:   true,
+		WebAuthUsername:  "user",
+		WebAuthPassword:  "secret",
+		WebAdminUsername: "admin",
+		WebAdminPassword: "s3cret",
+		DenyFrames:       []config.DenyRule{{Name: "factory-reset", HexPrefix: "1a c0"}},
+	}
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer p.Stop(context.Background())
+	upstream.WaitConn()
+	testutil.Eventually(t, p.IsUpstreamConnected, "upstream not connected")
+	webServer := NewServer(cfg, p, log)
+
+	for _, tc := range []struct {
+		body       string
+		user, pass string
+		want       int
+	}{
+		{`{"target":"upstream","format":"hex","data":"1a c0 01"}`, "user", "secret", http.StatusForbidden},
+		{`{"target":"upstream","format":"hex","data":"1a c0 01","force":true}`, "user", "secret", http.StatusForbidden},
+		{`{"target":"upstream","format":"hex","data":"1a c0 01","force":true}`, "admin", "wrong", http.StatusForbidden},
+		{`{"target":"upstream","format":"hex","data":"1a c0 01","force":true}`, "admin", "s3cret", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/inject", strings.NewReader(tc.body))
+		req.SetBasicAuth(tc.user, tc.pass)
+		w := httptest.NewRecorder()
+		webServer.handleInject(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s as %s: expected status %d, got %d: %s", tc.body, tc.user, tc.want, w.Code, w.Body.String())
+		}
+	}
+	upstream.Expect([]byte{0x1A, 0xC0, 0x01})
+
+	// The admin account also passes the regular authentication
+	req := httptest.NewRequest(http.MethodGet, "/api/status", nil)
+	req.SetBasicAuth("admin", "s3cret")
+	if !webServer.isAuthenticated(req) {
+		t.Error("Expected the admin account to be authenticated")
+	}
+}
+
+func TestHandleInjectFile(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+	cfg := &config.Config{
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+		WebPort:      18080,
+	}
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	defer p.Stop(context.Background())
+	upstream.WaitConn()
+	testutil.Eventually(t, p.IsUpstreamConnected, "upstream not connected")
+	webServer := NewServer(cfg, p, log)
+
+	blob := make([]byte, 600)
+	for i := range blob {
+		blob[i] = byte(i)
+	}
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", "firmware.bin")
+	_, _ = part.Write(blob)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/inject/file?chunk_size=256&delay_ms=1", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	w := httptest.NewRecorder()
+	webServer.handleInjectFile(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp InjectFileResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if !resp.Success || resp.Bytes != 600 || resp.Chunks != 3 {
+		t.Errorf("Unexpected response %+v", resp)
+	}
+	upstream.Expect(blob)
+
+	for query, want := range map[string]int{
+		"chunk_size=0":                  http.StatusBadRequest,
+		"delay_ms=-1":                   http.StatusBadRequest,
+		"target=upstream&client_id=c#1": http.StatusBadRequest,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/inject/file?"+query, strings.NewReader(""))
+		w := httptest.NewRecorder()
+		webServer.handleInjectFile(w, req)
+		if w.Code != want {
+			t.Errorf("%s: expected status %d, got %d", query, want, w.Code)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/inject/file", strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	webServer.handleInjectFile(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without a multipart body, got %d", w.Code)
+	}
+}
+
+func TestBroadcastPacket(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost:    "127.0.0.1",
+		UpstreamPort:    9999,
+		MaxClients:      10,
+		WebPacketEvents: true,
+	}
+	log := newTestLogger()
+	webServer := NewServer(cfg, proxy.NewServer(cfg, log), log)
+
+	packetChan := make(chan PacketEvent, 10)
+	webServer.clientsMu.Lock()
+	webServer.packetClients[packetChan] = true
+	webServer.clientsMu.Unlock()
+
+	send := func(direction string, data []byte) PacketEvent {
+		t.Helper()
+		webServer.broadcastLog(logger.Entry{Level: logger.LogPkt, Direction: direction, Source: "client#1", Data: data})
+		select {
+		case p := <-packetChan:
+			return p
+		case <-time.After(time.Second):
+			t.Fatal("Timeout waiting for packet event")
+			return PacketEvent{}
+		}
+	}
+
+	p := send("->UP", []byte("AT+GMR\r\n"))
+	if !p.LikelyASCII || p.Direction != "to_upstream" || p.Hex != "41542b474d520d0a" || p.ASCII != "AT+GMR\r\n" {
+		t.Errorf("Unexpected text packet %+v", p)
+	}
+	// A binary frame in a text protocol is not rendered as text
+	p = send("->UP", []byte{0x01, 0x03, 0x00, 0x5c})
+	if p.LikelyASCII || p.ASCII != `\x01\x03\x00\\` {
+		t.Errorf("Unexpected binary packet %+v", p)
+	}
+	// Directions are judged separately
+	p = send("UP->", []byte("OK\r\n"))
+	if !p.LikelyASCII || p.Direction != "from_upstream" {
+		t.Errorf("Unexpected reply %+v", p)
+	}
+	for i := 0; i < 10; i++ {
+		send("UP->", bytes.Repeat([]byte{0xfe, 0x00}, 32))
+	}
+	if p = send("UP->", []byte("OK\r\n")); p.LikelyASCII {
+		t.Error("Expected text within mostly binary traffic to stay hex")
+	}
+}
+
+func TestHandleSessions(t *testing.T) {
+	cfg := &config.Config{
+		UpstreamHost:    "127.0.0.1",
+		UpstreamPort:    8899,
+		ListenPort:      18899,
+		MaxClients:      10,
+		WebPort:         18080,
+		WebAuthEnabled:  true,
+		WebAuthUsername: "admin",
+		WebAuthPassword: "secret",
+	}
+	log := newTestLogger()
+	webServer := NewServer(cfg, proxy.NewServer(cfg, log), log)
+
+	login := httptest.NewRequest(http.MethodPost, "/api/auth/login", nil)
+	login.Header.Set("User-Agent", "test-agent")
+	mine, _ := webServer.createSession(login)
+	other, _ := webServer.createSession(login)
+	withCookie := func(method, path string) *http.Request {
+		req := httptest.NewRequest(method, path, nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: mine})
+		return req
+	}
+
+	w := httptest.NewRecorder()
+	webServer.handleSessions(w, withCookie(http.MethodGet, "/api/sessions"))
+	var sessions []SessionInfo
+	if err := json.NewDecoder(w.Body).Decode(&sessions); err != nil {
+		t.Fatalf("Failed to decode sessions: %v", err)
+	}
+	if len(sessions) != 2 || sessions[0].UserAgent != "test-agent" {
+		t.Fatalf("Unexpected sessions %+v", sessions)
+	}
+	for _, s := range sessions {
+		if s.Current != (s.ID == sessionID(mine)) {
+			t.Errorf("Expected only the caller's session marked current, got %+v", s)
+		}
+	}
+	if strings.Contains(w.Body.String(), mine) {
+		t.Error("Expected session tokens not to be listed")
+	}
+
+	w = httptest.NewRecorder()
+	webServer.handleSession(w, withCookie(http.MethodDelete, "/api/sessions/"+sessionID(other)))
+	if w.Code != http.StatusOK || webServer.validateSession(other) {
+		t.Errorf("Expected the session revoked, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	webServer.handleSession(w, withCookie(http.MethodDelete, "/api/sessions/"+sessionID(other)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a revoked session, got %d", w.Code)
+	}
+
+	// Revoking all others keeps the caller's session
+	_, _ = webServer.createSession(login)
+	w = httptest.NewRecorder()
+	webServer.handleSessions(w, withCookie(http.MethodDelete, "/api/sessions"))
+	if !strings.Contains(w.Body.String(), `"revoked":1`) || !webServer.validateSession(mine) {
+		t.Errorf("Expected one session revoked and the caller's kept, got %s", w.Body.String())
+	}
+}
+
+func TestSession_IdleTimeout(t *testing.T) {
+	cfg := &config.Config{WebAuthEnabled: true, WebSessionIdle: 60}
+	log := newTestLogger()
+	webServer := NewServer(cfg, proxy.NewServer(cfg, log), log)
+
+	now := time.Now()
+	put := func(token string, seen time.Time) {
+		created := now.Add(-time.Hour)
+		_ = webServer.store.PutSession(storage.Session{
+			Token: token, CreatedAt: created, LastSeen: seen, ExpiresAt: webServer.sessionExpiry(created, seen),
+		})
+	}
+	put("idle", now.Add(-2*time.Minute))
+	put("active", now.Add(-30*time.Second))
+
+	if webServer.validateSession("idle") {
+		t.Error("Expected an idle session to have expired")
+	}
+	if !webServer.validateSession("active") {
+		t.Fatal("Expected an active session to be valid")
+	}
+	// Activity moves the expiry to a full idle timeout from now
+	s, _, _ := webServer.store.Session("active")
+	if s.ExpiresAt.Before(now.Add(time.Minute)) {
+		t.Errorf("Expected the expiry extended, got %v", s.ExpiresAt.Sub(now))
+	}
+
+	// The lifetime still bounds an active session
+	webServer.sessionLife = time.Hour
+	if got := webServer.sessionExpiry(now.Add(-time.Hour), now); !got.Equal(now) {
+		t.Errorf("Expected the expiry capped by the lifetime, got %v", got.Sub(now))
+	}
+}
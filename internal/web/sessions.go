@@ -0,0 +1,155 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SessionInfo describes a login session for /api/sessions. The token itself
+// is never returned; ID is derived from it.
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	LastSeen   time.Time `json:"last_seen"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Current    bool      `json:"current"` // the session of the request
+}
+
+// sessionID returns the public identifier of a session token
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// requestSession returns the session token of the request's cookie, or ""
+func requestSession(r *http.Request) string {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// handleSessions lists the active sessions (GET) or revokes all but the
+// caller's (DELETE)
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.listSessions(w, r)
+	case http.MethodDelete:
+		current := requestSession(r)
+		revoked, err := s.revokeSessions(func(token string) bool { return token != current })
+		if err != nil {
+			http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(map[string]int{"revoked": revoked}); err != nil {
+			s.logger.Error("Failed to encode response: %v", err)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleSession revokes one session by its ID (DELETE /api/sessions/{id})
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/sessions/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	revoked, err := s.revokeSessions(func(token string) bool { return sessionID(token) == id })
+	if err != nil {
+		http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+		return
+	}
+	if revoked == 0 {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]bool{"success": true}); err != nil {
+		s.logger.Error("Failed to encode response: %v", err)
+	}
+}
+
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := s.store.Sessions()
+	if err != nil {
+		s.logger.Warn("Failed to list sessions: %v", err)
+		http.Error(w, "Failed to list sessions", http.StatusInternalServerError)
+		return
+	}
+	current := requestSession(r)
+	now := time.Now()
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		if now.After(session.ExpiresAt) {
+			continue
+		}
+		infos = append(infos, SessionInfo{
+			ID:         sessionID(session.Token),
+			CreatedAt:  session.CreatedAt,
+			ExpiresAt:  session.ExpiresAt,
+			LastSeen:   session.LastSeen,
+			RemoteAddr: session.RemoteAddr,
+			UserAgent:  session.UserAgent,
+			Current:    session.Token == current,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(infos); err != nil {
+		s.logger.Error("Failed to encode sessions response: %v", err)
+	}
+}
+
+// revokeSessions deletes the sessions whose token matches and disconnects
+// the WebSocket clients that logged in with them. It returns the number of
+// sessions revoked.
+func (s *Server) revokeSessions(match func(token string) bool) (int, error) {
+	sessions, err := s.store.Sessions()
+	if err != nil {
+		s.logger.Warn("Failed to list sessions: %v", err)
+		return 0, err
+	}
+	revoked := make(map[string]bool)
+	for _, session := range sessions {
+		if !match(session.Token) {
+			continue
+		}
+		if err := s.store.DeleteSession(session.Token); err != nil {
+			s.logger.Warn("Failed to delete session: %v", err)
+			return len(revoked), err
+		}
+		revoked[session.Token] = true
+		s.logger.Info("Revoked web session %s", sessionID(session.Token))
+	}
+	if len(revoked) == 0 {
+		return 0, nil
+	}
+
+	// close takes wsClientsMu itself
+	var clients []*wsClient
+	s.wsClientsMu.Lock()
+	for c := range s.wsClients {
+		if revoked[c.session] {
+			clients = append(clients, c)
+		}
+	}
+	s.wsClientsMu.Unlock()
+	for _, c := range clients {
+		c.close()
+	}
+	return len(revoked), nil
+}
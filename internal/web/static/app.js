@@ -1,5 +1,5 @@
 
-import { initTabs, updateStatus, updateUptime } from './modules/ui.js';
+import { initTabs, updateStatus, updateUptime, showVersion } from './modules/ui.js';
 import { addLogEntry, clearLogs } from './modules/logs.js';
 import {
     addPacketEntry,
@@ -14,7 +14,8 @@ import { initInjection } from './modules/injection.js';
 import { updateInspector, renderDiff } from './modules/inspector.js';
 import { initTheme } from './modules/theme.js';
 import { apiUrl, wsUrl } from './modules/api.js';
-import { initClients } from './modules/clients.js';
+import { initClients, handleClientEvent } from './modules/clients.js';
+import { setSocket, handleAck } from './modules/commands.js';
 
 document.addEventListener('DOMContentLoaded', () => {
     // Initialize UI Modules
@@ -65,6 +66,12 @@ document.addEventListener('DOMContentLoaded', () => {
                     addLogEntry(logLine);
                 }
             }
+        } else if (type === 'logs') {
+            data.forEach(line => handleMessage('log', line));
+        } else if (type === 'ack') {
+            handleAck(data);
+        } else if (type === 'client_connected' || type === 'client_disconnected') {
+            handleClientEvent();
         }
     }
 
@@ -75,6 +82,7 @@ document.addEventListener('DOMContentLoaded', () => {
         ws.onopen = () => {
             console.log('WebSocket connected');
             setConnectionStatus(true);
+            setSocket(ws);
             reconnectAttempts = 0;
         };
 
@@ -94,6 +102,7 @@ document.addEventListener('DOMContentLoaded', () => {
         ws.onclose = () => {
             console.log('WebSocket disconnected');
             setConnectionStatus(false);
+            setSocket(null);
 
             // Reconnect with exponential backoff
             if (reconnectAttempts < maxReconnectAttempts) {
@@ -149,6 +158,11 @@ document.addEventListener('DOMContentLoaded', () => {
         })
         .catch(err => console.error('Failed to fetch initial status:', err));
 
+    fetch(apiUrl('/api/version'))
+        .then(response => response.json())
+        .then(showVersion)
+        .catch(err => console.error('Failed to fetch version:', err));
+
     // Start WebSocket connection (with SSE fallback)
     connectWebSocket();
 
@@ -1,5 +1,6 @@
 // Client management module
 import { apiUrl } from './api.js';
+import { canSend, sendCommand } from './commands.js';
 
 const clientsCard = document.getElementById('clients-card');
 const clientsModal = document.getElementById('clients-modal');
@@ -68,7 +69,7 @@ function renderClients(data) {
     sortedClients.forEach(client => {
         const row = document.createElement('tr');
         row.innerHTML = `
-            <td class="client-id">${client.id}</td>
+            <td class="client-id">${client.id}${client.name ? ` <span class="client-name">${client.name}</span>` : ''}</td>
             <td class="client-addr">${client.addr}</td>
             <td><span class="client-type ${client.type}">${client.type}</span></td>
             <td class="client-time">${formatConnectedTime(client.connected_at)}</td>
@@ -92,15 +93,19 @@ async function disconnectClient(clientId) {
     if (!confirm(`Disconnect ${clientId}?`)) return;
 
     try {
-        const response = await fetch(apiUrl('/api/clients/disconnect'), {
-            method: 'POST',
-            headers: { 'Content-Type': 'application/json' },
-            body: JSON.stringify({ client_id: clientId })
-        });
-
-        if (!response.ok) {
-            const error = await response.text();
-            throw new Error(error);
+        if (canSend()) {
+            await sendCommand('disconnect', { client_id: clientId });
+        } else {
+            const response = await fetch(apiUrl('/api/clients/disconnect'), {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ client_id: clientId })
+            });
+
+            if (!response.ok) {
+                const error = await response.text();
+                throw new Error(error);
+            }
         }
 
         // Refresh the list
@@ -133,6 +138,13 @@ function closeModal() {
     }
 }
 
+// Refresh the open client list when a client connects or disconnects
+export function handleClientEvent() {
+    if (isModalOpen) {
+        fetchClients();
+    }
+}
+
 // Initialize
 export function initClients() {
     // Card click handler
@@ -0,0 +1,52 @@
+// Commands sent over the WebSocket connection. Each command is answered by
+// an "ack" message carrying the same id.
+let socket = null;
+let nextId = 1;
+const pending = new Map();
+const ackTimeout = 10000;
+
+export function setSocket(ws) {
+    socket = ws;
+    if (!ws) {
+        // Fail commands still waiting on the closed socket
+        pending.forEach(({ reject, timer }) => {
+            clearTimeout(timer);
+            reject(new Error('connection closed'));
+        });
+        pending.clear();
+    }
+}
+
+// canSend reports whether commands can go over the WebSocket. Callers fall
+// back to the HTTP API otherwise.
+export function canSend() {
+    return socket !== null && socket.readyState === WebSocket.OPEN;
+}
+
+export function sendCommand(type, data) {
+    return new Promise((resolve, reject) => {
+        if (!canSend()) {
+            reject(new Error('not connected'));
+            return;
+        }
+        const id = String(nextId++);
+        const timer = setTimeout(() => {
+            pending.delete(id);
+            reject(new Error('no acknowledgement'));
+        }, ackTimeout);
+        pending.set(id, { resolve, reject, timer });
+        socket.send(JSON.stringify({ id, type, data }));
+    });
+}
+
+export function handleAck(ack) {
+    const entry = pending.get(ack.id);
+    if (!entry) return;
+    pending.delete(ack.id);
+    clearTimeout(entry.timer);
+    if (ack.ok) {
+        entry.resolve(ack);
+    } else {
+        entry.reject(new Error(ack.error || 'command failed'));
+    }
+}
@@ -1,4 +1,5 @@
 import { apiUrl } from './api.js';
+import { canSend, sendCommand } from './commands.js';
 
 export function initInjection() {
     const toggleInjectBtn = document.getElementById('toggle-inject');
@@ -30,21 +31,25 @@ export function initInjection() {
         }
 
         try {
-            const response = await fetch(apiUrl('/api/inject'), {
-                method: 'POST',
-                headers: {
-                    'Content-Type': 'application/json'
-                },
-                body: JSON.stringify({
-                    target,
-                    format,
-                    data
-                })
-            });
-
-            if (!response.ok) {
-                const errText = await response.text();
-                throw new Error(errText);
+            if (canSend()) {
+                await sendCommand('inject', { target, format, data });
+            } else {
+                const response = await fetch(apiUrl('/api/inject'), {
+                    method: 'POST',
+                    headers: {
+                        'Content-Type': 'application/json'
+                    },
+                    body: JSON.stringify({
+                        target,
+                        format,
+                        data
+                    })
+                });
+
+                if (!response.ok) {
+                    const errText = await response.text();
+                    throw new Error(errText);
+                }
             }
 
             const originalText = sendPacketBtn.innerText;
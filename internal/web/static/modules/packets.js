@@ -106,8 +106,13 @@ export function addPacketEntry(logLine) {
         else ascii += '.';
     }
 
+    // Time since the previous packet in this direction (LOG_PACKET_DELTAS)
+    const deltaMatch = logLine.match(/ dt=(\S+)/);
+    const delta = deltaMatch ? deltaMatch[1] : '';
+
     const packet = {
         time,
+        delta,
         direction,
         length,
         hexRaw: hexData,
@@ -292,7 +297,7 @@ function renderTableRow(row, item, index) {
     }
 
     row.innerHTML = `
-        <td>${p.time}</td>
+        <td>${p.time}${p.delta ? ` <span class="packet-delta">+${p.delta}</span>` : ''}</td>
         <td class="direction ${p.direction.includes('UP ->') ? 'up' : 'down'}">${p.direction}</td>
         <td>${p.length}</td>
         <td class="hex">${hexHtml}</td>
@@ -32,12 +32,75 @@ export function updateStatus(data) {
     listenPort.textContent = data.listen_addr.replace(':', '');
     clientCount.textContent = `${data.connected_clients} / ${data.max_clients}`;
 
+    if (data.runtime) {
+        updateResources(data.runtime);
+    }
+    updateConflict(data.controller_conflict);
+
     if (data.start_time) {
         return new Date(data.start_time);
     }
     return null;
 }
 
+// showVersion puts the build in the header, with the enabled features on
+// hover
+export function showVersion(data) {
+    const el = document.getElementById('app-version');
+    if (!el) return;
+    el.textContent = data.commit ? `${data.version} (${data.commit})` : data.version;
+    const enabled = Object.entries(data.features || {})
+        .filter(([, f]) => f.enabled)
+        .map(([name]) => name)
+        .sort();
+    const lines = [`${data.go_version || ''} ${data.os}/${data.arch}`.trim()];
+    if (data.build_date) lines.push(`Built ${data.build_date}`);
+    lines.push(`Enabled: ${enabled.length ? enabled.join(', ') : 'none'}`);
+    el.title = lines.join('\n');
+}
+
+// Two clients sending commands to the coordinator corrupt its network, so
+// the conflict stays on screen until it ends
+function updateConflict(conflict) {
+    const banner = document.getElementById('controller-conflict');
+    if (!banner) return;
+    banner.hidden = !conflict;
+    if (conflict) {
+        banner.textContent = `Several clients are controlling the coordinator: ${conflict.clients.join(', ')}. ` +
+            'Only one application may send it commands; stop the others.';
+    }
+}
+
+function updateResources(rt) {
+    const heapEl = document.getElementById('heap-usage');
+    const goroutineEl = document.getElementById('goroutine-count');
+    const card = document.getElementById('resources-card');
+    if (!heapEl || !goroutineEl) return;
+
+    heapEl.textContent = formatBytes(rt.heap_alloc_bytes);
+    goroutineEl.textContent = `${rt.goroutines} goroutines`;
+
+    // Details on hover: process memory, GC and queue depths
+    const lines = [
+        `Heap in use: ${formatBytes(rt.heap_inuse_bytes)}`,
+        `Process memory: ${formatBytes(rt.sys_bytes)}`,
+        `GC runs: ${rt.num_gc}`,
+    ];
+    for (const [name, depth] of Object.entries(rt.queues || {})) {
+        lines.push(`Queue ${name}: ${depth}`);
+    }
+    for (const pool of rt.buffer_pools || []) {
+        lines.push(`Pool ${pool.name}: ${pool.in_use} in use, ${pool.allocs} allocated`);
+    }
+    card.title = lines.join('\n');
+}
+
+function formatBytes(n) {
+    if (n >= 1024 * 1024) return `${(n / (1024 * 1024)).toFixed(1)} MiB`;
+    if (n >= 1024) return `${(n / 1024).toFixed(1)} KiB`;
+    return `${n} B`;
+}
+
 // Adjust font size based on text length
 function adjustFontSize(element) {
     const text = element.textContent;
@@ -0,0 +1,24 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handleStorage reports the disk use of the files under /data and the
+// retention limits
+func (s *Server) handleStorage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.retention == nil {
+		http.Error(w, "Storage usage is not tracked", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.retention.Usage()); err != nil {
+		s.logger.Warn("Failed to encode storage response: %v", err)
+	}
+}
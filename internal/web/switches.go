@@ -0,0 +1,54 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// SwitchSetting turns a proxy mode on or off
+type SwitchSetting struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// handleInjection shows (GET) or changes (PUT) whether packet injection,
+// macros and triggers are enabled. Only the admin account may change it,
+// so that other API users cannot undo INJECT_ENABLED=false.
+func (s *Server) handleInjection(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut && !s.isAdmin(r) {
+		http.Error(w, "changing injection requires the admin account", http.StatusForbidden)
+		return
+	}
+	s.handleSwitch(w, r, s.proxy.InjectionEnabled, s.proxy.SetInjectionEnabled)
+}
+
+// handleDryRun shows (GET) or changes (PUT) dry-run mode
+func (s *Server) handleDryRun(w http.ResponseWriter, r *http.Request) {
+	s.handleSwitch(w, r, s.proxy.DryRun, s.proxy.SetDryRun)
+}
+
+// handlePark shows (GET) or changes (PUT) whether the proxy is parked
+func (s *Server) handlePark(w http.ResponseWriter, r *http.Request) {
+	s.handleSwitch(w, r, s.proxy.Parked, s.proxy.SetParked)
+}
+
+func (s *Server) handleSwitch(w http.ResponseWriter, r *http.Request, get func() bool, set func(bool)) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req SwitchSetting
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+			http.Error(w, "enabled is required", http.StatusBadRequest)
+			return
+		}
+		set(*req.Enabled)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	enabled := get()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(SwitchSetting{Enabled: &enabled}); err != nil {
+		s.logger.Error("Failed to encode setting: %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strings"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/buildinfo"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+)
+
+// Feature tells whether a capability is built into the binary and whether
+// the configuration turns it on
+type Feature struct {
+	Compiled bool `json:"compiled"`
+	Enabled  bool `json:"enabled"`
+}
+
+// VersionResponse describes the build and its capabilities
+type VersionResponse struct {
+	buildinfo.Info
+	OS       string             `json:"os"`
+	Arch     string             `json:"arch"`
+	Features map[string]Feature `json:"features"`
+}
+
+// linuxOnly is true where the epoll client engine and the socket options
+// beyond keepalive are built, see the _linux.go files
+const linuxOnly = runtime.GOOS == "linux"
+
+// features lists the capabilities of the build for cfg
+func features(cfg *config.Config) map[string]Feature {
+	schemes := upstreamSchemes(cfg)
+	on := func(enabled bool) Feature { return Feature{Compiled: true, Enabled: enabled} }
+	return map[string]Feature{
+		"tls":            on(cfg.TLSListenPort > 0 || cfg.MuxListenPort > 0 || cfg.ACMEEnabled() || schemes["wss"]),
+		"quic":           on(cfg.QUICListenPort > 0 || schemes["quic"]),
+		"mux":            on(cfg.MuxListenPort > 0 || schemes["mux"]),
+		"websocket":      on(schemes["ws"] || schemes["wss"]),
+		"mqtt":           on(schemes["mqtt"] || cfg.RecoveryTopic != ""),
+		"serial":         on(schemes["rfc2217"] || cfg.UpstreamDetect),
+		"decoders":       on(cfg.TransformFrom != "" || cfg.TransformTo != "" || len(cfg.Values) > 0),
+		"triggers":       on(len(cfg.Triggers) > 0),
+		"injection":      on(cfg.InjectionEnabled()),
+		"hooks":          on(cfg.OnUpstreamUp != "" || cfg.OnUpstreamDown != "" || cfg.OnClientConnect != "" || cfg.OnClientClose != ""),
+		"influxdb":       on(cfg.InfluxURL != ""),
+		"statsd":         on(cfg.StatsdAddr != ""),
+		"sqlite":         on(cfg.StorageBackend == config.StorageSQLite),
+		"acme":           on(cfg.ACMEEnabled()),
+		"web_auth":       on(cfg.WebAuthEnabled),
+		"epoll":          {Compiled: linuxOnly, Enabled: linuxOnly && cfg.ClientEngine == config.EngineEpoll},
+		"socket_options": {Compiled: linuxOnly, Enabled: linuxOnly && (cfg.TCPUserTimeout > 0 || cfg.TCPKeepInterval > 0 || cfg.TCPKeepCount > 0 || cfg.SocketDSCP > 0 || cfg.SocketPriority > 0)},
+	}
+}
+
+// upstreamSchemes returns the transports of the primary and additional
+// upstreams, with "tcp" for host:port addresses
+func upstreamSchemes(cfg *config.Config) map[string]bool {
+	schemes := make(map[string]bool)
+	addrs := []string{cfg.UpstreamAddr()}
+	for _, spec := range cfg.Upstreams {
+		addrs = append(addrs, spec.Addr)
+	}
+	for _, addr := range addrs {
+		scheme, _, ok := strings.Cut(addr, "://")
+		if !ok {
+			scheme = "tcp"
+		}
+		schemes[strings.ToLower(scheme)] = true
+	}
+	return schemes
+}
+
+// handleVersion reports the build and which features it has, for support
+// requests and the UI
+func (s *Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := VersionResponse{
+		Info:     s.build,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Features: features(s.config),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		s.logger.Warn("Failed to encode version response: %v", err)
+	}
+}
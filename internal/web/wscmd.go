@@ -0,0 +1,220 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/inject"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/proxy"
+)
+
+// wsReadLimit bounds inbound WebSocket messages (commands)
+const wsReadLimit = 16 * 1024
+
+// wsCommand is a command sent by a WebSocket client. ID is echoed in the
+// acknowledgement so the client can match it to the request.
+type wsCommand struct {
+	ID   string          `json:"id"`
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// wsAck acknowledges a command
+type wsAck struct {
+	ID      string `json:"id,omitempty"`
+	Command string `json:"command"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+}
+
+// wsSubscription selects the messages pushed to a WebSocket client. Empty
+// lists match everything.
+type wsSubscription struct {
+	Types       []string `json:"types"`        // see wsMessageTypes
+	Directions  []string `json:"directions"`   // from_upstream, to_upstream
+	Sources     []string `json:"sources"`      // patterns as in LOG_PACKET_SOURCES
+	PacketsOnly bool     `json:"packets_only"` // drop non-packet log lines
+}
+
+// wsFilter is the compiled form of a wsSubscription
+type wsFilter struct {
+	types       []string
+	packets     logger.PacketFilter
+	packetsOnly bool
+}
+
+// wsMessageTypes lists the message types a client can subscribe to
+var wsMessageTypes = []string{
+	"status", "log", "value", "packet",
+	proxy.EventClientConnected, proxy.EventClientDisconnected, proxy.EventUpstreamState,
+}
+
+var errUnauthorized = errors.New("unauthorized")
+
+// handleCommand runs one command received from c and acknowledges it
+func (s *Server) handleCommand(c *wsClient, message []byte) {
+	var cmd wsCommand
+	if err := json.Unmarshal(message, &cmd); err != nil {
+		c.ack(wsAck{Error: "invalid JSON"})
+		return
+	}
+
+	err := s.runCommand(c, cmd)
+	ack := wsAck{ID: cmd.ID, Command: cmd.Type, OK: err == nil}
+	if err != nil {
+		ack.Error = err.Error()
+	}
+	c.ack(ack)
+}
+
+func (s *Server) runCommand(c *wsClient, cmd wsCommand) error {
+	// Sessions may expire or be logged out while the socket stays open
+	if !s.wsAuthorized(c) {
+		return errUnauthorized
+	}
+
+	switch cmd.Type {
+	case "inject":
+		var req InjectRequest
+		if err := json.Unmarshal(cmd.Data, &req); err != nil {
+			return errors.New("invalid inject request")
+		}
+		if req.ClientID != "" && req.Target != "downstream" {
+			return errClientTarget
+		}
+		if req.Force {
+			return errAdminRequired
+		}
+		data, err := s.renderInject(req, req.Vars)
+		if err != nil {
+			return err
+		}
+		if err := s.inject(req, data); err != nil {
+			return fmt.Errorf("injection failed: %w", err)
+		}
+	case "disconnect":
+		var req DisconnectRequest
+		if err := json.Unmarshal(cmd.Data, &req); err != nil || req.ClientID == "" {
+			return errors.New("client_id is required")
+		}
+		if !s.disconnectClient(req.ClientID) {
+			return errors.New("client not found")
+		}
+	case "pause":
+		s.proxy.SetForwardingPaused(true)
+	case "resume":
+		s.proxy.SetForwardingPaused(false)
+	case "subscribe":
+		var sub wsSubscription
+		if len(cmd.Data) > 0 {
+			if err := json.Unmarshal(cmd.Data, &sub); err != nil {
+				return errors.New("invalid subscription")
+			}
+		}
+		filter, err := sub.compile()
+		if err != nil {
+			return err
+		}
+		c.filterMu.Lock()
+		c.filter = filter
+		c.filterMu.Unlock()
+	default:
+		return fmt.Errorf("unknown command %q", cmd.Type)
+	}
+	return nil
+}
+
+// wsAuthorized re-checks the session a WebSocket client connected with.
+// Clients that authenticated with Basic auth have no session and keep the
+// access they were granted at upgrade.
+func (s *Server) wsAuthorized(c *wsClient) bool {
+	if !s.config.WebAuthEnabled || c.session == "" {
+		return true
+	}
+	return s.validateSession(c.session)
+}
+
+// renderInject decodes the data of an injection request, rendering its
+// placeholders if it is a template
+func (s *Server) renderInject(req InjectRequest, vars map[string]string) ([]byte, error) {
+	if !req.Template {
+		data, err := inject.Decode(req.Format, req.Data)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Hex: %v", err)
+		}
+		return data, nil
+	}
+	data, err := s.renderer.Render(req.Format, req.Data, vars)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid template: %v", err)
+	}
+	return data, nil
+}
+
+func (sub wsSubscription) compile() (wsFilter, error) {
+	f := wsFilter{types: sub.Types, packetsOnly: sub.PacketsOnly}
+	for _, t := range sub.Types {
+		if !slices.Contains(wsMessageTypes, t) {
+			return wsFilter{}, fmt.Errorf("unknown message type %q", t)
+		}
+	}
+	for _, d := range sub.Directions {
+		label, ok := logger.DirectionLabel(d)
+		if !ok {
+			return wsFilter{}, fmt.Errorf("unknown direction %q", d)
+		}
+		f.packets.Directions = append(f.packets.Directions, label)
+	}
+	for _, p := range sub.Sources {
+		if _, err := path.Match(p, ""); err != nil {
+			return wsFilter{}, fmt.Errorf("invalid source pattern %q", p)
+		}
+		f.packets.Sources = append(f.packets.Sources, p)
+	}
+	return f, nil
+}
+
+// wants reports whether a message passes the client's subscription
+func (c *wsClient) wants(msgType string, data interface{}) bool {
+	c.filterMu.Lock()
+	f := c.filter
+	c.filterMu.Unlock()
+
+	if len(f.types) > 0 && !slices.Contains(f.types, msgType) {
+		return false
+	}
+	if p, ok := data.(PacketEvent); ok {
+		label, _ := logger.DirectionLabel(p.Direction)
+		return f.packets.Allows(label, p.Source)
+	}
+	line, ok := data.(string)
+	if msgType != "log" || !ok {
+		return true
+	}
+	direction, source, isPacket := logger.ParsePacketLine(line)
+	if !isPacket {
+		return !f.packetsOnly
+	}
+	return f.packets.Allows(direction, source)
+}
+
+// ack queues an acknowledgement without blocking the read loop
+func (c *wsClient) ack(a wsAck) {
+	data, err := json.Marshal(wsMessage{Type: "ack", Data: a})
+	if err != nil {
+		return
+	}
+	c.closedMu.Lock()
+	defer c.closedMu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.send <- data:
+	default:
+	}
+}
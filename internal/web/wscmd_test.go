@@ -0,0 +1,486 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/proxy"
+	"github.com/hoon-ch/serial-tcp-proxy/pkg/testutil"
+)
+
+// startWSTest starts a proxy with a mock upstream and a web server for it
+func startWSTest(t *testing.T, cfg *config.Config) (*testutil.MockUpstream, *proxy.Server, *Server, *httptest.Server) {
+	t.Helper()
+	upstream := testutil.NewMockUpstream(t)
+	cfg.UpstreamHost = "127.0.0.1"
+	cfg.UpstreamPort = upstream.Port()
+	cfg.ListenPort = testutil.FreePort(t)
+	cfg.MaxClients = 10
+
+	log := newTestLogger()
+	p := proxy.NewServer(cfg, log)
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = p.Stop(context.Background()) })
+	upstream.WaitConn()
+	testutil.Eventually(t, p.IsUpstreamConnected, "upstream not connected")
+
+	ws := NewServer(cfg, p, log)
+	ts := httptest.NewServer(http.HandlerFunc(ws.handleWebSocket))
+	t.Cleanup(ts.Close)
+	return upstream, p, ws, ts
+}
+
+func dialWS(t *testing.T, ts *httptest.Server, header http.Header) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), header)
+	if err != nil {
+		t.Fatalf("Failed to dial WebSocket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// command sends a command and returns its acknowledgement
+func command(t *testing.T, conn *websocket.Conn, id, cmdType string, data interface{}) wsAck {
+	t.Helper()
+	raw, _ := json.Marshal(data)
+	if err := conn.WriteJSON(wsCommand{ID: id, Type: cmdType, Data: raw}); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(testutil.DefaultTimeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	for {
+		var msg struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Failed to read ack for %s: %v", id, err)
+		}
+		if msg.Type != "ack" {
+			continue
+		}
+		var ack wsAck
+		if err := json.Unmarshal(msg.Data, &ack); err != nil {
+			t.Fatalf("Invalid ack: %v", err)
+		}
+		if ack.ID == id {
+			return ack
+		}
+	}
+}
+
+func TestWebSocket_Commands(t *testing.T) {
+	cfg := &config.Config{}
+	upstream, p, _, ts := startWSTest(t, cfg)
+	conn := dialWS(t, ts, nil)
+
+	ack := command(t, conn, "1", "inject", InjectRequest{Target: "upstream", Format: "hex", Data: "01 02"})
+	if !ack.OK || ack.Command != "inject" {
+		t.Fatalf("Expected inject acknowledged, got %+v", ack)
+	}
+	upstream.Expect([]byte{0x01, 0x02})
+
+	if ack := command(t, conn, "2", "inject", InjectRequest{Target: "upstream", Format: "hex", Data: "zz"}); ack.OK || ack.Error == "" {
+		t.Errorf("Expected invalid hex rejected, got %+v", ack)
+	}
+
+	if ack := command(t, conn, "3", "pause", nil); !ack.OK || !p.ForwardingPaused() {
+		t.Errorf("Expected forwarding paused, got %+v", ack)
+	}
+	if ack := command(t, conn, "4", "resume", nil); !ack.OK || p.ForwardingPaused() {
+		t.Errorf("Expected forwarding resumed, got %+v", ack)
+	}
+
+	if ack := command(t, conn, "5", "disconnect", DisconnectRequest{ClientID: "client#999"}); ack.OK || ack.Error != "client not found" {
+		t.Errorf("Expected client not found, got %+v", ack)
+	}
+	if ack := command(t, conn, "6", "reboot", nil); ack.OK {
+		t.Errorf("Expected unknown command rejected, got %+v", ack)
+	}
+	if ack := command(t, conn, "7", "subscribe", wsSubscription{Directions: []string{"sideways"}}); ack.OK {
+		t.Errorf("Expected invalid direction rejected, got %+v", ack)
+	}
+
+	tcp := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	testutil.Eventually(t, func() bool { return p.GetTCPClientCount() == 1 }, "client not registered")
+	id := p.GetClients()[0].ID
+	if ack := command(t, conn, "8", "disconnect", DisconnectRequest{ClientID: id}); !ack.OK {
+		t.Errorf("Expected %s disconnected, got %+v", id, ack)
+	}
+	_ = tcp.SetReadDeadline(time.Now().Add(testutil.DefaultTimeout))
+	if _, err := tcp.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected TCP client connection closed")
+	}
+}
+
+func TestWebSocket_SessionExpiry(t *testing.T) {
+	_, p, ws, ts := startWSTest(t, &config.Config{WebAuthEnabled: true})
+
+	token, err := ws.createSession(httptest.NewRequest(http.MethodPost, "/api/auth/login", nil))
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	header := http.Header{}
+	header.Set("Cookie", sessionCookieName+"="+token)
+	conn := dialWS(t, ts, header)
+
+	if ack := command(t, conn, "1", "pause", nil); !ack.OK {
+		t.Fatalf("Expected command allowed with a valid session, got %+v", ack)
+	}
+
+	ws.deleteSession(token)
+	if ack := command(t, conn, "2", "resume", nil); ack.OK || ack.Error != "unauthorized" {
+		t.Errorf("Expected unauthorized after logout, got %+v", ack)
+	}
+	if !p.ForwardingPaused() {
+		t.Error("Expected rejected command to have no effect")
+	}
+}
+
+func TestWebSocket_CrossOrigin(t *testing.T) {
+	_, _, _, ts := startWSTest(t, &config.Config{})
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	// A page on another site cannot open the socket with the user's cookie
+	header := http.Header{"Origin": {"http://evil.example"}}
+	if _, resp, err := websocket.DefaultDialer.Dial(url, header); err == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a cross-origin handshake refused, got %v", err)
+	}
+
+	// The web UI's own page, a page behind Ingress and clients without a
+	// browser are accepted
+	dialWS(t, ts, http.Header{"Origin": {ts.URL}})
+	dialWS(t, ts, http.Header{"Origin": {"https://ha.example"}, "X-Forwarded-Host": {"ha.example"}})
+	dialWS(t, ts, nil)
+}
+
+func TestWsClient_Wants(t *testing.T) {
+	pkt := func(dir, source string) string {
+		line := fmt.Sprintf("2024-01-15T10:30:50Z [PKT] [%s] 01 (1 bytes)", dir)
+		if source != "" {
+			line += " from " + source
+		}
+		return line + "\n"
+	}
+
+	tests := []struct {
+		name    string
+		sub     wsSubscription
+		msgType string
+		data    interface{}
+		want    bool
+	}{
+		{"default", wsSubscription{}, "status", nil, true},
+		{"type excluded", wsSubscription{Types: []string{"log"}}, "status", nil, false},
+		{"type included", wsSubscription{Types: []string{"log"}}, "log", "[INFO] hello", true},
+		{"packets only", wsSubscription{PacketsOnly: true}, "log", "2024-01-15T10:30:50Z [INFO] hello\n", false},
+		{"direction match", wsSubscription{Directions: []string{"from_upstream"}}, "log", pkt("UP->", ""), true},
+		{"direction miss", wsSubscription{Directions: []string{"from_upstream"}}, "log", pkt("->UP", "client#1"), false},
+		{"source match", wsSubscription{Sources: []string{"client#*"}}, "log", pkt("->UP", "client#1"), true},
+		{"source miss", wsSubscription{Sources: []string{"INJECT"}}, "log", pkt("->UP", "client#1"), false},
+		{"packet event match", wsSubscription{Directions: []string{"to_upstream"}}, "packet", PacketEvent{Direction: "to_upstream", Source: "client#1"}, true},
+		{"packet event miss", wsSubscription{Sources: []string{"INJECT"}}, "packet", PacketEvent{Direction: "to_upstream", Source: "client#1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := tt.sub.compile()
+			if err != nil {
+				t.Fatalf("compile: %v", err)
+			}
+			c := &wsClient{filter: f}
+			if got := c.wants(tt.msgType, tt.data); got != tt.want {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestWebSocket_ClientEvents(t *testing.T) {
+	cfg := &config.Config{}
+	_, _, _, ts := startWSTest(t, cfg)
+	conn := dialWS(t, ts, nil)
+
+	if ack := command(t, conn, "1", "subscribe", wsSubscription{Types: []string{"client_connected"}}); !ack.OK {
+		t.Fatalf("Expected subscription accepted, got %+v", ack)
+	}
+	testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+
+	_ = conn.SetReadDeadline(time.Now().Add(testutil.DefaultTimeout))
+	var msg struct {
+		Type string      `json:"type"`
+		Data proxy.Event `json:"data"`
+	}
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read event: %v", err)
+	}
+	if msg.Type != proxy.EventClientConnected || msg.Data.Client == nil || msg.Data.Client.Type != "tcp" {
+		t.Errorf("Expected client_connected event for a TCP client, got %+v", msg)
+	}
+}
+
+func TestWebSocket_ManyValues(t *testing.T) {
+	// More current values than the send buffer holds must not hold up the
+	// connection
+	cfg := &config.Config{}
+	for i := range 300 {
+		cfg.Values = append(cfg.Values, config.ValueRule{Name: fmt.Sprintf("reg%d", i), Match: "01 03", Offset: 2, Type: "u8"})
+	}
+	upstream, p, _, ts := startWSTest(t, cfg)
+	upstream.Send([]byte{0x01, 0x03, 0x2a})
+	testutil.Eventually(t, func() bool { return len(p.GetValues()) == len(cfg.Values) }, "values not extracted")
+
+	conn := dialWS(t, ts, nil)
+	if ack := command(t, conn, "1", "subscribe", wsSubscription{Types: []string{"status"}}); !ack.OK {
+		t.Errorf("Expected the connection to take commands, got %+v", ack)
+	}
+}
+
+func TestWebSocket_LogBatch(t *testing.T) {
+	cfg := &config.Config{}
+	_, _, ws, ts := startWSTest(t, cfg)
+	conn := dialWS(t, ts, nil)
+
+	if ack := command(t, conn, "1", "subscribe", wsSubscription{Types: []string{"log"}, PacketsOnly: true}); !ack.OK {
+		t.Fatalf("Expected subscription accepted, got %+v", ack)
+	}
+	for _, line := range []string{
+		"2024-01-15T10:30:50Z [PKT] [UP->] 01 (1 bytes)\n",
+		"2024-01-15T10:30:50Z [INFO] hello\n",
+		"2024-01-15T10:30:50Z [PKT] [->UP] 02 (1 bytes) from client#1\n",
+	} {
+		ws.broadcastLog(logger.Entry{Line: line})
+	}
+
+	// The subscription drops the INFO line from the batch
+	_ = conn.SetReadDeadline(time.Now().Add(testutil.DefaultTimeout))
+	for {
+		var msg struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("Failed to read logs: %v", err)
+		}
+		if msg.Type == "log" {
+			continue // packets logged while the proxy started
+		}
+		var lines []string
+		if err := json.Unmarshal(msg.Data, &lines); err != nil {
+			t.Fatalf("Expected an array of lines, got %s", msg.Data)
+		}
+		if msg.Type != "logs" || len(lines) != 2 || !strings.Contains(lines[1], "02") {
+			t.Errorf("Expected a logs message with both packet lines, got %s %q", msg.Type, lines)
+		}
+		return
+	}
+}
+
+func TestWebSocket_KeepAliveIntervals(t *testing.T) {
+	disabled := false
+	cfg := &config.Config{WebStatusPush: &disabled, WebStatusInterval: 1, WebWSPing: 1}
+	_, _, _, ts := startWSTest(t, cfg)
+	conn := dialWS(t, ts, nil)
+
+	pinged := make(chan struct{}, 1)
+	conn.SetPingHandler(func(data string) error {
+		select {
+		case pinged <- struct{}{}:
+		default:
+		}
+		return conn.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+	})
+
+	// Only the initial status arrives while periodic pushes are disabled
+	statuses := 0
+	_ = conn.SetReadDeadline(time.Now().Add(2500 * time.Millisecond))
+	for {
+		var msg struct {
+			Type string `json:"type"`
+		}
+		if err := conn.ReadJSON(&msg); err != nil {
+			break
+		}
+		if msg.Type == "status" {
+			statuses++
+		}
+	}
+	if statuses != 1 {
+		t.Errorf("Expected only the initial status, got %d", statuses)
+	}
+	select {
+	case <-pinged:
+	default:
+		t.Error("Expected a ping within the configured interval")
+	}
+}
+
+func TestPacketTap(t *testing.T) {
+	cfg := &config.Config{}
+	upstream, _, ws, _ := startWSTest(t, cfg)
+	ts := httptest.NewServer(http.HandlerFunc(ws.handlePacketTap))
+	t.Cleanup(ts.Close)
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	if _, resp, err := websocket.DefaultDialer.Dial(url+"?direction=sideways", nil); err == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown direction, got %v", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?direction=to_upstream", nil)
+	if err != nil {
+		t.Fatalf("Failed to dial packet tap: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	testutil.Eventually(t, func() bool { return ws.tapCount.Load() == 1 }, "tap not registered")
+
+	client := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	before := time.Now()
+	_, _ = client.Write([]byte{0xf7, 0x01})
+	upstream.Expect([]byte{0xf7, 0x01})
+	// Filtered out: received from the upstream
+	upstream.Send([]byte{0x02})
+	testutil.ExpectRead(t, client, []byte{0x02})
+	_, _ = client.Write([]byte{0x03})
+
+	for i, want := range [][]byte{{0xf7, 0x01}, {0x03}} {
+		_ = conn.SetReadDeadline(time.Now().Add(testutil.DefaultTimeout))
+		msgType, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to read packet: %v", err)
+		}
+		if msgType != websocket.BinaryMessage || len(msg) < tapHeaderSize {
+			t.Fatalf("Expected a binary packet message, got type %d: %x", msgType, msg)
+		}
+		if msg[0] != tapVersion || msg[1] != 1 || binary.BigEndian.Uint32(msg[2:6]) != uint32(i+1) {
+			t.Errorf("Unexpected header %x", msg[:6])
+		}
+		if at := time.Unix(0, int64(binary.BigEndian.Uint64(msg[6:14]))); at.Before(before.Add(-time.Second)) || at.After(time.Now()) {
+			t.Errorf("Unexpected timestamp %v", at)
+		}
+		n := int(msg[14])
+		if source := string(msg[tapHeaderSize : tapHeaderSize+n]); !strings.HasPrefix(source, "client#") {
+			t.Errorf("Expected a client source, got %q", source)
+		}
+		if data := msg[tapHeaderSize+n:]; !bytes.Equal(data, want) {
+			t.Errorf("Expected %x, got %x", want, data)
+		}
+	}
+}
+
+func TestPacketStream(t *testing.T) {
+	cfg := &config.Config{}
+	upstream, _, ws, _ := startWSTest(t, cfg)
+	ts := httptest.NewServer(http.HandlerFunc(ws.handlePacketStream))
+	t.Cleanup(ts.Close)
+
+	resp, err := http.Get(ts.URL + "?format=xml")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown format, got %d", resp.StatusCode)
+	}
+
+	ndjson, err := http.Get(ts.URL + "?direction=to_upstream")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	t.Cleanup(func() { ndjson.Body.Close() })
+	if ct := ndjson.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Expected application/x-ndjson, got %q", ct)
+	}
+	proto, err := http.Get(ts.URL + "?format=protobuf")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	t.Cleanup(func() { proto.Body.Close() })
+	testutil.Eventually(t, func() bool { return ws.tapCount.Load() == 2 }, "streams not registered")
+
+	client := testutil.Dial(t, fmt.Sprintf("127.0.0.1:%d", cfg.ListenPort))
+	_, _ = client.Write([]byte{0xf7, 0x01})
+	upstream.Expect([]byte{0xf7, 0x01})
+	upstream.Send([]byte{0x02})
+	testutil.ExpectRead(t, client, []byte{0x02})
+
+	lines := bufio.NewReader(ndjson.Body)
+	line, err := lines.ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("Failed to read NDJSON line: %v", err)
+	}
+	var p StreamPacket
+	if err := json.Unmarshal(line, &p); err != nil {
+		t.Fatalf("Invalid NDJSON line %q: %v", line, err)
+	}
+	if p.Seq != 1 || p.Direction != "to_upstream" || p.Data != "f701" || p.Length != 2 || !strings.HasPrefix(p.Source, "client#") {
+		t.Errorf("Unexpected packet %+v", p)
+	}
+
+	// The unfiltered protobuf stream carries both packets
+	body := bufio.NewReader(proto.Body)
+	for i, want := range []struct {
+		direction uint64
+		data      []byte
+	}{{1, []byte{0xf7, 0x01}}, {0, []byte{0x02}}} {
+		size, err := binary.ReadUvarint(body)
+		if err != nil {
+			t.Fatalf("Failed to read message length: %v", err)
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(body, msg); err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+		fields := decodeProtobuf(t, msg)
+		if fields[1].(uint64) != uint64(i+1) || fields[3] != nil && fields[3].(uint64) != want.direction {
+			t.Errorf("Unexpected fields %v", fields)
+		}
+		if want.direction == 1 && fields[3] == nil {
+			t.Errorf("Expected direction in %v", fields)
+		}
+		if data, _ := fields[5].([]byte); !bytes.Equal(data, want.data) {
+			t.Errorf("Expected data %x, got %x", want.data, data)
+		}
+	}
+}
+
+// decodeProtobuf decodes the varint and length-delimited fields of a
+// protobuf message by field number
+func decodeProtobuf(t *testing.T, msg []byte) map[int]interface{} {
+	t.Helper()
+	fields := make(map[int]interface{})
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		msg = msg[n:]
+		v, n := binary.Uvarint(msg)
+		if n <= 0 {
+			t.Fatalf("Invalid varint in %x", msg)
+		}
+		msg = msg[n:]
+		switch key & 7 {
+		case 0:
+			fields[int(key>>3)] = v
+		case 2:
+			fields[int(key>>3)] = msg[:v]
+			msg = msg[v:]
+		default:
+			t.Fatalf("Unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
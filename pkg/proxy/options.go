@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"io"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+)
+
+// Option adjusts the proxy before it is created
+type Option func(*options)
+
+// options collects the settings applied by Options
+type options struct {
+	cfg       *config.Config
+	logOutput io.Writer
+	onPacket  func(Packet)
+}
+
+// WithListenPort sets the TCP port clients connect to (LISTEN_PORT,
+// default 18899)
+func WithListenPort(port int) Option {
+	return func(o *options) { o.cfg.ListenPort = port }
+}
+
+// WithMaxClients sets how many clients may connect at once (MAX_CLIENTS,
+// default 10)
+func WithMaxClients(n int) Option {
+	return func(o *options) { o.cfg.MaxClients = n }
+}
+
+// WithUpstreamName names the upstream in logs and packet sources
+// (UPSTREAM_NAME, default primary)
+func WithUpstreamName(name string) Option {
+	return func(o *options) { o.cfg.UpstreamName = name }
+}
+
+// WithWaitForUpstream makes Start wait up to d for the upstream before
+// accepting clients (WAIT_FOR_UPSTREAM)
+func WithWaitForUpstream(d time.Duration) Option {
+	return func(o *options) { o.cfg.WaitForUpstream = d.String() }
+}
+
+// WithFrameGap holds back upstream data until the line has been quiet for
+// ms milliseconds, so clients receive whole frames (FRAME_GAP_MS)
+func WithFrameGap(ms int) Option {
+	return func(o *options) { o.cfg.FrameGapMs = ms }
+}
+
+// WithLogOutput writes the proxy's log lines to w
+func WithLogOutput(w io.Writer) Option {
+	return func(o *options) { o.logOutput = w }
+}
+
+// WithPacketLog adds a line per forwarded packet to the log output
+// (LOG_PACKETS)
+func WithPacketLog() Option {
+	return func(o *options) { o.cfg.LogPackets = true }
+}
+
+// WithPacketHandler calls fn for every packet forwarded or injected. It is
+// called from a single goroutine after the packet has been sent on, so a
+// slow handler never holds up the proxy; packets are dropped instead once
+// it falls too far behind. Packet.Data is only valid during the call.
+func WithPacketHandler(fn func(Packet)) Option {
+	return func(o *options) { o.onPacket = fn }
+}
@@ -0,0 +1,255 @@
+// Package proxy embeds the serial-to-TCP bridge in another Go program.
+// A Proxy keeps one connection to a serial device server and shares it with
+// every TCP client connecting to its listen port, as the serial-tcp-proxy
+// binary does:
+//
+//	p, err := proxy.New("192.168.1.50:8899", proxy.WithListenPort(18899))
+//	if err != nil {
+//		return err
+//	}
+//	return p.Run(ctx) // until ctx is cancelled
+//
+// Only the core bridge is started; the web UI and metrics exporters are
+// not part of an embedded proxy.
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	core "github.com/hoon-ch/serial-tcp-proxy/internal/proxy"
+)
+
+// Errors returned by Inject
+var (
+	ErrInjectDisabled = core.ErrInjectDisabled
+	ErrParked         = core.ErrParked
+)
+
+// ErrStarted is returned by Start and Run on a proxy that was already started
+var ErrStarted = errors.New("proxy already started")
+
+// Direction is the way a packet travelled through the proxy
+type Direction string
+
+const (
+	FromUpstream Direction = "from_upstream" // device to clients
+	ToUpstream   Direction = "to_upstream"   // a client to the device
+)
+
+// Packet is a chunk of data forwarded by the proxy, as passed to the
+// handler set with WithPacketHandler
+type Packet struct {
+	Time      time.Time
+	Direction Direction
+	Source    string // client ID, or INJECT, POLL, INIT for packets the proxy sent itself
+	Data      []byte
+}
+
+// Stats are the traffic counters since the proxy was created
+type Stats struct {
+	BytesFromUpstream   uint64
+	PacketsFromUpstream uint64
+	BytesToUpstream     uint64
+	PacketsToUpstream   uint64
+	DroppedPackets      uint64
+	UpstreamReconnects  uint64
+	UpstreamConnected   bool
+	Clients             int
+}
+
+// Proxy is an embedded serial bridge. Create it with New, then call Run or
+// Start. A Proxy cannot be restarted once stopped.
+type Proxy struct {
+	cfg    *config.Config
+	server *core.Server
+
+	mu      sync.Mutex
+	started bool
+	stop    sync.Once
+	stopErr error
+	done    chan struct{} // closed once stopped
+}
+
+// New returns a proxy for the device server at upstream, either host:port
+// or a URL with scheme tcp, ws, wss, quic or rfc2217 (see UPSTREAM_URL in
+// the configuration guide). Settings not given as options have the same
+// defaults as the binary; log lines are discarded unless WithLogOutput is
+// given.
+func New(upstream string, opts ...Option) (*Proxy, error) {
+	o := &options{cfg: config.Default(), logOutput: io.Discard}
+	if err := setUpstream(o.cfg, upstream); err != nil {
+		return nil, err
+	}
+	return newProxy(o, opts)
+}
+
+// NewFromEnv returns a proxy configured like the binary, from
+// /data/options.json and the environment, with opts applied on top
+func NewFromEnv(opts ...Option) (*Proxy, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+	return newProxy(&options{cfg: cfg, logOutput: io.Discard}, opts)
+}
+
+// setUpstream sets the upstream address from host:port or a URL
+func setUpstream(cfg *config.Config, upstream string) error {
+	if strings.Contains(upstream, "://") {
+		cfg.UpstreamURL = upstream
+		return nil
+	}
+	host, port, err := net.SplitHostPort(upstream)
+	if err != nil {
+		return fmt.Errorf("invalid upstream %q: %w", upstream, err)
+	}
+	cfg.UpstreamHost = host
+	cfg.UpstreamPort, err = strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("invalid upstream port %q", port)
+	}
+	return nil
+}
+
+func newProxy(o *options, opts []Option) (*Proxy, error) {
+	for _, opt := range opts {
+		opt(o)
+	}
+	// Packet lines go to the log output only when asked for; the packet
+	// handler gets packets either way
+	o.cfg.LogFile = ""
+	if err := o.cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	log, err := logger.New(o.cfg.LogPackets, "")
+	if err != nil {
+		return nil, err
+	}
+	log.SetOutput(o.logOutput)
+	log.SetPacketFilter(o.cfg.PacketLogFilter())
+	if fn := o.onPacket; fn != nil {
+		log.SetEntryCallback(func(e logger.Entry) {
+			if e.Level != logger.LogPkt {
+				return
+			}
+			direction := FromUpstream
+			if e.Direction == "->UP" {
+				direction = ToUpstream
+			}
+			fn(Packet{Time: e.Time, Direction: direction, Source: e.Source, Data: e.Data})
+		})
+	}
+
+	return &Proxy{
+		cfg:    o.cfg,
+		server: core.NewServer(o.cfg, log),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// Start connects to the upstream and starts accepting clients. The proxy
+// stops when ctx is cancelled or Stop is called. Start returns once the
+// listener is open, after waiting for the upstream if WithWaitForUpstream
+// is set.
+func (p *Proxy) Start(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.started {
+		return ErrStarted
+	}
+	p.started = true
+
+	if err := p.server.Start(ctx); err != nil {
+		_ = p.Stop(context.Background())
+		return err
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = p.Stop(context.Background())
+		case <-p.done:
+		}
+	}()
+	return nil
+}
+
+// Run starts the proxy and blocks until ctx is cancelled or Stop is
+// called, returning once every connection is closed. It returns the error
+// of stopping, if any.
+func (p *Proxy) Run(ctx context.Context) error {
+	if err := p.Start(ctx); err != nil {
+		return err
+	}
+	<-p.done
+	return p.stopErr
+}
+
+// Stop closes the listener, gives connected clients until ctx is done to
+// finish, or five seconds if ctx has no deadline, then disconnects them and
+// the upstream. It returns ctx's error if clients had to be cut off. Later
+// calls return the result of the first.
+func (p *Proxy) Stop(ctx context.Context) error {
+	p.stop.Do(func() {
+		p.stopErr = p.server.Stop(ctx)
+		close(p.done)
+	})
+	<-p.done
+	return p.stopErr
+}
+
+// Done returns a channel closed once the proxy has stopped
+func (p *Proxy) Done() <-chan struct{} {
+	return p.done
+}
+
+// Addr returns the address clients connect to
+func (p *Proxy) Addr() string {
+	return p.cfg.ListenAddr()
+}
+
+// UpstreamConnected reports whether the device server is connected
+func (p *Proxy) UpstreamConnected() bool {
+	return p.server.IsUpstreamConnected()
+}
+
+// Clients returns the number of connected TCP clients
+func (p *Proxy) Clients() int {
+	return p.server.GetTCPClientCount()
+}
+
+// Inject sends data to the device, as if a client had written it, logged
+// with source INJECT
+func (p *Proxy) Inject(data []byte) error {
+	return p.server.InjectPacket("upstream", data)
+}
+
+// Broadcast sends data to every client, as if the device had sent it
+func (p *Proxy) Broadcast(data []byte) error {
+	return p.server.InjectPacket("downstream", data)
+}
+
+// Stats returns the traffic counters
+func (p *Proxy) Stats() Stats {
+	s := p.server.GetMetrics()
+	return Stats{
+		BytesFromUpstream:   s.BytesFromUpstream,
+		PacketsFromUpstream: s.PacketsFromUpstream,
+		BytesToUpstream:     s.BytesToUpstream,
+		PacketsToUpstream:   s.PacketsToUpstream,
+		DroppedPackets:      s.DroppedPackets,
+		UpstreamReconnects:  s.UpstreamReconnects,
+		UpstreamConnected:   s.UpstreamConnected,
+		Clients:             s.Clients,
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/pkg/testutil"
+)
+
+func TestProxy_Run(t *testing.T) {
+	upstream := testutil.NewMockUpstream(t)
+
+	var mu sync.Mutex
+	var packets []Packet
+	p, err := New(upstream.Addr(), WithListenPort(testutil.FreePort(t)), WithPacketHandler(func(pkt Packet) {
+		pkt.Data = append([]byte(nil), pkt.Data...)
+		mu.Lock()
+		packets = append(packets, pkt)
+		mu.Unlock()
+	}))
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ran := make(chan error, 1)
+	go func() { ran <- p.Run(ctx) }()
+
+	upstream.WaitConn()
+	testutil.Eventually(t, p.UpstreamConnected, "proxy did not connect to the mock upstream")
+	client := testutil.Dial(t, p.Addr())
+	testutil.Eventually(t, func() bool { return p.Clients() == 1 }, "proxy did not register the client")
+
+	upstream.Send([]byte{0xf7, 0x01})
+	testutil.ExpectRead(t, client, []byte{0xf7, 0x01})
+	if _, err := client.Write([]byte{0xf7, 0x02}); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	upstream.Expect([]byte{0xf7, 0x02})
+
+	if err := p.Inject([]byte{0xaa}); err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+	upstream.Expect([]byte{0xaa})
+	if err := p.Broadcast([]byte{0xbb}); err != nil {
+		t.Fatalf("Broadcast: %v", err)
+	}
+	testutil.ExpectRead(t, client, []byte{0xbb})
+
+	testutil.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(packets) == 4
+	}, "packet handler did not see every packet")
+	mu.Lock()
+	if packets[0].Direction != FromUpstream || packets[1].Direction != ToUpstream || packets[2].Source != "INJECT" || string(packets[3].Data) != "\xbb" {
+		t.Errorf("Unexpected packets %+v", packets)
+	}
+	mu.Unlock()
+	if s := p.Stats(); s.PacketsFromUpstream != 1 || s.BytesToUpstream != 3 || !s.UpstreamConnected {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+
+	if err := p.Start(ctx); !errors.Is(err, ErrStarted) {
+		t.Errorf("Expected ErrStarted, got %v", err)
+	}
+
+	// Stop gives connected clients a few seconds to finish
+	client.Close()
+	cancel()
+	select {
+	case err := <-ran:
+		if err != nil {
+			t.Errorf("Run returned %v", err)
+		}
+	case <-time.After(testutil.DefaultTimeout):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+	if _, err := net.DialTimeout("tcp", p.Addr(), time.Second); err == nil {
+		t.Error("Expected the listener closed")
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	for _, upstream := range []string{"no-port", "host:port", "ftp://host:21"} {
+		if _, err := New(upstream); err == nil {
+			t.Errorf("%s: expected an error", upstream)
+		}
+	}
+	if _, err := New("127.0.0.1:8899", WithMaxClients(-1)); err == nil {
+		t.Error("Expected an error for negative MaxClients")
+	}
+}
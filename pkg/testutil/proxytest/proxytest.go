@@ -0,0 +1,104 @@
+// Package proxytest starts a proxy connected to a mock upstream for
+// integration tests.
+package proxytest
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/hoon-ch/serial-tcp-proxy/internal/config"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/logger"
+	"github.com/hoon-ch/serial-tcp-proxy/internal/proxy"
+	"github.com/hoon-ch/serial-tcp-proxy/pkg/testutil"
+)
+
+// Option adjusts the proxy configuration before the proxy starts
+type Option func(*config.Config)
+
+// WithMaxClients sets MAX_CLIENTS
+func WithMaxClients(n int) Option {
+	return func(c *config.Config) { c.MaxClients = n }
+}
+
+// WithPacketLog enables packet logging to the given file
+func WithPacketLog(path string) Option {
+	return func(c *config.Config) {
+		c.LogPackets = true
+		c.LogFile = path
+	}
+}
+
+// WithFrameGap sets FRAME_GAP_MS
+func WithFrameGap(ms int) Option {
+	return func(c *config.Config) { c.FrameGapMs = ms }
+}
+
+// WithFairWrites enables fair write scheduling
+func WithFairWrites() Option {
+	return func(c *config.Config) { c.FairWrites = true }
+}
+
+// Fixture is a running proxy whose upstream is a mock
+type Fixture struct {
+	Upstream *testutil.MockUpstream
+	Server   *proxy.Server
+	Config   *config.Config
+	Addr     string // address clients connect to
+}
+
+// Start launches a mock upstream and a proxy connected to it, and waits for
+// the upstream connection. Everything is stopped when the test ends.
+func Start(t testing.TB, opts ...Option) *Fixture {
+	t.Helper()
+	upstream := testutil.NewMockUpstream(t)
+
+	cfg := &config.Config{
+		UpstreamType: config.UpstreamTypeTCP,
+		UpstreamHost: "127.0.0.1",
+		UpstreamPort: upstream.Port(),
+		UpstreamName: "primary",
+		ListenPort:   testutil.FreePort(t),
+		MaxClients:   10,
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	log, err := logger.New(cfg.LogPackets, cfg.LogFile)
+	if err != nil {
+		t.Fatalf("Failed to create logger: %v", err)
+	}
+	log.SetOutput(io.Discard)
+
+	server := proxy.NewServer(cfg, log)
+	if err := server.Start(context.Background()); err != nil {
+		_ = server.Stop(context.Background())
+		t.Fatalf("Failed to start proxy: %v", err)
+	}
+	t.Cleanup(func() { _ = server.Stop(context.Background()) })
+
+	upstream.WaitConn()
+	testutil.Eventually(t, server.IsUpstreamConnected, "proxy did not connect to the mock upstream")
+
+	return &Fixture{
+		Upstream: upstream,
+		Server:   server,
+		Config:   cfg,
+		Addr:     net.JoinHostPort("127.0.0.1", strconv.Itoa(cfg.ListenPort)),
+	}
+}
+
+// Dial connects a client to the proxy and waits until the proxy has
+// registered it
+func (f *Fixture) Dial(t testing.TB) net.Conn {
+	t.Helper()
+	before := f.Server.GetTCPClientCount()
+	conn := testutil.Dial(t, f.Addr)
+	testutil.Eventually(t, func() bool {
+		return f.Server.GetTCPClientCount() > before
+	}, "proxy did not register the client")
+	return conn
+}
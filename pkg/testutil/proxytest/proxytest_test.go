@@ -0,0 +1,40 @@
+package proxytest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hoon-ch/serial-tcp-proxy/pkg/testutil"
+)
+
+func TestFixture_RoundTrip(t *testing.T) {
+	f := Start(t)
+	client := f.Dial(t)
+
+	// Upstream to client
+	f.Upstream.Send([]byte{0xf7, 0x0e, 0x1f, 0x01})
+	testutil.ExpectRead(t, client, []byte{0xf7, 0x0e, 0x1f, 0x01})
+
+	// Client to upstream
+	if _, err := client.Write([]byte{0xf7, 0x12, 0x01}); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	f.Upstream.Expect([]byte{0xf7, 0x12, 0x01})
+}
+
+func TestFixture_Options(t *testing.T) {
+	f := Start(t, WithMaxClients(1))
+	f.Dial(t)
+
+	if f.Config.MaxClients != 1 {
+		t.Errorf("Expected MaxClients 1, got %d", f.Config.MaxClients)
+	}
+
+	// The second client is rejected and closed by the proxy
+	second := testutil.Dial(t, f.Addr)
+	buf := make([]byte, 1)
+	_ = second.SetReadDeadline(time.Now().Add(testutil.DefaultTimeout))
+	if _, err := second.Read(buf); err == nil {
+		t.Error("Expected the second client to be disconnected")
+	}
+}
@@ -0,0 +1,219 @@
+// Package testutil provides scaffolding for integration tests against the
+// proxy: a mock upstream device, free ports and frame helpers. It has no
+// dependencies on the proxy itself, so it can be used from any package.
+package testutil
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DefaultTimeout bounds every blocking helper
+const DefaultTimeout = 2 * time.Second
+
+// FreePort returns a TCP port that was free at the time of the call
+func FreePort(t testing.TB) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to get free port: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	return port
+}
+
+// MockUpstream is a TCP listener standing in for a serial-TCP converter.
+// It records everything its connections receive and can push data to them.
+type MockUpstream struct {
+	t        testing.TB
+	listener net.Listener
+	received chan []byte
+	conns    chan net.Conn
+	mu       sync.Mutex
+	current  net.Conn
+	all      []net.Conn
+}
+
+// NewMockUpstream starts a mock upstream on a random local port. It is
+// closed automatically when the test ends.
+func NewMockUpstream(t testing.TB) *MockUpstream {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start mock upstream: %v", err)
+	}
+	m := &MockUpstream{
+		t:        t,
+		listener: ln,
+		received: make(chan []byte, 256),
+		conns:    make(chan net.Conn, 16),
+	}
+	go m.acceptLoop()
+	t.Cleanup(m.Close)
+	return m
+}
+
+// Addr returns the host:port the mock listens on
+func (m *MockUpstream) Addr() string {
+	return m.listener.Addr().String()
+}
+
+// Port returns the port the mock listens on
+func (m *MockUpstream) Port() int {
+	return m.listener.Addr().(*net.TCPAddr).Port
+}
+
+// Close stops the listener and closes every accepted connection
+func (m *MockUpstream) Close() {
+	m.listener.Close()
+	m.mu.Lock()
+	for _, conn := range m.all {
+		conn.Close()
+	}
+	m.mu.Unlock()
+}
+
+func (m *MockUpstream) acceptLoop() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		m.mu.Lock()
+		m.current = conn
+		m.all = append(m.all, conn)
+		m.mu.Unlock()
+
+		select {
+		case m.conns <- conn:
+		default:
+		}
+		go m.readLoop(conn)
+	}
+}
+
+func (m *MockUpstream) readLoop(conn net.Conn) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case m.received <- append([]byte(nil), buf[:n]...):
+		default:
+		}
+	}
+}
+
+// WaitConn waits for the next connection to the mock
+func (m *MockUpstream) WaitConn() net.Conn {
+	m.t.Helper()
+	select {
+	case conn := <-m.conns:
+		return conn
+	case <-time.After(DefaultTimeout):
+		m.t.Fatal("Timed out waiting for a connection to the mock upstream")
+		return nil
+	}
+}
+
+// Send writes data to the most recent connection
+func (m *MockUpstream) Send(data []byte) {
+	m.t.Helper()
+	m.mu.Lock()
+	conn := m.current
+	m.mu.Unlock()
+	if conn == nil {
+		m.t.Fatal("Mock upstream has no connection")
+	}
+	if _, err := conn.Write(data); err != nil {
+		m.t.Fatalf("Mock upstream write failed: %v", err)
+	}
+}
+
+// Received returns the chunks read by the mock, one per read
+func (m *MockUpstream) Received() <-chan []byte {
+	return m.received
+}
+
+// Expect reads from the mock until it has received exactly the expected
+// bytes, failing the test on a mismatch or timeout
+func (m *MockUpstream) Expect(expected []byte) {
+	m.t.Helper()
+	var got []byte
+	deadline := time.After(DefaultTimeout)
+	for len(got) < len(expected) {
+		select {
+		case data := <-m.received:
+			got = append(got, data...)
+		case <-deadline:
+			m.t.Fatalf("Mock upstream expected %x, got %x before timeout", expected, got)
+		}
+	}
+	if !bytes.Equal(got, expected) {
+		m.t.Fatalf("Mock upstream expected %x, got %x", expected, got)
+	}
+}
+
+// Dial connects a TCP client to addr. The connection is closed when the
+// test ends.
+func Dial(t testing.TB, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, DefaultTimeout)
+	if err != nil {
+		t.Fatalf("Failed to connect to %s: %v", addr, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// ReadFrame performs one read from conn
+func ReadFrame(t testing.TB, conn net.Conn) []byte {
+	t.Helper()
+	buf := make([]byte, 64*1024)
+	_ = conn.SetReadDeadline(time.Now().Add(DefaultTimeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	return buf[:n]
+}
+
+// ExpectRead reads from conn until it has received exactly the expected
+// bytes
+func ExpectRead(t testing.TB, conn net.Conn, expected []byte) {
+	t.Helper()
+	var got []byte
+	buf := make([]byte, 4096)
+	_ = conn.SetReadDeadline(time.Now().Add(DefaultTimeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	for len(got) < len(expected) {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("Expected %x, got %x before error: %v", expected, got, err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("Expected %x, got %x", expected, got)
+	}
+}
+
+// Eventually polls cond until it returns true, failing the test after
+// DefaultTimeout
+func Eventually(t testing.TB, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(DefaultTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out: %s", msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}